@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"time"
 
 	"github.com/danzipie/go-pec/pec"
 )
@@ -35,10 +36,40 @@ func verifyCmd(args []string) {
 		os.Exit(1)
 	}
 
-	err := pec.Verify(*in)
+	result, err := pec.VerifyDetailed(*in)
 	if err != nil {
 		log.Fatal("Verification failed:", err)
 	}
+	printVerification(result)
 
+	if !result.SignatureValid {
+		log.Fatal("Verification failed: ", result.SignatureError)
+	}
 	fmt.Println("Ricevuta is valid.")
 }
+
+// printVerification renders the outcome of each check
+func printVerification(result *pec.VerificationResult) {
+	fmt.Println("Signer:   ", result.SignerSubject)
+	fmt.Println("Issuer:   ", result.SignerIssuer)
+	fmt.Printf("Validity:  %s - %s\n", result.NotBefore.Format(time.RFC3339), result.NotAfter.Format(time.RFC3339))
+	if result.DatiCert != nil {
+		fmt.Println("Tipo:     ", result.DatiCert.Tipo)
+		fmt.Println("Mittente: ", result.DatiCert.Intestazione.Mittente)
+		fmt.Println("Ident.:   ", result.DatiCert.Dati.Identificativo)
+	}
+	fmt.Println("Signature:", checkStatus(result.SignatureValid, result.SignatureError))
+	fmt.Println("Chain:    ", checkStatus(result.ChainValid, result.ChainError))
+	fmt.Println("Time:     ", checkStatus(result.TimeValid, result.TimeError))
+}
+
+// checkStatus describes the outcome of a single check
+func checkStatus(ok bool, reason string) string {
+	if ok {
+		return "OK"
+	}
+	if reason == "" {
+		return "not checked"
+	}
+	return "FAILED (" + reason + ")"
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/danzipie/go-pec/pec-server/internal/common"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Println("Usage: pec-tools <command> [options]")
+		fmt.Println("Commands: envelope, replay")
+		os.Exit(1)
+	}
+
+	switch os.Args[1] {
+	case "envelope":
+		envelopeCmd(os.Args[2:])
+	case "replay":
+		replayCmd(os.Args[2:])
+	default:
+		fmt.Println("Unknown command:", os.Args[1])
+		os.Exit(1)
+	}
+}
+
+// envelopeCmd wraps a plain message in a signed busta di trasporto
+func envelopeCmd(args []string) {
+	fs := flag.NewFlagSet("envelope", flag.ExitOnError)
+	in := fs.String("in", "", "Path to the original .eml")
+	out := fs.String("out", "", "Path of the transport envelope (default stdout)")
+	domain := fs.String("domain", "", "Domain of the sending provider")
+	var cfg common.Config
+	fs.StringVar(&cfg.CertFile, "cert", "", "Path to the PEM certificate of the provider")
+	fs.StringVar(&cfg.KeyFile, "key", "", "Path to the PEM private key of the provider")
+	fs.StringVar(&cfg.P12File, "p12", "", "Path to a PKCS#12 bundle, instead of -cert and -key")
+	fs.StringVar(&cfg.P12Password, "p12-password", "", "Password of the PKCS#12 bundle")
+	fs.Parse(args)
+
+	if *in == "" || *domain == "" || (cfg.P12File == "" && (cfg.CertFile == "" || cfg.KeyFile == "")) {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	original, err := os.ReadFile(*in)
+	if err != nil {
+		log.Fatal("Failed to read message: ", err)
+	}
+	cert, key, chain, err := common.LoadCredentials(&cfg)
+	if err != nil {
+		log.Fatal("Failed to load S/MIME credentials: ", err)
+	}
+	signer := &common.Signer{Cert: cert, Key: key, Chain: chain, Domain: *domain}
+
+	envelope, err := common.BuildTransportEnvelope(original, common.PECCertificationData{}, signer)
+	if err != nil {
+		log.Fatal("Failed to build transport envelope: ", err)
+	}
+	if *out == "" {
+		os.Stdout.Write(envelope)
+		return
+	}
+	if err := os.WriteFile(*out, envelope, 0644); err != nil {
+		log.Fatal("Failed to write transport envelope: ", err)
+	}
+}
+
+// replayCmd lists the dead-letter items of a server, through its admin
+// endpoints, or replays the ones given as arguments
+func replayCmd(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	admin := fs.String("admin", "http://127.0.0.1:8090", "URL of the admin endpoints of the server")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: pec-tools replay [-admin URL] [id ...]")
+		fmt.Fprintln(fs.Output(), "Lists the dead-letter items, or replays the given ones")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	base := strings.TrimSuffix(*admin, "/")
+	client := &http.Client{Timeout: time.Minute}
+
+	if fs.NArg() == 0 {
+		resp, err := client.Get(base + "/dead-letters")
+		if err != nil {
+			log.Fatal("Failed to list dead-letter items: ", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			log.Fatal("Failed to list dead-letter items: ", resp.Status)
+		}
+		var deadLetters []common.DeadLetter
+		if err := json.NewDecoder(resp.Body).Decode(&deadLetters); err != nil {
+			log.Fatal("Failed to decode dead-letter items: ", err)
+		}
+		for _, item := range deadLetters {
+			fmt.Printf("%s\t%s\t%s\t%d attempts\t%s\n", item.ID, item.Kind, item.MessageID, item.Attempts, item.LastError)
+		}
+		return
+	}
+
+	failed := false
+	for _, id := range fs.Args() {
+		resp, err := client.Post(base+"/dead-letters/"+url.PathEscape(id)+"/replay", "", nil)
+		if err != nil {
+			log.Fatal("Failed to replay ", id, ": ", err)
+		}
+		var result common.ReplayResult
+		if resp.StatusCode == http.StatusNotFound {
+			result = common.ReplayResult{ID: id, Outcome: "not found"}
+		} else if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			result = common.ReplayResult{ID: id, Outcome: resp.Status}
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			failed = true
+		}
+		fmt.Printf("%s\t%s\t%s\n", result.ID, result.Outcome, result.Detail)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,23 @@
+package common
+
+import (
+	"time"
+
+	"github.com/danzipie/go-pec/pec"
+)
+
+// NewAcceptanceDatiCert returns the daticert.xml of the ricevuta di
+// accettazione issued by domain at the given time for the message messageID
+// from from, listing the primary recipients in to and the ones in copy in
+// cc. Its identificativo is the ReceiptIdentifier of the message.
+func NewAcceptanceDatiCert(domain, messageID, from string, to, cc []string, subject string, at time.Time) *pec.DatiCert {
+	d := pec.NewDatiCert(pec.TipoAccettazione, pec.ErroreNessuno, ProviderName(domain), at)
+	d.Intestazione.Mittente = from
+	d.AddDestinatari("certificato", to...)
+	d.AddDestinatari("certificato", cc...)
+	d.Intestazione.Risposte = from
+	d.Intestazione.Oggetto = subject
+	d.Dati.Identificativo = ReceiptIdentifier(pec.TipoAccettazione, messageID, domain)
+	d.Dati.MsgID = messageID
+	return d
+}
@@ -0,0 +1,77 @@
+package common
+
+import (
+	"encoding/xml"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/danzipie/go-pec/pec"
+)
+
+// TestNewAcceptanceDatiCert tests the fields of the daticert.xml of an
+// acceptance receipt and its XML encoding
+func TestNewAcceptanceDatiCert(t *testing.T) {
+	at := time.Date(2025, 3, 10, 9, 5, 7, 0, time.FixedZone("CET", 3600))
+	d := NewAcceptanceDatiCert("example.com", "<original@example.com>", "sender@example.com",
+		[]string{"to@example.org"}, []string{"cc@example.org"}, "Fattura & allegati", at)
+
+	if d.Tipo != pec.TipoAccettazione || d.Errore != pec.ErroreNessuno {
+		t.Errorf("Expected tipo accettazione and errore nessuno, got %q and %q", d.Tipo, d.Errore)
+	}
+	if d.Intestazione.Mittente != "sender@example.com" || d.Intestazione.Risposte != "sender@example.com" {
+		t.Errorf("Unexpected mittente and risposte: %+v", d.Intestazione)
+	}
+	want := []pec.Destinatario{{Tipo: "certificato", Val: "to@example.org"}, {Tipo: "certificato", Val: "cc@example.org"}}
+	if !reflect.DeepEqual(d.Intestazione.Destinatari, want) {
+		t.Errorf("Expected destinatari %+v, got %+v", want, d.Intestazione.Destinatari)
+	}
+	if d.Dati.GestoreEmittente != ProviderName("example.com") {
+		t.Errorf("Expected gestore-emittente %q, got %q", ProviderName("example.com"), d.Dati.GestoreEmittente)
+	}
+	if id := ReceiptIdentifier(pec.TipoAccettazione, "<original@example.com>", "example.com"); d.Dati.Identificativo != id {
+		t.Errorf("Expected identificativo %q, got %q", id, d.Dati.Identificativo)
+	}
+	if d.Dati.MsgID != "<original@example.com>" {
+		t.Errorf("Expected msgid <original@example.com>, got %q", d.Dati.MsgID)
+	}
+
+	xmlBytes, err := d.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	for _, element := range []string{
+		`<postacert tipo="accettazione" errore="nessuno">`,
+		`<oggetto>Fattura &amp; allegati</oggetto>`,
+		`<data zona="+0100">`,
+		`<giorno>10/03/2025</giorno>`,
+		`<ora>09:05:07</ora>`,
+		`<msgid>&lt;original@example.com&gt;</msgid>`,
+	} {
+		if !strings.Contains(string(xmlBytes), element) {
+			t.Errorf("Expected XML to contain %s, got\n%s", element, xmlBytes)
+		}
+	}
+}
+
+// TestNewAcceptanceDatiCert_RoundTrip tests that the encoded daticert.xml
+// decodes to the same structure
+func TestNewAcceptanceDatiCert_RoundTrip(t *testing.T) {
+	at := time.Date(2025, 3, 10, 9, 5, 7, 0, time.UTC)
+	d := NewAcceptanceDatiCert("example.com", "<original@example.com>", "sender@example.com",
+		[]string{"to1@example.org", "to2@example.org"}, nil, "Round trip", at)
+
+	xmlBytes, err := d.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	var parsed pec.DatiCert
+	if err := xml.Unmarshal(xmlBytes, &parsed); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	parsed.XMLName = d.XMLName
+	if !reflect.DeepEqual(&parsed, d) {
+		t.Errorf("Expected round trip to give\n%+v\ngot\n%+v", d, &parsed)
+	}
+}
@@ -0,0 +1,62 @@
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/emersion/go-message"
+)
+
+// AttachmentHash identifies an attachment of the original message by its SHA-256 digest
+type AttachmentHash struct {
+	Filename string
+	SHA256   string // hex encoded digest of the decoded content
+}
+
+// HashAttachments walks the MIME tree of original and hashes the content of
+// every attachment, in the order they appear. Parts with an attachment
+// disposition or a filename are considered attachments. HashAttachments
+// consumes the entity.
+func HashAttachments(original *message.Entity) ([]AttachmentHash, error) {
+	var hashes []AttachmentHash
+	err := original.Walk(func(path []int, part *message.Entity, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(mediaType(part), "multipart/") {
+			return nil
+		}
+
+		disposition, params, _ := part.Header.ContentDisposition()
+		filename := params["filename"]
+		if filename == "" {
+			_, ctParams, _ := part.Header.ContentType()
+			filename = ctParams["name"]
+		}
+		if disposition != "attachment" && filename == "" {
+			return nil
+		}
+
+		hash := sha256.New()
+		if _, err := io.Copy(hash, part.Body); err != nil {
+			return fmt.Errorf("failed to read attachment %q: %w", filename, err)
+		}
+		hashes = append(hashes, AttachmentHash{
+			Filename: filename,
+			SHA256:   hex.EncodeToString(hash.Sum(nil)),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return hashes, nil
+}
+
+func mediaType(entity *message.Entity) string {
+	t, _, _ := entity.Header.ContentType()
+	return t
+}
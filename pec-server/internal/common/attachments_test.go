@@ -0,0 +1,85 @@
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message"
+)
+
+func sha256Hex(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+// TestHashAttachments tests that every attachment of a multipart message is hashed
+func TestHashAttachments(t *testing.T) {
+	raw := "From: sender@example.com\r\n" +
+		"To: recipient@example.com\r\n" +
+		"Subject: Attachments\r\n" +
+		"Content-Type: multipart/mixed; boundary=\"outer\"\r\n" +
+		"\r\n" +
+		"--outer\r\n" +
+		"Content-Type: multipart/alternative; boundary=\"inner\"\r\n" +
+		"\r\n" +
+		"--inner\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Body text\r\n" +
+		"--inner\r\n" +
+		"Content-Type: text/html\r\n" +
+		"\r\n" +
+		"<p>Body text</p>\r\n" +
+		"--inner--\r\n" +
+		"--outer\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"Content-Disposition: attachment; filename=\"notes.txt\"\r\n" +
+		"\r\n" +
+		"first attachment\r\n" +
+		"--outer\r\n" +
+		"Content-Type: application/octet-stream; name=\"data.bin\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"c2Vjb25kIGF0dGFjaG1lbnQ=\r\n" +
+		"--outer--\r\n"
+
+	entity, err := message.Read(strings.NewReader(raw))
+	if err != nil {
+		t.Fatalf("Failed to parse message: %v", err)
+	}
+
+	hashes, err := HashAttachments(entity)
+	if err != nil {
+		t.Fatalf("HashAttachments failed: %v", err)
+	}
+
+	expected := []AttachmentHash{
+		{Filename: "notes.txt", SHA256: sha256Hex("first attachment")},
+		{Filename: "data.bin", SHA256: sha256Hex("second attachment")},
+	}
+	if len(hashes) != len(expected) {
+		t.Fatalf("Expected %d attachment hashes, got %d: %+v", len(expected), len(hashes), hashes)
+	}
+	for i := range expected {
+		if hashes[i] != expected[i] {
+			t.Errorf("Expected attachment %d to be %+v, got %+v", i, expected[i], hashes[i])
+		}
+	}
+}
+
+// TestHashAttachments_NoAttachments tests that a plain message has no attachment hashes
+func TestHashAttachments_NoAttachments(t *testing.T) {
+	entity, err := message.Read(strings.NewReader("Subject: plain\r\nContent-Type: text/plain\r\n\r\nHello\r\n"))
+	if err != nil {
+		t.Fatalf("Failed to parse message: %v", err)
+	}
+	hashes, err := HashAttachments(entity)
+	if err != nil {
+		t.Fatalf("HashAttachments failed: %v", err)
+	}
+	if len(hashes) != 0 {
+		t.Errorf("Expected no attachment hashes, got %+v", hashes)
+	}
+}
@@ -0,0 +1,33 @@
+package common
+
+import (
+	"context"
+	"net"
+)
+
+// AuthResult is the outcome of a DKIM or SPF check, using the
+// Authentication-Results vocabulary (RFC 8601)
+type AuthResult string
+
+const (
+	AuthNone      AuthResult = "none"
+	AuthPass      AuthResult = "pass"
+	AuthFail      AuthResult = "fail"
+	AuthSoftFail  AuthResult = "softfail"
+	AuthNeutral   AuthResult = "neutral"
+	AuthTempError AuthResult = "temperror"
+	AuthPermError AuthResult = "permerror"
+)
+
+// DNSResolver is the subset of net.Resolver used by the DKIM and SPF checks
+type DNSResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupIP(ctx context.Context, network, host string) ([]net.IP, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+}
+
+// isTemporaryDNSError reports whether a lookup failure may succeed later
+func isTemporaryDNSError(err error) bool {
+	dnsErr, ok := err.(*net.DNSError)
+	return ok && !dnsErr.IsNotFound
+}
@@ -3,15 +3,16 @@ package common
 import (
 	"bytes"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
 	"fmt"
-	"os"
 	"strings"
 	"time"
 
-	"github.com/danzipie/go-pec/pec"
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-message"
 	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-message/textproto"
 )
 
 // ParseEmailMessage parses a raw email message and returns a *mail.Reader.
@@ -30,43 +31,66 @@ func ParseEmailMessage(rawMessage []byte) (*mail.Reader, error) {
 	return msgReader, nil
 }
 
-// ExtractRecipients extracts and cleans recipient addresses from To and Cc headers
+// ExtractRecipients extracts and cleans recipient addresses from To and Cc
+// headers, the To recipients first
 func ExtractRecipients(headers *mail.Header) []string {
+	to, cc := SplitRecipients(headers)
+	return append(to, cc...)
+}
+
+// SplitRecipients extracts and cleans the primary recipients from the To
+// header and the recipients in copy from the Cc header
+func SplitRecipients(headers *mail.Header) (to, cc []string) {
+	return parseRecipients(headers.Get("To")), parseRecipients(headers.Get("Cc"))
+}
+
+// parseRecipients returns the addresses of an address list header value
+func parseRecipients(value string) []string {
 	recipients := []string{}
+	if value == "" {
+		return recipients
+	}
 
-	// Extract from To header
-	if to := headers.Get("To"); to != "" {
-		toAddrs, err := mail.ParseAddressList(to)
-		if err == nil {
-			for _, addr := range toAddrs {
-				recipients = append(recipients, addr.Address)
-			}
-		} else {
-			// Fallback to simple splitting if parsing fails
-			toAddrs := strings.Split(to, ",")
-			for _, addr := range toAddrs {
-				recipients = append(recipients, strings.TrimSpace(addr))
-			}
+	addrs, err := mail.ParseAddressList(value)
+	if err == nil {
+		for _, addr := range addrs {
+			recipients = append(recipients, addr.Address)
+		}
+	} else {
+		// Fallback to simple splitting if parsing fails
+		for _, addr := range strings.Split(value, ",") {
+			recipients = append(recipients, strings.TrimSpace(addr))
 		}
 	}
+	return recipients
+}
 
-	// Extract from Cc header
-	if cc := headers.Get("Cc"); cc != "" {
-		ccAddrs, err := mail.ParseAddressList(cc)
-		if err == nil {
-			for _, addr := range ccAddrs {
-				recipients = append(recipients, addr.Address)
-			}
-		} else {
-			// Fallback to simple splitting if parsing fails
-			ccAddrs := strings.Split(cc, ",")
-			for _, addr := range ccAddrs {
-				recipients = append(recipients, strings.TrimSpace(addr))
-			}
-		}
+// OriginalMessageID returns the Message-ID of the user message a PEC artifact
+// refers to. The correlation rules are:
+//   - the transport envelope keeps the user's Message-ID and also carries it
+//     in X-Riferimento-Message-ID;
+//   - every receipt, notice and anomaly envelope sets X-Riferimento-Message-ID
+//     to the user's Message-ID, never to the Message-ID of the artifact it
+//     answers.
+//
+// So the reference, when present, wins over the artifact's own Message-ID.
+func OriginalMessageID(header interface{ Get(key string) string }) string {
+	if ref := header.Get("X-Riferimento-Message-ID"); ref != "" {
+		return ref
 	}
+	return header.Get("Message-ID")
+}
 
-	return recipients
+// SetReferenceHeaders makes a receipt refer to the user message messageID:
+// X-Riferimento-Message-ID as required by PEC, In-Reply-To and References so
+// that mail clients thread the receipt with the sent message.
+func SetReferenceHeaders(header interface{ Set(key, value string) }, messageID string) {
+	header.Set("X-Riferimento-Message-ID", messageID)
+	if messageID == "" {
+		return
+	}
+	header.Set("In-Reply-To", messageID)
+	header.Set("References", messageID)
 }
 
 // Helper function to convert message.Entity to imap.Message
@@ -89,30 +113,61 @@ func ConvertToIMAPMessage(entity *message.Entity) *imap.Message {
 	var buf bytes.Buffer
 	entity.WriteTo(&buf)
 	msg.Size = uint32(buf.Len())
+	msg.Body[&imap.BodySectionName{}] = bytes.NewReader(buf.Bytes())
 
 	return msg
 }
 
 // IsSignatureValid checks if the S/MIME signature of the message is valid.
-// It writes the body to a temporary file and calls verifySMIMEWithOpenSSL.
+// body is the raw message body, as received in the session; the signed part
+// is taken from it byte for byte and verified in memory.
 func IsSignatureValid(header *mail.Header, body []byte) bool {
-	// Write body to a temporary file
-	tmpFile, err := os.CreateTemp("", "pec-smime-*.eml")
+	_, err := VerifySignature(header, body)
+	return err == nil
+}
+
+// VerifySignature verifies the S/MIME signature of a message split into its
+// header and raw body, and returns the signing certificate
+func VerifySignature(header *mail.Header, body []byte) (*x509.Certificate, error) {
+	raw, err := RawMessage(header, body)
 	if err != nil {
-		return false
+		return nil, err
 	}
-	defer os.Remove(tmpFile.Name())
-	if _, err := tmpFile.Write(body); err != nil {
-		tmpFile.Close()
-		return false
+	return VerifySignedMessage(raw)
+}
+
+// VerifySignatureChain is VerifySignature, also returning the other
+// certificates embedded in the signature
+func VerifySignatureChain(header *mail.Header, body []byte) (*x509.Certificate, []*x509.Certificate, error) {
+	raw, err := RawMessage(header, body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return VerifySignedMessageChain(raw)
+}
+
+// RawMessage joins a message split into its header and raw body back into
+// the raw message, with CRLF line endings
+func RawMessage(header *mail.Header, body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := textproto.WriteHeader(&buf, header.Header.Header); err != nil {
+		return nil, fmt.Errorf("failed to write header: %v", err)
 	}
-	tmpFile.Close()
+	buf.Write(toCRLF(body))
+	return buf.Bytes(), nil
+}
 
-	// Use your OpenSSL-based verifier
-	if err := pec.VerifySMIMEWithOpenSSL(tmpFile.Name()); err != nil {
-		return false
+// RawBody returns the body of a raw message, without decoding it
+func RawBody(data []byte) []byte {
+	crlf := bytes.Index(data, []byte("\r\n\r\n"))
+	lf := bytes.Index(data, []byte("\n\n"))
+	switch {
+	case crlf >= 0 && (lf < 0 || crlf < lf):
+		return data[crlf+4:]
+	case lf >= 0:
+		return data[lf+2:]
 	}
-	return true
+	return nil
 }
 
 // generateMessageID generates a unique message ID
@@ -124,6 +179,32 @@ func GenerateMessageID(domain string) string {
 	return fmt.Sprintf("<%x.%d@%s>", b, time.Now().Unix(), domain)
 }
 
+// ReceiptIdentifier returns the identificativo of the receipt of the given
+// tipo issued by domain for the message messageID. It is derived from its
+// inputs, so that a message processed again gets the same receipt; a
+// message without Message-ID gets a random one. The qualifiers tell apart
+// the receipts of the same tipo, such as the delivery receipt of each
+// recipient.
+func ReceiptIdentifier(tipo, messageID, domain string, qualifiers ...string) string {
+	messageID = strings.TrimSpace(messageID)
+	if messageID == "" {
+		b := make([]byte, 16)
+		rand.Read(b)
+		return fmt.Sprintf("opec%x@%s", b, domain)
+	}
+	hash := sha256.New()
+	for _, part := range append([]string{tipo, messageID, strings.ToLower(domain)}, qualifiers...) {
+		hash.Write([]byte(part))
+		hash.Write([]byte{0})
+	}
+	return fmt.Sprintf("opec%x@%s", hash.Sum(nil)[:16], domain)
+}
+
+// ProviderName returns the gestore-emittente reported in daticert.xml for domain
+func ProviderName(domain string) string {
+	return fmt.Sprintf("%s PEC S.p.A.", strings.ToUpper(domain))
+}
+
 // IsTransportEnvelope checks if the message is a PEC transport envelope
 func IsTransportEnvelope(msg *message.Entity) bool {
 	header := msg.Header
@@ -0,0 +1,69 @@
+package common
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/emersion/go-message/mail"
+)
+
+// splitSignedTestMessage signs content and returns the header and raw body of the result
+func splitSignedTestMessage(t *testing.T, content string) (*mail.Header, []byte) {
+	t.Helper()
+	cert, key := createTestCertAndKey(t)
+	signer := &Signer{Cert: cert, Key: key, Domain: "example.com"}
+
+	signed, err := signer.CreateSignedMimeMessage([]byte(content))
+	if err != nil {
+		t.Fatalf("Failed to sign message: %v", err)
+	}
+	mr, err := mail.CreateReader(bytes.NewReader(signed))
+	if err != nil {
+		t.Fatalf("Failed to parse signed message: %v", err)
+	}
+	return &mr.Header, RawBody(signed)
+}
+
+// TestIsSignatureValid tests the in-memory verification of valid and tampered bodies
+func TestIsSignatureValid(t *testing.T) {
+	content := "Content-Type: text/plain\r\n\r\nHello from the sender provider\r\n"
+	header, body := splitSignedTestMessage(t, content)
+
+	tests := []struct {
+		name string
+		body []byte
+		want bool
+	}{
+		{"valid body", body, true},
+		{"LF line endings", bytes.ReplaceAll(body, []byte("\r\n"), []byte("\n")), true},
+		{"tampered body", bytes.Replace(body, []byte("Hello"), []byte("Howdy"), 1), false},
+		{"missing signature", []byte(content), false},
+		{"empty body", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsSignatureValid(header, tt.body); got != tt.want {
+				t.Errorf("Expected IsSignatureValid to return %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+// TestRawBody tests that the body is split at the first blank line
+func TestRawBody(t *testing.T) {
+	tests := []struct {
+		data string
+		want string
+	}{
+		{"Subject: a\r\n\r\nbody\r\n\r\nmore", "body\r\n\r\nmore"},
+		{"Subject: a\n\nbody\r\n\r\nmore", "body\r\n\r\nmore"},
+		{"Subject: a\r\n", ""},
+	}
+
+	for _, tt := range tests {
+		if got := string(RawBody([]byte(tt.data))); got != tt.want {
+			t.Errorf("RawBody(%q) = %q, expected %q", tt.data, got, tt.want)
+		}
+	}
+}
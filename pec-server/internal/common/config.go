@@ -6,12 +6,208 @@ import (
 )
 
 type Config struct {
-	Domain     string `json:"domain"`
-	SMTPServer string `json:"smtp_server"`
-	IMAPServer string `json:"imap_server"`
-	CertFile   string `json:"cert_file"`
-	KeyFile    string `json:"key_file"`
-	APIServer  string `json:"api_server"`
+	Domain      string `json:"domain"`
+	SMTPServer  string `json:"smtp_server"`
+	IMAPServer  string `json:"imap_server"`
+	CertFile    string `json:"cert_file"`
+	KeyFile     string `json:"key_file"`
+	APIServer   string `json:"api_server"`
+	JournalFile string `json:"journal_file"`
+
+	// PKCS#12 bundle used instead of CertFile/KeyFile when set
+	P12File     string `json:"p12_file"`
+	P12Password string `json:"p12_password"`
+
+	// Passphrase of an encrypted KeyFile; PEC_KEY_PASSPHRASE is used when empty
+	KeyPassphrase string `json:"key_passphrase"`
+
+	// Warn when the S/MIME certificate expires within this many days (default 30)
+	CertExpiryWarningDays int `json:"cert_expiry_warning_days"`
+	// How often the credential files are checked for changes (default 60)
+	CertReloadIntervalSeconds int `json:"cert_reload_interval_seconds"`
+
+	// TLS certificate of the listeners, reloaded on SIGHUP or when the files
+	// change; the S/MIME credentials are served when empty
+	TLSCertFile string `json:"tls_cert_file"`
+	TLSKeyFile  string `json:"tls_key_file"`
+
+	// CA certificates of the providers allowed to connect with mutual TLS;
+	// client certificates are not requested when empty
+	ClientCAFile string `json:"client_ca_file"`
+
+	// Allow SMTP authentication without STARTTLS; credentials travel in
+	// cleartext, so this is only meant for local testing
+	AllowInsecureAuth bool `json:"allow_insecure_auth"`
+
+	// CIDR ranges of provider peers allowed to relay to the reception point;
+	// only peers presenting a verified client certificate may when empty
+	TrustedNetworks []string `json:"trusted_networks"`
+
+	// Listen address of the submission port (587), where users hand their
+	// messages to the access point after authenticating; SMTPServer is used
+	// when empty
+	SubmissionServer string `json:"submission_server"`
+
+	// Listen address of the relay port (25), where providers deliver
+	// transport envelopes to the reception point; SMTPServer is used when
+	// empty
+	RelayServer string `json:"relay_server"`
+
+	// Forwarding from the reception point to the delivery point
+	DeliveryPointURL      string `json:"delivery_point_url"`
+	ForwardMaxAttempts    int    `json:"forward_max_attempts"`
+	ForwardTimeoutSeconds int    `json:"forward_timeout_seconds"`
+
+	// Directory of the durable outbound queue; receipts and forwards are
+	// sent inline when empty
+	QueueDir string `json:"queue_dir"`
+
+	// Directory where the access point persists the accepted messages until
+	// they are processed, to process them again after a crash; disabled
+	// when empty
+	WriteAheadDir string `json:"write_ahead_dir"`
+
+	// DKIM signing of outbound messages; disabled when no key is configured
+	DKIMSelector string   `json:"dkim_selector"`
+	DKIMKeyFile  string   `json:"dkim_key_file"`
+	DKIMHeaders  []string `json:"dkim_headers"`
+
+	// DKIM/SPF verification of incoming messages at the reception point
+	VerifyDKIM bool `json:"verify_dkim"`
+	VerifySPF  bool `json:"verify_spf"`
+
+	// Revocation checking, over OCSP and CRLs, of the provider certificates
+	// signing the envelopes and receipts at the reception point. A
+	// certificate whose status cannot be determined is accepted unless
+	// RevocationFailClosed; responses without a next update are cached for
+	// RevocationCacheTTLSeconds (default 3600)
+	CheckRevocation           bool `json:"check_revocation"`
+	RevocationFailClosed      bool `json:"revocation_fail_closed"`
+	RevocationCacheTTLSeconds int  `json:"revocation_cache_ttl_seconds"`
+
+	// JSON file listing the PEC providers, used to address receipts and to
+	// trust the certificates signing the envelopes when no database registry
+	// is injected
+	AuthorityRegistryFile string `json:"authority_registry_file"`
+
+	// PEM file of the CAs the provider certificates must chain to; the
+	// system roots are used when empty
+	ProviderRootsFile string `json:"provider_roots_file"`
+
+	// Lookups in the authority registry are cached for this long; not cached
+	// when zero
+	AuthorityCacheTTLSeconds int `json:"authority_cache_ttl_seconds"`
+
+	// Address of a clamd daemon scanning messages at the access point;
+	// messages are not scanned when empty
+	ClamAVServer string `json:"clamav_server"`
+
+	// Messages with a Message-ID seen within this window are accepted only
+	// once (default 86400), remembering at most DuplicateCacheSize of them
+	DuplicateWindowSeconds int `json:"duplicate_window_seconds"`
+	DuplicateCacheSize     int `json:"duplicate_cache_size"`
+
+	// Reject messages whose Date, Message-ID, From, To or Subject fields are
+	// missing or malformed, beyond the checks always made at acceptance
+	StrictHeaders bool `json:"strict_headers"`
+
+	// Messages addressed to more recipients, counting the To and Cc fields,
+	// are refused at the access point (default 500)
+	MaxRecipients int `json:"max_recipients"`
+
+	// Recipients of a message the delivery point delivers to at the same
+	// time (default 4); the receipts are still sent in the order of the
+	// recipients
+	DeliveryWorkers int `json:"delivery_workers"`
+
+	// SMTP address of the reception point the access point relays transport
+	// envelopes to; messages are refused while it is not configured
+	ReceptionPointSMTP string `json:"reception_point_smtp"`
+
+	// Locale of the human-readable receipt bodies (default "it") and a
+	// directory of <locale>/<kind>.txt and .html templates overriding the
+	// embedded ones
+	ReceiptLocale       string `json:"receipt_locale"`
+	ReceiptTemplatesDir string `json:"receipt_templates_dir"`
+
+	// S/MIME structure the receipts are signed into: "detached" (default),
+	// a multipart/signed message, or "opaque", an application/pkcs7-mime
+	// one, for the clients expecting it
+	ReceiptSigningMode string `json:"receipt_signing_mode"`
+
+	// IANA name of the zone the dates of the receipts and envelopes are
+	// given in (default "Europe/Rome")
+	Timezone string `json:"timezone"`
+
+	// Display names of the From field of the receipts and notices (none by
+	// default) and of the envelopes sent on behalf of a sender (default "Per
+	// conto di: {sender}"), where {domain} stands for Domain and {sender} for
+	// the original sender
+	ProviderDisplayName string `json:"provider_display_name"`
+	OnBehalfDisplayName string `json:"on_behalf_display_name"`
+
+	// Host name announced in the SMTP and IMAP greetings (default Domain)
+	ServerName string `json:"server_name"`
+
+	// Text of the greetings following the server name; the servers'
+	// own text is used when empty
+	SMTPGreeting string `json:"smtp_greeting"`
+	IMAPGreeting string `json:"imap_greeting"`
+
+	// Longest line the SMTP servers accept, in the commands and in the
+	// message data (default 65536); a negative value removes the limit
+	SMTPMaxLineLength int `json:"smtp_max_line_length"`
+
+	// Listen address of the /healthz and /readyz endpoints; disabled when empty
+	HealthServer string `json:"health_server"`
+
+	// Listen address of the /metrics endpoint; disabled when empty
+	MetricsServer string `json:"metrics_server"`
+
+	// Listen address of the endpoints listing and replaying the dead-letter
+	// items of the outbound queue; they are not authenticated, so bind it
+	// to a private interface. Disabled when empty
+	AdminServer string `json:"admin_server"`
+
+	// URL posted a JSON notification of each event of the lifecycle of the
+	// messages, or of WebhookEvents only when set; the payload is signed
+	// with an HMAC-SHA256 keyed with WebhookSecret. Disabled when empty
+	WebhookURL    string   `json:"webhook_url"`
+	WebhookSecret string   `json:"webhook_secret"`
+	WebhookEvents []string `json:"webhook_events"`
+
+	// Backend of the mailboxes: "memory" (default), "maildir" or "postgres".
+	// StoreDSN is the root directory of the maildirs, or the connection
+	// string of the PostgreSQL database
+	StoreType string `json:"store_type"`
+	StoreDSN  string `json:"store_dsn"`
+
+	// Mask the addresses and omit the message contents in the logs
+	RedactLogs bool `json:"redact_logs"`
+}
+
+// Hostname returns the host name the servers announce themselves as
+func (c *Config) Hostname() string {
+	if c.ServerName != "" {
+		return c.ServerName
+	}
+	return c.Domain
+}
+
+// SubmissionAddress returns the listen address of the submission port
+func (c *Config) SubmissionAddress() string {
+	if c.SubmissionServer != "" {
+		return c.SubmissionServer
+	}
+	return c.SMTPServer
+}
+
+// RelayAddress returns the listen address of the relay port
+func (c *Config) RelayAddress() string {
+	if c.RelayServer != "" {
+		return c.RelayServer
+	}
+	return c.SMTPServer
 }
 
 func LoadConfig(path string) (*Config, error) {
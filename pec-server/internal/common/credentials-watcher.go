@@ -0,0 +1,187 @@
+package common
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/danzipie/go-pec/pec-server/logger"
+)
+
+const (
+	defaultCertExpiryWarning  = 30 * 24 * time.Hour
+	defaultCertReloadInterval = time.Minute
+)
+
+var (
+	// ErrCertificateExpired is returned for a certificate past its NotAfter date
+	ErrCertificateExpired = errors.New("certificate has expired")
+	// ErrCertificateExpiring is returned for a certificate expiring within the warning window
+	ErrCertificateExpiring = errors.New("certificate is about to expire")
+)
+
+// CheckCertificateExpiry reports whether cert is expired, or expires within
+// window, at time now
+func CheckCertificateExpiry(cert *x509.Certificate, window time.Duration, now time.Time) error {
+	if now.After(cert.NotAfter) {
+		return fmt.Errorf("%w on %s", ErrCertificateExpired, cert.NotAfter.Format(time.RFC3339))
+	}
+	if now.Add(window).After(cert.NotAfter) {
+		return fmt.Errorf("%w on %s", ErrCertificateExpiring, cert.NotAfter.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// LogCertificateExpiry logs a warning if cert expires within window and an
+// error if it has already expired
+func LogCertificateExpiry(cert *x509.Certificate, window time.Duration) error {
+	err := CheckCertificateExpiry(cert, window, time.Now())
+	ctx := map[string]string{
+		"subject":   cert.Subject.String(),
+		"not_after": cert.NotAfter.Format(time.RFC3339),
+	}
+	switch {
+	case errors.Is(err, ErrCertificateExpired):
+		logger.LogError("S/MIME certificate has expired, receipts will not validate", err, ctx)
+	case errors.Is(err, ErrCertificateExpiring):
+		ctx["days_left"] = strconv.Itoa(int(time.Until(cert.NotAfter).Hours() / 24))
+		logger.LogWarn("S/MIME certificate is about to expire", ctx)
+	}
+	return err
+}
+
+// CredentialsWatcher re-reads the configured S/MIME credentials when their
+// files change on disk and swaps them into the Signer
+type CredentialsWatcher struct {
+	Interval     time.Duration
+	ExpiryWindow time.Duration
+
+	cfg      *Config
+	signer   *Signer
+	modTimes map[string]time.Time
+
+	mu   sync.Mutex
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewCredentialsWatcher creates a watcher for the credential files of cfg
+func NewCredentialsWatcher(cfg *Config, signer *Signer) *CredentialsWatcher {
+	w := &CredentialsWatcher{
+		Interval:     defaultCertReloadInterval,
+		ExpiryWindow: defaultCertExpiryWarning,
+		cfg:          cfg,
+		signer:       signer,
+	}
+	if cfg.CertReloadIntervalSeconds > 0 {
+		w.Interval = time.Duration(cfg.CertReloadIntervalSeconds) * time.Second
+	}
+	if cfg.CertExpiryWarningDays > 0 {
+		w.ExpiryWindow = time.Duration(cfg.CertExpiryWarningDays) * 24 * time.Hour
+	}
+	w.modTimes = w.statFiles()
+	return w
+}
+
+// CheckExpiry logs the expiry state of the current certificate
+func (w *CredentialsWatcher) CheckExpiry() error {
+	cert, _, _ := w.signer.Credentials()
+	if cert == nil {
+		return nil
+	}
+	return LogCertificateExpiry(cert, w.ExpiryWindow)
+}
+
+// files returns the credential files being watched
+func (w *CredentialsWatcher) files() []string {
+	if w.cfg.P12File != "" {
+		return []string{w.cfg.P12File}
+	}
+	return []string{w.cfg.CertFile, w.cfg.KeyFile}
+}
+
+// statFiles returns the modification time of each credential file
+func (w *CredentialsWatcher) statFiles() map[string]time.Time {
+	modTimes := make(map[string]time.Time)
+	for _, path := range w.files() {
+		if info, err := os.Stat(path); err == nil {
+			modTimes[path] = info.ModTime()
+		}
+	}
+	return modTimes
+}
+
+// Reload re-reads the credentials if any of the files changed since the
+// last check, and reports whether the signer was updated
+func (w *CredentialsWatcher) Reload() (bool, error) {
+	modTimes := w.statFiles()
+	changed := false
+	for _, path := range w.files() {
+		if !modTimes[path].Equal(w.modTimes[path]) {
+			changed = true
+		}
+	}
+	if !changed {
+		return false, nil
+	}
+
+	cert, key, chain, err := LoadCredentials(w.cfg)
+	if err != nil {
+		// Keep the current credentials; the files may be halfway through an update
+		return false, fmt.Errorf("failed to reload S/MIME credentials: %w", err)
+	}
+	w.modTimes = modTimes
+	w.signer.Update(cert, key, chain)
+
+	logger.LogInfo("Reloaded S/MIME credentials", map[string]string{
+		"subject":   cert.Subject.String(),
+		"not_after": cert.NotAfter.Format(time.RFC3339),
+	})
+	w.CheckExpiry()
+	return true, nil
+}
+
+// Start runs the watcher in the background until Stop is called
+func (w *CredentialsWatcher) Start() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.stop != nil {
+		return
+	}
+	w.stop = make(chan struct{})
+	w.done = make(chan struct{})
+
+	go func(stop, done chan struct{}) {
+		defer close(done)
+		ticker := time.NewTicker(w.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if _, err := w.Reload(); err != nil {
+					logger.LogError("Credentials watcher failed", err, nil)
+				}
+			}
+		}
+	}(w.stop, w.done)
+}
+
+// Stop halts the watcher and waits for the current check to complete
+func (w *CredentialsWatcher) Stop() {
+	w.mu.Lock()
+	stop, done := w.stop, w.done
+	w.stop, w.done = nil, nil
+	w.mu.Unlock()
+
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+}
@@ -0,0 +1,179 @@
+package common
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCredentials writes a self-signed certificate expiring at notAfter, and its key, as PEM files
+func writeTestCredentials(t *testing.T, certPath, keyPath, commonName string, notAfter time.Time) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := os.WriteFile(certPath, certPEM, 0600); err != nil {
+		t.Fatalf("Failed to write certificate: %v", err)
+	}
+	if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+}
+
+// TestCheckCertificateExpiry tests the classification of valid, expiring and expired certificates
+func TestCheckCertificateExpiry(t *testing.T) {
+	now := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	window := 30 * 24 * time.Hour
+
+	tests := []struct {
+		name     string
+		notAfter time.Time
+		wantErr  error
+	}{
+		{"valid", now.AddDate(1, 0, 0), nil},
+		{"expiring within the window", now.AddDate(0, 0, 10), ErrCertificateExpiring},
+		{"expiring just after the window", now.AddDate(0, 0, 31), nil},
+		{"expired", now.AddDate(0, 0, -1), ErrCertificateExpired},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cert := &x509.Certificate{NotAfter: tt.notAfter}
+			err := CheckCertificateExpiry(cert, window, now)
+			if tt.wantErr == nil && err != nil {
+				t.Errorf("Expected no error, got %v", err)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("Expected %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+// TestCredentialsWatcher_Reload tests that changed files are swapped into the signer
+func TestCredentialsWatcher_Reload(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &Config{CertFile: filepath.Join(dir, "cert.pem"), KeyFile: filepath.Join(dir, "key.pem")}
+	writeTestCredentials(t, cfg.CertFile, cfg.KeyFile, "old", time.Now().AddDate(0, 0, 5))
+
+	cert, key, chain, err := LoadCredentials(cfg)
+	if err != nil {
+		t.Fatalf("LoadCredentials failed: %v", err)
+	}
+	signer := &Signer{Cert: cert, Key: key, Chain: chain}
+	watcher := NewCredentialsWatcher(cfg, signer)
+
+	if err := watcher.CheckExpiry(); !errors.Is(err, ErrCertificateExpiring) {
+		t.Errorf("Expected the old certificate to be reported as expiring, got %v", err)
+	}
+
+	if reloaded, err := watcher.Reload(); reloaded || err != nil {
+		t.Fatalf("Expected no reload without changes, got %v, %v", reloaded, err)
+	}
+
+	// Renew the certificate; the modification time is bumped explicitly, as
+	// the file system may not tell apart writes within the same tick
+	writeTestCredentials(t, cfg.CertFile, cfg.KeyFile, "renewed", time.Now().AddDate(1, 0, 0))
+	later := time.Now().Add(time.Minute)
+	for _, path := range []string{cfg.CertFile, cfg.KeyFile} {
+		if err := os.Chtimes(path, later, later); err != nil {
+			t.Fatalf("Failed to touch %s: %v", path, err)
+		}
+	}
+
+	reloaded, err := watcher.Reload()
+	if err != nil || !reloaded {
+		t.Fatalf("Expected the credentials to be reloaded, got %v, %v", reloaded, err)
+	}
+	current, _, _ := signer.Credentials()
+	if current.Subject.CommonName != "renewed" {
+		t.Errorf("Expected the renewed certificate, got %s", current.Subject.CommonName)
+	}
+	if _, err := signer.SignEmail([]byte("Subject: test\r\n\r\nHello\r\n")); err != nil {
+		t.Errorf("Expected the renewed credentials to sign, got %v", err)
+	}
+	if err := watcher.CheckExpiry(); err != nil {
+		t.Errorf("Expected the renewed certificate to be valid, got %v", err)
+	}
+}
+
+// TestCredentialsWatcher_KeepsCredentialsOnError tests that broken files do not replace working credentials
+func TestCredentialsWatcher_KeepsCredentialsOnError(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &Config{CertFile: filepath.Join(dir, "cert.pem"), KeyFile: filepath.Join(dir, "key.pem")}
+	writeTestCredentials(t, cfg.CertFile, cfg.KeyFile, "current", time.Now().AddDate(1, 0, 0))
+
+	cert, key, chain, err := LoadCredentials(cfg)
+	if err != nil {
+		t.Fatalf("LoadCredentials failed: %v", err)
+	}
+	signer := &Signer{Cert: cert, Key: key, Chain: chain}
+	watcher := NewCredentialsWatcher(cfg, signer)
+
+	if err := os.WriteFile(cfg.KeyFile, []byte("not a key"), 0600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(cfg.KeyFile, later, later)
+
+	if reloaded, err := watcher.Reload(); reloaded || err == nil {
+		t.Fatalf("Expected the reload to fail, got %v, %v", reloaded, err)
+	}
+	if current, _, _ := signer.Credentials(); current != cert {
+		t.Errorf("Expected the current credentials to be kept")
+	}
+}
+
+// TestCredentialsWatcher_Start tests that the background worker picks up renewed files
+func TestCredentialsWatcher_Start(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &Config{CertFile: filepath.Join(dir, "cert.pem"), KeyFile: filepath.Join(dir, "key.pem")}
+	writeTestCredentials(t, cfg.CertFile, cfg.KeyFile, "old", time.Now().AddDate(1, 0, 0))
+
+	cert, key, chain, err := LoadCredentials(cfg)
+	if err != nil {
+		t.Fatalf("LoadCredentials failed: %v", err)
+	}
+	signer := &Signer{Cert: cert, Key: key, Chain: chain}
+	watcher := NewCredentialsWatcher(cfg, signer)
+	watcher.Interval = 10 * time.Millisecond
+	watcher.Start()
+	defer watcher.Stop()
+
+	writeTestCredentials(t, cfg.CertFile, cfg.KeyFile, "renewed", time.Now().AddDate(1, 0, 0))
+	later := time.Now().Add(time.Minute)
+	for _, path := range []string{cfg.CertFile, cfg.KeyFile} {
+		os.Chtimes(path, later, later)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if current, _, _ := signer.Credentials(); current.Subject.CommonName == "renewed" {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Expected the watcher to reload the renewed certificate")
+}
@@ -0,0 +1,144 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	pec_storage "github.com/danzipie/go-pec/pec-server/internal/storage"
+	"github.com/danzipie/go-pec/pec-server/logger"
+)
+
+// DeadLetter describes an item of the dead-letter directory, without its data
+type DeadLetter struct {
+	ID         string       `json:"id"`
+	Kind       OutboundKind `json:"kind"`
+	MessageID  string       `json:"message_id,omitempty"`
+	To         []string     `json:"to,omitempty"`
+	Attempts   int          `json:"attempts"`
+	LastError  string       `json:"last_error,omitempty"`
+	EnqueuedAt time.Time    `json:"enqueued_at"`
+}
+
+// ReplayResult is the body of the answer to a replay
+type ReplayResult struct {
+	ID        string `json:"id"`
+	MessageID string `json:"message_id,omitempty"`
+	Outcome   string `json:"outcome"`
+	Detail    string `json:"detail,omitempty"`
+}
+
+// DeadLetterAdmin lets an operator inspect the items the outbound queue gave
+// up and replay them once the cause of the failure is fixed. Every replay is
+// recorded in the journal, if one is configured.
+type DeadLetterAdmin struct {
+	queue   *OutboundQueue
+	journal pec_storage.Journal
+}
+
+// NewDeadLetterAdmin creates the admin of the dead-letter items of queue
+func NewDeadLetterAdmin(queue *OutboundQueue, journal pec_storage.Journal) *DeadLetterAdmin {
+	return &DeadLetterAdmin{queue: queue, journal: journal}
+}
+
+// List returns the dead-letter items, oldest first
+func (a *DeadLetterAdmin) List() ([]DeadLetter, error) {
+	items, err := a.queue.DeadLetters()
+	if err != nil {
+		return nil, err
+	}
+	deadLetters := []DeadLetter{}
+	for _, item := range items {
+		deadLetters = append(deadLetters, DeadLetter{
+			ID:         item.ID,
+			Kind:       item.Kind,
+			MessageID:  itemMessageID(item),
+			To:         item.To,
+			Attempts:   item.Attempts,
+			LastError:  item.LastError,
+			EnqueuedAt: item.EnqueuedAt,
+		})
+	}
+	return deadLetters, nil
+}
+
+// Replay sends the dead-letter item id again and records the attempt in the
+// journal, see OutboundQueue.Replay
+func (a *DeadLetterAdmin) Replay(id string) (ReplayResult, error) {
+	item, err := a.queue.Replay(id)
+	if item == nil {
+		return ReplayResult{ID: id, Outcome: pec_storage.OutcomeFailure}, err
+	}
+
+	entry := pec_storage.JournalEntry{
+		Event:     pec_storage.EventReplayed,
+		MessageID: itemMessageID(item),
+		Outcome:   pec_storage.OutcomeSuccess,
+		Detail:    "outbound item " + item.ID,
+	}
+	if err != nil {
+		entry.Outcome = pec_storage.OutcomeFailure
+		entry.Detail += ": " + err.Error()
+	}
+	if a.journal != nil {
+		if jErr := a.journal.Record(entry); jErr != nil {
+			logger.LogError("Failed to record journal entry", jErr, map[string]string{"message_id": entry.MessageID})
+		}
+	}
+
+	result := ReplayResult{ID: item.ID, MessageID: entry.MessageID, Outcome: entry.Outcome}
+	if err != nil {
+		result.Detail = err.Error()
+	}
+	return result, err
+}
+
+// itemMessageID returns the Message-ID of the user message an item refers to
+func itemMessageID(item *OutboundItem) string {
+	msg, err := ParseEmailMessage(item.Data)
+	if err != nil {
+		return ""
+	}
+	return OriginalMessageID(&msg.Header)
+}
+
+// Handler returns the admin endpoints: GET /dead-letters lists the items,
+// POST /dead-letters/{id}/replay replays one, answering 502 when it fails
+// again
+func (a *DeadLetterAdmin) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /dead-letters", func(w http.ResponseWriter, r *http.Request) {
+		deadLetters, err := a.List()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, deadLetters)
+	})
+	mux.HandleFunc("POST /dead-letters/{id}/replay", func(w http.ResponseWriter, r *http.Request) {
+		result, err := a.Replay(r.PathValue("id"))
+		switch {
+		case errors.Is(err, ErrDeadLetterNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case err != nil:
+			writeJSON(w, http.StatusBadGateway, result)
+		default:
+			writeJSON(w, http.StatusOK, result)
+		}
+	})
+	return mux
+}
+
+// writeJSON writes v as the JSON body of an answer with the given status code
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// StartAdminServer serves the admin endpoints on addr (blocking)
+func StartAdminServer(addr string, a *DeadLetterAdmin) error {
+	logger.LogInfo("Starting admin server", map[string]string{"addr": addr})
+	return http.ListenAndServe(addr, a.Handler())
+}
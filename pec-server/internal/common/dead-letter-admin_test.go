@@ -0,0 +1,104 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	pec_storage "github.com/danzipie/go-pec/pec-server/internal/storage"
+)
+
+// TestDeadLetterAdmin_Handler tests listing the dead-letter items and
+// replaying them over HTTP, with the replays recorded in the journal
+func TestDeadLetterAdmin_Handler(t *testing.T) {
+	sender := &recordingSender{err: errors.New("connection refused")}
+	queue, err := NewOutboundQueue(t.TempDir(), sender.send)
+	if err != nil {
+		t.Fatalf("NewOutboundQueue failed: %v", err)
+	}
+	queue.MaxAttempts = 1
+	journal, err := pec_storage.NewFileJournal(filepath.Join(t.TempDir(), "journal.log"))
+	if err != nil {
+		t.Fatalf("NewFileJournal failed: %v", err)
+	}
+	defer journal.Close()
+
+	receipt := "Message-ID: <receipt@example.com>\r\n" +
+		"X-Riferimento-Message-ID: <original@example.com>\r\n" +
+		"Subject: ACCETTAZIONE: test\r\n" +
+		"\r\n" +
+		"body\r\n"
+	item := OutboundItem{Kind: OutboundSMTP, To: []string{"sender@example.com"}, Data: []byte(receipt)}
+	if err := queue.Enqueue(item); err != nil {
+		t.Fatalf("Enqueue failed: %v", err)
+	}
+	queue.ProcessPending()
+
+	server := httptest.NewServer(NewDeadLetterAdmin(queue, journal).Handler())
+	defer server.Close()
+
+	// List
+	resp, err := http.Get(server.URL + "/dead-letters")
+	if err != nil {
+		t.Fatalf("GET /dead-letters failed: %v", err)
+	}
+	var deadLetters []DeadLetter
+	if err := json.NewDecoder(resp.Body).Decode(&deadLetters); err != nil {
+		t.Fatalf("Failed to decode dead-letter items: %v", err)
+	}
+	resp.Body.Close()
+	if len(deadLetters) != 1 {
+		t.Fatalf("Expected 1 dead-letter item, got %d", len(deadLetters))
+	}
+	dead := deadLetters[0]
+	if dead.MessageID != "<original@example.com>" || dead.Attempts != 1 || dead.LastError != "connection refused" {
+		t.Errorf("Unexpected dead-letter item: %+v", dead)
+	}
+
+	replay := func(id string) (int, ReplayResult) {
+		t.Helper()
+		resp, err := http.Post(server.URL+"/dead-letters/"+id+"/replay", "", nil)
+		if err != nil {
+			t.Fatalf("POST replay failed: %v", err)
+		}
+		defer resp.Body.Close()
+		var result ReplayResult
+		json.NewDecoder(resp.Body).Decode(&result)
+		return resp.StatusCode, result
+	}
+
+	// A replay failing again is reported, and the item kept
+	if code, result := replay(dead.ID); code != http.StatusBadGateway || result.Outcome != pec_storage.OutcomeFailure {
+		t.Errorf("Expected 502 and a failure, got %d and %+v", code, result)
+	}
+
+	sender.mu.Lock()
+	sender.err = nil
+	sender.mu.Unlock()
+	code, result := replay(dead.ID)
+	if code != http.StatusOK || result.Outcome != pec_storage.OutcomeSuccess || result.MessageID != "<original@example.com>" {
+		t.Errorf("Expected 200 and a success, got %d and %+v", code, result)
+	}
+	if sender.count() != 1 {
+		t.Errorf("Expected the item to be sent once, got %d", sender.count())
+	}
+	if code, _ := replay(dead.ID); code != http.StatusNotFound {
+		t.Errorf("Expected 404 replaying a sent item, got %d", code)
+	}
+
+	entries, err := journal.QueryByMessageID("<original@example.com>")
+	if err != nil {
+		t.Fatalf("QueryByMessageID failed: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 journal entries, got %d", len(entries))
+	}
+	for i, outcome := range []string{pec_storage.OutcomeFailure, pec_storage.OutcomeSuccess} {
+		if entries[i].Event != pec_storage.EventReplayed || entries[i].Outcome != outcome {
+			t.Errorf("Expected a %s replay entry, got %+v", outcome, entries[i])
+		}
+	}
+}
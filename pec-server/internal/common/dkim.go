@@ -0,0 +1,388 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// DefaultDKIMHeaders is the set of headers signed when none is configured
+var DefaultDKIMHeaders = []string{
+	"From",
+	"To",
+	"Cc",
+	"Subject",
+	"Date",
+	"Message-ID",
+	"Reply-To",
+	"MIME-Version",
+	"Content-Type",
+	"X-Trasporto",
+	"X-Ricevuta",
+	"X-Riferimento-Message-ID",
+}
+
+// DKIMSigner adds a DKIM-Signature (rsa-sha256, relaxed/relaxed) to outbound messages
+type DKIMSigner struct {
+	Domain   string
+	Selector string
+	Key      *rsa.PrivateKey
+	// Headers to sign; DefaultDKIMHeaders when empty
+	Headers []string
+}
+
+// LoadDKIMSigner reads a PEM encoded RSA private key and returns a signer
+func LoadDKIMSigner(domain, selector, keyPath string, headers []string) (*DKIMSigner, error) {
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("failed to decode DKIM private key")
+	}
+
+	var key *rsa.PrivateKey
+	if parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		rsaKey, ok := parsed.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("DKIM private key is not an RSA key")
+		}
+		key = rsaKey
+	} else if key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+		return nil, err
+	}
+
+	return &DKIMSigner{
+		Domain:   domain,
+		Selector: selector,
+		Key:      key,
+		Headers:  headers,
+	}, nil
+}
+
+// Sign returns the message, with CRLF line endings, prefixed by a DKIM-Signature header
+func (d *DKIMSigner) Sign(msg []byte) ([]byte, error) {
+	if d.Key == nil {
+		return nil, errors.New("DKIM key is nil")
+	}
+
+	msg = toCRLF(msg)
+	headers, body := splitMessage(msg)
+
+	bodyHash := sha256.Sum256(dkimRelaxedBody(body))
+
+	signedHeaders := d.Headers
+	if len(signedHeaders) == 0 {
+		signedHeaders = DefaultDKIMHeaders
+	}
+	picked, names := dkimPickHeaders(headers, signedHeaders)
+
+	sigValue := fmt.Sprintf("v=1; a=rsa-sha256; c=relaxed/relaxed; d=%s; s=%s; t=%d; h=%s; bh=%s; b=",
+		d.Domain,
+		d.Selector,
+		time.Now().Unix(),
+		strings.Join(names, ":"),
+		base64.StdEncoding.EncodeToString(bodyHash[:]))
+
+	// The header is folded before hashing so that the signed form matches
+	// what the verifier sees once the b= value is removed
+	sigHeader := "DKIM-Signature: " + foldDKIMValue(sigValue)
+
+	hash := sha256.New()
+	for _, h := range picked {
+		hash.Write([]byte(dkimRelaxedHeader(h)))
+		hash.Write([]byte("\r\n"))
+	}
+	hash.Write([]byte(dkimRelaxedHeader(sigHeader)))
+
+	signature, err := rsa.SignPKCS1v15(rand.Reader, d.Key, crypto.SHA256, hash.Sum(nil))
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign DKIM header: %v", err)
+	}
+
+	var result bytes.Buffer
+	result.WriteString(sigHeader)
+	b := base64.StdEncoding.EncodeToString(signature)
+	for len(b) > 0 {
+		n := min(len(b), 72)
+		result.WriteString("\r\n\t")
+		result.WriteString(b[:n])
+		b = b[n:]
+	}
+	result.WriteString("\r\n")
+	result.Write(msg)
+	return result.Bytes(), nil
+}
+
+// dkimSignatureValue matches the b= tag of a DKIM-Signature, which is
+// emptied when computing the header hash
+var dkimSignatureValue = regexp.MustCompile(`((?:^|;)\s*b=)[^;]*`)
+
+// VerifyDKIM checks the first DKIM-Signature of msg, fetching the public key
+// from the selector record of the signing domain. AuthNone is returned for
+// unsigned messages; the error explains any other result than AuthPass.
+func VerifyDKIM(ctx context.Context, resolver DNSResolver, msg []byte) (AuthResult, error) {
+	fields, body := splitMessage(toCRLF(msg))
+
+	sigIndex := -1
+	for i, field := range fields {
+		if strings.EqualFold(headerName(field), "DKIM-Signature") {
+			sigIndex = i
+			break
+		}
+	}
+	if sigIndex < 0 {
+		return AuthNone, nil
+	}
+
+	sigField := fields[sigIndex]
+	name, value, _ := strings.Cut(sigField, ":")
+	tags := dkimTags(value)
+	if tags["v"] != "1" || tags["a"] != "rsa-sha256" {
+		return AuthPermError, fmt.Errorf("unsupported DKIM signature: v=%s a=%s", tags["v"], tags["a"])
+	}
+	if tags["d"] == "" || tags["s"] == "" || tags["h"] == "" || tags["b"] == "" {
+		return AuthPermError, errors.New("DKIM signature is missing required tags")
+	}
+
+	headerCanon, bodyCanon, _ := strings.Cut(tags["c"], "/")
+	canonicalizeHeader := dkimSimpleHeader
+	if headerCanon == "relaxed" {
+		canonicalizeHeader = dkimRelaxedHeader
+	}
+	canonicalizeBody := dkimSimpleBody
+	if bodyCanon == "relaxed" {
+		canonicalizeBody = dkimRelaxedBody
+	}
+
+	bodyHash := sha256.Sum256(canonicalizeBody(body))
+	if tags["bh"] != base64.StdEncoding.EncodeToString(bodyHash[:]) {
+		return AuthFail, errors.New("DKIM body hash mismatch")
+	}
+
+	pub, result, err := lookupDKIMKey(ctx, resolver, tags["s"], tags["d"])
+	if err != nil {
+		return result, err
+	}
+
+	others := append(append([]string{}, fields[:sigIndex]...), fields[sigIndex+1:]...)
+	signedNames := strings.Split(tags["h"], ":")
+	for i := range signedNames {
+		signedNames[i] = strings.TrimSpace(signedNames[i])
+	}
+	picked, _ := dkimPickHeaders(others, signedNames)
+
+	hash := sha256.New()
+	for _, h := range picked {
+		hash.Write([]byte(canonicalizeHeader(h)))
+		hash.Write([]byte("\r\n"))
+	}
+	hash.Write([]byte(canonicalizeHeader(name + ":" + dkimSignatureValue.ReplaceAllString(value, "$1"))))
+
+	signature, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return AuthPermError, fmt.Errorf("invalid DKIM signature encoding: %v", err)
+	}
+	if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, hash.Sum(nil), signature); err != nil {
+		return AuthFail, fmt.Errorf("DKIM signature mismatch: %v", err)
+	}
+	return AuthPass, nil
+}
+
+// lookupDKIMKey fetches the RSA public key published at selector._domainkey.domain
+func lookupDKIMKey(ctx context.Context, resolver DNSResolver, selector, domain string) (*rsa.PublicKey, AuthResult, error) {
+	txts, err := resolver.LookupTXT(ctx, selector+"._domainkey."+domain)
+	if err != nil {
+		if isTemporaryDNSError(err) {
+			return nil, AuthTempError, fmt.Errorf("DKIM key lookup failed: %v", err)
+		}
+		return nil, AuthPermError, fmt.Errorf("DKIM key not found: %v", err)
+	}
+
+	keyTags := dkimTags(strings.Join(txts, ""))
+	if k := keyTags["k"]; k != "" && k != "rsa" {
+		return nil, AuthPermError, fmt.Errorf("unsupported DKIM key type: %s", k)
+	}
+	if keyTags["p"] == "" {
+		return nil, AuthPermError, errors.New("DKIM key has been revoked")
+	}
+	der, err := base64.StdEncoding.DecodeString(keyTags["p"])
+	if err != nil {
+		return nil, AuthPermError, fmt.Errorf("invalid DKIM key encoding: %v", err)
+	}
+
+	if parsed, err := x509.ParsePKIXPublicKey(der); err == nil {
+		if pub, ok := parsed.(*rsa.PublicKey); ok {
+			return pub, AuthPass, nil
+		}
+		return nil, AuthPermError, errors.New("DKIM key is not an RSA key")
+	}
+	pub, err := x509.ParsePKCS1PublicKey(der)
+	if err != nil {
+		return nil, AuthPermError, fmt.Errorf("invalid DKIM key: %v", err)
+	}
+	return pub, AuthPass, nil
+}
+
+// toCRLF normalizes line endings to CRLF
+func toCRLF(msg []byte) []byte {
+	msg = bytes.ReplaceAll(msg, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(msg, []byte("\n"), []byte("\r\n"))
+}
+
+// splitMessage splits a CRLF message into its raw header fields (unfolded
+// continuation lines kept) and its body.
+func splitMessage(msg []byte) ([]string, []byte) {
+	var headerPart, body []byte
+	if i := bytes.Index(msg, []byte("\r\n\r\n")); i >= 0 {
+		headerPart, body = msg[:i+2], msg[i+4:]
+	} else {
+		headerPart = msg
+	}
+
+	var fields []string
+	for _, line := range strings.SplitAfter(string(headerPart), "\r\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1] += line
+			continue
+		}
+		fields = append(fields, line)
+	}
+	for i := range fields {
+		fields[i] = strings.TrimSuffix(fields[i], "\r\n")
+	}
+	return fields, body
+}
+
+// dkimPickHeaders selects, for each requested name, the last unused instance
+// of that header (RFC 6376 section 5.4.2). Absent headers are skipped.
+func dkimPickHeaders(fields []string, names []string) ([]string, []string) {
+	used := make([]bool, len(fields))
+	var picked, pickedNames []string
+	for _, name := range names {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if used[i] || !strings.EqualFold(headerName(fields[i]), name) {
+				continue
+			}
+			used[i] = true
+			picked = append(picked, fields[i])
+			pickedNames = append(pickedNames, strings.ToLower(name))
+			break
+		}
+	}
+	return picked, pickedNames
+}
+
+func headerName(field string) string {
+	if i := strings.Index(field, ":"); i >= 0 {
+		return strings.TrimSpace(field[:i])
+	}
+	return field
+}
+
+// dkimRelaxedHeader applies the relaxed header canonicalization
+func dkimRelaxedHeader(field string) string {
+	i := strings.Index(field, ":")
+	if i < 0 {
+		return strings.ToLower(strings.TrimSpace(field)) + ":"
+	}
+	name := strings.ToLower(strings.TrimSpace(field[:i]))
+	value := strings.ReplaceAll(field[i+1:], "\r\n", "")
+	value = strings.Join(strings.FieldsFunc(value, isWSP), " ")
+	return name + ":" + value
+}
+
+// dkimSimpleHeader applies the simple header canonicalization
+func dkimSimpleHeader(field string) string {
+	return field
+}
+
+// dkimSimpleBody applies the simple body canonicalization
+func dkimSimpleBody(body []byte) []byte {
+	for bytes.HasSuffix(body, []byte("\r\n\r\n")) {
+		body = body[:len(body)-2]
+	}
+	if len(body) == 0 || !bytes.HasSuffix(body, []byte("\r\n")) {
+		return append(append([]byte{}, body...), '\r', '\n')
+	}
+	return body
+}
+
+// dkimRelaxedBody applies the relaxed body canonicalization
+func dkimRelaxedBody(body []byte) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	for i, line := range lines {
+		fields := strings.FieldsFunc(line, isWSP)
+		compacted := strings.Join(fields, " ")
+		if len(line) > 0 && isWSP(rune(line[0])) && compacted != "" {
+			compacted = " " + compacted
+		}
+		lines[i] = compacted
+	}
+	// Remove trailing empty lines
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+func isWSP(r rune) bool {
+	return r == ' ' || r == '\t'
+}
+
+// foldDKIMValue folds a tag list between tags to keep lines short
+func foldDKIMValue(value string) string {
+	const lineLength = 76
+	var result strings.Builder
+	lineLen := len("DKIM-Signature: ")
+	for i, tag := range strings.Split(value, "; ") {
+		if i > 0 {
+			result.WriteString(";")
+			lineLen++
+			if lineLen+len(tag)+1 > lineLength {
+				result.WriteString("\r\n\t")
+				lineLen = 1
+			} else {
+				result.WriteString(" ")
+				lineLen++
+			}
+		}
+		result.WriteString(tag)
+		lineLen += len(tag)
+	}
+	return result.String()
+}
+
+// dkimTags parses a "k=v; k=v" tag list
+func dkimTags(value string) map[string]string {
+	tags := make(map[string]string)
+	for _, part := range strings.Split(value, ";") {
+		k, v, ok := strings.Cut(part, "=")
+		if !ok {
+			continue
+		}
+		k = strings.TrimSpace(k)
+		v = strings.Join(strings.Fields(v), "")
+		tags[k] = v
+	}
+	return tags
+}
@@ -0,0 +1,189 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"net"
+	"strings"
+	"testing"
+)
+
+// fakeResolver answers DNS queries from static maps
+type fakeResolver struct {
+	txt map[string][]string
+	ips map[string][]net.IP
+	mx  map[string][]*net.MX
+}
+
+func (r *fakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if txt, ok := r.txt[name]; ok {
+		return txt, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *fakeResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	if ips, ok := r.ips[host]; ok {
+		return ips, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func (r *fakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	if mx, ok := r.mx[name]; ok {
+		return mx, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+// dkimResolver publishes the public key of signer at its selector record
+func dkimResolver(t *testing.T, signer *DKIMSigner) *fakeResolver {
+	der, err := x509.MarshalPKIXPublicKey(&signer.Key.PublicKey)
+	if err != nil {
+		t.Fatalf("Failed to marshal public key: %v", err)
+	}
+	record := "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der)
+	return &fakeResolver{txt: map[string][]string{
+		signer.Selector + "._domainkey." + signer.Domain: {record[:100], record[100:]},
+	}}
+}
+
+// verifyDKIM checks the DKIM-Signature of msg against the key of signer
+func verifyDKIM(t *testing.T, msg []byte, signer *DKIMSigner) error {
+	t.Helper()
+	result, err := VerifyDKIM(context.Background(), dkimResolver(t, signer), msg)
+	if result != AuthPass && err == nil {
+		t.Fatalf("Expected an error with result %s", result)
+	}
+	return err
+}
+
+func newTestDKIMSigner(t *testing.T) *DKIMSigner {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate private key: %v", err)
+	}
+	return &DKIMSigner{Domain: "example.com", Selector: "pec", Key: key}
+}
+
+const dkimTestMessage = "From: posta-certificata@example.com\n" +
+	"To: user@example.org\n" +
+	"Subject:  POSTA CERTIFICATA:   test\n" +
+	"Date: Mon, 02 Jan 2006 15:04:05 +0000\n" +
+	"Message-ID: <1@example.com>\n" +
+	"X-Trasporto: posta-certificata\n" +
+	"\n" +
+	"Hello  world \n" +
+	"\n" +
+	"\n"
+
+// TestDKIMSigner_Sign tests that the produced signature validates against the public key
+func TestDKIMSigner_Sign(t *testing.T) {
+	signer := newTestDKIMSigner(t)
+
+	signed, err := signer.Sign([]byte(dkimTestMessage))
+	if err != nil {
+		t.Fatalf("Sign failed: %v", err)
+	}
+
+	if bytes.Contains(bytes.ReplaceAll(signed, []byte("\r\n"), nil), []byte("\n")) {
+		t.Errorf("Expected CRLF line endings in signed message")
+	}
+	for _, line := range strings.Split(string(signed), "\r\n") {
+		if len(line) > 78 {
+			t.Errorf("Expected header lines of at most 78 characters, got %d: %q", len(line), line)
+		}
+	}
+
+	fields, _ := splitMessage(signed)
+	tags := dkimTags(strings.SplitN(fields[0], ":", 2)[1])
+	if tags["d"] != "example.com" || tags["s"] != "pec" || tags["a"] != "rsa-sha256" {
+		t.Errorf("Unexpected DKIM tags: %v", tags)
+	}
+	if tags["h"] != "from:to:subject:date:message-id:x-trasporto" {
+		t.Errorf("Unexpected signed headers: %s", tags["h"])
+	}
+
+	if err := verifyDKIM(t, signed, signer); err != nil {
+		t.Fatalf("Expected signature to verify, got %v", err)
+	}
+
+	// Whitespace changes are tolerated by the relaxed canonicalization
+	reformatted := bytes.Replace(signed, []byte("Hello  world"), []byte("Hello world"), 1)
+	if err := verifyDKIM(t, reformatted, signer); err != nil {
+		t.Errorf("Expected signature to survive whitespace changes, got %v", err)
+	}
+
+	tampered := bytes.Replace(signed, []byte("POSTA CERTIFICATA"), []byte("POSTA MODIFICATA"), 1)
+	if err := verifyDKIM(t, tampered, signer); err == nil {
+		t.Errorf("Expected signature to fail on a modified subject")
+	}
+}
+
+// TestDKIMSigner_ConfiguredHeaders tests that only the configured headers are signed
+func TestDKIMSigner_ConfiguredHeaders(t *testing.T) {
+	signer := newTestDKIMSigner(t)
+	signer.Headers = []string{"From", "Message-ID"}
+
+	signed, err := signer.Sign([]byte(dkimTestMessage))
+	if err != nil {
+		t.Fatalf("Sign failed: %v", err)
+	}
+
+	fields, _ := splitMessage(signed)
+	tags := dkimTags(strings.SplitN(fields[0], ":", 2)[1])
+	if tags["h"] != "from:message-id" {
+		t.Errorf("Expected h=from:message-id, got %s", tags["h"])
+	}
+
+	// Unsigned headers can change without breaking the signature
+	changed := bytes.Replace(signed, []byte("POSTA CERTIFICATA"), []byte("POSTA MODIFICATA"), 1)
+	if err := verifyDKIM(t, changed, signer); err != nil {
+		t.Errorf("Expected signature to verify, got %v", err)
+	}
+}
+
+// TestVerifyDKIM tests the verification of valid, invalid and missing signatures
+func TestVerifyDKIM(t *testing.T) {
+	signer := newTestDKIMSigner(t)
+	signed, err := signer.Sign([]byte(dkimTestMessage))
+	if err != nil {
+		t.Fatalf("Sign failed: %v", err)
+	}
+	resolver := dkimResolver(t, signer)
+
+	tests := []struct {
+		name     string
+		msg      []byte
+		resolver DNSResolver
+		want     AuthResult
+	}{
+		{"valid signature", signed, resolver, AuthPass},
+		{"modified body", bytes.Replace(signed, []byte("Hello"), []byte("Goodbye"), 1), resolver, AuthFail},
+		{"modified header", bytes.Replace(signed, []byte("user@example.org"), []byte("other@example.org"), 1), resolver, AuthFail},
+		{"signed with another key", mustSign(t, newTestDKIMSigner(t), dkimTestMessage), resolver, AuthFail},
+		{"unsigned message", []byte(dkimTestMessage), resolver, AuthNone},
+		{"missing key record", signed, &fakeResolver{}, AuthPermError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := VerifyDKIM(context.Background(), tt.resolver, tt.msg)
+			if result != tt.want {
+				t.Errorf("Expected %s, got %s (%v)", tt.want, result, err)
+			}
+		})
+	}
+}
+
+func mustSign(t *testing.T, signer *DKIMSigner, msg string) []byte {
+	signed, err := signer.Sign([]byte(msg))
+	if err != nil {
+		t.Fatalf("Sign failed: %v", err)
+	}
+	return signed
+}
@@ -0,0 +1,114 @@
+package common
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDuplicateWindow    = 24 * time.Hour
+	defaultDuplicateCacheSize = 100000
+)
+
+// DuplicateDetector tells apart messages that were already processed
+type DuplicateDetector interface {
+	// Seen reports whether key was already seen, and records it otherwise
+	Seen(key string) bool
+	// Forget drops key, so that a message whose processing failed is
+	// processed again when retried
+	Forget(key string)
+}
+
+// MessageKey identifies a message of sender by its Message-ID or, when it has
+// none, by a hash of its raw body. Keys are scoped to the sender, so that a
+// sender reusing the Message-ID of another one is not taken for a retry.
+func MessageKey(sender, messageID string, raw []byte) string {
+	sender = strings.ToLower(strings.TrimSpace(sender)) + "\x00"
+	if id := strings.TrimSpace(messageID); id != "" {
+		return sender + id
+	}
+	sum := sha256.Sum256(RawBody(raw))
+	return sender + "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// SeenMessageCache is an in-memory DuplicateDetector remembering keys for a
+// time window, up to a maximum number of entries
+type SeenMessageCache struct {
+	Window  time.Duration
+	MaxSize int
+	now     func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List // oldest first
+}
+
+type seenEntry struct {
+	key    string
+	seenAt time.Time
+}
+
+// NewSeenMessageCache creates a cache configured from cfg
+func NewSeenMessageCache(cfg *Config) *SeenMessageCache {
+	c := &SeenMessageCache{
+		Window:  defaultDuplicateWindow,
+		MaxSize: defaultDuplicateCacheSize,
+		now:     time.Now,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+	if cfg.DuplicateWindowSeconds > 0 {
+		c.Window = time.Duration(cfg.DuplicateWindowSeconds) * time.Second
+	}
+	if cfg.DuplicateCacheSize > 0 {
+		c.MaxSize = cfg.DuplicateCacheSize
+	}
+	return c
+}
+
+// Seen implements DuplicateDetector
+func (c *SeenMessageCache) Seen(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	c.expire(now)
+	if _, ok := c.entries[key]; ok {
+		return true
+	}
+
+	c.entries[key] = c.order.PushBack(&seenEntry{key: key, seenAt: now})
+	for c.MaxSize > 0 && c.order.Len() > c.MaxSize {
+		c.remove(c.order.Front())
+	}
+	return false
+}
+
+// Forget implements DuplicateDetector
+func (c *SeenMessageCache) Forget(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+}
+
+// expire drops the entries older than the window
+func (c *SeenMessageCache) expire(now time.Time) {
+	for front := c.order.Front(); front != nil; front = c.order.Front() {
+		if now.Sub(front.Value.(*seenEntry).seenAt) < c.Window {
+			return
+		}
+		c.remove(front)
+	}
+}
+
+// remove drops an entry from the cache
+func (c *SeenMessageCache) remove(elem *list.Element) {
+	delete(c.entries, elem.Value.(*seenEntry).key)
+	c.order.Remove(elem)
+}
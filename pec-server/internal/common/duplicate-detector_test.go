@@ -0,0 +1,85 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+// TestSeenMessageCache_Window tests that keys are reported as duplicates only within the window
+func TestSeenMessageCache_Window(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	cache := NewSeenMessageCache(&Config{DuplicateWindowSeconds: 60})
+	cache.now = func() time.Time { return now }
+
+	if cache.Seen("<a@example.com>") {
+		t.Fatal("Expected the first occurrence not to be a duplicate")
+	}
+	if cache.Seen("<b@example.com>") {
+		t.Error("Expected a distinct message not to be a duplicate")
+	}
+
+	now = now.Add(30 * time.Second)
+	if !cache.Seen("<a@example.com>") {
+		t.Error("Expected a retry within the window to be a duplicate")
+	}
+
+	now = now.Add(31 * time.Second)
+	if cache.Seen("<a@example.com>") {
+		t.Error("Expected a message outside of the window not to be a duplicate")
+	}
+}
+
+// TestSeenMessageCache_MaxSize tests that the oldest keys are evicted once the cache is full
+func TestSeenMessageCache_MaxSize(t *testing.T) {
+	cache := NewSeenMessageCache(&Config{DuplicateCacheSize: 2})
+	cache.Seen("a")
+	cache.Seen("b")
+	cache.Seen("c")
+
+	if len(cache.entries) != 2 {
+		t.Fatalf("Expected 2 entries, got %d", len(cache.entries))
+	}
+	if !cache.Seen("c") || !cache.Seen("b") {
+		t.Error("Expected the newest keys to be kept")
+	}
+	if cache.Seen("a") {
+		t.Error("Expected the oldest key to be evicted")
+	}
+}
+
+// TestSeenMessageCache_Forget tests that a forgotten key is no longer a duplicate
+func TestSeenMessageCache_Forget(t *testing.T) {
+	cache := NewSeenMessageCache(&Config{})
+	cache.Seen("a")
+	cache.Seen("b")
+	cache.Forget("a")
+	cache.Forget("unknown")
+
+	if cache.Seen("a") {
+		t.Error("Expected a forgotten key not to be a duplicate")
+	}
+	if !cache.Seen("b") {
+		t.Error("Expected the other keys to be kept")
+	}
+}
+
+// TestMessageKey tests that messages are keyed by sender and Message-ID, or
+// by body when they have none
+func TestMessageKey(t *testing.T) {
+	if key := MessageKey("Sender@example.com", " <a@example.com> ", nil); key != "sender@example.com\x00<a@example.com>" {
+		t.Errorf("Expected the sender and the Message-ID as key, got %q", key)
+	}
+	if MessageKey("sender@example.com", "<a@example.com>", nil) == MessageKey("other@example.com", "<a@example.com>", nil) {
+		t.Errorf("Expected the same Message-ID of distinct senders to have distinct keys")
+	}
+
+	first := MessageKey("sender@example.com", "", []byte("Subject: a\r\n\r\nHello\r\n"))
+	retried := MessageKey("sender@example.com", "", []byte("Subject: a\r\nReceived: later\r\n\r\nHello\r\n"))
+	other := MessageKey("sender@example.com", "", []byte("Subject: a\r\n\r\nGoodbye\r\n"))
+	if first != retried {
+		t.Errorf("Expected messages with the same body to share a key")
+	}
+	if first == other {
+		t.Errorf("Expected messages with different bodies to have distinct keys")
+	}
+}
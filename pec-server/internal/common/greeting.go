@@ -0,0 +1,62 @@
+package common
+
+import (
+	"net"
+	"strings"
+	"sync"
+)
+
+// greetingListener rewrites the greeting, the first line a server writes on
+// each accepted connection, replacing its trailing text. The SMTP and IMAP
+// servers do not let the text be configured otherwise.
+type greetingListener struct {
+	net.Listener
+	text     string
+	greeting string
+}
+
+// newGreetingListener returns l rewriting the text ending the greetings into
+// greeting; l is returned as is when greeting is empty
+func newGreetingListener(l net.Listener, text, greeting string) net.Listener {
+	if greeting == "" || greeting == text {
+		return l
+	}
+	// The greeting must stay on a single line
+	greeting = strings.NewReplacer("\r", " ", "\n", " ").Replace(greeting)
+	return &greetingListener{Listener: l, text: text, greeting: greeting}
+}
+
+func (l *greetingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &greetingConn{Conn: conn, text: l.text, greeting: l.greeting}, nil
+}
+
+// greetingConn rewrites the first write on the connection
+type greetingConn struct {
+	net.Conn
+	text     string
+	greeting string
+	once     sync.Once
+}
+
+func (c *greetingConn) Write(b []byte) (int, error) {
+	var rewritten []byte
+	c.once.Do(func() {
+		suffix := c.text + "\r\n"
+		if strings.HasSuffix(string(b), suffix) {
+			rewritten = make([]byte, 0, len(b)-len(c.text)+len(c.greeting))
+			rewritten = append(rewritten, b[:len(b)-len(suffix)]...)
+			rewritten = append(rewritten, c.greeting+"\r\n"...)
+		}
+	})
+	if rewritten == nil {
+		return c.Conn.Write(b)
+	}
+	if _, err := c.Conn.Write(rewritten); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
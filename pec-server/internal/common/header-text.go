@@ -0,0 +1,72 @@
+package common
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/mail"
+	"strings"
+
+	"github.com/emersion/go-message"
+)
+
+// wordDecoder decodes RFC 2047 encoded-words; besides UTF-8, ISO-8859-1 and
+// US-ASCII it knows the charsets registered with go-message
+var wordDecoder = &mime.WordDecoder{
+	CharsetReader: func(charset string, input io.Reader) (io.Reader, error) {
+		if message.CharsetReader == nil {
+			return nil, fmt.Errorf("unhandled charset %q", charset)
+		}
+		return message.CharsetReader(charset, input)
+	},
+}
+
+// DecodeHeaderText returns the text of an unstructured header field such as
+// Subject, decoding any RFC 2047 encoded-words. A value that cannot be
+// decoded is returned as is.
+func DecodeHeaderText(value string) string {
+	decoded, err := wordDecoder.DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
+
+// NoSubject stands for the subject of a message without one in the
+// envelopes and receipts: in their Subject, their text and the daticert
+const NoSubject = "(nessun oggetto)"
+
+// SubjectText returns the subject shown for a message, NoSubject when it is
+// empty or blank
+func SubjectText(subject string) string {
+	if strings.TrimSpace(subject) == "" {
+		return NoSubject
+	}
+	return subject
+}
+
+// EncodeHeaderText encodes text for an unstructured header field, using
+// RFC 2047 Q encoded-words when it is not plain ASCII
+func EncodeHeaderText(text string) string {
+	return mime.QEncoding.Encode("utf-8", text)
+}
+
+// EncodeAddressList re-formats an address list header value so that display
+// names that are not plain ASCII are RFC 2047 encoded. A value that cannot
+// be parsed is returned as is.
+func EncodeAddressList(value string) string {
+	parser := mail.AddressParser{WordDecoder: wordDecoder}
+	addrs, err := parser.ParseList(value)
+	if err != nil {
+		return value
+	}
+	formatted := make([]string, len(addrs))
+	for i, addr := range addrs {
+		if addr.Name == "" {
+			formatted[i] = addr.Address
+		} else {
+			formatted[i] = addr.String()
+		}
+	}
+	return strings.Join(formatted, ", ")
+}
@@ -0,0 +1,89 @@
+package common
+
+import (
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+func TestDecodeHeaderText(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{"plain", "Fattura gennaio", "Fattura gennaio"},
+		{"base64", "=?UTF-8?B?RmF0dHVyYSBkaSBnZW5uYWlvIOKCrCAxMCDDqCBwYWdhdGE=?=", "Fattura di gennaio € 10 è pagata"},
+		{"q-encoded", "=?ISO-8859-1?Q?Perch=E8_no??=", "Perchè no?"},
+		{"mixed", "Re: =?UTF-8?Q?citt=C3=A0?= di Roma", "Re: città di Roma"},
+		{"unknown charset", "=?x-unknown?Q?abc?=", "=?x-unknown?Q?abc?="},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DecodeHeaderText(tt.value); got != tt.want {
+				t.Errorf("Expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestSubjectText(t *testing.T) {
+	tests := []struct {
+		subject string
+		want    string
+	}{
+		{"Fattura gennaio", "Fattura gennaio"},
+		{"", NoSubject},
+		{"  \t", NoSubject},
+	}
+	for _, tt := range tests {
+		if got := SubjectText(tt.subject); got != tt.want {
+			t.Errorf("Expected %q for %q, got %q", tt.want, tt.subject, got)
+		}
+	}
+}
+
+func TestEncodeHeaderText(t *testing.T) {
+	if got := EncodeHeaderText("CONSEGNA: hello"); got != "CONSEGNA: hello" {
+		t.Errorf("Expected ASCII text unchanged, got %q", got)
+	}
+	text := "CONSEGNA: Perchè no?"
+	encoded := EncodeHeaderText(text)
+	if encoded == text {
+		t.Fatalf("Expected non-ASCII text to be encoded")
+	}
+	if got := DecodeHeaderText(encoded); got != text {
+		t.Errorf("Expected %q to decode back to %q, got %q", encoded, text, got)
+	}
+}
+
+func TestEncodeAddressList(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{"bare address", "sender@example.com", "sender@example.com"},
+		{"ascii name", "Mario Rossi <mario@example.com>", `"Mario Rossi" <mario@example.com>`},
+		{"unparseable", "not an address", "not an address"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := EncodeAddressList(tt.value); got != tt.want {
+				t.Errorf("Expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+
+	encoded := EncodeAddressList("Niccolò Rossi <niccolo@example.com>, sender@example.com")
+	if strings.ContainsRune(encoded, 'ò') {
+		t.Fatalf("Expected the display name to be encoded, got %q", encoded)
+	}
+	addrs, err := (&mail.AddressParser{WordDecoder: wordDecoder}).ParseList(encoded)
+	if err != nil || len(addrs) != 2 {
+		t.Fatalf("Failed to parse %q: %v", encoded, err)
+	}
+	if addrs[0].Name != "Niccolò Rossi" || addrs[0].Address != "niccolo@example.com" || addrs[1].Address != "sender@example.com" {
+		t.Errorf("Unexpected addresses %v", addrs)
+	}
+}
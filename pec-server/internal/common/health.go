@@ -0,0 +1,105 @@
+package common
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	pec_storage "github.com/danzipie/go-pec/pec-server/internal/storage"
+	"github.com/danzipie/go-pec/pec-server/logger"
+)
+
+// Health tracks the state reported by the /healthz and /readyz endpoints
+type Health struct {
+	mu        sync.RWMutex
+	store     pec_storage.MessageStore
+	listeners map[string]bool // key: listener name, value: bound
+}
+
+// HealthStatus is the body of the health endpoints
+type HealthStatus struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// NewHealth creates a Health that is ready once all of the named listeners
+// are bound and store is reachable
+func NewHealth(store pec_storage.MessageStore, listeners ...string) *Health {
+	h := &Health{
+		store:     store,
+		listeners: make(map[string]bool),
+	}
+	for _, name := range listeners {
+		h.listeners[name] = false
+	}
+	return h
+}
+
+// SetBound records whether the named listener is accepting connections
+func (h *Health) SetBound(name string, bound bool) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.listeners[name] = bound
+}
+
+// Check returns the state of every listener and of the store
+func (h *Health) Check() (bool, map[string]string) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	ready := true
+	checks := make(map[string]string)
+	for name, bound := range h.listeners {
+		if bound {
+			checks[name] = "bound"
+		} else {
+			checks[name] = "not bound"
+			ready = false
+		}
+	}
+
+	if h.store != nil {
+		if err := h.store.Ping(); err != nil {
+			checks["store"] = err.Error()
+			ready = false
+		} else {
+			checks["store"] = "ok"
+		}
+	}
+	return ready, checks
+}
+
+// Handler returns the /healthz and /readyz endpoints. /healthz reports that
+// the process is alive, /readyz answers 503 until every check passes.
+func (h *Health) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		_, checks := h.Check()
+		writeHealth(w, http.StatusOK, "ok", checks)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		ready, checks := h.Check()
+		if !ready {
+			writeHealth(w, http.StatusServiceUnavailable, "not ready", checks)
+			return
+		}
+		writeHealth(w, http.StatusOK, "ready", checks)
+	})
+	return mux
+}
+
+// writeHealth writes a HealthStatus with the given HTTP status code
+func writeHealth(w http.ResponseWriter, code int, status string, checks map[string]string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(HealthStatus{Status: status, Checks: checks})
+}
+
+// StartHealthServer serves the health endpoints on addr (blocking)
+func StartHealthServer(addr string, h *Health) error {
+	logger.LogInfo("Starting health server", map[string]string{"addr": addr})
+	return http.ListenAndServe(addr, h.Handler())
+}
@@ -0,0 +1,86 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	pec_storage "github.com/danzipie/go-pec/pec-server/internal/storage"
+)
+
+// unreachableStore is a MessageStore whose backend cannot be reached
+type unreachableStore struct {
+	*pec_storage.InMemoryStore
+}
+
+func (s *unreachableStore) Ping() error {
+	return errors.New("connection refused")
+}
+
+// getHealth requests path from the health endpoints of h
+func getHealth(t *testing.T, h *Health, path string) (int, HealthStatus) {
+	t.Helper()
+	server := httptest.NewServer(h.Handler())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + path)
+	if err != nil {
+		t.Fatalf("GET %s failed: %v", path, err)
+	}
+	defer resp.Body.Close()
+
+	var status HealthStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		t.Fatalf("Failed to decode %s response: %v", path, err)
+	}
+	return resp.StatusCode, status
+}
+
+// TestHealth_Readiness tests that /readyz waits for the listeners and the store
+func TestHealth_Readiness(t *testing.T) {
+	h := NewHealth(pec_storage.NewInMemoryStore(), "smtp", "imap")
+
+	code, status := getHealth(t, h, "/readyz")
+	if code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 before the listeners are bound, got %d", code)
+	}
+	if status.Checks["smtp"] != "not bound" || status.Checks["store"] != "ok" {
+		t.Errorf("Unexpected checks: %v", status.Checks)
+	}
+
+	h.SetBound("smtp", true)
+	if code, _ := getHealth(t, h, "/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 with the IMAP listener unbound, got %d", code)
+	}
+
+	h.SetBound("imap", true)
+	code, status = getHealth(t, h, "/readyz")
+	if code != http.StatusOK || status.Status != "ready" {
+		t.Errorf("Expected 200 ready, got %d %s", code, status.Status)
+	}
+
+	h.SetBound("imap", false)
+	if code, _ := getHealth(t, h, "/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 after the IMAP listener closed, got %d", code)
+	}
+}
+
+// TestHealth_UnreachableStore tests that an unreachable store fails readiness but not liveness
+func TestHealth_UnreachableStore(t *testing.T) {
+	h := NewHealth(&unreachableStore{pec_storage.NewInMemoryStore()}, "smtp")
+	h.SetBound("smtp", true)
+
+	code, status := getHealth(t, h, "/readyz")
+	if code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 with an unreachable store, got %d", code)
+	}
+	if status.Checks["store"] != "connection refused" {
+		t.Errorf("Expected the store error in the checks, got %q", status.Checks["store"])
+	}
+
+	if code, _ := getHealth(t, h, "/healthz"); code != http.StatusOK {
+		t.Errorf("Expected /healthz to answer 200, got %d", code)
+	}
+}
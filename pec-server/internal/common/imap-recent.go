@@ -0,0 +1,82 @@
+package common
+
+import (
+	"github.com/danzipie/go-pec/pec-server/logger"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	imapserver "github.com/emersion/go-imap/server"
+)
+
+// recentExtension clears the \Recent flag of the messages of a mailbox once a
+// client has seen them: when it selects the mailbox read-write, and when it
+// closes it for the messages delivered meanwhile. EXAMINE and STATUS leave
+// the flag set.
+type recentExtension struct{}
+
+func (recentExtension) Capabilities(imapserver.Conn) []string {
+	return nil
+}
+
+func (recentExtension) Command(name string) imapserver.HandlerFactory {
+	switch name {
+	case "SELECT":
+		return func() imapserver.Handler { return &recentSelect{} }
+	case "CLOSE":
+		return func() imapserver.Handler { return &recentClose{} }
+	}
+	return nil
+}
+
+// recentSelect is SELECT, clearing \Recent after the mailbox status, which
+// reports the recent messages, was sent
+type recentSelect struct {
+	imapserver.Select
+}
+
+func (cmd *recentSelect) Handle(conn imapserver.Conn) error {
+	err := cmd.Select.Handle(conn)
+	ctx := conn.Context()
+	// The mailbox is only set when the selection succeeded
+	if ctx.Mailbox != nil && !ctx.MailboxReadOnly {
+		clearRecent(ctx.Mailbox)
+	}
+	return err
+}
+
+// recentClose is CLOSE, clearing \Recent on the messages delivered while the
+// mailbox was selected
+type recentClose struct {
+	imapserver.Close
+}
+
+func (cmd *recentClose) Handle(conn imapserver.Conn) error {
+	ctx := conn.Context()
+	mailbox, readOnly := ctx.Mailbox, ctx.MailboxReadOnly
+	err := cmd.Close.Handle(conn)
+	// The mailbox is deselected even when expunging it fails
+	if mailbox != nil && !readOnly {
+		clearRecent(mailbox)
+	}
+	return err
+}
+
+// clearRecent removes \Recent from the messages of mailbox
+func clearRecent(mailbox backend.Mailbox) {
+	m, ok := mailbox.(*IMAPMailbox)
+	if !ok {
+		return
+	}
+	messages, err := m.store.GetMessages(m.username)
+	if err != nil {
+		logger.LogError("Failed to get messages", err, map[string]string{"username": m.username})
+		return
+	}
+	for _, msg := range messages {
+		if !hasFlag(msg.Flags, imap.RecentFlag) {
+			continue
+		}
+		if _, err := m.store.RemoveFlags(m.username, msg.Uid, imap.RecentFlag); err != nil {
+			logger.LogError("Failed to clear the recent flag", err, map[string]string{"username": m.username})
+		}
+	}
+}
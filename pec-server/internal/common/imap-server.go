@@ -1,18 +1,25 @@
 package common
 
 import (
+	"bufio"
+	"bytes"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
 	"fmt"
-	"log"
+	"net"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	pec_storage "github.com/danzipie/go-pec/pec-server/internal/storage"
+	"github.com/danzipie/go-pec/pec-server/logger"
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
 	imapserver "github.com/emersion/go-imap/server"
+	"github.com/emersion/go-message/textproto"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -21,6 +28,8 @@ var (
 	ErrMailboxNotAllowed = errors.New("mailbox operation not allowed")
 	// ErrNotAllowed is returned when an operation is not allowed
 	ErrNotAllowed = errors.New("operation not allowed")
+	// ErrInvalidPartial is returned for a partial fetch with a negative range
+	ErrInvalidPartial = errors.New("invalid partial fetch range")
 )
 
 // IMAPBackend implements the IMAP server backend
@@ -28,10 +37,20 @@ type IMAPBackend struct {
 	store pec_storage.MessageStore
 	cert  *x509.Certificate
 	key   interface{}
+
+	// Certificates serves the TLS certificate, if set; cert and key are
+	// used otherwise
+	Certificates *CertificateHolder
+	// ClientCAs verifies the certificates of connecting clients, if set
+	ClientCAs *x509.CertPool
+	// ServerName is announced in the greeting, if set
+	ServerName string
+	// Greeting replaces the text of the greeting following the server
+	// name, if set
+	Greeting string
 }
 
 func NewIMAPBackend(store pec_storage.MessageStore, cert *x509.Certificate, key interface{}) *IMAPBackend {
-	fmt.Println("Creating IMAP backend")
 	return &IMAPBackend{
 		store: store,
 		cert:  cert,
@@ -40,11 +59,11 @@ func NewIMAPBackend(store pec_storage.MessageStore, cert *x509.Certificate, key
 }
 
 func (b *IMAPBackend) Login(connInfo *imap.ConnInfo, username, password string) (backend.User, error) {
-	log.Printf("Login attempt: %s", username)
+	logger.LogInfo("Login attempt", map[string]string{"username": username})
 
 	// Check if user exists
 	if !b.store.UserExists(username) {
-		log.Printf("Creating new user: %s", username)
+		logger.LogInfo("Creating new user", map[string]string{"username": username})
 
 		// Hash the provided password
 		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
@@ -57,7 +76,7 @@ func (b *IMAPBackend) Login(connInfo *imap.ConnInfo, username, password string)
 			return nil, fmt.Errorf("failed to create user: %v", err)
 		}
 
-		log.Printf("User created successfully: %s", username)
+		logger.LogInfo("User created successfully", map[string]string{"username": username})
 	} else {
 		// User exists, verify password
 		storedHash, err := b.store.GetUserPasswordHash(username)
@@ -68,7 +87,7 @@ func (b *IMAPBackend) Login(connInfo *imap.ConnInfo, username, password string)
 		// Compare the stored hash with the provided password
 		if err := bcrypt.CompareHashAndPassword([]byte(storedHash), []byte(password)); err != nil {
 			// Password doesn't match
-			log.Printf("Failed login attempt for %s: invalid password", username)
+			logger.LogInfo("Failed login attempt: invalid password", map[string]string{"username": username})
 			return nil, errors.New("invalid username or password")
 		}
 	}
@@ -161,8 +180,6 @@ func (m *IMAPMailbox) Info() (*imap.MailboxInfo, error) {
 
 func (m *IMAPMailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
 	status := imap.NewMailboxStatus(m.name, items)
-	fmt.Println("Status messages for user:", m.username)
-
 	messages, err := m.store.GetMessages(m.username)
 	if err != nil {
 		return nil, err
@@ -177,13 +194,26 @@ func (m *IMAPMailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, erro
 		case imap.StatusUidValidity:
 			status.UidValidity = 1
 		case imap.StatusRecent:
-			status.Recent = 0 // We don't support recent messages
+			status.Recent = 0
+			for _, msg := range messages {
+				if hasFlag(msg.Flags, imap.RecentFlag) {
+					status.Recent++
+				}
+			}
 		case imap.StatusUnseen:
-			status.Unseen = 0 // We don't track seen/unseen status yet
+			status.Unseen = 0
+			for _, msg := range messages {
+				if !hasFlag(msg.Flags, imap.SeenFlag) {
+					status.Unseen++
+				}
+			}
 		}
 	}
 
-	fmt.Println("Mailbox status for user:", m.username, "is", status)
+	logger.LogDebug("Mailbox status", map[string]string{
+		"username": m.username,
+		"messages": strconv.FormatUint(uint64(status.Messages), 10),
+	})
 
 	return status, nil
 }
@@ -248,20 +278,18 @@ func (m *IMAPMailbox) Check() error {
 func (m *IMAPMailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
 	defer close(ch)
 
-	fmt.Println("Listing messages for user:", m.username)
 	messages, err := m.store.GetMessages(m.username)
-	fmt.Println("Total messages for user:", m.username, "is", len(messages))
 	if err != nil {
-		fmt.Printf("failed to get messages: %v", err)
+		logger.LogError("Failed to get messages", err, map[string]string{"username": m.username})
 		return err
 	}
 
-	// Debug sequence set in detail
-	fmt.Printf("ListMessages called with uid=%v, seqSet=%v\n", uid, seqSet.String())
-
-	for i, seq := range seqSet.Set {
-		fmt.Printf("  Sequence %d: Start=%d, Stop=%d\n", i, seq.Start, seq.Stop)
-	}
+	logger.LogDebug("Listing messages", map[string]string{
+		"username": m.username,
+		"total":    strconv.Itoa(len(messages)),
+		"uid":      strconv.FormatBool(uid),
+		"seq_set":  seqSet.String(),
+	})
 
 	// Some IMAP clients send "1:*" which means "all messages"
 	isAllMessages := false
@@ -279,19 +307,15 @@ func (m *IMAPMailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap.F
 		var inSeqSet bool
 		if isAllMessages {
 			inSeqSet = true
-			fmt.Printf("Including message %d (UID %d) due to 1:* request\n", seqNum, msg.Uid)
 		} else if uid {
 			// In UID mode, check against message UID, not sequence number
 			inSeqSet = seqSet.Contains(msg.Uid)
-			fmt.Printf("UID mode: Checking message UID %d against seqSet: %v\n", msg.Uid, inSeqSet)
 		} else {
 			// In sequence mode, check against sequence number
 			inSeqSet = seqSet.Contains(seqNum)
-			fmt.Printf("Sequence mode: Checking seqNum %d against seqSet: %v\n", seqNum, inSeqSet)
 		}
 
 		if !inSeqSet {
-			fmt.Printf("Skipping message %d (UID %d), not in sequence set\n", seqNum, msg.Uid)
 			continue
 		}
 
@@ -303,6 +327,7 @@ func (m *IMAPMailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap.F
 		fetchedMsg.Envelope = msg.Envelope
 
 		// Only include requested items
+		markSeen := false
 		for _, item := range items {
 			switch item {
 			case imap.FetchEnvelope:
@@ -317,19 +342,80 @@ func (m *IMAPMailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap.F
 				fetchedMsg.Size = msg.Size
 			case imap.FetchUid:
 				fetchedMsg.Uid = msg.Uid
+			default:
+				section, err := imap.ParseBodySectionName(item)
+				if err != nil {
+					break
+				}
+				markSeen = markSeen || !section.Peek
+				literal, err := fetchBodySection(msg, section)
+				if err != nil {
+					logger.LogError("Failed to fetch body section", err, map[string]string{
+						"username": m.username,
+						"uid":      strconv.FormatUint(uint64(msg.Uid), 10),
+						"section":  string(item),
+					})
+					break
+				}
+				fetchedMsg.Body[section] = literal
+			}
+		}
+
+		// Fetching a body section without PEEK sets \Seen, and the new
+		// flags are returned along with the fetched items (RFC 3501, 6.4.5)
+		if markSeen && !hasFlag(msg.Flags, imap.SeenFlag) {
+			if _, err := m.store.AddFlags(m.username, msg.Uid, imap.SeenFlag); err != nil {
+				logger.LogError("Failed to mark message seen", err, map[string]string{
+					"username": m.username,
+					"uid":      strconv.FormatUint(uint64(msg.Uid), 10),
+				})
+			} else {
+				fetchedMsg.Flags = append(fetchedMsg.Flags[:len(fetchedMsg.Flags):len(fetchedMsg.Flags)], imap.SeenFlag)
+				fetchedMsg.Items[imap.FetchFlags] = nil
 			}
 		}
 
-		fmt.Printf("Sending message %d with UID %d\n", seqNum, msg.Uid)
 		ch <- fetchedMsg
 	}
 
 	return nil
 }
 
+// fetchBodySection returns a section of the stored raw message, such as
+// BODY[HEADER.FIELDS (FROM TO SUBJECT)] or BODY[TEXT], sliced to the byte
+// range of a partial fetch like BODY[]<0.2048>
+func fetchBodySection(msg *imap.Message, section *imap.BodySectionName) (imap.Literal, error) {
+	// The range is sliced without further checks, so negative values would panic
+	for _, n := range section.Partial {
+		if n < 0 {
+			return nil, ErrInvalidPartial
+		}
+	}
+	raw, err := pec_storage.MessageBody(msg)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(bytes.NewReader(raw))
+	header, err := textproto.ReadHeader(br)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse message header: %v", err)
+	}
+	return backendutil.FetchBodySection(header, br, section)
+}
+
+// hasFlag reports whether flags contains flag, ignoring case
+func hasFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if strings.EqualFold(f, flag) {
+			return true
+		}
+	}
+	return false
+}
+
 func (m *IMAPMailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
 	var ids []uint32
-	fmt.Println("Searching messages for user:", m.username)
+	logger.LogDebug("Searching messages", map[string]string{"username": m.username})
 
 	messages, err := m.store.GetMessages(m.username)
 	if err != nil {
@@ -375,33 +461,77 @@ func (m *IMAPMailbox) Expunge() error {
 	return ErrNotAllowed
 }
 
-// Add this new function to support direct TLS connections
-func StartIMAPWithTLS(addr string, backend *IMAPBackend) error {
-	s := imapserver.New(backend)
-	s.Addr = addr
-
-	// Create TLS config
-	tlsConfig := &tls.Config{
-		Certificates: []tls.Certificate{
+// tlsConfig returns the TLS configuration of the IMAP listeners, serving the
+// reloadable certificate if one is set
+func (b *IMAPBackend) tlsConfig() *tls.Config {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if b.Certificates != nil {
+		config.GetCertificate = b.Certificates.GetCertificate
+	} else {
+		config.Certificates = []tls.Certificate{
 			{
-				Certificate: [][]byte{backend.cert.Raw},
-				PrivateKey:  backend.key,
+				Certificate: [][]byte{b.cert.Raw},
+				PrivateKey:  b.key,
 			},
-		},
-		MinVersion: tls.VersionTLS12,
-		ClientAuth: tls.NoClientCert,
+		}
 	}
+	setClientAuth(config, b.ClientCAs)
+	return config
+}
 
-	s.TLSConfig = tlsConfig
+// imapGreetingText ends the greeting of the IMAP server
+const imapGreetingText = "IMAP4rev1 Service Ready"
 
-	log.Printf("Starting IMAP server with TLS at %v", addr)
+// greeting returns the text of the greeting, naming the server if
+// configured
+func (b *IMAPBackend) greeting() string {
+	text := imapGreetingText
+	if b.Greeting != "" {
+		text = b.Greeting
+	}
+	if b.ServerName != "" {
+		text = b.ServerName + " " + text
+	}
+	return text
+}
+
+// listener wraps l so that connections are greeted with the configured text
+func (b *IMAPBackend) listener(l net.Listener) net.Listener {
+	return newGreetingListener(l, imapGreetingText, b.greeting())
+}
+
+// newIMAPServerWithTLS returns an IMAP server and the listener it serves,
+// wrapping the direct TLS listener l
+func newIMAPServerWithTLS(l net.Listener, backend *IMAPBackend) (*imapserver.Server, net.Listener) {
+	s := imapserver.New(backend)
+	s.TLSConfig = backend.tlsConfig()
+	s.Enable(recentExtension{})
+
+	listener := backend.listener(l)
+	if listener != l {
+		// The server no longer sees the wrapped connections as TLS ones,
+		// though all of them are
+		s.AllowInsecureAuth = true
+	}
+	return s, listener
+}
+
+// StartIMAPWithTLS starts the IMAP server with direct TLS connections. The
+// listener state is reported to health, if not nil.
+func StartIMAPWithTLS(addr string, backend *IMAPBackend, health *Health) error {
+	logger.LogInfo("Starting IMAP server with TLS", map[string]string{"addr": addr, "server_name": backend.ServerName})
 
 	// Listen for TLS connections directly
-	listener, err := tls.Listen("tcp", addr, tlsConfig)
+	listener, err := tls.Listen("tcp", addr, backend.tlsConfig())
 	if err != nil {
 		return err
 	}
 
+	s, listener := newIMAPServerWithTLS(listener, backend)
+	s.Addr = addr
+
+	health.SetBound("imap", true)
+	defer health.SetBound("imap", false)
 	return s.Serve(listener)
 }
 
@@ -409,17 +539,12 @@ func StartIMAPWithTLS(addr string, backend *IMAPBackend) error {
 func StartIMAPWithSTARTTLS(addr string, backend *IMAPBackend) error {
 	s := imapserver.New(backend)
 	s.Addr = addr
-	s.TLSConfig = &tls.Config{
-		Certificates: []tls.Certificate{
-			{
-				Certificate: [][]byte{backend.cert.Raw},
-				PrivateKey:  backend.key,
-			},
-		},
-		MinVersion:         tls.VersionTLS12,
-		InsecureSkipVerify: true,
-		ClientAuth:         tls.NoClientCert,
+	s.TLSConfig = backend.tlsConfig()
+	s.Enable(recentExtension{})
+	logger.LogInfo("Starting IMAP server with STARTTLS support", map[string]string{"addr": addr})
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
 	}
-	log.Printf("Starting IMAP server at %v with STARTTLS support", addr)
-	return s.ListenAndServe() // The go-imap server automatically supports STARTTLS
+	return s.Serve(backend.listener(listener)) // The go-imap server automatically supports STARTTLS
 }
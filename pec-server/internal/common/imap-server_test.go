@@ -0,0 +1,484 @@
+package common
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/danzipie/go-pec/pec"
+	pec_storage "github.com/danzipie/go-pec/pec-server/internal/storage"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-message"
+)
+
+const testIMAPMessage = "From: sender@example.com\r\n" +
+	"To: recipient@example.com\r\n" +
+	"Subject: Fattura\r\n" +
+	"X-Ricevuta: accettazione\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"Corpo del messaggio\r\n"
+
+// newTestIMAPMailbox returns the INBOX of a user holding testIMAPMessage
+func newTestIMAPMailbox(t *testing.T) *IMAPMailbox {
+	t.Helper()
+	entity, err := message.Read(strings.NewReader(testIMAPMessage))
+	if err != nil {
+		t.Fatalf("Failed to read message: %v", err)
+	}
+	store := pec_storage.NewInMemoryStore()
+	if err := store.AddMessage("user@example.com", ConvertToIMAPMessage(entity)); err != nil {
+		t.Fatalf("AddMessage failed: %v", err)
+	}
+	return &IMAPMailbox{name: "INBOX", username: "user@example.com", store: store}
+}
+
+// fetchSection fetches a single body section of the first message
+func fetchSection(t *testing.T, mailbox *IMAPMailbox, item imap.FetchItem) string {
+	t.Helper()
+	seqSet, _ := imap.ParseSeqSet("1")
+	ch := make(chan *imap.Message, 1)
+	if err := mailbox.ListMessages(false, seqSet, []imap.FetchItem{item}, ch); err != nil {
+		t.Fatalf("ListMessages failed: %v", err)
+	}
+	msg, ok := <-ch
+	if !ok {
+		t.Fatalf("Expected a message")
+	}
+	if len(msg.Body) != 1 {
+		t.Fatalf("Expected the %s section, got %d sections", item, len(msg.Body))
+	}
+	var data []byte
+	for _, literal := range msg.Body {
+		var err error
+		if data, err = io.ReadAll(literal); err != nil {
+			t.Fatalf("Failed to read %s: %v", item, err)
+		}
+	}
+	return string(data)
+}
+
+func TestIMAPMailbox_FetchBodySections(t *testing.T) {
+	mailbox := newTestIMAPMailbox(t)
+
+	tests := []struct {
+		item imap.FetchItem
+		want string
+	}{
+		{"BODY.PEEK[HEADER.FIELDS (FROM SUBJECT)]", "From: sender@example.com\r\nSubject: Fattura\r\n\r\n"},
+		{"BODY[HEADER.FIELDS (x-ricevuta)]", "X-Ricevuta: accettazione\r\n\r\n"},
+		{"BODY.PEEK[HEADER.FIELDS.NOT (FROM TO SUBJECT CONTENT-TYPE MIME-VERSION)]", "X-Ricevuta: accettazione\r\n\r\n"},
+		{"BODY.PEEK[TEXT]", "Corpo del messaggio\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.item), func(t *testing.T) {
+			if got := fetchSection(t, mailbox, tt.item); got != tt.want {
+				t.Errorf("Expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestIMAPMailbox_FetchHeader(t *testing.T) {
+	mailbox := newTestIMAPMailbox(t)
+	header := fetchSection(t, mailbox, "BODY.PEEK[HEADER]")
+	if !strings.HasSuffix(header, "\r\n\r\n") || strings.Contains(header, "Corpo del messaggio") {
+		t.Errorf("Expected only the header, got %q", header)
+	}
+	for _, field := range []string{"From: sender@example.com", "Subject: Fattura", "X-Ricevuta: accettazione"} {
+		if !strings.Contains(header, field) {
+			t.Errorf("Expected %q in the header, got %q", field, header)
+		}
+	}
+
+	if entire := fetchSection(t, mailbox, "BODY.PEEK[]"); !strings.HasPrefix(entire, header) {
+		t.Errorf("Expected the entire message to start with the header, got %q", entire)
+	}
+}
+
+func TestIMAPMailbox_FetchPartial(t *testing.T) {
+	mailbox := newTestIMAPMailbox(t)
+	entire := fetchSection(t, mailbox, "BODY.PEEK[]")
+	text := fetchSection(t, mailbox, "BODY.PEEK[TEXT]")
+
+	tests := []struct {
+		item imap.FetchItem
+		want string
+	}{
+		{"BODY.PEEK[]<0.20>", entire[:20]},
+		{"BODY.PEEK[]<10.15>", entire[10:25]},
+		{"BODY.PEEK[TEXT]<6.3>", text[6:9]},
+		{"BODY.PEEK[TEXT]<6.2048>", text[6:]},
+		{"BODY.PEEK[TEXT]<4096.10>", ""},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.item), func(t *testing.T) {
+			if got := fetchSection(t, mailbox, tt.item); got != tt.want {
+				t.Errorf("Expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestIMAPMailbox_FetchPartialResponse(t *testing.T) {
+	mailbox := newTestIMAPMailbox(t)
+	seqSet, _ := imap.ParseSeqSet("1")
+	ch := make(chan *imap.Message, 1)
+	if err := mailbox.ListMessages(false, seqSet, []imap.FetchItem{"BODY.PEEK[]<0.16>"}, ch); err != nil {
+		t.Fatalf("ListMessages failed: %v", err)
+	}
+	msg := <-ch
+
+	// The response names the section by its origin only, followed by a
+	// literal of exactly the requested length
+	fields := msg.Format()
+	if len(fields) != 2 {
+		t.Fatalf("Expected one item in the response, got %v", fields)
+	}
+	section, ok := fields[0].(*imap.BodySectionName)
+	if !ok || section.FetchItem() != "BODY[]<0>" {
+		t.Errorf("Expected BODY[]<0> in the response, got %v", fields[0])
+	}
+	literal, ok := fields[1].(imap.Literal)
+	if !ok || literal.Len() != 16 {
+		t.Errorf("Expected a 16 byte literal, got %v", fields[1])
+	}
+}
+
+func TestIMAPMailbox_FetchPartialInvalid(t *testing.T) {
+	mailbox := newTestIMAPMailbox(t)
+	seqSet, _ := imap.ParseSeqSet("1")
+	ch := make(chan *imap.Message, 1)
+	if err := mailbox.ListMessages(false, seqSet, []imap.FetchItem{"BODY.PEEK[]<-5.10>"}, ch); err != nil {
+		t.Fatalf("ListMessages failed: %v", err)
+	}
+	if msg := <-ch; len(msg.Body) != 0 {
+		t.Errorf("Expected no section for a negative range, got %v", msg.Body)
+	}
+}
+
+// unseenCount returns the UNSEEN status of a mailbox
+func unseenCount(t *testing.T, mailbox *IMAPMailbox) uint32 {
+	t.Helper()
+	status, err := mailbox.Status([]imap.StatusItem{imap.StatusUnseen})
+	if err != nil {
+		t.Fatalf("Status failed: %v", err)
+	}
+	return status.Unseen
+}
+
+func recentCount(t *testing.T, mailbox *IMAPMailbox) uint32 {
+	t.Helper()
+	status, err := mailbox.Status([]imap.StatusItem{imap.StatusRecent})
+	if err != nil {
+		t.Fatalf("Status failed: %v", err)
+	}
+	return status.Recent
+}
+
+// fetchFlags fetches a body section of the first message and returns the
+// flags included in the response, if any
+func fetchFlags(t *testing.T, mailbox *IMAPMailbox, item imap.FetchItem) ([]string, bool) {
+	t.Helper()
+	seqSet, _ := imap.ParseSeqSet("1")
+	ch := make(chan *imap.Message, 1)
+	if err := mailbox.ListMessages(false, seqSet, []imap.FetchItem{item}, ch); err != nil {
+		t.Fatalf("ListMessages failed: %v", err)
+	}
+	msg := <-ch
+	_, ok := msg.Items[imap.FetchFlags]
+	return msg.Flags, ok
+}
+
+func TestIMAPMailbox_FetchSetsSeen(t *testing.T) {
+	mailbox := newTestIMAPMailbox(t)
+	notified := make(chan struct{}, 10)
+	mailbox.store.(*pec_storage.InMemoryStore).RegisterNotifier(mailbox.username, func() { notified <- struct{}{} })
+
+	if got := unseenCount(t, mailbox); got != 1 {
+		t.Fatalf("Expected 1 unseen message, got %d", got)
+	}
+
+	// A peek leaves the message unseen
+	if _, ok := fetchFlags(t, mailbox, "BODY.PEEK[]"); ok {
+		t.Errorf("Expected no flags in the response to a peek")
+	}
+	if got := unseenCount(t, mailbox); got != 1 {
+		t.Errorf("Expected the message to stay unseen after a peek, got %d unseen", got)
+	}
+
+	// A body fetch marks it seen and reports the new flags
+	flags, ok := fetchFlags(t, mailbox, "BODY[TEXT]")
+	if !ok || !hasFlag(flags, imap.SeenFlag) {
+		t.Errorf("Expected \\Seen in the response flags, got %v", flags)
+	}
+	if got := unseenCount(t, mailbox); got != 0 {
+		t.Errorf("Expected no unseen message, got %d", got)
+	}
+	select {
+	case <-notified:
+	case <-time.After(time.Second):
+		t.Errorf("Expected the mailbox to be notified of the flag change")
+	}
+
+	// Fetching it again changes nothing
+	if _, ok := fetchFlags(t, mailbox, "BODY[TEXT]"); ok {
+		t.Errorf("Expected no flag update for a message already seen")
+	}
+	select {
+	case <-notified:
+		t.Errorf("Expected no further notification")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestStartIMAPWithTLS_Greeting(t *testing.T) {
+	tests := []struct {
+		name       string
+		serverName string
+		greeting   string
+		want       string
+	}{
+		{"default", "", "", "] IMAP4rev1 Service Ready\r\n"},
+		{"server name", "imap.example.com", "", "] imap.example.com IMAP4rev1 Service Ready\r\n"},
+		{"custom", "imap.example.com", "Posta Elettronica Certificata", "] imap.example.com Posta Elettronica Certificata\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cert, key := createTestCertAndKey(t)
+			backend := NewIMAPBackend(pec_storage.NewInMemoryStore(), cert, key)
+			backend.ServerName = tt.serverName
+			backend.Greeting = tt.greeting
+
+			l, err := tls.Listen("tcp", "127.0.0.1:0", backend.tlsConfig())
+			if err != nil {
+				t.Fatalf("Failed to listen: %v", err)
+			}
+			s, listener := newIMAPServerWithTLS(l, backend)
+			go s.Serve(listener)
+			defer s.Close()
+
+			conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+			if err != nil {
+				t.Fatalf("Failed to connect: %v", err)
+			}
+			defer conn.Close()
+			greeting := readGreeting(t, conn)
+			if !strings.HasPrefix(greeting, "* OK [CAPABILITY ") || !strings.HasSuffix(greeting, tt.want) {
+				t.Errorf("Expected a greeting ending with %q, got %q", tt.want, greeting)
+			}
+			// Logging in stays allowed over the wrapped TLS connections
+			if !strings.Contains(greeting, "AUTH=PLAIN") || strings.Contains(greeting, "LOGINDISABLED") {
+				t.Errorf("Expected authentication to be offered, got %q", greeting)
+			}
+		})
+	}
+}
+
+func TestIMAPBackend_GreetingListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer l.Close()
+
+	backend := &IMAPBackend{}
+	if backend.listener(l) != l {
+		t.Errorf("Expected the listener to be left as is without a configured greeting")
+	}
+	backend.ServerName = "imap.example.com"
+	if backend.listener(l) == l {
+		t.Errorf("Expected the listener to be wrapped for a configured server name")
+	}
+}
+
+// signedTestReceipt returns an acceptance receipt signed by signer
+func signedTestReceipt(t *testing.T, signer *Signer) *message.Entity {
+	t.Helper()
+	datiCert := pec.NewDatiCert(pec.TipoAccettazione, pec.ErroreNessuno, ProviderName(signer.Domain), time.Now())
+	datiCert.Intestazione.Mittente = "sender@testdomain.com"
+	datiCert.AddDestinatari("certificato", "recipient@example.com")
+	datiCert.Intestazione.Oggetto = "Fattura"
+	datiCert.Dati.MsgID = "<original@testdomain.com>"
+	xmlData, err := datiCert.Marshal()
+	if err != nil {
+		t.Fatalf("Failed to marshal daticert.xml: %v", err)
+	}
+	receipt := &PECTransportEnvelope{
+		Headers: map[string]string{
+			"From":                     "posta-certificata@testdomain.com",
+			"To":                       "sender@testdomain.com",
+			"Subject":                  "ACCETTAZIONE: Fattura",
+			"Date":                     time.Now().Format(time.RFC1123Z),
+			"X-Ricevuta":               "accettazione",
+			"X-Riferimento-Message-ID": "<original@testdomain.com>",
+		},
+		Body:    "Ricevuta di accettazione",
+		XMLData: string(xmlData),
+	}
+	signed, err := SignPECEnvelope(signer, receipt, []byte(testIMAPMessage))
+	if err != nil {
+		t.Fatalf("Failed to sign receipt: %v", err)
+	}
+	signed.Header.Del("X-Trasporto")
+	return signed
+}
+
+func TestReceiptClient_FetchReceipts(t *testing.T) {
+	cert, key := createTestCertAndKey(t)
+	store := pec_storage.NewInMemoryStore()
+	backend := NewIMAPBackend(store, cert, key)
+	// A user logging in for the first time is created with its password
+	const username, password = "sender@testdomain.com", "secret"
+	if _, err := backend.Login(nil, username, password); err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+
+	plain, err := message.Read(strings.NewReader(strings.Replace(testIMAPMessage, "X-Ricevuta: accettazione\r\n", "", 1)))
+	if err != nil {
+		t.Fatalf("Failed to read message: %v", err)
+	}
+	unsigned, err := message.Read(strings.NewReader(testIMAPMessage))
+	if err != nil {
+		t.Fatalf("Failed to read message: %v", err)
+	}
+	signer := &Signer{Cert: cert, Key: key, Domain: "testdomain.com"}
+	for _, entity := range []*message.Entity{plain, signedTestReceipt(t, signer), unsigned} {
+		if err := store.AddMessage(username, ConvertToIMAPMessage(entity)); err != nil {
+			t.Fatalf("AddMessage failed: %v", err)
+		}
+	}
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", backend.tlsConfig())
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	s, listener := newIMAPServerWithTLS(l, backend)
+	go s.Serve(listener)
+	defer s.Close()
+
+	// The test certificate names no host: pin it instead
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 || !bytes.Equal(rawCerts[0], cert.Raw) {
+				return errors.New("unexpected server certificate")
+			}
+			return nil
+		},
+	}
+	client := &pec.ReceiptClient{
+		Addr:      l.Addr().String(),
+		Username:  username,
+		Password:  password,
+		TLSConfig: tlsConfig,
+	}
+	receipts, err := client.FetchReceipts()
+	if err != nil {
+		t.Fatalf("FetchReceipts failed: %v", err)
+	}
+	if len(receipts) != 2 {
+		t.Fatalf("Expected the 2 receipts, got %+v", receipts)
+	}
+
+	signed, unsignedReceipt := receipts[0], receipts[1]
+	if signed.Ricevuta != "accettazione" || signed.Error != "" || signed.Verification == nil {
+		t.Fatalf("Expected the signed receipt to be verified, got %+v", signed)
+	}
+	if !signed.Verification.SignatureValid || signed.Verification.PecType != pec.AcceptanceReceipt {
+		t.Errorf("Expected a valid acceptance receipt signature, got %+v", signed.Verification)
+	}
+	if signed.Verification.DatiCert == nil || signed.Verification.DatiCert.Dati.MsgID != "<original@testdomain.com>" {
+		t.Errorf("Expected the receipt daticert, got %+v", signed.Verification.DatiCert)
+	}
+	if signed.Mail == nil || signed.Mail.Envelope.Subject != "ACCETTAZIONE: Fattura" {
+		t.Errorf("Expected the parsed receipt, got %+v", signed.Mail)
+	}
+	if !bytes.Contains(signed.Raw, []byte("daticert.xml")) {
+		t.Errorf("Expected the raw receipt, got %q", signed.Raw)
+	}
+	if unsignedReceipt.Error == "" || unsignedReceipt.Verification != nil {
+		t.Errorf("Expected the unsigned receipt to fail parsing, got %+v", unsignedReceipt)
+	}
+
+	// The receipts are left unseen
+	mailbox := &IMAPMailbox{name: "INBOX", username: username, store: store}
+	if got := unseenCount(t, mailbox); got != 3 {
+		t.Errorf("Expected 3 unseen messages, got %d", got)
+	}
+}
+
+func TestIMAPServer_RecentClearedOnSelect(t *testing.T) {
+	cert, key := createTestCertAndKey(t)
+	store := pec_storage.NewInMemoryStore()
+	backend := NewIMAPBackend(store, cert, key)
+	const username, password = "user@example.com", "secret"
+	if _, err := backend.Login(nil, username, password); err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+	entity, err := message.Read(strings.NewReader(testIMAPMessage))
+	if err != nil {
+		t.Fatalf("Failed to read message: %v", err)
+	}
+	if err := store.AddMessage(username, ConvertToIMAPMessage(entity)); err != nil {
+		t.Fatalf("AddMessage failed: %v", err)
+	}
+	mailbox := &IMAPMailbox{name: "INBOX", username: username, store: store}
+	if got := recentCount(t, mailbox); got != 1 {
+		t.Fatalf("Expected 1 recent message, got %d", got)
+	}
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", backend.tlsConfig())
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	s, listener := newIMAPServerWithTLS(l, backend)
+	go s.Serve(listener)
+	defer s.Close()
+
+	c, err := client.DialTLS(l.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer c.Logout()
+	if err := c.Login(username, password); err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+
+	// Neither STATUS nor EXAMINE clear the flag
+	if _, err := c.Status("INBOX", []imap.StatusItem{imap.StatusRecent}); err != nil {
+		t.Fatalf("STATUS failed: %v", err)
+	}
+	status, err := c.Select("INBOX", true)
+	if err != nil {
+		t.Fatalf("EXAMINE failed: %v", err)
+	}
+	if status.Recent != 1 || recentCount(t, mailbox) != 1 {
+		t.Fatalf("Expected the message to stay recent after EXAMINE, got %d", status.Recent)
+	}
+
+	status, err = c.Select("INBOX", false)
+	if err != nil {
+		t.Fatalf("SELECT failed: %v", err)
+	}
+	if status.Recent != 1 {
+		t.Errorf("Expected SELECT to report 1 recent message, got %d", status.Recent)
+	}
+	if got := recentCount(t, mailbox); got != 0 {
+		t.Errorf("Expected no recent messages after SELECT, got %d", got)
+	}
+	status, err = c.Select("INBOX", false)
+	if err != nil {
+		t.Fatalf("SELECT failed: %v", err)
+	}
+	if status.Recent != 0 {
+		t.Errorf("Expected the next SELECT to report no recent messages, got %d", status.Recent)
+	}
+}
@@ -0,0 +1,47 @@
+package common
+
+import (
+	"fmt"
+
+	pec_storage "github.com/danzipie/go-pec/pec-server/internal/storage"
+)
+
+// The backends of the mailboxes selected by Config.StoreType
+const (
+	StoreTypeMemory   = "memory"
+	StoreTypeMaildir  = "maildir"
+	StoreTypePostgres = "postgres"
+)
+
+// NewMessageStore returns the message store configured in cfg, the
+// in-memory one when no StoreType is configured. The usernames given
+// without a domain are qualified with cfg.Domain.
+func NewMessageStore(cfg *Config) (pec_storage.MessageStore, error) {
+	switch cfg.StoreType {
+	case "", StoreTypeMemory:
+		store := pec_storage.NewInMemoryStore()
+		store.DefaultDomain = cfg.Domain
+		return store, nil
+	case StoreTypeMaildir:
+		if cfg.StoreDSN == "" {
+			return nil, fmt.Errorf("store_dsn is required for the %s store", cfg.StoreType)
+		}
+		store, err := pec_storage.NewMaildirStore(cfg.StoreDSN)
+		if err != nil {
+			return nil, err
+		}
+		store.DefaultDomain = cfg.Domain
+		return store, nil
+	case StoreTypePostgres:
+		if cfg.StoreDSN == "" {
+			return nil, fmt.Errorf("store_dsn is required for the %s store", cfg.StoreType)
+		}
+		store, err := pec_storage.OpenPostgresStore(cfg.StoreDSN)
+		if err != nil {
+			return nil, err
+		}
+		store.DefaultDomain = cfg.Domain
+		return store, nil
+	}
+	return nil, fmt.Errorf("unknown store type %q", cfg.StoreType)
+}
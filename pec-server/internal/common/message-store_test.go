@@ -0,0 +1,70 @@
+package common
+
+import (
+	"testing"
+
+	pec_storage "github.com/danzipie/go-pec/pec-server/internal/storage"
+)
+
+// TestNewMessageStore tests the store returned for each store_type
+func TestNewMessageStore(t *testing.T) {
+	maildir := t.TempDir()
+	tests := []struct {
+		name      string
+		storeType string
+		dsn       string
+		check     func(pec_storage.MessageStore) bool
+	}{
+		{"default", "", "", func(s pec_storage.MessageStore) bool {
+			store, ok := s.(*pec_storage.InMemoryStore)
+			return ok && store.DefaultDomain == "example.com"
+		}},
+		{"memory", StoreTypeMemory, "", func(s pec_storage.MessageStore) bool {
+			_, ok := s.(*pec_storage.InMemoryStore)
+			return ok
+		}},
+		{"maildir", StoreTypeMaildir, maildir, func(s pec_storage.MessageStore) bool {
+			store, ok := s.(*pec_storage.MaildirStore)
+			return ok && store.DefaultDomain == "example.com"
+		}},
+		{"postgres", StoreTypePostgres, "host=localhost dbname=pec sslmode=disable", func(s pec_storage.MessageStore) bool {
+			store, ok := s.(*pec_storage.PostgresStore)
+			return ok && store.DefaultDomain == "example.com"
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{Domain: "example.com", StoreType: tt.storeType, StoreDSN: tt.dsn}
+			store, err := NewMessageStore(cfg)
+			if err != nil {
+				t.Fatalf("NewMessageStore failed: %v", err)
+			}
+			defer store.Close()
+			if !tt.check(store) {
+				t.Errorf("Unexpected store %T for store_type %q", store, tt.storeType)
+			}
+		})
+	}
+}
+
+// TestNewMessageStore_Errors tests that an unknown store_type, or a missing
+// store_dsn, is reported
+func TestNewMessageStore_Errors(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+	}{
+		{"unknown type", Config{StoreType: "mongodb"}},
+		{"maildir without dsn", Config{StoreType: StoreTypeMaildir}},
+		{"postgres without dsn", Config{StoreType: StoreTypePostgres}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if store, err := NewMessageStore(&tt.cfg); err == nil {
+				t.Errorf("Expected an error, got %T", store)
+			}
+		})
+	}
+}
@@ -0,0 +1,355 @@
+package common
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/danzipie/go-pec/pec-server/logger"
+	"github.com/danzipie/go-pec/pec-server/metrics"
+)
+
+// OutboundKind identifies how an outbound item has to be sent
+type OutboundKind string
+
+const (
+	// OutboundSMTP items are sent to another provider via SMTP
+	OutboundSMTP OutboundKind = "smtp"
+	// OutboundHTTP items are posted to the delivery point API
+	OutboundHTTP OutboundKind = "http"
+)
+
+const (
+	defaultQueueInterval    = 5 * time.Second
+	defaultQueueMaxAttempts = 10
+	deadLetterDir           = "dead"
+	queueQuarantineDir      = "quarantine"
+)
+
+// ErrDeadLetterNotFound is returned when replaying an item that is not in
+// the dead-letter directory
+var ErrDeadLetterNotFound = errors.New("dead-letter item not found")
+
+// OutboundItem is a message waiting to be sent
+type OutboundItem struct {
+	ID         string       `json:"id"`
+	Kind       OutboundKind `json:"kind"`
+	From       string       `json:"from,omitempty"`
+	To         []string     `json:"to,omitempty"`
+	Data       []byte       `json:"data"`
+	Attempts   int          `json:"attempts"`
+	LastError  string       `json:"last_error,omitempty"`
+	EnqueuedAt time.Time    `json:"enqueued_at"`
+}
+
+// OutboundSender performs the actual delivery of an item. It makes a single
+// attempt, the queue retrying the items that failed: an error with a
+// Retryable method returning false is a permanent failure, and its item is
+// moved to the dead-letter directory at once.
+type OutboundSender func(item *OutboundItem) error
+
+// permanentFailure reports whether sending the item again cannot fix err
+func permanentFailure(err error) bool {
+	var retryable interface{ Retryable() bool }
+	return errors.As(err, &retryable) && !retryable.Retryable()
+}
+
+// OutboundQueue is a filesystem-backed queue of outbound receipts and forwards.
+// Each item is stored as a JSON file in the queue directory until it is sent,
+// so pending obligations survive a restart. Items failing more than
+// MaxAttempts times are moved to the dead-letter subdirectory, and files that
+// cannot be decoded to the quarantine one, for an operator to inspect.
+type OutboundQueue struct {
+	dir    string
+	sender OutboundSender
+
+	// Interval between two passes of the worker
+	Interval time.Duration
+	// MaxAttempts before an item is moved to the dead-letter directory
+	MaxAttempts int
+	// OnDeadLetter, if set, is called when an item is given up
+	OnDeadLetter func(item *OutboundItem, err error)
+
+	mu       sync.Mutex
+	replayMu sync.Mutex // one replay at a time, so an item is sent once
+	stop     chan struct{}
+	done     chan struct{}
+	wakeup   chan struct{}
+}
+
+// NewOutboundQueue opens (or creates) a queue stored in dir
+func NewOutboundQueue(dir string, sender OutboundSender) (*OutboundQueue, error) {
+	if err := os.MkdirAll(filepath.Join(dir, deadLetterDir), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create queue directory: %w", err)
+	}
+	return &OutboundQueue{
+		dir:         dir,
+		sender:      sender,
+		Interval:    defaultQueueInterval,
+		MaxAttempts: defaultQueueMaxAttempts,
+		wakeup:      make(chan struct{}, 1),
+	}, nil
+}
+
+// Enqueue persists an item and wakes up the worker
+func (q *OutboundQueue) Enqueue(item OutboundItem) error {
+	if item.ID == "" {
+		item.ID = newQueueItemID()
+	}
+	if item.EnqueuedAt.IsZero() {
+		item.EnqueuedAt = time.Now()
+	}
+	if err := q.write(q.dir, &item); err != nil {
+		return err
+	}
+	q.updateDepth()
+
+	select {
+	case q.wakeup <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Pending returns the items waiting to be sent, oldest first
+func (q *OutboundQueue) Pending() ([]*OutboundItem, error) {
+	return q.list(q.dir)
+}
+
+// Start runs the worker in the background until Stop is called
+func (q *OutboundQueue) Start() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.stop != nil {
+		return
+	}
+	q.stop = make(chan struct{})
+	q.done = make(chan struct{})
+
+	go func(stop, done chan struct{}) {
+		defer close(done)
+		ticker := time.NewTicker(q.Interval)
+		defer ticker.Stop()
+		for {
+			q.ProcessPending()
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			case <-q.wakeup:
+			}
+		}
+	}(q.stop, q.done)
+}
+
+// Stop halts the worker and waits for the current pass to complete
+func (q *OutboundQueue) Stop() {
+	q.mu.Lock()
+	stop, done := q.stop, q.done
+	q.stop, q.done = nil, nil
+	q.mu.Unlock()
+
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+}
+
+// ProcessPending makes one attempt at sending every pending item
+func (q *OutboundQueue) ProcessPending() {
+	items, err := q.list(q.dir)
+	if err != nil {
+		logger.LogError("Failed to list outbound queue", err, map[string]string{"dir": q.dir})
+		return
+	}
+	defer q.updateDepth()
+
+	for _, item := range items {
+		sendErr := q.sender(item)
+		if sendErr == nil {
+			if err := os.Remove(q.path(q.dir, item.ID)); err != nil {
+				logger.LogError("Failed to remove sent item", err, map[string]string{"id": item.ID})
+			}
+			continue
+		}
+
+		item.Attempts++
+		item.LastError = sendErr.Error()
+		ctx := map[string]string{
+			"id":       item.ID,
+			"kind":     string(item.Kind),
+			"attempts": strconv.Itoa(item.Attempts),
+		}
+
+		if permanentFailure(sendErr) || (q.MaxAttempts > 0 && item.Attempts >= q.MaxAttempts) {
+			logger.LogError("Giving up outbound item", sendErr, ctx)
+			if err := q.moveToDeadLetter(item); err != nil {
+				logger.LogError("Failed to move item to dead-letter", err, ctx)
+			}
+			if q.OnDeadLetter != nil {
+				q.OnDeadLetter(item, sendErr)
+			}
+			continue
+		}
+
+		logger.LogError("Failed to send outbound item", sendErr, ctx)
+		if err := q.write(q.dir, item); err != nil {
+			logger.LogError("Failed to update outbound item", err, ctx)
+		}
+	}
+}
+
+// DeadLetters returns the items given up, oldest first
+func (q *OutboundQueue) DeadLetters() ([]*OutboundItem, error) {
+	return q.list(filepath.Join(q.dir, deadLetterDir))
+}
+
+// Replay makes one more attempt at sending the dead-letter item id, for an
+// operator who fixed the cause of the failure. A sent item leaves the
+// dead-letter directory; otherwise it stays there with the attempt counted.
+// The item is returned along with the error of the attempt.
+func (q *OutboundQueue) Replay(id string) (*OutboundItem, error) {
+	q.replayMu.Lock()
+	defer q.replayMu.Unlock()
+
+	items, err := q.DeadLetters()
+	if err != nil {
+		return nil, err
+	}
+	var item *OutboundItem
+	for _, dead := range items {
+		if dead.ID == id {
+			item = dead
+			break
+		}
+	}
+	if item == nil {
+		return nil, fmt.Errorf("%w: %s", ErrDeadLetterNotFound, id)
+	}
+
+	dir := filepath.Join(q.dir, deadLetterDir)
+	if sendErr := q.sender(item); sendErr != nil {
+		item.Attempts++
+		item.LastError = sendErr.Error()
+		if err := q.write(dir, item); err != nil {
+			logger.LogError("Failed to update dead-letter item", err, map[string]string{"id": item.ID})
+		}
+		return item, sendErr
+	}
+	if err := os.Remove(q.path(dir, item.ID)); err != nil {
+		logger.LogError("Failed to remove replayed item", err, map[string]string{"id": item.ID})
+	}
+	return item, nil
+}
+
+// updateDepth publishes the number of pending items
+func (q *OutboundQueue) updateDepth() {
+	items, err := q.list(q.dir)
+	if err != nil {
+		return
+	}
+	metrics.QueueDepth.Set(int64(len(items)))
+}
+
+// moveToDeadLetter stores the item in the dead-letter directory
+func (q *OutboundQueue) moveToDeadLetter(item *OutboundItem) error {
+	if err := q.write(filepath.Join(q.dir, deadLetterDir), item); err != nil {
+		return err
+	}
+	return os.Remove(q.path(q.dir, item.ID))
+}
+
+// write atomically stores an item in dir
+func (q *OutboundQueue) write(dir string, item *OutboundItem) error {
+	data, err := json.Marshal(item)
+	if err != nil {
+		return fmt.Errorf("failed to encode queue item: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create queue item: %w", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write queue item: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to sync queue item: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to close queue item: %w", err)
+	}
+	return os.Rename(tmp.Name(), q.path(dir, item.ID))
+}
+
+// quarantine moves the item file name of dir to the quarantine subdirectory
+func (q *OutboundQueue) quarantine(dir, name string) error {
+	quarantineDir := filepath.Join(q.dir, queueQuarantineDir)
+	if err := os.MkdirAll(quarantineDir, 0755); err != nil {
+		return fmt.Errorf("failed to create quarantine directory: %w", err)
+	}
+	if err := os.Rename(filepath.Join(dir, name), filepath.Join(quarantineDir, name)); err != nil {
+		return fmt.Errorf("failed to quarantine queue item: %w", err)
+	}
+	return nil
+}
+
+// list reads all the items stored in dir, oldest first. Items that cannot be
+// decoded are quarantined, so that they do not hold up the others.
+func (q *OutboundQueue) list(dir string) ([]*OutboundItem, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read queue directory: %w", err)
+	}
+
+	var items []*OutboundItem
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read queue item: %w", err)
+		}
+		var item OutboundItem
+		if err := json.Unmarshal(data, &item); err != nil {
+			logger.LogError("Failed to decode queue item, quarantining it", err, map[string]string{"file": entry.Name()})
+			if qErr := q.quarantine(dir, entry.Name()); qErr != nil {
+				return nil, qErr
+			}
+			continue
+		}
+		items = append(items, &item)
+	}
+
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].EnqueuedAt.Before(items[j].EnqueuedAt)
+	})
+	return items, nil
+}
+
+func (q *OutboundQueue) path(dir, id string) string {
+	return filepath.Join(dir, id+".json")
+}
+
+// newQueueItemID returns a unique, time-ordered identifier
+func newQueueItemID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return fmt.Sprintf("%d-%s", time.Now().UnixNano(), hex.EncodeToString(b))
+}
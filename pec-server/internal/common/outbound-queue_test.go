@@ -0,0 +1,250 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingSender collects the items it is asked to send
+type recordingSender struct {
+	mu    sync.Mutex
+	items []*OutboundItem
+	err   error
+}
+
+func (r *recordingSender) send(item *OutboundItem) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return r.err
+	}
+	r.items = append(r.items, item)
+	return nil
+}
+
+func (r *recordingSender) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.items)
+}
+
+// TestOutboundQueue_SurvivesRestart tests that an item enqueued before a restart is still sent
+func TestOutboundQueue_SurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+
+	// First instance: enqueue but never send
+	failing := &recordingSender{err: errors.New("not started")}
+	queue, err := NewOutboundQueue(dir, failing.send)
+	if err != nil {
+		t.Fatalf("NewOutboundQueue failed: %v", err)
+	}
+	item := OutboundItem{
+		Kind: OutboundSMTP,
+		From: "posta-certificata@example.com",
+		To:   []string{"sender@example.com"},
+		Data: []byte("Subject: receipt\r\n\r\nbody\r\n"),
+	}
+	if err := queue.Enqueue(item); err != nil {
+		t.Fatalf("Enqueue failed: %v", err)
+	}
+
+	// Second instance on the same directory: the item must be picked up
+	sender := &recordingSender{}
+	restarted, err := NewOutboundQueue(dir, sender.send)
+	if err != nil {
+		t.Fatalf("NewOutboundQueue failed: %v", err)
+	}
+	restarted.Interval = 10 * time.Millisecond
+	restarted.Start()
+	defer restarted.Stop()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for sender.count() == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	restarted.Stop()
+
+	if sender.count() != 1 {
+		t.Fatalf("Expected 1 item to be sent, got %d", sender.count())
+	}
+	sent := sender.items[0]
+	if string(sent.Data) != string(item.Data) {
+		t.Errorf("Expected data %q, got %q", item.Data, sent.Data)
+	}
+	if len(sent.To) != 1 || sent.To[0] != "sender@example.com" {
+		t.Errorf("Unexpected recipients: %v", sent.To)
+	}
+
+	pending, err := restarted.Pending()
+	if err != nil {
+		t.Fatalf("Pending failed: %v", err)
+	}
+	if len(pending) != 0 {
+		t.Errorf("Expected queue to be empty after sending, got %d items", len(pending))
+	}
+}
+
+// TestOutboundQueue_RetriesAndDeadLetter tests that failing items are retried, then dead-lettered
+func TestOutboundQueue_RetriesAndDeadLetter(t *testing.T) {
+	dir := t.TempDir()
+	sender := &recordingSender{err: errors.New("connection refused")}
+	queue, err := NewOutboundQueue(dir, sender.send)
+	if err != nil {
+		t.Fatalf("NewOutboundQueue failed: %v", err)
+	}
+	queue.MaxAttempts = 2
+
+	var deadItem *OutboundItem
+	queue.OnDeadLetter = func(item *OutboundItem, err error) {
+		deadItem = item
+	}
+
+	if err := queue.Enqueue(OutboundItem{Kind: OutboundHTTP, Data: []byte("data")}); err != nil {
+		t.Fatalf("Enqueue failed: %v", err)
+	}
+
+	queue.ProcessPending()
+	pending, _ := queue.Pending()
+	if len(pending) != 1 || pending[0].Attempts != 1 || pending[0].LastError != "connection refused" {
+		t.Fatalf("Expected item to stay queued after first failure, got %+v", pending)
+	}
+
+	queue.ProcessPending()
+	pending, _ = queue.Pending()
+	if len(pending) != 0 {
+		t.Errorf("Expected item to leave the queue, got %d items", len(pending))
+	}
+	if deadItem == nil || deadItem.Attempts != 2 {
+		t.Fatalf("Expected OnDeadLetter to be called after 2 attempts, got %+v", deadItem)
+	}
+
+	entries, err := os.ReadDir(filepath.Join(dir, deadLetterDir))
+	if err != nil {
+		t.Fatalf("Failed to read dead-letter directory: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("Expected 1 dead-letter item, got %d", len(entries))
+	}
+}
+
+// permanentError is a send failure that a later attempt cannot fix
+type permanentError struct{}
+
+func (permanentError) Error() string   { return "rejected" }
+func (permanentError) Retryable() bool { return false }
+
+// TestOutboundQueue_PermanentFailure tests that an item failing for good is
+// dead-lettered after its first attempt
+func TestOutboundQueue_PermanentFailure(t *testing.T) {
+	sender := &recordingSender{err: fmt.Errorf("delivery failed: %w", permanentError{})}
+	queue, err := NewOutboundQueue(t.TempDir(), sender.send)
+	if err != nil {
+		t.Fatalf("NewOutboundQueue failed: %v", err)
+	}
+	var deadItem *OutboundItem
+	queue.OnDeadLetter = func(item *OutboundItem, err error) {
+		deadItem = item
+	}
+	if err := queue.Enqueue(OutboundItem{Kind: OutboundHTTP, Data: []byte("data")}); err != nil {
+		t.Fatalf("Enqueue failed: %v", err)
+	}
+
+	queue.ProcessPending()
+	if pending, _ := queue.Pending(); len(pending) != 0 {
+		t.Errorf("Expected the item to leave the queue, got %d items", len(pending))
+	}
+	if deadItem == nil || deadItem.Attempts != 1 {
+		t.Errorf("Expected OnDeadLetter to be called after 1 attempt, got %+v", deadItem)
+	}
+}
+
+// TestOutboundQueue_Quarantine tests that a file that cannot be decoded is
+// quarantined and does not stop the other items from being sent
+func TestOutboundQueue_Quarantine(t *testing.T) {
+	dir := t.TempDir()
+	sender := &recordingSender{}
+	queue, err := NewOutboundQueue(dir, sender.send)
+	if err != nil {
+		t.Fatalf("NewOutboundQueue failed: %v", err)
+	}
+	if err := queue.Enqueue(OutboundItem{Kind: OutboundSMTP, Data: []byte("data")}); err != nil {
+		t.Fatalf("Enqueue failed: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "truncated.json"), []byte(`{"id":"trunc`), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, deadLetterDir, "garbage.json"), []byte("not json"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	queue.ProcessPending()
+	if sender.count() != 1 {
+		t.Errorf("Expected the valid item to be sent, got %d", sender.count())
+	}
+	if dead, err := queue.DeadLetters(); err != nil || len(dead) != 0 {
+		t.Errorf("Expected no dead-letter items, got %d and %v", len(dead), err)
+	}
+	for _, name := range []string{"truncated.json", "garbage.json"} {
+		if _, err := os.Stat(filepath.Join(dir, queueQuarantineDir, name)); err != nil {
+			t.Errorf("Expected %s to be quarantined: %v", name, err)
+		}
+	}
+}
+
+// TestOutboundQueue_Replay tests that a dead-letter item replayed while the
+// failure persists stays there, and leaves once it is sent
+func TestOutboundQueue_Replay(t *testing.T) {
+	sender := &recordingSender{err: errors.New("connection refused")}
+	queue, err := NewOutboundQueue(t.TempDir(), sender.send)
+	if err != nil {
+		t.Fatalf("NewOutboundQueue failed: %v", err)
+	}
+	queue.MaxAttempts = 1
+
+	if err := queue.Enqueue(OutboundItem{Kind: OutboundHTTP, Data: []byte("data")}); err != nil {
+		t.Fatalf("Enqueue failed: %v", err)
+	}
+	queue.ProcessPending()
+	dead, err := queue.DeadLetters()
+	if err != nil {
+		t.Fatalf("DeadLetters failed: %v", err)
+	}
+	if len(dead) != 1 {
+		t.Fatalf("Expected 1 dead-letter item, got %d", len(dead))
+	}
+	id := dead[0].ID
+
+	if _, err := queue.Replay(id); err == nil {
+		t.Fatal("Expected the replay to fail while the sender fails")
+	}
+	dead, _ = queue.DeadLetters()
+	if len(dead) != 1 || dead[0].Attempts != 2 {
+		t.Fatalf("Expected the item to stay dead-lettered with 2 attempts, got %+v", dead)
+	}
+
+	sender.mu.Lock()
+	sender.err = nil
+	sender.mu.Unlock()
+	item, err := queue.Replay(id)
+	if err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	if item.ID != id || sender.count() != 1 || string(sender.items[0].Data) != "data" {
+		t.Errorf("Expected item %s to be sent, got %+v", id, sender.items)
+	}
+	if dead, _ := queue.DeadLetters(); len(dead) != 0 {
+		t.Errorf("Expected the dead-letter directory to be empty, got %d items", len(dead))
+	}
+	if pending, _ := queue.Pending(); len(pending) != 0 {
+		t.Errorf("Expected no pending items, got %d", len(pending))
+	}
+
+	if _, err := queue.Replay(id); !errors.Is(err, ErrDeadLetterNotFound) {
+		t.Errorf("Expected ErrDeadLetterNotFound replaying again, got %v", err)
+	}
+}
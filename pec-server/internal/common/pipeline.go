@@ -0,0 +1,52 @@
+package common
+
+// Step is a stage of the processing of the message of a session. It hands
+// the session over to the following stages by calling next, and may act
+// before and after them; returning without calling next ends the processing
+// of the message, successfully when it returns nil.
+type Step func(s *Session, next func(*Session) error) error
+
+// Pipeline is a session handler made of steps run in order. The steps are
+// set up before the server starts; the pipeline is then safe for concurrent
+// use.
+type Pipeline struct {
+	steps []Step
+}
+
+// NewPipeline returns a pipeline running steps in order
+func NewPipeline(steps ...Step) *Pipeline {
+	return &Pipeline{steps: steps}
+}
+
+// Use inserts steps ahead of the steps of the pipeline, so that they see
+// the message first and the outcome of the following steps last
+func (p *Pipeline) Use(steps ...Step) {
+	p.steps = append(append([]Step{}, steps...), p.steps...)
+}
+
+// Handle runs the steps of the pipeline on the session; it is the handler
+// of the SMTP backend
+func (p *Pipeline) Handle(s *Session) error {
+	return p.run(0, s)
+}
+
+// run runs the steps from the i-th on
+func (p *Pipeline) run(i int, s *Session) error {
+	if i == len(p.steps) {
+		return nil
+	}
+	return p.steps[i](s, func(s *Session) error {
+		return p.run(i+1, s)
+	})
+}
+
+// HandlerStep makes a step of a handler: the following steps run once it
+// succeeds
+func HandlerStep(handler func(*Session) error) Step {
+	return func(s *Session, next func(*Session) error) error {
+		if err := handler(s); err != nil {
+			return err
+		}
+		return next(s)
+	}
+}
@@ -0,0 +1,57 @@
+package common
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// recordingStep records its name before and after the following steps
+func recordingStep(name string, trace *[]string) Step {
+	return func(s *Session, next func(*Session) error) error {
+		*trace = append(*trace, name+" before")
+		err := next(s)
+		*trace = append(*trace, name+" after")
+		return err
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	var trace []string
+	pipeline := NewPipeline(recordingStep("default", &trace), HandlerStep(func(*Session) error {
+		trace = append(trace, "handler")
+		return nil
+	}))
+	pipeline.Use(recordingStep("first", &trace), recordingStep("second", &trace))
+
+	if err := pipeline.Handle(&Session{}); err != nil {
+		t.Fatalf("Handle failed: %v", err)
+	}
+	want := []string{"first before", "second before", "default before", "handler", "default after", "second after", "first after"}
+	if !reflect.DeepEqual(trace, want) {
+		t.Errorf("Expected %v, got %v", want, trace)
+	}
+}
+
+func TestPipeline_Stop(t *testing.T) {
+	refused := errors.New("refused")
+	ran := false
+	last := func(s *Session, next func(*Session) error) error {
+		ran = true
+		return next(s)
+	}
+
+	// A failing handler stops the pipeline with its error
+	pipeline := NewPipeline(HandlerStep(func(*Session) error { return refused }), last)
+	if err := pipeline.Handle(&Session{}); !errors.Is(err, refused) {
+		t.Errorf("Expected %v, got %v", refused, err)
+	}
+	// A step not calling next ends the processing
+	pipeline = NewPipeline(func(*Session, func(*Session) error) error { return nil }, last)
+	if err := pipeline.Handle(&Session{}); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+	if ran {
+		t.Error("Expected the steps after a stop not to run")
+	}
+}
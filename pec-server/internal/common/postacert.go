@@ -0,0 +1,75 @@
+package common
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/danzipie/go-pec/pec"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+)
+
+// ErrInvalidSenderSignature is returned when the original message of a
+// transport envelope is signed, but not validly by its sender
+var ErrInvalidSenderSignature = errors.New("invalid signature of the sender on the original message")
+
+// VerifyEnvelopePostacert verifies the signature of the sender on the
+// original message postacert.eml of the transport envelope raw, see
+// VerifyPostacert
+func VerifyEnvelopePostacert(raw []byte) (*x509.Certificate, error) {
+	postacert, err := pec.ExtractPostacert(raw)
+	if err != nil {
+		return nil, err
+	}
+	return VerifyPostacert(postacert)
+}
+
+// VerifyPostacert verifies the S/MIME signature of the sender on postacert,
+// the original message of a transport envelope, and returns the certificate
+// of the sender. The senders are not required to sign their messages: an
+// original message not signed is accepted with a nil certificate. A signed
+// one must be signed validly by a certificate issued to the address of its
+// From field, or ErrInvalidSenderSignature is returned.
+func VerifyPostacert(postacert []byte) (*x509.Certificate, error) {
+	postacert = toCRLF(postacert)
+	entity, err := message.Read(bytes.NewReader(postacert))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse original message: %v", err)
+	}
+	if !isSignedEntity(entity) {
+		return nil, nil
+	}
+
+	header := mail.Header{Header: entity.Header}
+	from, err := header.AddressList("From")
+	if err != nil || len(from) != 1 {
+		return nil, fmt.Errorf("%w: no single sender in the From field", ErrInvalidSenderSignature)
+	}
+	cert, err := VerifySignedMessage(postacert)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSenderSignature, err)
+	}
+	if err := pec.CheckSignerIdentity(cert, from[0].Address, pec.IdentityStrict); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSenderSignature, err)
+	}
+	return cert, nil
+}
+
+// isSignedEntity reports whether the message is S/MIME signed, rather than
+// plain or only encrypted
+func isSignedEntity(entity *message.Entity) bool {
+	mediaType, params, err := entity.Header.ContentType()
+	if err != nil {
+		return false
+	}
+	switch mediaType {
+	case "multipart/signed":
+		return true
+	case "application/pkcs7-mime", "application/x-pkcs7-mime":
+		return !strings.EqualFold(params["smime-type"], "enveloped-data")
+	}
+	return false
+}
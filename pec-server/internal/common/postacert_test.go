@@ -0,0 +1,68 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/danzipie/go-pec/pec"
+)
+
+// testSignedPostacertEnvelope is a transport envelope whose original message
+// is signed by its sender, sender@example.com
+const testSignedPostacertEnvelope = "testdata/envelope-signed-postacert.eml"
+
+func TestVerifyEnvelopePostacert(t *testing.T) {
+	data, err := os.ReadFile(testSignedPostacertEnvelope)
+	if err != nil {
+		t.Fatalf("Failed to read fixture: %v", err)
+	}
+	if err := pec.ValidateEnvelopeStructure(data); err != nil {
+		t.Fatalf("Expected the MIME structure of a transport envelope, got %v", err)
+	}
+
+	cert, err := VerifyEnvelopePostacert(data)
+	if err != nil {
+		t.Fatalf("VerifyEnvelopePostacert failed: %v", err)
+	}
+	if cert == nil || len(cert.EmailAddresses) != 1 || cert.EmailAddresses[0] != "sender@example.com" {
+		t.Errorf("Expected the certificate of the sender, got %v", cert)
+	}
+
+	// The original message altered on the way fails the signature of the sender
+	postacert, err := pec.ExtractPostacert(data)
+	if err != nil {
+		t.Fatalf("ExtractPostacert failed: %v", err)
+	}
+	altered := bytes.Replace(postacert, []byte("Messaggio firmato dal mittente"), []byte("Messaggio alterato"), 1)
+	if _, err := VerifyPostacert(altered); !errors.Is(err, ErrInvalidSenderSignature) {
+		t.Errorf("Expected ErrInvalidSenderSignature for an altered message, got %v", err)
+	}
+}
+
+func TestVerifyPostacert(t *testing.T) {
+	cert, key := createTestCertAndKey(t)
+	signer := &Signer{Cert: cert, Key: key}
+	signed, err := signer.CreateSignedMimeMessage([]byte("Content-Type: text/plain\r\n\r\nHello\r\n"))
+	if err != nil {
+		t.Fatalf("Failed to sign message: %v", err)
+	}
+
+	// An original message not signed is accepted
+	cert, err = VerifyPostacert([]byte("From: sender@example.com\r\nSubject: test\r\n\r\nHello\r\n"))
+	if err != nil || cert != nil {
+		t.Errorf("Expected an unsigned message to be accepted without certificate, got %v (%v)", cert, err)
+	}
+
+	// A message signed by its sender, test@example.com
+	cert, err = VerifyPostacert(append([]byte("From: test@example.com\r\n"), signed...))
+	if err != nil || cert == nil {
+		t.Errorf("Expected a message signed by its sender to be accepted, got %v", err)
+	}
+
+	// The same signature on a message of another sender
+	if _, err := VerifyPostacert(append([]byte("From: sender@example.com\r\n"), signed...)); !errors.Is(err, ErrInvalidSenderSignature) {
+		t.Errorf("Expected ErrInvalidSenderSignature for a message signed by another, got %v", err)
+	}
+}
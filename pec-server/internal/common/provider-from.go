@@ -0,0 +1,67 @@
+package common
+
+import (
+	"net/mail"
+	"strings"
+)
+
+// providerMailbox is the local-part of the address the provider issues its
+// receipts, notices and envelopes from
+const providerMailbox = "posta-certificata"
+
+// defaultOnBehalfName is the display name of the envelopes sent on behalf of
+// a sender
+const defaultOnBehalfName = "Per conto di: {sender}"
+
+// ProviderFrom composes the From field of the messages issued by a provider.
+// Its display names are templates where {domain} stands for the domain of
+// the provider and {sender} for the original sender; the zero value gives
+// the defaults.
+type ProviderFrom struct {
+	// Name is the display name of the receipts and notices, none when empty
+	Name string
+	// OnBehalfName is the display name of the transport and anomaly
+	// envelopes, "Per conto di: {sender}" when empty
+	OnBehalfName string
+}
+
+// NewProviderFrom returns the display names configured for the provider
+func NewProviderFrom(cfg *Config) ProviderFrom {
+	return ProviderFrom{Name: cfg.ProviderDisplayName, OnBehalfName: cfg.OnBehalfDisplayName}
+}
+
+// Address returns the From address of the receipts and notices of domain
+func (p ProviderFrom) Address(domain string) *mail.Address {
+	return &mail.Address{
+		Name:    expandDisplayName(p.Name, domain, ""),
+		Address: providerMailbox + "@" + domain,
+	}
+}
+
+// OnBehalfOf returns the From address of the envelopes domain sends on
+// behalf of sender
+func (p ProviderFrom) OnBehalfOf(domain, sender string) *mail.Address {
+	name := p.OnBehalfName
+	if name == "" {
+		name = defaultOnBehalfName
+	}
+	return &mail.Address{
+		Name:    expandDisplayName(name, domain, sender),
+		Address: providerMailbox + "@" + domain,
+	}
+}
+
+// expandDisplayName replaces the placeholders of a display name template
+func expandDisplayName(template, domain, sender string) string {
+	return strings.NewReplacer("{domain}", domain, "{sender}", sender).Replace(template)
+}
+
+// FormatAddress formats addr for a header field, RFC 2047 encoding a display
+// name that is not plain ASCII; an address without display name is written
+// bare.
+func FormatAddress(addr *mail.Address) string {
+	if addr.Name == "" {
+		return addr.Address
+	}
+	return addr.String()
+}
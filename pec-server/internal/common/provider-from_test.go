@@ -0,0 +1,58 @@
+package common
+
+import (
+	"net/mail"
+	"testing"
+)
+
+func TestProviderFrom(t *testing.T) {
+	tests := []struct {
+		name         string
+		from         ProviderFrom
+		wantName     string
+		wantOnBehalf string
+	}{
+		{"default", ProviderFrom{}, "", "Per conto di: sender@example.com"},
+		{
+			"configured", ProviderFrom{Name: "Posta Certificata {domain}", OnBehalfName: "{sender} via {domain}"},
+			"Posta Certificata testdomain.com", "sender@example.com via testdomain.com",
+		},
+		{
+			"non-ASCII", ProviderFrom{Name: "Posta Certificata Città", OnBehalfName: "Inviato per conto di {sender} – Città"},
+			"Posta Certificata Città", "Inviato per conto di sender@example.com – Città",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for value, want := range map[string]string{
+				FormatAddress(tt.from.Address("testdomain.com")):                          tt.wantName,
+				FormatAddress(tt.from.OnBehalfOf("testdomain.com", "sender@example.com")): tt.wantOnBehalf,
+			} {
+				for _, b := range []byte(value) {
+					if b > 127 {
+						t.Fatalf("Expected an encoded From, got %q", value)
+					}
+				}
+				parser := mail.AddressParser{WordDecoder: wordDecoder}
+				addr, err := parser.Parse(value)
+				if err != nil {
+					t.Fatalf("Failed to parse From %q: %v", value, err)
+				}
+				if addr.Name != want || addr.Address != "posta-certificata@testdomain.com" {
+					t.Errorf("Expected From %q <posta-certificata@testdomain.com>, got %q", want, value)
+				}
+			}
+		})
+	}
+
+	if got := FormatAddress(ProviderFrom{}.Address("testdomain.com")); got != "posta-certificata@testdomain.com" {
+		t.Errorf("Expected a bare address without display name, got %q", got)
+	}
+}
+
+func TestNewProviderFrom(t *testing.T) {
+	from := NewProviderFrom(&Config{ProviderDisplayName: "Posta Certificata", OnBehalfDisplayName: "Per conto di {sender}"})
+	if from.Name != "Posta Certificata" || from.OnBehalfName != "Per conto di {sender}" {
+		t.Errorf("Expected the configured display names, got %+v", from)
+	}
+}
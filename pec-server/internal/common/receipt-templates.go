@@ -0,0 +1,181 @@
+package common
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/danzipie/go-pec/pec"
+)
+
+// DefaultReceiptLocale is the locale of the embedded receipt templates
+const DefaultReceiptLocale = "it"
+
+// ReceiptAnomalia names the template of the anomaly envelope body, which is
+// not a receipt but is worded like one
+const ReceiptAnomalia = "anomalia"
+
+// receiptKinds are the bodies every locale must provide a text template for;
+// the HTML templates are optional
+var receiptKinds = []string{
+	pec.TipoAccettazione,
+	pec.TipoNonAccettazione,
+	pec.TipoPresaInCarico,
+	pec.TipoAvvenutaConsegna,
+	pec.TipoErroreConsegna,
+	ReceiptAnomalia,
+}
+
+// embeddedReceiptTemplates holds <locale>/<kind>.txt and <locale>/<kind>.html
+//
+//go:embed receipt-templates
+var embeddedReceiptTemplates embed.FS
+
+var receiptFuncs = map[string]any{
+	"join": strings.Join,
+}
+
+// ReceiptData holds the values the receipt templates are rendered with
+type ReceiptData struct {
+	Date           time.Time
+	Subject        string
+	From           string
+	To             []string
+	Cc             []string // recipients in copy, listed apart from To
+	MessageID      string   // Message-ID of the original message
+	Identificativo string   // identifier of the receipt itself
+	Reason         string
+
+	// Text is the rendered text body, set when rendering an HTML template
+	Text string
+}
+
+// ReceiptTemplates renders the human-readable bodies of the receipts
+type ReceiptTemplates struct {
+	text map[string]*texttemplate.Template
+	html map[string]*htmltemplate.Template
+}
+
+// DefaultReceiptTemplates returns the embedded templates of the default locale
+func DefaultReceiptTemplates() *ReceiptTemplates {
+	t, err := NewReceiptTemplates("", DefaultReceiptLocale)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// LoadReceiptTemplates loads the receipt templates of the configured locale
+func LoadReceiptTemplates(cfg *Config) (*ReceiptTemplates, error) {
+	return NewReceiptTemplates(cfg.ReceiptTemplatesDir, cfg.ReceiptLocale)
+}
+
+// NewReceiptTemplates parses the templates of locale, looking them up in dir
+// before the embedded ones; a template missing for locale falls back to the
+// default locale
+func NewReceiptTemplates(dir, locale string) (*ReceiptTemplates, error) {
+	if locale == "" {
+		locale = DefaultReceiptLocale
+	}
+	embedded, err := fs.Sub(embeddedReceiptTemplates, "receipt-templates")
+	if err != nil {
+		return nil, err
+	}
+	sources := []fs.FS{embedded}
+	if dir != "" {
+		sources = []fs.FS{os.DirFS(dir), embedded}
+	}
+
+	t := &ReceiptTemplates{
+		text: make(map[string]*texttemplate.Template),
+		html: make(map[string]*htmltemplate.Template),
+	}
+	for _, kind := range receiptKinds {
+		name, src, err := findReceiptTemplate(sources, locale, kind+".txt")
+		if err != nil {
+			return nil, fmt.Errorf("no text template for %s receipts: %w", kind, err)
+		}
+		text, err := texttemplate.New(name).Funcs(receiptFuncs).Parse(src)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse receipt template %s: %w", name, err)
+		}
+		t.text[kind] = text
+
+		name, src, err = findReceiptTemplate(sources, locale, kind+".html")
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		html, err := htmltemplate.New(name).Funcs(receiptFuncs).Parse(src)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse receipt template %s: %w", name, err)
+		}
+		t.html[kind] = html
+	}
+	return t, nil
+}
+
+// findReceiptTemplate returns the first file named file of locale, then of
+// the default locale, in sources
+func findReceiptTemplate(sources []fs.FS, locale, file string) (string, string, error) {
+	locales := []string{locale}
+	if locale != DefaultReceiptLocale {
+		locales = append(locales, DefaultReceiptLocale)
+	}
+	for _, loc := range locales {
+		name := path.Join(loc, file)
+		for _, fsys := range sources {
+			data, err := fs.ReadFile(fsys, name)
+			if err == nil {
+				return name, string(data), nil
+			}
+			if !errors.Is(err, fs.ErrNotExist) {
+				return "", "", err
+			}
+		}
+	}
+	return "", "", fs.ErrNotExist
+}
+
+// Text renders the text body of the receipt of the given kind
+func (t *ReceiptTemplates) Text(kind string, data ReceiptData) (string, error) {
+	tmpl, ok := t.text[kind]
+	if !ok {
+		return "", fmt.Errorf("unknown receipt kind %q", kind)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("failed to render %s receipt: %w", kind, err)
+	}
+	return buf.String(), nil
+}
+
+// HTML renders the HTML body of the receipt of the given kind, exposing the
+// rendered text body to the template as .Text; the values are escaped for
+// their context, since the subject and addresses come from the sender
+func (t *ReceiptTemplates) HTML(kind string, data ReceiptData) (string, error) {
+	tmpl, ok := t.html[kind]
+	if !ok {
+		return "", fmt.Errorf("no HTML body for %s receipts", kind)
+	}
+	text, err := t.Text(kind, data)
+	if err != nil {
+		return "", err
+	}
+	data.Text = text
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("failed to render %s receipt: %w", kind, err)
+	}
+	return buf.String(), nil
+}
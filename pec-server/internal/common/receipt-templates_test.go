@@ -0,0 +1,160 @@
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/danzipie/go-pec/pec"
+)
+
+func testReceiptData() ReceiptData {
+	return ReceiptData{
+		Date:           time.Date(2026, 3, 9, 14, 5, 30, 0, time.FixedZone("CET", 3600)),
+		Subject:        "Fattura gennaio",
+		From:           "mittente@example.com",
+		To:             []string{"uno@example.com", "due@example.com"},
+		MessageID:      "<orig@example.com>",
+		Identificativo: "opec-id@example.com",
+		Reason:         "destinatario sconosciuto",
+	}
+}
+
+func TestDefaultReceiptTemplates_Text(t *testing.T) {
+	templates := DefaultReceiptTemplates()
+	tests := []struct {
+		kind    string
+		phrases []string
+	}{
+		{pec.TipoAccettazione, []string{
+			"-- Ricevuta di accettazione del messaggio indirizzato a uno@example.com, due@example.com (\"posta certificata\") --\n\n",
+			"Il giorno 09/03/2026 alle ore 14:05:30 (+0100) il messaggio con Oggetto\n",
+			"\"Fattura gennaio\" inviato da \"mittente@example.com\"\n",
+			"uno@example.com (\"posta certificata\")\ndue@example.com (\"posta certificata\")\n",
+			"è stato accettato dal sistema ed inoltrato.\n",
+			"Identificativo del messaggio: opec-id@example.com\n",
+		}},
+		{pec.TipoNonAccettazione, []string{
+			"Errore nell’accettazione del messaggio\n",
+			"Il giorno 09/03/2026 alle ore 14:05:30 (CET) nel messaggio\n",
+			"ed indirizzato a:\nuno@example.com\ndue@example.com\nè stato rilevato",
+			"a causa di destinatario sconosciuto.\nIl messaggio non è stato accettato.\n",
+			"Identificativo messaggio: <orig@example.com>\n",
+		}},
+		{pec.TipoPresaInCarico, []string{
+			"Ricevuta di presa in carico\n",
+			"ed indirizzato a:\nuno@example.com\ndue@example.com\n\nè stato accettato dal sistema.\n",
+		}},
+		{pec.TipoAvvenutaConsegna, []string{
+			"Ricevuta di avvenuta consegna\n",
+			"è stato consegnato nella casella di destinazione.\n",
+			"Identificativo messaggio: <orig@example.com>",
+		}},
+		{pec.TipoErroreConsegna, []string{
+			"Avviso di mancata consegna\n",
+			"\"Fattura gennaio\" non è stato consegnato a causa di:\ndestinatario sconosciuto\n",
+		}},
+		{ReceiptAnomalia, []string{
+			"Anomalia nel messaggio\n",
+			"Il giorno 09/03/2026 alle ore 14:05:30 (CET) è stato ricevuto\n",
+			"Tali dati non sono stati certificati per il seguente errore:\ndestinatario sconosciuto\n",
+			"Il messaggio originale è incluso in allegato.\n",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.kind, func(t *testing.T) {
+			text, err := templates.Text(tt.kind, testReceiptData())
+			if err != nil {
+				t.Fatalf("Text failed: %v", err)
+			}
+			for _, phrase := range tt.phrases {
+				if !strings.Contains(text, phrase) {
+					t.Errorf("Expected %q in:\n%s", phrase, text)
+				}
+			}
+		})
+	}
+}
+
+func TestDefaultReceiptTemplates_HTML(t *testing.T) {
+	templates := DefaultReceiptTemplates()
+
+	html, err := templates.HTML(pec.TipoAccettazione, testReceiptData())
+	if err != nil {
+		t.Fatalf("HTML failed: %v", err)
+	}
+	for _, phrase := range []string{
+		"<h3>Ricevuta di accettazione</h3>\n",
+		"Il messaggio &egrave; stato accettato dal sistema ed inoltrato.<br>\n",
+		"Identificativo messaggio: opec-id@example.com<br>\n",
+	} {
+		if !strings.Contains(html, phrase) {
+			t.Errorf("Expected %q in:\n%s", phrase, html)
+		}
+	}
+
+	html, err = templates.HTML(pec.TipoNonAccettazione, testReceiptData())
+	if err != nil {
+		t.Fatalf("HTML failed: %v", err)
+	}
+	if !strings.HasPrefix(html, "<html><body><pre>Errore nell’accettazione del messaggio\n") {
+		t.Errorf("Expected the text body wrapped in <pre>, got:\n%s", html)
+	}
+
+	if _, err := templates.HTML(pec.TipoPresaInCarico, testReceiptData()); err == nil {
+		t.Errorf("Expected an error for a receipt without an HTML body")
+	}
+}
+
+func TestReceiptTemplates_UnknownKind(t *testing.T) {
+	if _, err := DefaultReceiptTemplates().Text("sconosciuta", testReceiptData()); err == nil {
+		t.Errorf("Expected an error for an unknown receipt kind")
+	}
+}
+
+func TestNewReceiptTemplates_Override(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "en"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	override := "Acceptance receipt for \"{{.Subject}}\"\n"
+	if err := os.WriteFile(filepath.Join(dir, "en", "accettazione.txt"), []byte(override), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	templates, err := NewReceiptTemplates(dir, "en")
+	if err != nil {
+		t.Fatalf("NewReceiptTemplates failed: %v", err)
+	}
+	text, err := templates.Text(pec.TipoAccettazione, testReceiptData())
+	if err != nil {
+		t.Fatalf("Text failed: %v", err)
+	}
+	if text != "Acceptance receipt for \"Fattura gennaio\"\n" {
+		t.Errorf("Expected the overriding template, got %q", text)
+	}
+
+	// Receipts the locale does not translate fall back to the default locale
+	text, err = templates.Text(pec.TipoPresaInCarico, testReceiptData())
+	if err != nil {
+		t.Fatalf("Text failed: %v", err)
+	}
+	if !strings.HasPrefix(text, "Ricevuta di presa in carico\n") {
+		t.Errorf("Expected the default template, got %q", text)
+	}
+}
+
+func TestNewReceiptTemplates_InvalidOverride(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "it"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "it", "accettazione.txt"), []byte("{{.Subject"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewReceiptTemplates(dir, ""); err == nil {
+		t.Errorf("Expected an error for a malformed template")
+	}
+}
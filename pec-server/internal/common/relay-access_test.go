@@ -0,0 +1,187 @@
+package common
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/smtp"
+	"testing"
+)
+
+// mailFrom connects to addr, optionally authenticates, and returns the result of MAIL FROM
+func mailFrom(t *testing.T, addr string, authenticate bool) error {
+	t.Helper()
+	client, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+	if authenticate {
+		if err := client.Auth(smtp.PlainAuth("", "username", "password", "127.0.0.1")); err != nil {
+			t.Fatalf("Authentication failed: %v", err)
+		}
+	}
+	return client.Mail("sender@example.com")
+}
+
+// TestSession_TrustedNetworks tests relay access by source network and authentication
+func TestSession_TrustedNetworks(t *testing.T) {
+	tests := []struct {
+		name         string
+		networks     []string
+		authenticate bool
+		wantErr      bool
+	}{
+		{"allowed network", []string{"10.0.0.0/8", "127.0.0.0/8"}, false, false},
+		{"disallowed network", []string{"10.0.0.0/8"}, false, true},
+		{"no trusted networks", nil, false, true},
+		{"authenticated from a disallowed network", []string{"10.0.0.0/8"}, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			networks, err := ParseTrustedNetworks(tt.networks)
+			if err != nil {
+				t.Fatalf("ParseTrustedNetworks failed: %v", err)
+			}
+			backend := NewBackend(nil, nil, nil, nil, "example.com")
+			backend.TrustedNetworks = networks
+			backend.AllowInsecureAuth = true
+			addr := startTestSMTP(t, backend)
+
+			err = mailFrom(t, addr, tt.authenticate)
+			if tt.wantErr && err == nil {
+				t.Error("Expected MAIL FROM to be refused")
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("Expected MAIL FROM to be accepted, got %v", err)
+			}
+		})
+	}
+}
+
+// TestParseTrustedNetworks tests the parsing of CIDR ranges and single addresses
+func TestParseTrustedNetworks(t *testing.T) {
+	networks, err := ParseTrustedNetworks([]string{"192.0.2.0/24", "198.51.100.7", "2001:db8::/32"})
+	if err != nil {
+		t.Fatalf("ParseTrustedNetworks failed: %v", err)
+	}
+
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"192.0.2.10", true},
+		{"198.51.100.7", true},
+		{"198.51.100.8", false},
+		{"2001:db8::1", true},
+		{"203.0.113.1", false},
+	}
+	for _, tt := range tests {
+		if got := inNetworks(net.ParseIP(tt.ip), networks); got != tt.want {
+			t.Errorf("inNetworks(%s) = %v, expected %v", tt.ip, got, tt.want)
+		}
+	}
+
+	if _, err := ParseTrustedNetworks([]string{"not-a-network"}); err == nil {
+		t.Error("Expected an error for an invalid network")
+	}
+}
+
+// TestSession_SubmissionPolicy tests that the submission port requires authentication, even from a trusted network
+func TestSession_SubmissionPolicy(t *testing.T) {
+	networks, _ := ParseTrustedNetworks([]string{"127.0.0.0/8"})
+	backend := NewBackend(nil, nil, nil, nil, "example.com")
+	backend.TrustedNetworks = networks
+	backend.AllowInsecureAuth = true
+	backend.Policy = PolicySubmission
+	addr := startTestSMTP(t, backend)
+
+	if err := mailFrom(t, addr, false); err == nil {
+		t.Error("Expected MAIL FROM to be refused without authentication")
+	}
+	if err := mailFrom(t, addr, true); err != nil {
+		t.Errorf("Expected MAIL FROM to be accepted after authentication, got %v", err)
+	}
+}
+
+// TestSession_RelayPolicy tests that the relay port trusts peers by network and offers no authentication
+func TestSession_RelayPolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		networks []string
+		wantErr  bool
+	}{
+		{"trusted network", []string{"127.0.0.0/8"}, false},
+		{"untrusted network", []string{"10.0.0.0/8"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			networks, _ := ParseTrustedNetworks(tt.networks)
+			backend := NewBackend(nil, nil, nil, nil, "example.com")
+			backend.TrustedNetworks = networks
+			backend.AllowInsecureAuth = true
+			backend.Policy = PolicyRelay
+			addr := startTestSMTP(t, backend)
+
+			err := mailFrom(t, addr, false)
+			if tt.wantErr && err == nil {
+				t.Error("Expected MAIL FROM to be refused")
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("Expected MAIL FROM to be accepted, got %v", err)
+			}
+
+			client, err := smtp.Dial(addr)
+			if err != nil {
+				t.Fatalf("Failed to connect: %v", err)
+			}
+			defer client.Close()
+			if ok, _ := client.Extension("AUTH"); ok {
+				t.Error("Expected AUTH not to be advertised on the relay port")
+			}
+			if err := client.Auth(smtp.PlainAuth("", "username", "password", "127.0.0.1")); err == nil {
+				t.Error("Expected authentication to be refused on the relay port")
+			}
+		})
+	}
+}
+
+// TestSession_RelayClientCertificate tests that the relay port trusts peers presenting a certificate issued by the client CAs
+func TestSession_RelayClientCertificate(t *testing.T) {
+	ca := createTestCertificate(t, "Test Provider CA", true, nil)
+	provider := createTestCertificate(t, "pec.provider.example", false, &ca)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.Leaf)
+
+	cert, key := createTestCertAndKey(t)
+	backend := NewBackend(&Signer{Cert: cert, Key: key}, nil, nil, nil, "example.com")
+	backend.ClientCAs = clientCAs
+	backend.Policy = PolicyRelay
+	addr := startTestSMTP(t, backend)
+
+	// Without TLS the peer is not trusted
+	if err := mailFrom(t, addr, false); err == nil {
+		t.Error("Expected MAIL FROM to be refused without a client certificate")
+	}
+
+	client, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+	if err := client.StartTLS(&tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{provider}}); err != nil {
+		t.Fatalf("STARTTLS failed: %v", err)
+	}
+	if err := client.Mail("sender@example.com"); err != nil {
+		t.Errorf("Expected MAIL FROM to be accepted with a verified certificate, got %v", err)
+	}
+}
+
+// TestBackend_SubmissionNoClientCert tests that the submission port does not request client certificates
+func TestBackend_SubmissionNoClientCert(t *testing.T) {
+	backend := &Backend{ClientCAs: x509.NewCertPool(), Policy: PolicySubmission}
+	if config := backend.tlsConfig(); config.ClientAuth != tls.NoClientCert {
+		t.Errorf("Expected NoClientCert, got %v", config.ClientAuth)
+	}
+}
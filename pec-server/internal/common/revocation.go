@@ -0,0 +1,229 @@
+package common
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/danzipie/go-pec/pec-server/logger"
+	"golang.org/x/crypto/ocsp"
+)
+
+// defaultRevocationCacheTTL is how long revocation responses without a next
+// update are cached
+const defaultRevocationCacheTTL = time.Hour
+
+// maxRevocationResponse is the largest CRL or OCSP response downloaded
+const maxRevocationResponse = 10 << 20
+
+// ErrCertificateRevoked is returned when a certificate was revoked by its issuer
+var ErrCertificateRevoked = errors.New("certificate has been revoked")
+
+// ErrRevocationUnknown is returned under a fail-closed policy when neither
+// the OCSP responders nor the CRLs of a certificate could tell its status
+var ErrRevocationUnknown = errors.New("certificate revocation status unknown")
+
+// RevocationChecker checks that certificates were not revoked, asking the
+// OCSP responders of their AuthorityInfoAccess first and then downloading
+// the CRLs of their CRLDistributionPoints. Responses are cached until their
+// next update. A certificate naming no responder nor CRL is accepted.
+type RevocationChecker struct {
+	failClosed bool
+	ttl        time.Duration
+	client     *http.Client
+	now        func() time.Time
+
+	mu   sync.Mutex
+	ocsp map[string]*ocspCacheEntry // key: responder URL and certificate hash
+	crls map[string]*crlCacheEntry  // key: distribution point URL
+}
+
+// ocspCacheEntry is a cached OCSP response
+type ocspCacheEntry struct {
+	status  int
+	expires time.Time
+}
+
+// crlCacheEntry is a cached CRL, whose signature was checked
+type crlCacheEntry struct {
+	list    *x509.RevocationList
+	expires time.Time
+}
+
+// NewRevocationChecker returns a checker rejecting the certificates whose
+// status is unknown when failClosed, and accepting them otherwise. Responses
+// without a next update are cached for cacheTTL, an hour when zero.
+func NewRevocationChecker(failClosed bool, cacheTTL time.Duration) *RevocationChecker {
+	if cacheTTL <= 0 {
+		cacheTTL = defaultRevocationCacheTTL
+	}
+	return &RevocationChecker{
+		failClosed: failClosed,
+		ttl:        cacheTTL,
+		client:     &http.Client{Timeout: 10 * time.Second},
+		now:        time.Now,
+		ocsp:       make(map[string]*ocspCacheEntry),
+		crls:       make(map[string]*crlCacheEntry),
+	}
+}
+
+// CheckChain checks the certificates of a verified chain, each against the
+// next one as its issuer. The root is not checked, unless it is the only
+// certificate of the chain.
+func (c *RevocationChecker) CheckChain(chain []*x509.Certificate) error {
+	if len(chain) == 1 {
+		return c.Check(chain[0], chain[0])
+	}
+	for i := 0; i+1 < len(chain); i++ {
+		if err := c.Check(chain[i], chain[i+1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Check checks that cert, issued by issuer, was not revoked
+func (c *RevocationChecker) Check(cert, issuer *x509.Certificate) error {
+	if len(cert.OCSPServer) == 0 && len(cert.CRLDistributionPoints) == 0 {
+		return nil
+	}
+
+	var errs []error
+	for _, server := range cert.OCSPServer {
+		status, err := c.ocspStatus(server, cert, issuer)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		switch status {
+		case ocsp.Good:
+			return nil
+		case ocsp.Revoked:
+			return fmt.Errorf("%w: reported by %s", ErrCertificateRevoked, server)
+		}
+		errs = append(errs, fmt.Errorf("OCSP responder %s does not know the certificate", server))
+	}
+	for _, url := range cert.CRLDistributionPoints {
+		list, err := c.crl(url, issuer)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, entry := range list.RevokedCertificateEntries {
+			if entry.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+				return fmt.Errorf("%w: listed in %s", ErrCertificateRevoked, url)
+			}
+		}
+		return nil
+	}
+
+	return c.unknownStatus(cert, errors.Join(errs...))
+}
+
+// unknownStatus rejects cert, whose status could not be determined because
+// of err, when failing closed, and accepts it otherwise
+func (c *RevocationChecker) unknownStatus(cert *x509.Certificate, err error) error {
+	if c.failClosed {
+		return fmt.Errorf("%w: %v", ErrRevocationUnknown, err)
+	}
+	logger.LogWarn("Certificate revocation status unknown, accepting it", map[string]string{
+		"subject": cert.Subject.String(),
+		"error":   err.Error(),
+	})
+	return nil
+}
+
+// ocspStatus returns the status of cert from an OCSP responder, from the
+// cache when possible
+func (c *RevocationChecker) ocspStatus(server string, cert, issuer *x509.Certificate) (int, error) {
+	key := server + " " + CertificateHash(cert)
+	c.mu.Lock()
+	entry, ok := c.ocsp[key]
+	c.mu.Unlock()
+	if ok && c.now().Before(entry.expires) {
+		return entry.status, nil
+	}
+
+	request, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create OCSP request: %v", err)
+	}
+	body, err := c.fetch(http.MethodPost, server, request)
+	if err != nil {
+		return 0, err
+	}
+	response, err := ocsp.ParseResponseForCert(body, cert, issuer)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse OCSP response from %s: %v", server, err)
+	}
+
+	c.mu.Lock()
+	c.ocsp[key] = &ocspCacheEntry{status: response.Status, expires: c.expiry(response.NextUpdate)}
+	c.mu.Unlock()
+	return response.Status, nil
+}
+
+// crl returns the CRL published at url, checking that issuer signed it,
+// from the cache when possible
+func (c *RevocationChecker) crl(url string, issuer *x509.Certificate) (*x509.RevocationList, error) {
+	c.mu.Lock()
+	entry, ok := c.crls[url]
+	c.mu.Unlock()
+	if ok && c.now().Before(entry.expires) {
+		return entry.list, nil
+	}
+
+	body, err := c.fetch(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	list, err := x509.ParseRevocationList(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CRL from %s: %v", url, err)
+	}
+	if err := list.CheckSignatureFrom(issuer); err != nil {
+		return nil, fmt.Errorf("invalid CRL signature from %s: %v", url, err)
+	}
+
+	c.mu.Lock()
+	c.crls[url] = &crlCacheEntry{list: list, expires: c.expiry(list.NextUpdate)}
+	c.mu.Unlock()
+	return list, nil
+}
+
+// expiry returns until when a response is cached
+func (c *RevocationChecker) expiry(nextUpdate time.Time) time.Time {
+	if nextUpdate.IsZero() {
+		return c.now().Add(c.ttl)
+	}
+	return nextUpdate
+}
+
+// fetch downloads a CRL or posts an OCSP request
+func (c *RevocationChecker) fetch(method, url string, request []byte) ([]byte, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(request))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request for %s: %v", url, err)
+	}
+	if request != nil {
+		req.Header.Set("Content-Type", "application/ocsp-request")
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status from %s: %s", url, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxRevocationResponse))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response from %s: %v", url, err)
+	}
+	return body, nil
+}
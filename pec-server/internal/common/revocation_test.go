@@ -0,0 +1,284 @@
+package common
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/mail"
+	"golang.org/x/crypto/ocsp"
+)
+
+// testCA issues provider certificates and publishes their revocation status
+type testCA struct {
+	cert    *x509.Certificate
+	key     *rsa.PrivateKey
+	revoked map[string]bool // serial numbers
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test PEC CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse certificate: %v", err)
+	}
+	return &testCA{cert: cert, key: key, revoked: make(map[string]bool)}
+}
+
+// issue returns a certificate naming the given OCSP responder and CRL
+func (ca *testCA) issue(t *testing.T, serial int64, ocspServer, crlURL string) *x509.Certificate {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "posta-certificata@example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	if ocspServer != "" {
+		template.OCSPServer = []string{ocspServer}
+	}
+	if crlURL != "" {
+		template.CRLDistributionPoints = []string{crlURL}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse certificate: %v", err)
+	}
+	return cert
+}
+
+// ocspResponder answers OCSP requests from the revoked serial numbers
+func (ca *testCA) ocspResponder(t *testing.T, hits *int32) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(hits, 1)
+		body, _ := io.ReadAll(r.Body)
+		request, err := ocsp.ParseRequest(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		template := ocsp.Response{
+			Status:       ocsp.Good,
+			SerialNumber: request.SerialNumber,
+			ThisUpdate:   time.Now().Add(-time.Minute),
+			NextUpdate:   time.Now().Add(time.Hour),
+		}
+		if ca.revoked[request.SerialNumber.String()] {
+			template.Status = ocsp.Revoked
+			template.RevokedAt = time.Now().Add(-time.Minute)
+		}
+		response, err := ocsp.CreateResponse(ca.cert, ca.cert, template, ca.key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(response)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// crlServer publishes a CRL listing the revoked serial numbers
+func (ca *testCA) crlServer(t *testing.T, hits *int32) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(hits, 1)
+		template := &x509.RevocationList{
+			Number:     big.NewInt(1),
+			ThisUpdate: time.Now().Add(-time.Minute),
+			NextUpdate: time.Now().Add(time.Hour),
+		}
+		for serial := range ca.revoked {
+			n, _ := new(big.Int).SetString(serial, 10)
+			template.RevokedCertificateEntries = append(template.RevokedCertificateEntries, x509.RevocationListEntry{
+				SerialNumber:   n,
+				RevocationTime: time.Now().Add(-time.Minute),
+			})
+		}
+		der, err := x509.CreateRevocationList(rand.Reader, template, ca.cert, crypto.Signer(ca.key))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(der)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestRevocationChecker_OCSP(t *testing.T) {
+	ca := newTestCA(t)
+	ca.revoked["3"] = true
+	var hits int32
+	responder := ca.ocspResponder(t, &hits)
+	checker := NewRevocationChecker(true, 0)
+
+	good := ca.issue(t, 2, responder.URL, "")
+	if err := checker.Check(good, ca.cert); err != nil {
+		t.Errorf("Expected a good certificate to pass, got %v", err)
+	}
+	revoked := ca.issue(t, 3, responder.URL, "")
+	if err := checker.Check(revoked, ca.cert); !errors.Is(err, ErrCertificateRevoked) {
+		t.Errorf("Expected ErrCertificateRevoked, got %v", err)
+	}
+
+	// The responses are cached until their next update
+	checker.Check(good, ca.cert)
+	checker.Check(revoked, ca.cert)
+	if atomic.LoadInt32(&hits) != 2 {
+		t.Errorf("Expected 2 OCSP requests, got %d", hits)
+	}
+}
+
+func TestRevocationChecker_CRL(t *testing.T) {
+	ca := newTestCA(t)
+	ca.revoked["3"] = true
+	var hits int32
+	crl := ca.crlServer(t, &hits)
+	checker := NewRevocationChecker(true, 0)
+
+	good := ca.issue(t, 2, "", crl.URL)
+	if err := checker.Check(good, ca.cert); err != nil {
+		t.Errorf("Expected a good certificate to pass, got %v", err)
+	}
+	revoked := ca.issue(t, 3, "", crl.URL)
+	if err := checker.Check(revoked, ca.cert); !errors.Is(err, ErrCertificateRevoked) {
+		t.Errorf("Expected ErrCertificateRevoked, got %v", err)
+	}
+	if atomic.LoadInt32(&hits) != 1 {
+		t.Errorf("Expected the CRL to be downloaded once, got %d", hits)
+	}
+}
+
+func TestRevocationChecker_CRLFallback(t *testing.T) {
+	ca := newTestCA(t)
+	ca.revoked["3"] = true
+	var hits int32
+	crl := ca.crlServer(t, &hits)
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+
+	revoked := ca.issue(t, 3, down.URL, crl.URL)
+	err := NewRevocationChecker(false, 0).Check(revoked, ca.cert)
+	if !errors.Is(err, ErrCertificateRevoked) {
+		t.Errorf("Expected ErrCertificateRevoked from the CRL, got %v", err)
+	}
+}
+
+func TestRevocationChecker_CRLSignature(t *testing.T) {
+	ca := newTestCA(t)
+	other := newTestCA(t)
+	var hits int32
+	crl := other.crlServer(t, &hits)
+
+	cert := ca.issue(t, 2, "", crl.URL)
+	err := NewRevocationChecker(true, 0).Check(cert, ca.cert)
+	if !errors.Is(err, ErrRevocationUnknown) {
+		t.Errorf("Expected a CRL signed by another CA to be refused, got %v", err)
+	}
+}
+
+func TestRevocationChecker_Policy(t *testing.T) {
+	ca := newTestCA(t)
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+	cert := ca.issue(t, 2, down.URL, down.URL)
+
+	if err := NewRevocationChecker(false, 0).Check(cert, ca.cert); err != nil {
+		t.Errorf("Expected fail-open to accept the certificate, got %v", err)
+	}
+	if err := NewRevocationChecker(true, 0).Check(cert, ca.cert); !errors.Is(err, ErrRevocationUnknown) {
+		t.Errorf("Expected fail-closed to return ErrRevocationUnknown, got %v", err)
+	}
+
+	// A certificate naming no responder nor CRL has nothing to check
+	bare := ca.issue(t, 4, "", "")
+	if err := NewRevocationChecker(true, 0).Check(bare, ca.cert); err != nil {
+		t.Errorf("Expected a certificate without revocation sources to pass, got %v", err)
+	}
+}
+
+func TestCheckTransportEnvelope_Revoked(t *testing.T) {
+	ca := newTestCA(t)
+	ca.revoked["3"] = true
+	var hits int32
+	responder := ca.ocspResponder(t, &hits)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	header := &mail.Header{}
+	header.Set("X-Trasporto", "posta-certificata")
+	header.Set("From", "posta-certificata@example.com")
+	header.Set("To", "user@example.org")
+	header.Set("Date", "Mon, 02 Jan 2006 15:04:05 +0000")
+
+	tests := []struct {
+		name    string
+		serial  int64
+		check   bool
+		revoked bool
+	}{
+		{"good certificate", 2, true, false},
+		{"revoked certificate", 3, true, true},
+		{"revocation not checked", 3, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cert := ca.issue(t, tt.serial, responder.URL, "")
+			trust := &ProviderTrust{
+				CertificateHashes: map[string]struct{}{CertificateHash(cert): {}},
+				Roots:             roots,
+			}
+			if tt.check {
+				trust.Revocation = NewRevocationChecker(true, 0)
+			}
+			err := CheckTransportEnvelope(header, cert, trust)
+			if tt.revoked {
+				if !errors.Is(err, ErrUntrustedSigner) || !errors.Is(err, ErrCertificateRevoked) {
+					t.Errorf("Expected a revoked untrusted signer, got %v", err)
+				}
+			} else if err != nil {
+				t.Errorf("Expected the envelope to pass, got %v", err)
+			}
+		})
+	}
+}
@@ -6,44 +6,138 @@ import (
 	"crypto/x509"
 	"encoding/base64"
 	"fmt"
+	"io"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/danzipie/go-pec/pec-server/metrics"
 	"github.com/emersion/go-message"
 	"go.mozilla.org/pkcs7"
 )
 
-// Use your existing Signer struct
+// Signer signs the messages and receipts of a provider. It is shared by all
+// the sessions of a server: SignEmail, CreateSignedMimeMessage,
+// CreateSignedMimeMessageEntity and their Mode variants are safe for
+// concurrent use, including while
+// Update swaps in renewed credentials. Set Cert, Key and Chain directly only
+// before the signer is in use; read them with Credentials afterwards.
 type Signer struct {
 	Cert   *x509.Certificate
 	Key    interface{}
+	Chain  []*x509.Certificate // intermediate certificates included in signatures
 	Domain string
+
+	mu    sync.RWMutex // guards the credentials and state once the signer is in use
+	state *signingState
 }
 
-// S/MIME signing using go.mozilla.org/pkcs7
-func (s *Signer) SignEmail(emailContent []byte) ([]byte, error) {
+// signingState is what signing derives from the credentials, built once per
+// credential set rather than for every message
+type signingState struct {
+	cert  *x509.Certificate
+	key   crypto.PrivateKey
+	chain []*x509.Certificate
 
+	// The chain has been verified and names the issuer of cert by the same
+	// bytes, so pkcs7 need not verify it again on every signature
+	chainVerified bool
+}
+
+// newSigningState validates the credentials and verifies the chain
+func newSigningState(cert *x509.Certificate, key interface{}, chain []*x509.Certificate) (*signingState, error) {
 	// Validate the certificate and key
-	if s.Cert == nil {
+	if cert == nil {
 		return nil, fmt.Errorf("certificate is nil")
 	}
-	if s.Key == nil {
+	if key == nil {
 		return nil, fmt.Errorf("key is nil")
 	}
 
+	// Convert interface{} to crypto.PrivateKey
+	privateKey, ok := key.(crypto.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("key is not a crypto.PrivateKey")
+	}
+
+	state := &signingState{cert: cert, key: privateKey, chain: chain}
+	if len(chain) > 0 && bytes.Equal(cert.RawIssuer, chain[0].RawSubject) {
+		issued := cert
+		for _, parent := range chain {
+			if err := issued.CheckSignatureFrom(parent); err != nil {
+				return nil, fmt.Errorf("failed to add signer: pkcs7: certificate signature from parent is invalid: %v", err)
+			}
+			issued = parent
+		}
+		state.chainVerified = true
+	}
+	return state, nil
+}
+
+// signingState returns the state of the current credentials, building it on
+// first use after an Update
+func (s *Signer) signingState() (*signingState, error) {
+	s.mu.RLock()
+	state := s.state
+	s.mu.RUnlock()
+	if state != nil {
+		return state, nil
+	}
+
+	cert, key, chain := s.Credentials()
+	state, err := newSigningState(cert, key, chain)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	if s.Cert == cert {
+		s.state = state
+	}
+	s.mu.Unlock()
+	return state, nil
+}
+
+// Credentials returns the current certificate, key and chain
+func (s *Signer) Credentials() (*x509.Certificate, interface{}, []*x509.Certificate) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Cert, s.Key, s.Chain
+}
+
+// Update replaces the credentials used for new signatures; signatures in
+// progress complete with the previous ones
+func (s *Signer) Update(cert *x509.Certificate, key interface{}, chain []*x509.Certificate) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Cert, s.Key, s.Chain = cert, key, chain
+	s.state = nil
+}
+
+// S/MIME signing using go.mozilla.org/pkcs7; every call builds its own
+// pkcs7 state, so concurrent callers share only the immutable signingState
+func (s *Signer) SignEmail(emailContent []byte) ([]byte, error) {
+	defer metrics.SigningDuration.ObserveSince(time.Now())
+	state, err := s.signingState()
+	if err != nil {
+		return nil, err
+	}
+
 	// Create PKCS7 signed data
 	signedData, err := pkcs7.NewSignedData(emailContent)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create signed data: %v", err)
 	}
 
-	// Convert interface{} to crypto.PrivateKey
-	privateKey, ok := s.Key.(crypto.PrivateKey)
-	if !ok {
-		return nil, fmt.Errorf("key is not a crypto.PrivateKey")
+	// Add signer; a verified chain is appended as AddSignerChain would,
+	// without checking its signatures again
+	if state.chainVerified {
+		err = signedData.AddSigner(state.cert, state.key, pkcs7.SignerInfoConfig{})
+		for _, parent := range state.chain {
+			signedData.AddCertificate(parent)
+		}
+	} else {
+		err = signedData.AddSignerChain(state.cert, state.key, state.chain, pkcs7.SignerInfoConfig{})
 	}
-
-	// Add signer
-	err = signedData.AddSigner(s.Cert, privateKey, pkcs7.SignerInfoConfig{})
 	if err != nil {
 		return nil, fmt.Errorf("failed to add signer: %v", err)
 	}
@@ -57,14 +151,55 @@ func (s *Signer) SignEmail(emailContent []byte) ([]byte, error) {
 	return signedBytes, nil
 }
 
+// SigningMode selects the S/MIME structure of a signed message
+type SigningMode string
+
+const (
+	// SigningDetached signs into a multipart/signed message, the content
+	// readable in clear next to an application/pkcs7-signature part
+	SigningDetached SigningMode = "detached"
+	// SigningOpaque signs into an application/pkcs7-mime message, the
+	// content enclosed in the signed data
+	SigningOpaque SigningMode = "opaque"
+)
+
+// ParseSigningMode returns the signing mode named mode, SigningDetached when
+// mode is empty
+func ParseSigningMode(mode string) (SigningMode, error) {
+	switch SigningMode(mode) {
+	case "", SigningDetached:
+		return SigningDetached, nil
+	case SigningOpaque:
+		return SigningOpaque, nil
+	}
+	return "", fmt.Errorf("unknown signing mode %q", mode)
+}
+
 // Create a complete S/MIME signed email message from email bytes
 func (s *Signer) CreateSignedMimeMessage(emailContent []byte) ([]byte, error) {
+	return s.CreateSignedMimeMessageMode(emailContent, SigningDetached)
+}
+
+// CreateSignedMimeMessageMode creates an S/MIME signed email message from
+// email bytes with the structure of mode
+func (s *Signer) CreateSignedMimeMessageMode(emailContent []byte, mode SigningMode) ([]byte, error) {
 	// Sign the email content
 	signedData, err := s.SignEmail(emailContent)
 	if err != nil {
 		return nil, fmt.Errorf("failed to sign email: %v", err)
 	}
+	switch mode {
+	case "", SigningDetached:
+		return detachedMimeMessage(emailContent, signedData), nil
+	case SigningOpaque:
+		return opaqueMimeMessage(signedData), nil
+	}
+	return nil, fmt.Errorf("unknown signing mode %q", mode)
+}
 
+// detachedMimeMessage returns the multipart/signed message of emailContent
+// and its signature signedData
+func detachedMimeMessage(emailContent, signedData []byte) []byte {
 	// Encode the signed data as base64
 	signedDataB64 := base64.StdEncoding.EncodeToString(signedData)
 
@@ -72,38 +207,62 @@ func (s *Signer) CreateSignedMimeMessage(emailContent []byte) ([]byte, error) {
 	boundary := "----=_NextPart_000_0000_01234567.89ABCDEF"
 
 	// Build the S/MIME multipart/signed message
-	var result strings.Builder
+	var result bytes.Buffer
+	result.Grow(len(emailContent) + len(signedDataB64) + len(signedDataB64)/38 + 512)
 
 	// Write MIME headers for the signed message
 	result.WriteString("MIME-Version: 1.0\r\n")
-	result.WriteString(fmt.Sprintf("Content-Type: multipart/signed; protocol=\"application/pkcs7-signature\"; micalg=sha256; boundary=\"%s\"\r\n", boundary))
+	fmt.Fprintf(&result, "Content-Type: multipart/signed; protocol=\"application/pkcs7-signature\"; micalg=sha256; boundary=\"%s\"\r\n", boundary)
 	result.WriteString("\r\n")
 	result.WriteString("This is an S/MIME signed message\r\n")
 	result.WriteString("\r\n")
 
 	// Write the original email content
-	result.WriteString(fmt.Sprintf("--%s\r\n", boundary))
-	result.WriteString(string(emailContent))
-	if !strings.HasSuffix(string(emailContent), "\r\n") {
+	fmt.Fprintf(&result, "--%s\r\n", boundary)
+	result.Write(emailContent)
+	if !bytes.HasSuffix(emailContent, []byte("\r\n")) {
 		result.WriteString("\r\n")
 	}
 	result.WriteString("\r\n")
 
 	// Write the signature part
-	result.WriteString(fmt.Sprintf("--%s\r\n", boundary))
+	fmt.Fprintf(&result, "--%s\r\n", boundary)
 	result.WriteString("Content-Type: application/pkcs7-signature; name=\"smime.p7s\"\r\n")
 	result.WriteString("Content-Transfer-Encoding: base64\r\n")
 	result.WriteString("Content-Disposition: attachment; filename=\"smime.p7s\"\r\n")
 	result.WriteString("\r\n")
-	result.WriteString(formatBase64(signedDataB64, 76))
+	result.WriteString(FormatBase64(signedDataB64, Base64LineLength))
 	result.WriteString("\r\n")
-	result.WriteString(fmt.Sprintf("--%s--\r\n", boundary))
+	fmt.Fprintf(&result, "--%s--\r\n", boundary)
+
+	return result.Bytes()
+}
+
+// opaqueMimeMessage returns the application/pkcs7-mime message of
+// signedData, which encloses the signed content
+func opaqueMimeMessage(signedData []byte) []byte {
+	signedDataB64 := base64.StdEncoding.EncodeToString(signedData)
 
-	return []byte(result.String()), nil
+	var result bytes.Buffer
+	result.Grow(len(signedDataB64) + len(signedDataB64)/38 + 256)
+	result.WriteString("MIME-Version: 1.0\r\n")
+	result.WriteString("Content-Type: application/pkcs7-mime; smime-type=signed-data; name=\"smime.p7m\"\r\n")
+	result.WriteString("Content-Transfer-Encoding: base64\r\n")
+	result.WriteString("Content-Disposition: attachment; filename=\"smime.p7m\"\r\n")
+	result.WriteString("\r\n")
+	result.WriteString(FormatBase64(signedDataB64, Base64LineLength))
+	result.WriteString("\r\n")
+	return result.Bytes()
 }
 
 func (s *Signer) CreateSignedMimeMessageEntity(emailContent []byte) (*message.Entity, error) {
-	signedMessage, err := s.CreateSignedMimeMessage(emailContent)
+	return s.CreateSignedMimeMessageEntityMode(emailContent, SigningDetached)
+}
+
+// CreateSignedMimeMessageEntityMode is CreateSignedMimeMessageMode returning
+// the parsed message
+func (s *Signer) CreateSignedMimeMessageEntityMode(emailContent []byte, mode SigningMode) (*message.Entity, error) {
+	signedMessage, err := s.CreateSignedMimeMessageMode(emailContent, mode)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create signed S/MIME message: %v", err)
 	}
@@ -116,8 +275,37 @@ func (s *Signer) CreateSignedMimeMessageEntity(emailContent []byte) (*message.En
 	return entity, nil
 }
 
-// formatBase64 formats base64 string with line breaks
-func formatBase64(data string, lineLength int) string {
+// UnwrapSigned verifies the S/MIME signature of entity and returns the
+// payload that was signed, with the signer certificate, so that a provider
+// can inspect it before signing it again. It is the inverse of
+// CreateSignedMimeMessageEntity and consumes the body of entity.
+func UnwrapSigned(entity *message.Entity) (*message.Entity, *x509.Certificate, error) {
+	mediaType, params, err := entity.Header.ContentType()
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid Content-Type: %v", err)
+	}
+	// The body of a multipart entity is read raw, as the signature requires
+	body, err := io.ReadAll(entity.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read signed body: %v", err)
+	}
+	p7, signerCert, err := verifySignedBody(mediaType, params, body)
+	if err != nil {
+		return nil, nil, err
+	}
+	inner, err := message.Read(bytes.NewReader(p7.Content))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse signed content: %v", err)
+	}
+	return inner, signerCert, nil
+}
+
+// Base64LineLength is the length of the lines of base64 encoded MIME parts,
+// the maximum RFC 2045 allows
+const Base64LineLength = 76
+
+// FormatBase64 formats base64 string with line breaks
+func FormatBase64(data string, lineLength int) string {
 	var result strings.Builder
 	for i := 0; i < len(data); i += lineLength {
 		end := i + lineLength
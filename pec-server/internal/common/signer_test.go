@@ -6,11 +6,15 @@ import (
 	"crypto/rsa"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"errors"
+	"io"
 	"math/big"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/emersion/go-message"
 	"go.mozilla.org/pkcs7"
 )
 
@@ -218,7 +222,7 @@ func TestSigner_CreateSignedMimeMessage_InvalidKey(t *testing.T) {
 	}
 }
 
-// TestFormatBase64 tests the formatBase64 helper function
+// TestFormatBase64 tests the FormatBase64 helper function
 func TestFormatBase64(t *testing.T) {
 	testCases := []struct {
 		input      string
@@ -248,7 +252,7 @@ func TestFormatBase64(t *testing.T) {
 	}
 
 	for i, tc := range testCases {
-		result := formatBase64(tc.input, tc.lineLength)
+		result := FormatBase64(tc.input, tc.lineLength)
 		if result != tc.expected {
 			t.Errorf("Test case %d failed. Expected: %q, Got: %q", i+1, tc.expected, result)
 		}
@@ -365,6 +369,143 @@ func BenchmarkCreateSignedMimeMessage(b *testing.B) {
 	}
 }
 
+// BenchmarkSignEmail_Chain compares signing with a fresh signer, which
+// validates the credentials and verifies the chain every time, against a
+// signer reused across messages
+func BenchmarkSignEmail_Chain(b *testing.B) {
+	cert, key, chain, err := LoadSMIMECredentialsP12(testP12File, testP12Password)
+	if err != nil {
+		b.Fatalf("LoadSMIMECredentialsP12 failed: %v", err)
+	}
+	emailContent := []byte("Subject: Benchmark Test\r\nTo: test@example.com\r\n\r\nBenchmark test content.")
+
+	b.Run("fresh", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			signer := &Signer{Cert: cert, Key: key, Chain: chain}
+			if _, err := signer.SignEmail(emailContent); err != nil {
+				b.Fatalf("SignEmail failed: %v", err)
+			}
+		}
+	})
+	b.Run("reused", func(b *testing.B) {
+		b.ReportAllocs()
+		signer := &Signer{Cert: cert, Key: key, Chain: chain}
+		for i := 0; i < b.N; i++ {
+			if _, err := signer.SignEmail(emailContent); err != nil {
+				b.Fatalf("SignEmail failed: %v", err)
+			}
+		}
+	})
+}
+
+// TestSigner_SignEmail_ChainMatchesPkcs7 tests that reusing the verified
+// chain produces the same bytes as pkcs7.AddSignerChain
+func TestSigner_SignEmail_ChainMatchesPkcs7(t *testing.T) {
+	cert, key, chain, err := LoadSMIMECredentialsP12(testP12File, testP12Password)
+	if err != nil {
+		t.Fatalf("LoadSMIMECredentialsP12 failed: %v", err)
+	}
+	signer := &Signer{Cert: cert, Key: key, Chain: chain}
+	content := []byte("Subject: test\r\n\r\nHello\r\n")
+
+	// The signing time has a resolution of one second: retry when the two
+	// signatures straddle a second boundary
+	for attempt := 0; attempt < 3; attempt++ {
+		signed, err := signer.SignEmail(content)
+		if err != nil {
+			t.Fatalf("SignEmail failed: %v", err)
+		}
+		reference, err := pkcs7.NewSignedData(content)
+		if err != nil {
+			t.Fatalf("NewSignedData failed: %v", err)
+		}
+		if err := reference.AddSignerChain(cert, key, chain, pkcs7.SignerInfoConfig{}); err != nil {
+			t.Fatalf("AddSignerChain failed: %v", err)
+		}
+		want, err := reference.Finish()
+		if err != nil {
+			t.Fatalf("Finish failed: %v", err)
+		}
+		if bytes.Equal(signed, want) {
+			return
+		}
+	}
+	t.Fatal("Expected the signature to match pkcs7.AddSignerChain")
+}
+
+// TestSigner_Update tests that new credentials are used after an Update
+func TestSigner_Update(t *testing.T) {
+	oldCert, oldKey := createTestCertAndKey(t)
+	newCert, newKey := createTestCertAndKey(t)
+	signer := &Signer{Cert: oldCert, Key: oldKey}
+	content := []byte("Subject: test\r\n\r\nHello\r\n")
+	if _, err := signer.SignEmail(content); err != nil {
+		t.Fatalf("SignEmail failed: %v", err)
+	}
+
+	signer.Update(newCert, newKey, nil)
+	signed, err := signer.SignEmail(content)
+	if err != nil {
+		t.Fatalf("SignEmail failed: %v", err)
+	}
+	p7, err := pkcs7.Parse(signed)
+	if err != nil {
+		t.Fatalf("Failed to parse signature: %v", err)
+	}
+	if len(p7.Certificates) != 1 || !p7.Certificates[0].Equal(newCert) {
+		t.Errorf("Expected the signature to carry the new certificate")
+	}
+	if err := p7.Verify(); err != nil {
+		t.Errorf("Expected the signature to verify: %v", err)
+	}
+}
+
+// TestSigner_ConcurrentUse tests signing from many goroutines while the
+// credentials are swapped; run with -race
+func TestSigner_ConcurrentUse(t *testing.T) {
+	certA, keyA := createTestCertAndKey(t)
+	certB, keyB := createTestCertAndKey(t)
+	signer := &Signer{Cert: certA, Key: keyA, Domain: "example.com"}
+	content := []byte("Subject: test\r\n\r\nHello\r\n")
+
+	const workers, signatures = 8, 5
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*signatures)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < signatures; i++ {
+				signed, err := signer.CreateSignedMimeMessage(content)
+				if err == nil && len(signed) == 0 {
+					err = errors.New("empty signed message")
+				}
+				if err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < signatures; i++ {
+			if i%2 == 0 {
+				signer.Update(certB, keyB, nil)
+			} else {
+				signer.Update(certA, keyA, nil)
+			}
+			signer.Credentials()
+		}
+	}()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("Concurrent signing failed: %v", err)
+	}
+}
+
 // TestCreateSignedMimeMessageEntity tests the main functionality
 func TestCreateSignedMimeMessageEntity(t *testing.T) {
 	// Create test certificate and key
@@ -599,3 +740,142 @@ func TestCreateSignedMimeMessageEntity_ErrorHandling(t *testing.T) {
 		t.Error("Expected error when key is nil")
 	}
 }
+
+// TestUnwrapSigned tests the sign/unwrap round trip
+func TestUnwrapSigned(t *testing.T) {
+	cert, key := createTestCertAndKey(t)
+	signer := &Signer{Cert: cert, Key: key, Domain: "example.com"}
+	content := []byte("Subject: Round trip\r\nContent-Type: text/plain\r\n\r\nHello from the sender\r\n")
+
+	signed, err := signer.CreateSignedMimeMessageEntity(content)
+	if err != nil {
+		t.Fatalf("CreateSignedMimeMessageEntity failed: %v", err)
+	}
+	inner, signerCert, err := UnwrapSigned(signed)
+	if err != nil {
+		t.Fatalf("UnwrapSigned failed: %v", err)
+	}
+	if !signerCert.Equal(cert) {
+		t.Errorf("Expected the signer certificate to be returned")
+	}
+	if got := inner.Header.Get("Subject"); got != "Round trip" {
+		t.Errorf("Expected the inner Subject, got %q", got)
+	}
+	body, err := io.ReadAll(inner.Body)
+	if err != nil {
+		t.Fatalf("Failed to read inner body: %v", err)
+	}
+	if string(body) != "Hello from the sender\r\n" {
+		t.Errorf("Unexpected inner body %q", body)
+	}
+
+	// The payload can be signed again by the next hop
+	var raw bytes.Buffer
+	if err := inner.WriteTo(&raw); err != nil {
+		t.Fatalf("Failed to write inner entity: %v", err)
+	}
+	if _, err := signer.CreateSignedMimeMessageEntity(raw.Bytes()); err != nil {
+		t.Errorf("Failed to sign the unwrapped payload again: %v", err)
+	}
+}
+
+// TestUnwrapSigned_Errors tests that tampered and unsigned messages are refused
+func TestUnwrapSigned_Errors(t *testing.T) {
+	cert, key := createTestCertAndKey(t)
+	signer := &Signer{Cert: cert, Key: key, Domain: "example.com"}
+	signed, err := signer.CreateSignedMimeMessage([]byte("Subject: test\r\n\r\nOriginal body\r\n"))
+	if err != nil {
+		t.Fatalf("CreateSignedMimeMessage failed: %v", err)
+	}
+	tampered := bytes.Replace(signed, []byte("Original body"), []byte("Modified body"), 1)
+
+	for name, data := range map[string][]byte{
+		"tampered": tampered,
+		"unsigned": []byte("Subject: test\r\nContent-Type: text/plain\r\n\r\nHello\r\n"),
+	} {
+		entity, err := message.Read(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("Failed to read %s message: %v", name, err)
+		}
+		if _, _, err := UnwrapSigned(entity); err == nil {
+			t.Errorf("Expected an error for the %s message", name)
+		}
+	}
+}
+
+// TestSigner_CreateSignedMimeMessageMode tests that a message signed in each
+// mode has the structure of the mode and verifies back to its content
+func TestSigner_CreateSignedMimeMessageMode(t *testing.T) {
+	cert, key := createTestCertAndKey(t)
+	signer := &Signer{Cert: cert, Key: key, Domain: "example.com"}
+	content := []byte("Subject: Modes\r\nContent-Type: text/plain\r\n\r\nSigned content\r\n")
+
+	tests := []struct {
+		mode      SigningMode
+		mediaType string
+	}{
+		{"", "multipart/signed"},
+		{SigningDetached, "multipart/signed"},
+		{SigningOpaque, "application/pkcs7-mime"},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.mode), func(t *testing.T) {
+			signed, err := signer.CreateSignedMimeMessageMode(content, tt.mode)
+			if err != nil {
+				t.Fatalf("CreateSignedMimeMessageMode failed: %v", err)
+			}
+			entity, err := message.Read(bytes.NewReader(signed))
+			if err != nil {
+				t.Fatalf("Failed to parse signed message: %v", err)
+			}
+			mediaType, params, _ := entity.Header.ContentType()
+			if mediaType != tt.mediaType {
+				t.Errorf("Expected %s, got %s", tt.mediaType, mediaType)
+			}
+			if tt.mode == SigningOpaque && params["smime-type"] != "signed-data" {
+				t.Errorf("Expected smime-type signed-data, got %q", params["smime-type"])
+			}
+
+			signerCert, err := VerifySignedMessage(signed)
+			if err != nil {
+				t.Fatalf("VerifySignedMessage failed: %v", err)
+			}
+			if !signerCert.Equal(cert) {
+				t.Error("Expected the signer certificate to be returned")
+			}
+
+			inner, _, err := UnwrapSigned(entity)
+			if err != nil {
+				t.Fatalf("UnwrapSigned failed: %v", err)
+			}
+			body, _ := io.ReadAll(inner.Body)
+			if inner.Header.Get("Subject") != "Modes" || string(body) != "Signed content\r\n" {
+				t.Errorf("Unexpected signed content %q: %q", inner.Header.Get("Subject"), body)
+			}
+		})
+	}
+
+	if _, err := signer.CreateSignedMimeMessageMode(content, "enveloped"); err == nil {
+		t.Error("Expected an error for an unknown mode")
+	}
+}
+
+// TestParseSigningMode tests the names of the signing modes
+func TestParseSigningMode(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    SigningMode
+		wantErr bool
+	}{
+		{"", SigningDetached, false},
+		{"detached", SigningDetached, false},
+		{"opaque", SigningOpaque, false},
+		{"clear", "", true},
+	}
+	for _, tt := range tests {
+		got, err := ParseSigningMode(tt.name)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseSigningMode(%q): expected %q (error %v), got %q (%v)", tt.name, tt.want, tt.wantErr, got, err)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package common
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"os"
+
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/pkcs12"
+)
+
+// LoadCredentials loads the S/MIME credentials configured in cfg, from a
+// PKCS#12 bundle when P12File is set and from PEM files otherwise
+func LoadCredentials(cfg *Config) (*x509.Certificate, crypto.PrivateKey, []*x509.Certificate, error) {
+	if cfg.P12File != "" {
+		return LoadSMIMECredentialsP12(cfg.P12File, cfg.P12Password)
+	}
+	passphrase := cfg.KeyPassphrase
+	if passphrase == "" {
+		passphrase = os.Getenv(KeyPassphraseEnv)
+	}
+	cert, key, err := LoadSMIMECredentialsWithPassphrase(cfg.CertFile, cfg.KeyFile, passphrase)
+	return cert, key, nil, err
+}
+
+// LoadSMIMECredentialsP12 reads a password-protected PKCS#12 bundle and
+// returns the leaf certificate, its private key and the CA chain
+func LoadSMIMECredentialsP12(path, password string) (*x509.Certificate, crypto.PrivateKey, []*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	blocks, err := pkcs12.ToPEM(data, password)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to decode PKCS#12 bundle: %v", err)
+	}
+
+	var key crypto.PrivateKey
+	var certs []*x509.Certificate
+	for _, block := range blocks {
+		switch block.Type {
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, nil, nil, fmt.Errorf("failed to parse certificate: %v", err)
+			}
+			certs = append(certs, cert)
+		case "PRIVATE KEY":
+			if key != nil {
+				return nil, nil, nil, errors.New("PKCS#12 bundle contains more than one private key")
+			}
+			key, err = parseP12PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+		}
+	}
+	if key == nil {
+		return nil, nil, nil, errors.New("PKCS#12 bundle contains no private key")
+	}
+
+	// The leaf is the certificate matching the private key, the others form the chain
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, nil, nil, errors.New("unsupported private key type")
+	}
+	var leaf *x509.Certificate
+	var chain []*x509.Certificate
+	for _, cert := range certs {
+		if pub, ok := cert.PublicKey.(interface{ Equal(crypto.PublicKey) bool }); ok && leaf == nil && pub.Equal(signer.Public()) {
+			leaf = cert
+			continue
+		}
+		chain = append(chain, cert)
+	}
+	if leaf == nil {
+		return nil, nil, nil, errors.New("PKCS#12 bundle contains no certificate for the private key")
+	}
+
+	return leaf, key, orderChain(leaf, chain), nil
+}
+
+// orderChain sorts certs so that each certificate is issued by the next one,
+// starting from the issuer of leaf. Unrelated certificates are kept at the end.
+func orderChain(leaf *x509.Certificate, certs []*x509.Certificate) []*x509.Certificate {
+	remaining := append([]*x509.Certificate(nil), certs...)
+	ordered := make([]*x509.Certificate, 0, len(certs))
+	current := leaf
+	for len(remaining) > 0 {
+		next := -1
+		for i, cert := range remaining {
+			if bytes.Equal(cert.RawSubject, current.RawIssuer) {
+				next = i
+				break
+			}
+		}
+		if next < 0 || bytes.Equal(current.RawSubject, current.RawIssuer) {
+			break
+		}
+		current = remaining[next]
+		ordered = append(ordered, current)
+		remaining = append(remaining[:next], remaining[next+1:]...)
+	}
+	return append(ordered, remaining...)
+}
+
+// parseP12PrivateKey parses a key converted by pkcs12.ToPEM, which is encoded
+// as PKCS#1 for RSA keys and SEC 1 for ECDSA keys
+func parseP12PrivateKey(der []byte) (crypto.PrivateKey, error) {
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		return key, nil
+	}
+	return nil, errors.New("failed to parse private key")
+}
+
+// KeyPassphraseEnv names the environment variable holding the passphrase of
+// an encrypted private key, used when none is configured
+const KeyPassphraseEnv = "PEC_KEY_PASSPHRASE"
+
+var (
+	// ErrMissingPassphrase is returned when an encrypted key is loaded without a passphrase
+	ErrMissingPassphrase = errors.New("private key is encrypted but no passphrase is configured")
+	// ErrIncorrectPassphrase is returned when an encrypted key cannot be decrypted
+	ErrIncorrectPassphrase = errors.New("incorrect passphrase for private key")
+)
+
+var (
+	oidPBES2      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidHMACSHA512 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}
+	oidAES128CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	oidDESEDE3CBC = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+)
+
+// encryptedPrivateKeyInfo is the PKCS#8 EncryptedPrivateKeyInfo structure
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+// pbes2Params are the PBES2 parameters of RFC 8018
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+// pbkdf2Params are the PBKDF2 parameters of RFC 8018
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// ParsePEMPrivateKey parses a PEM private key in PKCS#8 or PKCS#1 form,
+// decrypting it with passphrase when it is an "ENCRYPTED PRIVATE KEY" or a
+// legacy "Proc-Type: 4,ENCRYPTED" block
+func ParsePEMPrivateKey(keyPEM []byte, passphrase string) (crypto.PrivateKey, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("failed to decode private key")
+	}
+
+	der := block.Bytes
+	switch {
+	case block.Type == "ENCRYPTED PRIVATE KEY":
+		if passphrase == "" {
+			return nil, ErrMissingPassphrase
+		}
+		return decryptPKCS8PrivateKey(block.Bytes, passphrase)
+
+	case x509.IsEncryptedPEMBlock(block):
+		// Legacy OpenSSL encryption: insecure, but still found in the wild
+		if passphrase == "" {
+			return nil, ErrMissingPassphrase
+		}
+		var err error
+		der, err = x509.DecryptPEMBlock(block, []byte(passphrase))
+		if errors.Is(err, x509.IncorrectPasswordError) {
+			return nil, ErrIncorrectPassphrase
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unsupported private key encryption: %v", err)
+		}
+	}
+
+	privKey, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		// fallback
+		privKey, err = x509.ParsePKCS1PrivateKey(der)
+	}
+	if err != nil && block.Headers["Proc-Type"] != "" {
+		// A wrong passphrase can still produce valid padding
+		return nil, ErrIncorrectPassphrase
+	}
+	return privKey, err
+}
+
+// decryptPKCS8PrivateKey decrypts a PBES2-encrypted PKCS#8 private key
+func decryptPKCS8PrivateKey(der []byte, passphrase string) (crypto.PrivateKey, error) {
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, fmt.Errorf("failed to parse encrypted private key: %v", err)
+	}
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("unsupported private key encryption: %s (only PBES2 is supported)", info.Algorithm.Algorithm)
+	}
+
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, fmt.Errorf("failed to parse PBES2 parameters: %v", err)
+	}
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, fmt.Errorf("unsupported key derivation function: %s", params.KeyDerivationFunc.Algorithm)
+	}
+	var kdf pbkdf2Params
+	if _, err := asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdf); err != nil {
+		return nil, fmt.Errorf("failed to parse PBKDF2 parameters: %v", err)
+	}
+
+	var prf func() hash.Hash
+	switch {
+	case len(kdf.PRF.Algorithm) == 0, kdf.PRF.Algorithm.Equal(oidHMACSHA1):
+		prf = sha1.New
+	case kdf.PRF.Algorithm.Equal(oidHMACSHA256):
+		prf = sha256.New
+	case kdf.PRF.Algorithm.Equal(oidHMACSHA512):
+		prf = sha512.New
+	default:
+		return nil, fmt.Errorf("unsupported PBKDF2 pseudorandom function: %s", kdf.PRF.Algorithm)
+	}
+
+	var keyLen int
+	var newCipher func([]byte) (cipher.Block, error)
+	switch scheme := params.EncryptionScheme.Algorithm; {
+	case scheme.Equal(oidAES128CBC):
+		keyLen, newCipher = 16, aes.NewCipher
+	case scheme.Equal(oidAES192CBC):
+		keyLen, newCipher = 24, aes.NewCipher
+	case scheme.Equal(oidAES256CBC):
+		keyLen, newCipher = 32, aes.NewCipher
+	case scheme.Equal(oidDESEDE3CBC):
+		keyLen, newCipher = 24, des.NewTripleDESCipher
+	default:
+		return nil, fmt.Errorf("unsupported private key cipher: %s", scheme)
+	}
+
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, fmt.Errorf("failed to parse cipher IV: %v", err)
+	}
+
+	key := pbkdf2.Key([]byte(passphrase), kdf.Salt, kdf.IterationCount, keyLen, prf)
+	block, err := newCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != block.BlockSize() || len(info.EncryptedData)%block.BlockSize() != 0 {
+		return nil, errors.New("malformed encrypted private key")
+	}
+
+	plain := make([]byte, len(info.EncryptedData))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, info.EncryptedData)
+
+	// A wrong passphrase shows up as invalid padding or an unparsable key
+	padding := int(plain[len(plain)-1])
+	if padding == 0 || padding > block.BlockSize() {
+		return nil, ErrIncorrectPassphrase
+	}
+	for _, b := range plain[len(plain)-padding:] {
+		if int(b) != padding {
+			return nil, ErrIncorrectPassphrase
+		}
+	}
+	privKey, err := x509.ParsePKCS8PrivateKey(plain[:len(plain)-padding])
+	if err != nil {
+		return nil, ErrIncorrectPassphrase
+	}
+	return privKey, nil
+}
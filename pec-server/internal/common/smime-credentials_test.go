@@ -0,0 +1,169 @@
+package common
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"strings"
+	"testing"
+
+	"go.mozilla.org/pkcs7"
+)
+
+// testP12File is a bundle with a leaf certificate signed by a test CA, generated with
+// openssl pkcs12 -export -legacy -inkey leaf.key -in leaf.crt -certfile ca.crt -passout pass:changeit
+const (
+	testP12File     = "testdata/smime.p12"
+	testP12Password = "changeit"
+)
+
+// TestLoadSMIMECredentialsP12 tests that the leaf, its key and the CA chain are extracted
+func TestLoadSMIMECredentialsP12(t *testing.T) {
+	cert, key, chain, err := LoadSMIMECredentialsP12(testP12File, testP12Password)
+	if err != nil {
+		t.Fatalf("LoadSMIMECredentialsP12 failed: %v", err)
+	}
+
+	if cert.Subject.CommonName != "posta-certificata@example.com" {
+		t.Errorf("Expected the leaf certificate, got %s", cert.Subject)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		t.Fatalf("Expected an RSA key, got %T", key)
+	}
+	if !rsaKey.PublicKey.Equal(cert.PublicKey) {
+		t.Errorf("Expected the key to match the leaf certificate")
+	}
+	if len(chain) != 1 || chain[0].Subject.CommonName != "Test PEC CA" {
+		t.Fatalf("Expected the CA certificate in the chain, got %v", chain)
+	}
+	if err := cert.CheckSignatureFrom(chain[0]); err != nil {
+		t.Errorf("Expected the leaf to be issued by the chain: %v", err)
+	}
+}
+
+// TestLoadSMIMECredentialsP12_WrongPassword tests that a wrong password is reported
+func TestLoadSMIMECredentialsP12_WrongPassword(t *testing.T) {
+	if _, _, _, err := LoadSMIMECredentialsP12(testP12File, "wrong"); err == nil {
+		t.Fatal("Expected an error with a wrong password")
+	}
+	if _, _, _, err := LoadSMIMECredentialsP12("testdata/missing.p12", testP12Password); err == nil {
+		t.Fatal("Expected an error with a missing file")
+	}
+}
+
+// TestLoadCredentials_P12 tests that the configured bundle is used to sign with the full chain
+func TestLoadCredentials_P12(t *testing.T) {
+	cfg := &Config{P12File: testP12File, P12Password: testP12Password}
+	cert, key, chain, err := LoadCredentials(cfg)
+	if err != nil {
+		t.Fatalf("LoadCredentials failed: %v", err)
+	}
+
+	signer := &Signer{Cert: cert, Key: key, Chain: chain, Domain: "example.com"}
+	signed, err := signer.SignEmail([]byte("Subject: test\r\n\r\nHello\r\n"))
+	if err != nil {
+		t.Fatalf("SignEmail failed: %v", err)
+	}
+
+	p7, err := pkcs7.Parse(signed)
+	if err != nil {
+		t.Fatalf("Failed to parse signature: %v", err)
+	}
+	if len(p7.Certificates) != 2 {
+		t.Errorf("Expected the signature to carry the leaf and the CA, got %d certificates", len(p7.Certificates))
+	}
+	if err := p7.Verify(); err != nil {
+		t.Errorf("Expected the signature to verify: %v", err)
+	}
+}
+
+// Encrypted copies of the key of testdata/encrypted-key-cert.pem, generated with
+// openssl pkcs8 -topk8 -v2 aes-256-cbc (PBES2) and -v1 PBE-SHA1-3DES (PBES1)
+const (
+	testEncryptedKeyCert  = "testdata/encrypted-key-cert.pem"
+	testEncryptedKey      = "testdata/encrypted-key.pem"
+	testEncryptedKeyPBES1 = "testdata/encrypted-key-pbes1.pem"
+	testKeyPassphrase     = "changeit"
+)
+
+// TestLoadSMIMECredentialsWithPassphrase tests the decryption of an encrypted PKCS#8 key
+func TestLoadSMIMECredentialsWithPassphrase(t *testing.T) {
+	cert, key, err := LoadSMIMECredentialsWithPassphrase(testEncryptedKeyCert, testEncryptedKey, testKeyPassphrase)
+	if err != nil {
+		t.Fatalf("LoadSMIMECredentialsWithPassphrase failed: %v", err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		t.Fatalf("Expected an RSA key, got %T", key)
+	}
+	if !rsaKey.PublicKey.Equal(cert.PublicKey) {
+		t.Errorf("Expected the decrypted key to match the certificate")
+	}
+}
+
+// TestLoadSMIMECredentialsWithPassphrase_Errors tests that passphrase and format errors are told apart
+func TestLoadSMIMECredentialsWithPassphrase_Errors(t *testing.T) {
+	tests := []struct {
+		name       string
+		keyFile    string
+		passphrase string
+		wantErr    error
+	}{
+		{"wrong passphrase", testEncryptedKey, "wrong", ErrIncorrectPassphrase},
+		{"missing passphrase", testEncryptedKey, "", ErrMissingPassphrase},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := LoadSMIMECredentialsWithPassphrase(testEncryptedKeyCert, tt.keyFile, tt.passphrase)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Expected %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+
+	_, _, err := LoadSMIMECredentialsWithPassphrase(testEncryptedKeyCert, testEncryptedKeyPBES1, testKeyPassphrase)
+	if err == nil || errors.Is(err, ErrIncorrectPassphrase) || !strings.Contains(err.Error(), "unsupported") {
+		t.Errorf("Expected an unsupported format error, got %v", err)
+	}
+}
+
+// TestLoadCredentials_PassphraseFromEnv tests that the passphrase falls back to the environment
+func TestLoadCredentials_PassphraseFromEnv(t *testing.T) {
+	cfg := &Config{CertFile: testEncryptedKeyCert, KeyFile: testEncryptedKey}
+
+	t.Setenv(KeyPassphraseEnv, testKeyPassphrase)
+	if _, _, _, err := LoadCredentials(cfg); err != nil {
+		t.Fatalf("Expected the passphrase to be read from %s: %v", KeyPassphraseEnv, err)
+	}
+
+	cfg.KeyPassphrase = "wrong"
+	if _, _, _, err := LoadCredentials(cfg); !errors.Is(err, ErrIncorrectPassphrase) {
+		t.Errorf("Expected the configured passphrase to take precedence, got %v", err)
+	}
+}
+
+// TestParsePEMPrivateKey_LegacyEncryption tests keys encrypted with a Proc-Type header
+func TestParsePEMPrivateKey_LegacyEncryption(t *testing.T) {
+	_, key := createTestCertAndKey(t)
+	block, err := x509.EncryptPEMBlock(rand.Reader, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key), []byte(testKeyPassphrase), x509.PEMCipherAES256)
+	if err != nil {
+		t.Fatalf("Failed to encrypt key: %v", err)
+	}
+	keyPEM := pem.EncodeToMemory(block)
+
+	parsed, err := ParsePEMPrivateKey(keyPEM, testKeyPassphrase)
+	if err != nil {
+		t.Fatalf("ParsePEMPrivateKey failed: %v", err)
+	}
+	if !key.Equal(parsed) {
+		t.Errorf("Expected the decrypted key to match the original")
+	}
+
+	if _, err := ParsePEMPrivateKey(keyPEM, "wrong"); !errors.Is(err, ErrIncorrectPassphrase) {
+		t.Errorf("Expected %v, got %v", ErrIncorrectPassphrase, err)
+	}
+}
@@ -2,32 +2,101 @@ package common
 
 import (
 	"bytes"
+	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/hex"
 	"encoding/pem"
 	"errors"
+	"fmt"
 	"io"
-	"log"
+	"net"
 	"os"
+	"strconv"
+	"strings"
 
 	pec_storage "github.com/danzipie/go-pec/pec-server/internal/storage"
+	"github.com/danzipie/go-pec/pec-server/logger"
+	"github.com/danzipie/go-pec/pec-server/metrics"
 	"github.com/emersion/go-message/mail"
 	"github.com/emersion/go-sasl"
 	"github.com/emersion/go-smtp"
 )
 
+// SMTPPolicy decides which clients of an SMTP listener may send messages
+type SMTPPolicy int
+
+const (
+	// PolicyAuthOrTrusted accepts clients that authenticate or connect from
+	// a trusted network
+	PolicyAuthOrTrusted SMTPPolicy = iota
+	// PolicySubmission is the policy of the submission port (587) of the
+	// access point: users must authenticate, wherever they connect from,
+	// and no client certificate is requested
+	PolicySubmission
+	// PolicyRelay is the policy of the relay port (25) of the reception
+	// point: providers are trusted by their network or by a client
+	// certificate verified against ClientCAs, and authentication is not
+	// offered
+	PolicyRelay
+)
+
 // The Backend implements SMTP server methods.
 type Backend struct {
 	signer  *Signer
 	store   pec_storage.MessageStore
+	journal pec_storage.Journal
 	handler func(*Session) error
 	domain  string
+
+	// Certificates serves the TLS certificate, if set; the S/MIME
+	// credentials of the signer are used otherwise
+	Certificates *CertificateHolder
+	// ClientCAs verifies the certificates of connecting providers, if set
+	ClientCAs *x509.CertPool
+	// AllowInsecureAuth allows authentication on connections without TLS
+	AllowInsecureAuth bool
+	// TrustedNetworks may relay without authenticating
+	TrustedNetworks []*net.IPNet
+	// Greeting replaces the text following the server name in the 220
+	// greeting, if set
+	Greeting string
+	// Policy decides which clients may send messages
+	Policy SMTPPolicy
+	// MaxLineLength is the longest line accepted, in the commands and in the
+	// message data: defaultMaxLineLength when zero, unlimited when negative
+	MaxLineLength int
+	// WriteAhead persists the accepted messages until they are processed,
+	// if set; see RecoverWriteAhead
+	WriteAhead *WriteAheadLog
+	// Webhook is notified of the events recorded by the sessions, if set
+	Webhook *Webhook
+}
+
+// defaultMaxLineLength leaves room for the long lines of the binary and
+// 8bit parts of the messages, which the envelopes carry as they are
+const defaultMaxLineLength = 64 * 1024
+
+// ErrAuthNotOffered is returned when authentication is attempted on the
+// relay port
+var ErrAuthNotOffered = &smtp.SMTPError{
+	Code:         502,
+	EnhancedCode: smtp.EnhancedCode{5, 5, 1},
+	Message:      "Authentication is not offered on this port",
 }
 
-func NewBackend(signer *Signer, store pec_storage.MessageStore, handler func(*Session) error, domain string) *Backend {
+// ErrTLSRequired is returned when authentication is attempted before STARTTLS
+var ErrTLSRequired = &smtp.SMTPError{
+	Code:         530,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 0},
+	Message:      "Must issue a STARTTLS command first",
+}
+
+func NewBackend(signer *Signer, store pec_storage.MessageStore, journal pec_storage.Journal, handler func(*Session) error, domain string) *Backend {
 	return &Backend{
 		signer:  signer,
 		store:   store,
+		journal: journal,
 		handler: handler,
 		domain:  domain,
 	}
@@ -35,63 +104,183 @@ func NewBackend(signer *Signer, store pec_storage.MessageStore, handler func(*Se
 
 // NewSession is called after client greeting (EHLO, HELO).
 func (bkd *Backend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	var remoteIP net.IP
+	var helo string
+	if c != nil {
+		helo = c.Hostname()
+		if conn := c.Conn(); conn != nil {
+			remoteIP = addrIP(conn.RemoteAddr())
+		}
+	}
+	metrics.ActiveSMTPSessions.Inc()
 	return &Session{
-		signer:  bkd.signer,
-		Store:   bkd.store,
-		handler: bkd.handler,
-		Domain:  bkd.domain,
+		ID:                newSessionID(),
+		RemoteIP:          remoteIP,
+		Helo:              helo,
+		conn:              c,
+		allowInsecureAuth: bkd.AllowInsecureAuth,
+		trusted:           inNetworks(remoteIP, bkd.TrustedNetworks),
+		policy:            bkd.Policy,
+		signer:            bkd.signer,
+		Store:             bkd.store,
+		Journal:           bkd.journal,
+		handler:           bkd.handler,
+		Domain:            bkd.domain,
+		writeAhead:        bkd.WriteAhead,
+		webhook:           bkd.Webhook,
 	}, nil
 }
 
 // A Session is returned after successful login.
 type Session struct {
-	From    string
-	To      []string
-	data    bytes.Buffer
-	auth    bool
-	signer  *Signer
-	Store   pec_storage.MessageStore
-	handler func(*Session) error
-	Domain  string
+	ID       string
+	RemoteIP net.IP // address of the connecting client, if known
+	Helo     string
+	From     string
+	To       []string
+	data     bytes.Buffer
+	auth     bool
+	signer   *Signer
+	Store    pec_storage.MessageStore
+	Journal  pec_storage.Journal
+	handler  func(*Session) error
+	Domain   string
+
+	conn              *smtp.Conn // nil when the session is not bound to a connection
+	allowInsecureAuth bool
+	trusted           bool // the client connects from a trusted network
+	policy            SMTPPolicy
+	writeAhead        *WriteAheadLog
+	webhook           *Webhook
+}
+
+// authorized reports whether the client may relay messages under the policy
+// of the listener
+func (s *Session) authorized() bool {
+	switch s.policy {
+	case PolicySubmission:
+		return s.auth
+	case PolicyRelay:
+		return s.trusted || s.verifiedPeer()
+	default:
+		return s.auth || s.trusted
+	}
+}
+
+// verifiedPeer reports whether the client presented a TLS certificate that
+// was verified against the client CAs
+func (s *Session) verifiedPeer() bool {
+	state, isTLS := s.TLSConnectionState()
+	return isTLS && len(state.VerifiedChains) > 0
+}
+
+// TLSConnectionState returns the TLS state of the connection, if it is
+// encrypted. The state changes after a STARTTLS command.
+func (s *Session) TLSConnectionState() (tls.ConnectionState, bool) {
+	if s.conn == nil {
+		return tls.ConnectionState{}, false
+	}
+	return s.conn.TLSConnectionState()
+}
+
+// addrIP extracts the IP address of a network address
+func addrIP(addr net.Addr) net.IP {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP
+	}
+	if addr == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// newSessionID returns a random identifier used to correlate log lines
+// belonging to the same SMTP session.
+func newSessionID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// LogContext returns the structured fields identifying this session.
+func (s *Session) LogContext() map[string]string {
+	return map[string]string{
+		"session_id": s.ID,
+		"from":       s.From,
+		"to":         strings.Join(s.To, ","),
+	}
+}
+
+// Record appends an entry to the session journal and notifies the webhook,
+// if configured. Journal failures are logged but do not interrupt message
+// processing.
+func (s *Session) Record(entry pec_storage.JournalEntry) {
+	s.webhook.NotifyEntry(entry, s.From, s.To)
+	if s.Journal == nil {
+		return
+	}
+	if err := s.Journal.Record(entry); err != nil {
+		logger.LogError("Failed to record journal entry", err, s.LogContext())
+	}
+}
+
+// RecordResult records event for messageID with an outcome derived from err.
+func (s *Session) RecordResult(event pec_storage.JournalEvent, messageID string, err error) {
+	s.Record(ResultEntry(event, messageID, err))
+}
+
+// ResultEntry returns the journal entry of event for messageID, with an
+// outcome derived from err
+func ResultEntry(event pec_storage.JournalEvent, messageID string, err error) pec_storage.JournalEntry {
+	entry := pec_storage.JournalEntry{Event: event, MessageID: messageID}
+	if err != nil {
+		entry.Outcome = pec_storage.OutcomeFailure
+		entry.Detail = err.Error()
+	}
+	return entry
 }
 
 func (s *Session) GetFrom() (string, error) {
-	if !s.auth {
+	if !s.authorized() {
 		return "", smtp.ErrAuthRequired
 	}
 	return s.From, nil
 }
 
 func (s *Session) GetTo() ([]string, error) {
-	if !s.auth {
+	if !s.authorized() {
 		return nil, smtp.ErrAuthRequired
 	}
 	return s.To, nil
 }
 
 func (s *Session) GetData() ([]byte, error) {
-	if !s.auth {
+	if !s.authorized() {
 		return nil, smtp.ErrAuthRequired
 	}
 	return s.data.Bytes(), nil
 }
 
 func (s *Session) GetSigner() *Signer {
-	if !s.auth {
+	if !s.authorized() {
 		return nil
 	}
 	return s.signer
 }
 
 func (s *Session) GetStore() pec_storage.MessageStore {
-	if !s.auth {
+	if !s.authorized() {
 		return nil
 	}
 	return s.Store
 }
 
 func (s *Session) GetHandler() func(*Session) error {
-	if !s.auth {
+	if !s.authorized() {
 		return nil
 	}
 	return s.handler
@@ -100,11 +289,21 @@ func (s *Session) GetHandler() func(*Session) error {
 // AuthMechanisms returns a slice of available auth mechanisms; only PLAIN is
 // supported in this example.
 func (s *Session) AuthMechanisms() []string {
+	if s.policy == PolicyRelay {
+		return nil
+	}
 	return []string{sasl.Plain}
 }
 
 // Auth is the handler for supported authenticators.
 func (s *Session) Auth(mech string) (sasl.Server, error) {
+	if s.policy == PolicyRelay {
+		return nil, ErrAuthNotOffered
+	}
+	if _, isTLS := s.TLSConnectionState(); !isTLS && !s.allowInsecureAuth {
+		logger.LogWarn("Refused authentication without TLS", s.LogContext())
+		return nil, ErrTLSRequired
+	}
 	return sasl.NewPlainServer(func(identity, username, password string) error {
 		if username != "username" || password != "password" {
 			return errors.New("invalid username or password")
@@ -115,44 +314,163 @@ func (s *Session) Auth(mech string) (sasl.Server, error) {
 }
 
 func (s *Session) Mail(from string, opts *smtp.MailOptions) error {
-	if !s.auth {
+	if !s.authorized() {
+		ctx := s.LogContext()
+		ctx["remote_ip"] = s.RemoteIP.String()
+		logger.LogWarn("Refused relay from an untrusted network without authentication", ctx)
 		return smtp.ErrAuthRequired
 	}
-	log.Println("Mail from:", from)
 	s.From = from
+	logger.LogInfo("Mail from", s.LogContext())
 	return nil
 }
 
 func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) error {
-	if !s.auth {
+	if !s.authorized() {
 		return smtp.ErrAuthRequired
 	}
-	log.Println("Rcpt to:", to)
 	s.To = append(s.To, to)
+	logger.LogInfo("Rcpt to", s.LogContext())
 	return nil
 }
 
 func (s *Session) Data(r io.Reader) error {
-	if !s.auth {
+	if !s.authorized() {
 		return smtp.ErrAuthRequired
 	}
 	if b, err := io.ReadAll(r); err != nil {
 		return err
 	} else {
-		log.Println("Data:", string(b))
+		ctx := s.LogContext()
+		ctx["size"] = strconv.Itoa(len(b))
+		logger.LogDebug("Data received", ctx)
 		s.data.Write(b)
+		// Persist the message before processing it, so that it survives a crash
+		var writeAheadID string
+		if s.writeAhead != nil {
+			id, err := s.writeAhead.Write(WriteAheadEntry{
+				From:     s.From,
+				To:       s.To,
+				RemoteIP: ipString(s.RemoteIP),
+				Helo:     s.Helo,
+				Data:     b,
+			})
+			if err != nil {
+				logger.LogError("Failed to persist accepted message", err, s.LogContext())
+				return ErrWriteAheadFailed
+			}
+			writeAheadID = id
+		}
 		// Process the email data
-		if err := s.handler(s); err != nil {
-			log.Println("Error processing email data:", err)
-			return err
+		err := s.handler(s)
+		// The client is answered either way: the message is no longer ours
+		// to recover
+		if writeAheadID != "" {
+			if ackErr := s.writeAhead.Ack(writeAheadID); ackErr != nil {
+				logger.LogError("Failed to acknowledge accepted message", ackErr, s.LogContext())
+			}
+		}
+		if err != nil {
+			logger.LogError("Error processing email data", err, s.LogContext())
+			return ToSMTPError(err)
 		}
 	}
 	return nil
 }
 
+// ErrWriteAheadFailed is returned when an accepted message cannot be
+// persisted before processing it
+var ErrWriteAheadFailed = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+	Message:      "Requested action aborted: message could not be stored",
+}
+
+// RecoverWriteAhead processes again the messages of the write-ahead log whose
+// processing was interrupted, as they were received. A message failing
+// temporarily is kept for the next start; one failing permanently is
+// dropped, like a message refused to the client, and one crashing the
+// handler again is quarantined. It returns the number of messages processed.
+func (bkd *Backend) RecoverWriteAhead() (int, error) {
+	if bkd.WriteAhead == nil {
+		return 0, nil
+	}
+	entries, err := bkd.WriteAhead.Pending()
+	if err != nil {
+		return 0, err
+	}
+
+	processed := 0
+	for _, entry := range entries {
+		s := &Session{
+			ID:       newSessionID(),
+			RemoteIP: net.ParseIP(entry.RemoteIP),
+			Helo:     entry.Helo,
+			From:     entry.From,
+			To:       entry.To,
+			auth:     true, // the client was authorized when the message was accepted
+			signer:   bkd.signer,
+			Store:    bkd.store,
+			Journal:  bkd.journal,
+			handler:  bkd.handler,
+			Domain:   bkd.domain,
+			webhook:  bkd.Webhook,
+		}
+		s.data.Write(entry.Data)
+		ctx := s.LogContext()
+		ctx["message_id"] = entry.MessageID
+		logger.LogInfo("Recovering accepted message", ctx)
+
+		err := handleRecovered(s)
+		if errors.Is(err, errHandlerPanic) {
+			logger.LogError("Accepted message crashed on recovery, quarantining it", err, ctx)
+			if err := bkd.WriteAhead.Quarantine(entry.ID); err != nil {
+				logger.LogError("Failed to quarantine accepted message", err, ctx)
+			}
+			continue
+		}
+		var smtpErr *smtp.SMTPError
+		if err != nil && !(errors.As(ToSMTPError(err), &smtpErr) && smtpErr.Code >= 500) {
+			logger.LogError("Failed to recover accepted message", err, ctx)
+			continue
+		}
+		if err != nil {
+			logger.LogError("Accepted message refused on recovery", err, ctx)
+		}
+		if err := bkd.WriteAhead.Ack(entry.ID); err != nil {
+			logger.LogError("Failed to acknowledge accepted message", err, ctx)
+		}
+		processed++
+	}
+	return processed, nil
+}
+
+// errHandlerPanic is wrapped by the error of a handler that panicked
+var errHandlerPanic = errors.New("handler panicked")
+
+// handleRecovered runs the handler of a recovered message, turning a panic
+// into an error so that one message cannot stop the recovery of the others
+func handleRecovered(s *Session) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: %v", errHandlerPanic, r)
+		}
+	}()
+	return s.handler(s)
+}
+
+// ipString formats ip, empty when unknown
+func ipString(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
 func (s *Session) Reset() {}
 
 func (s *Session) Logout() error {
+	metrics.ActiveSMTPSessions.Dec()
 	return nil
 }
 
@@ -177,7 +495,15 @@ func ParseEmailFromSession(s Session) (*mail.Header, []byte, error) {
 	return &header, body, nil
 }
 
+// LoadSMIMECredentials reads a PEM certificate and private key. An encrypted
+// key is decrypted with the passphrase in the PEC_KEY_PASSPHRASE variable.
 func LoadSMIMECredentials(certPath, keyPath string) (*x509.Certificate, interface{}, error) {
+	return LoadSMIMECredentialsWithPassphrase(certPath, keyPath, os.Getenv(KeyPassphraseEnv))
+}
+
+// LoadSMIMECredentialsWithPassphrase reads a PEM certificate and private key,
+// decrypting the key with passphrase if it is encrypted
+func LoadSMIMECredentialsWithPassphrase(certPath, keyPath, passphrase string) (*x509.Certificate, interface{}, error) {
 	certPEM, err := os.ReadFile(certPath)
 	if err != nil {
 		return nil, nil, err
@@ -198,15 +524,7 @@ func LoadSMIMECredentials(certPath, keyPath string) (*x509.Certificate, interfac
 	}
 
 	// Parse private key
-	keyBlock, _ := pem.Decode(keyPEM)
-	if keyBlock == nil {
-		return nil, nil, errors.New("failed to decode private key")
-	}
-	privKey, err := x509.ParsePKCS8PrivateKey(keyBlock.Bytes)
-	if err != nil {
-		// fallback
-		privKey, err = x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
-	}
+	privKey, err := ParsePEMPrivateKey(keyPEM, passphrase)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -214,24 +532,72 @@ func LoadSMIMECredentials(certPath, keyPath string) (*x509.Certificate, interfac
 	return cert, privKey, nil
 }
 
-// StartSMTP starts the SMTP server with the given configuration
-func StartSMTP(addr string, domain string, backend *Backend) error {
+// getCertificate returns the TLS certificate for a handshake. It is looked up
+// on each handshake, so that reloaded certificates are picked up.
+func (bkd *Backend) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if bkd.Certificates != nil {
+		return bkd.Certificates.GetCertificate(hello)
+	}
+	cert, key, _ := bkd.signer.Credentials()
+	return &tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key}, nil
+}
+
+// tlsConfig returns the TLS configuration of the SMTP listener
+func (bkd *Backend) tlsConfig() *tls.Config {
+	config := &tls.Config{
+		GetCertificate: bkd.getCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+	if bkd.Policy == PolicySubmission {
+		// Users authenticate with their credentials instead
+		setClientAuth(config, nil)
+	} else {
+		setClientAuth(config, bkd.ClientCAs)
+	}
+	return config
+}
+
+// smtpGreetingText ends the greeting of the SMTP server, after its name
+const smtpGreetingText = "ESMTP Service Ready"
+
+// newSMTPServer returns an SMTP server announcing itself as serverName in
+// its greeting. It advertises 8BITMIME and CHUNKING: a body sent in BDAT
+// chunks is assembled before Session.Data reads it. BINARYMIME stays off,
+// binary parts would not survive the S/MIME signature of the envelopes.
+func newSMTPServer(serverName string, backend *Backend) *smtp.Server {
 	s := smtp.NewServer(backend)
+	s.Domain = serverName
+	s.AllowInsecureAuth = backend.AllowInsecureAuth
+	s.TLSConfig = backend.tlsConfig()
+	switch {
+	case backend.MaxLineLength > 0:
+		s.MaxLineLength = backend.MaxLineLength
+	case backend.MaxLineLength < 0:
+		s.MaxLineLength = 0
+	default:
+		s.MaxLineLength = defaultMaxLineLength
+	}
+	return s
+}
+
+// listener wraps l so that connections are greeted with the configured text
+func (bkd *Backend) listener(l net.Listener) net.Listener {
+	return newGreetingListener(l, smtpGreetingText, bkd.Greeting)
+}
+
+// StartSMTP starts the SMTP server with the given configuration, greeting
+// clients as serverName. The listener state is reported to health, if not nil.
+func StartSMTP(addr string, serverName string, backend *Backend, health *Health) error {
+	s := newSMTPServer(serverName, backend)
 	s.Addr = addr
-	s.Domain = domain
-	s.AllowInsecureAuth = true // Allow plain auth over STARTTLS
-	s.TLSConfig = &tls.Config{
-		Certificates: []tls.Certificate{
-			{
-				Certificate: [][]byte{backend.signer.Cert.Raw},
-				PrivateKey:  backend.signer.Key,
-			},
-		},
-		MinVersion:         tls.VersionTLS12,
-		InsecureSkipVerify: true,
-		ClientAuth:         tls.NoClientCert,
-	}
-
-	log.Printf("Starting SMTP server at %v with STARTTLS support", s.Addr)
-	return s.ListenAndServe()
+
+	logger.LogInfo("Starting SMTP server with STARTTLS support", map[string]string{"addr": s.Addr, "server_name": serverName})
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	health.SetBound("smtp", true)
+	defer health.SetBound("smtp", false)
+	return s.Serve(backend.listener(listener))
 }
@@ -0,0 +1,336 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	pec_storage "github.com/danzipie/go-pec/pec-server/internal/storage"
+	"github.com/emersion/go-sasl"
+)
+
+// startTestSMTP serves backend on a local listener and returns its address
+func startTestSMTP(t *testing.T, backend *Backend) string {
+	t.Helper()
+	s := newSMTPServer("localhost", backend)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go s.Serve(backend.listener(listener))
+	t.Cleanup(func() { s.Close() })
+	return listener.Addr().String()
+}
+
+// TestSession_AuthRequiresTLS tests that authentication is refused without TLS by default
+func TestSession_AuthRequiresTLS(t *testing.T) {
+	backend := NewBackend(nil, nil, nil, nil, "example.com")
+	session, err := backend.NewSession(nil)
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	if _, err := session.(*Session).Auth(sasl.Plain); !errors.Is(err, ErrTLSRequired) {
+		t.Errorf("Expected %v, got %v", ErrTLSRequired, err)
+	}
+
+	backend.AllowInsecureAuth = true
+	session, _ = backend.NewSession(nil)
+	auth, err := session.(*Session).Auth(sasl.Plain)
+	if err != nil {
+		t.Fatalf("Expected insecure authentication to be allowed, got %v", err)
+	}
+	if _, done, err := auth.Next([]byte("\x00username\x00password")); err != nil || !done {
+		t.Errorf("Authentication failed: %v", err)
+	}
+}
+
+// TestStartTLSBeforeAuth tests authentication over a real connection before and after STARTTLS
+func TestStartTLSBeforeAuth(t *testing.T) {
+	cert, key := createTestCertAndKey(t)
+	var sawTLS bool
+	handler := func(s *Session) error {
+		_, sawTLS = s.TLSConnectionState()
+		return nil
+	}
+	backend := NewBackend(&Signer{Cert: cert, Key: key}, pec_storage.NewInMemoryStore(), nil, handler, "example.com")
+	addr := startTestSMTP(t, backend)
+	auth := smtp.PlainAuth("", "username", "password", "127.0.0.1")
+
+	// Without STARTTLS, AUTH is neither advertised nor accepted
+	client, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if err := client.Auth(auth); err == nil {
+		t.Error("Expected authentication without TLS to be refused")
+	}
+	client.Close()
+
+	// After STARTTLS, the credentials are accepted and the session sees the TLS state
+	client, err = smtp.Dial(addr)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+	if err := client.StartTLS(&tls.Config{InsecureSkipVerify: true}); err != nil {
+		t.Fatalf("STARTTLS failed: %v", err)
+	}
+	if err := client.Auth(auth); err != nil {
+		t.Fatalf("Expected authentication over TLS to succeed, got %v", err)
+	}
+	if err := client.Mail("sender@example.com"); err != nil {
+		t.Fatalf("MAIL failed: %v", err)
+	}
+	if err := client.Rcpt("recipient@example.com"); err != nil {
+		t.Fatalf("RCPT failed: %v", err)
+	}
+	w, err := client.Data()
+	if err != nil {
+		t.Fatalf("DATA failed: %v", err)
+	}
+	w.Write([]byte(strings.ReplaceAll("Subject: test\n\nHello\n", "\n", "\r\n")))
+	if err := w.Close(); err != nil {
+		t.Fatalf("DATA failed: %v", err)
+	}
+	if !sawTLS {
+		t.Error("Expected the session to expose the TLS state")
+	}
+}
+
+// readGreeting returns the first line the server sends on conn
+func readGreeting(t *testing.T, conn net.Conn) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("Failed to read the greeting: %v", err)
+	}
+	return line
+}
+
+func TestStartSMTP_Greeting(t *testing.T) {
+	tests := []struct {
+		name     string
+		greeting string
+		want     string
+	}{
+		{"default", "", "220 mx.example.com ESMTP Service Ready\r\n"},
+		{"custom", "Posta Elettronica Certificata", "220 mx.example.com Posta Elettronica Certificata\r\n"},
+		{"multiline", "PEC\r\n250 injected", "220 mx.example.com PEC  250 injected\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := NewBackend(nil, pec_storage.NewInMemoryStore(), nil, nil, "example.com")
+			backend.Greeting = tt.greeting
+			s := newSMTPServer("mx.example.com", backend)
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("Failed to listen: %v", err)
+			}
+			go s.Serve(backend.listener(listener))
+			defer s.Close()
+
+			conn, err := net.Dial("tcp", listener.Addr().String())
+			if err != nil {
+				t.Fatalf("Failed to connect: %v", err)
+			}
+			defer conn.Close()
+			if got := readGreeting(t, conn); got != tt.want {
+				t.Errorf("Expected greeting %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+// TestStartSMTP_GreetingSession tests that a session works past the rewritten greeting
+func TestStartSMTP_GreetingSession(t *testing.T) {
+	backend := NewBackend(nil, pec_storage.NewInMemoryStore(), nil, nil, "example.com")
+	backend.Greeting = "Posta Elettronica Certificata"
+	addr := startTestSMTP(t, backend)
+
+	client, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+	if err := client.Hello("client.example.com"); err != nil {
+		t.Fatalf("EHLO failed: %v", err)
+	}
+	if ok, _ := client.Extension("STARTTLS"); !ok {
+		t.Errorf("Expected STARTTLS to be advertised")
+	}
+}
+
+// TestSession_DataChunking tests that a body sent in BDAT chunks reaches the
+// handler as sent
+func TestSession_DataChunking(t *testing.T) {
+	received := make(chan []byte, 1)
+	handler := func(s *Session) error {
+		data, err := s.GetData()
+		if err != nil {
+			return err
+		}
+		received <- append([]byte(nil), data...)
+		return nil
+	}
+	backend := NewBackend(nil, pec_storage.NewInMemoryStore(), nil, handler, "example.com")
+	backend.AllowInsecureAuth = true // there is no TLS to test
+	addr := startTestSMTP(t, backend)
+
+	conn, err := textproto.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	command := func(code int, format string, args ...interface{}) string {
+		t.Helper()
+		if _, err := conn.Cmd(format, args...); err != nil {
+			t.Fatalf("Failed to send %q: %v", format, err)
+		}
+		_, msg, err := conn.ReadResponse(code)
+		if err != nil {
+			t.Fatalf("Unexpected response to %q: %v", format, err)
+		}
+		return msg
+	}
+	if _, _, err := conn.ReadResponse(220); err != nil {
+		t.Fatalf("Unexpected greeting: %v", err)
+	}
+	extensions := command(250, "EHLO client.example.com")
+	for _, extension := range []string{"8BITMIME", "CHUNKING"} {
+		if !strings.Contains(extensions, extension) {
+			t.Errorf("Expected %s to be advertised, got %q", extension, extensions)
+		}
+	}
+	command(235, "AUTH PLAIN AHVzZXJuYW1lAHBhc3N3b3Jk")
+	command(250, "MAIL FROM:<sender@example.com> BODY=8BITMIME")
+	command(250, "RCPT TO:<recipient@example.com>")
+
+	// The chunks split a line and a UTF-8 sequence; a leading dot is not
+	// stuffed in BDAT
+	body := []byte("Subject: Fattura\r\nContent-Type: text/plain; charset=utf-8\r\n" +
+		"Content-Transfer-Encoding: 8bit\r\n\r\nPerchè la città è chiusa?\r\n.\r\nFine\r\n")
+	split := bytes.Index(body, []byte("città")) + 4
+	chunks := [][]byte{body[:split], body[split:]}
+	for i, chunk := range chunks {
+		last := ""
+		if i == len(chunks)-1 {
+			last = " LAST"
+		}
+		fmt.Fprintf(conn.W, "BDAT %d%s\r\n", len(chunk), last)
+		conn.W.Write(chunk)
+		if err := conn.W.Flush(); err != nil {
+			t.Fatalf("Failed to send chunk %d: %v", i, err)
+		}
+		if _, _, err := conn.ReadResponse(250); err != nil {
+			t.Fatalf("Unexpected response to chunk %d: %v", i, err)
+		}
+	}
+
+	select {
+	case got := <-received:
+		if !bytes.Equal(got, body) {
+			t.Errorf("Expected the reassembled body %q, got %q", body, got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the handler to be called")
+	}
+}
+
+// TestSession_DataBinary tests that an envelope carrying a binary part with
+// long and NUL-bearing lines goes through a session unchanged
+func TestSession_DataBinary(t *testing.T) {
+	cert, key := createTestCertAndKey(t)
+	signer := &Signer{Cert: cert, Key: key, Domain: "testdomain.com"}
+	original := "From: sender@testdomain.com\r\n" +
+		"To: recipient@example.com\r\n" +
+		"Subject: Binary\r\n" +
+		"Message-ID: <binary@testdomain.com>\r\n" +
+		"Content-Type: multipart/mixed; boundary=\"binary\"\r\n" +
+		"Content-Transfer-Encoding: binary\r\n" +
+		"\r\n" +
+		"--binary\r\n" +
+		"Content-Type: application/octet-stream\r\n" +
+		"Content-Transfer-Encoding: binary\r\n" +
+		"\r\n" +
+		strings.Repeat("0123456789", 500) + "\x00\x01\xff\r\n" +
+		"--binary--\r\n"
+	envelope, err := BuildTransportEnvelope([]byte(original), PECCertificationData{}, signer)
+	if err != nil {
+		t.Fatalf("BuildTransportEnvelope failed: %v", err)
+	}
+
+	tests := []struct {
+		name          string
+		maxLineLength int
+		accepted      bool
+	}{
+		{"default", 0, true},
+		{"unlimited", -1, true},
+		{"limited", 1000, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			received := make(chan []byte, 1)
+			handler := func(s *Session) error {
+				data, err := s.GetData()
+				if err != nil {
+					return err
+				}
+				received <- append([]byte(nil), data...)
+				return nil
+			}
+			backend := NewBackend(nil, pec_storage.NewInMemoryStore(), nil, handler, "example.com")
+			backend.AllowInsecureAuth = true // there is no TLS to test
+			backend.MaxLineLength = tt.maxLineLength
+			addr := startTestSMTP(t, backend)
+
+			client, err := smtp.Dial(addr)
+			if err != nil {
+				t.Fatalf("Failed to connect: %v", err)
+			}
+			defer client.Close()
+			if err := client.Auth(smtp.PlainAuth("", "username", "password", "127.0.0.1")); err != nil {
+				t.Fatalf("AUTH failed: %v", err)
+			}
+			if err := client.Mail("sender@testdomain.com"); err != nil {
+				t.Fatalf("MAIL failed: %v", err)
+			}
+			if err := client.Rcpt("recipient@example.com"); err != nil {
+				t.Fatalf("RCPT failed: %v", err)
+			}
+			w, err := client.Data()
+			if err != nil {
+				t.Fatalf("DATA failed: %v", err)
+			}
+			w.Write(envelope)
+			err = w.Close()
+			if !tt.accepted {
+				if err == nil {
+					t.Errorf("Expected a line over the limit to be refused")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("DATA failed: %v", err)
+			}
+
+			got := <-received
+			if !bytes.Equal(got, envelope) {
+				t.Fatalf("Expected the envelope unchanged, got %d bytes instead of %d", len(got), len(envelope))
+			}
+			if err := VerifyTransportEnvelope(got, testTrust(cert)); err != nil {
+				t.Errorf("Expected the received envelope to verify, got %v", err)
+			}
+		})
+	}
+}
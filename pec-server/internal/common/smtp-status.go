@@ -0,0 +1,65 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/emersion/go-smtp"
+)
+
+// SMTPStatus is implemented by handler errors that choose the SMTP reply
+// they are reported with
+type SMTPStatus interface {
+	SMTPStatus() (code int, enhancedCode smtp.EnhancedCode)
+}
+
+// ErrTimeout is the reply to a message whose processing timed out; it is a
+// temporary failure so that the client retries
+var ErrTimeout = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 4, 1},
+	Message:      "Timed out processing the message, try again later",
+}
+
+// ErrNotDelivered is the reply to a message whose delivery was given up
+// without its sender being notified; it is a permanent failure, so that the
+// client notifies the sender rather than retrying
+var ErrNotDelivered = &smtp.SMTPError{
+	Code:         554,
+	EnhancedCode: smtp.EnhancedCode{5, 4, 0},
+	Message:      "Unable to deliver the message",
+}
+
+// ToSMTPError maps an error returned by a handler to the reply to the DATA
+// command. An *smtp.SMTPError anywhere in the chain is returned as is,
+// errors implementing SMTPStatus get the code they choose and timeouts are
+// temporary failures. Other errors are returned unchanged and reported by
+// the server as permanent failures.
+func ToSMTPError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var smtpErr *smtp.SMTPError
+	if errors.As(err, &smtpErr) {
+		return smtpErr
+	}
+	var status SMTPStatus
+	if errors.As(err, &status) {
+		code, enhancedCode := status.SMTPStatus()
+		return &smtp.SMTPError{Code: code, EnhancedCode: enhancedCode, Message: err.Error()}
+	}
+	if isTimeout(err) {
+		return ErrTimeout
+	}
+	return err
+}
+
+// isTimeout reports whether err is caused by a deadline being exceeded
+func isTimeout(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, context.DeadlineExceeded)
+}
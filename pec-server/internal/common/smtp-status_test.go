@@ -0,0 +1,70 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// statusError chooses its own SMTP reply
+type statusError struct{}
+
+func (statusError) Error() string { return "refused" }
+
+func (statusError) SMTPStatus() (int, smtp.EnhancedCode) {
+	return 550, smtp.EnhancedCode{5, 7, 1}
+}
+
+// httpTimeout returns the error of a request to a server answering too late
+func httpTimeout(t *testing.T) error {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer server.Close()
+	client := &http.Client{Timeout: 20 * time.Millisecond}
+	_, err := client.Get(server.URL)
+	if err == nil {
+		t.Fatalf("Expected the request to time out")
+	}
+	return err
+}
+
+func TestToSMTPError(t *testing.T) {
+	plain := errors.New("failed to parse incoming message")
+	tests := []struct {
+		name         string
+		err          error
+		wantCode     int
+		wantEnhanced smtp.EnhancedCode
+	}{
+		{"SMTP error", fmt.Errorf("wrapped: %w", ErrTLSRequired), 530, smtp.EnhancedCode{5, 7, 0}},
+		{"status error", fmt.Errorf("wrapped: %w", statusError{}), 550, smtp.EnhancedCode{5, 7, 1}},
+		{"forward timeout", fmt.Errorf("failed to forward to delivery point: %w", httpTimeout(t)), 451, smtp.EnhancedCode{4, 4, 1}},
+		{"deadline exceeded", fmt.Errorf("wrapped: %w", context.DeadlineExceeded), 451, smtp.EnhancedCode{4, 4, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var smtpErr *smtp.SMTPError
+			if !errors.As(ToSMTPError(tt.err), &smtpErr) {
+				t.Fatalf("Expected an SMTP error, got %v", ToSMTPError(tt.err))
+			}
+			if smtpErr.Code != tt.wantCode || smtpErr.EnhancedCode != tt.wantEnhanced {
+				t.Errorf("Expected %d %v, got %d %v", tt.wantCode, tt.wantEnhanced, smtpErr.Code, smtpErr.EnhancedCode)
+			}
+		})
+	}
+
+	if err := ToSMTPError(plain); err != plain {
+		t.Errorf("Expected other errors to be returned unchanged, got %v", err)
+	}
+	if err := ToSMTPError(nil); err != nil {
+		t.Errorf("Expected nil, got %v", err)
+	}
+}
@@ -0,0 +1,237 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// spfMaxLookups is the limit on DNS querying terms per evaluation (RFC 7208 section 4.6.4)
+const spfMaxLookups = 10
+
+// CheckSPF evaluates the SPF policy of domain for a message received from ip.
+// Macros and the ptr mechanism are not supported.
+func CheckSPF(ctx context.Context, resolver DNSResolver, ip net.IP, domain string) (AuthResult, error) {
+	if ip == nil {
+		return AuthNone, errors.New("no client IP available")
+	}
+	if domain == "" {
+		return AuthNone, errors.New("no sender domain available")
+	}
+	lookups := 0
+	return checkSPF(ctx, resolver, ip, domain, &lookups)
+}
+
+func checkSPF(ctx context.Context, resolver DNSResolver, ip net.IP, domain string, lookups *int) (AuthResult, error) {
+	record, result, err := lookupSPFRecord(ctx, resolver, domain)
+	if record == "" {
+		return result, err
+	}
+
+	var redirect string
+	for _, term := range strings.Fields(record)[1:] {
+		if name, value, ok := strings.Cut(term, "="); ok && !strings.Contains(name, ":") {
+			if strings.EqualFold(name, "redirect") {
+				redirect = value
+			}
+			continue
+		}
+
+		qualifier := AuthPass
+		switch term[0] {
+		case '+':
+			term = term[1:]
+		case '-':
+			qualifier, term = AuthFail, term[1:]
+		case '~':
+			qualifier, term = AuthSoftFail, term[1:]
+		case '?':
+			qualifier, term = AuthNeutral, term[1:]
+		}
+
+		match, result, err := spfMatch(ctx, resolver, ip, domain, term, lookups)
+		if err != nil {
+			return result, err
+		}
+		if match {
+			return qualifier, nil
+		}
+	}
+
+	if redirect != "" {
+		if err := spfCountLookup(lookups); err != nil {
+			return AuthPermError, err
+		}
+		result, err := checkSPF(ctx, resolver, ip, redirect, lookups)
+		if result == AuthNone {
+			return AuthPermError, fmt.Errorf("SPF redirect to %s has no record", redirect)
+		}
+		return result, err
+	}
+	return AuthNeutral, nil
+}
+
+// lookupSPFRecord returns the "v=spf1" record of domain, if any
+func lookupSPFRecord(ctx context.Context, resolver DNSResolver, domain string) (string, AuthResult, error) {
+	txts, err := resolver.LookupTXT(ctx, domain)
+	if err != nil {
+		if isTemporaryDNSError(err) {
+			return "", AuthTempError, fmt.Errorf("SPF lookup failed: %v", err)
+		}
+		return "", AuthNone, nil
+	}
+
+	var records []string
+	for _, txt := range txts {
+		if strings.EqualFold(txt, "v=spf1") || strings.HasPrefix(strings.ToLower(txt), "v=spf1 ") {
+			records = append(records, txt)
+		}
+	}
+	switch len(records) {
+	case 0:
+		return "", AuthNone, nil
+	case 1:
+		return records[0], AuthNone, nil
+	default:
+		return "", AuthPermError, fmt.Errorf("multiple SPF records for %s", domain)
+	}
+}
+
+// spfMatch reports whether ip matches a single mechanism
+func spfMatch(ctx context.Context, resolver DNSResolver, ip net.IP, domain, mechanism string, lookups *int) (bool, AuthResult, error) {
+	name, arg, _ := strings.Cut(mechanism, ":")
+	name, cidr, _ := strings.Cut(name, "/")
+	if cidr != "" {
+		arg += "/" + cidr
+	}
+
+	switch strings.ToLower(name) {
+	case "all":
+		return true, AuthNone, nil
+
+	case "ip4", "ip6":
+		if !strings.Contains(arg, "/") {
+			other := net.ParseIP(arg)
+			if other == nil {
+				return false, AuthPermError, fmt.Errorf("invalid SPF address: %s", arg)
+			}
+			return other.Equal(ip), AuthNone, nil
+		}
+		_, network, err := net.ParseCIDR(arg)
+		if err != nil {
+			return false, AuthPermError, fmt.Errorf("invalid SPF network: %s", arg)
+		}
+		return network.Contains(ip), AuthNone, nil
+
+	case "a", "mx":
+		if err := spfCountLookup(lookups); err != nil {
+			return false, AuthPermError, err
+		}
+		host, v4Bits, v6Bits, err := spfDualCIDR(arg, domain)
+		if err != nil {
+			return false, AuthPermError, err
+		}
+
+		hosts := []string{host}
+		if strings.EqualFold(name, "mx") {
+			mxs, err := resolver.LookupMX(ctx, host)
+			if err != nil && isTemporaryDNSError(err) {
+				return false, AuthTempError, fmt.Errorf("SPF MX lookup failed: %v", err)
+			}
+			hosts = hosts[:0]
+			for _, mx := range mxs {
+				hosts = append(hosts, strings.TrimSuffix(mx.Host, "."))
+			}
+		}
+
+		for _, h := range hosts {
+			addrs, err := resolver.LookupIP(ctx, "ip", h)
+			if err != nil && isTemporaryDNSError(err) {
+				return false, AuthTempError, fmt.Errorf("SPF address lookup failed: %v", err)
+			}
+			for _, addr := range addrs {
+				bits, size := v6Bits, 128
+				if addr.To4() != nil {
+					bits, size = v4Bits, 32
+				}
+				network := &net.IPNet{IP: addr, Mask: net.CIDRMask(bits, size)}
+				if network.Contains(ip) {
+					return true, AuthNone, nil
+				}
+			}
+		}
+		return false, AuthNone, nil
+
+	case "include":
+		if err := spfCountLookup(lookups); err != nil {
+			return false, AuthPermError, err
+		}
+		result, err := checkSPF(ctx, resolver, ip, arg, lookups)
+		switch result {
+		case AuthPass:
+			return true, AuthNone, nil
+		case AuthFail, AuthSoftFail, AuthNeutral:
+			return false, AuthNone, nil
+		case AuthTempError:
+			return false, AuthTempError, err
+		default:
+			if err == nil {
+				err = fmt.Errorf("SPF include of %s has no record", arg)
+			}
+			return false, AuthPermError, err
+		}
+
+	case "exists":
+		if err := spfCountLookup(lookups); err != nil {
+			return false, AuthPermError, err
+		}
+		addrs, err := resolver.LookupIP(ctx, "ip4", arg)
+		if err != nil && isTemporaryDNSError(err) {
+			return false, AuthTempError, fmt.Errorf("SPF exists lookup failed: %v", err)
+		}
+		return len(addrs) > 0, AuthNone, nil
+
+	case "ptr":
+		// Deprecated by RFC 7208 and never matched here
+		return false, AuthNone, nil
+
+	default:
+		return false, AuthPermError, fmt.Errorf("unknown SPF mechanism: %s", name)
+	}
+}
+
+// spfDualCIDR splits "domain/24//64" into its host and prefix lengths
+func spfDualCIDR(arg, domain string) (string, int, int, error) {
+	v4Bits, v6Bits := 32, 128
+
+	if rest, v6, ok := strings.Cut(arg, "//"); ok {
+		bits, err := strconv.Atoi(v6)
+		if err != nil || bits < 0 || bits > 128 {
+			return "", 0, 0, fmt.Errorf("invalid SPF prefix: %s", arg)
+		}
+		v6Bits, arg = bits, rest
+	}
+	host, v4, ok := strings.Cut(arg, "/")
+	if ok {
+		bits, err := strconv.Atoi(v4)
+		if err != nil || bits < 0 || bits > 32 {
+			return "", 0, 0, fmt.Errorf("invalid SPF prefix: %s", arg)
+		}
+		v4Bits = bits
+	}
+	if host == "" {
+		host = domain
+	}
+	return host, v4Bits, v6Bits, nil
+}
+
+func spfCountLookup(lookups *int) error {
+	*lookups++
+	if *lookups > spfMaxLookups {
+		return errors.New("too many SPF DNS lookups")
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package common
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+// TestCheckSPF tests the evaluation of SPF policies against the client IP
+func TestCheckSPF(t *testing.T) {
+	resolver := &fakeResolver{
+		txt: map[string][]string{
+			"example.com":       {"v=spf1 ip4:192.0.2.0/24 include:_spf.example.net -all"},
+			"_spf.example.net":  {"v=spf1 a:mail.example.net mx ~all"},
+			"soft.example.com":  {"v=spf1 ~all"},
+			"redir.example.com": {"v=spf1 redirect=example.com"},
+			"other.example.com": {"some unrelated record"},
+		},
+		ips: map[string][]net.IP{
+			"mail.example.net": {net.ParseIP("198.51.100.10")},
+			"mx.example.net":   {net.ParseIP("2001:db8::25")},
+		},
+		mx: map[string][]*net.MX{
+			"_spf.example.net": {{Host: "mx.example.net.", Pref: 10}},
+		},
+	}
+
+	tests := []struct {
+		name   string
+		ip     string
+		domain string
+		want   AuthResult
+	}{
+		{"ip4 network", "192.0.2.55", "example.com", AuthPass},
+		{"include a", "198.51.100.10", "example.com", AuthPass},
+		{"include mx", "2001:db8::25", "example.com", AuthPass},
+		{"not listed", "203.0.113.7", "example.com", AuthFail},
+		{"softfail", "203.0.113.7", "soft.example.com", AuthSoftFail},
+		{"redirect", "192.0.2.1", "redir.example.com", AuthPass},
+		{"no record", "192.0.2.1", "other.example.com", AuthNone},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := CheckSPF(context.Background(), resolver, net.ParseIP(tt.ip), tt.domain)
+			if result != tt.want {
+				t.Errorf("Expected %s, got %s (%v)", tt.want, result, err)
+			}
+		})
+	}
+}
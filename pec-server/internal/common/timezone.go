@@ -0,0 +1,35 @@
+package common
+
+import (
+	"fmt"
+	"time"
+	_ "time/tzdata" // the zone database, for hosts installed without one
+)
+
+// DefaultTimezone is the zone the dates of the receipts and envelopes are
+// given in when none is configured: the Italian time
+const DefaultTimezone = "Europe/Rome"
+
+// DefaultLocation is the location of DefaultTimezone
+var DefaultLocation = mustLoadLocation(DefaultTimezone)
+
+// LoadTimezone returns the location of the configured Timezone, or
+// DefaultLocation when none is configured
+func LoadTimezone(cfg *Config) (*time.Location, error) {
+	if cfg.Timezone == "" {
+		return DefaultLocation, nil
+	}
+	location, err := time.LoadLocation(cfg.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load timezone %q: %v", cfg.Timezone, err)
+	}
+	return location, nil
+}
+
+func mustLoadLocation(name string) *time.Location {
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		panic(fmt.Sprintf("failed to load timezone %q: %v", name, err))
+	}
+	return location
+}
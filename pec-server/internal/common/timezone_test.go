@@ -0,0 +1,80 @@
+package common
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/danzipie/go-pec/pec"
+)
+
+func TestLoadTimezone(t *testing.T) {
+	location, err := LoadTimezone(&Config{})
+	if err != nil || location.String() != DefaultTimezone {
+		t.Errorf("Expected %s by default, got %v (%v)", DefaultTimezone, location, err)
+	}
+	location, err = LoadTimezone(&Config{Timezone: "UTC"})
+	if err != nil || location != time.UTC {
+		t.Errorf("Expected UTC, got %v (%v)", location, err)
+	}
+	if _, err := LoadTimezone(&Config{Timezone: "Europe/Atlantide"}); err == nil {
+		t.Error("Expected an error for an unknown timezone")
+	}
+}
+
+// TestCreatePECTransportEnvelope_Timezone tests that the dates of an
+// envelope are given in the Italian time, with or without daylight saving
+func TestCreatePECTransportEnvelope_Timezone(t *testing.T) {
+	tests := []struct {
+		name     string
+		instant  time.Time
+		zona     string
+		ora      string
+		abbrev   string
+		dateHead string
+	}{
+		{"winter", time.Date(2024, 1, 15, 12, 0, 0, 0, time.UTC), "+0100", "13:00:00", "CET", "Mon, 15 Jan 2024 13:00:00 +0100"},
+		{"summer", time.Date(2024, 7, 15, 12, 0, 0, 0, time.UTC), "+0200", "14:00:00", "CEST", "Mon, 15 Jul 2024 14:00:00 +0200"},
+	}
+	location, err := LoadTimezone(&Config{})
+	if err != nil {
+		t.Fatalf("LoadTimezone failed: %v", err)
+	}
+	mailReader, err := ParseEmailMessage([]byte("From: sender@testdomain.com\r\nTo: primo@example.com\r\nSubject: Ora\r\n\r\nHello\r\n"))
+	if err != nil {
+		t.Fatalf("Failed to parse message: %v", err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			envelope, err := CreatePECTransportEnvelope(&mailReader.Header, PECCertificationData{
+				OriginalSubject: "Ora",
+				OriginalFrom:    "sender@testdomain.com",
+				Recipients:      []string{"primo@example.com"},
+				Date:            tt.instant.In(location),
+				ProviderDomain:  "testdomain.com",
+			})
+			if err != nil {
+				t.Fatalf("CreatePECTransportEnvelope failed: %v", err)
+			}
+			if got := envelope.Headers["Date"]; got != tt.dateHead {
+				t.Errorf("Expected Date %q, got %q", tt.dateHead, got)
+			}
+			if want := "alle ore " + tt.ora + " (" + tt.abbrev + ")"; !strings.Contains(envelope.Body, want) {
+				t.Errorf("Expected %q in the body, got %q", want, envelope.Body)
+			}
+
+			var datiCert pec.DatiCert
+			if err := xml.Unmarshal([]byte(envelope.XMLData), &datiCert); err != nil {
+				t.Fatalf("Failed to parse daticert.xml: %v", err)
+			}
+			if datiCert.Dati.Data.Zona != tt.zona {
+				t.Errorf("Expected zona %s, got %s", tt.zona, datiCert.Dati.Data.Zona)
+			}
+			if datiCert.Dati.Data.Ora != tt.ora {
+				t.Errorf("Expected ora %s, got %s", tt.ora, datiCert.Dati.Data.Ora)
+			}
+		})
+	}
+}
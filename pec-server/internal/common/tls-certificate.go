@@ -0,0 +1,143 @@
+package common
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/danzipie/go-pec/pec-server/logger"
+)
+
+// CertificateHolder serves the TLS certificate of the listeners and lets it
+// be swapped while they are running. The certificate is re-read from its
+// files on SIGHUP or when the files change.
+type CertificateHolder struct {
+	certFile string
+	keyFile  string
+	cert     atomic.Pointer[tls.Certificate]
+	modTimes [2]time.Time
+	reloadMu sync.Mutex // serializes reloads
+
+	mu   sync.Mutex
+	stop chan struct{}
+	done chan struct{}
+}
+
+// LoadCertificateHolder loads a PEM certificate and key into a new holder
+func LoadCertificateHolder(certFile, keyFile string) (*CertificateHolder, error) {
+	h := &CertificateHolder{certFile: certFile, keyFile: keyFile}
+	if err := h.Reload(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// LoadTLSCertificates loads the TLS certificate configured in cfg. It returns
+// nil if none is configured.
+func LoadTLSCertificates(cfg *Config) (*CertificateHolder, error) {
+	if cfg.TLSCertFile == "" && cfg.TLSKeyFile == "" {
+		return nil, nil
+	}
+	return LoadCertificateHolder(cfg.TLSCertFile, cfg.TLSKeyFile)
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (h *CertificateHolder) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return h.cert.Load(), nil
+}
+
+// Reload re-reads the certificate and key files. The current certificate is
+// kept if they cannot be loaded.
+func (h *CertificateHolder) Reload() error {
+	h.reloadMu.Lock()
+	defer h.reloadMu.Unlock()
+	return h.reload()
+}
+
+// reload loads the files; reloadMu must be held
+func (h *CertificateHolder) reload() error {
+	modTimes := h.statFiles()
+	cert, err := tls.LoadX509KeyPair(h.certFile, h.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %v", err)
+	}
+	h.cert.Store(&cert)
+	h.modTimes = modTimes
+	return nil
+}
+
+// statFiles returns the modification times of the certificate and key files
+func (h *CertificateHolder) statFiles() [2]time.Time {
+	var modTimes [2]time.Time
+	for i, path := range []string{h.certFile, h.keyFile} {
+		if info, err := os.Stat(path); err == nil {
+			modTimes[i] = info.ModTime()
+		}
+	}
+	return modTimes
+}
+
+// reloadIfChanged reloads the certificate if its files were modified
+func (h *CertificateHolder) reloadIfChanged() error {
+	h.reloadMu.Lock()
+	defer h.reloadMu.Unlock()
+	if h.statFiles() == h.modTimes {
+		return nil
+	}
+	return h.reload()
+}
+
+// Start reloads the certificate on SIGHUP and checks its files for changes
+// every interval, until Stop is called
+func (h *CertificateHolder) Start(interval time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.stop != nil {
+		return
+	}
+	h.stop = make(chan struct{})
+	h.done = make(chan struct{})
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func(stop, done chan struct{}) {
+		defer close(done)
+		defer signal.Stop(hup)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			var err error
+			select {
+			case <-stop:
+				return
+			case <-hup:
+				err = h.Reload()
+			case <-ticker.C:
+				err = h.reloadIfChanged()
+			}
+			if err != nil {
+				logger.LogError("Failed to reload TLS certificate", err, map[string]string{"cert_file": h.certFile})
+			}
+		}
+	}(h.stop, h.done)
+}
+
+// Stop halts the reloading and waits for the current reload to complete
+func (h *CertificateHolder) Stop() {
+	h.mu.Lock()
+	stop, done := h.stop, h.done
+	h.stop, h.done = nil, nil
+	h.mu.Unlock()
+
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+}
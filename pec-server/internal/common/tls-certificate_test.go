@@ -0,0 +1,136 @@
+package common
+
+import (
+	"crypto/tls"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// handshakeCommonName connects to addr and returns the common name of the served certificate
+func handshakeCommonName(t *testing.T, addr string) string {
+	t.Helper()
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+// startTLSListener accepts connections with config and completes their handshakes
+func startTLSListener(t *testing.T, config *tls.Config) string {
+	t.Helper()
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// touch bumps the modification time of the files, as the file system may
+// not tell apart writes within the same tick
+func touch(t *testing.T, paths ...string) {
+	t.Helper()
+	later := time.Now().Add(time.Minute)
+	for _, path := range paths {
+		if err := os.Chtimes(path, later, later); err != nil {
+			t.Fatalf("Failed to touch %s: %v", path, err)
+		}
+	}
+}
+
+// TestCertificateHolder_Reload tests that a new handshake uses the swapped certificate
+func TestCertificateHolder_Reload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeTestCredentials(t, certFile, keyFile, "old.example.com", time.Now().AddDate(1, 0, 0))
+
+	holder, err := LoadCertificateHolder(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("LoadCertificateHolder failed: %v", err)
+	}
+	backend := &IMAPBackend{Certificates: holder}
+	addr := startTLSListener(t, backend.tlsConfig())
+
+	if cn := handshakeCommonName(t, addr); cn != "old.example.com" {
+		t.Fatalf("Expected the old certificate, got %s", cn)
+	}
+
+	writeTestCredentials(t, certFile, keyFile, "new.example.com", time.Now().AddDate(1, 0, 0))
+	touch(t, certFile, keyFile)
+	if err := holder.reloadIfChanged(); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if cn := handshakeCommonName(t, addr); cn != "new.example.com" {
+		t.Errorf("Expected the new certificate, got %s", cn)
+	}
+
+	// A broken key keeps the current certificate in use
+	if err := os.WriteFile(keyFile, []byte("not a key"), 0600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+	if err := holder.Reload(); err == nil {
+		t.Fatal("Expected the reload to fail")
+	}
+	if cn := handshakeCommonName(t, addr); cn != "new.example.com" {
+		t.Errorf("Expected the current certificate to be kept, got %s", cn)
+	}
+}
+
+// TestCertificateHolder_SIGHUP tests that SIGHUP reloads the certificate
+func TestCertificateHolder_SIGHUP(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeTestCredentials(t, certFile, keyFile, "old.example.com", time.Now().AddDate(1, 0, 0))
+
+	holder, err := LoadCertificateHolder(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("LoadCertificateHolder failed: %v", err)
+	}
+	// The interval is long enough for only the signal to trigger a reload
+	holder.Start(time.Hour)
+	defer holder.Stop()
+
+	writeTestCredentials(t, certFile, keyFile, "new.example.com", time.Now().AddDate(1, 0, 0))
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatalf("Failed to send SIGHUP: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		cert, _ := holder.GetCertificate(nil)
+		if cert.Leaf != nil && cert.Leaf.Subject.CommonName == "new.example.com" {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Expected SIGHUP to reload the certificate")
+}
+
+// TestBackend_GetCertificateFallback tests that the S/MIME credentials are served without a holder
+func TestBackend_GetCertificateFallback(t *testing.T) {
+	cert, key := createTestCertAndKey(t)
+	backend := &Backend{signer: &Signer{Cert: cert, Key: key}}
+
+	served, err := backend.getCertificate(nil)
+	if err != nil {
+		t.Fatalf("getCertificate failed: %v", err)
+	}
+	if len(served.Certificate) != 1 || string(served.Certificate[0]) != string(cert.Raw) {
+		t.Errorf("Expected the S/MIME certificate to be served")
+	}
+}
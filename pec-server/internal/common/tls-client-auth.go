@@ -0,0 +1,36 @@
+package common
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// LoadClientCAs loads the CA certificates that client certificates are
+// verified against. It returns nil if mutual TLS is not configured.
+func LoadClientCAs(cfg *Config) (*x509.CertPool, error) {
+	if cfg.ClientCAFile == "" {
+		return nil, nil
+	}
+	caPEM, err := os.ReadFile(cfg.ClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client CA file: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates found in client CA file %s", cfg.ClientCAFile)
+	}
+	return pool, nil
+}
+
+// setClientAuth requires clients to present a certificate issued by one of
+// clientCAs. Client certificates are not requested if clientCAs is nil.
+func setClientAuth(config *tls.Config, clientCAs *x509.CertPool) {
+	if clientCAs == nil {
+		config.ClientAuth = tls.NoClientCert
+		return
+	}
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	config.ClientCAs = clientCAs
+}
@@ -0,0 +1,148 @@
+package common
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// createTestCertificate issues a certificate for commonName, signed by parent
+// or self-signed when parent is nil
+func createTestCertificate(t *testing.T, commonName string, isCA bool, parent *tls.Certificate) tls.Certificate {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+	}
+	issuer, signerKey := template, interface{}(key)
+	if parent != nil {
+		issuer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// handshakeResult serves a single connection with config and returns the
+// outcome of the server side of the handshake
+func handshakeResult(t *testing.T, config *tls.Config, client *tls.Config) error {
+	t.Helper()
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	result := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			result <- err
+			return
+		}
+		defer conn.Close()
+		result <- conn.(*tls.Conn).Handshake()
+	}()
+
+	conn, err := tls.Dial("tcp", listener.Addr().String(), client)
+	if err == nil {
+		conn.Close()
+	}
+	return <-result
+}
+
+// TestBackend_MutualTLS tests that only clients with a certificate issued by the configured CA are accepted
+func TestBackend_MutualTLS(t *testing.T) {
+	ca := createTestCertificate(t, "Test Provider CA", true, nil)
+	trusted := createTestCertificate(t, "pec.trusted.example", false, &ca)
+	rogue := createTestCertificate(t, "pec.rogue.example", false, nil)
+
+	caFile := filepath.Join(t.TempDir(), "client-ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Certificate[0]}), 0600); err != nil {
+		t.Fatalf("Failed to write CA file: %v", err)
+	}
+	clientCAs, err := LoadClientCAs(&Config{ClientCAFile: caFile})
+	if err != nil {
+		t.Fatalf("LoadClientCAs failed: %v", err)
+	}
+
+	cert, key := createTestCertAndKey(t)
+	backend := &Backend{signer: &Signer{Cert: cert, Key: key}, ClientCAs: clientCAs}
+
+	tests := []struct {
+		name    string
+		certs   []tls.Certificate
+		wantErr bool
+	}{
+		{"certificate issued by the CA", []tls.Certificate{trusted}, false},
+		{"certificate issued by another CA", []tls.Certificate{rogue}, true},
+		{"no certificate", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &tls.Config{InsecureSkipVerify: true, Certificates: tt.certs}
+			err := handshakeResult(t, backend.tlsConfig(), client)
+			if tt.wantErr && err == nil {
+				t.Error("Expected the handshake to be rejected")
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("Expected the handshake to succeed, got %v", err)
+			}
+		})
+	}
+}
+
+// TestBackend_NoClientCert tests that client certificates are not requested by default
+func TestBackend_NoClientCert(t *testing.T) {
+	cert, key := createTestCertAndKey(t)
+	backend := &Backend{signer: &Signer{Cert: cert, Key: key}}
+
+	config := backend.tlsConfig()
+	if config.ClientAuth != tls.NoClientCert {
+		t.Errorf("Expected NoClientCert, got %v", config.ClientAuth)
+	}
+	if err := handshakeResult(t, config, &tls.Config{InsecureSkipVerify: true}); err != nil {
+		t.Errorf("Expected the handshake to succeed, got %v", err)
+	}
+}
+
+// TestLoadClientCAs tests the loading of the client CA file
+func TestLoadClientCAs(t *testing.T) {
+	if pool, err := LoadClientCAs(&Config{}); pool != nil || err != nil {
+		t.Errorf("Expected no pool without a CA file, got %v, %v", pool, err)
+	}
+
+	empty := filepath.Join(t.TempDir(), "empty.pem")
+	os.WriteFile(empty, []byte("not a certificate"), 0600)
+	if _, err := LoadClientCAs(&Config{ClientCAFile: empty}); err == nil {
+		t.Error("Expected an error for a file without certificates")
+	}
+	if _, err := LoadClientCAs(&Config{ClientCAFile: "testdata/missing.pem"}); err == nil {
+		t.Error("Expected an error for a missing file")
+	}
+}
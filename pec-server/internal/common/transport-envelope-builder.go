@@ -0,0 +1,313 @@
+package common
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/danzipie/go-pec/pec"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+)
+
+// PECTransportEnvelope represents the PEC transport envelope
+type PECTransportEnvelope struct {
+	Headers map[string]string
+	Body    string
+	XMLData string // XML attachment data
+}
+
+// envelopeHeaderOrder is the canonical order of the transport envelope
+// headers; any other header (X-*) follows in alphabetical order.
+var envelopeHeaderOrder = []string{
+	"Received",
+	"Return-Path",
+	"From",
+	"Reply-To",
+	"To",
+	"Cc",
+	"Subject",
+	"Date",
+	"Message-ID",
+}
+
+// orderedHeaderNames returns the names of the envelope headers in canonical order
+func (e *PECTransportEnvelope) orderedHeaderNames() []string {
+	names := make([]string, 0, len(e.Headers))
+	known := make(map[string]bool, len(envelopeHeaderOrder))
+	for _, name := range envelopeHeaderOrder {
+		known[name] = true
+		if _, ok := e.Headers[name]; ok {
+			names = append(names, name)
+		}
+	}
+
+	var others []string
+	for name := range e.Headers {
+		if !known[name] {
+			others = append(others, name)
+		}
+	}
+	sort.Strings(others)
+
+	return append(names, others...)
+}
+
+// PECCertificationData contains the certification information
+type PECCertificationData struct {
+	MessageID       string
+	OriginalSubject string
+	OriginalFrom    string
+	Recipients      []string  // primary recipients, from To
+	Cc              []string  // recipients in copy, from Cc
+	Date            time.Time // in the zone the dates are given in
+	Timezone        string    // name of the zone in the body, that of Date when empty
+	ProviderDomain  string    // domain of the sending provider
+	From            ProviderFrom
+}
+
+// CreatePECTransportEnvelope creates a PEC transport envelope from the original message
+func CreatePECTransportEnvelope(originalMsg *mail.Header, certData PECCertificationData) (*PECTransportEnvelope, error) {
+	envelope := &PECTransportEnvelope{
+		Headers: make(map[string]string),
+	}
+	certData.OriginalSubject = SubjectText(certData.OriginalSubject)
+	if certData.Timezone == "" {
+		certData.Timezone = certData.Date.Format("MST")
+	}
+
+	// Inherit unchanged headers from original message
+	inheritedHeaders := []string{
+		"Received",
+		"To",
+		"Cc",
+		"Return-Path",
+		"Message-ID",
+		"X-TipoRicevuta",
+	}
+
+	for _, header := range inheritedHeaders {
+		if value := originalMsg.Header.Get(header); value != "" {
+			envelope.Headers[header] = value
+		}
+	}
+
+	// Set/modify required headers
+	envelope.Headers["X-Trasporto"] = "posta-certificata"
+	if certData.MessageID != "" {
+		envelope.Headers["X-Riferimento-Message-ID"] = certData.MessageID
+	}
+	envelope.Headers["Date"] = certData.Date.Format(time.RFC1123Z)
+	envelope.Headers["Subject"] = EncodeHeaderText(fmt.Sprintf("POSTA CERTIFICATA: %s", certData.OriginalSubject))
+	envelope.Headers["From"] = FormatAddress(certData.From.Address(certData.ProviderDomain))
+	if certData.OriginalFrom != "" {
+		envelope.Headers["From"] = FormatAddress(certData.From.OnBehalfOf(certData.ProviderDomain, originalAddress(certData.OriginalFrom)))
+
+		// Add Reply-To if not present in original
+		if originalMsg.Header.Get("Reply-To") == "" {
+			envelope.Headers["Reply-To"] = EncodeAddressList(certData.OriginalFrom)
+		}
+	}
+
+	// Create the body text
+	envelope.Body = createPECBodyText(certData)
+
+	// Generate XML certification data
+	envelope.XMLData = createPECXMLData(certData)
+
+	return envelope, nil
+}
+
+// originalAddress returns the bare address of a From header value
+func originalAddress(from string) string {
+	if addr, err := mail.ParseAddress(from); err == nil {
+		return addr.Address
+	}
+	return from
+}
+
+// createPECBodyText creates the human-readable body text for the PEC envelope
+func createPECBodyText(certData PECCertificationData) string {
+	// Format date and time
+	dateStr := certData.Date.Format("02/01/2006")
+	timeStr := certData.Date.Format("15:04:05")
+
+	// Build recipients list, marking the recipients in copy
+	recipients := append([]string{}, certData.Recipients...)
+	for _, cc := range certData.Cc {
+		recipients = append(recipients, cc+" (in copia)")
+	}
+	recipientsList := strings.Join(recipients, "\n")
+
+	bodyText := fmt.Sprintf(`Messaggio di posta certificata
+
+Il giorno %s alle ore %s (%s) il messaggio
+"%s" è stato inviato da "%s"
+indirizzato a:
+%s
+
+Il messaggio originale è incluso in allegato.
+Identificativo messaggio: %s`,
+		dateStr,
+		timeStr,
+		certData.Timezone,
+		certData.OriginalSubject,
+		certData.OriginalFrom,
+		recipientsList,
+		certData.MessageID,
+	)
+
+	return bodyText
+}
+
+// createPECXMLData creates the XML attachment with certification data
+func createPECXMLData(certData PECCertificationData) string {
+	xmlData := pec.NewDatiCert(pec.TipoPostaCertificata, pec.ErroreNessuno, ProviderName(certData.ProviderDomain), certData.Date)
+	xmlData.Intestazione.Mittente = certData.OriginalFrom
+	// Recipients in copy are certified like the primary ones: the daticert
+	// has no distinct tipo for them
+	xmlData.AddDestinatari("certificato", certData.Recipients...)
+	xmlData.AddDestinatari("certificato", certData.Cc...)
+	xmlData.Intestazione.Risposte = certData.OriginalFrom
+	xmlData.Intestazione.Oggetto = certData.OriginalSubject
+	xmlData.Dati.Identificativo = certData.MessageID
+	xmlData.Dati.MsgID = certData.MessageID
+
+	// a DatiCert always marshals, its fields are plain strings
+	xmlBytes, _ := xmlData.Marshal()
+	return string(xmlBytes)
+}
+
+// FormatPECEnvelopeAsRFC2822 formats the PEC envelope as RFC 2822 compliant message
+func FormatPECEnvelopeAsRFC2822(envelope *PECTransportEnvelope, originalMessageRaw []byte) []byte {
+	var message strings.Builder
+
+	// Write headers in canonical order
+	var headers strings.Builder
+	for _, header := range envelope.orderedHeaderNames() {
+		headers.WriteString(fmt.Sprintf("%s: %s\r\n", header, envelope.Headers[header]))
+	}
+	message.WriteString(headers.String())
+
+	// Add MIME headers for multipart message
+	boundary := generateBoundary(headers.String(), envelope.Body, envelope.XMLData, string(originalMessageRaw))
+	message.WriteString(fmt.Sprintf("Content-Type: multipart/mixed; boundary=\"%s\"\r\n", boundary))
+	message.WriteString("MIME-Version: 1.0\r\n")
+	message.WriteString("\r\n")
+
+	// Body text part
+	message.WriteString(fmt.Sprintf("--%s\r\n", boundary))
+	message.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	message.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	message.WriteString("\r\n")
+	// The generated parts go on the wire: their lines end in CRLF
+	message.Write(toCRLF([]byte(envelope.Body)))
+	message.WriteString("\r\n\r\n")
+
+	// Certification data attachment, ahead of the original message as the
+	// PEC rules require
+	message.WriteString(fmt.Sprintf("--%s\r\n", boundary))
+	message.WriteString("Content-Type: application/xml\r\n")
+	message.WriteString("Content-Disposition: attachment; filename=\"daticert.xml\"\r\n")
+	message.WriteString("\r\n")
+	message.Write(toCRLF([]byte(envelope.XMLData)))
+	message.WriteString("\r\n\r\n")
+
+	// Original message attachment
+	message.WriteString(fmt.Sprintf("--%s\r\n", boundary))
+	message.WriteString("Content-Type: message/rfc822\r\n")
+	message.WriteString("Content-Disposition: attachment; filename=\"postacert.eml\"\r\n")
+	message.WriteString("\r\n")
+	message.Write(originalMessageRaw)
+	message.WriteString("\r\n\r\n")
+
+	// End boundary
+	message.WriteString(fmt.Sprintf("--%s--\r\n", boundary))
+
+	return []byte(message.String())
+}
+
+// generateBoundary derives a MIME boundary string from the message parts, so
+// that the same envelope is always formatted to the same bytes
+func generateBoundary(parts ...string) string {
+	hash := sha256.New()
+	for _, part := range parts {
+		hash.Write([]byte(part))
+		hash.Write([]byte{0})
+	}
+	return fmt.Sprintf("----=_NextPart_%x", hash.Sum(nil)[:12])
+}
+
+// SignPECEnvelope formats the envelope and signs it with the provider's
+// S/MIME certificate, producing the busta di trasporto. The envelope headers
+// are repeated on the signed outer message so that it can be routed.
+func SignPECEnvelope(signer *Signer, envelope *PECTransportEnvelope, originalMessageRaw []byte) (*message.Entity, error) {
+	if signer == nil {
+		return nil, fmt.Errorf("no signer available")
+	}
+
+	formatted := FormatPECEnvelopeAsRFC2822(envelope, originalMessageRaw)
+	signedEnvelope, err := signer.CreateSignedMimeMessageEntity(formatted)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign transport envelope: %v", err)
+	}
+
+	for _, header := range envelope.orderedHeaderNames() {
+		signedEnvelope.Header.Set(header, envelope.Headers[header])
+	}
+	signedEnvelope.Header.Set("X-Trasporto", "posta-certificata")
+
+	return signedEnvelope, nil
+}
+
+// BuildTransportEnvelope wraps the raw original message in a busta di
+// trasporto signed by signer. The fields of certData left empty are taken
+// from the original message, the current time and the signer's domain; a
+// message without Subject or From is enveloped all the same.
+func BuildTransportEnvelope(original []byte, certData PECCertificationData, signer *Signer) ([]byte, error) {
+	if signer == nil {
+		return nil, fmt.Errorf("no signer available")
+	}
+	mailReader, err := ParseEmailMessage(original)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse original message: %w", err)
+	}
+	header := &mailReader.Header
+
+	if certData.MessageID == "" {
+		certData.MessageID = header.Get("Message-ID")
+	}
+	if certData.OriginalSubject == "" {
+		certData.OriginalSubject = DecodeHeaderText(header.Get("Subject"))
+	}
+	if certData.OriginalFrom == "" {
+		certData.OriginalFrom = header.Get("From")
+	}
+	if certData.Recipients == nil && certData.Cc == nil {
+		certData.Recipients, certData.Cc = SplitRecipients(header)
+	}
+	if certData.Date.IsZero() {
+		certData.Date = time.Now().In(DefaultLocation)
+	}
+	if certData.ProviderDomain == "" {
+		certData.ProviderDomain = signer.Domain
+	}
+
+	envelope, err := CreatePECTransportEnvelope(header, certData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create transport envelope: %w", err)
+	}
+	signedEnvelope, err := SignPECEnvelope(signer, envelope, original)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := signedEnvelope.WriteTo(&buf); err != nil {
+		return nil, fmt.Errorf("failed to write transport envelope: %w", err)
+	}
+	return buf.Bytes(), nil
+}
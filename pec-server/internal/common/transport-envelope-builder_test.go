@@ -0,0 +1,238 @@
+package common
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/xml"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/danzipie/go-pec/pec"
+)
+
+// TestFormatPECEnvelopeAsRFC2822_Deterministic tests that the same envelope is always formatted to the same bytes
+func TestFormatPECEnvelopeAsRFC2822_Deterministic(t *testing.T) {
+	original := "From: sender@testdomain.com\r\n" +
+		"To: recipient@example.com\r\n" +
+		"Cc: other@example.com\r\n" +
+		"Subject: Deterministic\r\n" +
+		"Message-ID: <deterministic@testdomain.com>\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Hello\r\n"
+
+	mailReader, err := ParseEmailMessage([]byte(original))
+	if err != nil {
+		t.Fatalf("Failed to parse message: %v", err)
+	}
+	certData := PECCertificationData{
+		MessageID:       "<deterministic@testdomain.com>",
+		OriginalSubject: "Deterministic",
+		OriginalFrom:    "sender@testdomain.com",
+		Recipients:      []string{"recipient@example.com", "other@example.com"},
+		Date:            time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC),
+		Timezone:        "CET",
+		ProviderDomain:  "testdomain.com",
+	}
+	envelope, err := CreatePECTransportEnvelope(&mailReader.Header, certData)
+	if err != nil {
+		t.Fatalf("CreatePECTransportEnvelope failed: %v", err)
+	}
+
+	first := FormatPECEnvelopeAsRFC2822(envelope, []byte(original))
+	for i := 0; i < 20; i++ {
+		if again := FormatPECEnvelopeAsRFC2822(envelope, []byte(original)); !bytes.Equal(first, again) {
+			t.Fatalf("Expected byte-identical output, run %d differs:\n%s\n---\n%s", i, first, again)
+		}
+	}
+
+	// Headers are written in canonical order
+	headerBlock := string(first[:bytes.Index(first, []byte("\r\n\r\n"))])
+	expected := []string{"From:", "Reply-To:", "To:", "Cc:", "Subject:", "Date:", "Message-ID:", "X-Riferimento-Message-ID:", "X-Trasporto:", "Content-Type:"}
+	last := -1
+	for _, name := range expected {
+		idx := strings.Index(headerBlock, "\r\n"+name)
+		if strings.HasPrefix(headerBlock, name) {
+			idx = 0
+		}
+		if idx < 0 {
+			t.Fatalf("Expected header %s in envelope:\n%s", name, headerBlock)
+		}
+		if idx < last {
+			t.Errorf("Expected header %s to follow the previous canonical header", name)
+		}
+		last = idx
+	}
+}
+
+// TestCreatePECTransportEnvelope_Cc tests that the recipients in copy are
+// listed apart from the primary recipients
+func TestCreatePECTransportEnvelope_Cc(t *testing.T) {
+	original := "From: sender@testdomain.com\r\n" +
+		"To: Primo <primo@example.com>\r\n" +
+		"Cc: Copia <copia@example.com>\r\n" +
+		"Subject: Copia\r\n" +
+		"\r\n" +
+		"Hello\r\n"
+	mailReader, err := ParseEmailMessage([]byte(original))
+	if err != nil {
+		t.Fatalf("Failed to parse message: %v", err)
+	}
+	to, cc := SplitRecipients(&mailReader.Header)
+	if len(to) != 1 || to[0] != "primo@example.com" || len(cc) != 1 || cc[0] != "copia@example.com" {
+		t.Fatalf("Expected primo@example.com in To and copia@example.com in Cc, got %v and %v", to, cc)
+	}
+
+	envelope, err := CreatePECTransportEnvelope(&mailReader.Header, PECCertificationData{
+		OriginalSubject: "Copia",
+		OriginalFrom:    "sender@testdomain.com",
+		Recipients:      to,
+		Cc:              cc,
+		Date:            time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC),
+		Timezone:        "CET",
+		ProviderDomain:  "testdomain.com",
+	})
+	if err != nil {
+		t.Fatalf("CreatePECTransportEnvelope failed: %v", err)
+	}
+	if !strings.Contains(envelope.Body, "primo@example.com\ncopia@example.com (in copia)") {
+		t.Errorf("Expected the recipient in copy to be marked in the body, got %q", envelope.Body)
+	}
+
+	var datiCert pec.DatiCert
+	if err := xml.Unmarshal([]byte(envelope.XMLData), &datiCert); err != nil {
+		t.Fatalf("Failed to parse daticert.xml: %v", err)
+	}
+	want := []pec.Destinatario{{Tipo: "certificato", Val: "primo@example.com"}, {Tipo: "certificato", Val: "copia@example.com"}}
+	if len(datiCert.Intestazione.Destinatari) != len(want) {
+		t.Fatalf("Expected destinatari %+v, got %+v", want, datiCert.Intestazione.Destinatari)
+	}
+	for i, rcpt := range want {
+		if got := datiCert.Intestazione.Destinatari[i]; got != rcpt {
+			t.Errorf("Expected destinatario %+v, got %+v", rcpt, got)
+		}
+	}
+}
+
+// testTrust trusts the provider certificate cert
+func testTrust(cert *x509.Certificate) *ProviderTrust {
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	return &ProviderTrust{
+		CertificateHashes: map[string]struct{}{CertificateHash(cert): {}},
+		Roots:             roots,
+	}
+}
+
+func TestBuildTransportEnvelope(t *testing.T) {
+	cert, key := createTestCertAndKey(t)
+	signer := &Signer{Cert: cert, Key: key, Domain: "testdomain.com"}
+
+	original := "From: Mario Rossi <sender@testdomain.com>\r\n" +
+		"To: recipient@example.com\r\n" +
+		"Subject: Offline\r\n" +
+		"Message-ID: <offline@testdomain.com>\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Hello\r\n"
+	date := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	data, err := BuildTransportEnvelope([]byte(original), PECCertificationData{Date: date}, signer)
+	if err != nil {
+		t.Fatalf("BuildTransportEnvelope failed: %v", err)
+	}
+	if err := VerifyTransportEnvelope(data, testTrust(cert)); err != nil {
+		t.Fatalf("Expected a valid transport envelope, got %v", err)
+	}
+	if err := pec.ValidateEnvelopeStructure(data); err != nil {
+		t.Errorf("Expected the MIME structure of a transport envelope, got %v", err)
+	}
+
+	envelope, err := ParseEmailMessage(data)
+	if err != nil {
+		t.Fatalf("Failed to parse envelope: %v", err)
+	}
+	for field, want := range map[string]string{
+		"From":                     "\"Per conto di: sender@testdomain.com\" <posta-certificata@testdomain.com>",
+		"Subject":                  "POSTA CERTIFICATA: Offline",
+		"X-Riferimento-Message-ID": "<offline@testdomain.com>",
+		"Date":                     date.Format(time.RFC1123Z),
+	} {
+		if got := envelope.Header.Get(field); got != want {
+			t.Errorf("Expected %s %q, got %q", field, want, got)
+		}
+	}
+	if !bytes.Contains(data, []byte("alle ore 10:00:00 (UTC)")) {
+		t.Errorf("Expected the envelope text to show the time zone of the date")
+	}
+
+}
+
+func TestBuildTransportEnvelope_ProviderFrom(t *testing.T) {
+	cert, key := createTestCertAndKey(t)
+	signer := &Signer{Cert: cert, Key: key, Domain: "testdomain.com"}
+
+	original := "From: Mario Rossi <sender@testdomain.com>\r\n" +
+		"To: recipient@example.com\r\n" +
+		"Subject: Branded\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Hello\r\n"
+	certData := PECCertificationData{From: ProviderFrom{OnBehalfName: "Posta Certificata {domain} per {sender}"}}
+	data, err := BuildTransportEnvelope([]byte(original), certData, signer)
+	if err != nil {
+		t.Fatalf("BuildTransportEnvelope failed: %v", err)
+	}
+	envelope, err := ParseEmailMessage(data)
+	if err != nil {
+		t.Fatalf("Failed to parse envelope: %v", err)
+	}
+	want := "\"Posta Certificata testdomain.com per sender@testdomain.com\" <posta-certificata@testdomain.com>"
+	if got := envelope.Header.Get("From"); got != want {
+		t.Errorf("Expected From %q, got %q", want, got)
+	}
+}
+
+func TestBuildTransportEnvelope_MissingFields(t *testing.T) {
+	cert, key := createTestCertAndKey(t)
+	signer := &Signer{Cert: cert, Key: key, Domain: "testdomain.com"}
+
+	original := "To: recipient@example.com\r\n" +
+		"Message-ID: <bare@testdomain.com>\r\n" +
+		"\r\n" +
+		"Hello\r\n"
+	data, err := BuildTransportEnvelope([]byte(original), PECCertificationData{}, signer)
+	if err != nil {
+		t.Fatalf("BuildTransportEnvelope failed: %v", err)
+	}
+	if err := VerifyTransportEnvelope(data, testTrust(cert)); err != nil {
+		t.Fatalf("Expected a valid transport envelope, got %v", err)
+	}
+	envelope, err := ParseEmailMessage(data)
+	if err != nil {
+		t.Fatalf("Failed to parse envelope: %v", err)
+	}
+	if got := envelope.Header.Get("From"); got != "posta-certificata@testdomain.com" {
+		t.Errorf("Expected the provider address as From, got %q", got)
+	}
+	if got := envelope.Header.Get("Reply-To"); got != "" {
+		t.Errorf("Expected no Reply-To, got %q", got)
+	}
+	if got := envelope.Header.Get("Subject"); got != "POSTA CERTIFICATA: "+NoSubject {
+		t.Errorf("Expected the placeholder subject, got %q", got)
+	}
+	if !bytes.Contains(data, []byte("<oggetto>"+NoSubject+"</oggetto>")) {
+		t.Errorf("Expected the placeholder subject in the daticert")
+	}
+}
+
+func TestBuildTransportEnvelope_Errors(t *testing.T) {
+	cert, key := createTestCertAndKey(t)
+	if _, err := BuildTransportEnvelope([]byte("To: a@example.com\r\n\r\nHello\r\n"), PECCertificationData{}, nil); err == nil {
+		t.Errorf("Expected an error without a signer")
+	}
+	if _, err := BuildTransportEnvelope([]byte("not a message"), PECCertificationData{}, &Signer{Cert: cert, Key: key}); err == nil {
+		t.Errorf("Expected an error for a malformed message")
+	}
+}
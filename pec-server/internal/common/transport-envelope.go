@@ -0,0 +1,315 @@
+package common
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	pec_storage "github.com/danzipie/go-pec/pec-server/internal/storage"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+	"go.mozilla.org/pkcs7"
+)
+
+// ProviderTrust identifies the signing certificates of certified providers
+type ProviderTrust struct {
+	// Upper-case hex SHA-1 hashes of the provider certificates, trusted in
+	// addition to the ones listed by Authorities
+	CertificateHashes map[string]struct{}
+	// Authorities is the provider index resolving the certificate hashes;
+	// only CertificateHashes are trusted when nil
+	Authorities pec_storage.AuthorityRegistryStore
+	Roots       *x509.CertPool
+	// Revocation checks that the provider certificates were not revoked;
+	// not checked when nil
+	Revocation *RevocationChecker
+}
+
+// CheckRevocation checks that no certificate of the chain of cert was
+// revoked. The chain is built to the trusted roots, with the certificates
+// embedded in the signature as intermediates; failing that, from the
+// embedded certificates alone. When no issuer of cert is found its status
+// is unknown, which is an error under a fail-closed policy.
+func (t *ProviderTrust) CheckRevocation(cert *x509.Certificate, embedded []*x509.Certificate) error {
+	if t == nil || t.Revocation == nil {
+		return nil
+	}
+	opts := t.verifyOptions()
+	opts.Intermediates = x509.NewCertPool()
+	for _, c := range embedded {
+		opts.Intermediates.AddCert(c)
+	}
+	if chains, err := cert.Verify(opts); err == nil {
+		return t.Revocation.CheckChain(chains[0])
+	}
+
+	chain := embeddedChain(cert, embedded)
+	if len(chain) == 1 && !isSelfSigned(cert) {
+		return t.Revocation.unknownStatus(cert, errors.New("no issuer found for the certificate"))
+	}
+	return t.Revocation.CheckChain(chain)
+}
+
+// embeddedChain returns the chain from cert through the certificates of
+// embedded that signed it, up to a self-signed one or a missing issuer
+func embeddedChain(cert *x509.Certificate, embedded []*x509.Certificate) []*x509.Certificate {
+	chain := []*x509.Certificate{cert}
+	for current := cert; !isSelfSigned(current) && len(chain) <= len(embedded); {
+		var issuer *x509.Certificate
+		for _, c := range embedded {
+			if bytes.Equal(c.RawSubject, current.RawIssuer) && current.CheckSignatureFrom(c) == nil {
+				issuer = c
+				break
+			}
+		}
+		if issuer == nil {
+			break
+		}
+		chain = append(chain, issuer)
+		current = issuer
+	}
+	return chain
+}
+
+// isSelfSigned reports whether cert is signed by its own key
+func isSelfSigned(cert *x509.Certificate) bool {
+	return bytes.Equal(cert.RawSubject, cert.RawIssuer) &&
+		cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature) == nil
+}
+
+// checkProvider checks that cert is the certificate of a certified provider
+func (t *ProviderTrust) checkProvider(cert *x509.Certificate) error {
+	hash := CertificateHash(cert)
+	if _, ok := t.CertificateHashes[hash]; ok {
+		return nil
+	}
+	if t.Authorities == nil {
+		return ErrUntrustedSigner
+	}
+	_, err := t.Authorities.GetByCertHash(hash)
+	if errors.Is(err, pec_storage.ErrAuthorityNotFound) {
+		return ErrUntrustedSigner
+	}
+	if err != nil {
+		return fmt.Errorf("%w: failed to lookup certificate %s: %v", ErrUntrustedSigner, hash, err)
+	}
+	return nil
+}
+
+// verifyOptions returns the options verifying a provider certificate
+func (t *ProviderTrust) verifyOptions() x509.VerifyOptions {
+	return x509.VerifyOptions{
+		Roots:     t.Roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+}
+
+// LoadProviderRoots reads the CAs the provider certificates must chain to.
+// The system roots are used when no file is configured.
+func LoadProviderRoots(cfg *Config) (*x509.CertPool, error) {
+	if cfg.ProviderRootsFile == "" {
+		return nil, nil
+	}
+	rootsPEM, err := os.ReadFile(cfg.ProviderRootsFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read provider roots file: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(rootsPEM) {
+		return nil, fmt.Errorf("no certificates found in provider roots file %s", cfg.ProviderRootsFile)
+	}
+	return pool, nil
+}
+
+// CertificateHash returns the upper-case hex SHA-1 hash used to identify a provider certificate
+func CertificateHash(cert *x509.Certificate) string {
+	sum := sha1.Sum(cert.Raw)
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// VerifyTransportEnvelope checks that data is a busta di trasporto signed by
+// a certified provider: S/MIME signature, trusted certificate and formally
+// correct headers.
+func VerifyTransportEnvelope(data []byte, trust *ProviderTrust) error {
+	signerCert, err := VerifySignedMessage(data)
+	if err != nil {
+		return err
+	}
+
+	entity, err := message.Read(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to parse envelope: %v", err)
+	}
+	return CheckTransportEnvelope(&mail.Header{Header: entity.Header}, signerCert, trust)
+}
+
+// ErrUntrustedSigner is returned when a transport envelope is not signed with
+// the certificate of a certified provider
+var ErrUntrustedSigner = errors.New("signing certificate is not from a certified provider")
+
+// CheckTransportEnvelope checks the headers and the signing certificate of a
+// busta di trasporto whose signature was already verified
+func CheckTransportEnvelope(header *mail.Header, signerCert *x509.Certificate, trust *ProviderTrust) error {
+	if trust == nil {
+		return fmt.Errorf("%w: no trusted providers configured", ErrUntrustedSigner)
+	}
+	if err := trust.checkProvider(signerCert); err != nil {
+		return err
+	}
+	chains, err := signerCert.Verify(trust.verifyOptions())
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUntrustedSigner, err)
+	}
+	if trust.Revocation != nil {
+		if err := trust.Revocation.CheckChain(chains[0]); err != nil {
+			return fmt.Errorf("%w: %w", ErrUntrustedSigner, err)
+		}
+	}
+
+	if !strings.EqualFold(header.Get("X-Trasporto"), "posta-certificata") {
+		return errors.New("missing X-Trasporto header")
+	}
+	if _, err := header.AddressList("From"); err != nil {
+		return fmt.Errorf("invalid From header: %v", err)
+	}
+	if _, err := header.AddressList("To"); err != nil {
+		return fmt.Errorf("invalid To header: %v", err)
+	}
+	if _, err := header.Date(); err != nil {
+		return fmt.Errorf("invalid Date header: %v", err)
+	}
+	return nil
+}
+
+// VerifySignedMessage verifies the S/MIME signature of a raw message, either
+// multipart/signed or application/pkcs7-mime, and returns the signer certificate.
+func VerifySignedMessage(data []byte) (*x509.Certificate, error) {
+	signerCert, _, err := VerifySignedMessageChain(data)
+	return signerCert, err
+}
+
+// VerifySignedMessageChain is VerifySignedMessage, also returning the other
+// certificates embedded in the signature, which the signer usually includes
+// to let its chain be built
+func VerifySignedMessageChain(data []byte) (*x509.Certificate, []*x509.Certificate, error) {
+	headerEnd := bytes.Index(data, []byte("\r\n\r\n"))
+	if headerEnd < 0 {
+		return nil, nil, errors.New("message has no body")
+	}
+	body := data[headerEnd+4:]
+
+	entity, err := message.Read(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse message: %v", err)
+	}
+	mediaType, params, err := entity.Header.ContentType()
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid Content-Type: %v", err)
+	}
+
+	if mediaType != "multipart/signed" {
+		body, err = io.ReadAll(entity.Body)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read PKCS7 body: %v", err)
+		}
+	}
+	p7, signerCert, err := verifySignedBody(mediaType, params, body)
+	if err != nil {
+		return nil, nil, err
+	}
+	var certificates []*x509.Certificate
+	for _, cert := range p7.Certificates {
+		if !cert.Equal(signerCert) {
+			certificates = append(certificates, cert)
+		}
+	}
+	return signerCert, certificates, nil
+}
+
+// verifySignedBody verifies the signature of an S/MIME body and returns the
+// parsed signature, holding the signed content, and the signer certificate.
+// A multipart/signed body is passed raw, an application/pkcs7-mime one decoded.
+func verifySignedBody(mediaType string, params map[string]string, body []byte) (*pkcs7.PKCS7, *x509.Certificate, error) {
+	var p7 *pkcs7.PKCS7
+	switch mediaType {
+	case "multipart/signed":
+		content, signature, err := splitMultipartSigned(body, params["boundary"])
+		if err != nil {
+			return nil, nil, err
+		}
+		p7, err = pkcs7.Parse(signature)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid PKCS7 signature: %v", err)
+		}
+		p7.Content = content
+
+	case "application/pkcs7-mime", "application/x-pkcs7-mime":
+		var err error
+		p7, err = pkcs7.Parse(body)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid PKCS7 structure: %v", err)
+		}
+
+	default:
+		return nil, nil, fmt.Errorf("message is not S/MIME signed: %s", mediaType)
+	}
+
+	signerCert := p7.GetOnlySigner()
+	if signerCert == nil {
+		return nil, nil, errors.New("no signing certificate found")
+	}
+	if err := p7.Verify(); err != nil {
+		return nil, nil, fmt.Errorf("signature not valid: %v", err)
+	}
+	return p7, signerCert, nil
+}
+
+// splitMultipartSigned returns the raw signed content and the decoded
+// signature of a multipart/signed body. The content must be kept byte for
+// byte, so the parts are located directly rather than through a MIME reader.
+func splitMultipartSigned(body []byte, boundary string) ([]byte, []byte, error) {
+	if boundary == "" {
+		return nil, nil, errors.New("multipart/signed without boundary")
+	}
+	delimiter := []byte("--" + boundary + "\r\n")
+	separator := []byte("\r\n--" + boundary)
+
+	start := bytes.Index(body, delimiter)
+	if start < 0 {
+		return nil, nil, errors.New("signed content not found")
+	}
+	rest := body[start+len(delimiter):]
+	end := bytes.Index(rest, separator)
+	if end < 0 {
+		return nil, nil, errors.New("signature part not found")
+	}
+	content := rest[:end]
+
+	rest = rest[end+len(separator):]
+	if !bytes.HasPrefix(rest, []byte("\r\n")) {
+		return nil, nil, errors.New("signature part not found")
+	}
+	rest = rest[2:]
+	if end := bytes.Index(rest, separator); end >= 0 {
+		rest = rest[:end]
+	}
+
+	part, err := message.Read(bytes.NewReader(rest))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse signature part: %v", err)
+	}
+	if mediaType, _, _ := part.Header.ContentType(); !strings.Contains(mediaType, "pkcs7-signature") {
+		return nil, nil, fmt.Errorf("unexpected signature type: %s", mediaType)
+	}
+	signature, err := io.ReadAll(part.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read signature: %v", err)
+	}
+	return content, signature, nil
+}
@@ -0,0 +1,169 @@
+package common
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	pec_storage "github.com/danzipie/go-pec/pec-server/internal/storage"
+	"github.com/danzipie/go-pec/pec-server/logger"
+)
+
+const (
+	defaultWebhookMaxAttempts = 5
+	defaultWebhookBackoff     = time.Second
+)
+
+// WebhookSignatureHeader carries the HMAC-SHA256 of the payload of a webhook
+// notification, keyed with the configured secret, as "sha256=" and its hex
+// encoding
+const WebhookSignatureHeader = "X-PEC-Signature"
+
+// WebhookEvent is the JSON payload of a webhook notification
+type WebhookEvent struct {
+	Event     pec_storage.JournalEvent `json:"event"`
+	MessageID string                   `json:"message_id"`
+	From      string                   `json:"from,omitempty"`
+	To        []string                 `json:"to,omitempty"`
+	Timestamp time.Time                `json:"timestamp"`
+	Outcome   string                   `json:"outcome"`
+	Detail    string                   `json:"detail,omitempty"`
+}
+
+// Webhook notifies an external URL of the events of the lifecycle of the
+// messages, the ones recorded in the journal. The notifications are posted
+// in the background and retried with an exponential backoff, so that a slow
+// or unavailable endpoint does not hold up the messages.
+type Webhook struct {
+	url    string
+	secret []byte
+	events map[pec_storage.JournalEvent]bool // all the events when empty
+	client *http.Client
+
+	// MaxAttempts is the number of times a notification is posted before
+	// it is given up
+	MaxAttempts int
+	// Backoff is the delay before the first retry, doubled at each one
+	Backoff time.Duration
+
+	wg sync.WaitGroup
+}
+
+// NewWebhook returns the webhook configured in cfg, or nil when no URL is
+// configured
+func NewWebhook(cfg *Config) *Webhook {
+	if cfg.WebhookURL == "" {
+		return nil
+	}
+	w := &Webhook{
+		url:         cfg.WebhookURL,
+		secret:      []byte(cfg.WebhookSecret),
+		events:      make(map[pec_storage.JournalEvent]bool),
+		client:      &http.Client{Timeout: 10 * time.Second},
+		MaxAttempts: defaultWebhookMaxAttempts,
+		Backoff:     defaultWebhookBackoff,
+	}
+	for _, event := range cfg.WebhookEvents {
+		w.events[pec_storage.JournalEvent(event)] = true
+	}
+	return w
+}
+
+// Notify posts the event in the background, if it is one of the events
+// notified. A nil webhook notifies nothing.
+func (w *Webhook) Notify(event WebhookEvent) {
+	if w == nil || (len(w.events) > 0 && !w.events[event.Event]) {
+		return
+	}
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now()
+	}
+	if event.Outcome == "" {
+		event.Outcome = pec_storage.OutcomeSuccess
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		logger.LogError("Failed to encode webhook event", err, map[string]string{"message_id": event.MessageID})
+		return
+	}
+
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		w.deliver(event, payload)
+	}()
+}
+
+// NotifyEntry posts the event of a journal entry about a message from from
+// to the recipients to
+func (w *Webhook) NotifyEntry(entry pec_storage.JournalEntry, from string, to []string) {
+	w.Notify(WebhookEvent{
+		Event:     entry.Event,
+		MessageID: entry.MessageID,
+		From:      from,
+		To:        to,
+		Timestamp: entry.Timestamp,
+		Outcome:   entry.Outcome,
+		Detail:    entry.Detail,
+	})
+}
+
+// Close waits for the notifications being posted
+func (w *Webhook) Close() {
+	if w == nil {
+		return
+	}
+	w.wg.Wait()
+}
+
+// deliver posts payload until it is accepted or MaxAttempts is reached
+func (w *Webhook) deliver(event WebhookEvent, payload []byte) {
+	backoff := w.Backoff
+	var err error
+	for attempt := 1; attempt <= w.MaxAttempts; attempt++ {
+		if err = w.post(payload); err == nil {
+			return
+		}
+		if attempt < w.MaxAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	logger.LogError("Giving up webhook notification", err, map[string]string{
+		"event":      string(event.Event),
+		"message_id": event.MessageID,
+	})
+}
+
+// post makes one attempt at posting payload
+func (w *Webhook) post(payload []byte) error {
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("failed to create webhook request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookSignatureHeader, SignWebhookPayload(w.secret, payload))
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to post webhook: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// SignWebhookPayload returns the value of the WebhookSignatureHeader of
+// payload, for the receivers to check it
+func SignWebhookPayload(secret, payload []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,84 @@
+package common
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	pec_storage "github.com/danzipie/go-pec/pec-server/internal/storage"
+)
+
+// webhookReceiver collects the notifications posted to it, answering the
+// first failures attempts with 503
+type webhookReceiver struct {
+	mu       sync.Mutex
+	failures int
+	attempts int
+	events   []WebhookEvent
+}
+
+func (r *webhookReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.attempts++
+	if r.attempts <= r.failures {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	var event WebhookEvent
+	body, _ := io.ReadAll(req.Body)
+	json.Unmarshal(body, &event)
+	r.events = append(r.events, event)
+}
+
+func TestWebhook_Retry(t *testing.T) {
+	receiver := &webhookReceiver{failures: 2}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	webhook := NewWebhook(&Config{WebhookURL: server.URL})
+	webhook.Backoff = time.Millisecond
+	webhook.NotifyEntry(pec_storage.JournalEntry{Event: pec_storage.EventDelivered, MessageID: "<retry@example.com>"}, "sender@example.com", []string{"recipient@example.com"})
+	webhook.Close()
+
+	if receiver.attempts != 3 || len(receiver.events) != 1 {
+		t.Fatalf("Expected the notification to be delivered at the third attempt, got %d attempts and %d events", receiver.attempts, len(receiver.events))
+	}
+	if event := receiver.events[0]; event.Event != pec_storage.EventDelivered || event.Outcome != pec_storage.OutcomeSuccess || event.Timestamp.IsZero() {
+		t.Errorf("Unexpected event %+v", event)
+	}
+
+	// A notification failing every attempt is given up
+	receiver.failures = 100
+	webhook.MaxAttempts = 2
+	webhook.Notify(WebhookEvent{Event: pec_storage.EventDelivered})
+	webhook.Close()
+	if receiver.attempts != 5 {
+		t.Errorf("Expected 2 more attempts, got %d", receiver.attempts-3)
+	}
+}
+
+func TestWebhook_Events(t *testing.T) {
+	receiver := &webhookReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	webhook := NewWebhook(&Config{WebhookURL: server.URL, WebhookEvents: []string{"accepted"}})
+	webhook.Notify(WebhookEvent{Event: pec_storage.EventReceived})
+	webhook.Notify(WebhookEvent{Event: pec_storage.EventAccepted})
+	webhook.Close()
+	if len(receiver.events) != 1 || receiver.events[0].Event != pec_storage.EventAccepted {
+		t.Errorf("Expected only the accepted event, got %+v", receiver.events)
+	}
+
+	if NewWebhook(&Config{}) != nil {
+		t.Error("Expected no webhook without a URL")
+	}
+	var disabled *Webhook
+	disabled.Notify(WebhookEvent{Event: pec_storage.EventAccepted})
+	disabled.Close()
+}
@@ -0,0 +1,163 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/danzipie/go-pec/pec-server/logger"
+	"github.com/emersion/go-message"
+)
+
+// WriteAheadEntry is an accepted message waiting to be processed
+type WriteAheadEntry struct {
+	ID         string    `json:"id"`
+	MessageID  string    `json:"message_id,omitempty"`
+	From       string    `json:"from"`
+	To         []string  `json:"to"`
+	RemoteIP   string    `json:"remote_ip,omitempty"`
+	Helo       string    `json:"helo,omitempty"`
+	Data       []byte    `json:"data"`
+	ReceivedAt time.Time `json:"received_at"`
+}
+
+// WriteAheadLog persists the messages accepted by an SMTP server before they
+// are processed, so that a message whose processing was interrupted by a
+// crash is processed again at the next start. Each accepted message is
+// stored as a JSON file of its own until it is acknowledged, even when
+// another one has the same Message-ID. Entries that cannot be processed are
+// moved to the quarantine subdirectory, for an operator to inspect.
+type WriteAheadLog struct {
+	dir string
+}
+
+// NewWriteAheadLog opens (or creates) a write-ahead log stored in dir
+func NewWriteAheadLog(dir string) (*WriteAheadLog, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create write-ahead directory: %w", err)
+	}
+	return &WriteAheadLog{dir: dir}, nil
+}
+
+// writeAheadQuarantineDir is the subdirectory of the entries that cannot be
+// processed
+const writeAheadQuarantineDir = "quarantine"
+
+// Write durably stores entry under a new identifier, which it returns
+func (w *WriteAheadLog) Write(entry WriteAheadEntry) (string, error) {
+	if entry.MessageID == "" {
+		entry.MessageID = headerMessageID(entry.Data)
+	}
+	if entry.ID == "" {
+		entry.ID = newQueueItemID()
+	}
+	if entry.ReceivedAt.IsZero() {
+		entry.ReceivedAt = time.Now()
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode write-ahead entry: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(w.dir, ".tmp-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create write-ahead entry: %w", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("failed to write write-ahead entry: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("failed to sync write-ahead entry: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("failed to close write-ahead entry: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), w.path(entry.ID)); err != nil {
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("failed to store write-ahead entry: %w", err)
+	}
+	return entry.ID, nil
+}
+
+// Ack removes the entry id once its message was processed
+func (w *WriteAheadLog) Ack(id string) error {
+	if err := os.Remove(w.path(id)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove write-ahead entry: %w", err)
+	}
+	return nil
+}
+
+// Quarantine moves the entry id out of the pending ones, to the quarantine
+// subdirectory
+func (w *WriteAheadLog) Quarantine(id string) error {
+	return w.quarantine(id + ".json")
+}
+
+// quarantine moves the entry file name to the quarantine subdirectory
+func (w *WriteAheadLog) quarantine(name string) error {
+	dir := filepath.Join(w.dir, writeAheadQuarantineDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create quarantine directory: %w", err)
+	}
+	if err := os.Rename(filepath.Join(w.dir, name), filepath.Join(dir, name)); err != nil {
+		return fmt.Errorf("failed to quarantine write-ahead entry: %w", err)
+	}
+	return nil
+}
+
+// Pending returns the entries not acknowledged, oldest first. Entries that
+// cannot be decoded are quarantined.
+func (w *WriteAheadLog) Pending() ([]*WriteAheadEntry, error) {
+	files, err := os.ReadDir(w.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read write-ahead directory: %w", err)
+	}
+
+	var entries []*WriteAheadEntry
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(w.dir, file.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read write-ahead entry: %w", err)
+		}
+		var entry WriteAheadEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			logger.LogError("Failed to decode write-ahead entry, quarantining it", err, map[string]string{"file": file.Name()})
+			if qErr := w.quarantine(file.Name()); qErr != nil {
+				return nil, qErr
+			}
+			continue
+		}
+		entries = append(entries, &entry)
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].ReceivedAt.Before(entries[j].ReceivedAt)
+	})
+	return entries, nil
+}
+
+func (w *WriteAheadLog) path(id string) string {
+	return filepath.Join(w.dir, id+".json")
+}
+
+// headerMessageID returns the Message-ID field of a raw message, if any
+func headerMessageID(data []byte) string {
+	entity, err := message.Read(bytes.NewReader(data))
+	if err != nil && entity == nil {
+		return ""
+	}
+	return strings.TrimSpace(entity.Header.Get("Message-ID"))
+}
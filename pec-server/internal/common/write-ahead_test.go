@@ -0,0 +1,218 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+)
+
+const writeAheadTestMessage = "From: sender@example.com\r\n" +
+	"To: recipient@example.com\r\n" +
+	"Message-ID: <wal@example.com>\r\n" +
+	"Subject: Write-ahead\r\n" +
+	"\r\n" +
+	"Hello\r\n"
+
+func newWriteAheadLog(t *testing.T) *WriteAheadLog {
+	t.Helper()
+	wal, err := NewWriteAheadLog(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewWriteAheadLog failed: %v", err)
+	}
+	return wal
+}
+
+func TestWriteAheadLog(t *testing.T) {
+	wal := newWriteAheadLog(t)
+
+	id, err := wal.Write(WriteAheadEntry{From: "sender@example.com", To: []string{"recipient@example.com"}, Data: []byte(writeAheadTestMessage)})
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	// A message sent again with the same Message-ID, in another session,
+	// gets an entry of its own
+	again, err := wal.Write(WriteAheadEntry{From: "other@example.com", Data: []byte(writeAheadTestMessage)})
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if again == id {
+		t.Errorf("Expected distinct identifiers for the same Message-ID, got %s twice", id)
+	}
+	if _, err := wal.Write(WriteAheadEntry{Data: []byte("Subject: no Message-ID\r\n\r\nHello\r\n")}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	pending, err := wal.Pending()
+	if err != nil {
+		t.Fatalf("Pending failed: %v", err)
+	}
+	if len(pending) != 3 {
+		t.Fatalf("Expected 3 pending entries, got %d", len(pending))
+	}
+	if pending[0].MessageID != "<wal@example.com>" || pending[1].MessageID != "<wal@example.com>" {
+		t.Errorf("Expected the Message-ID to be recorded, got %q and %q", pending[0].MessageID, pending[1].MessageID)
+	}
+
+	if err := wal.Ack(id); err != nil {
+		t.Fatalf("Ack failed: %v", err)
+	}
+	if err := wal.Ack(id); err != nil {
+		t.Errorf("Expected a repeated Ack to succeed, got %v", err)
+	}
+	pending, _ = wal.Pending()
+	if len(pending) != 2 {
+		t.Fatalf("Expected 2 pending entries after Ack, got %d", len(pending))
+	}
+	if pending[0].ID != again || pending[0].From != "other@example.com" {
+		t.Errorf("Expected the other entry with the same Message-ID to be kept, got %+v", pending[0])
+	}
+}
+
+// TestSession_DataWriteAheadCrash tests that a message whose processing
+// crashed is kept and processed again on recovery
+func TestSession_DataWriteAheadCrash(t *testing.T) {
+	wal := newWriteAheadLog(t)
+	crash := func(*Session) error { panic("crash while processing") }
+	backend := NewBackend(nil, nil, nil, crash, "example.com")
+	backend.WriteAhead = wal
+
+	session, _ := backend.NewSession(nil)
+	s := session.(*Session)
+	s.auth = true
+	s.From = "sender@example.com"
+	s.To = []string{"recipient@example.com"}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("Expected the handler to panic")
+			}
+		}()
+		s.Data(strings.NewReader(writeAheadTestMessage))
+	}()
+
+	pending, err := wal.Pending()
+	if err != nil || len(pending) != 1 {
+		t.Fatalf("Expected the crashed message to be pending, got %d (%v)", len(pending), err)
+	}
+
+	// At the next start the message is processed as it was received
+	var recovered *Session
+	var data []byte
+	backend.handler = func(s *Session) error {
+		recovered = s
+		data, _ = s.GetData()
+		return nil
+	}
+	n, err := backend.RecoverWriteAhead()
+	if err != nil || n != 1 {
+		t.Fatalf("Expected 1 recovered message, got %d (%v)", n, err)
+	}
+	if recovered.From != "sender@example.com" || len(recovered.To) != 1 || recovered.To[0] != "recipient@example.com" {
+		t.Errorf("Expected the envelope of the message, got %s %v", recovered.From, recovered.To)
+	}
+	if !bytes.Equal(data, []byte(writeAheadTestMessage)) {
+		t.Errorf("Expected the message data to be recovered, got %q", data)
+	}
+	if pending, _ := wal.Pending(); len(pending) != 0 {
+		t.Errorf("Expected no pending message after recovery, got %d", len(pending))
+	}
+}
+
+// TestSession_DataWriteAheadAck tests that a processed message is not kept,
+// whether it was accepted or refused
+func TestSession_DataWriteAheadAck(t *testing.T) {
+	for _, handlerErr := range []error{nil, errors.New("refused")} {
+		wal := newWriteAheadLog(t)
+		backend := NewBackend(nil, nil, nil, func(*Session) error { return handlerErr }, "example.com")
+		backend.WriteAhead = wal
+		session, _ := backend.NewSession(nil)
+		session.(*Session).auth = true
+
+		if err := session.Data(strings.NewReader(writeAheadTestMessage)); (err != nil) != (handlerErr != nil) {
+			t.Errorf("Expected error %v, got %v", handlerErr, err)
+		}
+		if pending, _ := wal.Pending(); len(pending) != 0 {
+			t.Errorf("Expected no pending message after processing, got %d", len(pending))
+		}
+	}
+}
+
+// TestRecoverWriteAhead_TemporaryFailure tests that a message failing
+// temporarily on recovery is kept, and one failing permanently dropped
+func TestRecoverWriteAhead_TemporaryFailure(t *testing.T) {
+	wal := newWriteAheadLog(t)
+	if _, err := wal.Write(WriteAheadEntry{Data: []byte(writeAheadTestMessage)}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	backend := NewBackend(nil, nil, nil, func(*Session) error { return ErrTimeout }, "example.com")
+	backend.WriteAhead = wal
+
+	if n, err := backend.RecoverWriteAhead(); err != nil || n != 0 {
+		t.Errorf("Expected no recovered message, got %d (%v)", n, err)
+	}
+	if pending, _ := wal.Pending(); len(pending) != 1 {
+		t.Fatalf("Expected the message to be kept, got %d", len(pending))
+	}
+
+	backend.handler = func(*Session) error {
+		return &smtp.SMTPError{Code: 554, EnhancedCode: smtp.EnhancedCode{5, 6, 0}, Message: "refused"}
+	}
+	if n, err := backend.RecoverWriteAhead(); err != nil || n != 1 {
+		t.Errorf("Expected 1 recovered message, got %d (%v)", n, err)
+	}
+	if pending, _ := wal.Pending(); len(pending) != 0 {
+		t.Errorf("Expected the refused message to be dropped, got %d", len(pending))
+	}
+}
+
+// TestRecoverWriteAhead_Quarantine tests that an entry crashing the handler
+// again, or that cannot be decoded, is quarantined without stopping the
+// recovery of the others
+func TestRecoverWriteAhead_Quarantine(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := NewWriteAheadLog(dir)
+	if err != nil {
+		t.Fatalf("NewWriteAheadLog failed: %v", err)
+	}
+	poison, err := wal.Write(WriteAheadEntry{From: "poison@example.com", Data: []byte(writeAheadTestMessage)})
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if _, err := wal.Write(WriteAheadEntry{From: "sender@example.com", Data: []byte(writeAheadTestMessage)}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "corrupt.json"), []byte("{not json"), 0600); err != nil {
+		t.Fatalf("Failed to write corrupt entry: %v", err)
+	}
+
+	var handled []string
+	backend := NewBackend(nil, nil, nil, func(s *Session) error {
+		if s.From == "poison@example.com" {
+			panic("crash while processing")
+		}
+		handled = append(handled, s.From)
+		return nil
+	}, "example.com")
+	backend.WriteAhead = wal
+
+	n, err := backend.RecoverWriteAhead()
+	if err != nil || n != 1 {
+		t.Fatalf("Expected 1 recovered message, got %d (%v)", n, err)
+	}
+	if len(handled) != 1 || handled[0] != "sender@example.com" {
+		t.Errorf("Expected the other message to be processed, got %v", handled)
+	}
+	if pending, _ := wal.Pending(); len(pending) != 0 {
+		t.Errorf("Expected no pending message after recovery, got %d", len(pending))
+	}
+	for _, name := range []string{poison + ".json", "corrupt.json"} {
+		if _, err := os.Stat(filepath.Join(dir, "quarantine", name)); err != nil {
+			t.Errorf("Expected %s to be quarantined: %v", name, err)
+		}
+	}
+}
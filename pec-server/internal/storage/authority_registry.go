@@ -1,10 +1,16 @@
 package pec_storage
 
+import "errors"
+
+// ErrAuthorityNotFound is returned when no authority matches a lookup
+var ErrAuthorityNotFound = errors.New("authority not found")
+
 type PECAuthority struct {
-	Name                      string
-	SMTPAddr                  string
-	NotificationAddress       string
-	ProviderCertificateHashes []string
+	ID                        int      `json:"-"`
+	Name                      string   `json:"name"`
+	SMTPAddr                  string   `json:"smtp_addr"`
+	NotificationAddress       string   `json:"notification_address"`
+	ProviderCertificateHashes []string `json:"cert_hashes"`
 }
 
 // AuthorityRegistryStore defines the interface for authority registry storage backends.
@@ -0,0 +1,170 @@
+package pec_storage
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultMaxNegativeEntries bounds the unknown domains and hashes cached
+const defaultMaxNegativeEntries = 10000
+
+// CachedAuthorityRegistry caches the lookups of another AuthorityRegistryStore.
+// Unknown domains and hashes are cached too, up to MaxNegativeEntries: they
+// come from inbound mail, while the known ones are bounded by the registry.
+// Expired entries keep being served while they are refreshed in the
+// background, so that lookups do not fail while the underlying store is
+// unavailable.
+type CachedAuthorityRegistry struct {
+	store AuthorityRegistryStore
+	ttl   time.Duration
+	now   func() time.Time
+
+	// MaxNegativeEntries bounds the unknown domains and hashes cached; once
+	// reached the expired ones are dropped, and new ones are not cached
+	// while none has expired. Zero means no bound.
+	MaxNegativeEntries int
+
+	mu        sync.Mutex
+	entries   map[string]*authorityCacheEntry // key: "domain:" or "hash:" and the normalized value
+	negatives int                             // entries for unknown keys
+}
+
+// authorityCacheEntry is the cached result of a lookup
+type authorityCacheEntry struct {
+	authority  *PECAuthority
+	err        error // ErrAuthorityNotFound for unknown keys
+	expires    time.Time
+	refreshing bool
+}
+
+// NewCachedAuthorityRegistry caches the lookups of store for ttl
+func NewCachedAuthorityRegistry(store AuthorityRegistryStore, ttl time.Duration) *CachedAuthorityRegistry {
+	return &CachedAuthorityRegistry{
+		store:              store,
+		ttl:                ttl,
+		now:                time.Now,
+		MaxNegativeEntries: defaultMaxNegativeEntries,
+		entries:            make(map[string]*authorityCacheEntry),
+	}
+}
+
+// GetByDomain returns the authority for a domain, from the cache when possible
+func (c *CachedAuthorityRegistry) GetByDomain(domain string) (*PECAuthority, error) {
+	return c.get("domain:"+strings.ToLower(strings.TrimSpace(domain)), func() (*PECAuthority, error) {
+		return c.store.GetByDomain(domain)
+	})
+}
+
+// GetByCertHash returns the authority for a certificate hash, from the cache
+// when possible
+func (c *CachedAuthorityRegistry) GetByCertHash(hash string) (*PECAuthority, error) {
+	return c.get("hash:"+NormalizeCertHash(hash), func() (*PECAuthority, error) {
+		return c.store.GetByCertHash(hash)
+	})
+}
+
+// ListAuthorities lists the authorities of the underlying store; it is not cached
+func (c *CachedAuthorityRegistry) ListAuthorities() ([]*PECAuthority, error) {
+	return c.store.ListAuthorities()
+}
+
+// Invalidate drops every cached lookup
+func (c *CachedAuthorityRegistry) Invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]*authorityCacheEntry)
+	c.negatives = 0
+}
+
+// get returns the cached entry for key, loading it on a miss and refreshing
+// it in the background once expired
+func (c *CachedAuthorityRegistry) get(key string, load func() (*PECAuthority, error)) (*PECAuthority, error) {
+	c.mu.Lock()
+	if entry, ok := c.entries[key]; ok {
+		if !entry.refreshing && !c.now().Before(entry.expires) {
+			entry.refreshing = true
+			go c.refresh(key, entry, load)
+		}
+		c.mu.Unlock()
+		return entry.result()
+	}
+	c.mu.Unlock()
+
+	authority, err := load()
+	if err != nil && !errors.Is(err, ErrAuthorityNotFound) {
+		return nil, err
+	}
+	entry := c.newEntry(authority, err)
+	c.mu.Lock()
+	c.put(key, entry)
+	c.mu.Unlock()
+	return entry.result()
+}
+
+// refresh reloads the expired entry of key; on failure the stale entry is
+// kept and the refresh is retried on the next lookup. The result is dropped
+// if the entry was invalidated or replaced in the meantime.
+func (c *CachedAuthorityRegistry) refresh(key string, stale *authorityCacheEntry, load func() (*PECAuthority, error)) {
+	authority, err := load()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries[key] != stale {
+		return
+	}
+	if err != nil && !errors.Is(err, ErrAuthorityNotFound) {
+		stale.refreshing = false
+		return
+	}
+	c.put(key, c.newEntry(authority, err))
+}
+
+// put caches entry under key, with c.mu held. An entry for an unknown key is
+// not cached when MaxNegativeEntries is reached and none has expired.
+func (c *CachedAuthorityRegistry) put(key string, entry *authorityCacheEntry) {
+	old, replacing := c.entries[key]
+	if entry.err != nil && (!replacing || old.err == nil) &&
+		c.MaxNegativeEntries > 0 && c.negatives >= c.MaxNegativeEntries {
+		c.sweepNegatives()
+		if c.negatives >= c.MaxNegativeEntries {
+			return
+		}
+	}
+	if replacing && old.err != nil {
+		c.negatives--
+	}
+	if entry.err != nil {
+		c.negatives++
+	}
+	c.entries[key] = entry
+}
+
+// sweepNegatives drops the expired entries of unknown keys, with c.mu held
+func (c *CachedAuthorityRegistry) sweepNegatives() {
+	now := c.now()
+	for key, entry := range c.entries {
+		if entry.err != nil && !now.Before(entry.expires) {
+			delete(c.entries, key)
+			c.negatives--
+		}
+	}
+}
+
+// newEntry returns a cache entry for the result of a lookup
+func (c *CachedAuthorityRegistry) newEntry(authority *PECAuthority, err error) *authorityCacheEntry {
+	entry := &authorityCacheEntry{err: err, expires: c.now().Add(c.ttl)}
+	if err == nil {
+		entry.authority = copyAuthority(authority)
+	}
+	return entry
+}
+
+// result returns a copy of the cached authority, or the cached error
+func (e *authorityCacheEntry) result() (*PECAuthority, error) {
+	if e.err != nil {
+		return nil, e.err
+	}
+	return copyAuthority(e.authority), nil
+}
@@ -0,0 +1,232 @@
+package pec_storage
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingAuthorities is an authority registry counting the lookups it serves
+type countingAuthorities struct {
+	*InMemoryAuthorityRegistry
+	mu     sync.Mutex
+	calls  int
+	err    error
+	called chan struct{}
+	block  chan struct{} // when set, lookups wait for it to be closed
+}
+
+func newCountingAuthorities() *countingAuthorities {
+	registry := NewInMemoryAuthorityRegistry()
+	registry.AddAuthority(&PECAuthority{
+		Name:                      "pec.example.com",
+		NotificationAddress:       "ricevute@pec.example.com",
+		ProviderCertificateHashes: []string{"AABBCC"},
+	})
+	return &countingAuthorities{InMemoryAuthorityRegistry: registry, called: make(chan struct{}, 10)}
+}
+
+func (c *countingAuthorities) lookup() error {
+	c.mu.Lock()
+	c.calls++
+	err := c.err
+	block := c.block
+	c.mu.Unlock()
+	select {
+	case c.called <- struct{}{}:
+	default:
+	}
+	if block != nil {
+		<-block
+	}
+	return err
+}
+
+func (c *countingAuthorities) Calls() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.calls
+}
+
+func (c *countingAuthorities) GetByDomain(domain string) (*PECAuthority, error) {
+	if err := c.lookup(); err != nil {
+		return nil, err
+	}
+	return c.InMemoryAuthorityRegistry.GetByDomain(domain)
+}
+
+func (c *countingAuthorities) GetByCertHash(hash string) (*PECAuthority, error) {
+	if err := c.lookup(); err != nil {
+		return nil, err
+	}
+	return c.InMemoryAuthorityRegistry.GetByCertHash(hash)
+}
+
+// waitLookup waits for the store to serve a lookup
+func waitLookup(t *testing.T, store *countingAuthorities) {
+	select {
+	case <-store.called:
+	case <-time.After(time.Second):
+		t.Fatal("Expected a lookup on the underlying store")
+	}
+}
+
+// TestCachedAuthorityRegistry_Hits tests that repeated lookups, including of
+// unknown hashes, are served from the cache
+func TestCachedAuthorityRegistry_Hits(t *testing.T) {
+	store := newCountingAuthorities()
+	cache := NewCachedAuthorityRegistry(store, time.Minute)
+
+	for i := 0; i < 3; i++ {
+		authority, err := cache.GetByCertHash("aa:bb:cc")
+		if err != nil {
+			t.Fatalf("GetByCertHash failed: %v", err)
+		}
+		if authority.Name != "pec.example.com" {
+			t.Errorf("Unexpected authority %q", authority.Name)
+		}
+		if _, err := cache.GetByCertHash("000000"); !errors.Is(err, ErrAuthorityNotFound) {
+			t.Errorf("Expected ErrAuthorityNotFound, got %v", err)
+		}
+		if _, err := cache.GetByDomain("PEC.example.com"); err != nil {
+			t.Fatalf("GetByDomain failed: %v", err)
+		}
+	}
+	if calls := store.Calls(); calls != 3 {
+		t.Errorf("Expected 3 lookups on the underlying store, got %d", calls)
+	}
+}
+
+// TestCachedAuthorityRegistry_Expiry tests that expired entries are served
+// while refreshed in the background, and kept when the refresh fails
+func TestCachedAuthorityRegistry_Expiry(t *testing.T) {
+	store := newCountingAuthorities()
+	cache := NewCachedAuthorityRegistry(store, time.Minute)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	if _, err := cache.GetByDomain("pec.example.com"); err != nil {
+		t.Fatalf("GetByDomain failed: %v", err)
+	}
+	waitLookup(t, store)
+
+	// The underlying store changes and fails once the entry expires
+	store.UpsertAuthority(&PECAuthority{Name: "pec.example.com", NotificationAddress: "notifiche@pec.example.com"})
+	store.mu.Lock()
+	store.err = errors.New("database unavailable")
+	store.mu.Unlock()
+	now = now.Add(2 * time.Minute)
+
+	authority, err := cache.GetByDomain("pec.example.com")
+	if err != nil {
+		t.Fatalf("Expected the stale entry to be served, got %v", err)
+	}
+	if authority.NotificationAddress != "ricevute@pec.example.com" {
+		t.Errorf("Expected the stale entry, got %q", authority.NotificationAddress)
+	}
+	waitLookup(t, store)
+
+	// Once the store recovers the entry is refreshed
+	store.mu.Lock()
+	store.err = nil
+	store.mu.Unlock()
+	deadline := time.Now().Add(time.Second)
+	for {
+		authority, err = cache.GetByDomain("pec.example.com")
+		if err != nil {
+			t.Fatalf("GetByDomain failed: %v", err)
+		}
+		if authority.NotificationAddress == "notifiche@pec.example.com" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the entry to be refreshed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestCachedAuthorityRegistry_NegativeBound tests that the unknown hashes
+// cached are bounded, and that the expired ones make room for new ones
+func TestCachedAuthorityRegistry_NegativeBound(t *testing.T) {
+	store := newCountingAuthorities()
+	cache := NewCachedAuthorityRegistry(store, time.Minute)
+	cache.MaxNegativeEntries = 2
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	for _, hash := range []string{"000001", "000002", "000003", "000004"} {
+		if _, err := cache.GetByCertHash(hash); !errors.Is(err, ErrAuthorityNotFound) {
+			t.Errorf("Expected ErrAuthorityNotFound, got %v", err)
+		}
+	}
+	if _, err := cache.GetByCertHash("aa:bb:cc"); err != nil {
+		t.Fatalf("GetByCertHash failed: %v", err)
+	}
+	if len(cache.entries) != 3 {
+		t.Errorf("Expected 2 unknown hashes and 1 authority cached, got %d entries", len(cache.entries))
+	}
+
+	// The unknown hashes not cached are looked up again
+	calls := store.Calls()
+	cache.GetByCertHash("000004")
+	if store.Calls() != calls+1 {
+		t.Errorf("Expected an uncached unknown hash to be looked up again")
+	}
+
+	// Once expired, the cached unknown hashes are swept for new ones
+	now = now.Add(2 * time.Minute)
+	cache.GetByCertHash("000005")
+	if _, ok := cache.entries["hash:000005"]; !ok {
+		t.Errorf("Expected the new unknown hash to be cached after the sweep")
+	}
+	if _, ok := cache.entries["hash:000001"]; ok {
+		t.Errorf("Expected the expired unknown hash to be swept")
+	}
+	if cache.negatives != 1 {
+		t.Errorf("Expected 1 unknown hash cached, got %d", cache.negatives)
+	}
+}
+
+// TestCachedAuthorityRegistry_RefreshAfterInvalidate tests that a background
+// refresh finishing after Invalidate does not restore the old entry
+func TestCachedAuthorityRegistry_RefreshAfterInvalidate(t *testing.T) {
+	store := newCountingAuthorities()
+	cache := NewCachedAuthorityRegistry(store, time.Minute)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	if _, err := cache.GetByDomain("pec.example.com"); err != nil {
+		t.Fatalf("GetByDomain failed: %v", err)
+	}
+	waitLookup(t, store)
+
+	// The refresh of the expired entry blocks until after Invalidate
+	block := make(chan struct{})
+	store.mu.Lock()
+	store.block = block
+	store.mu.Unlock()
+	now = now.Add(2 * time.Minute)
+	if _, err := cache.GetByDomain("pec.example.com"); err != nil {
+		t.Fatalf("Expected the stale entry to be served, got %v", err)
+	}
+	waitLookup(t, store)
+
+	cache.Invalidate()
+	store.mu.Lock()
+	store.block = nil
+	store.mu.Unlock()
+	close(block)
+
+	deadline := time.Now().Add(100 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		cache.mu.Lock()
+		_, ok := cache.entries["domain:pec.example.com"]
+		cache.mu.Unlock()
+		if ok {
+			t.Fatal("Expected the refresh not to restore an invalidated entry")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -1,41 +1,46 @@
 package pec_storage
 
-import "database/sql"
+import (
+	"database/sql"
+	"fmt"
+)
 
+// AuthorityRegistry implements AuthorityRegistryStore on PostgreSQL
 type AuthorityRegistry struct {
 	db *sql.DB
 }
 
+// NewAuthorityRegistry creates an authority registry backed by db
+func NewAuthorityRegistry(db *sql.DB) *AuthorityRegistry {
+	return &AuthorityRegistry{db: db}
+}
+
+// GetByDomain returns the authority named domain, or whose notification
+// address belongs to domain, or ErrAuthorityNotFound
 func (ar *AuthorityRegistry) GetByDomain(domain string) (*PECAuthority, error) {
 	const query = `
         SELECT id, name, smtp_addr, notification_address
         FROM pec_authorities
-        WHERE name = $1 OR notification_address LIKE '%' || $1
+        WHERE lower(name) = lower($1)
+           OR lower(substring(notification_address from '@([^@]+)$')) = lower($1)
+        ORDER BY lower(name) = lower($1) DESC
         LIMIT 1`
-	var id int
 	var auth PECAuthority
-	err := ar.db.QueryRow(query, domain).Scan(&id, &auth.Name, &auth.SMTPAddr, &auth.NotificationAddress)
-	if err != nil {
-		return nil, err
+	err := ar.db.QueryRow(query, domain).Scan(&auth.ID, &auth.Name, &auth.SMTPAddr, &auth.NotificationAddress)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: domain %s", ErrAuthorityNotFound, domain)
 	}
-
-	// Load certificate hashes
-	const hashQuery = `SELECT sha1_hash FROM pec_cert_hashes WHERE authority_id = $1`
-	rows, err := ar.db.Query(hashQuery, id)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to lookup authority for domain %s: %w", domain, err)
 	}
-	defer rows.Close()
-	for rows.Next() {
-		var hash string
-		if err := rows.Scan(&hash); err != nil {
-			return nil, err
-		}
-		auth.ProviderCertificateHashes = append(auth.ProviderCertificateHashes, hash)
+	if err := ar.loadCertHashes(&auth); err != nil {
+		return nil, err
 	}
 	return &auth, nil
 }
 
+// GetByCertHash returns the authority owning a certificate hash, or
+// ErrAuthorityNotFound
 func (ar *AuthorityRegistry) GetByCertHash(hash string) (*PECAuthority, error) {
 	const query = `
         SELECT a.id, a.name, a.smtp_addr, a.notification_address
@@ -43,61 +48,143 @@ func (ar *AuthorityRegistry) GetByCertHash(hash string) (*PECAuthority, error) {
         JOIN pec_cert_hashes c ON a.id = c.authority_id
         WHERE c.sha1_hash = $1
         LIMIT 1`
-	var id int
+	hash = NormalizeCertHash(hash)
 	var auth PECAuthority
-	err := ar.db.QueryRow(query, hash).Scan(&id, &auth.Name, &auth.SMTPAddr, &auth.NotificationAddress)
-	if err != nil {
-		return nil, err
+	err := ar.db.QueryRow(query, hash).Scan(&auth.ID, &auth.Name, &auth.SMTPAddr, &auth.NotificationAddress)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: certificate hash %s", ErrAuthorityNotFound, hash)
 	}
-
-	// Load all hashes for this authority
-	const hashQuery = `SELECT sha1_hash FROM pec_cert_hashes WHERE authority_id = $1`
-	rows, err := ar.db.Query(hashQuery, id)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to lookup authority for certificate hash %s: %w", hash, err)
 	}
-	defer rows.Close()
-	for rows.Next() {
-		var h string
-		if err := rows.Scan(&h); err != nil {
-			return nil, err
-		}
-		auth.ProviderCertificateHashes = append(auth.ProviderCertificateHashes, h)
+	if err := ar.loadCertHashes(&auth); err != nil {
+		return nil, err
 	}
 	return &auth, nil
 }
 
+// ListAuthorities returns all the authorities with their certificate hashes
 func (ar *AuthorityRegistry) ListAuthorities() ([]*PECAuthority, error) {
 	const query = `SELECT id, name, smtp_addr, notification_address FROM pec_authorities`
 	rows, err := ar.db.Query(query)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to list authorities: %w", err)
 	}
 	defer rows.Close()
 
 	var authorities []*PECAuthority
 	for rows.Next() {
-		var id int
 		var auth PECAuthority
-		if err := rows.Scan(&id, &auth.Name, &auth.SMTPAddr, &auth.NotificationAddress); err != nil {
-			return nil, err
+		if err := rows.Scan(&auth.ID, &auth.Name, &auth.SMTPAddr, &auth.NotificationAddress); err != nil {
+			return nil, fmt.Errorf("failed to list authorities: %w", err)
 		}
-		// Load hashes
-		const hashQuery = `SELECT sha1_hash FROM pec_cert_hashes WHERE authority_id = $1`
-		hashRows, err := ar.db.Query(hashQuery, id)
-		if err != nil {
+		authorities = append(authorities, &auth)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list authorities: %w", err)
+	}
+	rows.Close()
+
+	for _, auth := range authorities {
+		if err := ar.loadCertHashes(auth); err != nil {
 			return nil, err
 		}
-		for hashRows.Next() {
-			var h string
-			if err := hashRows.Scan(&h); err != nil {
-				hashRows.Close()
-				return nil, err
-			}
-			auth.ProviderCertificateHashes = append(auth.ProviderCertificateHashes, h)
-		}
-		hashRows.Close()
-		authorities = append(authorities, &auth)
 	}
 	return authorities, nil
 }
+
+// loadCertHashes loads the certificate hashes of auth
+func (ar *AuthorityRegistry) loadCertHashes(auth *PECAuthority) error {
+	const hashQuery = `SELECT sha1_hash FROM pec_cert_hashes WHERE authority_id = $1`
+	rows, err := ar.db.Query(hashQuery, auth.ID)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate hashes of %s: %w", auth.Name, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return fmt.Errorf("failed to load certificate hashes of %s: %w", auth.Name, err)
+		}
+		auth.ProviderCertificateHashes = append(auth.ProviderCertificateHashes, hash)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to load certificate hashes of %s: %w", auth.Name, err)
+	}
+	return nil
+}
+
+// UpsertAuthority inserts the authority, or updates the one with the same
+// name, replacing its certificate hashes in a single transaction. The ID of
+// the authority is set on auth.
+func (ar *AuthorityRegistry) UpsertAuthority(auth *PECAuthority) error {
+	tx, err := ar.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	const upsert = `
+        INSERT INTO pec_authorities (name, smtp_addr, notification_address)
+        VALUES ($1, $2, $3)
+        ON CONFLICT (name) DO UPDATE
+        SET smtp_addr = EXCLUDED.smtp_addr, notification_address = EXCLUDED.notification_address
+        RETURNING id`
+	var id int
+	if err := tx.QueryRow(upsert, auth.Name, auth.SMTPAddr, auth.NotificationAddress).Scan(&id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM pec_cert_hashes WHERE authority_id = $1`, id); err != nil {
+		return err
+	}
+	for _, hash := range auth.ProviderCertificateHashes {
+		if err := insertCertHash(tx, id, hash); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	auth.ID = id
+	return nil
+}
+
+// AddCertHash adds a certificate hash to the authority with the given ID
+func (ar *AuthorityRegistry) AddCertHash(authorityID int, hash string) error {
+	tx, err := ar.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Lock the authority so it cannot be deleted concurrently
+	var id int
+	err = tx.QueryRow(`SELECT id FROM pec_authorities WHERE id = $1 FOR UPDATE`, authorityID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("%w: id %d", ErrAuthorityNotFound, authorityID)
+	}
+	if err != nil {
+		return err
+	}
+	if err := insertCertHash(tx, authorityID, hash); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RemoveCertHash removes a certificate hash from the authority with the given ID
+func (ar *AuthorityRegistry) RemoveCertHash(authorityID int, hash string) error {
+	const remove = `DELETE FROM pec_cert_hashes WHERE authority_id = $1 AND sha1_hash = $2`
+	_, err := ar.db.Exec(remove, authorityID, NormalizeCertHash(hash))
+	return err
+}
+
+// insertCertHash adds a normalized hash to an authority, ignoring duplicates
+func insertCertHash(tx *sql.Tx, authorityID int, hash string) error {
+	const insert = `
+        INSERT INTO pec_cert_hashes (authority_id, sha1_hash)
+        VALUES ($1, $2)
+        ON CONFLICT (authority_id, sha1_hash) DO NOTHING`
+	_, err := tx.Exec(insert, authorityID, NormalizeCertHash(hash))
+	return err
+}
@@ -0,0 +1,238 @@
+package pec_storage
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+// openTestRegistry returns a registry on a fresh schema of the test database
+func openTestRegistry(t *testing.T) *AuthorityRegistry {
+	return NewAuthorityRegistry(openTestDB(t))
+}
+
+// openTestDB returns a fresh schema, migrated, of the database configured
+// through the PG* environment variables, skipping the test when no database
+// is configured
+func openTestDB(t *testing.T) *sql.DB {
+	if os.Getenv("PGHOST") == "" {
+		t.Skip("PGHOST not set, skipping PostgreSQL integration test")
+	}
+
+	admin, err := sql.Open("postgres", "")
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	t.Cleanup(func() { admin.Close() })
+
+	schema := fmt.Sprintf("pec_test_%d", time.Now().UnixNano())
+	if _, err := admin.Exec("CREATE SCHEMA " + schema); err != nil {
+		t.Fatalf("Failed to create schema: %v", err)
+	}
+	t.Cleanup(func() { admin.Exec("DROP SCHEMA " + schema + " CASCADE") })
+
+	db, err := sql.Open("postgres", "search_path="+schema)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	migrations, err := filepath.Glob(filepath.Join("migrations", "*.up.sql"))
+	if err != nil {
+		t.Fatalf("Failed to list migrations: %v", err)
+	}
+	sort.Strings(migrations)
+	for _, migration := range migrations {
+		up, err := os.ReadFile(migration)
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", migration, err)
+		}
+		if _, err := db.Exec(string(up)); err != nil {
+			t.Fatalf("Failed to apply %s: %v", migration, err)
+		}
+	}
+	return db
+}
+
+// TestAuthorityRegistry_Upsert tests that an authority is stored and read
+// back with its certificate hashes
+func TestAuthorityRegistry_Upsert(t *testing.T) {
+	registry := openTestRegistry(t)
+
+	authority := &PECAuthority{
+		Name:                      "pec.example.com",
+		SMTPAddr:                  "smtp.pec.example.com:25",
+		NotificationAddress:       "ricevute@pec.example.com",
+		ProviderCertificateHashes: []string{"aa:bb:cc", "DDEEFF"},
+	}
+	if err := registry.UpsertAuthority(authority); err != nil {
+		t.Fatalf("UpsertAuthority failed: %v", err)
+	}
+	if authority.ID == 0 {
+		t.Fatal("Expected the authority ID to be set")
+	}
+
+	got, err := registry.GetByCertHash("ddeeff")
+	if err != nil {
+		t.Fatalf("GetByCertHash failed: %v", err)
+	}
+	sort.Strings(got.ProviderCertificateHashes)
+	if got.Name != authority.Name || len(got.ProviderCertificateHashes) != 2 ||
+		got.ProviderCertificateHashes[0] != "AABBCC" || got.ProviderCertificateHashes[1] != "DDEEFF" {
+		t.Errorf("Unexpected authority %+v", got)
+	}
+
+	// Upserting again replaces the authority instead of duplicating it
+	authority.NotificationAddress = "notifiche@pec.example.com"
+	authority.ProviderCertificateHashes = []string{"DDEEFF"}
+	if err := registry.UpsertAuthority(authority); err != nil {
+		t.Fatalf("UpsertAuthority failed: %v", err)
+	}
+	authorities, err := registry.ListAuthorities()
+	if err != nil {
+		t.Fatalf("ListAuthorities failed: %v", err)
+	}
+	if len(authorities) != 1 || authorities[0].NotificationAddress != "notifiche@pec.example.com" ||
+		len(authorities[0].ProviderCertificateHashes) != 1 {
+		t.Errorf("Unexpected authorities after update %+v", authorities)
+	}
+}
+
+// TestAuthorityRegistry_CertHashes tests adding and removing single hashes
+func TestAuthorityRegistry_CertHashes(t *testing.T) {
+	registry := openTestRegistry(t)
+
+	authority := &PECAuthority{Name: "pec.example.com", NotificationAddress: "ricevute@pec.example.com"}
+	if err := registry.UpsertAuthority(authority); err != nil {
+		t.Fatalf("UpsertAuthority failed: %v", err)
+	}
+
+	if err := registry.AddCertHash(authority.ID, "01:02"); err != nil {
+		t.Fatalf("AddCertHash failed: %v", err)
+	}
+	if err := registry.AddCertHash(authority.ID, "0102"); err != nil {
+		t.Fatalf("AddCertHash of a duplicate failed: %v", err)
+	}
+	if _, err := registry.GetByCertHash("0102"); err != nil {
+		t.Fatalf("GetByCertHash failed: %v", err)
+	}
+
+	if err := registry.RemoveCertHash(authority.ID, "0102"); err != nil {
+		t.Fatalf("RemoveCertHash failed: %v", err)
+	}
+	if _, err := registry.GetByCertHash("0102"); err == nil {
+		t.Error("Expected the hash to be removed")
+	}
+
+	if err := registry.AddCertHash(authority.ID+1, "0304"); !errors.Is(err, ErrAuthorityNotFound) {
+		t.Errorf("Expected ErrAuthorityNotFound for an unknown authority, got %v", err)
+	}
+}
+
+// TestAuthorityRegistry_GetByDomainExact tests that the domain of the
+// notification address must match exactly, not as a substring
+func TestAuthorityRegistry_GetByDomainExact(t *testing.T) {
+	registry := openTestRegistry(t)
+
+	for _, authority := range []*PECAuthority{
+		{Name: "Not PEC", NotificationAddress: "ricevute@notpec.it"},
+		{Name: "PEC", NotificationAddress: "ricevute@pec.it"},
+	} {
+		if err := registry.UpsertAuthority(authority); err != nil {
+			t.Fatalf("UpsertAuthority failed: %v", err)
+		}
+	}
+
+	tests := map[string]string{
+		"pec.it":    "PEC",
+		"PEC.it":    "PEC",
+		"notpec.it": "Not PEC",
+	}
+	for domain, want := range tests {
+		authority, err := registry.GetByDomain(domain)
+		if err != nil {
+			t.Fatalf("GetByDomain(%q) failed: %v", domain, err)
+		}
+		if authority.Name != want {
+			t.Errorf("GetByDomain(%q) = %q, want %q", domain, authority.Name, want)
+		}
+	}
+	if _, err := registry.GetByDomain("it"); !errors.Is(err, ErrAuthorityNotFound) {
+		t.Errorf("Expected ErrAuthorityNotFound for a domain suffix, got %v", err)
+	}
+}
+
+// fakeConnector opens connections on which every query fails with err, or
+// returns no rows when err is nil
+type fakeConnector struct{ err error }
+
+func (c fakeConnector) Connect(context.Context) (driver.Conn, error) { return fakeConn(c), nil }
+func (c fakeConnector) Driver() driver.Driver                        { return nil }
+
+type fakeConn struct{ err error }
+
+func (c fakeConn) Prepare(string) (driver.Stmt, error) { return fakeStmt(c), nil }
+func (c fakeConn) Close() error                        { return nil }
+func (c fakeConn) Begin() (driver.Tx, error)           { return nil, errors.New("not supported") }
+
+type fakeStmt struct{ err error }
+
+func (s fakeStmt) Close() error  { return nil }
+func (s fakeStmt) NumInput() int { return -1 }
+func (s fakeStmt) Exec([]driver.Value) (driver.Result, error) {
+	return nil, errors.New("not supported")
+}
+func (s fakeStmt) Query([]driver.Value) (driver.Rows, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	return fakeRows{}, nil
+}
+
+type fakeRows struct{}
+
+func (fakeRows) Columns() []string {
+	return []string{"id", "name", "smtp_addr", "notification_address"}
+}
+func (fakeRows) Close() error              { return nil }
+func (fakeRows) Next([]driver.Value) error { return io.EOF }
+
+// TestAuthorityRegistry_NotFound tests that a lookup matching no rows
+// returns ErrAuthorityNotFound
+func TestAuthorityRegistry_NotFound(t *testing.T) {
+	registry := NewAuthorityRegistry(sql.OpenDB(fakeConnector{}))
+
+	if _, err := registry.GetByDomain("pec.example.com"); !errors.Is(err, ErrAuthorityNotFound) {
+		t.Errorf("GetByDomain: expected ErrAuthorityNotFound, got %v", err)
+	}
+	if _, err := registry.GetByCertHash("AABBCC"); !errors.Is(err, ErrAuthorityNotFound) {
+		t.Errorf("GetByCertHash: expected ErrAuthorityNotFound, got %v", err)
+	}
+}
+
+// TestAuthorityRegistry_DatabaseError tests that database failures are not
+// reported as unknown authorities
+func TestAuthorityRegistry_DatabaseError(t *testing.T) {
+	dbErr := errors.New("connection reset")
+	registry := NewAuthorityRegistry(sql.OpenDB(fakeConnector{err: dbErr}))
+
+	if _, err := registry.GetByDomain("pec.example.com"); errors.Is(err, ErrAuthorityNotFound) || !errors.Is(err, dbErr) {
+		t.Errorf("GetByDomain: expected the database error, got %v", err)
+	}
+	if _, err := registry.GetByCertHash("AABBCC"); errors.Is(err, ErrAuthorityNotFound) || !errors.Is(err, dbErr) {
+		t.Errorf("GetByCertHash: expected the database error, got %v", err)
+	}
+	if _, err := registry.ListAuthorities(); !errors.Is(err, dbErr) {
+		t.Errorf("ListAuthorities: expected the database error, got %v", err)
+	}
+}
@@ -0,0 +1,131 @@
+package pec_storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// InMemoryAuthorityRegistry implements AuthorityRegistryStore in memory
+type InMemoryAuthorityRegistry struct {
+	mu          sync.RWMutex
+	authorities []*PECAuthority
+}
+
+// NewInMemoryAuthorityRegistry creates an empty in-memory authority registry
+func NewInMemoryAuthorityRegistry() *InMemoryAuthorityRegistry {
+	return &InMemoryAuthorityRegistry{}
+}
+
+// LoadInMemoryAuthorityRegistry reads a JSON array of authorities from path
+func LoadInMemoryAuthorityRegistry(path string) (*InMemoryAuthorityRegistry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var authorities []*PECAuthority
+	if err := json.Unmarshal(data, &authorities); err != nil {
+		return nil, fmt.Errorf("failed to parse authority registry %s: %v", path, err)
+	}
+
+	registry := NewInMemoryAuthorityRegistry()
+	for _, authority := range authorities {
+		registry.AddAuthority(authority)
+	}
+	return registry, nil
+}
+
+// NormalizeCertHash returns the canonical form of a SHA-1 certificate hash:
+// upper case hexadecimal without separators
+func NormalizeCertHash(hash string) string {
+	hash = strings.NewReplacer(":", "", " ", "", "-", "").Replace(strings.TrimSpace(hash))
+	return strings.ToUpper(hash)
+}
+
+// AddAuthority adds an authority to the registry, normalizing its hashes
+func (r *InMemoryAuthorityRegistry) AddAuthority(authority *PECAuthority) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.authorities = append(r.authorities, normalizeAuthority(authority))
+}
+
+// UpsertAuthority adds the authority, or replaces the one with the same name
+func (r *InMemoryAuthorityRegistry) UpsertAuthority(authority *PECAuthority) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, existing := range r.authorities {
+		if strings.EqualFold(existing.Name, authority.Name) {
+			r.authorities[i] = normalizeAuthority(authority)
+			return nil
+		}
+	}
+	r.authorities = append(r.authorities, normalizeAuthority(authority))
+	return nil
+}
+
+// GetByDomain returns the authority named domain, or whose notification
+// address belongs to domain
+func (r *InMemoryAuthorityRegistry) GetByDomain(domain string) (*PECAuthority, error) {
+	domain = strings.ToLower(strings.TrimSpace(domain))
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, authority := range r.authorities {
+		if strings.ToLower(authority.Name) == domain {
+			return copyAuthority(authority), nil
+		}
+		at := strings.LastIndex(authority.NotificationAddress, "@")
+		if at >= 0 && strings.ToLower(authority.NotificationAddress[at+1:]) == domain {
+			return copyAuthority(authority), nil
+		}
+	}
+	return nil, fmt.Errorf("%w: domain %s", ErrAuthorityNotFound, domain)
+}
+
+// GetByCertHash returns the authority owning the certificate hash
+func (r *InMemoryAuthorityRegistry) GetByCertHash(hash string) (*PECAuthority, error) {
+	hash = NormalizeCertHash(hash)
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, authority := range r.authorities {
+		for _, h := range authority.ProviderCertificateHashes {
+			if h == hash {
+				return copyAuthority(authority), nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("%w: certificate hash %s", ErrAuthorityNotFound, hash)
+}
+
+// ListAuthorities returns all the authorities in the registry
+func (r *InMemoryAuthorityRegistry) ListAuthorities() ([]*PECAuthority, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	authorities := make([]*PECAuthority, 0, len(r.authorities))
+	for _, authority := range r.authorities {
+		authorities = append(authorities, copyAuthority(authority))
+	}
+	return authorities, nil
+}
+
+// normalizeAuthority returns a copy of authority with normalized hashes
+func normalizeAuthority(authority *PECAuthority) *PECAuthority {
+	stored := *authority
+	stored.ProviderCertificateHashes = make([]string, 0, len(authority.ProviderCertificateHashes))
+	for _, hash := range authority.ProviderCertificateHashes {
+		stored.ProviderCertificateHashes = append(stored.ProviderCertificateHashes, NormalizeCertHash(hash))
+	}
+	return &stored
+}
+
+// copyAuthority returns a copy callers can modify without affecting the registry
+func copyAuthority(authority *PECAuthority) *PECAuthority {
+	c := *authority
+	c.ProviderCertificateHashes = append([]string(nil), authority.ProviderCertificateHashes...)
+	return &c
+}
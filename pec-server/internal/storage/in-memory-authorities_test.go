@@ -0,0 +1,142 @@
+package pec_storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testAuthorities = `[
+  {
+    "name": "pec.example.com",
+    "smtp_addr": "smtp.pec.example.com:25",
+    "notification_address": "ricevute@pec.example.com",
+    "cert_hashes": ["aa:bb:cc:dd", "0102 0304"]
+  },
+  {
+    "name": "Other PEC",
+    "smtp_addr": "smtp.other.example.org:25",
+    "notification_address": "posta-certificata@Other.Example.org",
+    "cert_hashes": ["EEFF"]
+  }
+]`
+
+// loadTestAuthorities writes testAuthorities to a file and loads it
+func loadTestAuthorities(t *testing.T) *InMemoryAuthorityRegistry {
+	path := filepath.Join(t.TempDir(), "authorities.json")
+	if err := os.WriteFile(path, []byte(testAuthorities), 0600); err != nil {
+		t.Fatalf("Failed to write registry file: %v", err)
+	}
+	registry, err := LoadInMemoryAuthorityRegistry(path)
+	if err != nil {
+		t.Fatalf("LoadInMemoryAuthorityRegistry failed: %v", err)
+	}
+	return registry
+}
+
+// TestInMemoryAuthorityRegistry_GetByDomain tests lookups by authority name
+// and by notification address domain
+func TestInMemoryAuthorityRegistry_GetByDomain(t *testing.T) {
+	registry := loadTestAuthorities(t)
+
+	tests := map[string]string{
+		"pec.example.com":   "ricevute@pec.example.com",
+		"PEC.Example.com":   "ricevute@pec.example.com",
+		"other.example.org": "posta-certificata@Other.Example.org",
+	}
+	for domain, want := range tests {
+		authority, err := registry.GetByDomain(domain)
+		if err != nil {
+			t.Fatalf("GetByDomain(%q) failed: %v", domain, err)
+		}
+		if authority.NotificationAddress != want {
+			t.Errorf("GetByDomain(%q) = %q, want %q", domain, authority.NotificationAddress, want)
+		}
+	}
+
+	if _, err := registry.GetByDomain("unknown.example.net"); !errors.Is(err, ErrAuthorityNotFound) {
+		t.Errorf("Expected ErrAuthorityNotFound, got %v", err)
+	}
+}
+
+// TestInMemoryAuthorityRegistry_GetByDomainExact tests that a domain does not
+// match notification addresses merely containing it
+func TestInMemoryAuthorityRegistry_GetByDomainExact(t *testing.T) {
+	registry := NewInMemoryAuthorityRegistry()
+	registry.AddAuthority(&PECAuthority{Name: "Not PEC", NotificationAddress: "ricevute@notpec.it"})
+	registry.AddAuthority(&PECAuthority{Name: "PEC", NotificationAddress: "ricevute@pec.it"})
+
+	authority, err := registry.GetByDomain("pec.it")
+	if err != nil {
+		t.Fatalf("GetByDomain failed: %v", err)
+	}
+	if authority.Name != "PEC" {
+		t.Errorf("Expected PEC, got %q", authority.Name)
+	}
+	if _, err := registry.GetByDomain("it"); !errors.Is(err, ErrAuthorityNotFound) {
+		t.Errorf("Expected ErrAuthorityNotFound for a domain suffix, got %v", err)
+	}
+}
+
+// TestInMemoryAuthorityRegistry_GetByCertHash tests that hashes match
+// regardless of case and separators
+func TestInMemoryAuthorityRegistry_GetByCertHash(t *testing.T) {
+	registry := loadTestAuthorities(t)
+
+	for _, hash := range []string{"AABBCCDD", "aabbccdd", "AA:BB:CC:DD", "01020304", "eeff"} {
+		if _, err := registry.GetByCertHash(hash); err != nil {
+			t.Errorf("GetByCertHash(%q) failed: %v", hash, err)
+		}
+	}
+
+	authority, err := registry.GetByCertHash("ee:ff")
+	if err != nil {
+		t.Fatalf("GetByCertHash failed: %v", err)
+	}
+	if authority.Name != "Other PEC" {
+		t.Errorf("Expected Other PEC, got %q", authority.Name)
+	}
+
+	if _, err := registry.GetByCertHash("0000"); !errors.Is(err, ErrAuthorityNotFound) {
+		t.Errorf("Expected ErrAuthorityNotFound, got %v", err)
+	}
+}
+
+// TestInMemoryAuthorityRegistry_ListAuthorities tests that all authorities
+// are listed with normalized hashes
+func TestInMemoryAuthorityRegistry_ListAuthorities(t *testing.T) {
+	registry := loadTestAuthorities(t)
+
+	authorities, err := registry.ListAuthorities()
+	if err != nil {
+		t.Fatalf("ListAuthorities failed: %v", err)
+	}
+	if len(authorities) != 2 {
+		t.Fatalf("Expected 2 authorities, got %d", len(authorities))
+	}
+
+	hashes := authorities[0].ProviderCertificateHashes
+	if len(hashes) != 2 || hashes[0] != "AABBCCDD" || hashes[1] != "01020304" {
+		t.Errorf("Expected normalized hashes, got %v", hashes)
+	}
+
+	// Returned authorities are copies
+	authorities[0].NotificationAddress = "changed@example.com"
+	authority, _ := registry.GetByDomain("pec.example.com")
+	if authority.NotificationAddress != "ricevute@pec.example.com" {
+		t.Error("Expected the registry not to be modified through ListAuthorities")
+	}
+}
+
+// TestLoadInMemoryAuthorityRegistry_InvalidFile tests that a malformed file
+// is rejected
+func TestLoadInMemoryAuthorityRegistry_InvalidFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "authorities.json")
+	if err := os.WriteFile(path, []byte("{not json"), 0600); err != nil {
+		t.Fatalf("Failed to write registry file: %v", err)
+	}
+	if _, err := LoadInMemoryAuthorityRegistry(path); err == nil {
+		t.Error("Expected an error for an invalid file")
+	}
+}
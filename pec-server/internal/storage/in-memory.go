@@ -2,9 +2,11 @@ package pec_storage
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 	"sync"
 
+	"github.com/danzipie/go-pec/pec-server/logger"
 	"github.com/emersion/go-imap"
 )
 
@@ -18,11 +20,14 @@ type InMemoryStore struct {
 	// For IDLE notifications
 	notifiers   map[string]func() // key: username, value: notification function
 	notifiersMu sync.RWMutex
+
+	// DefaultDomain qualifies usernames given without a domain
+	DefaultDomain string
 }
 
 // NewInMemoryStore creates a new in-memory message store
 func NewInMemoryStore() *InMemoryStore {
-	fmt.Println("Using in-memory message store")
+	logger.LogInfo("Using in-memory message store", nil)
 	return &InMemoryStore{
 		messages:     make(map[string][]*imap.Message),
 		passwordHash: make(map[string]string),
@@ -31,6 +36,22 @@ func NewInMemoryStore() *InMemoryStore {
 	}
 }
 
+// normalizeUsername returns the canonical mailbox key for a username: the
+// full lowercased address. A bare local-part is qualified with defaultDomain,
+// so that "alice" and "Alice@example.com" refer to the same mailbox.
+func normalizeUsername(username, defaultDomain string) string {
+	username = strings.ToLower(strings.TrimSpace(username))
+	if !strings.Contains(username, "@") && defaultDomain != "" {
+		username += "@" + strings.ToLower(defaultDomain)
+	}
+	return username
+}
+
+// normalizeUsername returns the mailbox key for username in this store
+func (s *InMemoryStore) normalizeUsername(username string) string {
+	return normalizeUsername(username, s.DefaultDomain)
+}
+
 // Register a notifier for a mailbox
 func (s *InMemoryStore) RegisterNotifier(username string, notify func()) {
 	s.notifiersMu.Lock()
@@ -39,7 +60,7 @@ func (s *InMemoryStore) RegisterNotifier(username string, notify func()) {
 	if s.notifiers == nil {
 		s.notifiers = make(map[string]func())
 	}
-	s.notifiers[username] = notify
+	s.notifiers[s.normalizeUsername(username)] = notify
 }
 
 // Update AddMessage to trigger notifications
@@ -47,13 +68,12 @@ func (s *InMemoryStore) AddMessage(username string, msg *imap.Message) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	to := username
-	if i := strings.Index(username, "@"); i > 0 {
-		to = username[:i] // Take only the part before @
-	}
+	to := s.normalizeUsername(username)
 
 	if _, ok := s.messages[to]; !ok {
 		s.messages[to] = make([]*imap.Message, 0)
+	}
+	if s.nextUID[to] == 0 {
 		s.nextUID[to] = 1 // Start UIDs at 1 for new mailboxes
 	}
 
@@ -79,29 +99,41 @@ func (s *InMemoryStore) AddMessage(username string, msg *imap.Message) error {
 	// Add message to mailbox
 	s.messages[to] = append(s.messages[to], msg)
 
-	fmt.Printf("Message added for user: %s, Total messages: %d, UID: %d, SeqNum: %d\n",
-		to, len(s.messages[to]), msg.Uid, msg.SeqNum)
+	logger.LogDebug("Message added", map[string]string{
+		"username": to,
+		"messages": strconv.Itoa(len(s.messages[to])),
+		"uid":      strconv.FormatUint(uint64(msg.Uid), 10),
+		"seq_num":  strconv.FormatUint(uint64(msg.SeqNum), 10),
+	})
 
 	// Trigger notification
+	s.notify(to)
+
+	return nil
+}
+
+// notify calls the notifier registered for a normalized username, if any
+func (s *InMemoryStore) notify(username string) {
 	s.notifiersMu.RLock()
-	notify := s.notifiers[to]
+	notify := s.notifiers[username]
 	s.notifiersMu.RUnlock()
 
 	if notify != nil {
 		go notify() // Call notification function
 	}
-
-	return nil
 }
 
 // GetMessages implements MessageStore.GetMessages
 func (s *InMemoryStore) GetMessages(username string) ([]*imap.Message, error) {
+	username = s.normalizeUsername(username)
+
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	fmt.Println("Retrieving messages for user:", username)
-
-	fmt.Println("Total messages for user:", username, "is", len(s.messages[username]))
+	logger.LogDebug("Retrieving messages", map[string]string{
+		"username": username,
+		"messages": strconv.Itoa(len(s.messages[username])),
+	})
 	if msgs, ok := s.messages[username]; ok {
 		return msgs, nil
 	}
@@ -110,6 +142,8 @@ func (s *InMemoryStore) GetMessages(username string) ([]*imap.Message, error) {
 
 // GetMessage implements MessageStore.GetMessage
 func (s *InMemoryStore) GetMessage(username string, uid uint32) (*imap.Message, error) {
+	username = s.normalizeUsername(username)
+
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
@@ -123,8 +157,90 @@ func (s *InMemoryStore) GetMessage(username string, uid uint32) (*imap.Message,
 	return nil, nil
 }
 
+// AddFlags implements MessageStore.AddFlags; the mailbox is notified when the
+// flags change
+func (s *InMemoryStore) AddFlags(username string, uid uint32, flags ...string) (bool, error) {
+	username = s.normalizeUsername(username)
+
+	s.mu.Lock()
+	var msg *imap.Message
+	for _, m := range s.messages[username] {
+		if m.Uid == uid {
+			msg = m
+			break
+		}
+	}
+	if msg == nil {
+		s.mu.Unlock()
+		return false, fmt.Errorf("message %d not found for user %s", uid, username)
+	}
+
+	// Readers may hold the current slice: replace it rather than append to it
+	updated := append([]string(nil), msg.Flags...)
+	for _, flag := range flags {
+		if !hasFlag(updated, flag) {
+			updated = append(updated, flag)
+		}
+	}
+	changed := len(updated) != len(msg.Flags)
+	msg.Flags = updated
+	s.mu.Unlock()
+
+	if changed {
+		s.notify(username)
+	}
+	return changed, nil
+}
+
+// RemoveFlags implements MessageStore.RemoveFlags; the mailbox is notified
+// when the flags change
+func (s *InMemoryStore) RemoveFlags(username string, uid uint32, flags ...string) (bool, error) {
+	username = s.normalizeUsername(username)
+
+	s.mu.Lock()
+	var msg *imap.Message
+	for _, m := range s.messages[username] {
+		if m.Uid == uid {
+			msg = m
+			break
+		}
+	}
+	if msg == nil {
+		s.mu.Unlock()
+		return false, fmt.Errorf("message %d not found for user %s", uid, username)
+	}
+
+	// Readers may hold the current slice: replace it rather than edit it
+	updated := make([]string, 0, len(msg.Flags))
+	for _, flag := range msg.Flags {
+		if !hasFlag(flags, flag) {
+			updated = append(updated, flag)
+		}
+	}
+	changed := len(updated) != len(msg.Flags)
+	msg.Flags = updated
+	s.mu.Unlock()
+
+	if changed {
+		s.notify(username)
+	}
+	return changed, nil
+}
+
+// hasFlag reports whether flags contains flag, ignoring case
+func hasFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if strings.EqualFold(f, flag) {
+			return true
+		}
+	}
+	return false
+}
+
 // DeleteMessage implements MessageStore.DeleteMessage
 func (s *InMemoryStore) DeleteMessage(username string, uid uint32) error {
+	username = s.normalizeUsername(username)
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -150,7 +266,14 @@ func (s *InMemoryStore) Close() error {
 	return nil
 }
 
+// Ping implements MessageStore.Ping; the in-memory store is always reachable
+func (s *InMemoryStore) Ping() error {
+	return nil
+}
+
 func (s *InMemoryStore) UserExists(username string) bool {
+	username = s.normalizeUsername(username)
+
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	_, exists := s.passwordHash[username]
@@ -158,6 +281,8 @@ func (s *InMemoryStore) UserExists(username string) bool {
 }
 
 func (s *InMemoryStore) CreateUserWithPassword(username, passwordHash string) error {
+	username = s.normalizeUsername(username)
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	s.passwordHash[username] = passwordHash
@@ -166,6 +291,8 @@ func (s *InMemoryStore) CreateUserWithPassword(username, passwordHash string) er
 }
 
 func (s *InMemoryStore) GetUserPasswordHash(username string) (string, error) {
+	username = s.normalizeUsername(username)
+
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	hash, exists := s.passwordHash[username]
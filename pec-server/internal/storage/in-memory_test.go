@@ -0,0 +1,186 @@
+package pec_storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// TestInMemoryStore_NotifiesMailboxOnce tests that adding a message for a full
+// address notifies the IDLE mailbox registered for the same user exactly once
+func TestInMemoryStore_NotifiesMailboxOnce(t *testing.T) {
+	store := NewInMemoryStore()
+	store.DefaultDomain = "example.com"
+
+	notified := make(chan struct{}, 10)
+	store.RegisterNotifier("alice@example.com", func() { notified <- struct{}{} })
+
+	if err := store.AddMessage("Alice@example.com", &imap.Message{}); err != nil {
+		t.Fatalf("AddMessage failed: %v", err)
+	}
+
+	select {
+	case <-notified:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the mailbox to be notified")
+	}
+	select {
+	case <-notified:
+		t.Fatal("Expected exactly one notification")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// The message is visible through any form of the username
+	for _, username := range []string{"alice", "alice@example.com"} {
+		msgs, err := store.GetMessages(username)
+		if err != nil {
+			t.Fatalf("GetMessages(%s) failed: %v", username, err)
+		}
+		if len(msgs) != 1 {
+			t.Errorf("Expected 1 message for %s, got %d", username, len(msgs))
+		}
+	}
+}
+
+// TestInMemoryStore_OtherMailboxNotNotified tests that notifications are scoped to the recipient
+func TestInMemoryStore_OtherMailboxNotNotified(t *testing.T) {
+	store := NewInMemoryStore()
+
+	notified := make(chan struct{}, 1)
+	store.RegisterNotifier("bob@example.com", func() { notified <- struct{}{} })
+
+	if err := store.AddMessage("alice@example.com", &imap.Message{}); err != nil {
+		t.Fatalf("AddMessage failed: %v", err)
+	}
+
+	select {
+	case <-notified:
+		t.Fatal("Expected bob not to be notified of alice's message")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// TestInMemoryStore_NormalizesUsernames tests that add-then-get works for both
+// bare and fully qualified logins
+func TestInMemoryStore_NormalizesUsernames(t *testing.T) {
+	tests := []struct {
+		name  string
+		addAs string
+		getAs string
+	}{
+		{"local part", "user", "user"},
+		{"full address", "user@example.com", "user@example.com"},
+		{"added as full, read as local part", "user@example.com", "user"},
+		{"added as local part, read as full", "user", "user@example.com"},
+		{"mixed case", "User@Example.com", "user@EXAMPLE.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewInMemoryStore()
+			store.DefaultDomain = "example.com"
+
+			msg := &imap.Message{}
+			if err := store.AddMessage(tt.addAs, msg); err != nil {
+				t.Fatalf("AddMessage failed: %v", err)
+			}
+
+			msgs, err := store.GetMessages(tt.getAs)
+			if err != nil {
+				t.Fatalf("GetMessages failed: %v", err)
+			}
+			if len(msgs) != 1 {
+				t.Fatalf("Expected 1 message, got %d", len(msgs))
+			}
+			if got, _ := store.GetMessage(tt.getAs, msg.Uid); got != msg {
+				t.Errorf("Expected GetMessage to return the added message")
+			}
+			if err := store.DeleteMessage(tt.getAs, msg.Uid); err != nil {
+				t.Fatalf("DeleteMessage failed: %v", err)
+			}
+			if msgs, _ := store.GetMessages(tt.addAs); len(msgs) != 0 {
+				t.Errorf("Expected message to be deleted, got %d messages", len(msgs))
+			}
+		})
+	}
+}
+
+// TestInMemoryStore_SeparatesDomains tests that the same local part on two domains are different mailboxes
+func TestInMemoryStore_SeparatesDomains(t *testing.T) {
+	store := NewInMemoryStore()
+	store.DefaultDomain = "example.com"
+
+	if err := store.AddMessage("user@other.com", &imap.Message{}); err != nil {
+		t.Fatalf("AddMessage failed: %v", err)
+	}
+	if msgs, _ := store.GetMessages("user"); len(msgs) != 0 {
+		t.Errorf("Expected user@example.com to have no messages, got %d", len(msgs))
+	}
+	if msgs, _ := store.GetMessages("user@other.com"); len(msgs) != 1 {
+		t.Errorf("Expected user@other.com to have 1 message, got %d", len(msgs))
+	}
+}
+
+// TestInMemoryStore_AddFlags tests that flags are added once and notified
+func TestInMemoryStore_AddFlags(t *testing.T) {
+	store := NewInMemoryStore()
+	msg := &imap.Message{}
+	if err := store.AddMessage("alice@example.com", msg); err != nil {
+		t.Fatalf("AddMessage failed: %v", err)
+	}
+	notified := make(chan struct{}, 10)
+	store.RegisterNotifier("alice@example.com", func() { notified <- struct{}{} })
+
+	changed, err := store.AddFlags("alice@example.com", msg.Uid, imap.SeenFlag)
+	if err != nil || !changed {
+		t.Fatalf("Expected the flag to be added, got %v (%v)", changed, err)
+	}
+	stored, _ := store.GetMessage("alice@example.com", msg.Uid)
+	if len(stored.Flags) != 2 || stored.Flags[1] != imap.SeenFlag {
+		t.Errorf("Expected \\Recent and \\Seen, got %v", stored.Flags)
+	}
+	select {
+	case <-notified:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the mailbox to be notified")
+	}
+
+	if changed, err := store.AddFlags("alice@example.com", msg.Uid, `\seen`); err != nil || changed {
+		t.Errorf("Expected no change for a flag already set, got %v (%v)", changed, err)
+	}
+	if _, err := store.AddFlags("alice@example.com", msg.Uid+1, imap.SeenFlag); err == nil {
+		t.Errorf("Expected an error for a missing message")
+	}
+}
+
+func TestInMemoryStore_RemoveFlags(t *testing.T) {
+	store := NewInMemoryStore()
+	msg := &imap.Message{}
+	if err := store.AddMessage("alice@example.com", msg); err != nil {
+		t.Fatalf("AddMessage failed: %v", err)
+	}
+	notified := make(chan struct{}, 10)
+	store.RegisterNotifier("alice@example.com", func() { notified <- struct{}{} })
+
+	changed, err := store.RemoveFlags("alice@example.com", msg.Uid, `\recent`)
+	if err != nil || !changed {
+		t.Fatalf("Expected the flag to be removed, got %v (%v)", changed, err)
+	}
+	stored, _ := store.GetMessage("alice@example.com", msg.Uid)
+	if len(stored.Flags) != 0 {
+		t.Errorf("Expected no flags, got %v", stored.Flags)
+	}
+	select {
+	case <-notified:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the mailbox to be notified")
+	}
+
+	if changed, err := store.RemoveFlags("alice@example.com", msg.Uid, imap.RecentFlag); err != nil || changed {
+		t.Errorf("Expected no change for a flag not set, got %v (%v)", changed, err)
+	}
+	if _, err := store.RemoveFlags("alice@example.com", msg.Uid+1, imap.RecentFlag); err == nil {
+		t.Errorf("Expected an error for a missing message")
+	}
+}
@@ -0,0 +1,128 @@
+package pec_storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// JournalEvent identifies a step in the lifecycle of a PEC message
+type JournalEvent string
+
+const (
+	EventReceived                 JournalEvent = "received"
+	EventSenderAuthenticated      JournalEvent = "sender-authenticated"
+	EventAccepted                 JournalEvent = "accepted"
+	EventNonAccepted              JournalEvent = "non-accepted"
+	EventDuplicate                JournalEvent = "duplicate"
+	EventTransportEnvelopeCreated JournalEvent = "transport-envelope-created"
+	EventForwarded                JournalEvent = "forwarded"
+	EventDelivered                JournalEvent = "delivered"
+	EventReceiptEmitted           JournalEvent = "receipt-emitted"
+	EventReplayed                 JournalEvent = "replayed"
+)
+
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+// JournalEntry is a single record of the transaction log
+type JournalEntry struct {
+	Timestamp      time.Time    `json:"timestamp"`
+	Event          JournalEvent `json:"event"`
+	MessageID      string       `json:"message_id"`
+	Identificativo string       `json:"identificativo,omitempty"`
+	Outcome        string       `json:"outcome"`
+	Detail         string       `json:"detail,omitempty"`
+}
+
+// Journal defines the interface for the per-message audit trail
+type Journal interface {
+	// Record appends an entry to the journal
+	Record(entry JournalEntry) error
+
+	// QueryByMessageID returns all entries for a Message-ID, in recording order
+	QueryByMessageID(messageID string) ([]JournalEntry, error)
+
+	// Close releases any resources used by the journal
+	Close() error
+}
+
+// FileJournal implements Journal as an append-only file of JSON lines
+type FileJournal struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+// NewFileJournal opens (or creates) the journal file at path
+func NewFileJournal(path string) (*FileJournal, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open journal: %w", err)
+	}
+	return &FileJournal{path: path, file: f}, nil
+}
+
+// Record implements Journal.Record
+func (j *FileJournal) Record(entry JournalEntry) error {
+	if entry.Timestamp.IsZero() {
+		entry.Timestamp = time.Now()
+	}
+	if entry.Outcome == "" {
+		entry.Outcome = OutcomeSuccess
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode journal entry: %w", err)
+	}
+	line = append(line, '\n')
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if _, err := j.file.Write(line); err != nil {
+		return fmt.Errorf("failed to write journal entry: %w", err)
+	}
+	return j.file.Sync()
+}
+
+// QueryByMessageID implements Journal.QueryByMessageID
+func (j *FileJournal) QueryByMessageID(messageID string) ([]JournalEntry, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	f, err := os.Open(j.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open journal: %w", err)
+	}
+	defer f.Close()
+
+	var entries []JournalEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry JournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("failed to decode journal entry: %w", err)
+		}
+		if entry.MessageID == messageID {
+			entries = append(entries, entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read journal: %w", err)
+	}
+	return entries, nil
+}
+
+// Close implements Journal.Close
+func (j *FileJournal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.file.Close()
+}
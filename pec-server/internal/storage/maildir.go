@@ -0,0 +1,439 @@
+package pec_storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// maildirFlags maps the IMAP flags kept by the maildir store to the letters
+// of the maildir info, in the alphabetical order the letters are written in
+var maildirFlags = []struct {
+	letter byte
+	flag   string
+}{
+	{'D', imap.DraftFlag},
+	{'F', imap.FlaggedFlag},
+	{'R', imap.AnsweredFlag},
+	{'S', imap.SeenFlag},
+	{'T', imap.DeletedFlag},
+}
+
+// MaildirStore implements MessageStore on a maildir per user under a root
+// directory, root/<username>/{tmp,new,cur}, so that the mailboxes survive a
+// restart. A message keeps its UID in its file name and its flags in the
+// maildir info; a \Recent message is kept in new/, the others in cur/. The
+// flags without a maildir letter are not kept.
+type MaildirStore struct {
+	mu   sync.Mutex
+	root string
+
+	// DefaultDomain qualifies usernames given without a domain
+	DefaultDomain string
+}
+
+// NewMaildirStore creates a maildir message store under root, creating the
+// directory if needed
+func NewMaildirStore(root string) (*MaildirStore, error) {
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create maildir root: %v", err)
+	}
+	return &MaildirStore{root: root}, nil
+}
+
+// userDir returns the maildir of username
+func (s *MaildirStore) userDir(username string) (string, error) {
+	username = normalizeUsername(username, s.DefaultDomain)
+	if username == "" || username == "." || username == ".." || strings.ContainsAny(username, `/\`) {
+		return "", fmt.Errorf("invalid username %q", username)
+	}
+	return filepath.Join(s.root, username), nil
+}
+
+// createUserDir creates the maildir of username, if it does not exist yet
+func (s *MaildirStore) createUserDir(username string) (string, error) {
+	dir, err := s.userDir(username)
+	if err != nil {
+		return "", err
+	}
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return "", fmt.Errorf("failed to create maildir: %v", err)
+		}
+	}
+	return dir, nil
+}
+
+// nextUID returns the UID of the next message added to the maildir dir
+func (s *MaildirStore) nextUID(dir string) (uint32, error) {
+	path := filepath.Join(dir, "uidnext")
+	uid := uint32(1)
+	data, err := os.ReadFile(path)
+	if err == nil {
+		next, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 32)
+		if err != nil {
+			return 0, fmt.Errorf("invalid uidnext file: %v", err)
+		}
+		uid = uint32(next)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return 0, fmt.Errorf("failed to read uidnext file: %v", err)
+	}
+	if err := os.WriteFile(path, []byte(strconv.FormatUint(uint64(uid+1), 10)), 0600); err != nil {
+		return 0, fmt.Errorf("failed to write uidnext file: %v", err)
+	}
+	return uid, nil
+}
+
+// maildirFile is a message file of a maildir
+type maildirFile struct {
+	path  string
+	base  string // the unique name, without the info
+	uid   uint32
+	flags []string
+}
+
+// listMessages returns the message files of the maildir dir, by UID
+func listMessages(dir string) ([]maildirFile, error) {
+	var files []maildirFile
+	for _, sub := range []string{"new", "cur"} {
+		entries, err := os.ReadDir(filepath.Join(dir, sub))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read maildir: %v", err)
+		}
+		for _, entry := range entries {
+			file, ok := parseMaildirName(entry.Name(), sub == "new")
+			if !ok {
+				continue
+			}
+			file.path = filepath.Join(dir, sub, entry.Name())
+			files = append(files, file)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].uid < files[j].uid })
+	return files, nil
+}
+
+// findMessage returns the message file of uid in the maildir dir
+func findMessage(dir string, uid uint32) (maildirFile, bool, error) {
+	files, err := listMessages(dir)
+	if err != nil {
+		return maildirFile{}, false, err
+	}
+	for _, file := range files {
+		if file.uid == uid {
+			return file, true, nil
+		}
+	}
+	return maildirFile{}, false, nil
+}
+
+// parseMaildirName parses a file name written by maildirName
+func parseMaildirName(name string, recent bool) (maildirFile, bool) {
+	base, info, _ := strings.Cut(name, ":")
+	file := maildirFile{base: base}
+	for _, field := range strings.Split(base, ".") {
+		if !strings.HasPrefix(field, "U") {
+			continue
+		}
+		uid, err := strconv.ParseUint(field[1:], 10, 32)
+		if err != nil {
+			return maildirFile{}, false
+		}
+		file.uid = uint32(uid)
+	}
+	if file.uid == 0 {
+		return maildirFile{}, false
+	}
+	if recent {
+		file.flags = append(file.flags, imap.RecentFlag)
+	}
+	if letters, ok := strings.CutPrefix(info, "2,"); ok {
+		for _, mf := range maildirFlags {
+			if strings.IndexByte(letters, mf.letter) >= 0 {
+				file.flags = append(file.flags, mf.flag)
+			}
+		}
+	}
+	return file, true
+}
+
+// maildirName returns the file name of the message base with flags
+func maildirName(base string, flags []string) string {
+	info := ""
+	for _, mf := range maildirFlags {
+		if hasFlag(flags, mf.flag) {
+			info += string(mf.letter)
+		}
+	}
+	return base + ":2," + info
+}
+
+// maildirPath returns the path of the message base with flags in dir
+func maildirPath(dir, base string, flags []string) string {
+	sub := "cur"
+	if hasFlag(flags, imap.RecentFlag) {
+		sub = "new"
+	}
+	return filepath.Join(dir, sub, maildirName(base, flags))
+}
+
+// AddMessage implements MessageStore.AddMessage; the message is written to
+// tmp/ and then moved to new/, as \Recent
+func (s *MaildirStore) AddMessage(username string, msg *imap.Message) error {
+	raw, err := MessageBody(msg)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dir, err := s.createUserDir(username)
+	if err != nil {
+		return err
+	}
+	uid, err := s.nextUID(dir)
+	if err != nil {
+		return err
+	}
+	files, err := listMessages(dir)
+	if err != nil {
+		return err
+	}
+
+	internalDate := msg.InternalDate
+	if internalDate.IsZero() {
+		internalDate = time.Now()
+	}
+	if !hasFlag(msg.Flags, imap.RecentFlag) {
+		msg.Flags = append(msg.Flags, imap.RecentFlag)
+	}
+
+	base := fmt.Sprintf("%d.U%d.pec", internalDate.Unix(), uid)
+	tmp := filepath.Join(dir, "tmp", base)
+	if err := os.WriteFile(tmp, raw, 0600); err != nil {
+		return fmt.Errorf("failed to write message: %v", err)
+	}
+	// The modification time keeps the InternalDate
+	if err := os.Chtimes(tmp, internalDate, internalDate); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write message: %v", err)
+	}
+	if err := os.Rename(tmp, maildirPath(dir, base, msg.Flags)); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to deliver message: %v", err)
+	}
+
+	msg.Uid = uid
+	msg.SeqNum = uint32(len(files) + 1)
+	return nil
+}
+
+// readMessage reads the stored message of a message file
+func readMessage(file maildirFile) (*imap.Message, error) {
+	raw, err := os.ReadFile(file.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read message %d: %v", file.uid, err)
+	}
+	info, err := os.Stat(file.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read message %d: %v", file.uid, err)
+	}
+	msg, err := newStoredMessage(raw, info.ModTime())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read message %d: %v", file.uid, err)
+	}
+	msg.Uid = file.uid
+	msg.Flags = file.flags
+	return msg, nil
+}
+
+// GetMessages implements MessageStore.GetMessages
+func (s *MaildirStore) GetMessages(username string) ([]*imap.Message, error) {
+	dir, err := s.userDir(username)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	files, err := listMessages(dir)
+	if err != nil {
+		return nil, err
+	}
+	var msgs []*imap.Message
+	for i, file := range files {
+		msg, err := readMessage(file)
+		if err != nil {
+			return nil, err
+		}
+		msg.SeqNum = uint32(i + 1)
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+// GetMessage implements MessageStore.GetMessage
+func (s *MaildirStore) GetMessage(username string, uid uint32) (*imap.Message, error) {
+	dir, err := s.userDir(username)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	files, err := listMessages(dir)
+	if err != nil {
+		return nil, err
+	}
+	for i, file := range files {
+		if file.uid == uid {
+			msg, err := readMessage(file)
+			if err != nil {
+				return nil, err
+			}
+			msg.SeqNum = uint32(i + 1)
+			return msg, nil
+		}
+	}
+	return nil, nil
+}
+
+// AddFlags implements MessageStore.AddFlags
+func (s *MaildirStore) AddFlags(username string, uid uint32, flags ...string) (bool, error) {
+	return s.updateFlags(username, uid, func(current []string) []string {
+		updated := append([]string(nil), current...)
+		for _, flag := range flags {
+			if !hasFlag(updated, flag) {
+				updated = append(updated, flag)
+			}
+		}
+		return updated
+	})
+}
+
+// RemoveFlags implements MessageStore.RemoveFlags
+func (s *MaildirStore) RemoveFlags(username string, uid uint32, flags ...string) (bool, error) {
+	return s.updateFlags(username, uid, func(current []string) []string {
+		var updated []string
+		for _, flag := range current {
+			if !hasFlag(flags, flag) {
+				updated = append(updated, flag)
+			}
+		}
+		return updated
+	})
+}
+
+// updateFlags renames the file of the message uid to the flags returned by
+// update, reporting whether they changed
+func (s *MaildirStore) updateFlags(username string, uid uint32, update func([]string) []string) (bool, error) {
+	dir, err := s.userDir(username)
+	if err != nil {
+		return false, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file, ok, err := findMessage(dir, uid)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		return false, fmt.Errorf("message %d not found for user %s", uid, normalizeUsername(username, s.DefaultDomain))
+	}
+
+	path := maildirPath(dir, file.base, update(file.flags))
+	if path == file.path {
+		return false, nil
+	}
+	if err := os.Rename(file.path, path); err != nil {
+		return false, fmt.Errorf("failed to update flags of message %d: %v", uid, err)
+	}
+	return true, nil
+}
+
+// DeleteMessage implements MessageStore.DeleteMessage
+func (s *MaildirStore) DeleteMessage(username string, uid uint32) error {
+	dir, err := s.userDir(username)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file, ok, err := findMessage(dir, uid)
+	if err != nil || !ok {
+		return err
+	}
+	if err := os.Remove(file.path); err != nil {
+		return fmt.Errorf("failed to delete message %d: %v", uid, err)
+	}
+	return nil
+}
+
+// UserExists implements MessageStore.UserExists
+func (s *MaildirStore) UserExists(username string) bool {
+	dir, err := s.userDir(username)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(filepath.Join(dir, "password"))
+	return err == nil
+}
+
+// CreateUserWithPassword implements MessageStore.CreateUserWithPassword
+func (s *MaildirStore) CreateUserWithPassword(username, passwordHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dir, err := s.createUserDir(username)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "password"), []byte(passwordHash), 0600); err != nil {
+		return fmt.Errorf("failed to write password: %v", err)
+	}
+	return nil
+}
+
+// GetUserPasswordHash implements MessageStore.GetUserPasswordHash
+func (s *MaildirStore) GetUserPasswordHash(username string) (string, error) {
+	dir, err := s.userDir(username)
+	if err != nil {
+		return "", err
+	}
+	hash, err := os.ReadFile(filepath.Join(dir, "password"))
+	if err != nil {
+		return "", fmt.Errorf("user not found: %s", normalizeUsername(username, s.DefaultDomain))
+	}
+	return string(hash), nil
+}
+
+// Ping implements MessageStore.Ping; the root directory must be reachable
+func (s *MaildirStore) Ping() error {
+	if _, err := os.Stat(s.root); err != nil {
+		return fmt.Errorf("maildir root unreachable: %v", err)
+	}
+	return nil
+}
+
+// Close implements MessageStore.Close; the maildir store holds no resources
+func (s *MaildirStore) Close() error {
+	return nil
+}
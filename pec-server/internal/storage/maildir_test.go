@@ -0,0 +1,95 @@
+package pec_storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// TestMaildirStore_Persists tests that the messages, flags and users of a
+// maildir store are found by a store reopened on the same directory, in the
+// maildir layout
+func TestMaildirStore_Persists(t *testing.T) {
+	root := t.TempDir()
+	store, err := NewMaildirStore(root)
+	if err != nil {
+		t.Fatalf("NewMaildirStore failed: %v", err)
+	}
+	store.DefaultDomain = "example.com"
+
+	raw := "From: sender@example.org\r\nTo: alice@example.com\r\nSubject: hello\r\n\r\nBody\r\n"
+	if err := store.CreateUserWithPassword("alice", "hash"); err != nil {
+		t.Fatalf("CreateUserWithPassword failed: %v", err)
+	}
+	if err := store.AddMessage("alice", storedMessage(raw, time.Now())); err != nil {
+		t.Fatalf("AddMessage failed: %v", err)
+	}
+	if err := store.AddMessage("alice", storedMessage(raw, time.Now())); err != nil {
+		t.Fatalf("AddMessage failed: %v", err)
+	}
+	if _, err := store.AddFlags("alice", 2, imap.SeenFlag, imap.FlaggedFlag); err != nil {
+		t.Fatalf("AddFlags failed: %v", err)
+	}
+	if _, err := store.RemoveFlags("alice", 2, imap.RecentFlag); err != nil {
+		t.Fatalf("RemoveFlags failed: %v", err)
+	}
+
+	// The \Recent message is in new/, the other one in cur/ with its flags
+	dir := filepath.Join(root, "alice@example.com")
+	if matches, _ := filepath.Glob(filepath.Join(dir, "new", "*.U1.*:2,")); len(matches) != 1 {
+		t.Errorf("Expected message 1 in new/, got %v", matches)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dir, "cur", "*.U2.*:2,FS")); len(matches) != 1 {
+		t.Errorf("Expected message 2 in cur/ with flags FS, got %v", matches)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(dir, "tmp")); len(entries) != 0 {
+		t.Errorf("Expected tmp/ to be empty, got %d files", len(entries))
+	}
+
+	reopened, err := NewMaildirStore(root)
+	if err != nil {
+		t.Fatalf("NewMaildirStore failed: %v", err)
+	}
+	if !reopened.UserExists("alice@example.com") {
+		t.Error("Expected alice to exist after reopening")
+	}
+	msgs, err := reopened.GetMessages("alice@example.com")
+	if err != nil {
+		t.Fatalf("GetMessages failed: %v", err)
+	}
+	if len(msgs) != 2 {
+		t.Fatalf("Expected 2 messages, got %d", len(msgs))
+	}
+	if flags := msgs[1].Flags; len(flags) != 2 || !hasFlag(flags, imap.SeenFlag) || !hasFlag(flags, imap.FlaggedFlag) {
+		t.Errorf("Expected flags [\\Flagged \\Seen], got %v", flags)
+	}
+	if msgs[1].Envelope == nil || msgs[1].Envelope.Subject != "hello" {
+		t.Errorf("Expected the envelope to be parsed, got %+v", msgs[1].Envelope)
+	}
+
+	// The UIDs go on from the ones already given
+	msg := storedMessage(raw, time.Now())
+	if err := reopened.AddMessage("alice@example.com", msg); err != nil {
+		t.Fatalf("AddMessage failed: %v", err)
+	}
+	if msg.Uid != 3 {
+		t.Errorf("Expected UID 3, got %d", msg.Uid)
+	}
+}
+
+// TestMaildirStore_RejectsPathUsernames tests that a username cannot name a
+// directory outside the root
+func TestMaildirStore_RejectsPathUsernames(t *testing.T) {
+	store, err := NewMaildirStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewMaildirStore failed: %v", err)
+	}
+	for _, username := range []string{"..", "../alice@example.com", "a/b@example.com"} {
+		if err := store.CreateUserWithPassword(username, "hash"); err == nil {
+			t.Errorf("Expected username %q to be rejected", username)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package pec_storage
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend/backendutil"
+	"github.com/emersion/go-message/textproto"
+)
+
+// mboxDateLayout is the asctime date of the mbox "From " separator line
+const mboxDateLayout = time.ANSIC
+
+// messageLiteral is a stored message body that can be read any number of times
+type messageLiteral interface {
+	io.ReaderAt
+	Size() int64
+}
+
+// MessageBody returns the raw RFC 5322 message stored in the BODY[] section of msg
+func MessageBody(msg *imap.Message) ([]byte, error) {
+	for section, literal := range msg.Body {
+		if section.Specifier != imap.EntireSpecifier || len(section.Path) != 0 || len(section.Fields) != 0 || section.Partial != nil {
+			continue
+		}
+		body, ok := literal.(messageLiteral)
+		if !ok {
+			return nil, fmt.Errorf("message %d body cannot be reread", msg.Uid)
+		}
+		return io.ReadAll(io.NewSectionReader(body, 0, body.Size()))
+	}
+	return nil, fmt.Errorf("message %d has no stored body", msg.Uid)
+}
+
+// ExportUser writes every message stored for username, envelopes and receipts
+// included, to w as an mboxrd stream. The separator line of each message
+// carries its InternalDate, so that retention archives keep the delivery time.
+func ExportUser(store MessageStore, username string, w io.Writer) error {
+	msgs, err := store.GetMessages(username)
+	if err != nil {
+		return fmt.Errorf("failed to get messages for %s: %v", username, err)
+	}
+
+	bw := bufio.NewWriter(w)
+	for _, msg := range msgs {
+		raw, err := MessageBody(msg)
+		if err != nil {
+			return err
+		}
+		date := msg.InternalDate
+		if date.IsZero() && msg.Envelope != nil {
+			date = msg.Envelope.Date
+		}
+		fmt.Fprintf(bw, "From MAILER-DAEMON %s\n", date.UTC().Format(mboxDateLayout))
+		writeMboxMessage(bw, raw)
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("failed to write export: %v", err)
+	}
+	return nil
+}
+
+// writeMboxMessage writes raw with LF line endings, quoting the lines that
+// would be taken for a separator, followed by the blank line closing it
+func writeMboxMessage(w *bufio.Writer, raw []byte) {
+	raw = bytes.ReplaceAll(raw, []byte("\r\n"), []byte("\n"))
+	raw = bytes.TrimSuffix(raw, []byte("\n"))
+	for _, line := range bytes.Split(raw, []byte("\n")) {
+		if bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")) {
+			w.WriteByte('>')
+		}
+		w.Write(line)
+		w.WriteByte('\n')
+	}
+	w.WriteByte('\n')
+}
+
+// ImportMailbox reads an mboxrd stream, as written by ExportUser, and adds
+// every message to the mailbox of username. The InternalDate is taken from
+// the separator line, or from the Date header when the line has none; the
+// store assigns the UIDs.
+func ImportMailbox(store MessageStore, username string, r io.Reader) error {
+	br := bufio.NewReader(r)
+	var separator string
+	var lines [][]byte
+	flush := func() error {
+		if separator == "" {
+			return nil
+		}
+		// The blank line before the next separator closes the message
+		if n := len(lines); n > 0 && len(lines[n-1]) == 0 {
+			lines = lines[:n-1]
+		}
+		msg, err := newImportedMessage(separator, lines)
+		if err != nil {
+			return err
+		}
+		if err := store.AddMessage(username, msg); err != nil {
+			return fmt.Errorf("failed to add message for %s: %v", username, err)
+		}
+		return nil
+	}
+
+	for {
+		line, err := br.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("failed to read mbox: %v", err)
+		}
+		if len(line) > 0 {
+			line = bytes.TrimSuffix(bytes.TrimSuffix(line, []byte("\n")), []byte("\r"))
+			switch {
+			case bytes.HasPrefix(line, []byte("From ")):
+				if err := flush(); err != nil {
+					return err
+				}
+				separator, lines = string(line), nil
+			case separator == "":
+				return fmt.Errorf("invalid mbox: expected a From separator line, got %q", line)
+			default:
+				if bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")) {
+					line = line[1:]
+				}
+				lines = append(lines, line)
+			}
+		}
+		if err == io.EOF {
+			return flush()
+		}
+	}
+}
+
+// newImportedMessage builds the stored message for the mbox lines following separator
+func newImportedMessage(separator string, lines [][]byte) (*imap.Message, error) {
+	var raw []byte
+	for _, line := range lines {
+		raw = append(raw, line...)
+		raw = append(raw, '\r', '\n')
+	}
+
+	var date time.Time
+	if len(separator) >= len(mboxDateLayout) {
+		if parsed, err := time.Parse(mboxDateLayout, separator[len(separator)-len(mboxDateLayout):]); err == nil {
+			date = parsed
+		}
+	}
+	return newStoredMessage(raw, date)
+}
+
+// newStoredMessage builds the stored message for the raw RFC 5322 message,
+// received at internalDate; the Date header is used when internalDate is
+// zero, and the current time when both are missing
+func newStoredMessage(raw []byte, internalDate time.Time) (*imap.Message, error) {
+	br := bufio.NewReader(bytes.NewReader(raw))
+	header, err := textproto.ReadHeader(br)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read message header: %v", err)
+	}
+	envelope, err := backendutil.FetchEnvelope(header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build envelope: %v", err)
+	}
+	bodyStructure, err := backendutil.FetchBodyStructure(header, br, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build body structure: %v", err)
+	}
+
+	if internalDate.IsZero() {
+		internalDate = envelope.Date
+	}
+	if internalDate.IsZero() {
+		internalDate = time.Now()
+	}
+
+	return &imap.Message{
+		Envelope:      envelope,
+		BodyStructure: bodyStructure,
+		Body:          map[*imap.BodySectionName]imap.Literal{{}: bytes.NewReader(raw)},
+		InternalDate:  internalDate,
+		Size:          uint32(len(raw)),
+	}, nil
+}
@@ -0,0 +1,210 @@
+package pec_storage
+
+import (
+	"bytes"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// storedMessage returns a message holding raw in its BODY[] section
+func storedMessage(raw string, internalDate time.Time) *imap.Message {
+	return &imap.Message{
+		Body:         map[*imap.BodySectionName]imap.Literal{{}: bytes.NewReader([]byte(raw))},
+		InternalDate: internalDate,
+		Size:         uint32(len(raw)),
+	}
+}
+
+// TestExportUser tests exporting a two-message mailbox and re-reading the messages
+func TestExportUser(t *testing.T) {
+	envelope := "From: \"Per conto di: sender@example.org\" <posta-certificata@example.org>\r\n" +
+		"To: alice@example.com\r\n" +
+		"Subject: POSTA CERTIFICATA: hello\r\n" +
+		"X-Trasporto: posta-certificata\r\n" +
+		"\r\n" +
+		"From here on the body starts with a separator-like line\r\n" +
+		">From an already quoted line\r\n"
+	receipt := "From: posta-certificata@example.com\r\n" +
+		"To: alice@example.com\r\n" +
+		"Subject: CONSEGNA: hello\r\n" +
+		"X-Ricevuta: avvenuta-consegna\r\n" +
+		"\r\n" +
+		"Ricevuta di avvenuta consegna\r\n"
+	dates := []time.Time{
+		time.Date(2024, 1, 15, 14, 30, 45, 0, time.UTC),
+		time.Date(2024, 1, 15, 14, 31, 2, 0, time.UTC),
+	}
+
+	store := NewInMemoryStore()
+	for i, raw := range []string{envelope, receipt} {
+		if err := store.AddMessage("alice@example.com", storedMessage(raw, dates[i])); err != nil {
+			t.Fatalf("AddMessage failed: %v", err)
+		}
+	}
+
+	var out bytes.Buffer
+	if err := ExportUser(store, "alice@example.com", &out); err != nil {
+		t.Fatalf("ExportUser failed: %v", err)
+	}
+
+	// Split the stream on its separator lines
+	var separators []string
+	var messages []string
+	for _, line := range strings.SplitAfter(out.String(), "\n") {
+		if strings.HasPrefix(line, "From ") {
+			separators = append(separators, line)
+			messages = append(messages, "")
+			continue
+		}
+		if len(messages) == 0 {
+			t.Fatalf("Expected the export to start with a separator, got %q", line)
+		}
+		if strings.HasPrefix(strings.TrimLeft(line, ">"), "From ") {
+			line = line[1:]
+		}
+		messages[len(messages)-1] += line
+	}
+	if len(messages) != 2 {
+		t.Fatalf("Expected 2 exported messages, got %d", len(messages))
+	}
+
+	for i, want := range []string{envelope, receipt} {
+		if got := strings.TrimSuffix(separators[i], "\n"); got != "From MAILER-DAEMON "+dates[i].Format(time.ANSIC) {
+			t.Errorf("Unexpected separator %q", got)
+		}
+		msg, err := mail.ReadMessage(strings.NewReader(messages[i]))
+		if err != nil {
+			t.Fatalf("Failed to read exported message %d: %v", i, err)
+		}
+		wantMsg, _ := mail.ReadMessage(strings.NewReader(want))
+		if got, want := msg.Header.Get("Subject"), wantMsg.Header.Get("Subject"); got != want {
+			t.Errorf("Expected subject %q, got %q", want, got)
+		}
+		body := new(bytes.Buffer)
+		if _, err := body.ReadFrom(msg.Body); err != nil {
+			t.Fatalf("Failed to read body: %v", err)
+		}
+		wantBody := strings.ReplaceAll(want[strings.Index(want, "\r\n\r\n")+4:], "\r\n", "\n") + "\n"
+		if body.String() != wantBody {
+			t.Errorf("Expected body %q, got %q", wantBody, body.String())
+		}
+	}
+
+	// Exporting does not consume the stored messages
+	msgs, _ := store.GetMessages("alice@example.com")
+	if raw, err := MessageBody(msgs[0]); err != nil || string(raw) != envelope {
+		t.Errorf("Expected the stored message to be unchanged, got %q (%v)", raw, err)
+	}
+}
+
+// TestExportUser_MissingBody tests that a message without a stored body fails the export
+func TestExportUser_MissingBody(t *testing.T) {
+	store := NewInMemoryStore()
+	if err := store.AddMessage("alice@example.com", &imap.Message{}); err != nil {
+		t.Fatalf("AddMessage failed: %v", err)
+	}
+	if err := ExportUser(store, "alice@example.com", new(bytes.Buffer)); err == nil {
+		t.Fatal("Expected an error for a message without body")
+	}
+}
+
+// TestImportMailbox_RoundTrip tests that an exported mailbox imports back with
+// the same messages, dates, envelopes and body structures
+func TestImportMailbox_RoundTrip(t *testing.T) {
+	plain := "From: sender@example.org\r\n" +
+		"To: alice@example.com\r\n" +
+		"Subject: hello\r\n" +
+		"Date: Mon, 15 Jan 2024 14:30:00 +0000\r\n" +
+		"Message-ID: <plain@example.org>\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"From the sender\r\n" +
+		"\r\n"
+	receipt := "From: posta-certificata@example.com\r\n" +
+		"To: alice@example.com\r\n" +
+		"Subject: CONSEGNA: hello\r\n" +
+		"X-Ricevuta: avvenuta-consegna\r\n" +
+		"Content-Type: multipart/mixed; boundary=\"b\"\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Ricevuta di avvenuta consegna\r\n" +
+		"--b\r\n" +
+		"Content-Type: application/xml\r\n" +
+		"\r\n" +
+		"<postacert/>\r\n" +
+		"--b--\r\n"
+	dates := []time.Time{
+		time.Date(2024, 1, 15, 14, 30, 45, 0, time.UTC),
+		time.Date(2024, 1, 15, 14, 31, 2, 0, time.UTC),
+	}
+
+	source := NewInMemoryStore()
+	for i, raw := range []string{plain, receipt} {
+		if err := source.AddMessage("alice@example.com", storedMessage(raw, dates[i])); err != nil {
+			t.Fatalf("AddMessage failed: %v", err)
+		}
+	}
+	var mbox bytes.Buffer
+	if err := ExportUser(source, "alice@example.com", &mbox); err != nil {
+		t.Fatalf("ExportUser failed: %v", err)
+	}
+
+	target := NewInMemoryStore()
+	if err := ImportMailbox(target, "bob@example.com", &mbox); err != nil {
+		t.Fatalf("ImportMailbox failed: %v", err)
+	}
+	msgs, err := target.GetMessages("bob@example.com")
+	if err != nil {
+		t.Fatalf("GetMessages failed: %v", err)
+	}
+	if len(msgs) != 2 {
+		t.Fatalf("Expected 2 imported messages, got %d", len(msgs))
+	}
+
+	for i, want := range []string{plain, receipt} {
+		msg := msgs[i]
+		if msg.Uid != uint32(i+1) {
+			t.Errorf("Expected UID %d, got %d", i+1, msg.Uid)
+		}
+		if !msg.InternalDate.Equal(dates[i]) {
+			t.Errorf("Expected InternalDate %v, got %v", dates[i], msg.InternalDate)
+		}
+		raw, err := MessageBody(msg)
+		if err != nil {
+			t.Fatalf("MessageBody failed: %v", err)
+		}
+		if string(raw) != want {
+			t.Errorf("Expected message %q, got %q", want, raw)
+		}
+		if msg.Size != uint32(len(want)) {
+			t.Errorf("Expected size %d, got %d", len(want), msg.Size)
+		}
+	}
+
+	if got := msgs[0].Envelope.Subject; got != "hello" {
+		t.Errorf("Expected subject hello, got %q", got)
+	}
+	if got := msgs[0].Envelope.MessageId; got != "<plain@example.org>" {
+		t.Errorf("Expected Message-ID <plain@example.org>, got %q", got)
+	}
+	if bs := msgs[0].BodyStructure; bs == nil || bs.MIMEType != "text" || bs.MIMESubType != "plain" {
+		t.Errorf("Unexpected body structure %+v", bs)
+	}
+	if bs := msgs[1].BodyStructure; bs == nil || bs.MIMEType != "multipart" || len(bs.Parts) != 2 {
+		t.Errorf("Unexpected body structure %+v", bs)
+	}
+}
+
+// TestImportMailbox_RejectsMissingSeparator tests that a stream not starting with a separator is refused
+func TestImportMailbox_RejectsMissingSeparator(t *testing.T) {
+	store := NewInMemoryStore()
+	if err := ImportMailbox(store, "alice@example.com", strings.NewReader("Subject: hello\n\nbody\n")); err == nil {
+		t.Fatal("Expected an error for a stream without separator")
+	}
+}
@@ -20,11 +20,22 @@ type MessageStore interface {
 	// GetMessage retrieves a specific message by UID for a user
 	GetMessage(username string, uid uint32) (*imap.Message, error)
 
+	// AddFlags adds flags to a message by UID for a user, reporting whether
+	// any of them was not set yet
+	AddFlags(username string, uid uint32, flags ...string) (bool, error)
+
+	// RemoveFlags removes flags from a message by UID for a user, reporting
+	// whether any of them was set
+	RemoveFlags(username string, uid uint32, flags ...string) (bool, error)
+
 	// DeleteMessage deletes a specific message by UID for a user
 	DeleteMessage(username string, uid uint32) error
 
 	UserExists(username string) bool
 
+	// Ping reports whether the store is reachable
+	Ping() error
+
 	// Close releases any resources used by the store
 	Close() error
 }
@@ -0,0 +1,143 @@
+package pec_storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// testMessageStore runs the behaviour every MessageStore must have on store,
+// whose DefaultDomain is example.com
+func testMessageStore(t *testing.T, store MessageStore) {
+	t.Helper()
+
+	if err := store.Ping(); err != nil {
+		t.Fatalf("Ping failed: %v", err)
+	}
+
+	// Users
+	if store.UserExists("alice") {
+		t.Error("Expected alice not to exist yet")
+	}
+	if err := store.CreateUserWithPassword("Alice@example.com", "hash"); err != nil {
+		t.Fatalf("CreateUserWithPassword failed: %v", err)
+	}
+	if !store.UserExists("alice") {
+		t.Error("Expected alice to exist")
+	}
+	if hash, err := store.GetUserPasswordHash("alice@example.com"); err != nil || hash != "hash" {
+		t.Errorf("Expected password hash %q, got %q (%v)", "hash", hash, err)
+	}
+	if _, err := store.GetUserPasswordHash("bob"); err == nil {
+		t.Error("Expected an error for an unknown user")
+	}
+
+	// Messages
+	date := time.Date(2025, 10, 1, 12, 30, 0, 0, time.UTC)
+	raws := []string{
+		"From: sender@example.org\r\nTo: alice@example.com\r\nSubject: first\r\n\r\nFirst body\r\n",
+		"From: sender@example.org\r\nTo: alice@example.com\r\nSubject: second\r\n\r\nSecond body\r\n",
+	}
+	for i, raw := range raws {
+		msg := storedMessage(raw, date)
+		if err := store.AddMessage("alice", msg); err != nil {
+			t.Fatalf("AddMessage failed: %v", err)
+		}
+		if msg.Uid != uint32(i+1) || msg.SeqNum != uint32(i+1) {
+			t.Errorf("Expected UID and sequence number %d, got %d and %d", i+1, msg.Uid, msg.SeqNum)
+		}
+	}
+
+	msgs, err := store.GetMessages("alice@example.com")
+	if err != nil {
+		t.Fatalf("GetMessages failed: %v", err)
+	}
+	if len(msgs) != len(raws) {
+		t.Fatalf("Expected %d messages, got %d", len(raws), len(msgs))
+	}
+	for i, msg := range msgs {
+		body, err := MessageBody(msg)
+		if err != nil {
+			t.Fatalf("MessageBody failed: %v", err)
+		}
+		if string(body) != raws[i] {
+			t.Errorf("Expected body %q, got %q", raws[i], body)
+		}
+		if msg.Uid != uint32(i+1) || msg.SeqNum != uint32(i+1) {
+			t.Errorf("Expected UID and sequence number %d, got %d and %d", i+1, msg.Uid, msg.SeqNum)
+		}
+		if !msg.InternalDate.Equal(date) {
+			t.Errorf("Expected InternalDate %v, got %v", date, msg.InternalDate)
+		}
+		if !hasFlag(msg.Flags, imap.RecentFlag) {
+			t.Errorf("Expected a new message to be \\Recent, got %v", msg.Flags)
+		}
+	}
+	if msgs, _ := store.GetMessages("bob"); len(msgs) != 0 {
+		t.Errorf("Expected no messages for bob, got %d", len(msgs))
+	}
+
+	// Flags
+	if changed, err := store.AddFlags("alice", 1, imap.SeenFlag); err != nil || !changed {
+		t.Errorf("Expected AddFlags to change the flags, got %v (%v)", changed, err)
+	}
+	if changed, err := store.AddFlags("alice", 1, imap.SeenFlag); err != nil || changed {
+		t.Errorf("Expected AddFlags of a set flag not to change the flags, got %v (%v)", changed, err)
+	}
+	if changed, err := store.RemoveFlags("alice", 1, imap.RecentFlag); err != nil || !changed {
+		t.Errorf("Expected RemoveFlags to change the flags, got %v (%v)", changed, err)
+	}
+	msg, err := store.GetMessage("alice", 1)
+	if err != nil || msg == nil {
+		t.Fatalf("GetMessage failed: %v", err)
+	}
+	if !hasFlag(msg.Flags, imap.SeenFlag) || hasFlag(msg.Flags, imap.RecentFlag) {
+		t.Errorf("Expected flags [\\Seen], got %v", msg.Flags)
+	}
+	if _, err := store.AddFlags("alice", 99, imap.SeenFlag); err == nil {
+		t.Error("Expected an error adding flags to a missing message")
+	}
+
+	// Deletion keeps the UIDs, and they are not reused
+	if err := store.DeleteMessage("alice", 1); err != nil {
+		t.Fatalf("DeleteMessage failed: %v", err)
+	}
+	if msg, err := store.GetMessage("alice", 1); err != nil || msg != nil {
+		t.Errorf("Expected message 1 to be deleted, got %v (%v)", msg, err)
+	}
+	third := storedMessage(raws[0], date)
+	if err := store.AddMessage("alice", third); err != nil {
+		t.Fatalf("AddMessage failed: %v", err)
+	}
+	if third.Uid != 3 || third.SeqNum != 2 {
+		t.Errorf("Expected UID 3 and sequence number 2, got %d and %d", third.Uid, third.SeqNum)
+	}
+}
+
+// TestInMemoryStore_MessageStore tests the in-memory store against the
+// behaviour of every MessageStore
+func TestInMemoryStore_MessageStore(t *testing.T) {
+	store := NewInMemoryStore()
+	store.DefaultDomain = "example.com"
+	testMessageStore(t, store)
+}
+
+// TestMaildirStore_MessageStore tests the maildir store against the behaviour
+// of every MessageStore
+func TestMaildirStore_MessageStore(t *testing.T) {
+	store, err := NewMaildirStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewMaildirStore failed: %v", err)
+	}
+	store.DefaultDomain = "example.com"
+	testMessageStore(t, store)
+}
+
+// TestPostgresStore_MessageStore tests the PostgreSQL store against the
+// behaviour of every MessageStore
+func TestPostgresStore_MessageStore(t *testing.T) {
+	store := NewPostgresStore(openTestDB(t))
+	store.DefaultDomain = "example.com"
+	testMessageStore(t, store)
+}
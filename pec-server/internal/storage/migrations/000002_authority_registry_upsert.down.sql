@@ -0,0 +1,2 @@
+ALTER TABLE pec_cert_hashes DROP CONSTRAINT IF EXISTS pec_cert_hashes_authority_hash_key;
+ALTER TABLE pec_authorities DROP CONSTRAINT IF EXISTS pec_authorities_name_key;
@@ -0,0 +1,5 @@
+ALTER TABLE pec_authorities
+    ADD CONSTRAINT pec_authorities_name_key UNIQUE (name);
+
+ALTER TABLE pec_cert_hashes
+    ADD CONSTRAINT pec_cert_hashes_authority_hash_key UNIQUE (authority_id, sha1_hash);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS pec_authorities_lower_name_idx;
+DROP INDEX IF EXISTS pec_authorities_notification_domain_idx;
@@ -0,0 +1,4 @@
+CREATE INDEX pec_authorities_notification_domain_idx
+    ON pec_authorities (lower(substring(notification_address from '@([^@]+)$')));
+
+CREATE INDEX pec_authorities_lower_name_idx ON pec_authorities (lower(name));
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS pec_messages;
+DROP TABLE IF EXISTS pec_mailboxes;
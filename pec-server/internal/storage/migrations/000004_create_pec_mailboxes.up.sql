@@ -0,0 +1,14 @@
+CREATE TABLE pec_mailboxes (
+    username TEXT PRIMARY KEY,
+    password_hash TEXT,
+    uid_next BIGINT NOT NULL DEFAULT 1
+);
+
+CREATE TABLE pec_messages (
+    username TEXT NOT NULL REFERENCES pec_mailboxes(username) ON DELETE CASCADE,
+    uid BIGINT NOT NULL,
+    internal_date TIMESTAMPTZ NOT NULL,
+    flags TEXT[] NOT NULL DEFAULT '{}',
+    body BYTEA NOT NULL,
+    PRIMARY KEY (username, uid)
+);
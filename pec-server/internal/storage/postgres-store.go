@@ -0,0 +1,279 @@
+package pec_storage
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/lib/pq"
+)
+
+// PostgresStore implements MessageStore on PostgreSQL, in the pec_mailboxes
+// and pec_messages tables. The messages are kept raw, with their flags and
+// InternalDate, and parsed again when read.
+type PostgresStore struct {
+	db *sql.DB
+
+	// DefaultDomain qualifies usernames given without a domain
+	DefaultDomain string
+}
+
+// NewPostgresStore creates a message store backed by db
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+// OpenPostgresStore opens the database at dsn, a lib/pq connection string,
+// and returns a message store backed by it; closing the store closes the
+// database
+func OpenPostgresStore(dsn string) (*PostgresStore, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %v", err)
+	}
+	return NewPostgresStore(db), nil
+}
+
+// normalizeUsername returns the mailbox key for username in this store
+func (s *PostgresStore) normalizeUsername(username string) string {
+	return normalizeUsername(username, s.DefaultDomain)
+}
+
+// AddMessage implements MessageStore.AddMessage
+func (s *PostgresStore) AddMessage(username string, msg *imap.Message) error {
+	username = s.normalizeUsername(username)
+	raw, err := MessageBody(msg)
+	if err != nil {
+		return err
+	}
+	internalDate := msg.InternalDate
+	if internalDate.IsZero() {
+		internalDate = time.Now()
+	}
+	flags := append([]string(nil), msg.Flags...)
+	if !hasFlag(flags, imap.RecentFlag) {
+		flags = append(flags, imap.RecentFlag)
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to add message for %s: %v", username, err)
+	}
+	defer tx.Rollback()
+
+	// The mailbox row is locked until the commit, so UIDs are never reused
+	const nextUID = `
+        INSERT INTO pec_mailboxes (username, uid_next) VALUES ($1, 2)
+        ON CONFLICT (username) DO UPDATE SET uid_next = pec_mailboxes.uid_next + 1
+        RETURNING uid_next - 1`
+	var uid int64
+	if err := tx.QueryRow(nextUID, username).Scan(&uid); err != nil {
+		return fmt.Errorf("failed to add message for %s: %v", username, err)
+	}
+	const insert = `
+        INSERT INTO pec_messages (username, uid, internal_date, flags, body)
+        VALUES ($1, $2, $3, $4, $5)`
+	if _, err := tx.Exec(insert, username, uid, internalDate, pq.StringArray(flags), raw); err != nil {
+		return fmt.Errorf("failed to add message for %s: %v", username, err)
+	}
+	var count int64
+	if err := tx.QueryRow(`SELECT count(*) FROM pec_messages WHERE username = $1`, username).Scan(&count); err != nil {
+		return fmt.Errorf("failed to add message for %s: %v", username, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to add message for %s: %v", username, err)
+	}
+
+	msg.Uid = uint32(uid)
+	msg.SeqNum = uint32(count)
+	msg.Flags = flags
+	return nil
+}
+
+// GetMessages implements MessageStore.GetMessages
+func (s *PostgresStore) GetMessages(username string) ([]*imap.Message, error) {
+	username = s.normalizeUsername(username)
+
+	const query = `
+        SELECT uid, internal_date, flags, body FROM pec_messages
+        WHERE username = $1 ORDER BY uid`
+	rows, err := s.db.Query(query, username)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get messages for %s: %v", username, err)
+	}
+	defer rows.Close()
+
+	var msgs []*imap.Message
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		msg.SeqNum = uint32(len(msgs) + 1)
+		msgs = append(msgs, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get messages for %s: %v", username, err)
+	}
+	return msgs, nil
+}
+
+// GetMessage implements MessageStore.GetMessage
+func (s *PostgresStore) GetMessage(username string, uid uint32) (*imap.Message, error) {
+	username = s.normalizeUsername(username)
+
+	const query = `
+        SELECT uid, internal_date, flags, body,
+               (SELECT count(*) FROM pec_messages p WHERE p.username = m.username AND p.uid <= m.uid)
+        FROM pec_messages m
+        WHERE username = $1 AND uid = $2`
+	var seqNum int64
+	msg, err := scanMessage(s.db.QueryRow(query, username, uid), &seqNum)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	msg.SeqNum = uint32(seqNum)
+	return msg, nil
+}
+
+// scanMessage builds the stored message of a row of uid, internal_date,
+// flags and body, followed by the columns scanned into extra
+func scanMessage(row interface{ Scan(...any) error }, extra ...any) (*imap.Message, error) {
+	var (
+		uid          int64
+		internalDate time.Time
+		flags        pq.StringArray
+		raw          []byte
+	)
+	if err := row.Scan(append([]any{&uid, &internalDate, &flags, &raw}, extra...)...); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to read message: %v", err)
+	}
+	msg, err := newStoredMessage(raw, internalDate)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read message %d: %v", uid, err)
+	}
+	msg.Uid = uint32(uid)
+	msg.Flags = []string(flags)
+	return msg, nil
+}
+
+// AddFlags implements MessageStore.AddFlags
+func (s *PostgresStore) AddFlags(username string, uid uint32, flags ...string) (bool, error) {
+	return s.updateFlags(username, uid, func(current []string) []string {
+		updated := append([]string(nil), current...)
+		for _, flag := range flags {
+			if !hasFlag(updated, flag) {
+				updated = append(updated, flag)
+			}
+		}
+		return updated
+	})
+}
+
+// RemoveFlags implements MessageStore.RemoveFlags
+func (s *PostgresStore) RemoveFlags(username string, uid uint32, flags ...string) (bool, error) {
+	return s.updateFlags(username, uid, func(current []string) []string {
+		updated := []string{}
+		for _, flag := range current {
+			if !hasFlag(flags, flag) {
+				updated = append(updated, flag)
+			}
+		}
+		return updated
+	})
+}
+
+// updateFlags replaces the flags of the message uid with the ones returned
+// by update, reporting whether they changed
+func (s *PostgresStore) updateFlags(username string, uid uint32, update func([]string) []string) (bool, error) {
+	username = s.normalizeUsername(username)
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("failed to update flags of message %d: %v", uid, err)
+	}
+	defer tx.Rollback()
+
+	var flags pq.StringArray
+	const query = `SELECT flags FROM pec_messages WHERE username = $1 AND uid = $2 FOR UPDATE`
+	err = tx.QueryRow(query, username, uid).Scan(&flags)
+	if err == sql.ErrNoRows {
+		return false, fmt.Errorf("message %d not found for user %s", uid, username)
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to update flags of message %d: %v", uid, err)
+	}
+
+	updated := update(flags)
+	if len(updated) == len(flags) {
+		return false, nil
+	}
+	const set = `UPDATE pec_messages SET flags = $3 WHERE username = $1 AND uid = $2`
+	if _, err := tx.Exec(set, username, uid, pq.StringArray(updated)); err != nil {
+		return false, fmt.Errorf("failed to update flags of message %d: %v", uid, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to update flags of message %d: %v", uid, err)
+	}
+	return true, nil
+}
+
+// DeleteMessage implements MessageStore.DeleteMessage
+func (s *PostgresStore) DeleteMessage(username string, uid uint32) error {
+	username = s.normalizeUsername(username)
+	if _, err := s.db.Exec(`DELETE FROM pec_messages WHERE username = $1 AND uid = $2`, username, uid); err != nil {
+		return fmt.Errorf("failed to delete message %d: %v", uid, err)
+	}
+	return nil
+}
+
+// UserExists implements MessageStore.UserExists
+func (s *PostgresStore) UserExists(username string) bool {
+	_, err := s.GetUserPasswordHash(username)
+	return err == nil
+}
+
+// CreateUserWithPassword implements MessageStore.CreateUserWithPassword
+func (s *PostgresStore) CreateUserWithPassword(username, passwordHash string) error {
+	username = s.normalizeUsername(username)
+
+	const upsert = `
+        INSERT INTO pec_mailboxes (username, password_hash) VALUES ($1, $2)
+        ON CONFLICT (username) DO UPDATE SET password_hash = EXCLUDED.password_hash`
+	if _, err := s.db.Exec(upsert, username, passwordHash); err != nil {
+		return fmt.Errorf("failed to create user %s: %v", username, err)
+	}
+	return nil
+}
+
+// GetUserPasswordHash implements MessageStore.GetUserPasswordHash
+func (s *PostgresStore) GetUserPasswordHash(username string) (string, error) {
+	username = s.normalizeUsername(username)
+
+	var hash sql.NullString
+	err := s.db.QueryRow(`SELECT password_hash FROM pec_mailboxes WHERE username = $1`, username).Scan(&hash)
+	if err == sql.ErrNoRows || (err == nil && !hash.Valid) {
+		return "", fmt.Errorf("user not found: %s", username)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get user %s: %v", username, err)
+	}
+	return hash.String, nil
+}
+
+// Ping implements MessageStore.Ping
+func (s *PostgresStore) Ping() error {
+	return s.db.Ping()
+}
+
+// Close implements MessageStore.Close
+func (s *PostgresStore) Close() error {
+	return s.db.Close()
+}
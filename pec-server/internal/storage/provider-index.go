@@ -0,0 +1,179 @@
+package pec_storage
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// AuthorityWriter is an authority registry that can be populated
+type AuthorityWriter interface {
+	AuthorityRegistryStore
+	// UpsertAuthority inserts the authority, or replaces the one with the
+	// same name along with its certificate hashes.
+	UpsertAuthority(authority *PECAuthority) error
+}
+
+// ParseProviderIndex reads the LDIF export of the AgID index of the PEC
+// providers. Each provider entry carries providerName, mailReceipt and any
+// number of providerCertificateHash and providerCertificate values; other
+// attributes and entries without a providerName are ignored.
+func ParseProviderIndex(r io.Reader) ([]*PECAuthority, error) {
+	var authorities []*PECAuthority
+	for _, entry := range parseLDIF(r) {
+		if entry.err != nil {
+			return nil, entry.err
+		}
+		authority, err := providerFromEntry(entry.attrs)
+		if err != nil {
+			return nil, err
+		}
+		if authority != nil {
+			authorities = append(authorities, authority)
+		}
+	}
+	return authorities, nil
+}
+
+// ImportProviderIndex loads the AgID provider index from r into registry and
+// returns the number of authorities written. Without update, providers
+// already in the registry are left untouched; with update they are replaced
+// by the ones in the index.
+func ImportProviderIndex(registry AuthorityWriter, r io.Reader, update bool) (int, error) {
+	authorities, err := ParseProviderIndex(r)
+	if err != nil {
+		return 0, err
+	}
+
+	existing := make(map[string]bool)
+	if !update {
+		known, err := registry.ListAuthorities()
+		if err != nil {
+			return 0, fmt.Errorf("failed to list authorities: %v", err)
+		}
+		for _, authority := range known {
+			existing[strings.ToLower(authority.Name)] = true
+		}
+	}
+
+	written := 0
+	for _, authority := range authorities {
+		if existing[strings.ToLower(authority.Name)] {
+			continue
+		}
+		if err := registry.UpsertAuthority(authority); err != nil {
+			return written, fmt.Errorf("failed to import %s: %v", authority.Name, err)
+		}
+		written++
+	}
+	return written, nil
+}
+
+// providerFromEntry maps the attributes of an index entry to an authority
+func providerFromEntry(attrs map[string][]string) (*PECAuthority, error) {
+	names := attrs["providername"]
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	authority := &PECAuthority{Name: strings.TrimSpace(names[0])}
+	if receipts := attrs["mailreceipt"]; len(receipts) > 0 {
+		authority.NotificationAddress = strings.TrimSpace(receipts[0])
+	}
+
+	seen := make(map[string]bool)
+	addHash := func(hash string) {
+		hash = NormalizeCertHash(hash)
+		if hash != "" && !seen[hash] {
+			seen[hash] = true
+			authority.ProviderCertificateHashes = append(authority.ProviderCertificateHashes, hash)
+		}
+	}
+	for _, hash := range attrs["providercertificatehash"] {
+		addHash(hash)
+	}
+	// Hash the certificates too, the index does not always list their hashes
+	for _, der := range attrs["providercertificate"] {
+		sum := sha1.Sum([]byte(der))
+		addHash(hex.EncodeToString(sum[:]))
+	}
+	return authority, nil
+}
+
+// ldifEntry holds the attributes of an LDIF entry, keyed by lowercased name
+type ldifEntry struct {
+	attrs map[string][]string
+	err   error
+}
+
+// parseLDIF splits r into entries, unfolding continuation lines and decoding
+// base64 values. Attribute options such as ";binary" are dropped.
+func parseLDIF(r io.Reader) []ldifEntry {
+	var entries []ldifEntry
+	var lines []string
+
+	flush := func() {
+		if len(lines) == 0 {
+			return
+		}
+		entry := ldifEntry{attrs: make(map[string][]string)}
+		for _, line := range lines {
+			name, value, err := parseLDIFLine(line)
+			if err != nil {
+				entry.err = err
+				break
+			}
+			entry.attrs[name] = append(entry.attrs[name], value)
+		}
+		entries = append(entries, entry)
+		lines = nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		switch {
+		case line == "":
+			flush()
+		case strings.HasPrefix(line, " "):
+			if len(lines) > 0 {
+				lines[len(lines)-1] += line[1:]
+			}
+		case strings.HasPrefix(line, "#"):
+		default:
+			lines = append(lines, line)
+		}
+	}
+	flush()
+	if err := scanner.Err(); err != nil {
+		entries = append(entries, ldifEntry{err: fmt.Errorf("failed to read provider index: %v", err)})
+	}
+	return entries
+}
+
+// parseLDIFLine returns the lowercased attribute name and the value of line
+func parseLDIFLine(line string) (string, string, error) {
+	colon := strings.Index(line, ":")
+	if colon < 0 {
+		return "", "", fmt.Errorf("malformed provider index line %q", line)
+	}
+	name := strings.ToLower(strings.TrimSpace(line[:colon]))
+	if semi := strings.Index(name, ";"); semi >= 0 {
+		name = name[:semi]
+	}
+
+	value := line[colon+1:]
+	if strings.HasPrefix(value, ":") {
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value[1:]))
+		if err != nil {
+			return "", "", fmt.Errorf("invalid base64 value for %s: %v", name, err)
+		}
+		return name, string(decoded), nil
+	}
+	return name, strings.TrimSpace(value), nil
+}
@@ -0,0 +1,110 @@
+package pec_storage
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// testCertificate stands in for the DER certificate of a provider
+var testCertificate = []byte("not really a certificate")
+
+// testProviderIndex is a small sample of the LDIF provider index
+var testProviderIndex = "version: 1\r\n" +
+	"\r\n" +
+	"# Aruba\r\n" +
+	"dn: providerName=ARUBA PEC S.p.A.,o=postacert\r\n" +
+	"objectClass: provider\r\n" +
+	"providerName: ARUBA PEC S.p.A.\r\n" +
+	"providerUnit: Aruba\r\n" +
+	"mailReceipt: ricevute@pec.aruba.it\r\n" +
+	"managedDomains: pec.it\r\n" +
+	"managedDomains: pec.aruba.it\r\n" +
+	"ProviderCertificateHash: aa:bb:cc:dd:ee:ff:00:11:22:33:44:55:66:77:88:99:aa:bb:cc:\r\n" +
+	" dd\r\n" +
+	"providerCertificateHash: 0102030405060708090A0B0C0D0E0F1011121314\r\n" +
+	"LDIFLocationURL: ldap://ldap.example.it/o=postacert\r\n" +
+	"\r\n" +
+	"dn: providerName=Poste Italiane S.p.A.,o=postacert\r\n" +
+	"providerName:: " + base64.StdEncoding.EncodeToString([]byte("Poste Italiane S.p.A.")) + "\r\n" +
+	"mailReceipt: ricevute@postecert.it\r\n" +
+	"providerCertificate;binary:: " + base64.StdEncoding.EncodeToString(testCertificate) + "\r\n" +
+	"\r\n" +
+	"dn: o=postacert\r\n" +
+	"objectClass: organization\r\n"
+
+// TestParseProviderIndex tests that providers are read from the index with
+// all their certificate hashes
+func TestParseProviderIndex(t *testing.T) {
+	authorities, err := ParseProviderIndex(strings.NewReader(testProviderIndex))
+	if err != nil {
+		t.Fatalf("ParseProviderIndex failed: %v", err)
+	}
+	if len(authorities) != 2 {
+		t.Fatalf("Expected 2 providers, got %d", len(authorities))
+	}
+
+	aruba := authorities[0]
+	if aruba.Name != "ARUBA PEC S.p.A." || aruba.NotificationAddress != "ricevute@pec.aruba.it" {
+		t.Errorf("Unexpected provider %+v", aruba)
+	}
+	wantHashes := []string{"AABBCCDDEEFF00112233445566778899AABBCCDD", "0102030405060708090A0B0C0D0E0F1011121314"}
+	if strings.Join(aruba.ProviderCertificateHashes, ",") != strings.Join(wantHashes, ",") {
+		t.Errorf("Expected hashes %v, got %v", wantHashes, aruba.ProviderCertificateHashes)
+	}
+
+	poste := authorities[1]
+	sum := sha1.Sum(testCertificate)
+	if poste.Name != "Poste Italiane S.p.A." {
+		t.Errorf("Expected the base64 name to be decoded, got %q", poste.Name)
+	}
+	if len(poste.ProviderCertificateHashes) != 1 || poste.ProviderCertificateHashes[0] != strings.ToUpper(hex.EncodeToString(sum[:])) {
+		t.Errorf("Expected the certificate to be hashed, got %v", poste.ProviderCertificateHashes)
+	}
+}
+
+// TestImportProviderIndex tests that importing without update keeps the
+// known providers, while update mode replaces them
+func TestImportProviderIndex(t *testing.T) {
+	registry := NewInMemoryAuthorityRegistry()
+	registry.AddAuthority(&PECAuthority{Name: "Aruba PEC S.p.A.", NotificationAddress: "old@pec.aruba.it"})
+
+	written, err := ImportProviderIndex(registry, strings.NewReader(testProviderIndex), false)
+	if err != nil {
+		t.Fatalf("ImportProviderIndex failed: %v", err)
+	}
+	if written != 1 {
+		t.Errorf("Expected 1 new provider, got %d", written)
+	}
+	if authority, err := registry.GetByDomain("pec.aruba.it"); err != nil || authority.NotificationAddress != "old@pec.aruba.it" {
+		t.Error("Expected the known provider to be left untouched")
+	}
+
+	written, err = ImportProviderIndex(registry, strings.NewReader(testProviderIndex), true)
+	if err != nil {
+		t.Fatalf("ImportProviderIndex failed: %v", err)
+	}
+	if written != 2 {
+		t.Errorf("Expected 2 upserted providers, got %d", written)
+	}
+	authorities, _ := registry.ListAuthorities()
+	if len(authorities) != 2 {
+		t.Fatalf("Expected 2 providers after update, got %d", len(authorities))
+	}
+	authority, err := registry.GetByCertHash("0102030405060708090a0b0c0d0e0f1011121314")
+	if err != nil {
+		t.Fatalf("GetByCertHash failed: %v", err)
+	}
+	if authority.NotificationAddress != "ricevute@pec.aruba.it" {
+		t.Errorf("Expected the provider to be updated, got %q", authority.NotificationAddress)
+	}
+}
+
+// TestParseProviderIndex_Malformed tests that a line without a colon is rejected
+func TestParseProviderIndex_Malformed(t *testing.T) {
+	if _, err := ParseProviderIndex(strings.NewReader("providerName: X\nnonsense\n")); err == nil {
+		t.Error("Expected an error for a malformed index")
+	}
+}
@@ -2,12 +2,17 @@ package logger
 
 import (
 	"os"
+	"regexp"
+	"sort"
+	"strings"
 
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
 
-var log *zap.Logger
+// log defaults to a no-op logger so that packages using these helpers can
+// run (e.g. in tests) before Init is called.
+var log = zap.NewNop()
 
 // Init initializes the structured logger with file output
 func Init(logFilePath string) error {
@@ -26,6 +31,73 @@ func Init(logFilePath string) error {
 	return nil
 }
 
+// InitWithCore initializes the logger on top of an arbitrary zap core.
+// It is mainly useful in tests, to capture the emitted entries.
+func InitWithCore(core zapcore.Core) {
+	log = zap.New(core)
+}
+
+// redact masks the addresses and omits the message contents in the entries,
+// see SetRedaction
+var redact bool
+
+// SetRedaction enables or disables the redaction of personal data: the
+// local-parts of the addresses are masked (j***@example.com) and the fields
+// holding message contents are omitted.
+func SetRedaction(enabled bool) {
+	redact = enabled
+}
+
+// addressKeys are the context keys whose values may hold addresses
+var addressKeys = map[string]bool{
+	"from":                 true,
+	"to":                   true,
+	"recipient":            true,
+	"sender":               true,
+	"username":             true,
+	"notification_address": true,
+	"reason":               true,
+}
+
+// contentKeys are the context keys holding message contents
+var contentKeys = map[string]bool{
+	"body":    true,
+	"data":    true,
+	"content": true,
+}
+
+// addressPattern matches the local-part and the domain of an address
+var addressPattern = regexp.MustCompile(`([^\s<>(),;:'"@]+)@([A-Za-z0-9.-]+)`)
+
+// MaskAddresses masks the local-part of the addresses within s, keeping its
+// first character: mario.rossi@example.com becomes m***@example.com
+func MaskAddresses(s string) string {
+	return addressPattern.ReplaceAllStringFunc(s, func(address string) string {
+		local, domain, _ := strings.Cut(address, "@")
+		return local[:1] + "***@" + domain
+	})
+}
+
+// address returns an address to log, masked when redacting
+func address(s string) string {
+	if redact {
+		return MaskAddresses(s)
+	}
+	return s
+}
+
+// addresses returns addresses to log, masked when redacting
+func addresses(list []string) []string {
+	if !redact {
+		return list
+	}
+	masked := make([]string, len(list))
+	for i, s := range list {
+		masked[i] = MaskAddresses(s)
+	}
+	return masked
+}
+
 func Sync() {
 	if log != nil {
 		log.Sync()
@@ -36,8 +108,8 @@ func Sync() {
 func LogAcceptance(from, to, messageID, path string) {
 	log.Info("Ricevuta di accettazione generata",
 		zap.String("event", "acceptance"),
-		zap.String("from", from),
-		zap.String("to", to),
+		zap.String("from", address(from)),
+		zap.String("to", address(to)),
 		zap.String("message_id", messageID),
 		zap.String("eml_path", path),
 	)
@@ -47,8 +119,8 @@ func LogAcceptance(from, to, messageID, path string) {
 func LogDelivery(from, to, messageID, status string) {
 	log.Info("Ricevuta di consegna emessa",
 		zap.String("event", "delivery"),
-		zap.String("from", from),
-		zap.String("to", to),
+		zap.String("from", address(from)),
+		zap.String("to", address(to)),
 		zap.String("message_id", messageID),
 		zap.String("status", status),
 	)
@@ -58,22 +130,81 @@ func LogDelivery(from, to, messageID, status string) {
 func LogMessageReceived(from string, to []string, path string) {
 	log.Info("Messaggio PEC ricevuto",
 		zap.String("event", "message_received"),
-		zap.String("from", from),
-		zap.Strings("to", to),
+		zap.String("from", address(from)),
+		zap.Strings("to", addresses(to)),
 		zap.String("path", path),
 	)
 }
 
-// LogError logs an operational error
+// LogNonAcceptance logs an avviso di non accettazione
+func LogNonAcceptance(from string, to []string, messageID, reason string) {
+	log.Info("Avviso di non accettazione generato",
+		zap.String("event", "non_acceptance"),
+		zap.String("from", address(from)),
+		zap.Strings("to", addresses(to)),
+		zap.String("message_id", messageID),
+		zap.String("reason", address(reason)),
+	)
+}
+
+// LogAnomaly logs a busta di anomalia
+func LogAnomaly(from string, to []string, messageID, reason string) {
+	log.Warn("Busta di anomalia generata",
+		zap.String("event", "anomaly"),
+		zap.String("from", address(from)),
+		zap.Strings("to", addresses(to)),
+		zap.String("message_id", messageID),
+		zap.String("reason", address(reason)),
+	)
+}
+
+// LogInfo logs an operational event
+func LogInfo(message string, context map[string]string) {
+	log.Info(message, contextFields("info", context)...)
+}
+
+// LogDebug logs a diagnostic event, dropped at the default level
+func LogDebug(message string, context map[string]string) {
+	log.Debug(message, contextFields("debug", context)...)
+}
+
+// LogWarn logs a condition that needs attention but is not an error yet
+func LogWarn(message string, context map[string]string) {
+	log.Warn(message, contextFields("warning", context)...)
+}
+
+// LogError logs an operational error; the addresses within the error are
+// masked when redacting
 func LogError(message string, err error, context map[string]string) {
-	fields := []zap.Field{
-		zap.String("event", "error"),
-		zap.String("error", err.Error()),
+	errField := zap.Error(err)
+	if redact && err != nil {
+		errField = zap.String("error", MaskAddresses(err.Error()))
 	}
+	fields := append(contextFields("error", context), errField)
+	log.Error(message, fields...)
+}
 
-	for k, v := range context {
-		fields = append(fields, zap.String(k, v))
+// contextFields converts a context map into zap fields, sorted by key so
+// that the output is stable, redacting them if enabled.
+func contextFields(event string, context map[string]string) []zap.Field {
+	keys := make([]string, 0, len(context))
+	for k := range context {
+		keys = append(keys, k)
 	}
+	sort.Strings(keys)
 
-	log.Error(message, fields...)
+	fields := []zap.Field{zap.String("event", event)}
+	for _, k := range keys {
+		value := context[k]
+		if redact {
+			if contentKeys[k] {
+				continue
+			}
+			if addressKeys[k] {
+				value = MaskAddresses(value)
+			}
+		}
+		fields = append(fields, zap.String(k, value))
+	}
+	return fields
 }
@@ -0,0 +1,164 @@
+package logger
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// newObservedLogger replaces the package logger with one recording entries in memory
+func newObservedLogger(t *testing.T) *observer.ObservedLogs {
+	core, logs := observer.New(zapcore.DebugLevel)
+	InitWithCore(core)
+	t.Cleanup(func() { log = zap.NewNop() })
+	return logs
+}
+
+func TestLogNonAcceptanceFields(t *testing.T) {
+	logs := newObservedLogger(t)
+
+	LogNonAcceptance("sender@example.com", []string{"a@example.com", "b@example.com"}, "<id@example.com>", "missing From")
+
+	entries := logs.All()
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 entry, got %d", len(entries))
+	}
+	fields := entries[0].ContextMap()
+
+	expected := map[string]string{
+		"event":      "non_acceptance",
+		"from":       "sender@example.com",
+		"message_id": "<id@example.com>",
+		"reason":     "missing From",
+	}
+	for k, v := range expected {
+		if fields[k] != v {
+			t.Errorf("expected field %s to be '%s', got '%v'", k, v, fields[k])
+		}
+	}
+
+	to, ok := fields["to"].([]interface{})
+	if !ok || len(to) != 2 || to[0] != "a@example.com" || to[1] != "b@example.com" {
+		t.Errorf("unexpected 'to' field: %v", fields["to"])
+	}
+}
+
+func TestLogAnomalyLevel(t *testing.T) {
+	logs := newObservedLogger(t)
+
+	LogAnomaly("sender@example.com", []string{"rcpt@example.com"}, "<id@example.com>", "invalid signature")
+
+	entries := logs.FilterField(zap.String("event", "anomaly")).All()
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 anomaly entry, got %d", len(entries))
+	}
+	if entries[0].Level != zapcore.WarnLevel {
+		t.Errorf("expected warn level, got %s", entries[0].Level)
+	}
+}
+
+func TestLogInfoAndErrorContext(t *testing.T) {
+	logs := newObservedLogger(t)
+
+	ctx := map[string]string{
+		"session_id": "abc123",
+		"from":       "sender@example.com",
+	}
+	LogInfo("Mail from", ctx)
+	LogError("Error processing email data", errors.New("boom"), ctx)
+
+	entries := logs.All()
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(entries))
+	}
+
+	info := entries[0].ContextMap()
+	if info["event"] != "info" || info["session_id"] != "abc123" || info["from"] != "sender@example.com" {
+		t.Errorf("unexpected info fields: %v", info)
+	}
+
+	errFields := entries[1].ContextMap()
+	if errFields["event"] != "error" || errFields["error"] != "boom" || errFields["session_id"] != "abc123" {
+		t.Errorf("unexpected error fields: %v", errFields)
+	}
+}
+
+func TestLogDebugBelowDefaultLevel(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	InitWithCore(core)
+	t.Cleanup(func() { log = zap.NewNop() })
+
+	LogDebug("Listing messages", map[string]string{"username": "user"})
+
+	if logs.Len() != 0 {
+		t.Errorf("expected debug entries to be dropped at info level, got %d", logs.Len())
+	}
+}
+
+func TestRedactedContext(t *testing.T) {
+	logs := newObservedLogger(t)
+	SetRedaction(true)
+	t.Cleanup(func() { SetRedaction(false) })
+
+	body := "Gentile Mario, in allegato la fattura"
+	LogInfo("Data received", map[string]string{
+		"session_id": "abc123",
+		"from":       "mario.rossi@example.com",
+		"to":         "anna@example.org,luca@example.org",
+		"message_id": "<id@example.com>",
+		"body":       body,
+	})
+	LogNonAcceptance("mario.rossi@example.com", []string{"anna@example.org"}, "<id@example.com>", "recipient 'luca@example.org' not found")
+	LogError("Failed to store message", errors.New("user not found: mario.rossi@example.com"), nil)
+
+	entries := logs.All()
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(entries))
+	}
+	for _, entry := range entries {
+		for k, v := range entry.ContextMap() {
+			if s, ok := v.(string); ok && (strings.Contains(s, body) || strings.Contains(s, "rossi")) {
+				t.Errorf("expected field %s to be redacted, got '%s'", k, s)
+			}
+		}
+	}
+
+	info := entries[0].ContextMap()
+	if _, ok := info["body"]; ok {
+		t.Errorf("expected the body to be omitted, got %v", info["body"])
+	}
+	if info["from"] != "m***@example.com" || info["to"] != "a***@example.org,l***@example.org" {
+		t.Errorf("expected masked addresses, got from '%v' and to '%v'", info["from"], info["to"])
+	}
+	if info["message_id"] != "<id@example.com>" || info["session_id"] != "abc123" {
+		t.Errorf("expected the identifiers to be kept, got %v", info)
+	}
+
+	nonAcceptance := entries[1].ContextMap()
+	to, ok := nonAcceptance["to"].([]interface{})
+	if !ok || len(to) != 1 || to[0] != "a***@example.org" {
+		t.Errorf("unexpected 'to' field: %v", nonAcceptance["to"])
+	}
+	if nonAcceptance["reason"] != "recipient 'l***@example.org' not found" {
+		t.Errorf("expected the address in the reason to be masked, got '%v'", nonAcceptance["reason"])
+	}
+
+	if errFields := entries[2].ContextMap(); errFields["error"] != "user not found: m***@example.com" {
+		t.Errorf("expected the address in the error to be masked, got '%v'", errFields["error"])
+	}
+}
+
+func TestUnredactedContext(t *testing.T) {
+	logs := newObservedLogger(t)
+
+	LogInfo("Data received", map[string]string{"from": "mario.rossi@example.com", "body": "Hello"})
+
+	fields := logs.All()[0].ContextMap()
+	if fields["from"] != "mario.rossi@example.com" || fields["body"] != "Hello" {
+		t.Errorf("expected the fields to be logged as is without redaction, got %v", fields)
+	}
+}
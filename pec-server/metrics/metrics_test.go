@@ -0,0 +1,48 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// TestWriteTo tests the text exposition format of each metric type
+func TestWriteTo(t *testing.T) {
+	counter := &Counter{name: "test_total", help: "A counter."}
+	counter.Inc()
+	counter.Inc()
+
+	gauge := &Gauge{name: "test_depth", help: "A gauge."}
+	gauge.Set(5)
+	gauge.Dec()
+
+	histogram := &Histogram{name: "test_seconds", help: "A histogram.", buckets: []float64{0.1, 1}, counts: make([]uint64, 2)}
+	histogram.Observe(0.05)
+	histogram.Observe(0.5)
+	histogram.Observe(3)
+
+	var buf bytes.Buffer
+	for _, m := range []metric{counter, gauge, histogram} {
+		m.write(&buf)
+	}
+
+	expected := strings.Join([]string{
+		"# HELP test_total A counter.",
+		"# TYPE test_total counter",
+		"test_total 2",
+		"# HELP test_depth A gauge.",
+		"# TYPE test_depth gauge",
+		"test_depth 4",
+		"# HELP test_seconds A histogram.",
+		"# TYPE test_seconds histogram",
+		`test_seconds_bucket{le="0.1"} 1`,
+		`test_seconds_bucket{le="1"} 2`,
+		`test_seconds_bucket{le="+Inf"} 3`,
+		"test_seconds_sum 3.55",
+		"test_seconds_count 3",
+	}, "\n") + "\n"
+
+	if buf.String() != expected {
+		t.Errorf("Unexpected exposition output:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+}
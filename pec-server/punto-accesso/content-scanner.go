@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	defaultClamAVTimeout   = 30 * time.Second
+	clamAVChunkSize        = 64 * 1024
+	clamAVFoundSuffix      = " FOUND"
+	clamAVCleanReply       = "stream: OK"
+	clamAVStreamReplyStart = "stream: "
+)
+
+// ContentScanner checks a message for malware before it is accepted
+type ContentScanner interface {
+	// Scan reports whether raw is clean, and the reason when it is not
+	Scan(raw []byte) (clean bool, reason string, err error)
+}
+
+// NoopScanner accepts every message
+type NoopScanner struct{}
+
+// Scan implements ContentScanner
+func (NoopScanner) Scan([]byte) (bool, string, error) {
+	return true, "", nil
+}
+
+// contentScanner is the scanner used by AccessPointHandler
+var contentScanner ContentScanner = NoopScanner{}
+
+// ClamAVScanner scans messages with a clamd daemon over TCP, using the
+// INSTREAM command
+type ClamAVScanner struct {
+	Addr    string
+	Timeout time.Duration
+}
+
+// NewClamAVScanner creates a scanner for the clamd daemon listening on addr
+func NewClamAVScanner(addr string) *ClamAVScanner {
+	return &ClamAVScanner{Addr: addr, Timeout: defaultClamAVTimeout}
+}
+
+// Scan implements ContentScanner
+func (c *ClamAVScanner) Scan(raw []byte) (bool, string, error) {
+	conn, err := net.DialTimeout("tcp", c.Addr, c.Timeout)
+	if err != nil {
+		return false, "", fmt.Errorf("failed to connect to clamd: %v", err)
+	}
+	defer conn.Close()
+	if c.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(c.Timeout))
+	}
+
+	// The stream is sent in length-prefixed chunks, terminated by an empty one
+	w := bufio.NewWriter(conn)
+	w.WriteString("zINSTREAM\x00")
+	var size [4]byte
+	for start := 0; start < len(raw); start += clamAVChunkSize {
+		end := min(start+clamAVChunkSize, len(raw))
+		binary.BigEndian.PutUint32(size[:], uint32(end-start))
+		w.Write(size[:])
+		w.Write(raw[start:end])
+	}
+	binary.BigEndian.PutUint32(size[:], 0)
+	w.Write(size[:])
+	if err := w.Flush(); err != nil {
+		return false, "", fmt.Errorf("failed to send message to clamd: %v", err)
+	}
+
+	reply, err := bufio.NewReader(conn).ReadBytes(0)
+	if err != nil && len(reply) == 0 {
+		return false, "", fmt.Errorf("failed to read clamd reply: %v", err)
+	}
+	return parseClamAVReply(string(bytes.TrimRight(reply, "\x00\n")))
+}
+
+// parseClamAVReply interprets a reply such as "stream: OK" or
+// "stream: Eicar-Signature FOUND"
+func parseClamAVReply(reply string) (bool, string, error) {
+	if reply == clamAVCleanReply {
+		return true, "", nil
+	}
+	if strings.HasPrefix(reply, clamAVStreamReplyStart) && strings.HasSuffix(reply, clamAVFoundSuffix) {
+		signature := strings.TrimSuffix(strings.TrimPrefix(reply, clamAVStreamReplyStart), clamAVFoundSuffix)
+		return false, fmt.Sprintf("virus detected (%s)", signature), nil
+	}
+	return false, "", fmt.Errorf("unexpected clamd reply: %q", reply)
+}
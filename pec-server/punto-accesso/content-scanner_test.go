@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/danzipie/go-pec/pec-server/internal/common"
+	pec_storage "github.com/danzipie/go-pec/pec-server/internal/storage"
+	"github.com/emersion/go-smtp"
+)
+
+// mockScanner returns a fixed verdict and remembers the scanned message
+type mockScanner struct {
+	clean   bool
+	reason  string
+	scanned []byte
+}
+
+func (m *mockScanner) Scan(raw []byte) (bool, string, error) {
+	m.scanned = raw
+	return m.clean, m.reason, nil
+}
+
+// useScanner replaces the content scanner for the duration of a test
+func useScanner(t *testing.T, scanner ContentScanner) {
+	contentScanner = scanner
+	t.Cleanup(func() { contentScanner = NoopScanner{} })
+}
+
+// TestAccessPointHandler_ContentScan tests that infected messages are not accepted
+func TestAccessPointHandler_ContentScan(t *testing.T) {
+	tests := []struct {
+		name    string
+		scanner *mockScanner
+		wantErr bool
+	}{
+		{"clean message", &mockScanner{clean: true}, false},
+		{"infected message", &mockScanner{reason: "virus detected (Eicar-Signature)"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useScanner(t, tt.scanner)
+			captureForwards(t)
+			cert, key := createTestCertAndKeyForNonAcceptance(t)
+			signer := &common.Signer{Cert: cert, Key: key, Domain: "testdomain.com"}
+			store := pec_storage.NewInMemoryStore()
+			backend := common.NewBackend(signer, store, nil, AccessPointHandler, "testdomain.com")
+			session := newAuthenticatedSession(t, backend)
+
+			email := "From: sender@example.com\r\n" +
+				"To: recipient@testdomain.com\r\n" +
+				"Subject: Scan test\r\n" +
+				"Message-ID: <scan-test@example.com>\r\n" +
+				"Content-Type: text/plain\r\n" +
+				"\r\n" +
+				"Hello\r\n"
+			session.Mail("sender@example.com", nil)
+			session.Rcpt("recipient@testdomain.com", nil)
+			err := session.Data(strings.NewReader(email))
+
+			if !bytes.Contains(tt.scanner.scanned, []byte("Scan test")) {
+				t.Errorf("Expected the raw message to be scanned")
+			}
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatalf("Expected the message to be accepted, got %v", err)
+				}
+				return
+			}
+
+			var smtpErr *smtp.SMTPError
+			if !errors.As(err, &smtpErr) || smtpErr.Code != 550 || !strings.Contains(smtpErr.Message, tt.scanner.reason) {
+				t.Fatalf("Expected a 550 rejection with the scan reason, got %v", err)
+			}
+			messages, err := store.GetMessages("sender@example.com")
+			if err != nil || len(messages) != 1 {
+				t.Fatalf("Expected a non-acceptance receipt for the sender, got %d messages (%v)", len(messages), err)
+			}
+			if messages[0].Envelope == nil || !strings.Contains(messages[0].Envelope.Subject, "AVVISO DI NON ACCETTAZIONE") {
+				t.Errorf("Expected a non-acceptance receipt, got %+v", messages[0].Envelope)
+			}
+		})
+	}
+}
+
+// startFakeClamd serves INSTREAM requests, replying with reply to each one
+func startFakeClamd(t *testing.T, reply string) (string, *bytes.Buffer) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	received := new(bytes.Buffer)
+	done := make(chan struct{})
+	t.Cleanup(func() { <-done })
+	go func() {
+		defer close(done)
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		if command, err := r.ReadString(0); err != nil || command != "zINSTREAM\x00" {
+			return
+		}
+		var size [4]byte
+		for {
+			if _, err := io.ReadFull(r, size[:]); err != nil {
+				return
+			}
+			n := binary.BigEndian.Uint32(size[:])
+			if n == 0 {
+				break
+			}
+			io.CopyN(received, r, int64(n))
+		}
+		conn.Write([]byte(reply + "\x00"))
+	}()
+	return listener.Addr().String(), received
+}
+
+// TestClamAVScanner tests the INSTREAM exchange and the interpretation of the replies
+func TestClamAVScanner(t *testing.T) {
+	tests := []struct {
+		name       string
+		reply      string
+		wantClean  bool
+		wantReason string
+		wantErr    bool
+	}{
+		{"clean", "stream: OK", true, "", false},
+		{"infected", "stream: Eicar-Signature FOUND", false, "virus detected (Eicar-Signature)", false},
+		{"error", "INSTREAM size limit exceeded. ERROR", false, "", true},
+	}
+
+	raw := bytes.Repeat([]byte("message content\r\n"), 10000)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, received := startFakeClamd(t, tt.reply)
+			clean, reason, err := NewClamAVScanner(addr).Scan(raw)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Expected error %v, got %v", tt.wantErr, err)
+			}
+			if clean != tt.wantClean || reason != tt.wantReason {
+				t.Errorf("Expected %v %q, got %v %q", tt.wantClean, tt.wantReason, clean, reason)
+			}
+			if !bytes.Equal(received.Bytes(), raw) {
+				t.Errorf("Expected clamd to receive the whole message, got %d bytes", received.Len())
+			}
+		})
+	}
+}
+
+// TestClamAVScanner_Unreachable tests that an unreachable daemon is reported as an error
+func TestClamAVScanner_Unreachable(t *testing.T) {
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := listener.Addr().String()
+	listener.Close()
+
+	if _, _, err := NewClamAVScanner(addr).Scan([]byte("hello")); err == nil {
+		t.Error("Expected an error for an unreachable clamd")
+	}
+}
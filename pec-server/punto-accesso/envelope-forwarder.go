@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"net/smtp"
+)
+
+// EnvelopeForwarder hands transport envelopes over to the reception point
+type EnvelopeForwarder interface {
+	Forward(from string, to []string, envelope []byte) error
+}
+
+// SMTPForwarder relays transport envelopes to a reception point over SMTP
+type SMTPForwarder struct {
+	Addr string
+}
+
+// NewSMTPForwarder creates a forwarder relaying to the SMTP server at addr
+func NewSMTPForwarder(addr string) *SMTPForwarder {
+	return &SMTPForwarder{Addr: addr}
+}
+
+// Forward implements EnvelopeForwarder
+func (f *SMTPForwarder) Forward(from string, to []string, envelope []byte) error {
+	return smtp.SendMail(f.Addr, nil, from, to, envelope)
+}
+
+// envelopeForwarder is the forwarder used by AccessPointHandler; messages are
+// refused while none is configured
+var envelopeForwarder EnvelopeForwarder
+
+// ForwardEnvelope hands a transport envelope over to the reception point
+func ForwardEnvelope(from string, to []string, envelope []byte) error {
+	if envelopeForwarder == nil {
+		return errors.New("no reception point configured")
+	}
+	return envelopeForwarder.Forward(from, to, envelope)
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/danzipie/go-pec/pec"
+	"github.com/danzipie/go-pec/pec-server/internal/common"
+	pec_storage "github.com/danzipie/go-pec/pec-server/internal/storage"
+	"github.com/emersion/go-smtp"
+)
+
+// forwardedEnvelope is an envelope handed over to a recordingForwarder
+type forwardedEnvelope struct {
+	from     string
+	to       []string
+	envelope []byte
+}
+
+// recordingForwarder remembers the envelopes it forwards, or fails with err
+type recordingForwarder struct {
+	forwarded []forwardedEnvelope
+	err       error
+}
+
+func (f *recordingForwarder) Forward(from string, to []string, envelope []byte) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.forwarded = append(f.forwarded, forwardedEnvelope{from: from, to: to, envelope: envelope})
+	return nil
+}
+
+// captureForwards replaces the envelope forwarder for the duration of a test
+func captureForwards(t *testing.T) *recordingForwarder {
+	forwarder := &recordingForwarder{}
+	envelopeForwarder = forwarder
+	t.Cleanup(func() { envelopeForwarder = nil })
+	return forwarder
+}
+
+// sendTestMessage submits a valid message through a session of backend
+func sendTestMessage(t *testing.T, backend *common.Backend, messageID string) error {
+	session := newAuthenticatedSession(t, backend)
+	email := "From: sender@testdomain.com\r\n" +
+		"To: recipient@example.com\r\n" +
+		"Subject: Forward test\r\n" +
+		"Message-ID: " + messageID + "\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Hello\r\n"
+	if err := session.Mail("sender@testdomain.com", nil); err != nil {
+		t.Fatalf("MAIL failed: %v", err)
+	}
+	if err := session.Rcpt("recipient@example.com", nil); err != nil {
+		t.Fatalf("RCPT failed: %v", err)
+	}
+	return session.Data(strings.NewReader(email))
+}
+
+// TestAccessPointHandler_ForwardsEnvelopeAndAccepts tests that an accepted
+// message is forwarded as a transport envelope and acknowledged to the sender
+func TestAccessPointHandler_ForwardsEnvelopeAndAccepts(t *testing.T) {
+	forwarder := captureForwards(t)
+
+	cert, key := createTestCertAndKeyForNonAcceptance(t)
+	signer := &common.Signer{Cert: cert, Key: key, Domain: "testdomain.com"}
+	store := pec_storage.NewInMemoryStore()
+	backend := common.NewBackend(signer, store, nil, AccessPointHandler, "testdomain.com")
+
+	if err := sendTestMessage(t, backend, "<forward-test@testdomain.com>"); err != nil {
+		t.Fatalf("DATA failed: %v", err)
+	}
+
+	if len(forwarder.forwarded) != 1 {
+		t.Fatalf("Expected 1 forwarded envelope, got %d", len(forwarder.forwarded))
+	}
+	forwarded := forwarder.forwarded[0]
+	if forwarded.from != "sender@testdomain.com" || len(forwarded.to) != 1 || forwarded.to[0] != "recipient@example.com" {
+		t.Errorf("Unexpected SMTP envelope %s -> %v", forwarded.from, forwarded.to)
+	}
+	envelope, _, err := pec.ParsePecReader(bytes.NewReader(forwarded.envelope))
+	if err != nil {
+		t.Fatalf("Failed to parse forwarded envelope: %v", err)
+	}
+	if envelope.PecType != pec.CertifiedEmail {
+		t.Errorf("Expected a transport envelope, got %v", envelope.PecType)
+	}
+
+	messages, err := store.GetMessages("sender@testdomain.com")
+	if err != nil {
+		t.Fatalf("GetMessages failed: %v", err)
+	}
+	if len(messages) != 1 {
+		t.Fatalf("Expected the acceptance receipt in the sender's mailbox, got %d messages", len(messages))
+	}
+	raw, err := pec_storage.MessageBody(messages[0])
+	if err != nil {
+		t.Fatalf("MessageBody failed: %v", err)
+	}
+	receipt, err := common.ParseEmailMessage(raw)
+	if err != nil {
+		t.Fatalf("Failed to parse receipt: %v", err)
+	}
+	if got := receipt.Header.Get("X-Ricevuta"); got != "accettazione" {
+		t.Errorf("Expected an acceptance receipt, got X-Ricevuta %q", got)
+	}
+}
+
+// TestAccessPointHandler_AcceptanceReceipt tests that the acceptance receipt
+// reports the validated header fields of the message
+func TestAccessPointHandler_AcceptanceReceipt(t *testing.T) {
+	captureForwards(t)
+
+	cert, key := createTestCertAndKeyForNonAcceptance(t)
+	signer := &common.Signer{Cert: cert, Key: key, Domain: "testdomain.com"}
+	store := pec_storage.NewInMemoryStore()
+	backend := common.NewBackend(signer, store, nil, AccessPointHandler, "testdomain.com")
+	session := newAuthenticatedSession(t, backend)
+
+	email := "From: Mario Rossi <sender@testdomain.com>\r\n" +
+		"To: Anna Bianchi <recipient@example.com>\r\n" +
+		"Subject: =?utf-8?q?Citt=C3=A0?=\r\n" +
+		"Message-ID: <receipt-test@testdomain.com>\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Hello\r\n"
+	session.Mail("sender@testdomain.com", nil)
+	session.Rcpt("recipient@example.com", nil)
+	if err := session.Data(strings.NewReader(email)); err != nil {
+		t.Fatalf("DATA failed: %v", err)
+	}
+
+	messages, err := store.GetMessages("sender@testdomain.com")
+	if err != nil || len(messages) != 1 {
+		t.Fatalf("Expected 1 receipt in the sender's mailbox, got %d (%v)", len(messages), err)
+	}
+	raw, err := pec_storage.MessageBody(messages[0])
+	if err != nil {
+		t.Fatalf("MessageBody failed: %v", err)
+	}
+	pecMail, datiCert, err := pec.ParsePecReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("Failed to parse receipt: %v", err)
+	}
+	if pecMail.PecType != pec.AcceptanceReceipt {
+		t.Errorf("Expected an acceptance receipt, got %v", pecMail.PecType)
+	}
+	if datiCert.Intestazione.Mittente != "sender@testdomain.com" {
+		t.Errorf("Unexpected mittente %q", datiCert.Intestazione.Mittente)
+	}
+	if len(datiCert.Intestazione.Destinatari) != 1 || datiCert.Intestazione.Destinatari[0].Val != "recipient@example.com" {
+		t.Errorf("Unexpected destinatari %+v", datiCert.Intestazione.Destinatari)
+	}
+	if datiCert.Intestazione.Oggetto != "Città" {
+		t.Errorf("Expected the decoded subject, got %q", datiCert.Intestazione.Oggetto)
+	}
+	if datiCert.Dati.MsgID != "<receipt-test@testdomain.com>" {
+		t.Errorf("Unexpected msgid %q", datiCert.Dati.MsgID)
+	}
+}
+
+// TestAccessPointHandler_CustomStep tests that a step inserted by the
+// deployment runs around the acceptance flow and sees its outcome
+func TestAccessPointHandler_CustomStep(t *testing.T) {
+	forwarder := captureForwards(t)
+	previous := accessPointPipeline
+	accessPointPipeline = common.NewPipeline(validationStep, acceptanceStep)
+	t.Cleanup(func() { accessPointPipeline = previous })
+
+	var logged []string
+	logging := func(s *common.Session, next func(*common.Session) error) error {
+		logged = append(logged, "received from "+s.From)
+		err := next(s)
+		logged = append(logged, fmt.Sprintf("processed: %v, %d forwarded", err, len(forwarder.forwarded)))
+		return err
+	}
+	(&PuntoAccessoServer{}).Use(logging)
+
+	cert, key := createTestCertAndKeyForNonAcceptance(t)
+	signer := &common.Signer{Cert: cert, Key: key, Domain: "testdomain.com"}
+	backend := common.NewBackend(signer, pec_storage.NewInMemoryStore(), nil, AccessPointHandler, "testdomain.com")
+	if err := sendTestMessage(t, backend, "<custom-step@testdomain.com>"); err != nil {
+		t.Fatalf("DATA failed: %v", err)
+	}
+
+	want := []string{"received from sender@testdomain.com", "processed: <nil>, 1 forwarded"}
+	if len(logged) != len(want) || logged[0] != want[0] || logged[1] != want[1] {
+		t.Errorf("Expected the step to log %q, got %q", want, logged)
+	}
+}
+
+// TestAccessPointHandler_ForwardFailure tests that a message which cannot be
+// forwarded is refused with a temporary failure and processed on retry
+func TestAccessPointHandler_ForwardFailure(t *testing.T) {
+	forwarder := captureForwards(t)
+	forwarder.err = errors.New("connection refused")
+	duplicates = common.NewSeenMessageCache(&common.Config{})
+	t.Cleanup(func() { duplicates = nil })
+
+	cert, key := createTestCertAndKeyForNonAcceptance(t)
+	signer := &common.Signer{Cert: cert, Key: key, Domain: "testdomain.com"}
+	store := pec_storage.NewInMemoryStore()
+	backend := common.NewBackend(signer, store, nil, AccessPointHandler, "testdomain.com")
+
+	err := sendTestMessage(t, backend, "<retry-test@testdomain.com>")
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 451 {
+		t.Fatalf("Expected a 451 temporary failure, got %v", err)
+	}
+	if messages, _ := store.GetMessages("sender@testdomain.com"); len(messages) != 0 {
+		t.Errorf("Expected no acceptance receipt, got %d messages", len(messages))
+	}
+
+	// The retry is not mistaken for a duplicate
+	forwarder.err = nil
+	if err := sendTestMessage(t, backend, "<retry-test@testdomain.com>"); err != nil {
+		t.Fatalf("DATA failed on retry: %v", err)
+	}
+	if len(forwarder.forwarded) != 1 {
+		t.Errorf("Expected the retry to be forwarded, got %d envelopes", len(forwarder.forwarded))
+	}
+}
+
+// TestAccessPointHandler_SMTPStatus tests the enhanced status codes of the
+// replies to refused messages: permanent for a validation error, temporary
+// for a forward timeout
+func TestAccessPointHandler_SMTPStatus(t *testing.T) {
+	cert, key := createTestCertAndKeyForNonAcceptance(t)
+	signer := &common.Signer{Cert: cert, Key: key, Domain: "testdomain.com"}
+
+	tests := []struct {
+		name       string
+		from       string
+		forwardErr error
+		wantClass  int
+	}{
+		{"validation error", "other@testdomain.com", nil, 5},
+		{"forward timeout", "sender@testdomain.com", &net.OpError{Op: "dial", Net: "tcp", Err: os.ErrDeadlineExceeded}, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forwarder := captureForwards(t)
+			forwarder.err = tt.forwardErr
+			backend := common.NewBackend(signer, pec_storage.NewInMemoryStore(), nil, AccessPointHandler, "testdomain.com")
+			session := newAuthenticatedSession(t, backend)
+			email := "From: " + tt.from + "\r\n" +
+				"To: recipient@example.com\r\n" +
+				"Subject: Status test\r\n" +
+				"Message-ID: <status-test@testdomain.com>\r\n" +
+				"\r\n" +
+				"Hello\r\n"
+			session.Mail("sender@testdomain.com", nil)
+			session.Rcpt("recipient@example.com", nil)
+
+			err := session.Data(strings.NewReader(email))
+			var smtpErr *smtp.SMTPError
+			if !errors.As(err, &smtpErr) {
+				t.Fatalf("Expected an SMTP error, got %v", err)
+			}
+			if smtpErr.Code/100 != tt.wantClass || smtpErr.EnhancedCode[0] != tt.wantClass {
+				t.Errorf("Expected a %d.x.x reply, got %d %v", tt.wantClass, smtpErr.Code, smtpErr.EnhancedCode)
+			}
+		})
+	}
+}
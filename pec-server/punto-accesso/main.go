@@ -40,9 +40,9 @@ func main() {
 	case err := <-errChan:
 		log.Fatalf("Server error: %v", err)
 	case sig := <-sigChan:
-		log.Printf("Received signal %v, shutting down...", sig)
+		logger.LogInfo("Received signal, shutting down", map[string]string{"signal": sig.String()})
 		if err := server.Stop(); err != nil {
-			log.Printf("Error during shutdown: %v", err)
+			logger.LogError("Error during shutdown", err, nil)
 		}
 	}
 }
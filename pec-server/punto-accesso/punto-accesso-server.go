@@ -3,20 +3,29 @@ package main
 import (
 	"crypto/x509"
 	"fmt"
+	"strconv"
 
 	"github.com/danzipie/go-pec/pec-server/internal/common"
 	pec_storage "github.com/danzipie/go-pec/pec-server/internal/storage"
+	"github.com/danzipie/go-pec/pec-server/logger"
+	"github.com/danzipie/go-pec/pec-server/metrics"
 )
 
 // PuntoAccessoServer represents a complete Punto accesso server instance
 type PuntoAccessoServer struct {
-	config      *common.Config
-	store       pec_storage.MessageStore
-	signer      *common.Signer
-	smtpAddress string
-	imapAddress string
-	certificate *x509.Certificate
-	privateKey  interface{}
+	config          *common.Config
+	store           pec_storage.MessageStore
+	journal         pec_storage.Journal
+	signer          *common.Signer
+	credentials     *common.CredentialsWatcher
+	tlsCertificates *common.CertificateHolder
+	health          *common.Health
+	smtpAddress     string
+	imapAddress     string
+	certificate     *x509.Certificate
+	privateKey      interface{}
+	writeAhead      *common.WriteAheadLog
+	webhook         *common.Webhook
 }
 
 // NewPuntoAccessoServer creates a new PEC punto Accesso server instance
@@ -27,8 +36,11 @@ func NewPuntoAccessoServer(configPath string) (*PuntoAccessoServer, error) {
 		return nil, fmt.Errorf("failed to load config: %v", err)
 	}
 
+	// Keep personal data out of the logs, if configured
+	logger.SetRedaction(cfg.RedactLogs)
+
 	// Load S/MIME credentials
-	cert, key, err := common.LoadSMIMECredentials(cfg.CertFile, cfg.KeyFile)
+	cert, key, chain, err := common.LoadCredentials(cfg)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load S/MIME credentials: %v", err)
 	}
@@ -37,37 +49,179 @@ func NewPuntoAccessoServer(configPath string) (*PuntoAccessoServer, error) {
 	signer := &common.Signer{
 		Cert:   cert,
 		Key:    key,
+		Chain:  chain,
 		Domain: cfg.Domain,
 	}
 
+	// Warn about an expiring certificate and pick up renewed ones
+	credentials := common.NewCredentialsWatcher(cfg, signer)
+	credentials.CheckExpiry()
+
+	// Load the TLS certificate of the listeners, if configured
+	tlsCertificates, err := common.LoadTLSCertificates(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Scan messages for malware, if configured
+	contentScanner = NoopScanner{}
+	if cfg.ClamAVServer != "" {
+		contentScanner = NewClamAVScanner(cfg.ClamAVServer)
+	}
+
+	// Accept retried messages only once
+	duplicates = common.NewSeenMessageCache(cfg)
+
+	// Validate the message header fields strictly, if configured
+	strictHeaders = cfg.StrictHeaders
+
+	// Limit the recipients of a message
+	maxRecipients = defaultMaxRecipients
+	if cfg.MaxRecipients > 0 {
+		maxRecipients = cfg.MaxRecipients
+	}
+
+	// Relay transport envelopes to the reception point
+	envelopeForwarder = nil
+	if cfg.ReceptionPointSMTP != "" {
+		envelopeForwarder = NewSMTPForwarder(cfg.ReceptionPointSMTP)
+	}
+
+	// Render the receipts in the configured locale
+	receiptTemplates, err = common.LoadReceiptTemplates(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load receipt templates: %v", err)
+	}
+
+	// Sign the receipts into the configured S/MIME structure
+	receiptSigningMode, err = common.ParseSigningMode(cfg.ReceiptSigningMode)
+	if err != nil {
+		return nil, fmt.Errorf("invalid receipt_signing_mode: %v", err)
+	}
+
+	// Brand the From field of the receipts and envelopes
+	providerFrom = common.NewProviderFrom(cfg)
+
+	// Give the dates of the receipts and envelopes in the configured zone
+	timezone, err = common.LoadTimezone(cfg)
+	if err != nil {
+		return nil, err
+	}
+
 	// Create message store
-	messageStore := pec_storage.NewInMemoryStore()
+	messageStore, err := common.NewMessageStore(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create message store: %v", err)
+	}
+
+	// Open the journal, if configured
+	var journal pec_storage.Journal
+	if cfg.JournalFile != "" {
+		fileJournal, err := pec_storage.NewFileJournal(cfg.JournalFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open journal: %v", err)
+		}
+		journal = fileJournal
+	}
+
+	// Persist the accepted messages until they are processed, if configured
+	var writeAhead *common.WriteAheadLog
+	if cfg.WriteAheadDir != "" {
+		writeAhead, err = common.NewWriteAheadLog(cfg.WriteAheadDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open write-ahead log: %v", err)
+		}
+	}
 
 	return &PuntoAccessoServer{
-		config:      cfg,
-		store:       messageStore,
-		signer:      signer,
-		smtpAddress: cfg.SMTPServer,
-		imapAddress: cfg.IMAPServer,
-		certificate: cert,
-		privateKey:  key,
+		config:          cfg,
+		store:           messageStore,
+		journal:         journal,
+		signer:          signer,
+		credentials:     credentials,
+		tlsCertificates: tlsCertificates,
+		health:          common.NewHealth(messageStore, "smtp"),
+		smtpAddress:     cfg.SubmissionAddress(),
+		imapAddress:     cfg.IMAPServer,
+		certificate:     cert,
+		privateKey:      key,
+		writeAhead:      writeAhead,
+		webhook:         common.NewWebhook(cfg),
 	}, nil
 }
 
+// Use inserts steps ahead of the processing of the submitted messages, such
+// as archiving or extra validation; it is called before Start
+func (s *PuntoAccessoServer) Use(steps ...common.Step) {
+	accessPointPipeline.Use(steps...)
+}
+
 // Start starts both SMTP and IMAP servers
 func (s *PuntoAccessoServer) Start() error {
 	// Create SMTP backend
-	smtpBackend := common.NewBackend(s.signer, s.store, AccessPointHandler, s.config.Domain)
+	smtpBackend := common.NewBackend(s.signer, s.store, s.journal, AccessPointHandler, s.config.Domain)
+	smtpBackend.Certificates = s.tlsCertificates
+	smtpBackend.AllowInsecureAuth = s.config.AllowInsecureAuth
+	smtpBackend.Greeting = s.config.SMTPGreeting
+	smtpBackend.MaxLineLength = s.config.SMTPMaxLineLength
+	smtpBackend.Policy = common.PolicySubmission
+	smtpBackend.WriteAhead = s.writeAhead
+	smtpBackend.Webhook = s.webhook
+
+	// Process the messages accepted before a crash and not processed yet
+	if recovered, err := smtpBackend.RecoverWriteAhead(); err != nil {
+		logger.LogError("Failed to recover accepted messages", err, map[string]string{"dir": s.config.WriteAheadDir})
+	} else if recovered > 0 {
+		logger.LogInfo("Recovered accepted messages", map[string]string{"count": strconv.Itoa(recovered)})
+	}
+
+	// Serve the health endpoints, if configured
+	if s.config.HealthServer != "" {
+		go func() {
+			if err := common.StartHealthServer(s.config.HealthServer, s.health); err != nil {
+				logger.LogError("Health server failed", err, map[string]string{"addr": s.config.HealthServer})
+			}
+		}()
+	}
+
+	// Watch the credential files for renewals
+	s.credentials.Start()
+	if s.tlsCertificates != nil {
+		s.tlsCertificates.Start(s.credentials.Interval)
+	}
+
+	// Serve the metrics endpoint, if configured
+	if s.config.MetricsServer != "" {
+		go func() {
+			if err := metrics.StartServer(s.config.MetricsServer); err != nil {
+				logger.LogError("Metrics server failed", err, map[string]string{"addr": s.config.MetricsServer})
+			}
+		}()
+	}
 
 	// Start SMTP server (blocking)
-	return common.StartSMTP(s.smtpAddress, s.config.Domain, smtpBackend)
+	return common.StartSMTP(s.smtpAddress, s.config.Hostname(), smtpBackend, s.health)
 }
 
 // Stop gracefully shuts down all servers
 func (s *PuntoAccessoServer) Stop() error {
+	// Stop watching the credential files
+	s.credentials.Stop()
+	if s.tlsCertificates != nil {
+		s.tlsCertificates.Stop()
+	}
+
 	// Close the message store
 	if err := s.store.Close(); err != nil {
 		return fmt.Errorf("failed to close message store: %v", err)
 	}
+	// Close the journal
+	if s.journal != nil {
+		if err := s.journal.Close(); err != nil {
+			return fmt.Errorf("failed to close journal: %v", err)
+		}
+	}
+	// Wait for the webhook notifications being posted
+	s.webhook.Close()
 	return nil
 }
@@ -3,43 +3,150 @@ package main
 import (
 	"bytes"
 	"encoding/base64"
-	"encoding/xml"
 	"fmt"
-	"log"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/danzipie/go-pec/pec"
 	"github.com/danzipie/go-pec/pec-server/internal/common"
+	pec_storage "github.com/danzipie/go-pec/pec-server/internal/storage"
+	"github.com/danzipie/go-pec/pec-server/logger"
+	"github.com/danzipie/go-pec/pec-server/metrics"
 	"github.com/emersion/go-message"
 	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-smtp"
 )
 
+// ValidationCode classifies the cause of a failed validation, for reporting
+type ValidationCode string
+
+const (
+	ValidationMissingFrom        ValidationCode = "missing-from"
+	ValidationMultipleFrom       ValidationCode = "multiple-from"
+	ValidationInvalidFrom        ValidationCode = "invalid-from"
+	ValidationMissingTo          ValidationCode = "missing-to"
+	ValidationMultipleTo         ValidationCode = "multiple-to"
+	ValidationInvalidTo          ValidationCode = "invalid-to"
+	ValidationBccPresent         ValidationCode = "bcc-present"
+	ValidationSenderMismatch     ValidationCode = "sender-mismatch"
+	ValidationRecipientMismatch  ValidationCode = "recipient-mismatch"
+	ValidationInvalidReceiptType ValidationCode = "invalid-receipt-type"
+	ValidationMissingDate        ValidationCode = "missing-date"
+	ValidationInvalidDate        ValidationCode = "invalid-date"
+	ValidationMissingMessageID   ValidationCode = "missing-message-id"
+	ValidationInvalidMessageID   ValidationCode = "invalid-message-id"
+	ValidationInvalidSubject     ValidationCode = "invalid-subject"
+	ValidationVirus              ValidationCode = "virus"
+	ValidationTooManyRecipients  ValidationCode = "too-many-recipients"
+)
+
+// Errore returns the value of the daticert errore attribute for the code
+func (c ValidationCode) Errore() string {
+	if c == ValidationVirus {
+		return pec.ErroreVirus
+	}
+	return pec.ErroreAltro
+}
+
+// addressFieldCodes are the codes of the failures of the From and To fields
+var addressFieldCodes = map[string]struct{ missing, multiple, invalid ValidationCode }{
+	"From": {ValidationMissingFrom, ValidationMultipleFrom, ValidationInvalidFrom},
+	"To":   {ValidationMissingTo, ValidationMultipleTo, ValidationInvalidTo},
+}
+
 // ValidationError represents a failed validation with a clear reason.
+// Reason is the human-readable message, Code the cause it falls under.
 type ValidationError struct {
+	Code        ValidationCode
 	Reason      string
 	MessageID   string
 	From        string
 	To          []string
 	Subject     string
 	GeneratedAt time.Time
+	// Identificativo of the non-acceptance receipt, derived from MessageID
+	// when empty
+	Identificativo string
 }
 
 func (e ValidationError) Error() string {
 	return fmt.Sprintf("validation failed: %s", e.Reason)
 }
 
+// SMTPStatus implements common.SMTPStatus: the message is refused for good,
+// since sending it again would fail the same validation
+func (e ValidationError) SMTPStatus() (int, smtp.EnhancedCode) {
+	return 550, smtp.EnhancedCode{5, 7, 1}
+}
+
+// duplicates detects retried messages; nil disables the check
+var duplicates common.DuplicateDetector
+
+// receiptTemplates renders the human-readable bodies of the receipts
+var receiptTemplates = common.DefaultReceiptTemplates()
+
+// providerFrom composes the From field of the receipts and envelopes
+var providerFrom common.ProviderFrom
+
+// receiptSigningMode is the S/MIME structure the receipts are signed into
+var receiptSigningMode = common.SigningDetached
+
+// timezone is the zone the dates of the receipts and envelopes are given in
+var timezone = common.DefaultLocation
+
+// clock returns the current time; tests replace it
+var clock = time.Now
+
+// receiptTime returns the current time in the zone the dates of the receipts
+// and envelopes are given in, whatever the zone of the host
+func receiptTime() time.Time {
+	return clock().In(timezone)
+}
+
+// ErrSignerUnavailable is returned when the session has no signer; it is a
+// temporary failure so that the client retries instead of losing the message
+var ErrSignerUnavailable = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+	Message:      "Signing service unavailable, try again later",
+}
+
+// accessPointPipeline processes the messages submitted to the access point:
+// the message is validated, then accepted. Deployments insert their own
+// steps with PuntoAccessoServer.Use.
+var accessPointPipeline = common.NewPipeline(validationStep, acceptanceStep)
+
+// AccessPointHandler processes a message submitted to the access point
 func AccessPointHandler(s *common.Session) error {
+	return accessPointPipeline.Handle(s)
+}
+
+// validationStep refuses a message that cannot be signed, and a message
+// failing the validation or the content scan with a non-acceptance receipt
+func validationStep(s *common.Session, next func(*common.Session) error) error {
+	// Every outcome is signed: refuse the message before doing any work
+	signer := s.GetSigner()
+	if signer == nil {
+		logger.LogError("No signer available", ErrSignerUnavailable, s.LogContext())
+		return ErrSignerUnavailable
+	}
 
 	// Parse the email and log the header and body
 	header, body, err := common.ParseEmailFromSession(*s)
 	if err != nil {
 		return err
 	}
-	log.Println("Parsed Email Header:", header)
-	log.Println("Parsed Email Body:", string(body))
+	messageID := header.Get("Message-ID")
+	ctx := s.LogContext()
+	ctx["message_id"] = messageID
+	ctx["body_size"] = strconv.Itoa(len(body))
+	logger.LogDebug("Parsed email", ctx)
+	s.Record(pec_storage.JournalEntry{Event: pec_storage.EventReceived, MessageID: messageID})
+	metrics.MessagesReceived.Inc()
 	data, err := s.GetData()
 	if err != nil {
-		log.Println("No data in session, skipping processing")
+		logger.LogInfo("No data in session, skipping processing", s.LogContext())
 		return nil
 	}
 	r := bytes.NewReader(data)
@@ -47,98 +154,222 @@ func AccessPointHandler(s *common.Session) error {
 	if err != nil {
 		return err
 	}
-	if err := ValidateEnvelopeAndHeaders(s.From, s.To, mr); err != nil {
+	err = ValidateEnvelopeAndHeaders(s.From, s.To, mr)
+	if err == nil {
+		err = scanContent(data)
+	}
+	if err != nil {
 		if valErr, ok := err.(ValidationError); ok {
-			log.Println("Validation Error:", valErr)
-			signer := s.GetSigner()
-			if signer == nil {
-				return fmt.Errorf("no signer available for non-acceptance email")
-			}
-			// emit message of non-acceptance
-			nonAcceptanceMsg, err := GenerateNonAcceptanceEmail("localhost", valErr, signer)
-			if err != nil {
-				return err
-			}
-
-			// Store the non-acceptance message in the IMAP store
-			if s.Store != nil {
-				msg := common.ConvertToIMAPMessage(nonAcceptanceMsg)
-				log.Printf("Storing non-acceptance message in mailbox: %s", s.From)
-				if err := s.Store.AddMessage(s.From, msg); err != nil {
-					return err
-				}
-				// Debug: check stored messages
-				if msgs, err := s.Store.GetMessages(s.From); err == nil {
-					log.Printf("Messages in %s's mailbox: %d", s.From, len(msgs))
-				}
+			if nErr := rejectMessage(s, header, messageID, valErr); nErr != nil {
+				return nErr
 			}
 		}
 		return err
-	} else {
-		log.Println("Envelope and headers validation passed")
-		if s.Store != nil {
-			data, dErr := s.GetData()
-			if dErr != nil {
-				log.Println("No data in session, skipping processing")
-				return nil
-			}
-			_, err := ProcessPECMessage(data)
-			if err != nil {
-				log.Printf("Error creating PEC envelope: %v", err)
-				return err
-			}
-			// Create a body section for the full message
-			/**
-			section := &imap.BodySectionName{}
-			literal := bytes.NewBuffer(s.data.Bytes())
-
-			msg := &imap.Message{
-				Envelope: &imap.Envelope{
-					Date:    time.Now(),
-					Subject: header.Get("Subject"),
-					From:    []*imap.Address{{HostName: s.from}},
-					To:      []*imap.Address{{HostName: s.to[0]}},
-				},
-				Body: map[*imap.BodySectionName]imap.Literal{
-					section: literal,
-				},
-				Flags:        []string{imap.SeenFlag},
-				InternalDate: time.Now(),
-				Size:         uint32(s.data.Len()),
-				Uid:          uint32(time.Now().Unix()),
-			}
-			log.Printf("Storing message in mailbox: %s", s.to[0])
-			if err := s.store.AddMessage(s.to[0], msg); err != nil {
-				return err
-			}
-			// Debug: check stored messages
-			if msgs, err := s.store.GetMessages(s.to[0]); err == nil {
-				log.Printf("Messages in %s's mailbox: %d", s.to[0], len(msgs))
-			}
-				**/
+	}
+	logger.LogInfo("Envelope and headers validation passed", ctx)
+	return next(s)
+}
+
+// acceptanceStep accepts a validated message, once: it emits the acceptance
+// receipt and forwards the transport envelope
+func acceptanceStep(s *common.Session, next func(*common.Session) error) error {
+	data, err := s.GetData()
+	if err != nil {
+		return err
+	}
+	mr, err := mail.CreateReader(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	header := &mr.Header
+	messageID := header.Get("Message-ID")
+	ctx := s.LogContext()
+	ctx["message_id"] = messageID
+
+	// A retried message was already accepted: succeed without processing it again
+	key := common.MessageKey(s.From, messageID, data)
+	if duplicates != nil && duplicates.Seen(key) {
+		logger.LogInfo("Duplicate message, already accepted", ctx)
+		s.Record(pec_storage.JournalEntry{Event: pec_storage.EventDuplicate, MessageID: messageID})
+		return nil
+	}
+	s.Record(pec_storage.JournalEntry{Event: pec_storage.EventAccepted, MessageID: messageID})
+	metrics.MessagesAccepted.Inc()
+
+	if err := acceptMessage(s, s.GetSigner(), header, messageID, data); err != nil {
+		// Let the retry of the client be processed
+		if duplicates != nil {
+			duplicates.Forget(key)
 		}
+		return err
+	}
+	return next(s)
+}
+
+// scanContent runs the content scanner on the raw message. Infected messages
+// are reported as a ValidationError carrying the scan reason.
+func scanContent(data []byte) error {
+	clean, reason, err := contentScanner.Scan(data)
+	if err != nil {
+		return fmt.Errorf("content scan failed: %v", err)
+	}
+	if !clean {
+		return ValidationError{Code: ValidationVirus, Reason: reason}
 	}
 	return nil
 }
 
+// rejectMessage records the non-acceptance of a message and stores the
+// non-acceptance receipt in the sender's mailbox. The receipt reports the
+// header fields of the message, or the SMTP envelope for those that cannot
+// be parsed.
+func rejectMessage(s *common.Session, header *mail.Header, messageID string, valErr ValidationError) error {
+	valErr.MessageID = messageID
+	valErr.From, valErr.To = s.From, s.To
+	if addrs, err := header.AddressList("From"); err == nil && len(addrs) == 1 {
+		valErr.From = addrs[0].Address
+	}
+	if to, cc := common.SplitRecipients(header); len(to) > 0 {
+		valErr.To = append(to, cc...)
+	}
+	valErr.Subject, _ = header.Subject()
+	valErr.GeneratedAt = clock()
+	valErr.Identificativo = common.ReceiptIdentifier(pec.TipoNonAccettazione, messageID, s.Domain)
+
+	logger.LogNonAcceptance(s.From, s.To, messageID, valErr.Reason)
+	metrics.MessagesRejected.Inc()
+	s.Record(pec_storage.JournalEntry{
+		Event:     pec_storage.EventNonAccepted,
+		MessageID: messageID,
+		Outcome:   pec_storage.OutcomeFailure,
+		Detail:    valErr.Reason,
+	})
+	signer := s.GetSigner()
+	if signer == nil {
+		return fmt.Errorf("no signer available for non-acceptance email")
+	}
+	// emit message of non-acceptance
+	nonAcceptanceMsg, err := GenerateNonAcceptanceEmail(s.Domain, valErr, signer)
+	if err != nil {
+		return err
+	}
+	return deliverReceipt(s, messageID, valErr.Identificativo, nonAcceptanceMsg)
+}
+
+// deliverReceipt stores the receipt identificativo in the sender's mailbox
+// and journals it
+func deliverReceipt(s *common.Session, messageID, identificativo string, receipt *message.Entity) error {
+	var err error
+	if s.Store != nil {
+		ctx := s.LogContext()
+		ctx["message_id"] = messageID
+		ctx["receipt"] = receipt.Header.Get("X-Ricevuta")
+		logger.LogInfo("Storing receipt in mailbox", ctx)
+		err = s.Store.AddMessage(s.From, common.ConvertToIMAPMessage(receipt))
+	}
+	entry := common.ResultEntry(pec_storage.EventReceiptEmitted, messageID, err)
+	entry.Identificativo = identificativo
+	s.Record(entry)
+	return err
+}
+
+// ErrForwardFailed is returned when the transport envelope cannot be handed
+// over to the reception point; it is a temporary failure so that the client
+// retries
+var ErrForwardFailed = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 4, 0},
+	Message:      "Unable to forward the message, try again later",
+}
+
+// acceptMessage wraps an accepted message in a transport envelope, forwards it
+// to the reception point and delivers the acceptance receipt to the sender
+func acceptMessage(s *common.Session, signer *common.Signer, header *mail.Header, messageID string, data []byte) error {
+	ctx := s.LogContext()
+	ctx["message_id"] = messageID
+
+	envelope, err := ProcessPECMessage(signer, data)
+	s.RecordResult(pec_storage.EventTransportEnvelopeCreated, messageID, err)
+	if err != nil {
+		logger.LogError("Error creating PEC envelope", err, ctx)
+		return err
+	}
+
+	err = ForwardEnvelope(s.From, s.To, envelope)
+	s.RecordResult(pec_storage.EventForwarded, messageID, err)
+	if err != nil {
+		logger.LogError("Failed to forward the transport envelope", err, ctx)
+		return ErrForwardFailed
+	}
+
+	// The receipt reports the validated header fields of the message
+	from, to := s.From, s.To
+	var cc []string
+	if addrs, err := header.AddressList("From"); err == nil && len(addrs) == 1 {
+		from = addrs[0].Address
+	}
+	if headerTo, headerCc := common.SplitRecipients(header); len(headerTo) > 0 {
+		to, cc = headerTo, headerCc
+	}
+	subject, _ := header.Subject()
+	receipt, err := GenerateAcceptanceEmail(s.Domain, messageID, from, to, cc, subject, signer)
+	if err != nil {
+		return fmt.Errorf("failed to generate acceptance receipt: %v", err)
+	}
+	return deliverReceipt(s, messageID, common.ReceiptIdentifier(pec.TipoAccettazione, messageID, s.Domain), receipt)
+}
+
+// receiptTypes are the values of X-TipoRicevuta a sender may request
+var receiptTypes = map[string]bool{
+	"completa":  true,
+	"breve":     true,
+	"sintetica": true,
+}
+
+// strictHeaders enables validateStrictHeaders in ValidateEnvelopeAndHeaders
+var strictHeaders bool
+
+// defaultMaxRecipients is the number of recipients, counting To and Cc, a
+// message may be addressed to when the configuration sets no limit
+const defaultMaxRecipients = 500
+
+// maxRecipients bounds the recipients of a message in ValidateEnvelopeAndHeaders
+var maxRecipients = defaultMaxRecipients
+
 // ValidateEnvelopeAndHeaders checks compliance between SMTP envelope and RFC822 headers.
 func ValidateEnvelopeAndHeaders(
 	smtpFrom string,
 	smtpRecipients []string,
 	msg *mail.Reader,
 ) error {
-	// 1. Parse From header
 	header := msg.Header
+
+	// 0. Check the RFC 5322 fields, in strict mode
+	if strictHeaders {
+		if err := validateStrictHeaders(header); err != nil {
+			return err
+		}
+	}
+
+	// 1. Parse From header
 	fromAddrs, err := header.AddressList("From")
 	if err != nil || len(fromAddrs) != 1 {
-		return ValidationError{Reason: "invalid or missing 'From' field"}
+		code := ValidationInvalidFrom
+		if len(fromAddrs) == 0 && err == nil {
+			code = ValidationMissingFrom
+		}
+		return ValidationError{Code: code, Reason: "invalid or missing 'From' field"}
 	}
 	fromHeader := fromAddrs[0].Address
 
 	// 2. Parse To header
 	toAddrs, err := header.AddressList("To")
 	if err != nil || len(toAddrs) == 0 {
-		return ValidationError{Reason: "missing or invalid 'To' field"}
+		code := ValidationInvalidTo
+		if len(toAddrs) == 0 && err == nil {
+			code = ValidationMissingTo
+		}
+		return ValidationError{Code: code, Reason: "missing or invalid 'To' field"}
 	}
 
 	// 3. Parse Cc header (optional)
@@ -147,17 +378,22 @@ func ValidateEnvelopeAndHeaders(
 		ccAddrs = ccList
 	}
 
-	// 4. Check Bcc (must not be present with valid addresses)
+	// 4. Limit the recipients, each of which gets a delivery receipt
+	if n := len(toAddrs) + len(ccAddrs); n > maxRecipients {
+		return ValidationError{Code: ValidationTooManyRecipients, Reason: fmt.Sprintf("%d recipients in 'To' and 'Cc' fields exceed the limit of %d", n, maxRecipients)}
+	}
+
+	// 5. Check Bcc (must not be present with valid addresses)
 	if bccList, err := header.AddressList("Bcc"); err == nil && len(bccList) > 0 {
-		return ValidationError{Reason: "'Bcc' field must not be present"}
+		return ValidationError{Code: ValidationBccPresent, Reason: "'Bcc' field must not be present"}
 	}
 
-	// 5. Validate reverse-path == From
+	// 6. Validate reverse-path == From
 	if !strings.EqualFold(smtpFrom, fromHeader) {
-		return ValidationError{Reason: fmt.Sprintf("reverse-path '%s' does not match From header '%s'", smtpFrom, fromHeader)}
+		return ValidationError{Code: ValidationSenderMismatch, Reason: fmt.Sprintf("reverse-path '%s' does not match From header '%s'", smtpFrom, fromHeader)}
 	}
 
-	// 6. Collect all valid recipient addresses from To and Cc
+	// 7. Collect all valid recipient addresses from To and Cc
 	validRecipients := make(map[string]bool)
 	for _, a := range toAddrs {
 		validRecipients[strings.ToLower(a.Address)] = true
@@ -166,25 +402,67 @@ func ValidateEnvelopeAndHeaders(
 		validRecipients[strings.ToLower(a.Address)] = true
 	}
 
-	// 7. Validate all forward-path recipients are in To/Cc
+	// 8. Validate all forward-path recipients are in To/Cc
 	for _, rcpt := range smtpRecipients {
 		if !validRecipients[strings.ToLower(rcpt)] {
-			return ValidationError{Reason: fmt.Sprintf("recipient '%s' not found in 'To' or 'Cc' fields", rcpt)}
+			return ValidationError{Code: ValidationRecipientMismatch, Reason: fmt.Sprintf("recipient '%s' not found in 'To' or 'Cc' fields", rcpt)}
+		}
+	}
+
+	// 9. Validate the requested receipt type, if any
+	if tipo := header.Get("X-TipoRicevuta"); tipo != "" && !receiptTypes[strings.ToLower(strings.TrimSpace(tipo))] {
+		return ValidationError{Code: ValidationInvalidReceiptType, Reason: fmt.Sprintf("invalid 'X-TipoRicevuta' value '%s'", tipo)}
+	}
+
+	return nil
+}
+
+// validateStrictHeaders checks the presence and well-formedness of the
+// RFC 5322 fields a PEC message must carry
+func validateStrictHeaders(header mail.Header) error {
+	if !header.Has("Date") {
+		return ValidationError{Code: ValidationMissingDate, Reason: "missing 'Date' field"}
+	}
+	if _, err := header.Date(); err != nil {
+		return ValidationError{Code: ValidationInvalidDate, Reason: fmt.Sprintf("malformed 'Date' field '%s'", header.Get("Date"))}
+	}
+
+	messageID := header.Get("Message-ID")
+	if messageID == "" {
+		return ValidationError{Code: ValidationMissingMessageID, Reason: "missing 'Message-ID' field"}
+	}
+	if !wellFormedMessageID(messageID) {
+		return ValidationError{Code: ValidationInvalidMessageID, Reason: fmt.Sprintf("malformed 'Message-ID' field '%s'", messageID)}
+	}
+
+	for _, field := range []string{"From", "To"} {
+		codes := addressFieldCodes[field]
+		values := header.Values(field)
+		switch {
+		case len(values) == 0:
+			return ValidationError{Code: codes.missing, Reason: fmt.Sprintf("missing '%s' field", field)}
+		case len(values) > 1:
+			return ValidationError{Code: codes.multiple, Reason: fmt.Sprintf("multiple '%s' fields", field)}
+		}
+		if _, err := header.AddressList(field); err != nil {
+			return ValidationError{Code: codes.invalid, Reason: fmt.Sprintf("malformed '%s' field '%s'", field, values[0])}
 		}
 	}
 
+	if _, err := header.Subject(); err != nil {
+		return ValidationError{Code: ValidationInvalidSubject, Reason: "undecodable 'Subject' field"}
+	}
 	return nil
 }
 
-// daticert.xml structure (simplified)
-type DatiCert struct {
-	XMLName     xml.Name `xml:"daticert"`
-	MessageID   string   `xml:"message-id"`
-	Subject     string   `xml:"subject"`
-	From        string   `xml:"from"`
-	To          []string `xml:"to>address"`
-	Reason      string   `xml:"reason"`
-	GeneratedAt string   `xml:"timestamp"`
+// wellFormedMessageID reports whether id is an angle-bracketed left@right
+func wellFormedMessageID(id string) bool {
+	id = strings.TrimSpace(id)
+	if len(id) < 2 || id[0] != '<' || id[len(id)-1] != '>' {
+		return false
+	}
+	left, right, ok := strings.Cut(id[1:len(id)-1], "@")
+	return ok && left != "" && right != "" && !strings.ContainsAny(id[1:len(id)-1], " \t<>")
 }
 
 // GenerateNonAcceptanceEmail creates an email message informing of non-acceptance with daticert.xml attached
@@ -193,62 +471,71 @@ func GenerateNonAcceptanceEmail(
 	validationError ValidationError,
 	signer *common.Signer,
 ) (*message.Entity, error) {
+	validationError.Subject = common.SubjectText(validationError.Subject)
+	if validationError.GeneratedAt.IsZero() {
+		validationError.GeneratedAt = clock()
+	}
+	validationError.GeneratedAt = validationError.GeneratedAt.In(timezone)
 
 	// Part 1: human-readable explanation
-	textBody := new(bytes.Buffer)
-	fmt.Fprintf(textBody, "Errore nell’accettazione del messaggio\n")
-	fmt.Fprintf(textBody, "Il giorno %s alle ore %s (%s) nel messaggio\n",
-		validationError.GeneratedAt.Format("02/01/2006"),
-		validationError.GeneratedAt.Format("15:04:05"),
-		validationError.GeneratedAt.Format("MST"))
-	fmt.Fprintf(textBody, "\"%s\" proveniente da \"%s\"\n", validationError.Subject, validationError.From)
-	fmt.Fprintf(textBody, "ed indirizzato a:\n")
-	for _, rcpt := range validationError.To {
-		fmt.Fprintf(textBody, "%s\n", rcpt)
-	}
-	fmt.Fprintf(textBody, "è stato rilevato un problema che ne impedisce l’accettazione\na causa di %s.\nIl messaggio non è stato accettato.\n", validationError.Reason)
-	fmt.Fprintf(textBody, "Identificativo messaggio: %s\n", validationError.MessageID)
+	data := common.ReceiptData{
+		Date:      validationError.GeneratedAt,
+		Subject:   validationError.Subject,
+		From:      validationError.From,
+		To:        validationError.To,
+		MessageID: validationError.MessageID,
+		Reason:    validationError.Reason,
+	}
+	textBody, err := receiptTemplates.Text(pec.TipoNonAccettazione, data)
+	if err != nil {
+		return nil, err
+	}
 
 	textHeader := message.Header{}
 	textHeader.Set("Content-Type", "text/plain; charset=utf-8")
-	textPart, err := message.New(textHeader, bytes.NewReader(textBody.Bytes()))
+	textPart, err := message.New(textHeader, strings.NewReader(textBody))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create text part: %v", err)
 	}
 
 	// Part 2: daticert.xml attachment
-	xmlData := DatiCert{
-		MessageID:   validationError.MessageID,
-		Subject:     validationError.Subject,
-		From:        validationError.From,
-		To:          validationError.To,
-		Reason:      validationError.Reason,
-		GeneratedAt: validationError.GeneratedAt.Format(time.RFC3339),
-	}
-	xmlBytes, _ := xml.MarshalIndent(xmlData, "", "  ")
-	var xmlB64 bytes.Buffer
-	b64Encoder := base64.NewEncoder(base64.StdEncoding, &xmlB64)
-	b64Encoder.Write(xmlBytes)
-	b64Encoder.Close()
+	xmlData := pec.NewDatiCert(pec.TipoNonAccettazione, validationError.Code.Errore(), common.ProviderName(domain), validationError.GeneratedAt)
+	xmlData.Intestazione.Mittente = validationError.From
+	xmlData.AddDestinatari("certificato", validationError.To...)
+	xmlData.Intestazione.Risposte = validationError.From
+	xmlData.Intestazione.Oggetto = validationError.Subject
+	xmlData.Dati.Identificativo = validationError.Identificativo
+	if xmlData.Dati.Identificativo == "" {
+		xmlData.Dati.Identificativo = common.ReceiptIdentifier(pec.TipoNonAccettazione, validationError.MessageID, domain)
+	}
+	xmlData.Dati.MsgID = validationError.MessageID
+	xmlData.Dati.ErroreEsteso = validationError.Reason
+	xmlBytes, err := xmlData.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	xmlB64 := common.FormatBase64(base64.StdEncoding.EncodeToString(xmlBytes), common.Base64LineLength)
 
 	xmlHeader := message.Header{}
 	xmlHeader.Set("Content-Type", "application/xml")
 	xmlHeader.Set("Content-Disposition", "attachment; filename=\"daticert.xml\"")
 	xmlHeader.Set("Content-Transfer-Encoding", "base64")
-	xmlPart, err := message.New(xmlHeader, bytes.NewReader(xmlB64.Bytes()))
+	xmlPart, err := message.New(xmlHeader, strings.NewReader(xmlB64))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create xml part: %v", err)
 	}
 
-	// Part 1b: human-readable explanation (HTML, reusing textBody)
-	htmlBody := new(bytes.Buffer)
-	fmt.Fprintf(htmlBody, "<html><body><pre>%s</pre></body></html>", textBody.String())
+	// Part 1b: human-readable explanation (HTML)
+	htmlBody, err := receiptTemplates.HTML(pec.TipoNonAccettazione, data)
+	if err != nil {
+		return nil, err
+	}
 
 	htmlHeader := message.Header{}
 	htmlHeader.Set("Content-Type", "text/html; charset=utf-8")
 	htmlHeader.Set("Content-Disposition", "inline")
 	htmlHeader.Set("Content-Transfer-Encoding", "quoted-printable")
-	htmlPart, err := message.New(htmlHeader, bytes.NewReader(htmlBody.Bytes()))
+	htmlPart, err := message.New(htmlHeader, strings.NewReader(htmlBody))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create html part: %v", err)
 	}
@@ -279,7 +566,7 @@ func GenerateNonAcceptanceEmail(
 	}
 
 	// Part 3: S/MIME signature
-	signedEmail, err := signer.CreateSignedMimeMessageEntity(body.Bytes())
+	signedEmail, err := signer.CreateSignedMimeMessageEntityMode(body.Bytes(), receiptSigningMode)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create signed email: %v", err)
 	}
@@ -287,142 +574,85 @@ func GenerateNonAcceptanceEmail(
 	// Create main headers
 	signedEmail.Header.Set("X-Ricevuta", "non-accettazione")
 	signedEmail.Header.Set("Date", validationError.GeneratedAt.Format(time.RFC1123Z))
-	signedEmail.Header.Set("Subject", fmt.Sprintf("AVVISO DI NON ACCETTAZIONE: %s", validationError.Subject))
-	signedEmail.Header.Set("From", fmt.Sprintf("posta-certificata@%s", domain))
-	signedEmail.Header.Set("To", validationError.From)
-	signedEmail.Header.Set("X-Riferimento-Message-ID", validationError.MessageID)
+	signedEmail.Header.Set("Subject", common.EncodeHeaderText(fmt.Sprintf("AVVISO DI NON ACCETTAZIONE: %s", validationError.Subject)))
+	signedEmail.Header.Set("From", common.FormatAddress(providerFrom.Address(domain)))
+	signedEmail.Header.Set("To", common.EncodeAddressList(validationError.From))
+	common.SetReferenceHeaders(&signedEmail.Header, validationError.MessageID)
 
 	return signedEmail, nil
 }
 
-// GenerateAcceptanceEmail creates an email message confirming acceptance with daticert.xml attached
+// GenerateAcceptanceEmail creates an email message confirming acceptance with daticert.xml attached.
+// The primary recipients in to and the recipients in copy in cc are listed apart.
 func GenerateAcceptanceEmail(
 	domain string,
 	messageID string,
 	from string,
 	to []string,
+	cc []string,
 	subject string,
 	signer *common.Signer,
 ) (*message.Entity, error) {
-	now := time.Now()
+	now := receiptTime()
+	subject = common.SubjectText(subject)
+
+	// The identificativo is derived from the message, so that a message
+	// processed again after a failure gets the same receipt
+	generatedMessageID := common.ReceiptIdentifier(pec.TipoAccettazione, messageID, domain)
 
 	// Part 1: human-readable explanation
-	textBody := new(bytes.Buffer)
-	fmt.Fprintf(textBody, "-- Ricevuta di accettazione del messaggio indirizzato a %s (\"posta certificata\") --\n\n", strings.Join(to, ", "))
-	fmt.Fprintf(textBody, "Il giorno %s alle ore %s (%s) il messaggio con Oggetto\n",
-		now.Format("02/01/2006"),
-		now.Format("15:04:05"),
-		now.Format("-0700"))
-	fmt.Fprintf(textBody, "\"%s\" inviato da \"%s\"\n", subject, from)
-	fmt.Fprintf(textBody, "ed indirizzato a:\n")
-	for _, rcpt := range to {
-		fmt.Fprintf(textBody, "%s (\"posta certificata\")\n", rcpt)
-	}
-	fmt.Fprintf(textBody, "è stato accettato dal sistema ed inoltrato.\n")
-	generatedMessageID := fmt.Sprintf("opec%s.%s@%s",
-		now.Format("210312"),
-		now.Format("20060102150405.000000.000.1.53"),
-		domain)
-	fmt.Fprintf(textBody, "Identificativo del messaggio: %s\n", generatedMessageID)
-	fmt.Fprintf(textBody, "L'allegato daticert.xml contiene informazioni di servizio sulla trasmissione\n")
+	data := common.ReceiptData{
+		Date:           now,
+		Subject:        subject,
+		From:           from,
+		To:             to,
+		Cc:             cc,
+		MessageID:      messageID,
+		Identificativo: generatedMessageID,
+	}
+	textBody, err := receiptTemplates.Text(pec.TipoAccettazione, data)
+	if err != nil {
+		return nil, err
+	}
 
 	textHeader := message.Header{}
 	textHeader.Set("Content-Type", "text/plain; charset=utf-8")
 	textHeader.Set("Content-Disposition", "inline")
 	textHeader.Set("Content-Transfer-Encoding", "quoted-printable")
-	textPart, err := message.New(textHeader, bytes.NewReader(textBody.Bytes()))
+	textPart, err := message.New(textHeader, strings.NewReader(textBody))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create text part: %v", err)
 	}
 
 	// Part 2: daticert.xml attachment
-	type postaCert struct {
-		XMLName      xml.Name `xml:"postacert"`
-		Tipo         string   `xml:"tipo,attr"`
-		Errore       string   `xml:"errore,attr"`
-		Intestazione struct {
-			Mittente    string `xml:"mittente"`
-			Destinatari struct {
-				Tipo string `xml:"tipo,attr"`
-				Val  string `xml:",chardata"`
-			} `xml:"destinatari"`
-			Risposte string `xml:"risposte"`
-			Oggetto  string `xml:"oggetto"`
-		} `xml:"intestazione"`
-		Dati struct {
-			GestoreEmittente string `xml:"gestore-emittente"`
-			Data             struct {
-				Zona   string `xml:"zona,attr"`
-				Giorno string `xml:"giorno"`
-				Ora    string `xml:"ora"`
-			} `xml:"data"`
-			Identificativo string `xml:"identificativo"`
-			MsgID          string `xml:"msgid"`
-		} `xml:"dati"`
-	}
-
-	xmlData := postaCert{
-		Tipo:   "accettazione",
-		Errore: "nessuno",
-	}
-	xmlData.Intestazione.Mittente = from
-	xmlData.Intestazione.Destinatari.Tipo = "certificato"
-	xmlData.Intestazione.Destinatari.Val = strings.Join(to, ", ")
-	xmlData.Intestazione.Risposte = from
-	xmlData.Intestazione.Oggetto = subject
-	xmlData.Dati.GestoreEmittente = fmt.Sprintf("%s PEC S.p.A.", strings.ToUpper(domain))
-	xmlData.Dati.Data.Zona = now.Format("-0700")
-	xmlData.Dati.Data.Giorno = now.Format("02/01/2006")
-	xmlData.Dati.Data.Ora = now.Format("15:04:05")
-	xmlData.Dati.Identificativo = generatedMessageID
-	xmlData.Dati.MsgID = messageID
-
-	xmlBytes, err := xml.MarshalIndent(xmlData, "", "  ")
+	xmlData := common.NewAcceptanceDatiCert(domain, messageID, from, to, cc, subject, now)
+	xmlBytes, err := xmlData.Marshal()
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal XML: %v", err)
+		return nil, err
 	}
 
-	// Add XML declaration
-	xmlWithHeader := []byte(xml.Header + string(xmlBytes))
-
-	var xmlB64 bytes.Buffer
-	b64Encoder := base64.NewEncoder(base64.StdEncoding, &xmlB64)
-	b64Encoder.Write(xmlWithHeader)
-	b64Encoder.Close()
+	xmlB64 := common.FormatBase64(base64.StdEncoding.EncodeToString(xmlBytes), common.Base64LineLength)
 
 	xmlHeader := message.Header{}
 	xmlHeader.Set("Content-Type", "application/xml; name=\"daticert.xml\"")
 	xmlHeader.Set("Content-Disposition", "inline; filename=\"daticert.xml\"")
 	xmlHeader.Set("Content-Transfer-Encoding", "base64")
-	xmlPart, err := message.New(xmlHeader, bytes.NewReader(xmlB64.Bytes()))
+	xmlPart, err := message.New(xmlHeader, strings.NewReader(xmlB64))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create xml part: %v", err)
 	}
 
 	// Part 1b: human-readable explanation (HTML)
-	htmlBody := new(bytes.Buffer)
-	fmt.Fprintf(htmlBody, "<html>\n<head><title>Ricevuta di accettazione</title></head>\n<body>\n")
-	fmt.Fprintf(htmlBody, "<h3>Ricevuta di accettazione</h3>\n")
-	fmt.Fprintf(htmlBody, "<hr><br>\n")
-	fmt.Fprintf(htmlBody, "Il giorno %s alle ore %s (%s) il messaggio<br>\n",
-		now.Format("02/01/2006"),
-		now.Format("15:04:05"),
-		now.Format("-0700"))
-	fmt.Fprintf(htmlBody, "&quot;%s&quot; proveniente da &quot;%s&quot;<br>\n", subject, from)
-	fmt.Fprintf(htmlBody, "ed indirizzato a:<br>\n")
-	for _, rcpt := range to {
-		fmt.Fprintf(htmlBody, "%s (&quot;posta certificata&quot;)<br>\n", rcpt)
-	}
-	fmt.Fprintf(htmlBody, "<br><br>\n")
-	fmt.Fprintf(htmlBody, "Il messaggio &egrave; stato accettato dal sistema ed inoltrato.<br>\n")
-	fmt.Fprintf(htmlBody, "Identificativo messaggio: %s<br>\n", generatedMessageID)
-	fmt.Fprintf(htmlBody, "</body>\n</html>\n")
+	htmlBody, err := receiptTemplates.HTML(pec.TipoAccettazione, data)
+	if err != nil {
+		return nil, err
+	}
 
 	htmlHeader := message.Header{}
 	htmlHeader.Set("Content-Type", "text/html; charset=utf-8")
 	htmlHeader.Set("Content-Disposition", "inline")
 	htmlHeader.Set("Content-Transfer-Encoding", "quoted-printable")
-	htmlPart, err := message.New(htmlHeader, bytes.NewReader(htmlBody.Bytes()))
+	htmlPart, err := message.New(htmlHeader, strings.NewReader(htmlBody))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create html part: %v", err)
 	}
@@ -453,7 +683,7 @@ func GenerateAcceptanceEmail(
 	}
 
 	// Part 3: S/MIME signature
-	signedEmail, err := signer.CreateSignedMimeMessageEntity(body.Bytes())
+	signedEmail, err := signer.CreateSignedMimeMessageEntityMode(body.Bytes(), receiptSigningMode)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create signed email: %v", err)
 	}
@@ -461,221 +691,15 @@ func GenerateAcceptanceEmail(
 	// Create main headers
 	signedEmail.Header.Set("X-Ricevuta", "accettazione")
 	signedEmail.Header.Set("Date", now.Format(time.RFC1123Z))
-	signedEmail.Header.Set("Subject", fmt.Sprintf("ACCETTAZIONE: %s", subject))
-	signedEmail.Header.Set("From", fmt.Sprintf("posta-certificata@%s", domain))
-	signedEmail.Header.Set("To", from)
-	signedEmail.Header.Set("X-Riferimento-Message-ID", messageID)
+	signedEmail.Header.Set("Subject", common.EncodeHeaderText(fmt.Sprintf("ACCETTAZIONE: %s", subject)))
+	signedEmail.Header.Set("From", common.FormatAddress(providerFrom.Address(domain)))
+	signedEmail.Header.Set("To", common.EncodeAddressList(from))
+	common.SetReferenceHeaders(&signedEmail.Header, messageID)
 
 	return signedEmail, nil
 }
 
-// PECTransportEnvelope represents the PEC transport envelope
-type PECTransportEnvelope struct {
-	Headers map[string]string
-	Body    string
-	XMLData string // XML attachment data
-}
-
-// PECCertificationData contains the certification information
-type PECCertificationData struct {
-	MessageID       string
-	OriginalSubject string
-	OriginalFrom    string
-	Recipients      []string
-	Date            time.Time
-	Timezone        string
-}
-
-// CreatePECTransportEnvelope creates a PEC transport envelope from the original message
-func CreatePECTransportEnvelope(originalMsg *mail.Header, certData PECCertificationData) (*PECTransportEnvelope, error) {
-	envelope := &PECTransportEnvelope{
-		Headers: make(map[string]string),
-	}
-
-	// Inherit unchanged headers from original message
-	inheritedHeaders := []string{
-		"Received",
-		"To",
-		"Cc",
-		"Return-Path",
-		"Message-ID",
-		"X-Riferimento-Message-ID",
-		"X-TipoRicevuta",
-	}
-
-	for _, header := range inheritedHeaders {
-		if value := originalMsg.Header.Get(header); value != "" {
-			envelope.Headers[header] = value
-		}
-	}
-
-	// Set/modify required headers
-	envelope.Headers["X-Trasporto"] = "posta-certificata"
-	envelope.Headers["Date"] = certData.Date.Format(time.RFC1123Z)
-	envelope.Headers["Subject"] = fmt.Sprintf("POSTA CERTIFICATA: %s", certData.OriginalSubject)
-	envelope.Headers["From"] = fmt.Sprintf("Per conto di: %s", certData.OriginalFrom)
-
-	// Add Reply-To if not present in original
-	if originalMsg.Header.Get("Reply-To") == "" {
-		envelope.Headers["Reply-To"] = certData.OriginalFrom
-	}
-
-	// Create the body text
-	envelope.Body = createPECBodyText(certData)
-
-	// Generate XML certification data
-	envelope.XMLData = createPECXMLData(certData)
-
-	return envelope, nil
-}
-
-// createPECBodyText creates the human-readable body text for the PEC envelope
-func createPECBodyText(certData PECCertificationData) string {
-	// Format date and time
-	dateStr := certData.Date.Format("02/01/2006")
-	timeStr := certData.Date.Format("15:04:05")
-
-	// Build recipients list
-	recipientsList := strings.Join(certData.Recipients, "\n")
-
-	bodyText := fmt.Sprintf(`Messaggio di posta certificata
-
-Il giorno %s alle ore %s (%s) il messaggio
-"%s" è stato inviato da "%s"
-indirizzato a:
-%s
-
-Il messaggio originale è incluso in allegato.
-Identificativo messaggio: %s`,
-		dateStr,
-		timeStr,
-		certData.Timezone,
-		certData.OriginalSubject,
-		certData.OriginalFrom,
-		recipientsList,
-		certData.MessageID,
-	)
-
-	return bodyText
-}
-
-// createPECXMLData creates the XML attachment with certification data
-func createPECXMLData(certData PECCertificationData) string {
-	xmlData := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
-<postacert xmlns="http://www.digitpa.gov.it/protocolli/postacert">
-    <intestazione>
-        <identificativo>%s</identificativo>
-        <mittente>%s</mittente>
-        <destinatari>`,
-		certData.MessageID,
-		certData.OriginalFrom,
-	)
-
-	// Add recipients
-	for _, recipient := range certData.Recipients {
-		xmlData += fmt.Sprintf(`
-            <destinatario>%s</destinatario>`, recipient)
-	}
-
-	xmlData += fmt.Sprintf(`
-        </destinatari>
-        <oggetto>%s</oggetto>
-        <data>%s</data>
-        <rilevanza>normale</rilevanza>
-        <conferma-ricezione>si</conferma-ricezione>
-    </intestazione>
-    <dati>
-        <tipo-messaggio>posta-certificata</tipo-messaggio>
-        <tipo-ricevuta>completa</tipo-ricevuta>
-        <errore-esteso></errore-esteso>
-    </dati>
-</postacert>`,
-		certData.OriginalSubject,
-		certData.Date.Format(time.RFC3339),
-	)
-
-	return xmlData
-}
-
-// FormatPECEnvelopeAsRFC2822 formats the PEC envelope as RFC 2822 compliant message
-func FormatPECEnvelopeAsRFC2822(envelope *PECTransportEnvelope, originalMessageRaw []byte) []byte {
-	var message strings.Builder
-
-	// Write headers
-	for header, value := range envelope.Headers {
-		message.WriteString(fmt.Sprintf("%s: %s\r\n", header, value))
-	}
-
-	// Add MIME headers for multipart message
-	boundary := generateBoundary()
-	message.WriteString(fmt.Sprintf("Content-Type: multipart/mixed; boundary=\"%s\"\r\n", boundary))
-	message.WriteString("MIME-Version: 1.0\r\n")
-	message.WriteString("\r\n")
-
-	// Body text part
-	message.WriteString(fmt.Sprintf("--%s\r\n", boundary))
-	message.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
-	message.WriteString("Content-Transfer-Encoding: 8bit\r\n")
-	message.WriteString("\r\n")
-	message.WriteString(envelope.Body)
-	message.WriteString("\r\n\r\n")
-
-	// Original message attachment
-	message.WriteString(fmt.Sprintf("--%s\r\n", boundary))
-	message.WriteString("Content-Type: message/rfc822\r\n")
-	message.WriteString("Content-Disposition: attachment; filename=\"messaggio-originale.eml\"\r\n")
-	message.WriteString("\r\n")
-	message.Write(originalMessageRaw)
-	message.WriteString("\r\n\r\n")
-
-	// XML data attachment
-	message.WriteString(fmt.Sprintf("--%s\r\n", boundary))
-	message.WriteString("Content-Type: application/xml\r\n")
-	message.WriteString("Content-Disposition: attachment; filename=\"postacert.xml\"\r\n")
-	message.WriteString("\r\n")
-	message.WriteString(envelope.XMLData)
-	message.WriteString("\r\n\r\n")
-
-	// End boundary
-	message.WriteString(fmt.Sprintf("--%s--\r\n", boundary))
-
-	return []byte(message.String())
-}
-
-// generateBoundary generates a MIME boundary string
-func generateBoundary() string {
-	return fmt.Sprintf("----=_NextPart_%d", time.Now().UnixNano())
-}
-
-// ProcessPECMessage receives a raw email message, processes it, and returns a formatted PEC message
-func ProcessPECMessage(originalMessageRaw []byte) ([]byte, error) {
-	// Parse original message
-	mailReader, err := common.ParseEmailMessage(originalMessageRaw)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse original message: %w", err)
-	}
-
-	// Extract recipients
-	recipients := common.ExtractRecipients(&mailReader.Header)
-
-	// Create certification data
-	certData := PECCertificationData{
-		MessageID:       mailReader.Header.Get("Message-ID"),
-		OriginalSubject: mailReader.Header.Get("Subject"),
-		OriginalFrom:    mailReader.Header.Get("From"),
-		Recipients:      recipients,
-		Date:            time.Now(),
-		Timezone:        "CET",
-	}
-
-	// Create transport envelope
-	envelope, err := CreatePECTransportEnvelope(&mailReader.Header, certData)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create transport envelope: %w", err)
-	}
-
-	// Format as RFC 2822 message
-	pecMessage := FormatPECEnvelopeAsRFC2822(envelope, originalMessageRaw)
-
-	return pecMessage, nil
+// ProcessPECMessage receives a raw email message, processes it, and returns the signed PEC transport envelope
+func ProcessPECMessage(signer *common.Signer, originalMessageRaw []byte) ([]byte, error) {
+	return common.BuildTransportEnvelope(originalMessageRaw, common.PECCertificationData{Date: receiptTime(), From: providerFrom}, signer)
 }
@@ -7,14 +7,28 @@ import (
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/base64"
+	"encoding/json"
 	"encoding/xml"
+	"errors"
 	"io"
 	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/danzipie/go-pec/pec"
 	"github.com/danzipie/go-pec/pec-server/internal/common"
+	pec_storage "github.com/danzipie/go-pec/pec-server/internal/storage"
+	"github.com/danzipie/go-pec/pec-server/metrics"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
 )
 
 // Helper function to create test certificate and key (reused from previous test)
@@ -113,6 +127,10 @@ func TestGenerateNonAcceptanceEmail(t *testing.T) {
 			t.Errorf("Date header is not in correct format: %v", err)
 		}
 	}
+	// The date is given in the Italian time
+	if expectedDate := "Mon, 15 Jan 2024 15:30:45 +0100"; dateStr != expectedDate {
+		t.Errorf("Expected Date to be '%s', got '%s'", expectedDate, dateStr)
+	}
 
 	// Check Subject header
 	expectedSubject := "AVVISO DI NON ACCETTAZIONE: Test Email Subject"
@@ -136,6 +154,13 @@ func TestGenerateNonAcceptanceEmail(t *testing.T) {
 		t.Errorf("Expected X-Riferimento-Message-ID to be '%s', got '%s'", validationError.MessageID, header.Get("X-Riferimento-Message-ID"))
 	}
 
+	// Check the threading headers
+	for _, field := range []string{"In-Reply-To", "References"} {
+		if header.Get(field) != validationError.MessageID {
+			t.Errorf("Expected %s to be '%s', got '%s'", field, validationError.MessageID, header.Get(field))
+		}
+	}
+
 	// Check Content-Type header
 	contentType := header.Get("Content-Type")
 	if !strings.HasPrefix(contentType, "multipart/signed") {
@@ -187,7 +212,7 @@ func TestGenerateNonAcceptanceEmail_ContentVerification(t *testing.T) {
 	expectedTexts := []string{
 		"Errore nell’accettazione del messaggio",
 		"15/01/2024",
-		"14:30:45",
+		"15:30:45 (CET)", // in the Italian time
 		"Important Message",
 		"sender@example.com",
 		"recipient@testdomain.com",
@@ -281,36 +306,44 @@ func TestGenerateNonAcceptanceEmail_XMLContent(t *testing.T) {
 	}
 
 	// Parse the XML
-	var datiCert DatiCert
+	var datiCert pec.DatiCert
 	err = xml.Unmarshal(xmlData, &datiCert)
 	if err != nil {
 		t.Fatalf("Failed to parse XML: %v", err)
 	}
 
 	// Verify XML content
-	if datiCert.MessageID != validationError.MessageID {
-		t.Errorf("Expected MessageID '%s', got '%s'", validationError.MessageID, datiCert.MessageID)
+	if datiCert.Tipo != pec.TipoNonAccettazione || datiCert.Errore != pec.ErroreAltro {
+		t.Errorf("Unexpected daticert type %q, error %q", datiCert.Tipo, datiCert.Errore)
+	}
+
+	if datiCert.Dati.MsgID != validationError.MessageID {
+		t.Errorf("Expected MsgID '%s', got '%s'", validationError.MessageID, datiCert.Dati.MsgID)
+	}
+
+	if datiCert.Intestazione.Oggetto != validationError.Subject {
+		t.Errorf("Expected Oggetto '%s', got '%s'", validationError.Subject, datiCert.Intestazione.Oggetto)
 	}
 
-	if datiCert.Subject != validationError.Subject {
-		t.Errorf("Expected Subject '%s', got '%s'", validationError.Subject, datiCert.Subject)
+	if datiCert.Intestazione.Mittente != validationError.From {
+		t.Errorf("Expected Mittente '%s', got '%s'", validationError.From, datiCert.Intestazione.Mittente)
 	}
 
-	if datiCert.From != validationError.From {
-		t.Errorf("Expected From '%s', got '%s'", validationError.From, datiCert.From)
+	if datiCert.Dati.ErroreEsteso != validationError.Reason {
+		t.Errorf("Expected ErroreEsteso '%s', got '%s'", validationError.Reason, datiCert.Dati.ErroreEsteso)
 	}
 
-	if datiCert.Reason != validationError.Reason {
-		t.Errorf("Expected Reason '%s', got '%s'", validationError.Reason, datiCert.Reason)
+	if datiCert.Dati.Data.Giorno != "15/01/2024" || datiCert.Dati.Data.Ora != "14:30:45" {
+		t.Errorf("Unexpected date %+v", datiCert.Dati.Data)
 	}
 
-	if len(datiCert.To) != len(validationError.To) {
-		t.Errorf("Expected %d recipients, got %d", len(validationError.To), len(datiCert.To))
+	if len(datiCert.Intestazione.Destinatari) != len(validationError.To) {
+		t.Errorf("Expected %d recipients, got %d", len(validationError.To), len(datiCert.Intestazione.Destinatari))
 	}
 
 	for i, expected := range validationError.To {
-		if i < len(datiCert.To) && datiCert.To[i] != expected {
-			t.Errorf("Expected recipient %d to be '%s', got '%s'", i, expected, datiCert.To[i])
+		if i < len(datiCert.Intestazione.Destinatari) && datiCert.Intestazione.Destinatari[i].Val != expected {
+			t.Errorf("Expected recipient %d to be '%s', got '%s'", i, expected, datiCert.Intestazione.Destinatari[i].Val)
 		}
 	}
 }
@@ -414,70 +447,40 @@ func TestValidationError_Error(t *testing.T) {
 	}
 }
 
-// TestDatiCert_XMLMarshaling tests XML marshaling of DatiCert
-func TestDatiCert_XMLMarshaling(t *testing.T) {
-	testTime := time.Date(2024, 1, 15, 14, 30, 45, 0, time.UTC)
-
-	datiCert := DatiCert{
-		MessageID:   "test-message-id",
-		Subject:     "Test Subject",
-		From:        "from@example.com",
-		To:          []string{"to1@example.com", "to2@example.com"},
-		Reason:      "test reason",
-		GeneratedAt: testTime.Format(time.RFC3339),
-	}
+// TestGenerateAcceptanceEmail tests the main functionality of acceptance receipt generation
+// TestGenerateReceipts_ProviderFrom tests that the receipts carry the
+// configured display name
+func TestGenerateReceipts_ProviderFrom(t *testing.T) {
+	providerFrom = common.ProviderFrom{Name: "Posta Certificata {domain}"}
+	t.Cleanup(func() { providerFrom = common.ProviderFrom{} })
 
-	// Marshal to XML
-	xmlData, err := xml.MarshalIndent(datiCert, "", "  ")
+	cert, key := createTestCertAndKeyForNonAcceptance(t)
+	signer := &common.Signer{Cert: cert, Key: key, Domain: "testdomain.com"}
+	acceptance, err := GenerateAcceptanceEmail("testdomain.com", "<branded@example.com>", "sender@example.com", []string{"recipient@testdomain.com"}, nil, "Branded", signer)
 	if err != nil {
-		t.Fatalf("Failed to marshal XML: %v", err)
-	}
-
-	// Verify XML content
-	xmlStr := string(xmlData)
-
-	expectedElements := []string{
-		"<daticert>",
-		"<message-id>test-message-id</message-id>",
-		"<subject>Test Subject</subject>",
-		"<from>from@example.com</from>",
-		"<to>",
-		"<address>to1@example.com</address>",
-		"<address>to2@example.com</address>",
-		"</to>",
-		"<reason>test reason</reason>",
-		"<timestamp>2024-01-15T14:30:45Z</timestamp>",
-		"</daticert>",
-	}
-
-	for _, element := range expectedElements {
-		if !strings.Contains(xmlStr, element) {
-			t.Errorf("Expected XML to contain '%s', but it was not found", element)
-		}
+		t.Fatalf("GenerateAcceptanceEmail failed: %v", err)
 	}
-
-	// Test unmarshaling
-	var parsed DatiCert
-	err = xml.Unmarshal(xmlData, &parsed)
+	nonAcceptance, err := GenerateNonAcceptanceEmail("testdomain.com", ValidationError{
+		Code:        ValidationBccPresent,
+		Reason:      "'Bcc' field must not be present",
+		MessageID:   "<branded@example.com>",
+		From:        "sender@example.com",
+		To:          []string{"recipient@testdomain.com"},
+		Subject:     "Branded",
+		GeneratedAt: time.Now(),
+	}, signer)
 	if err != nil {
-		t.Fatalf("Failed to unmarshal XML: %v", err)
-	}
-
-	// Verify parsed data
-	if parsed.MessageID != datiCert.MessageID {
-		t.Errorf("Expected MessageID '%s', got '%s'", datiCert.MessageID, parsed.MessageID)
-	}
-
-	if parsed.Subject != datiCert.Subject {
-		t.Errorf("Expected Subject '%s', got '%s'", datiCert.Subject, parsed.Subject)
+		t.Fatalf("GenerateNonAcceptanceEmail failed: %v", err)
 	}
 
-	if len(parsed.To) != len(datiCert.To) {
-		t.Errorf("Expected %d recipients, got %d", len(datiCert.To), len(parsed.To))
+	want := "\"Posta Certificata testdomain.com\" <posta-certificata@testdomain.com>"
+	for _, receipt := range []*message.Entity{acceptance, nonAcceptance} {
+		if got := receipt.Header.Get("From"); got != want {
+			t.Errorf("Expected From %q on the %s receipt, got %q", want, receipt.Header.Get("X-Ricevuta"), got)
+		}
 	}
 }
 
-// TestGenerateAcceptanceEmail tests the main functionality of acceptance receipt generation
 func TestGenerateAcceptanceEmail(t *testing.T) {
 	// Create test certificate and key
 	cert, key := createTestCertAndKeyForNonAcceptance(t)
@@ -497,7 +500,7 @@ func TestGenerateAcceptanceEmail(t *testing.T) {
 	subject := "Test Email Subject"
 
 	// Test the function
-	entity, err := GenerateAcceptanceEmail(domain, messageID, from, to, subject, signer)
+	entity, err := GenerateAcceptanceEmail(domain, messageID, from, to, nil, subject, signer)
 	if err != nil {
 		t.Fatalf("GenerateAcceptanceEmail failed: %v", err)
 	}
@@ -548,6 +551,13 @@ func TestGenerateAcceptanceEmail(t *testing.T) {
 		t.Errorf("Expected X-Riferimento-Message-ID to be '%s', got '%s'", messageID, header.Get("X-Riferimento-Message-ID"))
 	}
 
+	// Check the threading headers
+	for _, field := range []string{"In-Reply-To", "References"} {
+		if header.Get(field) != messageID {
+			t.Errorf("Expected %s to be '%s', got '%s'", field, messageID, header.Get(field))
+		}
+	}
+
 	// Check Content-Type header
 	contentType := header.Get("Content-Type")
 	if !strings.HasPrefix(contentType, "multipart/signed") {
@@ -580,3 +590,1527 @@ func TestGenerateAcceptanceEmail(t *testing.T) {
 		}
 	}
 }
+
+// newAuthenticatedSession creates an SMTP session through the backend and authenticates it
+func newAuthenticatedSession(t *testing.T, backend *common.Backend) *common.Session {
+	backend.AllowInsecureAuth = true // there is no connection to secure
+	smtpSession, err := backend.NewSession(nil)
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	session := smtpSession.(*common.Session)
+
+	auth, err := session.Auth(sasl.Plain)
+	if err != nil {
+		t.Fatalf("Failed to start authentication: %v", err)
+	}
+	if _, done, err := auth.Next([]byte("\x00username\x00password")); err != nil || !done {
+		t.Fatalf("Authentication failed: %v", err)
+	}
+	return session
+}
+
+// TestAccessPointHandler_JournalAccepted tests the journaled events for an accepted message
+func TestAccessPointHandler_JournalAccepted(t *testing.T) {
+	captureForwards(t)
+	journal, err := pec_storage.NewFileJournal(filepath.Join(t.TempDir(), "journal.log"))
+	if err != nil {
+		t.Fatalf("Failed to open journal: %v", err)
+	}
+	defer journal.Close()
+
+	cert, key := createTestCertAndKeyForNonAcceptance(t)
+	signer := &common.Signer{Cert: cert, Key: key, Domain: "testdomain.com"}
+	backend := common.NewBackend(signer, pec_storage.NewInMemoryStore(), journal, AccessPointHandler, "testdomain.com")
+	session := newAuthenticatedSession(t, backend)
+
+	messageID := "<journal-test@example.com>"
+	email := "From: sender@example.com\r\n" +
+		"To: recipient@testdomain.com\r\n" +
+		"Subject: Journal test\r\n" +
+		"Message-ID: " + messageID + "\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Hello\r\n"
+
+	if err := session.Mail("sender@example.com", nil); err != nil {
+		t.Fatalf("MAIL failed: %v", err)
+	}
+	if err := session.Rcpt("recipient@testdomain.com", nil); err != nil {
+		t.Fatalf("RCPT failed: %v", err)
+	}
+	if err := session.Data(strings.NewReader(email)); err != nil {
+		t.Fatalf("DATA failed: %v", err)
+	}
+
+	entries, err := journal.QueryByMessageID(messageID)
+	if err != nil {
+		t.Fatalf("QueryByMessageID failed: %v", err)
+	}
+
+	expected := []pec_storage.JournalEvent{
+		pec_storage.EventReceived,
+		pec_storage.EventAccepted,
+		pec_storage.EventTransportEnvelopeCreated,
+		pec_storage.EventForwarded,
+		pec_storage.EventReceiptEmitted,
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("Expected %d journal entries, got %d: %+v", len(expected), len(entries), entries)
+	}
+	for i, event := range expected {
+		if entries[i].Event != event {
+			t.Errorf("Expected event %d to be '%s', got '%s'", i, event, entries[i].Event)
+		}
+		if entries[i].Outcome != pec_storage.OutcomeSuccess {
+			t.Errorf("Expected event %d outcome to be '%s', got '%s'", i, pec_storage.OutcomeSuccess, entries[i].Outcome)
+		}
+		if entries[i].Timestamp.IsZero() {
+			t.Errorf("Expected event %d to have a timestamp", i)
+		}
+	}
+	// Only the receipt entry names the identificativo of the receipt
+	receiptID := common.ReceiptIdentifier(pec.TipoAccettazione, messageID, "testdomain.com")
+	for i, entry := range entries {
+		want := ""
+		if entry.Event == pec_storage.EventReceiptEmitted {
+			want = receiptID
+		}
+		if entry.Identificativo != want {
+			t.Errorf("Expected event %d identificativo %q, got %q", i, want, entry.Identificativo)
+		}
+	}
+}
+
+// TestAccessPointHandler_WebhookAccepted tests that the acceptance of a
+// message is notified to the webhook with a signed payload
+func TestAccessPointHandler_WebhookAccepted(t *testing.T) {
+	captureForwards(t)
+	secret := "webhook-secret"
+	received := make(chan common.WebhookEvent, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload, _ := io.ReadAll(r.Body)
+		if got, want := r.Header.Get(common.WebhookSignatureHeader), common.SignWebhookPayload([]byte(secret), payload); got != want {
+			t.Errorf("Expected signature %s, got %s", want, got)
+		}
+		var event common.WebhookEvent
+		if err := json.Unmarshal(payload, &event); err != nil {
+			t.Errorf("Failed to decode webhook payload: %v", err)
+		}
+		received <- event
+	}))
+	defer server.Close()
+
+	cert, key := createTestCertAndKeyForNonAcceptance(t)
+	signer := &common.Signer{Cert: cert, Key: key, Domain: "testdomain.com"}
+	backend := common.NewBackend(signer, pec_storage.NewInMemoryStore(), nil, AccessPointHandler, "testdomain.com")
+	backend.Webhook = common.NewWebhook(&common.Config{
+		WebhookURL:    server.URL,
+		WebhookSecret: secret,
+		WebhookEvents: []string{string(pec_storage.EventAccepted)},
+	})
+
+	if err := sendTestMessage(t, backend, "<webhook-test@testdomain.com>"); err != nil {
+		t.Fatalf("DATA failed: %v", err)
+	}
+	backend.Webhook.Close()
+	close(received)
+
+	var events []common.WebhookEvent
+	for event := range received {
+		events = append(events, event)
+	}
+	if len(events) != 1 {
+		t.Fatalf("Expected 1 notification, got %d: %+v", len(events), events)
+	}
+	event := events[0]
+	if event.Event != pec_storage.EventAccepted || event.Outcome != pec_storage.OutcomeSuccess {
+		t.Errorf("Expected a successful acceptance, got %s (%s)", event.Event, event.Outcome)
+	}
+	if event.MessageID != "<webhook-test@testdomain.com>" {
+		t.Errorf("Unexpected message_id %q", event.MessageID)
+	}
+	if event.From != "sender@testdomain.com" || len(event.To) != 1 || event.To[0] != "recipient@example.com" {
+		t.Errorf("Unexpected envelope %s -> %v", event.From, event.To)
+	}
+	if event.Timestamp.IsZero() {
+		t.Error("Expected the event to have a timestamp")
+	}
+}
+
+// TestAccessPointHandler_NoSigner tests that a session without a signer is
+// refused with a temporary failure before any processing
+func TestAccessPointHandler_NoSigner(t *testing.T) {
+	journal, err := pec_storage.NewFileJournal(filepath.Join(t.TempDir(), "journal.log"))
+	if err != nil {
+		t.Fatalf("Failed to open journal: %v", err)
+	}
+	defer journal.Close()
+
+	cert, key := createTestCertAndKeyForNonAcceptance(t)
+	signer := &common.Signer{Cert: cert, Key: key, Domain: "testdomain.com"}
+	backend := common.NewBackend(signer, pec_storage.NewInMemoryStore(), journal, AccessPointHandler, "testdomain.com")
+	smtpSession, err := backend.NewSession(nil)
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+
+	// An unauthenticated session has no signer
+	err = AccessPointHandler(smtpSession.(*common.Session))
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 451 {
+		t.Fatalf("Expected a 451 temporary failure, got %v", err)
+	}
+
+	// Neither has a session of a backend without one
+	backend = common.NewBackend(nil, pec_storage.NewInMemoryStore(), journal, AccessPointHandler, "testdomain.com")
+	session := newAuthenticatedSession(t, backend)
+	email := "From: sender@example.com\r\n" +
+		"To: recipient@testdomain.com\r\n" +
+		"Subject: No signer\r\n" +
+		"Message-ID: <no-signer@example.com>\r\n" +
+		"\r\n" +
+		"Hello\r\n"
+	if err := session.Mail("sender@example.com", nil); err != nil {
+		t.Fatalf("MAIL failed: %v", err)
+	}
+	if err := session.Rcpt("recipient@testdomain.com", nil); err != nil {
+		t.Fatalf("RCPT failed: %v", err)
+	}
+	if err := session.Data(strings.NewReader(email)); !errors.As(err, &smtpErr) || smtpErr.Code != 451 {
+		t.Fatalf("Expected a 451 temporary failure, got %v", err)
+	}
+
+	entries, err := journal.QueryByMessageID("<no-signer@example.com>")
+	if err != nil {
+		t.Fatalf("QueryByMessageID failed: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("Expected no processing, got journal entries %+v", entries)
+	}
+}
+
+// TestAccessPointHandler_JournalNonAccepted tests the journaled events for a rejected message
+func TestAccessPointHandler_JournalNonAccepted(t *testing.T) {
+	journal, err := pec_storage.NewFileJournal(filepath.Join(t.TempDir(), "journal.log"))
+	if err != nil {
+		t.Fatalf("Failed to open journal: %v", err)
+	}
+	defer journal.Close()
+
+	cert, key := createTestCertAndKeyForNonAcceptance(t)
+	signer := &common.Signer{Cert: cert, Key: key, Domain: "testdomain.com"}
+	backend := common.NewBackend(signer, pec_storage.NewInMemoryStore(), journal, AccessPointHandler, "testdomain.com")
+	session := newAuthenticatedSession(t, backend)
+
+	messageID := "<journal-reject@example.com>"
+	email := "From: other@example.com\r\n" +
+		"To: recipient@testdomain.com\r\n" +
+		"Subject: Journal test\r\n" +
+		"Message-ID: " + messageID + "\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Hello\r\n"
+
+	session.Mail("sender@example.com", nil)
+	session.Rcpt("recipient@testdomain.com", nil)
+	if err := session.Data(strings.NewReader(email)); err == nil {
+		t.Fatal("Expected DATA to fail for mismatching reverse-path")
+	}
+
+	entries, err := journal.QueryByMessageID(messageID)
+	if err != nil {
+		t.Fatalf("QueryByMessageID failed: %v", err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("Expected 3 journal entries, got %d: %+v", len(entries), entries)
+	}
+	receiptID := common.ReceiptIdentifier(pec.TipoNonAccettazione, messageID, "testdomain.com")
+	if entries[2].Event != pec_storage.EventReceiptEmitted || entries[2].Identificativo != receiptID {
+		t.Errorf("Expected the non-acceptance receipt %s to be journaled, got %+v", receiptID, entries[2])
+	}
+	if entries[1].Event != pec_storage.EventNonAccepted || entries[1].Outcome != pec_storage.OutcomeFailure {
+		t.Errorf("Expected a failed non-accepted entry, got %+v", entries[1])
+	}
+	if !strings.Contains(entries[1].Detail, "does not match From header") {
+		t.Errorf("Expected detail to contain the validation reason, got '%s'", entries[1].Detail)
+	}
+}
+
+// TestAccessPointHandler_NonAcceptanceReceipt tests that the non-acceptance
+// receipt of a message refused by the handler references the message and
+// reports its header fields
+func TestAccessPointHandler_NonAcceptanceReceipt(t *testing.T) {
+	now := time.Date(2025, 3, 10, 9, 5, 7, 0, time.UTC)
+	clock = func() time.Time { return now }
+	t.Cleanup(func() { clock = time.Now })
+
+	cert, key := createTestCertAndKeyForNonAcceptance(t)
+	signer := &common.Signer{Cert: cert, Key: key, Domain: "testdomain.com"}
+	store := pec_storage.NewInMemoryStore()
+	backend := common.NewBackend(signer, store, nil, AccessPointHandler, "testdomain.com")
+	session := newAuthenticatedSession(t, backend)
+
+	messageID := "<rejected@example.com>"
+	email := "From: other@example.com\r\n" +
+		"To: recipient@testdomain.com\r\n" +
+		"Cc: copy@testdomain.com\r\n" +
+		"Subject: Rejected test\r\n" +
+		"Message-ID: " + messageID + "\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Hello\r\n"
+	session.Mail("sender@example.com", nil)
+	session.Rcpt("recipient@testdomain.com", nil)
+	if err := session.Data(strings.NewReader(email)); err == nil {
+		t.Fatal("Expected DATA to fail for mismatching reverse-path")
+	}
+
+	messages, err := store.GetMessages("sender@example.com")
+	if err != nil || len(messages) != 1 {
+		t.Fatalf("Expected a non-acceptance receipt for the sender, got %d messages (%v)", len(messages), err)
+	}
+	raw, err := pec_storage.MessageBody(messages[0])
+	if err != nil {
+		t.Fatalf("MessageBody failed: %v", err)
+	}
+	receipt, err := message.Read(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("Failed to parse receipt: %v", err)
+	}
+	for _, field := range []string{"In-Reply-To", "References", "X-Riferimento-Message-ID"} {
+		if got := receipt.Header.Get(field); got != messageID {
+			t.Errorf("Expected %s %s, got %q", field, messageID, got)
+		}
+	}
+	if got := receipt.Header.Get("Subject"); got != "AVVISO DI NON ACCETTAZIONE: Rejected test" {
+		t.Errorf("Unexpected subject %q", got)
+	}
+
+	datiCert, err := pec.ParseDatiCertXML(string(extractDatiCert(t, receipt)))
+	if err != nil {
+		t.Fatalf("ParseDatiCertXML failed: %v", err)
+	}
+	intestazione := datiCert.Intestazione
+	if intestazione.Mittente != "other@example.com" || intestazione.Oggetto != "Rejected test" {
+		t.Errorf("Unexpected mittente %q and oggetto %q", intestazione.Mittente, intestazione.Oggetto)
+	}
+	wantDestinatari := []pec.Destinatario{{Tipo: "certificato", Val: "recipient@testdomain.com"}, {Tipo: "certificato", Val: "copy@testdomain.com"}}
+	if !reflect.DeepEqual(intestazione.Destinatari, wantDestinatari) {
+		t.Errorf("Expected destinatari %+v, got %+v", wantDestinatari, intestazione.Destinatari)
+	}
+	dati := datiCert.Dati
+	if dati.MsgID != messageID {
+		t.Errorf("Expected msgid %s, got %q", messageID, dati.MsgID)
+	}
+	if want := common.ReceiptIdentifier(pec.TipoNonAccettazione, messageID, "testdomain.com"); dati.Identificativo != want {
+		t.Errorf("Expected identificativo %q, got %q", want, dati.Identificativo)
+	}
+	if dati.Data.Giorno != "10/03/2025" || dati.Data.Ora != "10:05:07" {
+		t.Errorf("Expected the receipt to be dated at the clock, got %+v", dati.Data)
+	}
+}
+
+// TestProcessPECMessage_SignedEnvelopeRoundTrip tests that the produced envelope is accepted by the reception-side check
+func TestProcessPECMessage_SignedEnvelopeRoundTrip(t *testing.T) {
+	cert, key := createTestCertAndKeyForNonAcceptance(t)
+	signer := &common.Signer{Cert: cert, Key: key, Domain: "testdomain.com"}
+
+	original := "From: Mario Rossi <sender@testdomain.com>\r\n" +
+		"To: recipient@example.com\r\n" +
+		"Subject: Round trip\r\n" +
+		"Message-ID: <roundtrip@testdomain.com>\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Hello\r\n"
+
+	envelope, err := ProcessPECMessage(signer, []byte(original))
+	if err != nil {
+		t.Fatalf("ProcessPECMessage failed: %v", err)
+	}
+
+	signerCert, err := common.VerifySignedMessage(envelope)
+	if err != nil {
+		t.Fatalf("Expected envelope signature to verify, got %v", err)
+	}
+	if !signerCert.Equal(cert) {
+		t.Errorf("Expected envelope to be signed with the provider certificate")
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	trust := &common.ProviderTrust{
+		CertificateHashes: map[string]struct{}{common.CertificateHash(cert): {}},
+		Roots:             roots,
+	}
+	if err := common.VerifyTransportEnvelope(envelope, trust); err != nil {
+		t.Fatalf("Expected envelope to be a valid transport envelope, got %v", err)
+	}
+
+	// The envelope is rejected when the signer is not a certified provider
+	if err := common.VerifyTransportEnvelope(envelope, &common.ProviderTrust{Roots: roots}); err == nil {
+		t.Errorf("Expected envelope from an unknown provider to be rejected")
+	}
+
+	// Tampering with the signed content breaks the signature
+	tampered := bytes.Replace(envelope, []byte("Round trip"), []byte("Round trap"), -1)
+	if _, err := common.VerifySignedMessage(tampered); err == nil {
+		t.Errorf("Expected tampered envelope to fail verification")
+	}
+}
+
+// TestProcessPECMessage_EncodedSubject tests that encoded-word subjects are
+// decoded in the envelope text and re-encoded in its Subject header
+func TestProcessPECMessage_EncodedSubject(t *testing.T) {
+	cert, key := createTestCertAndKeyForNonAcceptance(t)
+	signer := &common.Signer{Cert: cert, Key: key, Domain: "testdomain.com"}
+
+	tests := []struct {
+		name    string
+		subject string
+		decoded string
+	}{
+		{"base64", "=?UTF-8?B?RmF0dHVyYSBkaSBnZW5uYWlvIOKCrCAxMCDDqCBwYWdhdGE=?=", "Fattura di gennaio € 10 è pagata"},
+		{"q-encoded", "=?ISO-8859-1?Q?Perch=E8_no??=", "Perchè no?"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			original := "From: sender@testdomain.com\r\n" +
+				"To: recipient@example.com\r\n" +
+				"Subject: " + tt.subject + "\r\n" +
+				"Message-ID: <encoded@testdomain.com>\r\n" +
+				"Content-Type: text/plain\r\n" +
+				"\r\n" +
+				"Hello\r\n"
+
+			data, err := ProcessPECMessage(signer, []byte(original))
+			if err != nil {
+				t.Fatalf("ProcessPECMessage failed: %v", err)
+			}
+			envelope, err := common.ParseEmailMessage(data)
+			if err != nil {
+				t.Fatalf("Failed to parse envelope: %v", err)
+			}
+			if raw := envelope.Header.Get("Subject"); strings.ContainsAny(raw, "€è") {
+				t.Errorf("Expected an encoded Subject header, got %q", raw)
+			}
+			if subject, err := envelope.Header.Subject(); err != nil || subject != "POSTA CERTIFICATA: "+tt.decoded {
+				t.Errorf("Expected Subject %q, got %q (%v)", "POSTA CERTIFICATA: "+tt.decoded, subject, err)
+			}
+			if !bytes.Contains(data, []byte("\""+tt.decoded+"\" è stato inviato")) {
+				t.Errorf("Expected the envelope text to show the decoded subject")
+			}
+			if !bytes.Contains(data, []byte("<oggetto>"+tt.decoded+"</oggetto>")) {
+				t.Errorf("Expected daticert.xml to carry the decoded subject")
+			}
+		})
+	}
+}
+
+// TestProcessPECMessage_ReferencesOriginalMessageID tests that the envelope threads the user's Message-ID
+func TestProcessPECMessage_ReferencesOriginalMessageID(t *testing.T) {
+	cert, key := createTestCertAndKeyForNonAcceptance(t)
+	signer := &common.Signer{Cert: cert, Key: key, Domain: "testdomain.com"}
+
+	originalID := "<original@testdomain.com>"
+	original := "From: sender@testdomain.com\r\n" +
+		"To: recipient@example.com\r\n" +
+		"Subject: Reference\r\n" +
+		"Message-ID: " + originalID + "\r\n" +
+		"X-Riferimento-Message-ID: <forged@example.com>\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Hello\r\n"
+
+	data, err := ProcessPECMessage(signer, []byte(original))
+	if err != nil {
+		t.Fatalf("ProcessPECMessage failed: %v", err)
+	}
+	envelope, err := common.ParseEmailMessage(data)
+	if err != nil {
+		t.Fatalf("Failed to parse envelope: %v", err)
+	}
+	if got := envelope.Header.Get("Message-ID"); got != originalID {
+		t.Errorf("Expected envelope Message-ID %s, got %s", originalID, got)
+	}
+	if got := envelope.Header.Get("X-Riferimento-Message-ID"); got != originalID {
+		t.Errorf("Expected envelope X-Riferimento-Message-ID %s, got %s", originalID, got)
+	}
+
+	receipt, err := GenerateAcceptanceEmail("testdomain.com", originalID, "sender@testdomain.com", []string{"recipient@example.com"}, nil, "Reference", signer)
+	if err != nil {
+		t.Fatalf("GenerateAcceptanceEmail failed: %v", err)
+	}
+	if got := common.OriginalMessageID(&receipt.Header); got != originalID {
+		t.Errorf("Expected acceptance receipt to reference %s, got %s", originalID, got)
+	}
+}
+
+// scrapeMetric returns the value of a sample served by the /metrics endpoint
+func scrapeMetric(t *testing.T, name string) float64 {
+	t.Helper()
+	server := httptest.NewServer(metrics.Handler())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("Failed to scrape metrics: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed to read metrics: %v", err)
+	}
+
+	for _, line := range strings.Split(string(body), "\n") {
+		if value, ok := strings.CutPrefix(line, name+" "); ok {
+			v, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				t.Fatalf("Invalid value for %s: %q", name, value)
+			}
+			return v
+		}
+	}
+	t.Fatalf("Metric %s not found in:\n%s", name, body)
+	return 0
+}
+
+// TestAccessPointHandler_Metrics tests that processing a message is reflected in the scraped metrics
+func TestAccessPointHandler_Metrics(t *testing.T) {
+	captureForwards(t)
+	cert, key := createTestCertAndKeyForNonAcceptance(t)
+	signer := &common.Signer{Cert: cert, Key: key, Domain: "testdomain.com"}
+	backend := common.NewBackend(signer, pec_storage.NewInMemoryStore(), nil, AccessPointHandler, "testdomain.com")
+
+	received := scrapeMetric(t, "pec_messages_received_total")
+	accepted := scrapeMetric(t, "pec_messages_accepted_total")
+	signings := scrapeMetric(t, "pec_signing_duration_seconds_count")
+	sessions := scrapeMetric(t, "pec_smtp_sessions_active")
+
+	session := newAuthenticatedSession(t, backend)
+	if got := scrapeMetric(t, "pec_smtp_sessions_active"); got != sessions+1 {
+		t.Errorf("Expected %v active sessions, got %v", sessions+1, got)
+	}
+
+	email := "From: sender@example.com\r\n" +
+		"To: recipient@testdomain.com\r\n" +
+		"Subject: Metrics test\r\n" +
+		"Message-ID: <metrics-test@example.com>\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Hello\r\n"
+	if err := session.Mail("sender@example.com", nil); err != nil {
+		t.Fatalf("MAIL failed: %v", err)
+	}
+	if err := session.Rcpt("recipient@testdomain.com", nil); err != nil {
+		t.Fatalf("RCPT failed: %v", err)
+	}
+	if err := session.Data(strings.NewReader(email)); err != nil {
+		t.Fatalf("DATA failed: %v", err)
+	}
+	session.Logout()
+
+	if got := scrapeMetric(t, "pec_messages_received_total"); got != received+1 {
+		t.Errorf("Expected received counter %v, got %v", received+1, got)
+	}
+	if got := scrapeMetric(t, "pec_messages_accepted_total"); got != accepted+1 {
+		t.Errorf("Expected accepted counter %v, got %v", accepted+1, got)
+	}
+	if got := scrapeMetric(t, "pec_signing_duration_seconds_count"); got <= signings {
+		t.Errorf("Expected signing duration observations, got %v", got)
+	}
+	if got := scrapeMetric(t, "pec_smtp_sessions_active"); got != sessions {
+		t.Errorf("Expected %v active sessions after logout, got %v", sessions, got)
+	}
+}
+
+// TestAccessPointHandler_Duplicates tests that a retried message is accepted
+// without being processed again, while the same Message-ID sent by another
+// sender is processed
+func TestAccessPointHandler_Duplicates(t *testing.T) {
+	captureForwards(t)
+	duplicates = common.NewSeenMessageCache(&common.Config{})
+	t.Cleanup(func() { duplicates = nil })
+
+	journal, err := pec_storage.NewFileJournal(filepath.Join(t.TempDir(), "journal.log"))
+	if err != nil {
+		t.Fatalf("Failed to open journal: %v", err)
+	}
+	defer journal.Close()
+
+	cert, key := createTestCertAndKeyForNonAcceptance(t)
+	signer := &common.Signer{Cert: cert, Key: key, Domain: "testdomain.com"}
+	backend := common.NewBackend(signer, pec_storage.NewInMemoryStore(), journal, AccessPointHandler, "testdomain.com")
+
+	send := func(sender, messageID string) {
+		session := newAuthenticatedSession(t, backend)
+		email := "From: " + sender + "\r\n" +
+			"To: recipient@testdomain.com\r\n" +
+			"Subject: Duplicate test\r\n" +
+			"Message-ID: " + messageID + "\r\n" +
+			"Content-Type: text/plain\r\n" +
+			"\r\n" +
+			"Hello\r\n"
+		session.Mail(sender, nil)
+		session.Rcpt("recipient@testdomain.com", nil)
+		if err := session.Data(strings.NewReader(email)); err != nil {
+			t.Fatalf("DATA failed for %s from %s: %v", messageID, sender, err)
+		}
+	}
+	countEvents := func(messageID string, event pec_storage.JournalEvent) int {
+		entries, err := journal.QueryByMessageID(messageID)
+		if err != nil {
+			t.Fatalf("QueryByMessageID failed: %v", err)
+		}
+		count := 0
+		for _, entry := range entries {
+			if entry.Event == event {
+				count++
+			}
+		}
+		return count
+	}
+
+	send("sender@example.com", "<retried@example.com>")
+	send("sender@example.com", "<retried@example.com>")
+	send("sender@example.com", "<distinct@example.com>")
+	send("other@example.com", "<retried@example.com>")
+
+	if got := countEvents("<retried@example.com>", pec_storage.EventTransportEnvelopeCreated); got != 2 {
+		t.Errorf("Expected the retried message to be processed once per sender, got %d", got)
+	}
+	if got := countEvents("<retried@example.com>", pec_storage.EventDuplicate); got != 1 {
+		t.Errorf("Expected the retry to be journaled as a duplicate, got %d", got)
+	}
+	if got := countEvents("<distinct@example.com>", pec_storage.EventTransportEnvelopeCreated); got != 1 {
+		t.Errorf("Expected the distinct message to be processed, got %d", got)
+	}
+}
+
+// TestValidateEnvelopeAndHeaders_ReceiptType tests the validation of the requested receipt type
+func TestValidateEnvelopeAndHeaders_ReceiptType(t *testing.T) {
+	tests := []struct {
+		tipo    string
+		wantErr bool
+	}{
+		{"", false},
+		{"completa", false},
+		{"breve", false},
+		{"sintetica", false},
+		{" Breve ", false},
+		{"normale", true},
+		{"lunga", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.tipo, func(t *testing.T) {
+			email := "From: sender@example.com\r\n" +
+				"To: recipient@testdomain.com\r\n" +
+				"Subject: Receipt type\r\n"
+			if tt.tipo != "" {
+				email += "X-TipoRicevuta: " + tt.tipo + "\r\n"
+			}
+			email += "Content-Type: text/plain\r\n\r\nHello\r\n"
+
+			mr, err := mail.CreateReader(strings.NewReader(email))
+			if err != nil {
+				t.Fatalf("Failed to parse message: %v", err)
+			}
+			err = ValidateEnvelopeAndHeaders("sender@example.com", []string{"recipient@testdomain.com"}, mr)
+			if !tt.wantErr {
+				if err != nil {
+					t.Errorf("Expected no error, got %v", err)
+				}
+				return
+			}
+			valErr, ok := err.(ValidationError)
+			if !ok || !strings.Contains(valErr.Reason, "X-TipoRicevuta") {
+				t.Errorf("Expected a ValidationError about X-TipoRicevuta, got %v", err)
+			}
+		})
+	}
+}
+
+// TestValidateEnvelopeAndHeaders_StrictHeaders tests the reason given for
+// each missing or malformed header in strict mode
+func TestValidateEnvelopeAndHeaders_StrictHeaders(t *testing.T) {
+	valid := map[string][]string{
+		"Date":       {"Mon, 15 Jan 2024 14:30:45 +0100"},
+		"Message-ID": {"<strict@example.com>"},
+		"From":       {"sender@example.com"},
+		"To":         {"recipient@testdomain.com"},
+		"Subject":    {"Strict"},
+	}
+	tests := []struct {
+		name   string
+		field  string
+		values []string
+		reason string
+		code   ValidationCode
+	}{
+		{"valid", "", nil, "", ""},
+		{"missing Date", "Date", nil, "missing 'Date' field", ValidationMissingDate},
+		{"malformed Date", "Date", []string{"yesterday"}, "malformed 'Date' field 'yesterday'", ValidationInvalidDate},
+		{"missing Message-ID", "Message-ID", nil, "missing 'Message-ID' field", ValidationMissingMessageID},
+		{"Message-ID without brackets", "Message-ID", []string{"strict@example.com"}, "malformed 'Message-ID' field", ValidationInvalidMessageID},
+		{"Message-ID without @", "Message-ID", []string{"<strict.example.com>"}, "malformed 'Message-ID' field", ValidationInvalidMessageID},
+		{"Message-ID with spaces", "Message-ID", []string{"<strict id@example.com>"}, "malformed 'Message-ID' field", ValidationInvalidMessageID},
+		{"missing From", "From", nil, "missing 'From' field", ValidationMissingFrom},
+		{"multiple From", "From", []string{"sender@example.com", "other@example.com"}, "multiple 'From' fields", ValidationMultipleFrom},
+		{"malformed From", "From", []string{"sender@"}, "malformed 'From' field", ValidationInvalidFrom},
+		{"missing To", "To", nil, "missing 'To' field", ValidationMissingTo},
+		{"multiple To", "To", []string{"recipient@testdomain.com", "recipient@testdomain.com"}, "multiple 'To' fields", ValidationMultipleTo},
+		{"malformed To", "To", []string{"recipient@testdomain.com,,<"}, "malformed 'To' field", ValidationInvalidTo},
+		{"undecodable Subject", "Subject", []string{"=?x-unknown?Q?Strict?="}, "undecodable 'Subject' field", ValidationInvalidSubject},
+	}
+
+	strictHeaders = true
+	t.Cleanup(func() { strictHeaders = false })
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var email strings.Builder
+			for _, field := range []string{"Date", "Message-ID", "From", "To", "Subject"} {
+				values := valid[field]
+				if field == tt.field {
+					values = tt.values
+				}
+				for _, value := range values {
+					email.WriteString(field + ": " + value + "\r\n")
+				}
+			}
+			email.WriteString("Content-Type: text/plain\r\n\r\nHello\r\n")
+
+			mr, err := mail.CreateReader(strings.NewReader(email.String()))
+			if err != nil {
+				t.Fatalf("Failed to parse message: %v", err)
+			}
+			err = ValidateEnvelopeAndHeaders("sender@example.com", []string{"recipient@testdomain.com"}, mr)
+			if tt.reason == "" {
+				if err != nil {
+					t.Errorf("Expected no error, got %v", err)
+				}
+				return
+			}
+			valErr, ok := err.(ValidationError)
+			if !ok || !strings.HasPrefix(valErr.Reason, tt.reason) {
+				t.Errorf("Expected a ValidationError %q, got %v", tt.reason, err)
+			}
+			if valErr.Code != tt.code {
+				t.Errorf("Expected code %q, got %q", tt.code, valErr.Code)
+			}
+		})
+	}
+}
+
+// TestValidateEnvelopeAndHeaders_Codes tests the code given for each failure
+// of the envelope and header checks
+func TestValidateEnvelopeAndHeaders_Codes(t *testing.T) {
+	tests := []struct {
+		name       string
+		from       string
+		recipients []string
+		headers    string
+		code       ValidationCode
+	}{
+		{"missing From", "sender@example.com", []string{"recipient@testdomain.com"}, "To: recipient@testdomain.com\r\n", ValidationMissingFrom},
+		{"invalid From", "sender@example.com", []string{"recipient@testdomain.com"}, "From: sender@\r\nTo: recipient@testdomain.com\r\n", ValidationInvalidFrom},
+		{"two From addresses", "sender@example.com", []string{"recipient@testdomain.com"}, "From: sender@example.com, other@example.com\r\nTo: recipient@testdomain.com\r\n", ValidationInvalidFrom},
+		{"missing To", "sender@example.com", []string{"recipient@testdomain.com"}, "From: sender@example.com\r\n", ValidationMissingTo},
+		{"invalid To", "sender@example.com", []string{"recipient@testdomain.com"}, "From: sender@example.com\r\nTo: recipient@\r\n", ValidationInvalidTo},
+		{"Bcc present", "sender@example.com", []string{"recipient@testdomain.com"}, "From: sender@example.com\r\nTo: recipient@testdomain.com\r\nBcc: hidden@testdomain.com\r\n", ValidationBccPresent},
+		{"reverse-path mismatch", "other@example.com", []string{"recipient@testdomain.com"}, "From: sender@example.com\r\nTo: recipient@testdomain.com\r\n", ValidationSenderMismatch},
+		{"recipient mismatch", "sender@example.com", []string{"other@testdomain.com"}, "From: sender@example.com\r\nTo: recipient@testdomain.com\r\n", ValidationRecipientMismatch},
+		{"invalid receipt type", "sender@example.com", []string{"recipient@testdomain.com"}, "From: sender@example.com\r\nTo: recipient@testdomain.com\r\nX-TipoRicevuta: lunga\r\n", ValidationInvalidReceiptType},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mr, err := mail.CreateReader(strings.NewReader(tt.headers + "Content-Type: text/plain\r\n\r\nHello\r\n"))
+			if err != nil {
+				t.Fatalf("Failed to parse message: %v", err)
+			}
+			err = ValidateEnvelopeAndHeaders(tt.from, tt.recipients, mr)
+			valErr, ok := err.(ValidationError)
+			if !ok {
+				t.Fatalf("Expected a ValidationError, got %v", err)
+			}
+			if valErr.Code != tt.code {
+				t.Errorf("Expected code %q, got %q (%s)", tt.code, valErr.Code, valErr.Reason)
+			}
+			if valErr.Reason == "" {
+				t.Errorf("Expected a reason along the code")
+			}
+		})
+	}
+}
+
+// TestValidateEnvelopeAndHeaders_MaxRecipients tests the limit on the
+// recipients of a message, counting To and Cc
+func TestValidateEnvelopeAndHeaders_MaxRecipients(t *testing.T) {
+	maxRecipients = 3
+	t.Cleanup(func() { maxRecipients = defaultMaxRecipients })
+
+	tests := []struct {
+		name    string
+		to, cc  []string
+		tooMany bool
+	}{
+		{"under the limit", []string{"a@testdomain.com", "b@testdomain.com"}, nil, false},
+		{"at the limit", []string{"a@testdomain.com", "b@testdomain.com"}, []string{"c@testdomain.com"}, false},
+		{"over the limit in To", []string{"a@testdomain.com", "b@testdomain.com", "c@testdomain.com", "d@testdomain.com"}, nil, true},
+		{"over the limit with Cc", []string{"a@testdomain.com", "b@testdomain.com"}, []string{"c@testdomain.com", "d@testdomain.com"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			email := "From: sender@example.com\r\nTo: " + strings.Join(tt.to, ", ") + "\r\n"
+			if len(tt.cc) > 0 {
+				email += "Cc: " + strings.Join(tt.cc, ", ") + "\r\n"
+			}
+			mr, err := mail.CreateReader(strings.NewReader(email + "Content-Type: text/plain\r\n\r\nHello\r\n"))
+			if err != nil {
+				t.Fatalf("Failed to parse message: %v", err)
+			}
+			err = ValidateEnvelopeAndHeaders("sender@example.com", append(tt.to, tt.cc...), mr)
+			if !tt.tooMany {
+				if err != nil {
+					t.Errorf("Expected no error, got %v", err)
+				}
+				return
+			}
+			valErr, ok := err.(ValidationError)
+			if !ok || valErr.Code != ValidationTooManyRecipients {
+				t.Fatalf("Expected a too-many-recipients ValidationError, got %v", err)
+			}
+			if !strings.Contains(valErr.Reason, "limit of 3") {
+				t.Errorf("Expected the limit in the reason, got %q", valErr.Reason)
+			}
+		})
+	}
+}
+
+// TestScanContent_Code tests that infected messages are reported with the virus code
+func TestScanContent_Code(t *testing.T) {
+	useScanner(t, &mockScanner{reason: "virus detected (Eicar-Signature)"})
+	err := scanContent([]byte("Subject: test\r\n\r\nX5O!P%@AP\r\n"))
+	valErr, ok := err.(ValidationError)
+	if !ok || valErr.Code != ValidationVirus || valErr.Reason != "virus detected (Eicar-Signature)" {
+		t.Errorf("Expected a virus ValidationError, got %v", err)
+	}
+}
+
+// TestValidationCode_Errore tests the mapping of the codes to the daticert errore attribute
+func TestValidationCode_Errore(t *testing.T) {
+	tests := map[ValidationCode]string{
+		ValidationVirus:          pec.ErroreVirus,
+		ValidationBccPresent:     pec.ErroreAltro,
+		ValidationSenderMismatch: pec.ErroreAltro,
+		"":                       pec.ErroreAltro,
+	}
+	for code, want := range tests {
+		if got := code.Errore(); got != want {
+			t.Errorf("Expected errore %q for %q, got %q", want, code, got)
+		}
+	}
+}
+
+// TestValidateEnvelopeAndHeaders_NotStrict tests that the strict checks are off by default
+func TestValidateEnvelopeAndHeaders_NotStrict(t *testing.T) {
+	email := "From: sender@example.com\r\n" +
+		"To: recipient@testdomain.com\r\n" +
+		"Content-Type: text/plain\r\n\r\nHello\r\n"
+	mr, err := mail.CreateReader(strings.NewReader(email))
+	if err != nil {
+		t.Fatalf("Failed to parse message: %v", err)
+	}
+	if err := ValidateEnvelopeAndHeaders("sender@example.com", []string{"recipient@testdomain.com"}, mr); err != nil {
+		t.Errorf("Expected no error without Date and Message-ID, got %v", err)
+	}
+}
+
+// TestValidateEnvelopeAndHeaders_ComposedMessage tests that the messages
+// composed by pec.ComposeMessage pass the strict checks of the access point
+func TestValidateEnvelopeAndHeaders_ComposedMessage(t *testing.T) {
+	strictHeaders = true
+	t.Cleanup(func() { strictHeaders = false })
+
+	base := pec.OutgoingMessage{
+		From:        "Niccolò Rossi <sender@example.com>",
+		To:          []string{"recipient@testdomain.com"},
+		Cc:          []string{"Copia <copia@testdomain.com>"},
+		Subject:     "Perchè la città è chiusa?",
+		Text:        "Buongiorno",
+		ReceiptType: "sintetica",
+	}
+	tests := []struct {
+		name   string
+		modify func(m *pec.OutgoingMessage)
+	}{
+		{"text", func(m *pec.OutgoingMessage) {}},
+		{"alternative", func(m *pec.OutgoingMessage) { m.HTML = "<p>Buongiorno</p>" }},
+		{"attachments", func(m *pec.OutgoingMessage) {
+			m.Attachments = []pec.Attachment{{Filename: "fattura.xml", ContentType: "application/xml", Data: []byte("<fattura/>")}}
+		}},
+		{"no subject", func(m *pec.OutgoingMessage) { m.Subject = "" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := base
+			tt.modify(&m)
+			composed, err := pec.ComposeMessage(m)
+			if err != nil {
+				t.Fatalf("ComposeMessage failed: %v", err)
+			}
+			var raw bytes.Buffer
+			if err := composed.WriteTo(&raw); err != nil {
+				t.Fatalf("Failed to write message: %v", err)
+			}
+			mr, err := mail.CreateReader(&raw)
+			if err != nil {
+				t.Fatalf("Failed to parse message: %v", err)
+			}
+			recipients, err := m.Recipients()
+			if err != nil {
+				t.Fatalf("Recipients failed: %v", err)
+			}
+			if err := ValidateEnvelopeAndHeaders("sender@example.com", recipients, mr); err != nil {
+				t.Errorf("Expected the composed message to be accepted, got %v", err)
+			}
+		})
+	}
+}
+
+// TestGenerateAcceptanceEmail_ParsesWithPecParser tests that an acceptance receipt round-trips through pec.ParsePec
+func TestGenerateAcceptanceEmail_ParsesWithPecParser(t *testing.T) {
+	cert, key := createTestCertAndKeyForNonAcceptance(t)
+	signer := &common.Signer{Cert: cert, Key: key, Domain: "testdomain.com"}
+
+	messageID := "<roundtrip@example.com>"
+	to := []string{"recipient@testdomain.com", "other@testdomain.com"}
+	receipt, err := GenerateAcceptanceEmail("testdomain.com", messageID, "sender@example.com", to, nil, "Round trip", signer)
+	if err != nil {
+		t.Fatalf("GenerateAcceptanceEmail failed: %v", err)
+	}
+	var raw bytes.Buffer
+	if err := receipt.WriteTo(&raw); err != nil {
+		t.Fatalf("Failed to write receipt: %v", err)
+	}
+
+	pecMail, datiCert, err := pec.ParsePecReader(bytes.NewReader(raw.Bytes()))
+	if err != nil {
+		t.Fatalf("ParsePec failed: %v", err)
+	}
+	if pecMail.PecType != pec.AcceptanceReceipt {
+		t.Errorf("Expected AcceptanceReceipt, got %v", pecMail.PecType)
+	}
+	if datiCert.Tipo != "accettazione" || datiCert.Errore != "nessuno" {
+		t.Errorf("Unexpected daticert type %q, error %q", datiCert.Tipo, datiCert.Errore)
+	}
+	if datiCert.Intestazione.Mittente != "sender@example.com" {
+		t.Errorf("Expected mittente sender@example.com, got %q", datiCert.Intestazione.Mittente)
+	}
+	if len(datiCert.Intestazione.Destinatari) != len(to) {
+		t.Fatalf("Expected %d destinatari, got %+v", len(to), datiCert.Intestazione.Destinatari)
+	}
+	for i, rcpt := range to {
+		if got := datiCert.Intestazione.Destinatari[i]; got.Val != rcpt || got.Tipo != "certificato" {
+			t.Errorf("Expected destinatario %s (certificato), got %+v", rcpt, got)
+		}
+	}
+	if datiCert.Intestazione.Oggetto != "Round trip" {
+		t.Errorf("Expected oggetto 'Round trip', got %q", datiCert.Intestazione.Oggetto)
+	}
+	if datiCert.Dati.MsgID != messageID {
+		t.Errorf("Expected msgid %s, got %q", messageID, datiCert.Dati.MsgID)
+	}
+	if datiCert.Dati.Identificativo == "" || datiCert.Dati.GestoreEmittente == "" {
+		t.Errorf("Expected identificativo and gestore-emittente, got %+v", datiCert.Dati)
+	}
+}
+
+// extractDatiCert returns the decoded daticert.xml attached to the receipt
+func extractDatiCert(t *testing.T, receipt *message.Entity) []byte {
+	t.Helper()
+	var raw bytes.Buffer
+	if err := receipt.WriteTo(&raw); err != nil {
+		t.Fatalf("Failed to write receipt: %v", err)
+	}
+	entity, err := message.Read(&raw)
+	if err != nil {
+		t.Fatalf("Failed to read receipt: %v", err)
+	}
+
+	var datiCert []byte
+	err = entity.Walk(func(path []int, part *message.Entity, err error) error {
+		if err != nil {
+			return err
+		}
+		mediaType, params, _ := part.Header.ContentType()
+		_, dispositionParams, _ := part.Header.ContentDisposition()
+		if mediaType != "application/xml" || (params["name"] != "daticert.xml" && dispositionParams["filename"] != "daticert.xml") {
+			return nil
+		}
+		if enc := part.Header.Get("Content-Transfer-Encoding"); enc != "base64" {
+			t.Errorf("Expected daticert.xml in base64, got %q", enc)
+		}
+		// The body of the part is decoded from base64 as it is read
+		datiCert, err = io.ReadAll(part.Body)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Failed to walk receipt: %v", err)
+	}
+	if datiCert == nil {
+		t.Fatal("Expected a daticert.xml attachment")
+	}
+	return datiCert
+}
+
+// TestGenerateAcceptanceEmail_DatiCertParses tests that the daticert.xml of
+// an acceptance receipt is parsed by pec.ParseDatiCertXML into the fields it
+// was generated from
+func TestGenerateAcceptanceEmail_DatiCertParses(t *testing.T) {
+	cert, key := createTestCertAndKeyForNonAcceptance(t)
+	signer := &common.Signer{Cert: cert, Key: key, Domain: "testdomain.com"}
+
+	messageID := "<daticert@example.com>"
+	to := []string{"recipient@testdomain.com"}
+	cc := []string{"copy@testdomain.com"}
+	receipt, err := GenerateAcceptanceEmail("testdomain.com", messageID, "sender@example.com", to, cc, "Dati & certificazione", signer)
+	if err != nil {
+		t.Fatalf("GenerateAcceptanceEmail failed: %v", err)
+	}
+
+	datiCert, err := pec.ParseDatiCertXML(string(extractDatiCert(t, receipt)))
+	if err != nil {
+		t.Fatalf("ParseDatiCertXML failed: %v", err)
+	}
+	if datiCert.XMLName.Local != "postacert" || datiCert.Tipo != pec.TipoAccettazione || datiCert.Errore != pec.ErroreNessuno {
+		t.Errorf("Unexpected root %q, tipo %q, errore %q", datiCert.XMLName.Local, datiCert.Tipo, datiCert.Errore)
+	}
+	intestazione := datiCert.Intestazione
+	if intestazione.Mittente != "sender@example.com" || intestazione.Risposte != "sender@example.com" {
+		t.Errorf("Unexpected mittente %q and risposte %q", intestazione.Mittente, intestazione.Risposte)
+	}
+	if intestazione.Oggetto != "Dati & certificazione" {
+		t.Errorf("Expected oggetto 'Dati & certificazione', got %q", intestazione.Oggetto)
+	}
+	wantDestinatari := []pec.Destinatario{{Tipo: "certificato", Val: to[0]}, {Tipo: "certificato", Val: cc[0]}}
+	if len(intestazione.Destinatari) != len(wantDestinatari) {
+		t.Fatalf("Expected destinatari %+v, got %+v", wantDestinatari, intestazione.Destinatari)
+	}
+	for i, want := range wantDestinatari {
+		if intestazione.Destinatari[i] != want {
+			t.Errorf("Expected destinatario %+v, got %+v", want, intestazione.Destinatari[i])
+		}
+	}
+
+	dati := datiCert.Dati
+	if dati.GestoreEmittente != common.ProviderName("testdomain.com") {
+		t.Errorf("Expected gestore-emittente %q, got %q", common.ProviderName("testdomain.com"), dati.GestoreEmittente)
+	}
+	if dati.Data.Zona == "" || dati.Data.Giorno == "" || dati.Data.Ora == "" {
+		t.Errorf("Expected a complete data, got %+v", dati.Data)
+	}
+	if want := common.ReceiptIdentifier(pec.TipoAccettazione, messageID, "testdomain.com"); dati.Identificativo != want {
+		t.Errorf("Expected identificativo %q, got %q", want, dati.Identificativo)
+	}
+	if dati.MsgID != messageID {
+		t.Errorf("Expected msgid %s, got %q", messageID, dati.MsgID)
+	}
+}
+
+// TestGenerateReceipts_SigningMode tests that the receipts are signed into
+// the configured S/MIME structure and verify back to their daticert.xml
+func TestGenerateReceipts_SigningMode(t *testing.T) {
+	cert, key := createTestCertAndKeyForNonAcceptance(t)
+	signer := &common.Signer{Cert: cert, Key: key, Domain: "testdomain.com"}
+	t.Cleanup(func() { receiptSigningMode = common.SigningDetached })
+
+	receipts := map[string]func() (*message.Entity, error){
+		pec.TipoAccettazione: func() (*message.Entity, error) {
+			return GenerateAcceptanceEmail("testdomain.com", "<modes@example.com>", "sender@example.com", []string{"recipient@testdomain.com"}, nil, "Modes", signer)
+		},
+		pec.TipoNonAccettazione: func() (*message.Entity, error) {
+			return GenerateNonAcceptanceEmail("testdomain.com", ValidationError{
+				Reason:      "test reason",
+				MessageID:   "<modes@example.com>",
+				From:        "sender@example.com",
+				To:          []string{"recipient@testdomain.com"},
+				Subject:     "Modes",
+				GeneratedAt: time.Now(),
+			}, signer)
+		},
+	}
+	modes := map[common.SigningMode]string{
+		common.SigningDetached: "multipart/signed",
+		common.SigningOpaque:   "application/pkcs7-mime",
+	}
+
+	for mode, mediaType := range modes {
+		for tipo, generate := range receipts {
+			t.Run(string(mode)+"/"+tipo, func(t *testing.T) {
+				receiptSigningMode = mode
+				receipt, err := generate()
+				if err != nil {
+					t.Fatalf("Failed to generate receipt: %v", err)
+				}
+				if got, _, _ := receipt.Header.ContentType(); got != mediaType {
+					t.Errorf("Expected %s, got %s", mediaType, got)
+				}
+				if got := receipt.Header.Get("X-Ricevuta"); got != tipo {
+					t.Errorf("Expected X-Ricevuta %s, got %q", tipo, got)
+				}
+
+				var raw bytes.Buffer
+				if err := receipt.WriteTo(&raw); err != nil {
+					t.Fatalf("Failed to write receipt: %v", err)
+				}
+				signerCert, err := common.VerifySignedMessage(raw.Bytes())
+				if err != nil {
+					t.Fatalf("VerifySignedMessage failed: %v", err)
+				}
+				if !signerCert.Equal(cert) {
+					t.Error("Expected the receipt to be signed by the provider")
+				}
+				_, parsed, err := pec.ParsePecReader(bytes.NewReader(raw.Bytes()))
+				if err != nil {
+					t.Fatalf("ParsePecReader failed: %v", err)
+				}
+				if parsed.Tipo != tipo {
+					t.Errorf("Expected pec.ParsePec to read daticert tipo %s, got %q", tipo, parsed.Tipo)
+				}
+
+				entity, err := message.Read(bytes.NewReader(raw.Bytes()))
+				if err != nil {
+					t.Fatalf("Failed to read receipt: %v", err)
+				}
+				inner, _, err := common.UnwrapSigned(entity)
+				if err != nil {
+					t.Fatalf("UnwrapSigned failed: %v", err)
+				}
+				datiCert, err := pec.ParseDatiCertXML(string(extractDatiCert(t, inner)))
+				if err != nil {
+					t.Fatalf("ParseDatiCertXML failed: %v", err)
+				}
+				if datiCert.Tipo != tipo || datiCert.Dati.MsgID != "<modes@example.com>" {
+					t.Errorf("Unexpected daticert tipo %q, msgid %q", datiCert.Tipo, datiCert.Dati.MsgID)
+				}
+			})
+		}
+	}
+}
+
+// TestGenerateAcceptanceEmail_Zona tests that the zona of the daticert.xml
+// follows the Italian daylight saving time, whatever the zone of the host
+func TestGenerateAcceptanceEmail_Zona(t *testing.T) {
+	cert, key := createTestCertAndKeyForNonAcceptance(t)
+	signer := &common.Signer{Cert: cert, Key: key, Domain: "testdomain.com"}
+	local := time.Local
+	time.Local = time.UTC
+	t.Cleanup(func() {
+		time.Local = local
+		clock = time.Now
+	})
+
+	tests := []struct {
+		name    string
+		instant time.Time
+		giorno  string
+		ora     string
+		zona    string
+	}{
+		{"winter", time.Date(2024, 1, 15, 23, 30, 0, 0, time.UTC), "16/01/2024", "00:30:00", "+0100"},
+		{"summer", time.Date(2024, 7, 15, 23, 30, 0, 0, time.UTC), "16/07/2024", "01:30:00", "+0200"},
+		{"last winter hour", time.Date(2024, 3, 31, 0, 59, 59, 0, time.UTC), "31/03/2024", "01:59:59", "+0100"},
+		{"first summer hour", time.Date(2024, 3, 31, 1, 0, 0, 0, time.UTC), "31/03/2024", "03:00:00", "+0200"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock = func() time.Time { return tt.instant }
+			receipt, err := GenerateAcceptanceEmail("testdomain.com", "<zona@example.com>", "sender@example.com", []string{"recipient@testdomain.com"}, nil, "Zona", signer)
+			if err != nil {
+				t.Fatalf("GenerateAcceptanceEmail failed: %v", err)
+			}
+			var raw bytes.Buffer
+			if err := receipt.WriteTo(&raw); err != nil {
+				t.Fatalf("Failed to write receipt: %v", err)
+			}
+			_, datiCert, err := pec.ParsePecReader(bytes.NewReader(raw.Bytes()))
+			if err != nil {
+				t.Fatalf("ParsePec failed: %v", err)
+			}
+			data := datiCert.Dati.Data
+			if data.Giorno != tt.giorno || data.Ora != tt.ora || data.Zona != tt.zona {
+				t.Errorf("Expected %s %s %s, got %s %s %s", tt.giorno, tt.ora, tt.zona, data.Giorno, data.Ora, data.Zona)
+			}
+		})
+	}
+}
+
+// TestGenerateAcceptanceEmail_Cc tests that the acceptance receipt lists the
+// recipients in copy apart from the primary recipients
+func TestGenerateAcceptanceEmail_Cc(t *testing.T) {
+	cert, key := createTestCertAndKeyForNonAcceptance(t)
+	signer := &common.Signer{Cert: cert, Key: key, Domain: "testdomain.com"}
+
+	receipt, err := GenerateAcceptanceEmail("testdomain.com", "<cc@example.com>", "sender@example.com",
+		[]string{"primo@testdomain.com"}, []string{"copia@testdomain.com"}, "Copia", signer)
+	if err != nil {
+		t.Fatalf("GenerateAcceptanceEmail failed: %v", err)
+	}
+	var raw bytes.Buffer
+	if err := receipt.WriteTo(&raw); err != nil {
+		t.Fatalf("Failed to write receipt: %v", err)
+	}
+
+	_, datiCert, err := pec.ParsePecReader(bytes.NewReader(raw.Bytes()))
+	if err != nil {
+		t.Fatalf("ParsePec failed: %v", err)
+	}
+	want := []pec.Destinatario{{Tipo: "certificato", Val: "primo@testdomain.com"}, {Tipo: "certificato", Val: "copia@testdomain.com"}}
+	if len(datiCert.Intestazione.Destinatari) != len(want) {
+		t.Fatalf("Expected destinatari %+v, got %+v", want, datiCert.Intestazione.Destinatari)
+	}
+	for i, rcpt := range want {
+		if got := datiCert.Intestazione.Destinatari[i]; got != rcpt {
+			t.Errorf("Expected destinatario %+v, got %+v", rcpt, got)
+		}
+	}
+
+	written, err := message.Read(bytes.NewReader(raw.Bytes()))
+	if err != nil {
+		t.Fatalf("Failed to read receipt: %v", err)
+	}
+	html := htmlPart(t, written)
+	if !strings.Contains(html, "primo@testdomain.com (&quot;posta certificata&quot;)<br>") {
+		t.Errorf("Expected the primary recipient in the receipt, got %q", html)
+	}
+	if !strings.Contains(html, "copia@testdomain.com (&quot;posta certificata&quot;, in copia)<br>") {
+		t.Errorf("Expected the recipient in copy to be marked in the receipt, got %q", html)
+	}
+}
+
+// TestGenerateNonAcceptanceEmail_ParsesWithPecParser tests that the non-acceptance
+// notice is recognized by the pec parser
+func TestGenerateNonAcceptanceEmail_ParsesWithPecParser(t *testing.T) {
+	cert, key := createTestCertAndKeyForNonAcceptance(t)
+	signer := &common.Signer{Cert: cert, Key: key, Domain: "testdomain.com"}
+
+	validationError := ValidationError{
+		Reason:      "missing recipients",
+		MessageID:   "<roundtrip@example.com>",
+		From:        "sender@example.com",
+		To:          []string{"recipient@testdomain.com"},
+		Subject:     "Round trip",
+		GeneratedAt: time.Now(),
+	}
+	notice, err := GenerateNonAcceptanceEmail("testdomain.com", validationError, signer)
+	if err != nil {
+		t.Fatalf("GenerateNonAcceptanceEmail failed: %v", err)
+	}
+	var raw bytes.Buffer
+	if err := notice.WriteTo(&raw); err != nil {
+		t.Fatalf("Failed to write notice: %v", err)
+	}
+
+	pecMail, datiCert, err := pec.ParsePecReader(bytes.NewReader(raw.Bytes()))
+	if err != nil {
+		t.Fatalf("ParsePec failed: %v", err)
+	}
+	if pecMail.PecType != pec.NonAcceptanceReceipt {
+		t.Errorf("Expected NonAcceptanceReceipt, got %v", pecMail.PecType)
+	}
+	if datiCert.Tipo != pec.TipoNonAccettazione || datiCert.Dati.ErroreEsteso != validationError.Reason {
+		t.Errorf("Unexpected daticert type %q, errore-esteso %q", datiCert.Tipo, datiCert.Dati.ErroreEsteso)
+	}
+}
+
+// TestReceipts_EncodeNonASCIIHeaders tests that the acceptance and non-acceptance
+// receipts encode non-ASCII Subject and To headers
+func TestReceipts_EncodeNonASCIIHeaders(t *testing.T) {
+	cert, key := createTestCertAndKeyForNonAcceptance(t)
+	signer := &common.Signer{Cert: cert, Key: key, Domain: "testdomain.com"}
+
+	const subject = "Perchè la città è chiusa?"
+	const from = "Niccolò Rossi <niccolo@example.com>"
+	to := []string{"recipient@testdomain.com"}
+
+	acceptance, err := GenerateAcceptanceEmail("testdomain.com", "<id@example.com>", from, to, nil, subject, signer)
+	if err != nil {
+		t.Fatalf("GenerateAcceptanceEmail failed: %v", err)
+	}
+	nonAcceptance, err := GenerateNonAcceptanceEmail("testdomain.com", ValidationError{
+		Reason:      "test reason",
+		MessageID:   "<id@example.com>",
+		From:        from,
+		To:          to,
+		Subject:     subject,
+		GeneratedAt: time.Now(),
+	}, signer)
+	if err != nil {
+		t.Fatalf("GenerateNonAcceptanceEmail failed: %v", err)
+	}
+
+	receipts := map[string]struct {
+		entity *message.Entity
+		prefix string
+	}{
+		"acceptance":     {acceptance, "ACCETTAZIONE: "},
+		"non-acceptance": {nonAcceptance, "AVVISO DI NON ACCETTAZIONE: "},
+	}
+	for name, receipt := range receipts {
+		var raw bytes.Buffer
+		if err := receipt.entity.WriteTo(&raw); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+		headerBlock := raw.Bytes()[:bytes.Index(raw.Bytes(), []byte("\r\n\r\n"))]
+		for _, b := range headerBlock {
+			if b > 127 {
+				t.Fatalf("Expected the %s header to be 7-bit, got:\n%s", name, headerBlock)
+			}
+		}
+
+		header := mail.Header{Header: receipt.entity.Header}
+		if got, err := header.Subject(); err != nil || got != receipt.prefix+subject {
+			t.Errorf("Expected %s Subject %q, got %q (%v)", name, receipt.prefix+subject, got, err)
+		}
+		addrs, err := header.AddressList("To")
+		if err != nil || len(addrs) != 1 || addrs[0].Name != "Niccolò Rossi" || addrs[0].Address != "niccolo@example.com" {
+			t.Errorf("Expected %s To %q, got %v (%v)", name, from, addrs, err)
+		}
+	}
+}
+
+// TestReceipts_NoSubject tests that the acceptance and non-acceptance
+// receipts of a message without subject show the placeholder in their
+// Subject, text and daticert
+func TestReceipts_NoSubject(t *testing.T) {
+	cert, key := createTestCertAndKeyForNonAcceptance(t)
+	signer := &common.Signer{Cert: cert, Key: key, Domain: "testdomain.com"}
+	to := []string{"recipient@testdomain.com"}
+
+	acceptance, err := GenerateAcceptanceEmail("testdomain.com", "<id@example.com>", "sender@example.com", to, nil, "", signer)
+	if err != nil {
+		t.Fatalf("GenerateAcceptanceEmail failed: %v", err)
+	}
+	nonAcceptance, err := GenerateNonAcceptanceEmail("testdomain.com", ValidationError{
+		Reason:      "test reason",
+		MessageID:   "<id@example.com>",
+		From:        "sender@example.com",
+		To:          to,
+		GeneratedAt: time.Now(),
+	}, signer)
+	if err != nil {
+		t.Fatalf("GenerateNonAcceptanceEmail failed: %v", err)
+	}
+
+	receipts := map[string]struct {
+		entity *message.Entity
+		prefix string
+	}{
+		"acceptance":     {acceptance, "ACCETTAZIONE: "},
+		"non-acceptance": {nonAcceptance, "AVVISO DI NON ACCETTAZIONE: "},
+	}
+	for name, receipt := range receipts {
+		if got := receipt.entity.Header.Get("Subject"); got != receipt.prefix+common.NoSubject {
+			t.Errorf("Expected %s Subject %q, got %q", name, receipt.prefix+common.NoSubject, got)
+		}
+		var raw bytes.Buffer
+		if err := receipt.entity.WriteTo(&raw); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+		if !strings.Contains(raw.String(), common.NoSubject) {
+			t.Errorf("Expected the placeholder subject in the %s text", name)
+		}
+		_, datiCert, err := pec.ParsePecReader(bytes.NewReader(raw.Bytes()))
+		if err != nil {
+			t.Fatalf("ParsePec of %s failed: %v", name, err)
+		}
+		if datiCert.Intestazione.Oggetto != common.NoSubject {
+			t.Errorf("Expected %s oggetto %q, got %q", name, common.NoSubject, datiCert.Intestazione.Oggetto)
+		}
+	}
+}
+
+// isBase64Line reports whether line holds only characters of the base64 alphabet
+func isBase64Line(line string) bool {
+	return line != "" && strings.Trim(line, "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/=") == ""
+}
+
+// TestReceipts_Base64LineLength tests that the base64 encoded parts of the
+// acceptance and non-acceptance receipts are wrapped at 76 characters
+func TestReceipts_Base64LineLength(t *testing.T) {
+	cert, key := createTestCertAndKeyForNonAcceptance(t)
+	signer := &common.Signer{Cert: cert, Key: key, Domain: "testdomain.com"}
+	to := []string{"recipient@testdomain.com"}
+	subject := strings.Repeat("Oggetto lungo ", 20)
+
+	acceptance, err := GenerateAcceptanceEmail("testdomain.com", "<id@example.com>", "sender@example.com", to, nil, subject, signer)
+	if err != nil {
+		t.Fatalf("GenerateAcceptanceEmail failed: %v", err)
+	}
+	nonAcceptance, err := GenerateNonAcceptanceEmail("testdomain.com", ValidationError{
+		Reason:      "test reason",
+		MessageID:   "<id@example.com>",
+		From:        "sender@example.com",
+		To:          to,
+		Subject:     subject,
+		GeneratedAt: time.Now(),
+	}, signer)
+	if err != nil {
+		t.Fatalf("GenerateNonAcceptanceEmail failed: %v", err)
+	}
+
+	for name, receipt := range map[string]*message.Entity{"acceptance": acceptance, "non-acceptance": nonAcceptance} {
+		var raw bytes.Buffer
+		if err := receipt.WriteTo(&raw); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+		base64Lines := 0
+		for _, line := range strings.Split(raw.String(), "\r\n") {
+			if !isBase64Line(line) {
+				continue
+			}
+			base64Lines++
+			if len(line) > common.Base64LineLength {
+				t.Errorf("Expected %s base64 lines of at most %d characters, got %d", name, common.Base64LineLength, len(line))
+			}
+		}
+		if base64Lines < 2 {
+			t.Errorf("Expected wrapped base64 parts in the %s, got %d lines", name, base64Lines)
+		}
+	}
+}
+
+// htmlPart returns the decoded text/html part of a receipt
+func htmlPart(t *testing.T, receipt *message.Entity) string {
+	t.Helper()
+	var raw bytes.Buffer
+	if err := receipt.WriteTo(&raw); err != nil {
+		t.Fatalf("Failed to write receipt: %v", err)
+	}
+	entity, err := message.Read(&raw)
+	if err != nil {
+		t.Fatalf("Failed to read receipt: %v", err)
+	}
+	var html []byte
+	err = entity.Walk(func(path []int, part *message.Entity, err error) error {
+		if err != nil {
+			return err
+		}
+		if mediaType, _, _ := part.Header.ContentType(); mediaType == "text/html" {
+			html, err = io.ReadAll(part.Body)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Failed to walk receipt: %v", err)
+	}
+	if html == nil {
+		t.Fatalf("Expected a text/html part")
+	}
+	return string(html)
+}
+
+// TestReceipts_EscapeHTML tests that the HTML bodies escape the user
+// controlled values
+func TestReceipts_EscapeHTML(t *testing.T) {
+	cert, key := createTestCertAndKeyForNonAcceptance(t)
+	signer := &common.Signer{Cert: cert, Key: key, Domain: "testdomain.com"}
+
+	const subject = `<script>alert("x")</script> & co`
+	const from = "sender@example.com"
+	to := []string{"<b>recipient</b>@testdomain.com"}
+
+	acceptance, err := GenerateAcceptanceEmail("testdomain.com", "<id@example.com>", from, to, nil, subject, signer)
+	if err != nil {
+		t.Fatalf("GenerateAcceptanceEmail failed: %v", err)
+	}
+	nonAcceptance, err := GenerateNonAcceptanceEmail("testdomain.com", ValidationError{
+		Reason:      "test <reason>",
+		MessageID:   "<id@example.com>",
+		From:        from,
+		To:          to,
+		Subject:     subject,
+		GeneratedAt: time.Now(),
+	}, signer)
+	if err != nil {
+		t.Fatalf("GenerateNonAcceptanceEmail failed: %v", err)
+	}
+
+	for name, receipt := range map[string]*message.Entity{"acceptance": acceptance, "non-acceptance": nonAcceptance} {
+		html := htmlPart(t, receipt)
+		for _, raw := range []string{"<script>", "<b>", " & co", "<reason>", "<id@example.com>"} {
+			if strings.Contains(html, raw) {
+				t.Errorf("Expected %q to be escaped in the %s HTML body:\n%s", raw, name, html)
+			}
+		}
+		if !strings.Contains(html, "&lt;script&gt;") || !strings.Contains(html, "&amp; co") {
+			t.Errorf("Expected the escaped subject in the %s HTML body:\n%s", name, html)
+		}
+	}
+}
+
+// TestReceipts_SameIdentificativo tests that generating the receipts of a
+// message again, as on a retry, gives them the same identificativo
+func TestReceipts_SameIdentificativo(t *testing.T) {
+	cert, key := createTestCertAndKeyForNonAcceptance(t)
+	signer := &common.Signer{Cert: cert, Key: key, Domain: "testdomain.com"}
+
+	identificativo := func(receipt *message.Entity) string {
+		var raw bytes.Buffer
+		if err := receipt.WriteTo(&raw); err != nil {
+			t.Fatalf("Failed to write receipt: %v", err)
+		}
+		_, datiCert, err := pec.ParsePecReader(bytes.NewReader(raw.Bytes()))
+		if err != nil {
+			t.Fatalf("ParsePec failed: %v", err)
+		}
+		return datiCert.Dati.Identificativo
+	}
+	acceptance := func(messageID string) string {
+		receipt, err := GenerateAcceptanceEmail("testdomain.com", messageID, "sender@example.com",
+			[]string{"recipient@testdomain.com"}, nil, "Retry", signer)
+		if err != nil {
+			t.Fatalf("GenerateAcceptanceEmail failed: %v", err)
+		}
+		return identificativo(receipt)
+	}
+	nonAcceptance := func(messageID string) string {
+		receipt, err := GenerateNonAcceptanceEmail("testdomain.com", ValidationError{
+			Reason:      "missing recipients",
+			MessageID:   messageID,
+			From:        "sender@example.com",
+			To:          []string{"recipient@testdomain.com"},
+			Subject:     "Retry",
+			GeneratedAt: time.Now(),
+		}, signer)
+		if err != nil {
+			t.Fatalf("GenerateNonAcceptanceEmail failed: %v", err)
+		}
+		return identificativo(receipt)
+	}
+
+	first := acceptance("<retry@example.com>")
+	if first == "" || !strings.HasSuffix(first, "@testdomain.com") {
+		t.Fatalf("Unexpected identificativo %q", first)
+	}
+	if again := acceptance("<retry@example.com>"); again != first {
+		t.Errorf("Expected the same identificativo on a retry, got %q and %q", first, again)
+	}
+	if other := acceptance("<other@example.com>"); other == first {
+		t.Errorf("Expected another message to get another identificativo, got %q", other)
+	}
+
+	rejected := nonAcceptance("<retry@example.com>")
+	if again := nonAcceptance("<retry@example.com>"); again != rejected {
+		t.Errorf("Expected the same non-acceptance identificativo on a retry, got %q and %q", rejected, again)
+	}
+	if rejected == first {
+		t.Errorf("Expected the acceptance and non-acceptance identificativi to differ")
+	}
+	if nonAcceptance("") == nonAcceptance("") {
+		t.Errorf("Expected messages without Message-ID to get distinct identificativi")
+	}
+}
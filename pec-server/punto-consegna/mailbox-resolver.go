@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/danzipie/go-pec/pec-server/internal/common"
+	pec_storage "github.com/danzipie/go-pec/pec-server/internal/storage"
+	"github.com/emersion/go-message"
+)
+
+// MailboxResolver looks up the mailbox of a recipient, e.g. in a user
+// directory. Resolve returns an *UnknownRecipientError for recipients that
+// have no mailbox.
+type MailboxResolver interface {
+	Resolve(recipient string) (Mailbox, error)
+}
+
+// UnknownRecipientError reports a recipient without a mailbox; delivery
+// fails and a non-delivery notice is sent
+type UnknownRecipientError struct {
+	Recipient string
+}
+
+func (e *UnknownRecipientError) Error() string {
+	return fmt.Sprintf("unknown recipient %s", e.Recipient)
+}
+
+// ErrMailboxUnavailable is returned when the recipient's mailbox cannot take messages
+var ErrMailboxUnavailable = errors.New("mailbox unavailable")
+
+// StoreMailbox is the mailbox of an address in a message store
+type StoreMailbox struct {
+	Store   pec_storage.MessageStore
+	Address string
+}
+
+// DeliverMessage implements Mailbox.DeliverMessage
+func (m *StoreMailbox) DeliverMessage(msg *message.Entity) error {
+	return m.Store.AddMessage(m.Address, common.ConvertToIMAPMessage(msg))
+}
+
+// IsAvailable implements Mailbox.IsAvailable
+func (m *StoreMailbox) IsAvailable() bool {
+	return m.Store.Ping() == nil
+}
+
+// mailboxRegistry holds the mailboxes registered with RegisterMailbox
+type mailboxRegistry struct {
+	mu        sync.RWMutex
+	mailboxes map[string]Mailbox // key: lowercased address
+}
+
+// SetMailboxResolver sets the resolver consulted before the registered mailboxes
+func (s *PuntoConsegnaServer) SetMailboxResolver(resolver MailboxResolver) {
+	s.resolver = resolver
+}
+
+// RegisterMailbox registers the mailbox of address
+func (s *PuntoConsegnaServer) RegisterMailbox(address string, mailbox Mailbox) {
+	s.mailboxes.mu.Lock()
+	defer s.mailboxes.mu.Unlock()
+	if s.mailboxes.mailboxes == nil {
+		s.mailboxes.mailboxes = make(map[string]Mailbox)
+	}
+	s.mailboxes.mailboxes[strings.ToLower(address)] = mailbox
+}
+
+// resolveMailbox returns the mailbox of recipient: the one found by the
+// resolver, else the registered one. When neither a resolver nor any
+// mailbox is set up, every recipient has a mailbox in the message store.
+func (s *PuntoConsegnaServer) resolveMailbox(recipient string) (Mailbox, error) {
+	if s.resolver != nil {
+		mailbox, err := s.resolver.Resolve(recipient)
+		var unknown *UnknownRecipientError
+		switch {
+		case err == nil && mailbox != nil:
+			return mailbox, nil
+		case err != nil && !errors.As(err, &unknown):
+			return nil, fmt.Errorf("failed to resolve %s: %w", recipient, err)
+		}
+	}
+
+	s.mailboxes.mu.RLock()
+	mailbox, ok := s.mailboxes.mailboxes[strings.ToLower(recipient)]
+	registered := len(s.mailboxes.mailboxes)
+	s.mailboxes.mu.RUnlock()
+	if ok {
+		return mailbox, nil
+	}
+
+	if s.resolver == nil && registered == 0 {
+		return &StoreMailbox{Store: s.store, Address: recipient}, nil
+	}
+	return nil, &UnknownRecipientError{Recipient: recipient}
+}
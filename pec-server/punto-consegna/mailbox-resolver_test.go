@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	pec_storage "github.com/danzipie/go-pec/pec-server/internal/storage"
+	"github.com/emersion/go-message"
+)
+
+// recordingMailbox is a mailbox keeping the messages delivered to it
+type recordingMailbox struct {
+	unavailable bool
+	delivered   []*message.Entity
+}
+
+func (m *recordingMailbox) DeliverMessage(msg *message.Entity) error {
+	m.delivered = append(m.delivered, msg)
+	return nil
+}
+
+func (m *recordingMailbox) IsAvailable() bool {
+	return !m.unavailable
+}
+
+// mapResolver resolves the recipients in its map
+type mapResolver struct {
+	mailboxes map[string]Mailbox
+	err       error
+}
+
+func (r *mapResolver) Resolve(recipient string) (Mailbox, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	if mailbox, ok := r.mailboxes[recipient]; ok {
+		return mailbox, nil
+	}
+	return nil, &UnknownRecipientError{Recipient: recipient}
+}
+
+// testMessage returns a message to deliver
+func testMessage(t *testing.T) *message.Entity {
+	t.Helper()
+	msg, err := message.Read(strings.NewReader("From: sender@example.org\r\nSubject: test\r\n\r\nHello\r\n"))
+	if err != nil {
+		t.Fatalf("Failed to parse message: %v", err)
+	}
+	return msg
+}
+
+// TestDeliverMessage_Resolver tests delivery through the resolver and the registered mailboxes
+func TestDeliverMessage_Resolver(t *testing.T) {
+	found := &recordingMailbox{}
+	registered := &recordingMailbox{}
+	server := &PuntoConsegnaServer{domain: "example.com", store: pec_storage.NewInMemoryStore()}
+	server.SetMailboxResolver(&mapResolver{mailboxes: map[string]Mailbox{"found@example.com": found}})
+	server.RegisterMailbox("Registered@example.com", registered)
+
+	if err := server.DeliverMessage("found@example.com", testMessage(t)); err != nil {
+		t.Fatalf("Expected delivery to a resolved recipient, got %v", err)
+	}
+	if len(found.delivered) != 1 {
+		t.Errorf("Expected 1 message in the resolved mailbox, got %d", len(found.delivered))
+	}
+
+	// The registered mailboxes are the fallback of the resolver
+	if err := server.DeliverMessage("registered@example.com", testMessage(t)); err != nil {
+		t.Fatalf("Expected delivery to a registered recipient, got %v", err)
+	}
+	if len(registered.delivered) != 1 {
+		t.Errorf("Expected 1 message in the registered mailbox, got %d", len(registered.delivered))
+	}
+
+	err := server.DeliverMessage("missing@example.com", testMessage(t))
+	var unknown *UnknownRecipientError
+	if !errors.As(err, &unknown) || unknown.Recipient != "missing@example.com" {
+		t.Errorf("Expected an UnknownRecipientError for missing@example.com, got %v", err)
+	}
+}
+
+// TestDeliverMessage_ResolverFailure tests that a failing lookup is not taken for an unknown recipient
+func TestDeliverMessage_ResolverFailure(t *testing.T) {
+	server := &PuntoConsegnaServer{domain: "example.com", store: pec_storage.NewInMemoryStore()}
+	lookupErr := errors.New("directory unreachable")
+	server.SetMailboxResolver(&mapResolver{err: lookupErr})
+
+	err := server.DeliverMessage("user@example.com", testMessage(t))
+	var unknown *UnknownRecipientError
+	if !errors.Is(err, lookupErr) || errors.As(err, &unknown) {
+		t.Errorf("Expected the lookup error, got %v", err)
+	}
+}
+
+// TestDeliverMessage_UnavailableMailbox tests that an unavailable mailbox fails delivery
+func TestDeliverMessage_UnavailableMailbox(t *testing.T) {
+	server := &PuntoConsegnaServer{domain: "example.com", store: pec_storage.NewInMemoryStore()}
+	mailbox := &recordingMailbox{unavailable: true}
+	server.RegisterMailbox("user@example.com", mailbox)
+
+	if err := server.DeliverMessage("user@example.com", testMessage(t)); !errors.Is(err, ErrMailboxUnavailable) {
+		t.Errorf("Expected ErrMailboxUnavailable, got %v", err)
+	}
+	if len(mailbox.delivered) != 0 {
+		t.Errorf("Expected no delivery to an unavailable mailbox")
+	}
+}
+
+// TestDeliverMessage_DefaultsToStore tests that without resolver every recipient is delivered to the store
+func TestDeliverMessage_DefaultsToStore(t *testing.T) {
+	store := pec_storage.NewInMemoryStore()
+	server := &PuntoConsegnaServer{domain: "example.com", store: store}
+
+	if err := server.DeliverMessage("user@example.com", testMessage(t)); err != nil {
+		t.Fatalf("DeliverMessage failed: %v", err)
+	}
+	msgs, _ := store.GetMessages("user@example.com")
+	if len(msgs) != 1 {
+		t.Errorf("Expected 1 stored message, got %d", len(msgs))
+	}
+}
+
+// TestProcessMessage_UnknownRecipient tests that an unknown recipient fails
+// the delivery of a transport envelope, which triggers the non-delivery notice
+func TestProcessMessage_UnknownRecipient(t *testing.T) {
+	server := &PuntoConsegnaServer{domain: "example.com", store: pec_storage.NewInMemoryStore()}
+	server.SetMailboxResolver(&mapResolver{})
+	session := &PuntoConsegnaSession{server: server, from: "posta-certificata@sender.example.com"}
+
+	envelope, err := message.Read(strings.NewReader("From: posta-certificata@sender.example.com\r\n" +
+		"To: missing@example.com\r\n" +
+		"Subject: POSTA CERTIFICATA: test\r\n" +
+		"X-Trasporto: posta-certificata\r\n" +
+		"\r\n" +
+		"Messaggio di posta certificata\r\n"))
+	if err != nil {
+		t.Fatalf("Failed to parse envelope: %v", err)
+	}
+
+	err = session.processMessage(envelope, "missing@example.com")
+	var unknown *UnknownRecipientError
+	if !errors.As(err, &unknown) {
+		t.Errorf("Expected delivery to fail with an UnknownRecipientError, got %v", err)
+	}
+}
@@ -10,6 +10,7 @@ import (
 
 	"github.com/danzipie/go-pec/pec-server/logger"
 	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
 )
 
 func main() {
@@ -28,7 +29,7 @@ func main() {
 	http.HandleFunc("/api/receive", func(w http.ResponseWriter, r *http.Request) {
 		ReceiveHandler(w, r, server)
 	})
-	log.Println("Punto di Consegna HTTP API listening on", server.config.APIServer)
+	logger.LogInfo("Punto di Consegna HTTP API listening", map[string]string{"addr": server.config.APIServer})
 
 	// Start the server
 	// Handle graceful shutdown
@@ -54,9 +55,9 @@ func main() {
 	case err := <-errChan:
 		log.Fatalf("Server error: %v", err)
 	case sig := <-sigChan:
-		log.Printf("Received signal %v, shutting down...", sig)
+		logger.LogInfo("Received signal, shutting down", map[string]string{"signal": sig.String()})
 		if err := server.Stop(); err != nil {
-			log.Printf("Error during shutdown: %v", err)
+			logger.LogError("Error during shutdown", err, nil)
 		}
 	}
 
@@ -91,8 +92,15 @@ func ReceiveHandler(w http.ResponseWriter, r *http.Request, s *PuntoConsegnaServ
 	session := &PuntoConsegnaSession{
 		server: s,
 	}
+	// The non-delivery notices go to the sender of the envelope
+	if from, err := mail.ParseAddress(msg.Header.Get("From")); err == nil {
+		session.from = from.Address
+	}
 
-	if session.processMessage(msg, msg.Header.Get("To")) != nil {
+	// A recipient whose sender was notified of the failed delivery is
+	// handled: answering 5xx would make the reception point send the
+	// message again and notify the sender once more
+	if err := session.processMessage(msg, msg.Header.Get("To")); err != nil && !senderNotified(err) {
 		http.Error(w, "Failed to process message", http.StatusInternalServerError)
 		return
 	}
@@ -3,21 +3,38 @@ package main
 import (
 	"crypto/x509"
 	"fmt"
+	"time"
 
 	"github.com/danzipie/go-pec/pec-server/internal/common"
 	pec_storage "github.com/danzipie/go-pec/pec-server/internal/storage"
+	"github.com/danzipie/go-pec/pec-server/logger"
+	"github.com/danzipie/go-pec/pec-server/metrics"
 	"github.com/emersion/go-message"
 )
 
 // PuntoConsegnaServer represents a complete Punto Consegna server instance
 type PuntoConsegnaServer struct {
-	config      *common.Config
-	store       pec_storage.MessageStore
-	signer      *common.Signer
-	imapAddress string
-	certificate *x509.Certificate
-	privateKey  interface{}
-	domain      string
+	config          *common.Config
+	store           pec_storage.MessageStore
+	journal         pec_storage.Journal
+	queue           *common.OutboundQueue
+	dkim            *common.DKIMSigner
+	signer          *common.Signer
+	credentials     *common.CredentialsWatcher
+	tlsCertificates *common.CertificateHolder
+	clientCAs       *x509.CertPool
+	health          *common.Health
+	imapAddress     string
+	certificate     *x509.Certificate
+	privateKey      interface{}
+	domain          string
+	resolver        MailboxResolver
+	mailboxes       mailboxRegistry
+	receipts        *common.ReceiptTemplates
+	from            common.ProviderFrom
+	location        *time.Location
+	webhook         *common.Webhook
+	workers         int
 }
 
 // Mailbox represents a destination mailbox
@@ -34,8 +51,11 @@ func NewPuntoConsegnaServer(configPath string) (*PuntoConsegnaServer, error) {
 		return nil, fmt.Errorf("failed to load config: %v", err)
 	}
 
+	// Keep personal data out of the logs, if configured
+	logger.SetRedaction(cfg.RedactLogs)
+
 	// Load S/MIME credentials
-	cert, key, err := common.LoadSMIMECredentials(cfg.CertFile, cfg.KeyFile)
+	cert, key, chain, err := common.LoadCredentials(cfg)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load S/MIME credentials: %v", err)
 	}
@@ -44,24 +64,128 @@ func NewPuntoConsegnaServer(configPath string) (*PuntoConsegnaServer, error) {
 	signer := &common.Signer{
 		Cert:   cert,
 		Key:    key,
+		Chain:  chain,
 		Domain: cfg.Domain,
 	}
 
+	// Warn about an expiring certificate and pick up renewed ones
+	credentials := common.NewCredentialsWatcher(cfg, signer)
+	credentials.CheckExpiry()
+
+	// Load the TLS certificate of the listeners, if configured
+	tlsCertificates, err := common.LoadTLSCertificates(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Load the CAs of the providers allowed to connect with mutual TLS
+	clientCAs, err := common.LoadClientCAs(cfg)
+	if err != nil {
+		return nil, err
+	}
+
 	// Create message store
-	var messageStore pec_storage.MessageStore
-
-	// Default to in-memory store
-	messageStore = pec_storage.NewInMemoryStore()
-
-	return &PuntoConsegnaServer{
-		config:      cfg,
-		store:       messageStore,
-		signer:      signer,
-		imapAddress: cfg.IMAPServer,
-		certificate: cert,
-		privateKey:  key,
-		domain:      cfg.Domain,
-	}, nil
+	messageStore, err := common.NewMessageStore(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create message store: %v", err)
+	}
+
+	// Open the journal, if configured
+	var journal pec_storage.Journal
+	if cfg.JournalFile != "" {
+		fileJournal, err := pec_storage.NewFileJournal(cfg.JournalFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open journal: %v", err)
+		}
+		journal = fileJournal
+	}
+
+	// Load the DKIM key, if configured
+	var dkimSigner *common.DKIMSigner
+	if cfg.DKIMKeyFile != "" {
+		dkimSigner, err = common.LoadDKIMSigner(cfg.Domain, cfg.DKIMSelector, cfg.DKIMKeyFile, cfg.DKIMHeaders)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load DKIM key: %v", err)
+		}
+	}
+
+	// Render the receipts in the configured locale
+	receipts, err := common.LoadReceiptTemplates(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load receipt templates: %v", err)
+	}
+
+	// Give the dates of the receipts in the configured zone
+	location, err := common.LoadTimezone(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	server := &PuntoConsegnaServer{
+		config:          cfg,
+		store:           messageStore,
+		journal:         journal,
+		signer:          signer,
+		credentials:     credentials,
+		tlsCertificates: tlsCertificates,
+		clientCAs:       clientCAs,
+		health:          common.NewHealth(messageStore, "imap"),
+		imapAddress:     cfg.IMAPServer,
+		certificate:     cert,
+		privateKey:      key,
+		domain:          cfg.Domain,
+		dkim:            dkimSigner,
+		receipts:        receipts,
+		from:            common.NewProviderFrom(cfg),
+		location:        location,
+		webhook:         common.NewWebhook(cfg),
+		workers:         cfg.DeliveryWorkers,
+	}
+
+	// Open the outbound queue, if configured
+	if cfg.QueueDir != "" {
+		queue, err := common.NewOutboundQueue(cfg.QueueDir, server.sendOutbound)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open outbound queue: %v", err)
+		}
+		server.queue = queue
+	}
+
+	return server, nil
+}
+
+// defaultReceiptTemplates renders the receipts of a server built without
+// NewPuntoConsegnaServer
+var defaultReceiptTemplates = common.DefaultReceiptTemplates()
+
+// receiptTemplates returns the templates the receipts are rendered with
+func (s *PuntoConsegnaServer) receiptTemplates() *common.ReceiptTemplates {
+	if s.receipts == nil {
+		return defaultReceiptTemplates
+	}
+	return s.receipts
+}
+
+// now returns the current time in the zone the dates of the receipts are
+// given in
+func (s *PuntoConsegnaServer) now() time.Time {
+	if s.location == nil {
+		return time.Now().In(common.DefaultLocation)
+	}
+	return time.Now().In(s.location)
+}
+
+// defaultDeliveryWorkers is the number of recipients of a message delivered
+// to at the same time, unless configured
+const defaultDeliveryWorkers = 4
+
+// deliveryWorkers returns the number of recipients of a message delivered
+// to at the same time
+func (s *PuntoConsegnaServer) deliveryWorkers() int {
+	if s.workers <= 0 {
+		return defaultDeliveryWorkers
+	}
+	return s.workers
 }
 
 // Start starts both SMTP and IMAP servers
@@ -69,24 +193,110 @@ func (s *PuntoConsegnaServer) Start() error {
 
 	// Create IMAP backend
 	imapBackend := common.NewIMAPBackend(s.store, s.certificate, s.privateKey)
+	imapBackend.Certificates = s.tlsCertificates
+	imapBackend.ClientCAs = s.clientCAs
+	imapBackend.ServerName = s.config.Hostname()
+	imapBackend.Greeting = s.config.IMAPGreeting
+
+	// Start the outbound queue worker
+	if s.queue != nil {
+		s.queue.Start()
+	}
+
+	// Serve the dead-letter admin endpoints, if configured
+	if s.config.AdminServer != "" && s.queue != nil {
+		admin := common.NewDeadLetterAdmin(s.queue, s.journal)
+		go func() {
+			if err := common.StartAdminServer(s.config.AdminServer, admin); err != nil {
+				logger.LogError("Admin server failed", err, map[string]string{"addr": s.config.AdminServer})
+			}
+		}()
+	}
+
+	// Serve the health endpoints, if configured
+	if s.config.HealthServer != "" {
+		go func() {
+			if err := common.StartHealthServer(s.config.HealthServer, s.health); err != nil {
+				logger.LogError("Health server failed", err, map[string]string{"addr": s.config.HealthServer})
+			}
+		}()
+	}
+
+	// Watch the credential files for renewals
+	s.credentials.Start()
+	if s.tlsCertificates != nil {
+		s.tlsCertificates.Start(s.credentials.Interval)
+	}
+
+	// Serve the metrics endpoint, if configured
+	if s.config.MetricsServer != "" {
+		go func() {
+			if err := metrics.StartServer(s.config.MetricsServer); err != nil {
+				logger.LogError("Metrics server failed", err, map[string]string{"addr": s.config.MetricsServer})
+			}
+		}()
+	}
 
 	// Start IMAP server (blocking)
-	return common.StartIMAPWithTLS(s.imapAddress, imapBackend)
+	return common.StartIMAPWithTLS(s.imapAddress, imapBackend, s.health)
 }
 
 // Stop gracefully shuts down all servers
 func (s *PuntoConsegnaServer) Stop() error {
+	// Stop the outbound queue worker
+	if s.queue != nil {
+		s.queue.Stop()
+	}
+
+	// Stop watching the credential files
+	s.credentials.Stop()
+	if s.tlsCertificates != nil {
+		s.tlsCertificates.Stop()
+	}
+
 	// Close the message store
 	if err := s.store.Close(); err != nil {
 		return fmt.Errorf("failed to close message store: %v", err)
 	}
+	// Close the journal
+	if s.journal != nil {
+		if err := s.journal.Close(); err != nil {
+			return fmt.Errorf("failed to close journal: %v", err)
+		}
+	}
+	// Wait for the webhook notifications being posted
+	s.webhook.Close()
 	return nil
 }
 
-func (s *PuntoConsegnaServer) DeliverMessage(to string, msg *message.Entity) error {
+// record appends an entry about a message from from to the recipient to the
+// journal and notifies the webhook, if configured
+func (s *PuntoConsegnaServer) record(entry pec_storage.JournalEntry, from, to string) {
+	s.webhook.NotifyEntry(entry, from, []string{to})
+	if s.journal == nil {
+		return
+	}
+	if err := s.journal.Record(entry); err != nil {
+		logger.LogError("Failed to record journal entry", err, map[string]string{"message_id": entry.MessageID})
+	}
+}
+
+// recordResult records event for messageID, from from to the recipient to,
+// with an outcome derived from err
+func (s *PuntoConsegnaServer) recordResult(event pec_storage.JournalEvent, messageID, from, to string, err error) {
+	s.record(common.ResultEntry(event, messageID, err), from, to)
+}
 
-	imapMsg := common.ConvertToIMAPMessage(msg)
+// DeliverMessage delivers msg to the mailbox of to
+func (s *PuntoConsegnaServer) DeliverMessage(to string, msg *message.Entity) error {
+	mailbox, err := s.resolveMailbox(to)
+	if err != nil {
+		return err
+	}
+	if !mailbox.IsAvailable() {
+		return ErrMailboxUnavailable
+	}
 
 	// Deliver the message to the mailbox
-	return s.store.AddMessage(to, imapMsg)
+	return mailbox.DeliverMessage(msg)
 }
@@ -2,13 +2,18 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/danzipie/go-pec/pec"
 	"github.com/danzipie/go-pec/pec-server/internal/common"
+	pec_storage "github.com/danzipie/go-pec/pec-server/internal/storage"
+	"github.com/danzipie/go-pec/pec-server/logger"
+	"github.com/danzipie/go-pec/pec-server/metrics"
 	"github.com/emersion/go-message"
 	"github.com/emersion/go-message/mail"
 	"github.com/emersion/go-sasl"
@@ -39,21 +44,100 @@ func (s *PuntoConsegnaSession) Rcpt(to string, opts *smtp.RcptOptions) error {
 }
 
 func (s *PuntoConsegnaSession) Data(r io.Reader) error {
-	// Parse the incoming message
-	msg, err := message.Read(r)
+	// The message is read once and parsed again for each recipient, as the
+	// body of a parsed message can be read only once
+	data, err := io.ReadAll(r)
 	if err != nil {
+		return fmt.Errorf("failed to read message: %w", err)
+	}
+	if _, err := message.Read(bytes.NewReader(data)); err != nil {
 		return fmt.Errorf("failed to parse message: %w", err)
 	}
 
-	// Process each recipient
-	for _, recipient := range s.to {
-		if err := s.processMessage(msg, recipient); err != nil {
-			log.Printf("Error processing message for %s: %v", recipient, err)
-			// Continue processing other recipients
+	// The recipients that failed are logged and notified to the sender; the
+	// message is not refused for them
+	s.processRecipients(data)
+	return nil
+}
+
+// ErrSenderNotified is wrapped by the error of a recipient whose delivery
+// failed and whose sender was sent the non-delivery notice: the failure is
+// handled and the message must not be sent again
+var ErrSenderNotified = errors.New("sender notified")
+
+// senderNotified reports whether every recipient failure joined in err was
+// notified to the sender
+func senderNotified(err error) bool {
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok {
+		return errors.Is(err, ErrSenderNotified)
+	}
+	for _, recipientErr := range joined.Unwrap() {
+		if !errors.Is(recipientErr, ErrSenderNotified) {
+			return false
 		}
 	}
+	return true
+}
 
-	return nil
+// deliveryResult is the outcome of the delivery of a message to a recipient
+type deliveryResult struct {
+	msg *message.Entity
+	err error
+}
+
+// processRecipients processes the message data for each recipient of the
+// session. The message is delivered to up to deliveryWorkers recipients at a
+// time, then the receipts are emitted in the order of the recipients. The
+// errors of the recipients that failed are returned joined.
+func (s *PuntoConsegnaSession) processRecipients(data []byte) error {
+	results := make([]deliveryResult, len(s.to))
+	workers := make(chan struct{}, s.server.deliveryWorkers())
+	var wg sync.WaitGroup
+	for i, recipient := range s.to {
+		workers <- struct{}{}
+		wg.Add(1)
+		go func(i int, recipient string) {
+			defer wg.Done()
+			defer func() { <-workers }()
+			msg, err := message.Read(bytes.NewReader(data))
+			if err != nil {
+				results[i] = deliveryResult{err: fmt.Errorf("failed to parse message: %w", err)}
+				return
+			}
+			results[i] = deliveryResult{msg: msg, err: s.deliver(msg, recipient)}
+		}(i, recipient)
+	}
+	wg.Wait()
+
+	var errs []error
+	for i, recipient := range s.to {
+		result := results[i]
+		if result.msg == nil {
+			errs = append(errs, fmt.Errorf("%s: %w", recipient, result.err))
+			continue
+		}
+		// The delivery consumed the body of its copy of the message, which
+		// the receipt may include
+		if msg, err := message.Read(bytes.NewReader(data)); err == nil {
+			result.msg = msg
+		}
+		if err := s.emitReceipt(result.msg, recipient, result.err); err != nil {
+			logger.LogError("Error processing message", err, s.logContext(result.msg, recipient))
+			errs = append(errs, fmt.Errorf("%s: %w", recipient, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// logContext returns the structured fields identifying a message being
+// processed for a recipient.
+func (s *PuntoConsegnaSession) logContext(msg *message.Entity, recipient string) map[string]string {
+	return map[string]string{
+		"from":       s.from,
+		"to":         recipient,
+		"message_id": msg.Header.Get("Message-ID"),
+	}
 }
 
 func (s *PuntoConsegnaSession) Reset() {
@@ -65,40 +149,73 @@ func (s *PuntoConsegnaSession) Logout() error {
 	return nil
 }
 
-// processMessage handles the core PEC logic for a single recipient
+// processMessage handles the core PEC logic for a single recipient. The body
+// of msg is consumed: it is buffered so that the delivery and the receipt
+// each read the whole message.
 func (s *PuntoConsegnaSession) processMessage(msg *message.Entity, recipient string) error {
-	// Check if this is a transport envelope (busta di trasporto)
-	isTransportEnvelope := common.IsTransportEnvelope(msg)
+	var data bytes.Buffer
+	if err := msg.WriteTo(&data); err != nil {
+		return fmt.Errorf("failed to read message: %w", err)
+	}
+	session := *s
+	session.to = []string{recipient}
+	return session.processRecipients(data.Bytes())
+}
+
+// deliver delivers msg to the mailbox of recipient, or saves it to the store
+// when it is a regular message, and returns the delivery error
+func (s *PuntoConsegnaSession) deliver(msg *message.Entity, recipient string) error {
+	messageID := msg.Header.Get("Message-ID")
+	s.server.record(pec_storage.JournalEntry{Event: pec_storage.EventReceived, MessageID: messageID}, s.from, recipient)
+	metrics.MessagesReceived.Inc()
 
 	var deliveryErr error
-	deliveryErr = nil
-	if isTransportEnvelope {
-		log.Printf("Processing transport envelope for recipient: %s", recipient)
+	if common.IsTransportEnvelope(msg) {
+		logger.LogInfo("Processing transport envelope", s.logContext(msg, recipient))
 		deliveryErr = s.server.DeliverMessage(recipient, msg)
 	} else {
-		log.Printf("Processing regular message for recipient: %s", recipient)
+		logger.LogInfo("Processing regular message", s.logContext(msg, recipient))
 		// save the message to the store
 		imapMessage := common.ConvertToIMAPMessage(msg)
 		if err := s.server.store.AddMessage(recipient, imapMessage); err != nil {
-			return fmt.Errorf("failed to save message: %w", err)
+			deliveryErr = fmt.Errorf("failed to save message: %w", err)
 		}
-
 	}
+	s.server.recordResult(pec_storage.EventDelivered, messageID, s.from, recipient, deliveryErr)
+	return deliveryErr
+}
+
+// emitReceipt completes the processing of msg for recipient after its
+// delivery: the sender of a transport envelope is sent a delivery receipt,
+// or a non-delivery notice when deliveryErr is set
+func (s *PuntoConsegnaSession) emitReceipt(msg *message.Entity, recipient string, deliveryErr error) error {
+	isTransportEnvelope := common.IsTransportEnvelope(msg)
+	messageID := msg.Header.Get("Message-ID")
 
 	if deliveryErr != nil {
-		// Delivery failed - send non-delivery notice if it was a transport envelope
-		if isTransportEnvelope {
-			if err := s.sendNonDeliveryNotice(s.from, msg, recipient, deliveryErr); err != nil {
-				log.Printf("Failed to send non-delivery notice: %v", err)
-			}
+		metrics.MessagesRejected.Inc()
+		if !isTransportEnvelope {
+			return deliveryErr
 		}
-		return fmt.Errorf("delivery failed: %w", deliveryErr)
+		// Delivery failed - send non-delivery notice
+		err := s.sendNonDeliveryNotice(s.from, msg, recipient, deliveryErr)
+		s.server.recordResult(pec_storage.EventReceiptEmitted, messageID, s.from, recipient, err)
+		if err != nil {
+			logger.LogError("Failed to send non-delivery notice", err, s.logContext(msg, recipient))
+			return fmt.Errorf("delivery failed: %w", deliveryErr)
+		}
+		return fmt.Errorf("delivery failed: %w (%w)", deliveryErr, ErrSenderNotified)
 	}
 
 	// Delivery succeeded - send delivery receipt if it was a transport envelope
+	metrics.MessagesDelivered.Inc()
 	if isTransportEnvelope {
-		if err := s.sendDeliveryReceipt(s.from, msg, recipient); err != nil {
-			log.Printf("Failed to send delivery receipt: %v", err)
+		err := s.sendDeliveryReceipt(s.from, msg, recipient)
+		entry := common.ResultEntry(pec_storage.EventReceiptEmitted, messageID, err)
+		entry.Identificativo = s.receiptIdentifier(msg, recipient)
+		s.server.record(entry, s.from, recipient)
+		if err != nil {
+			logger.LogError("Failed to send delivery receipt", err, s.logContext(msg, recipient))
 			// Don't return error - message was delivered successfully
 		}
 	}
@@ -106,23 +223,46 @@ func (s *PuntoConsegnaSession) processMessage(msg *message.Entity, recipient str
 	return nil
 }
 
-// SendEntity sends a message entity using SMTP
+// SendEntity sends a message entity using SMTP, through the outbound queue when one is configured
 func (s *PuntoConsegnaSession) SendEntity(receipt *message.Entity, to []string) error {
-	var w io.Writer
-	receipt.WriteTo(w)
+	var buf bytes.Buffer
+	if err := receipt.WriteTo(&buf); err != nil {
+		return fmt.Errorf("failed to write message: %w", err)
+	}
+
+	if s.server.queue != nil {
+		return s.server.queue.Enqueue(common.OutboundItem{Kind: common.OutboundSMTP, To: to, Data: buf.Bytes()})
+	}
+	return s.server.sendMail(to, buf.Bytes())
+}
+
+// sendOutbound delivers an item taken from the outbound queue
+func (s *PuntoConsegnaServer) sendOutbound(item *common.OutboundItem) error {
+	return s.sendMail(item.To, item.Data)
+}
+
+// sendMail sends raw message data using SMTP
+func (s *PuntoConsegnaServer) sendMail(to []string, data []byte) error {
+	if s.dkim != nil {
+		signed, err := s.dkim.Sign(data)
+		if err != nil {
+			return fmt.Errorf("failed to DKIM sign message: %v", err)
+		}
+		data = signed
+	}
 
 	// Set up authentication information.
 	auth := sasl.NewPlainClient("", "user@example.com", "password")
 
 	// Connect to the server, authenticate, set the sender and recipient,
 	// and send the email all in one step.
-	msg := bytes.NewReader(w.(*bytes.Buffer).Bytes())
-	return smtp.SendMail(fmt.Sprintf("postmaster@%s", s.server.domain), auth, "me", to, msg)
+	msg := bytes.NewReader(data)
+	return smtp.SendMail(fmt.Sprintf("postmaster@%s", s.domain), auth, "me", to, msg)
 }
 
 // sendDeliveryReceipt sends a "ricevuta di avvenuta consegna"
 func (s *PuntoConsegnaSession) sendDeliveryReceipt(originalSender string, originalMsg *message.Entity, recipient string) error {
-	log.Printf("Sending delivery receipt to %s for message delivered to %s", originalSender, recipient)
+	logger.LogDelivery(originalSender, recipient, originalMsg.Header.Get("Message-ID"), "avvenuta-consegna")
 
 	// Create delivery receipt message
 	receipt := s.createDeliveryReceipt(originalMsg, recipient)
@@ -131,7 +271,7 @@ func (s *PuntoConsegnaSession) sendDeliveryReceipt(originalSender string, origin
 
 // sendNonDeliveryNotice sends an "avviso di mancata consegna"
 func (s *PuntoConsegnaSession) sendNonDeliveryNotice(originalSender string, originalMsg *message.Entity, recipient string, deliveryErr error) error {
-	log.Printf("Sending non-delivery notice to %s for failed delivery to %s: %v", originalSender, recipient, deliveryErr)
+	logger.LogDelivery(originalSender, recipient, originalMsg.Header.Get("Message-ID"), "mancata-consegna")
 
 	// Create non-delivery notice
 	notice := s.createNonDeliveryNotice(originalMsg, recipient, deliveryErr)
@@ -143,11 +283,23 @@ func (s *PuntoConsegnaSession) sendNonDeliveryNotice(originalSender string, orig
 type ReceiptType int
 
 const (
-	ReceiptTypeNormal ReceiptType = iota
+	ReceiptTypeComplete ReceiptType = iota
 	ReceiptTypeShort
 	ReceiptTypeSynthetic
 )
 
+// String returns the X-TipoRicevuta value of the receipt type
+func (t ReceiptType) String() string {
+	switch t {
+	case ReceiptTypeShort:
+		return "breve"
+	case ReceiptTypeSynthetic:
+		return "sintetica"
+	default:
+		return "completa"
+	}
+}
+
 // parseReceiptType determines the receipt type from X-TipoRicevuta header
 func parseReceiptType(msg *message.Entity) ReceiptType {
 	tipoRicevuta := strings.ToLower(strings.TrimSpace(msg.Header.Get("X-TipoRicevuta")))
@@ -158,8 +310,8 @@ func parseReceiptType(msg *message.Entity) ReceiptType {
 	case "sintetica":
 		return ReceiptTypeSynthetic
 	default:
-		// If absent or unrecognized, default to normal
-		return ReceiptTypeNormal
+		// If absent, "completa" or unrecognized, default to a complete receipt
+		return ReceiptTypeComplete
 	}
 }
 
@@ -167,42 +319,32 @@ func parseReceiptType(msg *message.Entity) ReceiptType {
 func (s *PuntoConsegnaSession) createDeliveryReceipt(originalMsg *message.Entity, recipient string) *message.Entity {
 	// Generate unique message ID
 	msgID := common.GenerateMessageID(s.server.domain)
-	timestamp := time.Now()
+	timestamp := s.server.now()
 
 	// Determine receipt type from original message
 	receiptType := parseReceiptType(originalMsg)
 
 	// Get original subject
-	originalSubject := originalMsg.Header.Get("Subject")
-	if originalSubject == "" {
-		originalSubject = "(nessun oggetto)"
-	}
+	originalSubject := decodedSubject(originalMsg)
 
 	// Create receipt header according to specifications
 	header := message.Header{}
 	header.Set("Message-ID", msgID)
 	header.Set("X-Ricevuta", "avvenuta-consegna")
-	header.Set("Date", timestamp.Format(time.RFC822))
-	header.Set("Subject", fmt.Sprintf("CONSEGNA: %s", originalSubject))
-	header.Set("From", fmt.Sprintf("posta-certificata@%s", s.server.domain))
+	header.Set("Date", timestamp.Format(time.RFC1123Z))
+	header.Set("Subject", common.EncodeHeaderText(fmt.Sprintf("CONSEGNA: %s", originalSubject)))
+	header.Set("From", common.FormatAddress(s.server.from.Address(s.server.domain)))
 	header.Set("To", originalMsg.Header.Get("From"))
-	header.Set("X-Riferimento-Message-ID", originalMsg.Header.Get("Message-ID"))
+	common.SetReferenceHeaders(&header, common.OriginalMessageID(&originalMsg.Header))
 
 	// Add receipt type indicator
-	switch receiptType {
-	case ReceiptTypeShort:
-		header.Set("X-Tipo-Ricevuta", "breve")
-	case ReceiptTypeSynthetic:
-		header.Set("X-Tipo-Ricevuta", "sintetica")
-	default:
-		header.Set("X-Tipo-Ricevuta", "normale")
-	}
+	header.Set("X-TipoRicevuta", receiptType.String())
 
 	// Create receipt body based on type
 	var body io.Reader
 	switch receiptType {
-	case ReceiptTypeNormal:
-		body = s.createNormalReceiptBody(originalMsg, recipient, timestamp)
+	case ReceiptTypeComplete:
+		body = s.createCompleteReceiptBody(originalMsg, recipient, timestamp)
 	case ReceiptTypeShort:
 		body = s.createShortReceiptBody(originalMsg, recipient, timestamp)
 	case ReceiptTypeSynthetic:
@@ -224,31 +366,15 @@ const (
 	RecipientTypeAmbiguous // When we can't determine with certainty
 )
 
-// determineRecipientType analyzes To/CC fields to determine recipient type
+// determineRecipientType analyzes To/CC fields to determine recipient type.
+// A recipient listed in both is a primary recipient.
 func determineRecipientType(originalMsg *message.Entity, recipient string) RecipientType {
-	toField := originalMsg.Header.Get("To")
-	ccField := originalMsg.Header.Get("Cc")
-
-	// Parse addresses from To field
-	toAddresses, err := mail.ParseAddressList(toField)
-	if err == nil {
-		for _, addr := range toAddresses {
-			if strings.EqualFold(addr.Address, recipient) {
-				return RecipientTypePrimary
-			}
-		}
+	to, cc := common.SplitRecipients(&mail.Header{Header: originalMsg.Header})
+	if containsAddress(to, recipient) {
+		return RecipientTypePrimary
 	}
-
-	// Parse addresses from CC field
-	if ccField != "" {
-		ccAddresses, err := mail.ParseAddressList(ccField)
-		if err == nil {
-			for _, addr := range ccAddresses {
-				if strings.EqualFold(addr.Address, recipient) {
-					return RecipientTypeCC
-				}
-			}
-		}
+	if containsAddress(cc, recipient) {
+		return RecipientTypeCC
 	}
 
 	// If we can't determine with certainty (ambiguous), treat as primary
@@ -256,40 +382,43 @@ func determineRecipientType(originalMsg *message.Entity, recipient string) Recip
 	return RecipientTypeAmbiguous
 }
 
-// createNormalReceiptBody creates the body for a normal delivery receipt
-func (s *PuntoConsegnaSession) createNormalReceiptBody(originalMsg *message.Entity, recipient string, timestamp time.Time) io.Reader {
+// containsAddress reports whether addrs holds addr, ignoring case
+func containsAddress(addrs []string, addr string) bool {
+	for _, a := range addrs {
+		if strings.EqualFold(a, addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// createCompleteReceiptBody creates the body for a complete delivery receipt
+func (s *PuntoConsegnaSession) createCompleteReceiptBody(originalMsg *message.Entity, recipient string, timestamp time.Time) io.Reader {
 	// Determine recipient type to decide whether to include original message
 	recipientType := determineRecipientType(originalMsg, recipient)
 	includeOriginal := recipientType == RecipientTypePrimary || recipientType == RecipientTypeAmbiguous
 
 	// Get original message details
 	originalSender := originalMsg.Header.Get("From")
-	originalSubject := originalMsg.Header.Get("Subject")
-	originalMessageID := originalMsg.Header.Get("Message-ID")
+	originalSubject := decodedSubject(originalMsg)
+	originalMessageID := common.OriginalMessageID(&originalMsg.Header)
 
-	if originalSubject == "" {
-		originalSubject = "(nessun oggetto)"
-	}
 	if originalMessageID == "" {
 		originalMessageID = "(non disponibile)"
 	}
 
-	// Format timestamp according to Italian locale
-	dateStr := timestamp.Format("02/01/2006")
-	timeStr := timestamp.Format("15:04:05")
-	zone := timestamp.Format("MST")
-
 	// Create human-readable receipt text
-	receiptText := fmt.Sprintf(`Ricevuta di avvenuta consegna
-Il giorno %s alle ore %s (%s) il messaggio
-"%s" proveniente da "%s"
-ed indirizzato a "%s" è stato consegnato nella casella di destinazione.
-Identificativo messaggio: %s`,
-		dateStr, timeStr, zone,
-		originalSubject,
-		originalSender,
-		recipient,
-		originalMessageID)
+	receiptText, err := s.server.receiptTemplates().Text(pec.TipoAvvenutaConsegna, common.ReceiptData{
+		Date:      timestamp,
+		Subject:   originalSubject,
+		From:      originalSender,
+		To:        []string{recipient},
+		MessageID: originalMessageID,
+	})
+	if err != nil {
+		logger.LogError("Error rendering receipt", err, s.logContext(originalMsg, recipient))
+		return strings.NewReader("Error creating receipt")
+	}
 
 	// Create multipart message using emersion/go-message
 	var buf bytes.Buffer
@@ -301,7 +430,7 @@ Identificativo messaggio: %s`,
 	// Create multipart writer
 	mw, err := message.CreateWriter(&buf, header)
 	if err != nil {
-		log.Printf("Error creating multipart writer: %v", err)
+		logger.LogError("Error creating multipart writer", err, s.logContext(originalMsg, recipient))
 		return strings.NewReader("Error creating receipt")
 	}
 
@@ -320,7 +449,7 @@ Identificativo messaggio: %s`,
 	xmlData := s.createCertificationXML(originalMsg, recipient, timestamp)
 	xmlHeader := message.Header{}
 	xmlHeader.Set("Content-Type", "application/xml")
-	xmlHeader.Set("Content-Disposition", "attachment; filename=\"certificazione.xml\"")
+	xmlHeader.Set("Content-Disposition", "attachment; filename=\"daticert.xml\"")
 
 	xmlWriter, err := mw.CreatePart(xmlHeader)
 	if err == nil {
@@ -353,63 +482,63 @@ Identificativo messaggio: %s`,
 	return &buf
 }
 
+// decodedSubject returns the decoded Subject of the original message, for
+// rendering in receipts
+func decodedSubject(originalMsg *message.Entity) string {
+	return common.SubjectText(common.DecodeHeaderText(originalMsg.Header.Get("Subject")))
+}
+
 // createCertificationXML creates the XML certification data
 func (s *PuntoConsegnaSession) createCertificationXML(originalMsg *message.Entity, recipient string, timestamp time.Time) string {
-	// Get original message details
-	originalSender := originalMsg.Header.Get("From")
-	originalSubject := originalMsg.Header.Get("Subject")
-	originalMessageID := originalMsg.Header.Get("Message-ID")
+	originalSubject := decodedSubject(originalMsg)
 
-	if originalSubject == "" {
-		originalSubject = "(nessun oggetto)"
+	xmlData := pec.NewDatiCert(pec.TipoAvvenutaConsegna, pec.ErroreNessuno, common.ProviderName(s.server.domain), timestamp)
+	// The transport envelope carries the original sender in Reply-To
+	sender := originalMsg.Header.Get("Reply-To")
+	if sender == "" {
+		sender = originalMsg.Header.Get("From")
 	}
-	if originalMessageID == "" {
-		originalMessageID = "(non disponibile)"
-	}
-
-	// Create XML with certification data
-	// TODO: This is a basic structure - you may need to adjust according to official PEC XML schema
-	xml := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
-<certificazione xmlns="http://www.cnipa.it/schemas/2003/eGovIT/Busta1_0/">
-	<intestazione>
-		<identificativo>%s</identificativo>
-		<data-consegna>%s</data-consegna>
-		<tipo-ricevuta>avvenuta-consegna</tipo-ricevuta>
-	</intestazione>
-	<dati-certificazione>
-		<mittente>%s</mittente>
-		<destinatario>%s</destinatario>
-		<oggetto>%s</oggetto>
-		<identificativo-messaggio>%s</identificativo-messaggio>
-		<data-ora-consegna>%s</data-ora-consegna>
-		<gestore-consegna>%s</gestore-consegna>
-	</dati-certificazione>
-</certificazione>`,
-		common.GenerateMessageID(s.server.domain),
-		timestamp.Format(time.RFC3339),
-		originalSender,
-		recipient,
-		originalSubject,
-		originalMessageID,
-		timestamp.Format(time.RFC3339),
-		s.server.domain)
+	xmlData.Intestazione.Mittente = sender
+	xmlData.AddDestinatari("certificato", recipient)
+	xmlData.Intestazione.Risposte = sender
+	xmlData.Intestazione.Oggetto = originalSubject
+	xmlData.Dati.Identificativo = s.receiptIdentifier(originalMsg, recipient)
+	xmlData.Dati.MsgID = common.OriginalMessageID(&originalMsg.Header)
+	xmlData.Dati.Ricevuta = &pec.Ricevuta{Tipo: parseReceiptType(originalMsg).String()}
+	xmlData.Dati.Consegna = recipient
+
+	// a DatiCert always marshals, its fields are plain strings
+	xmlBytes, _ := xmlData.Marshal()
+	return string(xmlBytes)
+}
 
-	return xml
+// receiptIdentifier returns the identificativo of the delivery receipt of
+// originalMsg for recipient: each recipient gets its own receipt
+func (s *PuntoConsegnaSession) receiptIdentifier(originalMsg *message.Entity, recipient string) string {
+	return common.ReceiptIdentifier(pec.TipoAvvenutaConsegna, common.OriginalMessageID(&originalMsg.Header),
+		s.server.domain, strings.ToLower(recipient))
 }
 
 // createShortReceiptBody creates the body for a short delivery receipt
-// TODO: Implement reduced body with essential information only
 func (s *PuntoConsegnaSession) createShortReceiptBody(originalMsg *message.Entity, recipient string, timestamp time.Time) io.Reader {
 	content := fmt.Sprintf(`Ricevuta di avvenuta consegna - BREVE
 
 Destinatario: %s
 Data consegna: %s
 ID: %s
-
-[TODO: Include essential XML certification data only]`,
+`,
 		recipient,
 		timestamp.Format("02/01/2006 15:04:05"),
-		originalMsg.Header.Get("Message-ID"))
+		common.OriginalMessageID(&originalMsg.Header))
+
+	// The attachments are referenced by hash instead of being included
+	hashes, err := common.HashAttachments(originalMsg)
+	if err != nil {
+		logger.LogError("Error hashing attachments", err, s.logContext(originalMsg, recipient))
+	}
+	for _, hash := range hashes {
+		content += fmt.Sprintf("Allegato: %s SHA-256: %s\n", hash.Filename, hash.SHA256)
+	}
 
 	return strings.NewReader(content)
 }
@@ -432,17 +561,17 @@ Consegnato: %s - %s
 func (s *PuntoConsegnaSession) createNonDeliveryNotice(originalMsg *message.Entity, recipient string, deliveryErr error) *message.Entity {
 	// Generate unique message ID
 	msgID := common.GenerateMessageID(s.server.domain)
-	timestamp := time.Now()
+	timestamp := s.server.now()
 
 	// Create notice header
 	header := message.Header{}
 	header.Set("Message-ID", msgID)
-	header.Set("Date", timestamp.Format(time.RFC822))
+	header.Set("Date", timestamp.Format(time.RFC1123Z))
 	header.Set("From", fmt.Sprintf("postmaster@%s", s.server.domain))
 	header.Set("To", originalMsg.Header.Get("From"))
 	header.Set("Subject", "Avviso di mancata consegna")
 	header.Set("X-Ricevuta", "mancata-consegna")
-	header.Set("References", originalMsg.Header.Get("Message-ID"))
+	common.SetReferenceHeaders(&header, common.OriginalMessageID(&originalMsg.Header))
 
 	// Create body with error details
 	body := fmt.Sprintf("Delivery to %s failed: %s", recipient, deliveryErr.Error())
@@ -0,0 +1,521 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/danzipie/go-pec/pec"
+	"github.com/danzipie/go-pec/pec-server/internal/common"
+	"github.com/emersion/go-message"
+)
+
+// TestDeliveryReceipts_ReferenceOriginalMessageID tests that receipts built
+// for an envelope reference the user's Message-ID, not the envelope's own
+func TestDeliveryReceipts_ReferenceOriginalMessageID(t *testing.T) {
+	originalID := "<original@sender.example.com>"
+	envelope := "From: \"Per conto di: sender@sender.example.com\" <posta-certificata@sender.example.com>\r\n" +
+		"To: recipient@example.com\r\n" +
+		"Subject: POSTA CERTIFICATA: test\r\n" +
+		"Message-ID: <envelope@sender.example.com>\r\n" +
+		"X-Riferimento-Message-ID: " + originalID + "\r\n" +
+		"X-Trasporto: posta-certificata\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Messaggio di posta certificata\r\n"
+
+	msg, err := message.Read(strings.NewReader(envelope))
+	if err != nil {
+		t.Fatalf("Failed to parse envelope: %v", err)
+	}
+	session := &PuntoConsegnaSession{server: &PuntoConsegnaServer{domain: "example.com"}}
+
+	receipts := map[string]*message.Entity{
+		"avvenuta consegna": session.createDeliveryReceipt(msg, "recipient@example.com"),
+		"mancata consegna":  session.createNonDeliveryNotice(msg, "recipient@example.com", errors.New("mailbox full")),
+	}
+	for name, receipt := range receipts {
+		if got := receipt.Header.Get("X-Riferimento-Message-ID"); got != originalID {
+			t.Errorf("Expected %s to reference %s, got %q", name, originalID, got)
+		}
+		for _, field := range []string{"In-Reply-To", "References"} {
+			if got := receipt.Header.Get(field); got != originalID {
+				t.Errorf("Expected %s %s to be %s, got %q", name, field, originalID, got)
+			}
+		}
+		if got := common.OriginalMessageID(&receipt.Header); got != originalID {
+			t.Errorf("Expected %s to correlate to %s, got %q", name, originalID, got)
+		}
+	}
+}
+
+// TestDeliveryReceipt_ReceiptType tests that the requested receipt type is honored and reported
+func TestDeliveryReceipt_ReceiptType(t *testing.T) {
+	tests := []struct {
+		requested string
+		want      ReceiptType
+		header    string
+	}{
+		{"", ReceiptTypeComplete, "completa"},
+		{"completa", ReceiptTypeComplete, "completa"},
+		{"breve", ReceiptTypeShort, "breve"},
+		{"Sintetica", ReceiptTypeSynthetic, "sintetica"},
+	}
+
+	session := &PuntoConsegnaSession{server: &PuntoConsegnaServer{domain: "example.com"}}
+	for _, tt := range tests {
+		t.Run(tt.requested, func(t *testing.T) {
+			raw := "From: sender@sender.example.com\r\n" +
+				"To: recipient@example.com\r\n" +
+				"Subject: test\r\n" +
+				"Message-ID: <original@sender.example.com>\r\n"
+			if tt.requested != "" {
+				raw += "X-TipoRicevuta: " + tt.requested + "\r\n"
+			}
+			raw += "Content-Type: text/plain\r\n\r\nHello\r\n"
+			msg, err := message.Read(strings.NewReader(raw))
+			if err != nil {
+				t.Fatalf("Failed to parse message: %v", err)
+			}
+
+			if got := parseReceiptType(msg); got != tt.want {
+				t.Errorf("Expected receipt type %s, got %s", tt.want, got)
+			}
+			receipt := session.createDeliveryReceipt(msg, "recipient@example.com")
+			if got := receipt.Header.Get("X-TipoRicevuta"); got != tt.header {
+				t.Errorf("Expected X-TipoRicevuta %q, got %q", tt.header, got)
+			}
+			if receipt.Header.Has("X-Tipo-Ricevuta") {
+				t.Errorf("Expected no X-Tipo-Ricevuta header")
+			}
+			if got := receipt.Header.Get("X-Ricevuta"); got != "avvenuta-consegna" {
+				t.Errorf("Expected X-Ricevuta avvenuta-consegna, got %q", got)
+			}
+		})
+	}
+}
+
+// TestCreateCertificationXML_Postacert tests that the delivery daticert.xml uses the postacert schema
+func TestCreateCertificationXML_Postacert(t *testing.T) {
+	raw := "From: \"Per conto di: sender@sender.example.com\" <posta-certificata@sender.example.com>\r\n" +
+		"Reply-To: sender@sender.example.com\r\n" +
+		"To: recipient@example.com\r\n" +
+		"Subject: POSTA CERTIFICATA: test\r\n" +
+		"X-Riferimento-Message-ID: <original@sender.example.com>\r\n" +
+		"X-TipoRicevuta: breve\r\n" +
+		"Content-Type: text/plain\r\n\r\nHello\r\n"
+	msg, err := message.Read(strings.NewReader(raw))
+	if err != nil {
+		t.Fatalf("Failed to parse message: %v", err)
+	}
+	session := &PuntoConsegnaSession{server: &PuntoConsegnaServer{domain: "example.com"}}
+
+	var datiCert pec.DatiCert
+	if err := xml.Unmarshal([]byte(session.createCertificationXML(msg, "recipient@example.com", time.Now())), &datiCert); err != nil {
+		t.Fatalf("Failed to parse daticert.xml: %v", err)
+	}
+	if datiCert.Tipo != pec.TipoAvvenutaConsegna || datiCert.Errore != pec.ErroreNessuno {
+		t.Errorf("Unexpected daticert type %q, error %q", datiCert.Tipo, datiCert.Errore)
+	}
+	if datiCert.Intestazione.Mittente != "sender@sender.example.com" {
+		t.Errorf("Expected the original sender, got %q", datiCert.Intestazione.Mittente)
+	}
+	if datiCert.Dati.Consegna != "recipient@example.com" {
+		t.Errorf("Expected consegna recipient@example.com, got %q", datiCert.Dati.Consegna)
+	}
+	if datiCert.Dati.MsgID != "<original@sender.example.com>" {
+		t.Errorf("Expected the original Message-ID, got %q", datiCert.Dati.MsgID)
+	}
+	if datiCert.Dati.Ricevuta == nil || datiCert.Dati.Ricevuta.Tipo != "breve" {
+		t.Errorf("Expected ricevuta breve, got %+v", datiCert.Dati.Ricevuta)
+	}
+	if id := session.receiptIdentifier(msg, "recipient@example.com"); datiCert.Dati.Identificativo != id {
+		t.Errorf("Expected identificativo %q, got %q", id, datiCert.Dati.Identificativo)
+	}
+	if session.receiptIdentifier(msg, "other@example.com") == datiCert.Dati.Identificativo {
+		t.Error("Expected each recipient to get its own identificativo")
+	}
+}
+
+// TestCreateShortReceiptBody tests that the body of a short delivery receipt
+// references the attachments by hash, with no placeholder left
+func TestCreateShortReceiptBody(t *testing.T) {
+	raw := "From: posta-certificata@sender.example.com\r\n" +
+		"To: recipient@example.com\r\n" +
+		"X-Riferimento-Message-ID: <original@sender.example.com>\r\n" +
+		"Content-Type: multipart/mixed; boundary=b\r\n\r\n" +
+		"--b\r\nContent-Type: text/plain\r\n\r\nHello\r\n" +
+		"--b\r\nContent-Type: text/plain\r\nContent-Disposition: attachment; filename=fattura.txt\r\n\r\nabc\r\n" +
+		"--b--\r\n"
+	msg, err := message.Read(strings.NewReader(raw))
+	if err != nil {
+		t.Fatalf("Failed to parse message: %v", err)
+	}
+	session := &PuntoConsegnaSession{server: &PuntoConsegnaServer{domain: "example.com"}}
+
+	body, _ := io.ReadAll(session.createShortReceiptBody(msg, "recipient@example.com", time.Now()))
+	// sha256("abc")
+	want := "Allegato: fattura.txt SHA-256: ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad\n"
+	if !strings.Contains(string(body), want) || !strings.Contains(string(body), "ID: <original@sender.example.com>") {
+		t.Errorf("Expected the body to reference the message and its attachment, got\n%s", body)
+	}
+	if strings.Contains(string(body), "TODO") {
+		t.Errorf("Expected no placeholder in the body, got\n%s", body)
+	}
+}
+
+// TestDeliveryReceipt_EncodedSubject tests that encoded-word subjects are
+// decoded in the receipt and re-encoded in its Subject header
+func TestDeliveryReceipt_EncodedSubject(t *testing.T) {
+	tests := []struct {
+		name    string
+		subject string
+		decoded string
+	}{
+		{"base64", "=?UTF-8?B?RmF0dHVyYSBkaSBnZW5uYWlvIOKCrCAxMCDDqCBwYWdhdGE=?=", "Fattura di gennaio € 10 è pagata"},
+		{"q-encoded", "=?ISO-8859-1?Q?Perch=E8_no??=", "Perchè no?"},
+	}
+
+	session := &PuntoConsegnaSession{server: &PuntoConsegnaServer{domain: "example.com"}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := "From: sender@sender.example.com\r\n" +
+				"To: recipient@example.com\r\n" +
+				"Subject: " + tt.subject + "\r\n" +
+				"Message-ID: <original@sender.example.com>\r\n" +
+				"Content-Type: text/plain\r\n\r\nHello\r\n"
+			msg, err := message.Read(strings.NewReader(raw))
+			if err != nil {
+				t.Fatalf("Failed to parse message: %v", err)
+			}
+
+			receipt := session.createDeliveryReceipt(msg, "recipient@example.com")
+			if got := receipt.Header.Get("Subject"); strings.ContainsAny(got, "€è") {
+				t.Errorf("Expected an encoded Subject header, got %q", got)
+			}
+			if got := common.DecodeHeaderText(receipt.Header.Get("Subject")); got != "CONSEGNA: "+tt.decoded {
+				t.Errorf("Expected Subject %q, got %q", "CONSEGNA: "+tt.decoded, got)
+			}
+
+			var body bytes.Buffer
+			if err := receipt.WriteTo(&body); err != nil {
+				t.Fatalf("Failed to write receipt: %v", err)
+			}
+			if !strings.Contains(body.String(), tt.decoded) {
+				t.Errorf("Expected the receipt text to show the decoded subject")
+			}
+
+			var datiCert pec.DatiCert
+			if err := xml.Unmarshal([]byte(session.createCertificationXML(msg, "recipient@example.com", time.Now())), &datiCert); err != nil {
+				t.Fatalf("Failed to parse daticert.xml: %v", err)
+			}
+			if datiCert.Intestazione.Oggetto != tt.decoded {
+				t.Errorf("Expected oggetto %q, got %q", tt.decoded, datiCert.Intestazione.Oggetto)
+			}
+		})
+	}
+}
+
+// TestDeliveryReceipt_CcRecipient tests that the complete receipt of a
+// recipient in copy does not carry the original message
+func TestDeliveryReceipt_CcRecipient(t *testing.T) {
+	raw := "From: sender@sender.example.com\r\n" +
+		"To: Primo <primo@example.com>\r\n" +
+		"Cc: Copia <copia@example.com>\r\n" +
+		"Subject: test\r\n" +
+		"Message-ID: <original@sender.example.com>\r\n" +
+		"Content-Type: text/plain\r\n\r\nHello\r\n"
+
+	tests := []struct {
+		recipient       string
+		want            RecipientType
+		includeOriginal bool
+	}{
+		{"primo@example.com", RecipientTypePrimary, true},
+		{"COPIA@example.com", RecipientTypeCC, false},
+		{"nascosto@example.com", RecipientTypeAmbiguous, true},
+	}
+
+	session := &PuntoConsegnaSession{server: &PuntoConsegnaServer{domain: "example.com"}}
+	for _, tt := range tests {
+		t.Run(tt.recipient, func(t *testing.T) {
+			msg, err := message.Read(strings.NewReader(raw))
+			if err != nil {
+				t.Fatalf("Failed to parse message: %v", err)
+			}
+			if got := determineRecipientType(msg, tt.recipient); got != tt.want {
+				t.Errorf("Expected recipient type %d, got %d", tt.want, got)
+			}
+
+			var body bytes.Buffer
+			if err := session.createDeliveryReceipt(msg, tt.recipient).WriteTo(&body); err != nil {
+				t.Fatalf("Failed to write receipt: %v", err)
+			}
+			if got := strings.Contains(body.String(), "messaggio-originale.eml"); got != tt.includeOriginal {
+				t.Errorf("Expected the original message included: %v, got %v", tt.includeOriginal, got)
+			}
+			if !strings.Contains(body.String(), "daticert.xml") {
+				t.Errorf("Expected daticert.xml in every receipt")
+			}
+		})
+	}
+}
+
+// TestDeliveryReceipt_NoSubject tests that the receipt of a message without
+// subject shows the placeholder in its Subject, text and daticert
+func TestDeliveryReceipt_NoSubject(t *testing.T) {
+	raw := "From: sender@sender.example.com\r\n" +
+		"To: recipient@example.com\r\n" +
+		"Message-ID: <original@sender.example.com>\r\n" +
+		"Content-Type: text/plain\r\n\r\nHello\r\n"
+	msg, err := message.Read(strings.NewReader(raw))
+	if err != nil {
+		t.Fatalf("Failed to parse message: %v", err)
+	}
+	session := &PuntoConsegnaSession{server: &PuntoConsegnaServer{domain: "example.com"}}
+
+	receipt := session.createDeliveryReceipt(msg, "recipient@example.com")
+	if got := receipt.Header.Get("Subject"); got != "CONSEGNA: "+common.NoSubject {
+		t.Errorf("Expected Subject %q, got %q", "CONSEGNA: "+common.NoSubject, got)
+	}
+	var body bytes.Buffer
+	if err := receipt.WriteTo(&body); err != nil {
+		t.Fatalf("Failed to write receipt: %v", err)
+	}
+	if !strings.Contains(body.String(), `"`+common.NoSubject+`"`) {
+		t.Errorf("Expected the placeholder subject in the receipt text")
+	}
+
+	var datiCert pec.DatiCert
+	if err := xml.Unmarshal([]byte(session.createCertificationXML(msg, "recipient@example.com", time.Now())), &datiCert); err != nil {
+		t.Fatalf("Failed to parse daticert.xml: %v", err)
+	}
+	if datiCert.Intestazione.Oggetto != common.NoSubject {
+		t.Errorf("Expected oggetto %q, got %q", common.NoSubject, datiCert.Intestazione.Oggetto)
+	}
+}
+
+// concurrentMailbox records the deliveries made to it at the same time as
+// others, in the group of mailboxes sharing active
+type concurrentMailbox struct {
+	recordingMailbox
+	active *concurrency
+}
+
+// concurrency counts the deliveries in progress and their maximum
+type concurrency struct {
+	mu     sync.Mutex
+	active int
+	max    int
+}
+
+func (m *concurrentMailbox) DeliverMessage(msg *message.Entity) error {
+	m.active.mu.Lock()
+	m.active.active++
+	if m.active.active > m.active.max {
+		m.active.max = m.active.active
+	}
+	m.active.mu.Unlock()
+
+	time.Sleep(20 * time.Millisecond)
+	io.ReadAll(msg.Body)
+
+	m.active.mu.Lock()
+	m.active.active--
+	m.active.mu.Unlock()
+	return m.recordingMailbox.DeliverMessage(msg)
+}
+
+// TestProcessRecipients tests that the recipients are delivered to at the
+// same time, up to the configured workers, and the receipts emitted in their
+// order with the errors of the recipients that failed
+func TestProcessRecipients(t *testing.T) {
+	queue, err := common.NewOutboundQueue(t.TempDir(), func(*common.OutboundItem) error { return nil })
+	if err != nil {
+		t.Fatalf("NewOutboundQueue failed: %v", err)
+	}
+	server := &PuntoConsegnaServer{domain: "example.com", queue: queue, workers: 3}
+	active := &concurrency{}
+	mailboxes := map[string]*concurrentMailbox{}
+	resolved := map[string]Mailbox{}
+	for _, recipient := range []string{"a@example.com", "c@example.com", "e@example.com", "f@example.com"} {
+		mailboxes[recipient] = &concurrentMailbox{active: active}
+		resolved[recipient] = mailboxes[recipient]
+	}
+	resolved["b@example.com"] = &recordingMailbox{unavailable: true}
+	server.SetMailboxResolver(&mapResolver{mailboxes: resolved})
+
+	recipients := []string{"a@example.com", "b@example.com", "c@example.com", "d@example.com", "e@example.com", "f@example.com"}
+	session := &PuntoConsegnaSession{server: server, from: "posta-certificata@sender.example.com", to: recipients}
+	envelope := "From: posta-certificata@sender.example.com\r\n" +
+		"To: " + strings.Join(recipients, ", ") + "\r\n" +
+		"Subject: POSTA CERTIFICATA: test\r\n" +
+		"Message-ID: <fan-out@sender.example.com>\r\n" +
+		"X-Trasporto: posta-certificata\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Messaggio di posta certificata\r\n"
+
+	err = session.processRecipients([]byte(envelope))
+	if !errors.Is(err, ErrMailboxUnavailable) {
+		t.Errorf("Expected the unavailable mailbox among the errors, got %v", err)
+	}
+	var unknown *UnknownRecipientError
+	if !errors.As(err, &unknown) || unknown.Recipient != "d@example.com" {
+		t.Errorf("Expected the unknown recipient among the errors, got %v", err)
+	}
+
+	for recipient, mailbox := range mailboxes {
+		if len(mailbox.delivered) != 1 {
+			t.Errorf("Expected 1 message delivered to %s, got %d", recipient, len(mailbox.delivered))
+		}
+	}
+	if active.max < 2 || active.max > 3 {
+		t.Errorf("Expected 2 to 3 deliveries at the same time, got %d", active.max)
+	}
+
+	items, err := queue.Pending()
+	if err != nil {
+		t.Fatalf("Pending failed: %v", err)
+	}
+	if len(items) != len(recipients) {
+		t.Fatalf("Expected %d receipts, got %d", len(recipients), len(items))
+	}
+	for i, recipient := range recipients {
+		want := "avvenuta-consegna"
+		if recipient == "b@example.com" || recipient == "d@example.com" {
+			want = "mancata-consegna"
+		}
+		receipt, err := message.Read(bytes.NewReader(items[i].Data))
+		if err != nil {
+			t.Fatalf("Failed to parse receipt: %v", err)
+		}
+		if got := receipt.Header.Get("X-Ricevuta"); got != want {
+			t.Errorf("Expected receipt %d to be %s, got %s", i, want, got)
+		}
+		if !bytes.Contains(items[i].Data, []byte(recipient)) {
+			t.Errorf("Expected receipt %d to be for %s", i, recipient)
+		}
+	}
+}
+
+// TestReceiveHandler_MailboxFailure tests that an envelope whose delivery
+// failed is not posted again once its sender is notified: the delivery
+// point answers 200 and a single notice is sent
+func TestReceiveHandler_MailboxFailure(t *testing.T) {
+	queue, err := common.NewOutboundQueue(t.TempDir(), func(*common.OutboundItem) error { return nil })
+	if err != nil {
+		t.Fatalf("NewOutboundQueue failed: %v", err)
+	}
+	server := &PuntoConsegnaServer{domain: "example.com", queue: queue}
+	server.RegisterMailbox("recipient@example.com", &recordingMailbox{unavailable: true})
+
+	var posts atomic.Int32
+	deliveryPoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posts.Add(1)
+		ReceiveHandler(w, r, server)
+	}))
+	defer deliveryPoint.Close()
+
+	envelope := "From: \"Per conto di: sender@sender.example.com\" <posta-certificata@sender.example.com>\r\n" +
+		"To: recipient@example.com\r\n" +
+		"Subject: POSTA CERTIFICATA: test\r\n" +
+		"Message-ID: <mailbox-failure@sender.example.com>\r\n" +
+		"X-Trasporto: posta-certificata\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Messaggio di posta certificata\r\n"
+	// The reception point posts the envelope again while it gets a 5xx
+	status := 0
+	for attempt := 0; attempt < 5 && (status == 0 || status >= 500); attempt++ {
+		resp, err := http.Post(deliveryPoint.URL, "message/rfc822", strings.NewReader(envelope))
+		if err != nil {
+			t.Fatalf("POST failed: %v", err)
+		}
+		resp.Body.Close()
+		status = resp.StatusCode
+	}
+
+	if status != http.StatusOK || posts.Load() != 1 {
+		t.Errorf("Expected a single POST answered 200, got %d POSTs and status %d", posts.Load(), status)
+	}
+	items, err := queue.Pending()
+	if err != nil {
+		t.Fatalf("Pending failed: %v", err)
+	}
+	if len(items) != 1 {
+		t.Fatalf("Expected 1 notice, got %d", len(items))
+	}
+	notice, err := message.Read(bytes.NewReader(items[0].Data))
+	if err != nil {
+		t.Fatalf("Failed to parse notice: %v", err)
+	}
+	if got := notice.Header.Get("X-Ricevuta"); got != "mancata-consegna" {
+		t.Errorf("Expected a mancata-consegna notice, got %s", got)
+	}
+	if !reflect.DeepEqual(items[0].To, []string{"posta-certificata@sender.example.com"}) {
+		t.Errorf("Expected the notice to go to the sender, got %v", items[0].To)
+	}
+}
+
+// TestData_OriginalBodyForEachRecipient tests that every recipient of a
+// message gets the whole message, and a receipt including it
+func TestData_OriginalBodyForEachRecipient(t *testing.T) {
+	queue, err := common.NewOutboundQueue(t.TempDir(), func(*common.OutboundItem) error { return nil })
+	if err != nil {
+		t.Fatalf("NewOutboundQueue failed: %v", err)
+	}
+	server := &PuntoConsegnaServer{domain: "example.com", queue: queue}
+	first, second := &recordingMailbox{}, &recordingMailbox{}
+	server.RegisterMailbox("first@example.com", first)
+	server.RegisterMailbox("second@example.com", second)
+
+	body := "Il corpo del messaggio originale"
+	session := &PuntoConsegnaSession{server: server}
+	session.Mail("posta-certificata@sender.example.com", nil)
+	session.Rcpt("first@example.com", nil)
+	session.Rcpt("second@example.com", nil)
+	err = session.Data(strings.NewReader("From: posta-certificata@sender.example.com\r\n" +
+		"To: first@example.com, second@example.com\r\n" +
+		"Subject: POSTA CERTIFICATA: test\r\n" +
+		"Message-ID: <two-recipients@sender.example.com>\r\n" +
+		"X-Trasporto: posta-certificata\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		body + "\r\n"))
+	if err != nil {
+		t.Fatalf("DATA failed: %v", err)
+	}
+
+	for name, mailbox := range map[string]*recordingMailbox{"first": first, "second": second} {
+		if len(mailbox.delivered) != 1 {
+			t.Fatalf("Expected 1 message delivered to the %s recipient, got %d", name, len(mailbox.delivered))
+		}
+		delivered, _ := io.ReadAll(mailbox.delivered[0].Body)
+		if !strings.Contains(string(delivered), body) {
+			t.Errorf("Expected the %s recipient to get the original body, got %q", name, delivered)
+		}
+	}
+
+	items, err := queue.Pending()
+	if err != nil {
+		t.Fatalf("Pending failed: %v", err)
+	}
+	if len(items) != 2 {
+		t.Fatalf("Expected 2 receipts, got %d", len(items))
+	}
+	for i, item := range items {
+		if !bytes.Contains(item.Data, []byte(body)) {
+			t.Errorf("Expected receipt %d to include the original body", i)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/danzipie/go-pec/pec"
+	"github.com/danzipie/go-pec/pec-server/internal/common"
+	"github.com/emersion/go-message/mail"
+)
+
+// MessageClass is the kind of an incoming message, deciding how the
+// reception point routes it
+type MessageClass int
+
+const (
+	// Unknown messages are not signed by a certified provider
+	Unknown MessageClass = iota
+	// TransportEnvelope is a busta di trasporto from a certified provider
+	TransportEnvelope
+	// Receipt is a delivery receipt (avvenuta-consegna)
+	Receipt
+	// Avviso is a non-delivery notice (errore-consegna)
+	Avviso
+	// AnomalyCandidate is signed by a certified provider but is neither an
+	// envelope nor a receipt
+	AnomalyCandidate
+)
+
+// AnomalyReason tells why a message is wrapped in a busta di anomalia; it is
+// reported to the recipient in the body of the anomaly
+type AnomalyReason string
+
+const (
+	ReasonSenderAuth        AnomalyReason = "autenticazione del mittente (DKIM/SPF) non superata"
+	ReasonInvalidSignature  AnomalyReason = "firma del messaggio assente o non valida"
+	ReasonUnknownProvider   AnomalyReason = "messaggio non firmato da un gestore di posta certificata"
+	ReasonRevokedSigner     AnomalyReason = "certificato di firma del gestore revocato"
+	ReasonMalformedEnvelope AnomalyReason = "busta di trasporto non conforme"
+	ReasonSenderSignature   AnomalyReason = "firma del mittente sul messaggio originale non valida"
+	ReasonMalformedReceipt  AnomalyReason = "ricevuta non conforme"
+	ReasonNotPEC            AnomalyReason = "messaggio non riconosciuto come busta di trasporto o ricevuta"
+)
+
+func (c MessageClass) String() string {
+	switch c {
+	case TransportEnvelope:
+		return "transport-envelope"
+	case Receipt:
+		return "receipt"
+	case Avviso:
+		return "avviso"
+	case AnomalyCandidate:
+		return "anomaly-candidate"
+	}
+	return "unknown"
+}
+
+// ClassifyMessage classifies a message from its header and raw body. The
+// signature is verified at most once. For the classes handled as anomalies
+// the reason tells what made the message fail.
+func ClassifyMessage(header *mail.Header, body []byte) (MessageClass, AnomalyReason, error) {
+	if header == nil {
+		return Unknown, "", errors.New("missing message header")
+	}
+
+	// Receipts and avvisi are recognized from their headers alone, unless
+	// the revocation of their signer is checked
+	class := Unknown
+	var reason AnomalyReason
+	switch header.Get("X-Ricevuta") {
+	case "avvenuta-consegna":
+		class = Receipt
+	case "errore-consegna":
+		class = Avviso
+	}
+	if class != Unknown && !IsValidReceiptOrAvviso(header, body) {
+		class, reason = Unknown, ReasonMalformedReceipt
+	}
+	checkRevocation := providerTrust != nil && providerTrust.Revocation != nil
+	if class != Unknown && !checkRevocation {
+		return class, "", nil
+	}
+
+	signerCert, embedded, err := common.VerifySignatureChain(header, body)
+	if err != nil {
+		if class != Unknown {
+			return class, "", nil
+		}
+		if reason == "" {
+			reason = ReasonInvalidSignature
+		}
+		return Unknown, reason, nil
+	}
+	if class != Unknown {
+		err := providerTrust.CheckRevocation(signerCert, embedded)
+		if err == nil {
+			return class, "", nil
+		}
+		reason = signerReason(err)
+	} else if strings.EqualFold(header.Get("X-Trasporto"), "posta-certificata") {
+		err := common.CheckTransportEnvelope(header, signerCert, providerTrust)
+		if err == nil {
+			reason = envelopeContentReason(header, body)
+			if reason == "" {
+				return TransportEnvelope, "", nil
+			}
+		} else if errors.Is(err, common.ErrUntrustedSigner) {
+			reason = signerReason(err)
+		} else {
+			reason = ReasonMalformedEnvelope
+		}
+	} else if reason == "" {
+		reason = ReasonNotPEC
+	}
+	if IsFromCertifiedProvider(header) {
+		return AnomalyCandidate, reason, nil
+	}
+	return Unknown, reason, nil
+}
+
+// envelopeContentReason checks the content of a transport envelope: the MIME
+// parts required by the PEC rules and the signature of the sender on the
+// original message, when signed. It returns the reason of the anomaly, if any.
+func envelopeContentReason(header *mail.Header, body []byte) AnomalyReason {
+	raw, err := common.RawMessage(header, body)
+	if err != nil {
+		return ReasonMalformedEnvelope
+	}
+	if err := pec.ValidateEnvelopeStructure(raw); err != nil {
+		return ReasonMalformedEnvelope
+	}
+	if _, err := common.VerifyEnvelopePostacert(raw); err != nil {
+		if errors.Is(err, common.ErrInvalidSenderSignature) {
+			return ReasonSenderSignature
+		}
+		return ReasonMalformedEnvelope
+	}
+	return ""
+}
+
+// signerReason returns the anomaly reason of a message whose signer
+// certificate was rejected with err
+func signerReason(err error) AnomalyReason {
+	if errors.Is(err, common.ErrCertificateRevoked) {
+		return ReasonRevokedSigner
+	}
+	return ReasonUnknownProvider
+}
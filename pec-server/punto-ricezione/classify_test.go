@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/danzipie/go-pec/pec-server/internal/common"
+	"github.com/emersion/go-message/mail"
+	"golang.org/x/crypto/ocsp"
+)
+
+// newProviderSigner creates a signer with a self-signed provider certificate
+func newProviderSigner(t *testing.T) *common.Signer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "posta-certificata@sender.example.com"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse certificate: %v", err)
+	}
+	return &common.Signer{Cert: cert, Key: key, Domain: "sender.example.com"}
+}
+
+// trustProvider makes the certificate of signer trusted for the duration of a test
+func trustProvider(t *testing.T, signer *common.Signer) {
+	roots := x509.NewCertPool()
+	roots.AddCert(signer.Cert)
+	previous := providerTrust
+	providerTrust = &common.ProviderTrust{
+		CertificateHashes: map[string]struct{}{common.CertificateHash(signer.Cert): {}},
+		Roots:             roots,
+	}
+	t.Cleanup(func() { providerTrust = previous })
+}
+
+// signedTestMessage signs a text body and prepends outerHeaders to the result
+func signedTestMessage(t *testing.T, signer *common.Signer, outerHeaders string) []byte {
+	t.Helper()
+	signed, err := signer.CreateSignedMimeMessage([]byte("Content-Type: text/plain\r\n\r\nMessaggio di posta certificata\r\n"))
+	if err != nil {
+		t.Fatalf("Failed to sign message: %v", err)
+	}
+	return append([]byte(outerHeaders), signed...)
+}
+
+// testEnvelopeContent is the content of a transport envelope, with the MIME
+// parts required by the PEC rules
+const testEnvelopeContent = "Content-Type: multipart/mixed; boundary=\"envelope\"\r\n" +
+	"\r\n" +
+	"--envelope\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"Messaggio di posta certificata\r\n" +
+	"--envelope\r\n" +
+	"Content-Type: application/xml\r\n" +
+	"Content-Disposition: attachment; filename=\"daticert.xml\"\r\n" +
+	"\r\n" +
+	"<postacert tipo=\"posta-certificata\" errore=\"nessuno\"/>\r\n" +
+	"--envelope\r\n" +
+	"Content-Type: message/rfc822\r\n" +
+	"Content-Disposition: attachment; filename=\"postacert.eml\"\r\n" +
+	"\r\n" +
+	"Subject: test\r\n" +
+	"\r\n" +
+	"Hello\r\n" +
+	"--envelope--\r\n"
+
+// signedTestEnvelope signs the content of a transport envelope and prepends
+// outerHeaders to the result
+func signedTestEnvelope(t *testing.T, signer *common.Signer, outerHeaders string) []byte {
+	t.Helper()
+	signed, err := signer.CreateSignedMimeMessage([]byte(testEnvelopeContent))
+	if err != nil {
+		t.Fatalf("Failed to sign envelope: %v", err)
+	}
+	return append([]byte(outerHeaders), signed...)
+}
+
+// TestClassifyMessage tests the classification of each kind of incoming message
+func TestClassifyMessage(t *testing.T) {
+	provider := newProviderSigner(t)
+	trustProvider(t, provider)
+	untrusted := newProviderSigner(t)
+
+	envelopeHeaders := "From: posta-certificata@sender.example.com\r\n" +
+		"To: recipient@example.com\r\n" +
+		"Subject: POSTA CERTIFICATA: test\r\n" +
+		"Date: Mon, 02 Jan 2006 15:04:05 +0000\r\n" +
+		"Message-ID: <envelope@sender.example.com>\r\n" +
+		"X-Trasporto: posta-certificata\r\n"
+	receiptHeaders := "From: posta-certificata@sender.example.com\r\n" +
+		"To: sender@example.com\r\n" +
+		"Subject: CONSEGNA: test\r\n" +
+		"Date: Mon, 02 Jan 2006 15:04:05 +0000\r\n" +
+		"X-Riferimento-Message-ID: <original@example.com>\r\n"
+	plainHeaders := "From: sender@example.org\r\n" +
+		"To: recipient@example.com\r\n" +
+		"Subject: test\r\n"
+
+	malformedHeaders := "From: posta-certificata@sender.example.com\r\n" +
+		"To: not an address\r\n" +
+		"Subject: POSTA CERTIFICATA: test\r\n" +
+		"X-Trasporto: posta-certificata\r\n"
+
+	tests := []struct {
+		name       string
+		data       []byte
+		want       MessageClass
+		wantReason AnomalyReason
+	}{
+		{"transport envelope", signedTestEnvelope(t, provider, envelopeHeaders), TransportEnvelope, ""},
+		{"delivery receipt", []byte(receiptHeaders + "X-Ricevuta: avvenuta-consegna\r\nContent-Type: text/plain\r\n\r\nRicevuta\r\n"), Receipt, ""},
+		{"receipt with unknown type", []byte(receiptHeaders + "X-Ricevuta: avvenuta-consegna\r\nX-TipoRicevuta: lunga\r\nContent-Type: text/plain\r\n\r\nRicevuta\r\n"), Unknown, ReasonMalformedReceipt},
+		{"non-delivery avviso", []byte(receiptHeaders + "X-Ricevuta: errore-consegna\r\nContent-Type: text/plain\r\n\r\nAvviso\r\n"), Avviso, ""},
+		{"envelope signed by an untrusted provider", signedTestEnvelope(t, untrusted, envelopeHeaders), AnomalyCandidate, ReasonUnknownProvider},
+		{"envelope without daticert.xml", signedTestMessage(t, provider, envelopeHeaders), AnomalyCandidate, ReasonMalformedEnvelope},
+		{"envelope with an invalid To", signedTestMessage(t, provider, malformedHeaders), AnomalyCandidate, ReasonMalformedEnvelope},
+		{"signed message without X-Trasporto", signedTestMessage(t, provider, plainHeaders), AnomalyCandidate, ReasonNotPEC},
+		{"unsigned message", []byte(plainHeaders + "Content-Type: text/plain\r\n\r\nHello\r\n"), Unknown, ReasonInvalidSignature},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mr, err := mail.CreateReader(bytes.NewReader(tt.data))
+			if err != nil {
+				t.Fatalf("Failed to parse message: %v", err)
+			}
+			got, reason, err := ClassifyMessage(&mr.Header, common.RawBody(tt.data))
+			if err != nil {
+				t.Fatalf("ClassifyMessage failed: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Expected %s, got %s", tt.want, got)
+			}
+			if reason != tt.wantReason {
+				t.Errorf("Expected reason %q, got %q", tt.wantReason, reason)
+			}
+		})
+	}
+
+	if _, _, err := ClassifyMessage(nil, nil); err == nil {
+		t.Error("Expected an error without a header")
+	}
+}
+
+// TestClassifyMessage_SenderSignature tests that an envelope whose original
+// message is signed, but not by its sender, is an anomaly
+func TestClassifyMessage_SenderSignature(t *testing.T) {
+	provider := newProviderSigner(t)
+	trustProvider(t, provider)
+	signed, err := provider.CreateSignedMimeMessage([]byte("Content-Type: text/plain\r\n\r\nMessaggio firmato\r\n"))
+	if err != nil {
+		t.Fatalf("Failed to sign message: %v", err)
+	}
+	// The original message has a boundary of its own, not the envelope's
+	signed = bytes.ReplaceAll(signed, []byte("----=_NextPart_000_0000_01234567.89ABCDEF"), []byte("----=_Part_original"))
+
+	tests := []struct {
+		from       string
+		want       MessageClass
+		wantReason AnomalyReason
+	}{
+		{"posta-certificata@sender.example.com", TransportEnvelope, ""},
+		{"sender@sender.example.com", AnomalyCandidate, ReasonSenderSignature},
+	}
+	for _, tt := range tests {
+		original := append([]byte("From: "+tt.from+"\r\nTo: recipient@example.com\r\nSubject: test\r\nMessage-ID: <signed@sender.example.com>\r\n"), signed...)
+		data, err := common.BuildTransportEnvelope(original, common.PECCertificationData{Date: time.Now()}, provider)
+		if err != nil {
+			t.Fatalf("BuildTransportEnvelope failed: %v", err)
+		}
+		mr, err := mail.CreateReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("Failed to parse envelope: %v", err)
+		}
+		got, reason, err := ClassifyMessage(&mr.Header, common.RawBody(data))
+		if err != nil {
+			t.Fatalf("ClassifyMessage failed: %v", err)
+		}
+		if got != tt.want || reason != tt.wantReason {
+			t.Errorf("Expected %s (%q) for a message from %s, got %s (%q)", tt.want, tt.wantReason, tt.from, got, reason)
+		}
+	}
+}
+
+// issueRevokedSigner issues a provider certificate from ca whose OCSP
+// responder reports it revoked
+func issueRevokedSigner(t *testing.T, ca *common.Signer) *common.Signer {
+	t.Helper()
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		request, err := ocsp.ParseRequest(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		response, err := ocsp.CreateResponse(ca.Cert, ca.Cert, ocsp.Response{
+			Status:       ocsp.Revoked,
+			SerialNumber: request.SerialNumber,
+			ThisUpdate:   time.Now().Add(-time.Minute),
+			NextUpdate:   time.Now().Add(time.Hour),
+			RevokedAt:    time.Now().Add(-time.Minute),
+		}, ca.Key.(*rsa.PrivateKey))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(response)
+	}))
+	t.Cleanup(responder.Close)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "posta-certificata@sender.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		OCSPServer:   []string{responder.URL},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Cert, &key.PublicKey, ca.Key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse certificate: %v", err)
+	}
+	return &common.Signer{Cert: cert, Key: key, Domain: "sender.example.com"}
+}
+
+// TestClassifyMessage_RevokedSigner tests that envelopes and receipts signed
+// with a revoked provider certificate are anomalies once revocation is checked
+func TestClassifyMessage_RevokedSigner(t *testing.T) {
+	ca := newProviderSigner(t)
+	revoked := issueRevokedSigner(t, ca)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+	previous := providerTrust
+	providerTrust = &common.ProviderTrust{
+		CertificateHashes: map[string]struct{}{common.CertificateHash(revoked.Cert): {}},
+		Roots:             roots,
+	}
+	t.Cleanup(func() { providerTrust = previous })
+
+	envelope := signedTestEnvelope(t, revoked, "From: posta-certificata@sender.example.com\r\n"+
+		"To: recipient@example.com\r\n"+
+		"Subject: POSTA CERTIFICATA: test\r\n"+
+		"Date: Mon, 02 Jan 2006 15:04:05 +0000\r\n"+
+		"X-Trasporto: posta-certificata\r\n")
+	receipt := signedTestMessage(t, revoked, "From: posta-certificata@sender.example.com\r\n"+
+		"To: sender@example.com\r\n"+
+		"Subject: CONSEGNA: test\r\n"+
+		"Date: Mon, 02 Jan 2006 15:04:05 +0000\r\n"+
+		"X-Riferimento-Message-ID: <original@example.com>\r\n"+
+		"X-Ricevuta: avvenuta-consegna\r\n")
+	unsignedReceipt := []byte("From: posta-certificata@sender.example.com\r\n" +
+		"To: sender@example.com\r\n" +
+		"Subject: CONSEGNA: test\r\n" +
+		"Date: Mon, 02 Jan 2006 15:04:05 +0000\r\n" +
+		"X-Riferimento-Message-ID: <original@example.com>\r\n" +
+		"X-Ricevuta: avvenuta-consegna\r\n" +
+		"Content-Type: text/plain\r\n\r\nRicevuta\r\n")
+
+	tests := []struct {
+		name       string
+		data       []byte
+		check      bool
+		want       MessageClass
+		wantReason AnomalyReason
+	}{
+		{"envelope, not checked", envelope, false, TransportEnvelope, ""},
+		{"envelope, checked", envelope, true, AnomalyCandidate, ReasonRevokedSigner},
+		{"receipt, not checked", receipt, false, Receipt, ""},
+		{"receipt, checked", receipt, true, AnomalyCandidate, ReasonRevokedSigner},
+		{"unsigned receipt, checked", unsignedReceipt, true, Receipt, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			providerTrust.Revocation = nil
+			if tt.check {
+				providerTrust.Revocation = common.NewRevocationChecker(true, 0)
+			}
+			mr, err := mail.CreateReader(bytes.NewReader(tt.data))
+			if err != nil {
+				t.Fatalf("Failed to parse message: %v", err)
+			}
+			got, reason, err := ClassifyMessage(&mr.Header, common.RawBody(tt.data))
+			if err != nil {
+				t.Fatalf("ClassifyMessage failed: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Expected %s, got %s", tt.want, got)
+			}
+			if reason != tt.wantReason {
+				t.Errorf("Expected reason %q, got %q", tt.wantReason, reason)
+			}
+		})
+	}
+}
+
+// TestNewPuntoRicezioneServer_RevocationFailClosed tests that, with the
+// revocation checked fail-closed, a receipt whose signer chains to none of
+// the roots is revoked through the issuer embedded in its signature, and is
+// an anomaly when no issuer is embedded either
+func TestNewPuntoRicezioneServer_RevocationFailClosed(t *testing.T) {
+	ca := newProviderSigner(t)
+	revoked := issueRevokedSigner(t, ca)
+	withChain := &common.Signer{Cert: revoked.Cert, Key: revoked.Key, Chain: []*x509.Certificate{ca.Cert}, Domain: revoked.Domain}
+	newTestServer(t, map[string]any{"check_revocation": true, "revocation_fail_closed": true})
+
+	headers := "From: posta-certificata@sender.example.com\r\n" +
+		"To: sender@example.com\r\n" +
+		"Subject: CONSEGNA: test\r\n" +
+		"Date: Mon, 02 Jan 2006 15:04:05 +0000\r\n" +
+		"X-Riferimento-Message-ID: <original@example.com>\r\n" +
+		"X-Ricevuta: avvenuta-consegna\r\n"
+	tests := []struct {
+		name       string
+		signer     *common.Signer
+		wantReason AnomalyReason
+	}{
+		{"issuer embedded", withChain, ReasonRevokedSigner},
+		{"no issuer", revoked, ReasonUnknownProvider},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := signedTestMessage(t, tt.signer, headers)
+			mr, err := mail.CreateReader(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("Failed to parse message: %v", err)
+			}
+			got, reason, err := ClassifyMessage(&mr.Header, common.RawBody(data))
+			if err != nil {
+				t.Fatalf("ClassifyMessage failed: %v", err)
+			}
+			if got != AnomalyCandidate || reason != tt.wantReason {
+				t.Errorf("Expected %s (%q), got %s (%q)", AnomalyCandidate, tt.wantReason, got, reason)
+			}
+		})
+	}
+}
+
+// TestIsValidTransportEnvelope_Built tests that an envelope built offline is
+// accepted once its provider is trusted
+func TestIsValidTransportEnvelope_Built(t *testing.T) {
+	provider := newProviderSigner(t)
+	original := []byte("From: sender@sender.example.com\r\n" +
+		"To: recipient@example.com\r\n" +
+		"Subject: Offline\r\n" +
+		"Message-ID: <offline@sender.example.com>\r\n" +
+		"\r\n" +
+		"Hello\r\n")
+	envelope, err := common.BuildTransportEnvelope(original, common.PECCertificationData{}, provider)
+	if err != nil {
+		t.Fatalf("BuildTransportEnvelope failed: %v", err)
+	}
+
+	if IsValidTransportEnvelope(envelope) {
+		t.Errorf("Expected the envelope of an unknown provider to be refused")
+	}
+	trustProvider(t, provider)
+	if !IsValidTransportEnvelope(envelope) {
+		t.Errorf("Expected the envelope to be valid for a trusted provider")
+	}
+}
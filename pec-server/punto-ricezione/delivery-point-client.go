@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"time"
+)
+
+// ErrDeliveryFailed is wrapped by the error returned when forwarding to the
+// delivery point is given up, so that callers can emit a non-delivery notice.
+var ErrDeliveryFailed = errors.New("delivery to the delivery point failed")
+
+const (
+	defaultDeliveryPointURL = "http://delivery-point/api/receive"
+	defaultMaxAttempts      = 5
+	defaultForwardTimeout   = 10 * time.Second
+	defaultBaseDelay        = 500 * time.Millisecond
+	defaultMaxDelay         = 30 * time.Second
+)
+
+// DeliveryPointClient forwards raw messages to the punto di consegna HTTP API,
+// retrying transient failures with exponential backoff and jitter.
+type DeliveryPointClient struct {
+	URL         string
+	MaxAttempts int
+	Timeout     time.Duration // per attempt
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	HTTPClient  *http.Client
+}
+
+// NewDeliveryPointClient creates a client with default retry settings
+func NewDeliveryPointClient(url string) *DeliveryPointClient {
+	if url == "" {
+		url = defaultDeliveryPointURL
+	}
+	return &DeliveryPointClient{
+		URL:         url,
+		MaxAttempts: defaultMaxAttempts,
+		Timeout:     defaultForwardTimeout,
+		BaseDelay:   defaultBaseDelay,
+		MaxDelay:    defaultMaxDelay,
+		HTTPClient:  &http.Client{},
+	}
+}
+
+// deliveryPoint is the client used by ForwardToDeliveryPoint
+var deliveryPoint = NewDeliveryPointClient("")
+
+// ForwardError describes a failed attempt to reach the delivery point
+type ForwardError struct {
+	StatusCode int // zero for transport errors
+	Err        error
+}
+
+func (e *ForwardError) Error() string {
+	if e.Err != nil {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("delivery point returned status %d", e.StatusCode)
+}
+
+func (e *ForwardError) Unwrap() error {
+	return e.Err
+}
+
+// Retryable reports whether the failure may succeed on a later attempt:
+// transport errors, timeouts and 5xx responses are retried, other 4xx are not.
+func (e *ForwardError) Retryable() bool {
+	switch {
+	case e.StatusCode == 0:
+		return true
+	case e.StatusCode >= 500:
+		return true
+	case e.StatusCode == http.StatusRequestTimeout || e.StatusCode == http.StatusTooManyRequests:
+		return true
+	default:
+		return false
+	}
+}
+
+// Forward posts the message to the delivery point. Permanent failures are
+// returned immediately and transient ones are retried up to MaxAttempts; in
+// both cases the returned error wraps ErrDeliveryFailed.
+func (c *DeliveryPointClient) Forward(data []byte) error {
+	attempts := c.MaxAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	var lastErr *ForwardError
+	for attempt := 1; attempt <= attempts; attempt++ {
+		lastErr = c.post(data)
+		if lastErr == nil {
+			return nil
+		}
+		if !lastErr.Retryable() {
+			return fmt.Errorf("%w: permanent failure: %w", ErrDeliveryFailed, lastErr)
+		}
+		if attempt < attempts {
+			time.Sleep(c.backoff(attempt))
+		}
+	}
+
+	return fmt.Errorf("%w after %d attempts: %w", ErrDeliveryFailed, attempts, lastErr)
+}
+
+// ForwardOnce makes a single attempt at posting the message, for the callers
+// retrying on their own such as the outbound queue. The returned error wraps
+// ErrDeliveryFailed and the ForwardError of the attempt.
+func (c *DeliveryPointClient) ForwardOnce(data []byte) error {
+	if err := c.post(data); err != nil {
+		return fmt.Errorf("%w: %w", ErrDeliveryFailed, err)
+	}
+	return nil
+}
+
+// post performs a single delivery attempt
+func (c *DeliveryPointClient) post(data []byte) *ForwardError {
+	req, err := http.NewRequest("POST", c.URL, bytes.NewReader(data))
+	if err != nil {
+		// A malformed request will not get better by retrying
+		return &ForwardError{StatusCode: http.StatusBadRequest, Err: err}
+	}
+	req.Header.Set("Content-Type", "message/rfc822")
+
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	if c.Timeout > 0 {
+		timeoutClient := *client
+		timeoutClient.Timeout = c.Timeout
+		client = &timeoutClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return &ForwardError{Err: err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &ForwardError{StatusCode: resp.StatusCode}
+	}
+	return nil
+}
+
+// backoff returns the delay before the next attempt: exponential in the
+// attempt number, capped at MaxDelay, with jitter in [delay/2, delay).
+func (c *DeliveryPointClient) backoff(attempt int) time.Duration {
+	delay := c.BaseDelay << (attempt - 1)
+	if c.MaxDelay > 0 && (delay > c.MaxDelay || delay <= 0) {
+		delay = c.MaxDelay
+	}
+	if delay <= 1 {
+		return delay
+	}
+	half := delay / 2
+	return half + rand.N(half)
+}
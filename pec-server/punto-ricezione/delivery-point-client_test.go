@@ -0,0 +1,259 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/danzipie/go-pec/pec-server/internal/common"
+	pec_storage "github.com/danzipie/go-pec/pec-server/internal/storage"
+)
+
+// newTestDeliveryPointClient creates a client with short delays for testing
+func newTestDeliveryPointClient(url string) *DeliveryPointClient {
+	client := NewDeliveryPointClient(url)
+	client.BaseDelay = time.Millisecond
+	client.MaxDelay = 5 * time.Millisecond
+	client.Timeout = time.Second
+	return client
+}
+
+// TestDeliveryPointClient_RetriesThenSucceeds tests that transient failures are retried
+func TestDeliveryPointClient_RetriesThenSucceeds(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if string(body) != "raw message" {
+			t.Errorf("Expected body 'raw message', got '%s'", string(body))
+		}
+		if r.Header.Get("Content-Type") != "message/rfc822" {
+			t.Errorf("Expected Content-Type message/rfc822, got '%s'", r.Header.Get("Content-Type"))
+		}
+		if atomic.AddInt32(&calls, 1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	client := newTestDeliveryPointClient(server.URL)
+	if err := client.Forward([]byte("raw message")); err != nil {
+		t.Fatalf("Forward failed: %v", err)
+	}
+	if calls != 3 {
+		t.Errorf("Expected 3 attempts, got %d", calls)
+	}
+}
+
+// TestDeliveryPointClient_PermanentFailure tests that 4xx responses are not retried
+func TestDeliveryPointClient_PermanentFailure(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	client := newTestDeliveryPointClient(server.URL)
+	err := client.Forward([]byte("raw message"))
+	if err == nil {
+		t.Fatal("Expected error for permanent failure, got none")
+	}
+	if !errors.Is(err, ErrDeliveryFailed) {
+		t.Errorf("Expected error to wrap ErrDeliveryFailed, got: %v", err)
+	}
+	var forwardErr *ForwardError
+	if !errors.As(err, &forwardErr) || forwardErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected a ForwardError with status 400, got: %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("Expected 1 attempt, got %d", calls)
+	}
+}
+
+// TestDeliveryPointClient_GivesUp tests that retries are bounded by MaxAttempts
+func TestDeliveryPointClient_GivesUp(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	client := newTestDeliveryPointClient(server.URL)
+	client.MaxAttempts = 4
+	err := client.Forward([]byte("raw message"))
+	if !errors.Is(err, ErrDeliveryFailed) {
+		t.Fatalf("Expected error to wrap ErrDeliveryFailed, got: %v", err)
+	}
+	if calls != 4 {
+		t.Errorf("Expected 4 attempts, got %d", calls)
+	}
+}
+
+// TestDeliveryPointClient_ConnectionRefused tests that transport errors are retried
+func TestDeliveryPointClient_ConnectionRefused(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	url := server.URL
+	server.Close()
+
+	client := newTestDeliveryPointClient(url)
+	client.MaxAttempts = 2
+	err := client.Forward([]byte("raw message"))
+	if !errors.Is(err, ErrDeliveryFailed) {
+		t.Fatalf("Expected error to wrap ErrDeliveryFailed, got: %v", err)
+	}
+	var forwardErr *ForwardError
+	if !errors.As(err, &forwardErr) || !forwardErr.Retryable() {
+		t.Errorf("Expected a retryable ForwardError, got: %v", err)
+	}
+}
+
+// TestDeliveryPointClient_Backoff tests that delays grow and are capped
+func TestDeliveryPointClient_Backoff(t *testing.T) {
+	client := NewDeliveryPointClient("")
+	client.BaseDelay = 100 * time.Millisecond
+	client.MaxDelay = 1 * time.Second
+
+	for attempt := 1; attempt <= 10; attempt++ {
+		expected := client.BaseDelay << (attempt - 1)
+		if expected > client.MaxDelay {
+			expected = client.MaxDelay
+		}
+		delay := client.backoff(attempt)
+		if delay < expected/2 || delay >= expected {
+			t.Errorf("Attempt %d: expected delay in [%v, %v), got %v", attempt, expected/2, expected, delay)
+		}
+	}
+}
+
+// TestForwardToDeliveryPoint_QueuedAttempts tests that a queued envelope is
+// posted once per pass of the queue, and dead-lettered at once when the
+// delivery point refuses it for good
+func TestForwardToDeliveryPoint_QueuedAttempts(t *testing.T) {
+	var calls atomic.Int32
+	var status atomic.Int32
+	status.Store(http.StatusServiceUnavailable)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer server.Close()
+
+	saved := deliveryPoint
+	deliveryPoint = newTestDeliveryPointClient(server.URL)
+	t.Cleanup(func() { deliveryPoint = saved })
+
+	queue, err := common.NewOutboundQueue(t.TempDir(), sendOutbound)
+	if err != nil {
+		t.Fatalf("NewOutboundQueue failed: %v", err)
+	}
+	outboundQueue = queue
+	t.Cleanup(func() { outboundQueue = nil })
+
+	if err := ForwardToDeliveryPoint(newEnvelopeSession(t, testEnvelope)); err != nil {
+		t.Fatalf("ForwardToDeliveryPoint failed: %v", err)
+	}
+
+	// A transient failure is left to the queue to retry
+	queue.ProcessPending()
+	if calls.Load() != 1 {
+		t.Errorf("Expected 1 POST for a transient failure, got %d", calls.Load())
+	}
+	if pending, _ := queue.Pending(); len(pending) != 1 {
+		t.Fatalf("Expected the envelope to stay queued, got %d items", len(pending))
+	}
+
+	status.Store(http.StatusBadRequest)
+	queue.ProcessPending()
+	if calls.Load() != 2 {
+		t.Errorf("Expected 2 POSTs in total, got %d", calls.Load())
+	}
+	if pending, _ := queue.Pending(); len(pending) != 0 {
+		t.Errorf("Expected the envelope to leave the queue, got %d items", len(pending))
+	}
+	if dead, _ := queue.DeadLetters(); len(dead) != 1 {
+		t.Errorf("Expected the envelope to be dead-lettered, got %d items", len(dead))
+	}
+}
+
+// TestForwardToDeliveryPoint_ReplayDeadLetter tests that an envelope whose
+// forward is given up is dead-lettered, and delivered once replayed
+func TestForwardToDeliveryPoint_ReplayDeadLetter(t *testing.T) {
+	var available atomic.Bool
+	var delivered atomic.Value
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !available.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		delivered.Store(string(body))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	client := newTestDeliveryPointClient(server.URL)
+	client.MaxAttempts = 1
+	saved := deliveryPoint
+	deliveryPoint = client
+	t.Cleanup(func() { deliveryPoint = saved })
+
+	queue, err := common.NewOutboundQueue(t.TempDir(), sendOutbound)
+	if err != nil {
+		t.Fatalf("NewOutboundQueue failed: %v", err)
+	}
+	queue.MaxAttempts = 1
+	outboundQueue = queue
+	t.Cleanup(func() { outboundQueue = nil })
+
+	if err := ForwardToDeliveryPoint(newEnvelopeSession(t, testEnvelope)); err != nil {
+		t.Fatalf("ForwardToDeliveryPoint failed: %v", err)
+	}
+	queue.ProcessPending()
+
+	admin := common.NewDeadLetterAdmin(queue, nil)
+	dead, err := admin.List()
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if len(dead) != 1 || dead[0].Kind != common.OutboundHTTP || dead[0].MessageID != originalMessageID {
+		t.Fatalf("Expected the envelope to be dead-lettered, got %+v", dead)
+	}
+	if delivered.Load() != nil {
+		t.Fatal("Expected nothing to be delivered yet")
+	}
+
+	journal, err := pec_storage.NewFileJournal(filepath.Join(t.TempDir(), "journal.log"))
+	if err != nil {
+		t.Fatalf("NewFileJournal failed: %v", err)
+	}
+	defer journal.Close()
+	admin = common.NewDeadLetterAdmin(queue, journal)
+
+	available.Store(true)
+	if _, err := admin.Replay(dead[0].ID); err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	body, _ := delivered.Load().(string)
+	if !strings.Contains(body, "X-Riferimento-Message-ID: "+originalMessageID) {
+		t.Errorf("Expected the envelope to be delivered, got %q", body)
+	}
+	if dead, _ := admin.List(); len(dead) != 0 {
+		t.Errorf("Expected no dead-letter items after the replay, got %d", len(dead))
+	}
+	entries, err := journal.QueryByMessageID(originalMessageID)
+	if err != nil {
+		t.Fatalf("QueryByMessageID failed: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Event != pec_storage.EventReplayed || entries[0].Outcome != pec_storage.OutcomeSuccess {
+		t.Errorf("Expected a successful replay entry, got %+v", entries)
+	}
+}
@@ -9,6 +9,7 @@ import (
 
 	"github.com/danzipie/go-pec/pec-server/internal/common"
 	"github.com/danzipie/go-pec/pec-server/logger"
+	"github.com/danzipie/go-pec/pec-server/metrics"
 )
 
 // Main entry point for the PEC Punto ricezione server
@@ -42,27 +43,99 @@ func main() {
 	case err := <-errChan:
 		log.Fatalf("Server error: %v", err)
 	case sig := <-sigChan:
-		log.Printf("Received signal %v, shutting down...", sig)
+		logger.LogInfo("Received signal, shutting down", map[string]string{"signal": sig.String()})
 		if err := server.Stop(); err != nil {
-			log.Printf("Error during shutdown: %v", err)
+			logger.LogError("Error during shutdown", err, nil)
 		}
 	}
 }
 
+// Use inserts steps ahead of the processing of the received messages, such
+// as archiving or extra validation; it is called before Start
+func (s *PuntoRicezioneServer) Use(steps ...common.Step) {
+	receptionPointPipeline.Use(steps...)
+}
+
 // Start starts both SMTP and IMAP servers
 func (s *PuntoRicezioneServer) Start() error {
 	// Create SMTP backend
-	smtpBackend := common.NewBackend(s.signer, s.store, ReceptionPointHandler, s.config.Domain)
+	smtpBackend := common.NewBackend(s.signer, s.store, s.journal, ReceptionPointHandler, s.config.Domain)
+	smtpBackend.Certificates = s.tlsCertificates
+	smtpBackend.ClientCAs = s.clientCAs
+	smtpBackend.AllowInsecureAuth = s.config.AllowInsecureAuth
+	smtpBackend.Greeting = s.config.SMTPGreeting
+	smtpBackend.MaxLineLength = s.config.SMTPMaxLineLength
+	smtpBackend.TrustedNetworks = s.trustedNetworks
+	smtpBackend.Policy = common.PolicyRelay
+	smtpBackend.Webhook = s.webhook
+
+	// Start the outbound queue worker
+	if outboundQueue != nil {
+		outboundQueue.Start()
+	}
+
+	// Serve the dead-letter admin endpoints, if configured
+	if s.config.AdminServer != "" && outboundQueue != nil {
+		admin := common.NewDeadLetterAdmin(outboundQueue, s.journal)
+		go func() {
+			if err := common.StartAdminServer(s.config.AdminServer, admin); err != nil {
+				logger.LogError("Admin server failed", err, map[string]string{"addr": s.config.AdminServer})
+			}
+		}()
+	}
+
+	// Serve the health endpoints, if configured
+	if s.config.HealthServer != "" {
+		go func() {
+			if err := common.StartHealthServer(s.config.HealthServer, s.health); err != nil {
+				logger.LogError("Health server failed", err, map[string]string{"addr": s.config.HealthServer})
+			}
+		}()
+	}
+
+	// Watch the credential files for renewals
+	s.credentials.Start()
+	if s.tlsCertificates != nil {
+		s.tlsCertificates.Start(s.credentials.Interval)
+	}
+
+	// Serve the metrics endpoint, if configured
+	if s.config.MetricsServer != "" {
+		go func() {
+			if err := metrics.StartServer(s.config.MetricsServer); err != nil {
+				logger.LogError("Metrics server failed", err, map[string]string{"addr": s.config.MetricsServer})
+			}
+		}()
+	}
 
 	// Start SMTP server (blocking)
-	return common.StartSMTP(s.smtpAddress, s.config.Domain, smtpBackend)
+	return common.StartSMTP(s.smtpAddress, s.config.Hostname(), smtpBackend, s.health)
 }
 
 // Stop gracefully shuts down all servers
 func (s *PuntoRicezioneServer) Stop() error {
+	// Stop the outbound queue worker
+	if outboundQueue != nil {
+		outboundQueue.Stop()
+	}
+
+	// Stop watching the credential files
+	s.credentials.Stop()
+	if s.tlsCertificates != nil {
+		s.tlsCertificates.Stop()
+	}
+
 	// Close the message store
 	if err := s.store.Close(); err != nil {
 		return fmt.Errorf("failed to close message store: %v", err)
 	}
+	// Close the journal
+	if s.journal != nil {
+		if err := s.journal.Close(); err != nil {
+			return fmt.Errorf("failed to close journal: %v", err)
+		}
+	}
+	// Wait for the webhook notifications being posted
+	s.webhook.Close()
 	return nil
 }
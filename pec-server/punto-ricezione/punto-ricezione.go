@@ -2,33 +2,40 @@ package main
 
 import (
 	"bytes"
-	"crypto/sha1"
 	"crypto/x509"
 	"encoding/base64"
-	"encoding/hex"
-	"encoding/xml"
+	"errors"
 	"fmt"
-	"net/http"
+	"net"
 	"net/smtp"
 	"strings"
 	"time"
 
+	"github.com/danzipie/go-pec/pec"
 	"github.com/danzipie/go-pec/pec-server/internal/common"
 	pec_storage "github.com/danzipie/go-pec/pec-server/internal/storage"
+	"github.com/danzipie/go-pec/pec-server/logger"
+	"github.com/danzipie/go-pec/pec-server/metrics"
 	"github.com/emersion/go-message"
 	"github.com/emersion/go-message/mail"
-	"go.mozilla.org/pkcs7"
 )
 
 // PuntoRicezioneServer represents a complete Punto ricezione server instance
 type PuntoRicezioneServer struct {
-	config      *common.Config
-	store       pec_storage.MessageStore
-	signer      *common.Signer
-	smtpAddress string
-	imapAddress string
-	certificate *x509.Certificate
-	privateKey  interface{}
+	config          *common.Config
+	store           pec_storage.MessageStore
+	journal         pec_storage.Journal
+	signer          *common.Signer
+	credentials     *common.CredentialsWatcher
+	tlsCertificates *common.CertificateHolder
+	clientCAs       *x509.CertPool
+	trustedNetworks []*net.IPNet
+	health          *common.Health
+	smtpAddress     string
+	imapAddress     string
+	certificate     *x509.Certificate
+	privateKey      interface{}
+	webhook         *common.Webhook
 }
 
 // NewPuntoRicezioneServer creates a new PEC punto Ricezione server instance
@@ -39,8 +46,11 @@ func NewPuntoRicezioneServer(configPath string) (*PuntoRicezioneServer, error) {
 		return nil, fmt.Errorf("failed to load config: %v", err)
 	}
 
+	// Keep personal data out of the logs, if configured
+	logger.SetRedaction(cfg.RedactLogs)
+
 	// Load S/MIME credentials
-	cert, key, err := common.LoadSMIMECredentials(cfg.CertFile, cfg.KeyFile)
+	cert, key, chain, err := common.LoadCredentials(cfg)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load S/MIME credentials: %v", err)
 	}
@@ -49,151 +59,303 @@ func NewPuntoRicezioneServer(configPath string) (*PuntoRicezioneServer, error) {
 	signer := &common.Signer{
 		Cert:   cert,
 		Key:    key,
+		Chain:  chain,
 		Domain: cfg.Domain,
 	}
 
-	// Create message store
-	messageStore := pec_storage.NewInMemoryStore()
+	// Warn about an expiring certificate and pick up renewed ones
+	credentials := common.NewCredentialsWatcher(cfg, signer)
+	credentials.CheckExpiry()
 
-	return &PuntoRicezioneServer{
-		config:      cfg,
-		store:       messageStore,
-		signer:      signer,
-		smtpAddress: cfg.SMTPServer,
-		imapAddress: cfg.IMAPServer,
-		certificate: cert,
-		privateKey:  key,
-	}, nil
-}
+	// Load the TLS certificate of the listeners, if configured
+	tlsCertificates, err := common.LoadTLSCertificates(cfg)
+	if err != nil {
+		return nil, err
+	}
 
-// Assume you have a provider index like this:
-var providerCertificateHashes = map[string]struct{}{
-	// "SHA1_HEX_HASH": {},
-	// e.g. "AABBCCDDEEFF...": {},
-}
+	// Load the CAs of the providers allowed to connect with mutual TLS
+	clientCAs, err := common.LoadClientCAs(cfg)
+	if err != nil {
+		return nil, err
+	}
 
-// IsValidTransportEnvelope checks if the message is a valid, signed PEC transport envelope.
-func IsValidTransportEnvelope(header *mail.Header, body []byte) bool {
-	// 1. Check for S/MIME signature structure (Content-Type: application/pkcs7-mime or smime.p7m)
-	contentType := ""
-	if ct := header.Get("Content-Type"); ct != "" {
-		contentType = ct
+	// Parse the networks of the peers allowed to relay without authenticating
+	trustedNetworks, err := common.ParseTrustedNetworks(cfg.TrustedNetworks)
+	if err != nil {
+		return nil, err
+	}
+
+	// Configure forwarding to the delivery point
+	deliveryPoint = NewDeliveryPointClient(cfg.DeliveryPointURL)
+	if cfg.ForwardMaxAttempts > 0 {
+		deliveryPoint.MaxAttempts = cfg.ForwardMaxAttempts
 	}
-	if !strings.Contains(contentType, "application/pkcs7-mime") && !strings.Contains(contentType, "smime.p7m") {
-		return false // Not an S/MIME signed message
+	if cfg.ForwardTimeoutSeconds > 0 {
+		deliveryPoint.Timeout = time.Duration(cfg.ForwardTimeoutSeconds) * time.Second
 	}
 
-	// 2. Parse PKCS7 structure and extract certificates
-	p7, err := pkcs7.Parse(body)
-	if err != nil {
-		return false // Not a valid PKCS7 structure
+	// Load the DKIM key, if configured
+	dkimSigner = nil
+	if cfg.DKIMKeyFile != "" {
+		dkimSigner, err = common.LoadDKIMSigner(cfg.Domain, cfg.DKIMSelector, cfg.DKIMKeyFile, cfg.DKIMHeaders)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load DKIM key: %v", err)
+		}
 	}
-	if len(p7.Certificates) == 0 {
-		return false // No signing certificate found
+
+	// Enable DKIM/SPF verification of incoming messages, if configured
+	senderAuth = nil
+	if cfg.VerifyDKIM || cfg.VerifySPF {
+		senderAuth = NewSenderAuthVerifier(cfg.VerifyDKIM, cfg.VerifySPF)
 	}
 
-	// 3. Check if the signing certificate is from a certified provider
-	signerCert := p7.GetOnlySigner()
-	if signerCert == nil {
-		return false
+	// Load the CAs of the provider certificates signing the envelopes
+	roots, err := common.LoadProviderRoots(cfg)
+	if err != nil {
+		return nil, err
 	}
-	sha1sum := sha1.Sum(signerCert.Raw)
-	sha1hex := strings.ToUpper(hex.EncodeToString(sha1sum[:]))
-	if _, ok := providerCertificateHashes[sha1hex]; !ok {
-		return false // Not a certified provider
+	providerTrust = &common.ProviderTrust{Roots: roots}
+
+	// Check the revocation of the provider certificates, if configured
+	if cfg.CheckRevocation {
+		ttl := time.Duration(cfg.RevocationCacheTTLSeconds) * time.Second
+		providerTrust.Revocation = common.NewRevocationChecker(cfg.RevocationFailClosed, ttl)
 	}
 
-	// 4. Verify the S/MIME signature (including CRL and validity)
-	roots := x509.NewCertPool()
-	// Add trusted CA certs to roots as needed
-	opts := x509.VerifyOptions{
-		Roots: roots,
-		// Add CRL checking and time validity as needed
+	// Render the receipts in the configured locale
+	receiptTemplates, err = common.LoadReceiptTemplates(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load receipt templates: %v", err)
 	}
-	if _, err := signerCert.Verify(opts); err != nil {
-		return false // Certificate not valid
+
+	// Brand the From field of the receipts and envelopes
+	providerFrom = common.NewProviderFrom(cfg)
+
+	// Give the dates of the receipts and envelopes in the configured zone
+	timezone, err = common.LoadTimezone(cfg)
+	if err != nil {
+		return nil, err
 	}
-	if err := p7.Verify(); err != nil {
-		return false // Signature not valid
+
+	// Load the provider index from a file, if configured; a database
+	// registry can be injected with SetAuthorityRegistry
+	authorityRegistry = nil
+	if cfg.AuthorityRegistryFile != "" {
+		registry, err := pec_storage.LoadInMemoryAuthorityRegistry(cfg.AuthorityRegistryFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load authority registry: %v", err)
+		}
+		useAuthorityRegistry(cfg, registry)
 	}
 
-	// 5. Formal correctness (basic check: must have From, To, Date, etc.)
-	if _, err := header.AddressList("From"); err != nil {
-		return false
+	// Open the outbound queue, if configured
+	outboundQueue = nil
+	if cfg.QueueDir != "" {
+		queue, err := common.NewOutboundQueue(cfg.QueueDir, sendOutbound)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open outbound queue: %v", err)
+		}
+		queue.OnDeadLetter = func(item *common.OutboundItem, err error) {
+			if item.Kind != common.OutboundHTTP {
+				return
+			}
+			if nErr := emitNonDeliveryNotice(cfg.Domain, item.Data, err); nErr != nil {
+				logger.LogError("Failed to emit non-delivery notice", nErr, map[string]string{"id": item.ID})
+			}
+		}
+		outboundQueue = queue
 	}
-	if _, err := header.AddressList("To"); err != nil {
-		return false
+
+	// Create message store
+	messageStore, err := common.NewMessageStore(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create message store: %v", err)
 	}
-	if _, err := header.Date(); err != nil {
-		return false
+
+	// Open the journal, if configured
+	var journal pec_storage.Journal
+	if cfg.JournalFile != "" {
+		fileJournal, err := pec_storage.NewFileJournal(cfg.JournalFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open journal: %v", err)
+		}
+		journal = fileJournal
 	}
 
-	return true
+	return &PuntoRicezioneServer{
+		config:          cfg,
+		store:           messageStore,
+		journal:         journal,
+		signer:          signer,
+		credentials:     credentials,
+		tlsCertificates: tlsCertificates,
+		clientCAs:       clientCAs,
+		trustedNetworks: trustedNetworks,
+		health:          common.NewHealth(messageStore, "smtp"),
+		smtpAddress:     cfg.RelayAddress(),
+		imapAddress:     cfg.IMAPServer,
+		certificate:     cert,
+		privateKey:      key,
+		webhook:         common.NewWebhook(cfg),
+	}, nil
+}
+
+// providerTrust is used to check the signature of incoming transport
+// envelopes; the providers of the authority registry are trusted
+var providerTrust = &common.ProviderTrust{Roots: x509.NewCertPool()}
+
+// IsValidTransportEnvelope checks if the message is a valid, signed PEC transport envelope.
+func IsValidTransportEnvelope(data []byte) bool {
+	return common.VerifyTransportEnvelope(data, providerTrust) == nil
 }
 
+// ReceptionPointHandler processes a message received from another provider
 func ReceptionPointHandler(s *common.Session) error {
-	// 1. Parse and verify the incoming message
-	header, body, err := common.ParseEmailFromSession(*s)
+	return receptionPointPipeline.Handle(s)
+}
+
+// receptionPointPipeline processes the messages received from other
+// providers. Deployments insert their own steps with PuntoRicezioneServer.Use.
+var receptionPointPipeline = common.NewPipeline(common.HandlerStep(routeIncomingMessage))
+
+// routeIncomingMessage classifies a message received from another provider
+// and routes it: envelopes and receipts to the delivery point, the other
+// messages wrapped in an anomaly envelope
+func routeIncomingMessage(s *common.Session) error {
+	// 1. Parse the header of the incoming message; the body is only read
+	// raw, to verify its signature
+	data, _ := s.GetData()
+	mr, err := mail.CreateReader(bytes.NewReader(data))
 	if err != nil {
 		return fmt.Errorf("failed to parse incoming message: %w", err)
 	}
+	header := &mr.Header
+	messageID := header.Get("Message-ID")
+	s.Record(pec_storage.JournalEntry{Event: pec_storage.EventReceived, MessageID: messageID})
+	metrics.MessagesReceived.Inc()
+
+	// Messages failing DKIM or SPF are always treated as anomalies
+	authFailed := false
+	if senderAuth != nil {
+		results := senderAuth.Verify(s, data)
+		entry := pec_storage.JournalEntry{
+			Event:     pec_storage.EventSenderAuthenticated,
+			MessageID: messageID,
+			Detail:    results.String(),
+		}
+		if results.Failed() {
+			entry.Outcome = pec_storage.OutcomeFailure
+			authFailed = true
+		}
+		s.Record(entry)
+	}
 
-	// 2. Check if the message is a valid transport envelope (busta di trasporto)
-	if IsValidTransportEnvelope(header, body) {
+	// 2. Classify the message once; messages failing DKIM or SPF are always anomalies
+	class, reason := Unknown, ReasonSenderAuth
+	if !authFailed {
+		class, reason, err = ClassifyMessage(header, common.RawBody(data))
+		if err != nil {
+			return fmt.Errorf("failed to classify incoming message: %w", err)
+		}
+	}
+
+	switch class {
+	case TransportEnvelope:
+		// 3. A valid transport envelope (busta di trasporto)
+		metrics.MessagesAccepted.Inc()
 		// a. Emit a "presa in carico" receipt to the sender's provider
-		if err := EmitPresaInCaricoReceipt(s); err != nil {
+		err := EmitPresaInCaricoReceipt(s)
+		entry := common.ResultEntry(pec_storage.EventReceiptEmitted, messageID, err)
+		entry.Identificativo = common.ReceiptIdentifier(pec.TipoPresaInCarico, common.OriginalMessageID(header), s.Domain)
+		s.Record(entry)
+		if err != nil {
 			return fmt.Errorf("failed to emit presa in carico: %w", err)
 		}
 		// b. Forward the envelope to the delivery point (punto di consegna)
-		if err := ForwardToDeliveryPoint(s); err != nil {
+		err = ForwardToDeliveryPoint(s)
+		s.RecordResult(pec_storage.EventForwarded, messageID, err)
+		if err != nil && !errors.Is(err, ErrDeliveryFailed) {
 			return fmt.Errorf("failed to forward to delivery point: %w", err)
 		}
+		if err != nil {
+			// c. Delivery was given up: notify the sender. The envelope was
+			// taken in charge, so it is not retried: it is accepted once the
+			// sender is notified and refused permanently otherwise
+			nErr := EmitNonDeliveryNotice(s, err)
+			s.RecordResult(pec_storage.EventReceiptEmitted, messageID, nErr)
+			if nErr != nil {
+				logger.LogError("Failed to emit non-delivery notice", nErr, s.LogContext())
+				return common.ErrNotDelivered
+			}
+		}
 		return nil
-	} else if IsValidReceiptOrAvviso(header, body) {
-		// 3. If it's a valid receipt or avviso
+
+	case Receipt, Avviso:
+		// 4. A valid receipt or avviso
+		metrics.MessagesAccepted.Inc()
 		// Forward to delivery point
-		if err := ForwardToDeliveryPoint(s); err != nil {
+		err := ForwardToDeliveryPoint(s)
+		s.RecordResult(pec_storage.EventForwarded, messageID, err)
+		if err != nil {
 			return fmt.Errorf("failed to forward receipt/avviso: %w", err)
 		}
 		return nil
-	} else if IsFromCertifiedProvider(header) && common.IsSignatureValid(header, body) {
-		// 4. If not a valid envelope/receipt/avviso, but from a certified provider (firma OK)
-		// a. Wrap in "busta di anomalia"
-		anomalyEnvelope, err := CreateAnomalyEnvelope(s)
+
+	default:
+		// 5. Not a valid envelope/receipt/avviso: wrap in "busta di anomalia".
+		// The message is either from a certified provider (firma OK), not
+		// from a certified provider (firma NOT OK), or failing DKIM/SPF
+		logger.LogAnomaly(s.From, s.To, messageID, string(reason))
+		logReceivedTrace(s, header, messageID)
+		metrics.MessagesRejected.Inc()
+		anomalyEnvelope, err := CreateAnomalyEnvelope(s, reason)
 		if err != nil {
 			return fmt.Errorf("failed to create anomaly envelope: %w", err)
 		}
-		// b. Forward anomaly envelope to delivery point
-		if err := ForwardEnvelopeToDeliveryPoint(anomalyEnvelope); err != nil {
-			return fmt.Errorf("failed to forward anomaly envelope: %w", err)
-		}
-		return nil
-	} else {
-		// 5. If not from a certified provider (firma NOT OK)
-		// a. Wrap in "busta di anomalia"
-		anomalyEnvelope, err := CreateAnomalyEnvelope(s)
+		// Forward anomaly envelope to delivery point
+		err = ForwardEnvelopeToDeliveryPoint(anomalyEnvelope)
+		entry := common.ResultEntry(pec_storage.EventForwarded, messageID, err)
+		entry.Identificativo = common.ReceiptIdentifier(pec.TipoAnomalia, messageID, s.Domain)
+		s.Record(entry)
 		if err != nil {
-			return fmt.Errorf("failed to create anomaly envelope: %w", err)
-		}
-		// b. Forward anomaly envelope to delivery point
-		if err := ForwardEnvelopeToDeliveryPoint(anomalyEnvelope); err != nil {
 			return fmt.Errorf("failed to forward anomaly envelope: %w", err)
 		}
+		return nil
 	}
-
-	return nil
 }
 
-type CertData struct {
-	XMLName      xml.Name `xml:"certificazione"`
-	Data         string   `xml:"data"`
-	Ora          string   `xml:"ora"`
-	Oggetto      string   `xml:"oggetto"`
-	Mittente     string   `xml:"mittente"`
-	Destinatario string   `xml:"destinatario"`
-	MsgID        string   `xml:"identificativo"`
+// logReceivedTrace logs the hops the message went through, to help tracing
+// where an anomaly comes from
+func logReceivedTrace(s *common.Session, header *mail.Header, messageID string) {
+	hops, err := pec.ParseReceivedHeaders(header)
+	if len(hops) == 0 {
+		return
+	}
+	trace := make([]string, len(hops))
+	for i, hop := range hops {
+		trace[i] = hop.String()
+		if trace[i] == "" {
+			trace[i] = hop.Raw
+		}
+	}
+	ctx := s.LogContext()
+	ctx["message_id"] = messageID
+	ctx["received"] = strings.Join(trace, " | ")
+	if err != nil {
+		ctx["received_error"] = err.Error()
+	}
+	logger.LogInfo("Received trace of the anomalous message", ctx)
 }
 
+// receiptTemplates renders the human-readable bodies of the receipts
+var receiptTemplates = common.DefaultReceiptTemplates()
+
+// providerFrom composes the From field of the receipts and envelopes
+var providerFrom common.ProviderFrom
+
+// timezone is the zone the dates of the receipts and envelopes are given in
+var timezone = common.DefaultLocation
+
 // EmitPresaInCaricoReceipt creates and sends a "presa in carico" receipt for a valid transport envelope.
 func EmitPresaInCaricoReceipt(s *common.Session) error {
 	// Parse the original message
@@ -204,36 +366,41 @@ func EmitPresaInCaricoReceipt(s *common.Session) error {
 
 	// Extract original headers
 	origSubject, _ := header.Subject()
+	origSubject = common.SubjectText(origSubject)
 	origFrom, _ := header.AddressList("From")
 	origTo, _ := header.AddressList("To")
-	origMsgID := header.Get("Message-ID")
+	origMsgID := common.OriginalMessageID(header)
 
 	// Compose receipt headers
-	now := time.Now()
+	now := time.Now().In(timezone)
 	receiptHeader := mail.Header{}
 	receiptHeader.SetSubject("PRESA IN CARICO: " + origSubject)
-	receiptHeader.SetAddressList("From", []*mail.Address{{Address: "posta-certificata@" + s.Domain}})
-	// Lookup provider receipt address (implement this lookup as needed)
-	receiptTo := LookupProviderReceiptAddress(origFrom)
+	receiptHeader.SetAddressList("From", []*mail.Address{providerFrom.Address(s.Domain)})
+	// Lookup the receipt address of the sender's provider
+	receiptTo, err := LookupProviderReceiptAddress(origFrom)
+	if err != nil {
+		return fmt.Errorf("failed to lookup provider receipt address: %w", err)
+	}
 	receiptHeader.SetAddressList("To", []*mail.Address{{Address: receiptTo}})
 	receiptHeader.Set("X-Ricevuta", "presa-in-carico")
 	receiptHeader.Set("Date", now.Format(time.RFC1123Z))
 	receiptHeader.Set("X-Riferimento-Message-ID", origMsgID)
 
 	// Compose receipt body
-	var toList string
+	var toList []string
 	for _, addr := range origTo {
-		toList += addr.Address + "\n"
-	}
-	textBody := fmt.Sprintf(
-		`Ricevuta di presa in carico
-Il giorno %s alle ore %s (%s) il messaggio
-"%s" proveniente da "%s"
-ed indirizzato a:
-%s
-è stato accettato dal sistema.
-Identificativo messaggio: %s
-`, now.Format("02/01/2006"), now.Format("15:04:05"), now.Format("MST"), origSubject, origFrom[0].Address, toList, origMsgID)
+		toList = append(toList, addr.Address)
+	}
+	textBody, err := receiptTemplates.Text(pec.TipoPresaInCarico, common.ReceiptData{
+		Date:      now,
+		Subject:   origSubject,
+		From:      origFrom[0].Address,
+		To:        toList,
+		MessageID: origMsgID,
+	})
+	if err != nil {
+		return err
+	}
 
 	textHeader := message.Header{}
 	textHeader.Set("Content-Type", "text/plain; charset=utf-8")
@@ -242,31 +409,32 @@ Identificativo messaggio: %s
 		return fmt.Errorf("failed to create text part: %v", err)
 	}
 	// Compose XML certification data
-	certData := CertData{
-		Data:         now.Format("02/01/2006"),
-		Ora:          now.Format("15:04:05"),
-		Oggetto:      origSubject,
-		Mittente:     origFrom[0].Address,
-		Destinatario: toList,
-		MsgID:        origMsgID,
-	}
-	xmlBuf, _ := xml.MarshalIndent(certData, "", "  ")
-	var xmlB64 bytes.Buffer
-	b64Encoder := base64.NewEncoder(base64.StdEncoding, &xmlB64)
-	b64Encoder.Write(xmlBuf)
-	b64Encoder.Close()
+	certData := pec.NewDatiCert(pec.TipoPresaInCarico, pec.ErroreNessuno, common.ProviderName(s.Domain), now)
+	certData.Intestazione.Mittente = origFrom[0].Address
+	for _, addr := range origTo {
+		certData.AddDestinatari("certificato", addr.Address)
+	}
+	certData.Intestazione.Risposte = origFrom[0].Address
+	certData.Intestazione.Oggetto = origSubject
+	certData.Dati.Identificativo = common.ReceiptIdentifier(pec.TipoPresaInCarico, origMsgID, s.Domain)
+	certData.Dati.MsgID = origMsgID
+	xmlBuf, err := certData.Marshal()
+	if err != nil {
+		return err
+	}
+	xmlB64 := common.FormatBase64(base64.StdEncoding.EncodeToString(xmlBuf), common.Base64LineLength)
 
 	xmlHeader := message.Header{}
 	xmlHeader.Set("Content-Type", "application/xml")
 	xmlHeader.Set("Content-Disposition", "attachment; filename=\"daticert.xml\"")
 	xmlHeader.Set("Content-Transfer-Encoding", "base64")
-	xmlPart, err := message.New(xmlHeader, bytes.NewReader(xmlB64.Bytes()))
+	xmlPart, err := message.New(xmlHeader, strings.NewReader(xmlB64))
 	if err != nil {
 		return fmt.Errorf("failed to create xml part: %v", err)
 	}
 
-	// Create multipart/mixed entity (alternative + xml)
-	mixedHeader := message.Header{}
+	// Create multipart/mixed entity (text + xml) carrying the receipt headers
+	mixedHeader := receiptHeader.Header
 	mixedHeader.Set("Content-Type", "multipart/mixed")
 	mixedHeader.Set("Content-Transfer-Encoding", "binary")
 	mixedEntity, err := message.NewMultipart(mixedHeader, []*message.Entity{textPart, xmlPart})
@@ -285,10 +453,52 @@ Identificativo messaggio: %s
 	return ForwardEnvelopeToDeliveryPoint(body.Bytes())
 }
 
-// Helper: Lookup provider receipt address (stub)
-func LookupProviderReceiptAddress(from []*mail.Address) string {
-	// Implement lookup logic based on your provider index
-	return "ricevute@provider.it"
+// authorityRegistry is the provider index used to address receipts and to
+// trust the signers of the envelopes
+var authorityRegistry pec_storage.AuthorityRegistryStore
+
+// SetAuthorityRegistry sets the provider index used to address receipts and
+// to trust the signers of the envelopes, caching its lookups when configured
+func (s *PuntoRicezioneServer) SetAuthorityRegistry(registry pec_storage.AuthorityRegistryStore) {
+	useAuthorityRegistry(s.config, registry)
+}
+
+// useAuthorityRegistry makes registry the provider index of the reception point
+func useAuthorityRegistry(cfg *common.Config, registry pec_storage.AuthorityRegistryStore) {
+	if cfg.AuthorityCacheTTLSeconds > 0 {
+		ttl := time.Duration(cfg.AuthorityCacheTTLSeconds) * time.Second
+		registry = pec_storage.NewCachedAuthorityRegistry(registry, ttl)
+	}
+	authorityRegistry = registry
+	providerTrust.Authorities = registry
+}
+
+// LookupProviderReceiptAddress returns the notification address of the
+// provider the sender belongs to
+func LookupProviderReceiptAddress(from []*mail.Address) (string, error) {
+	if authorityRegistry == nil {
+		return "", errors.New("no authority registry configured")
+	}
+	if len(from) == 0 {
+		return "", errors.New("message has no sender")
+	}
+	at := strings.LastIndex(from[0].Address, "@")
+	if at < 0 || at == len(from[0].Address)-1 {
+		return "", fmt.Errorf("invalid sender address %q", from[0].Address)
+	}
+	domain := strings.ToLower(from[0].Address[at+1:])
+
+	authority, err := authorityRegistry.GetByDomain(domain)
+	if errors.Is(err, pec_storage.ErrAuthorityNotFound) {
+		return "", fmt.Errorf("unknown provider %s", domain)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to lookup provider %s: %v", domain, err)
+	}
+	if authority.NotificationAddress == "" {
+		return "", fmt.Errorf("provider %s has no notification address", domain)
+	}
+	return authority.NotificationAddress, nil
 }
 
 func IsValidReceiptOrAvviso(header *mail.Header, body []byte) bool {
@@ -306,7 +516,7 @@ func IsValidReceiptOrAvviso(header *mail.Header, body []byte) bool {
 		}
 		// Optionally check X-TipoRicevuta
 		tipo := header.Get("X-TipoRicevuta")
-		if tipo != "" && tipo != "breve" && tipo != "sintetica" {
+		if tipo != "" && tipo != "completa" && tipo != "breve" && tipo != "sintetica" {
 			return false
 		}
 		return true
@@ -342,24 +552,85 @@ func ForwardToDeliveryPoint(s *common.Session) error {
 	if data == nil {
 		return fmt.Errorf("no data to forward")
 	}
-	req, err := http.NewRequest("POST", "http://delivery-point/api/receive", bytes.NewReader(data))
+	if outboundQueue != nil {
+		return outboundQueue.Enqueue(common.OutboundItem{Kind: common.OutboundHTTP, Data: data})
+	}
+	return deliveryPoint.Forward(data)
+}
+
+// EmitNonDeliveryNotice creates and sends an "avviso di mancata consegna" when a
+// transport envelope could not be handed over to the delivery point.
+func EmitNonDeliveryNotice(s *common.Session, deliveryErr error) error {
+	data, err := s.GetData()
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to get session data: %v", err)
+	}
+	return emitNonDeliveryNotice(s.Domain, data, deliveryErr)
+}
+
+// emitNonDeliveryNotice builds and sends the notice for the raw transport envelope data
+func emitNonDeliveryNotice(domain string, data []byte, deliveryErr error) error {
+	// Parse the original message
+	mr, err := common.ParseEmailMessage(data)
+	if err != nil {
+		return fmt.Errorf("failed to parse original message: %w", err)
+	}
+	header := mr.Header
+
+	origSubject, _ := header.Subject()
+	origSubject = common.SubjectText(origSubject)
+	origMsgID := common.OriginalMessageID(&header)
+	// The transport envelope carries the original sender in Reply-To
+	sender, err := header.AddressList("Reply-To")
+	if err != nil || len(sender) == 0 {
+		sender, err = header.AddressList("From")
+		if err != nil || len(sender) == 0 {
+			return fmt.Errorf("no sender to notify")
+		}
 	}
-	req.Header.Set("Content-Type", "message/rfc822")
-	resp, err := http.DefaultClient.Do(req)
+
+	now := time.Now().In(timezone)
+	noticeHeader := mail.Header{}
+	noticeHeader.SetSubject("AVVISO DI MANCATA CONSEGNA: " + origSubject)
+	noticeHeader.SetAddressList("From", []*mail.Address{providerFrom.Address(domain)})
+	noticeHeader.SetAddressList("To", []*mail.Address{sender[0]})
+	noticeHeader.Set("X-Ricevuta", "errore-consegna")
+	noticeHeader.Set("Date", now.Format(time.RFC1123Z))
+	noticeHeader.Set("X-Riferimento-Message-ID", origMsgID)
+	noticeHeader.Set("Content-Type", "text/plain; charset=utf-8")
+
+	textBody, err := receiptTemplates.Text(pec.TipoErroreConsegna, common.ReceiptData{
+		Date:      now,
+		Subject:   origSubject,
+		MessageID: origMsgID,
+		Reason:    deliveryErr.Error(),
+	})
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("delivery point returned status %d", resp.StatusCode)
+
+	notice, err := message.New(noticeHeader.Header, strings.NewReader(textBody))
+	if err != nil {
+		return fmt.Errorf("failed to create notice: %v", err)
 	}
-	return nil
+
+	var body bytes.Buffer
+	if err := notice.WriteTo(&body); err != nil {
+		return fmt.Errorf("failed to write notice: %v", err)
+	}
+
+	return ForwardEnvelopeToDeliveryPoint(body.Bytes())
 }
 
-// CreateAnomalyEnvelope creates a "busta di anomalia" RFC 2822 message with the original message attached.
-func CreateAnomalyEnvelope(s *common.Session) ([]byte, error) {
+// CreateAnomalyEnvelope creates a "busta di anomalia" RFC 2822 message with a daticert.xml and the
+// original message attached, signed with the provider's certificate. The reason why the message was
+// not accepted as a PEC is reported in the body and in the errore-esteso of the daticert.xml.
+func CreateAnomalyEnvelope(s *common.Session, reason AnomalyReason) ([]byte, error) {
+	signer := s.GetSigner()
+	if signer == nil {
+		return nil, fmt.Errorf("no signer available")
+	}
+
 	// Parse the original message
 	header, _, err := common.ParseEmailFromSession(*s)
 	if err != nil {
@@ -367,36 +638,40 @@ func CreateAnomalyEnvelope(s *common.Session) ([]byte, error) {
 	}
 
 	// Extract required headers from the original message
-	receivedHeaders := header.FieldsByKey("Received")
+	receivedHeaders := header.Values("Received")
 	toHeader := header.Get("To")
 	ccHeader := header.Get("Cc")
 	returnPath := header.Get("Return-Path")
 	messageID := header.Get("Message-ID")
 	origSubject, _ := header.Subject()
-	origFrom, _ := header.AddressList("From")
+	origSubject = common.SubjectText(origSubject)
+	// A message without a valid From is still wrapped, on behalf of the
+	// sender of the SMTP envelope
+	origFrom, err := header.AddressList("From")
+	if err != nil || len(origFrom) == 0 {
+		origFrom = []*mail.Address{{Address: s.From}}
+	}
 	origTo, _ := header.AddressList("To")
 
 	// Compose anomaly envelope headers
-	now := time.Now()
+	now := time.Now().In(timezone)
 	anomalyHeader := mail.Header{}
 	anomalyHeader.Set("X-Trasporto", "errore")
 	anomalyHeader.Set("Date", now.Format(time.RFC1123Z))
 	anomalyHeader.SetSubject("ANOMALIA MESSAGGIO: " + origSubject)
 
 	// From: "Per conto di: [mittente originale]" <posta-certificata@[dominio_di_posta]>
-	fromDisplay := fmt.Sprintf("Per conto di: %s", origFrom[0].Address)
-	anomalyHeader.SetAddressList("From", []*mail.Address{
-		{Name: fromDisplay, Address: "posta-certificata@" + s.Domain},
-	})
+	anomalyHeader.SetAddressList("From", []*mail.Address{providerFrom.OnBehalfOf(s.Domain, origFrom[0].Address)})
 
 	// Reply-To: [mittente originale] (insert only if absent)
 	if header.Get("Reply-To") == "" {
 		anomalyHeader.SetAddressList("Reply-To", []*mail.Address{origFrom[0]})
 	}
 
-	// Copy original headers
-	for receivedHeaders.Next() != false {
-		anomalyHeader.Set("Received", receivedHeaders.Value())
+	// Copy original headers, keeping the whole Received trace in order.
+	// Add prepends fields, so the trace is added bottom-up.
+	for i := len(receivedHeaders) - 1; i >= 0; i-- {
+		anomalyHeader.Add("Received", receivedHeaders[i])
 	}
 	if toHeader != "" {
 		anomalyHeader.Set("To", toHeader)
@@ -410,23 +685,25 @@ func CreateAnomalyEnvelope(s *common.Session) ([]byte, error) {
 	if messageID != "" {
 		anomalyHeader.Set("Message-ID", messageID)
 	}
+	if originalID := common.OriginalMessageID(header); originalID != "" {
+		anomalyHeader.Set("X-Riferimento-Message-ID", originalID)
+	}
 
 	// Compose anomaly body text
-	var toList string
+	var toList []string
 	for _, addr := range origTo {
-		toList += addr.Address + "\n"
-	}
-	bodyText := fmt.Sprintf(
-		`Anomalia nel messaggio
-Il giorno %s alle ore %s (%s) è stato ricevuto
-il messaggio "%s" proveniente da "%s"
-ed indirizzato a:
-%s
-Tali dati non sono stati certificati per il seguente errore:
-%s
-Il messaggio originale è incluso in allegato.
-`, now.Format("02/01/2006"), now.Format("15:04:05"), now.Format("MST"),
-		origSubject, origFrom[0].Address, toList, "Errore di validazione PEC")
+		toList = append(toList, addr.Address)
+	}
+	bodyText, err := receiptTemplates.Text(common.ReceiptAnomalia, common.ReceiptData{
+		Date:    now,
+		Subject: origSubject,
+		From:    origFrom[0].Address,
+		To:      toList,
+		Reason:  string(reason),
+	})
+	if err != nil {
+		return nil, err
+	}
 
 	// Create the text part
 	textHeader := message.Header{}
@@ -436,6 +713,31 @@ Il messaggio originale è incluso in allegato.
 		return nil, fmt.Errorf("failed to create text part: %v", err)
 	}
 
+	// Compose the certification data describing the anomaly
+	certData := pec.NewDatiCert(pec.TipoAnomalia, pec.ErroreAltro, common.ProviderName(s.Domain), now)
+	certData.Intestazione.Mittente = origFrom[0].Address
+	to, cc := common.SplitRecipients(header)
+	certData.AddDestinatari("certificato", append(to, cc...)...)
+	certData.Intestazione.Risposte = origFrom[0].Address
+	certData.Intestazione.Oggetto = origSubject
+	certData.Dati.Identificativo = common.ReceiptIdentifier(pec.TipoAnomalia, messageID, s.Domain)
+	certData.Dati.MsgID = messageID
+	certData.Dati.ErroreEsteso = string(reason)
+	xmlBuf, err := certData.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	xmlB64 := common.FormatBase64(base64.StdEncoding.EncodeToString(xmlBuf), common.Base64LineLength)
+
+	xmlHeader := message.Header{}
+	xmlHeader.Set("Content-Type", "application/xml")
+	xmlHeader.Set("Content-Disposition", "attachment; filename=\"daticert.xml\"")
+	xmlHeader.Set("Content-Transfer-Encoding", "base64")
+	xmlPart, err := message.New(xmlHeader, strings.NewReader(xmlB64))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create xml part: %v", err)
+	}
+
 	// Attach the original message as RFC 822 attachment
 	data, err := s.GetData()
 	if err != nil {
@@ -449,11 +751,11 @@ Il messaggio originale è incluso in allegato.
 		return nil, fmt.Errorf("failed to create attachment part: %v", err)
 	}
 
-	// Create multipart/mixed entity
+	// Create multipart/mixed entity (text + xml + original message)
 	mixedHeader := message.Header{}
 	mixedHeader.Set("Content-Type", "multipart/mixed")
 	mixedHeader.Set("Content-Transfer-Encoding", "binary")
-	mixedEntity, err := message.NewMultipart(mixedHeader, []*message.Entity{textPart, attachmentPart})
+	mixedEntity, err := message.NewMultipart(mixedHeader, []*message.Entity{textPart, xmlPart, attachmentPart})
 	if err != nil {
 		return nil, fmt.Errorf("failed to create multipart/mixed entity: %v", err)
 	}
@@ -465,11 +767,65 @@ Il messaggio originale è incluso in allegato.
 		return nil, fmt.Errorf("failed to write multipart/mixed entity: %v", err)
 	}
 
-	return body.Bytes(), nil
+	// Sign it and carry the anomaly envelope headers on the signed message
+	signedEntity, err := signer.CreateSignedMimeMessageEntity(body.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign anomaly envelope: %v", err)
+	}
+	fields := signedEntity.Header.Fields()
+	for fields.Next() {
+		anomalyHeader.Set(fields.Key(), fields.Value())
+	}
+	signedEntity.Header = anomalyHeader.Header
+
+	var signed bytes.Buffer
+	if err := signedEntity.WriteTo(&signed); err != nil {
+		return nil, fmt.Errorf("failed to write anomaly envelope: %v", err)
+	}
+	return signed.Bytes(), nil
 }
 
-// ForwardEnvelopeToDeliveryPoint sends the envelope directly to the Punto di Ricezione of another authority via SMTP using emersion/go-smtp.
+// ForwardEnvelopeToDeliveryPoint sends the envelope to the Punto di Ricezione of another authority,
+// through the outbound queue when one is configured.
 func ForwardEnvelopeToDeliveryPoint(envelope []byte) error {
+	if outboundQueue != nil {
+		return outboundQueue.Enqueue(common.OutboundItem{Kind: common.OutboundSMTP, Data: envelope})
+	}
+	return sendEnvelope(envelope)
+}
+
+// sendEnvelope sends the envelopes directly, when there is no outbound queue
+var sendEnvelope = sendEnvelopeSMTP
+
+// outboundQueue, when set, decouples receipts and forwards from the SMTP session
+var outboundQueue *common.OutboundQueue
+
+// sendOutbound delivers an item taken from the outbound queue, which retries
+// it: the delivery point is posted to once
+func sendOutbound(item *common.OutboundItem) error {
+	switch item.Kind {
+	case common.OutboundHTTP:
+		return deliveryPoint.ForwardOnce(item.Data)
+	case common.OutboundSMTP:
+		return sendEnvelopeSMTP(item.Data)
+	default:
+		return fmt.Errorf("unknown outbound item kind: %s", item.Kind)
+	}
+}
+
+// dkimSigner, when set, signs envelopes before they are handed to SMTP
+var dkimSigner *common.DKIMSigner
+
+// sendEnvelopeSMTP sends the envelope directly via SMTP.
+func sendEnvelopeSMTP(envelope []byte) error {
+	if dkimSigner != nil {
+		signed, err := dkimSigner.Sign(envelope)
+		if err != nil {
+			return fmt.Errorf("failed to DKIM sign envelope: %v", err)
+		}
+		envelope = signed
+	}
+
 	// SMTP server details for the other authority
 	smtpAddr := "smtp.other-authority.it:25" // Change as needed
 	sender := "posta-certificata@yourdomain.it"
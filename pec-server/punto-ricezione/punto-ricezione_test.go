@@ -0,0 +1,675 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/danzipie/go-pec/pec"
+	"github.com/danzipie/go-pec/pec-server/internal/common"
+	pec_storage "github.com/danzipie/go-pec/pec-server/internal/storage"
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-sasl"
+)
+
+// originalMessageID is the Message-ID of the user message carried by testEnvelope
+const originalMessageID = "<original@sender.example.com>"
+
+// testEnvelope is a transport envelope whose own Message-ID differs from the
+// user message it carries
+const testEnvelope = "From: \"Per conto di: sender@sender.example.com\" <posta-certificata@sender.example.com>\r\n" +
+	"Reply-To: sender@sender.example.com\r\n" +
+	"To: recipient@example.com\r\n" +
+	"Subject: POSTA CERTIFICATA: test\r\n" +
+	"Date: Mon, 02 Jan 2006 15:04:05 +0000\r\n" +
+	"Message-ID: <envelope@sender.example.com>\r\n" +
+	"X-Riferimento-Message-ID: " + originalMessageID + "\r\n" +
+	"X-Trasporto: posta-certificata\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"Messaggio di posta certificata\r\n"
+
+// newEnvelopeSession returns an authenticated session holding data
+func newEnvelopeSession(t *testing.T, data string) *common.Session {
+	session := newAuthenticatedSession(t, func(*common.Session) error { return nil })
+	if err := session.Data(strings.NewReader(data)); err != nil {
+		t.Fatalf("DATA failed: %v", err)
+	}
+	return session
+}
+
+// newAuthenticatedSession returns an authenticated session passing the
+// messages to handler
+func newAuthenticatedSession(t *testing.T, handler func(*common.Session) error) *common.Session {
+	backend := common.NewBackend(newProviderSigner(t), nil, nil, handler, "example.com")
+	backend.AllowInsecureAuth = true // there is no connection to secure
+	smtpSession, err := backend.NewSession(nil)
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	session := smtpSession.(*common.Session)
+
+	auth, err := session.Auth(sasl.Plain)
+	if err != nil {
+		t.Fatalf("Failed to start authentication: %v", err)
+	}
+	if _, done, err := auth.Next([]byte("\x00username\x00password")); err != nil || !done {
+		t.Fatalf("Authentication failed: %v", err)
+	}
+	return session
+}
+
+// captureOutbound redirects outbound messages to a queue that never sends
+func captureOutbound(t *testing.T) *common.OutboundQueue {
+	queue, err := common.NewOutboundQueue(t.TempDir(), func(*common.OutboundItem) error {
+		return errors.New("not sent in tests")
+	})
+	if err != nil {
+		t.Fatalf("NewOutboundQueue failed: %v", err)
+	}
+	outboundQueue = queue
+	t.Cleanup(func() { outboundQueue = nil })
+	return queue
+}
+
+// useAuthorities installs an authority registry knowing the sender's provider
+func useAuthorities(t *testing.T) {
+	registry := pec_storage.NewInMemoryAuthorityRegistry()
+	registry.AddAuthority(&pec_storage.PECAuthority{Name: "sender.example.com", NotificationAddress: "ricevute@sender.example.com"})
+	authorityRegistry = registry
+	t.Cleanup(func() { authorityRegistry = nil })
+}
+
+// newTestServer creates a reception point from a configuration file holding
+// settings, with S/MIME credentials of its own. The globals the constructor
+// sets are restored when the test ends.
+func newTestServer(t *testing.T, settings map[string]any) *PuntoRicezioneServer {
+	t.Helper()
+	previousTrust, previousRegistry, previousDeliveryPoint := providerTrust, authorityRegistry, deliveryPoint
+	t.Cleanup(func() {
+		providerTrust, authorityRegistry, deliveryPoint = previousTrust, previousRegistry, previousDeliveryPoint
+		receiptTemplates, providerFrom, timezone = common.DefaultReceiptTemplates(), common.ProviderFrom{}, common.DefaultLocation
+		outboundQueue, dkimSigner, senderAuth = nil, nil, nil
+	})
+
+	dir := t.TempDir()
+	signer := newProviderSigner(t)
+	certFile := writeTestFile(t, dir, "cert.pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: signer.Cert.Raw}))
+	keyFile := writeTestFile(t, dir, "key.pem", pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(signer.Key.(*rsa.PrivateKey)),
+	}))
+
+	cfg := map[string]any{"domain": "example.com", "cert_file": certFile, "key_file": keyFile}
+	for name, value := range settings {
+		cfg[name] = value
+	}
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatalf("Failed to encode config: %v", err)
+	}
+	server, err := NewPuntoRicezioneServer(writeTestFile(t, dir, "config.json", data))
+	if err != nil {
+		t.Fatalf("NewPuntoRicezioneServer failed: %v", err)
+	}
+	return server
+}
+
+// writeTestFile writes data to the file name of dir and returns its path
+func writeTestFile(t *testing.T, dir, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("Failed to write %s: %v", name, err)
+	}
+	return path
+}
+
+// TestNewPuntoRicezioneServer_RegistryTrust tests that the envelopes signed
+// with a certificate of the authority registry file are trusted, provided
+// the certificate chains to the configured roots
+func TestNewPuntoRicezioneServer_RegistryTrust(t *testing.T) {
+	provider := newProviderSigner(t)
+	unknown := newProviderSigner(t)
+	unrooted := newProviderSigner(t)
+
+	dir := t.TempDir()
+	registry := fmt.Sprintf(`[{"name": "sender.example.com", "notification_address": "ricevute@sender.example.com", "cert_hashes": [%q, %q]}]`,
+		common.CertificateHash(provider.Cert), common.CertificateHash(unrooted.Cert))
+	var roots []byte
+	for _, signer := range []*common.Signer{provider, unknown} {
+		roots = append(roots, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: signer.Cert.Raw})...)
+	}
+	newTestServer(t, map[string]any{
+		"authority_registry_file": writeTestFile(t, dir, "authorities.json", []byte(registry)),
+		"provider_roots_file":     writeTestFile(t, dir, "roots.pem", roots),
+	})
+
+	original := []byte("From: sender@sender.example.com\r\n" +
+		"To: recipient@example.com\r\n" +
+		"Subject: Registry\r\n" +
+		"Message-ID: <registry@sender.example.com>\r\n" +
+		"\r\n" +
+		"Hello\r\n")
+	tests := []struct {
+		name   string
+		signer *common.Signer
+		want   bool
+	}{
+		{"registered provider", provider, true},
+		{"unregistered provider", unknown, false},
+		{"registered provider outside the roots", unrooted, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			envelope, err := common.BuildTransportEnvelope(original, common.PECCertificationData{}, tt.signer)
+			if err != nil {
+				t.Fatalf("BuildTransportEnvelope failed: %v", err)
+			}
+			if got := IsValidTransportEnvelope(envelope); got != tt.want {
+				t.Errorf("Expected IsValidTransportEnvelope to be %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+// TestLookupProviderReceiptAddress tests that receipts are addressed to the
+// notification address of the sender's provider
+func TestLookupProviderReceiptAddress(t *testing.T) {
+	useAuthorities(t)
+
+	got, err := LookupProviderReceiptAddress([]*mail.Address{{Address: "posta-certificata@Sender.Example.com"}})
+	if err != nil {
+		t.Fatalf("LookupProviderReceiptAddress failed: %v", err)
+	}
+	if got != "ricevute@sender.example.com" {
+		t.Errorf("Expected ricevute@sender.example.com, got %q", got)
+	}
+
+	if _, err := LookupProviderReceiptAddress([]*mail.Address{{Address: "someone@unknown.example.com"}}); err == nil {
+		t.Error("Expected an error for an unknown provider")
+	}
+	if _, err := LookupProviderReceiptAddress(nil); err == nil {
+		t.Error("Expected an error without a sender")
+	}
+
+	authorityRegistry = nil
+	if _, err := LookupProviderReceiptAddress([]*mail.Address{{Address: "posta-certificata@sender.example.com"}}); err == nil {
+		t.Error("Expected an error without a registry")
+	}
+}
+
+// TestReceptionPoint_ReferencesOriginalMessageID tests that every artifact
+// emitted for an envelope references the user's Message-ID
+func TestReceptionPoint_ReferencesOriginalMessageID(t *testing.T) {
+	queue := captureOutbound(t)
+	useAuthorities(t)
+	session := newEnvelopeSession(t, testEnvelope)
+
+	if err := EmitPresaInCaricoReceipt(session); err != nil {
+		t.Fatalf("EmitPresaInCaricoReceipt failed: %v", err)
+	}
+	if err := EmitNonDeliveryNotice(session, ErrDeliveryFailed); err != nil {
+		t.Fatalf("EmitNonDeliveryNotice failed: %v", err)
+	}
+	anomaly, err := CreateAnomalyEnvelope(session, ReasonNotPEC)
+	if err != nil {
+		t.Fatalf("CreateAnomalyEnvelope failed: %v", err)
+	}
+
+	items, err := queue.Pending()
+	if err != nil {
+		t.Fatalf("Pending failed: %v", err)
+	}
+	if len(items) != 2 {
+		t.Fatalf("Expected 2 queued artifacts, got %d", len(items))
+	}
+
+	artifacts := map[string][]byte{
+		"presa in carico":  items[0].Data,
+		"mancata consegna": items[1].Data,
+		"anomalia":         anomaly,
+	}
+	for name, data := range artifacts {
+		msg, err := common.ParseEmailMessage(data)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %v", name, err)
+		}
+		if got := msg.Header.Get("X-Riferimento-Message-ID"); got != originalMessageID {
+			t.Errorf("Expected %s to reference %s, got %q", name, originalMessageID, got)
+		}
+	}
+}
+
+// TestCreateAnomalyEnvelope_KeepsReceivedTrace tests that every Received header is copied in order
+func TestCreateAnomalyEnvelope_KeepsReceivedTrace(t *testing.T) {
+	received := []string{
+		"from mx3.example.org by mx.example.com; Mon, 02 Jan 2006 15:04:07 +0000",
+		"from mx2.example.org by mx3.example.org; Mon, 02 Jan 2006 15:04:06 +0000",
+		"from mx1.example.org by mx2.example.org; Mon, 02 Jan 2006 15:04:05 +0000",
+	}
+	var raw strings.Builder
+	for _, value := range received {
+		raw.WriteString("Received: " + value + "\r\n")
+	}
+	raw.WriteString("From: sender@example.org\r\n" +
+		"To: recipient@example.com\r\n" +
+		"Subject: not certified\r\n" +
+		"Message-ID: <plain@example.org>\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Hello\r\n")
+
+	session := newEnvelopeSession(t, raw.String())
+	anomaly, err := CreateAnomalyEnvelope(session, ReasonNotPEC)
+	if err != nil {
+		t.Fatalf("CreateAnomalyEnvelope failed: %v", err)
+	}
+
+	msg, err := common.ParseEmailMessage(anomaly)
+	if err != nil {
+		t.Fatalf("Failed to parse anomaly envelope: %v", err)
+	}
+	got := msg.Header.Values("Received")
+	if len(got) != len(received) {
+		t.Fatalf("Expected %d Received headers, got %d: %v", len(received), len(got), got)
+	}
+	for i := range received {
+		if got[i] != received[i] {
+			t.Errorf("Expected Received header %d to be %q, got %q", i, received[i], got[i])
+		}
+	}
+}
+
+// TestCreateAnomalyEnvelope_EncodesSubject tests that a non-ASCII subject is
+// carried encoded in the anomaly envelope and decodes back to the original
+func TestCreateAnomalyEnvelope_ProviderFrom(t *testing.T) {
+	providerFrom = common.ProviderFrom{OnBehalfName: "Anomalia per conto di {sender}"}
+	t.Cleanup(func() { providerFrom = common.ProviderFrom{} })
+
+	session := newEnvelopeSession(t, "From: sender@example.org\r\n"+
+		"To: recipient@example.com\r\n"+
+		"Subject: not certified\r\n"+
+		"Message-ID: <plain@example.org>\r\n"+
+		"Content-Type: text/plain\r\n"+
+		"\r\n"+
+		"Hello\r\n")
+	anomaly, err := CreateAnomalyEnvelope(session, ReasonNotPEC)
+	if err != nil {
+		t.Fatalf("CreateAnomalyEnvelope failed: %v", err)
+	}
+	msg, err := common.ParseEmailMessage(anomaly)
+	if err != nil {
+		t.Fatalf("Failed to parse anomaly envelope: %v", err)
+	}
+	from, err := msg.Header.AddressList("From")
+	if err != nil || len(from) != 1 {
+		t.Fatalf("Expected a From address, got %v (%v)", from, err)
+	}
+	if from[0].Name != "Anomalia per conto di sender@example.org" || from[0].Address != "posta-certificata@example.com" {
+		t.Errorf("Expected the configured display name, got %q", msg.Header.Get("From"))
+	}
+}
+
+func TestCreateAnomalyEnvelope_EncodesSubject(t *testing.T) {
+	session := newEnvelopeSession(t, "From: sender@example.org\r\n"+
+		"To: recipient@example.com\r\n"+
+		"Subject: =?UTF-8?Q?Perch=C3=A8_la_citt=C3=A0_=C3=A8_chiusa=3F?=\r\n"+
+		"Message-ID: <plain@example.org>\r\n"+
+		"Content-Type: text/plain\r\n"+
+		"\r\n"+
+		"Hello\r\n")
+	anomaly, err := CreateAnomalyEnvelope(session, ReasonNotPEC)
+	if err != nil {
+		t.Fatalf("CreateAnomalyEnvelope failed: %v", err)
+	}
+
+	headerBlock := anomaly[:strings.Index(string(anomaly), "\r\n\r\n")]
+	for _, b := range headerBlock {
+		if b > 127 {
+			t.Fatalf("Expected a 7-bit header, got:\n%s", headerBlock)
+		}
+	}
+	msg, err := common.ParseEmailMessage(anomaly)
+	if err != nil {
+		t.Fatalf("Failed to parse anomaly envelope: %v", err)
+	}
+	if got, err := msg.Header.Subject(); err != nil || got != "ANOMALIA MESSAGGIO: Perchè la città è chiusa?" {
+		t.Errorf("Unexpected Subject %q (%v)", got, err)
+	}
+}
+
+// TestReceptionPoint_NoSubject tests that the artifacts emitted for a
+// message without subject show the placeholder
+func TestReceptionPoint_NoSubject(t *testing.T) {
+	queue := captureOutbound(t)
+	useAuthorities(t)
+	session := newEnvelopeSession(t, strings.Replace(testEnvelope, "Subject: POSTA CERTIFICATA: test\r\n", "", 1))
+
+	if err := EmitPresaInCaricoReceipt(session); err != nil {
+		t.Fatalf("EmitPresaInCaricoReceipt failed: %v", err)
+	}
+	if err := EmitNonDeliveryNotice(session, ErrDeliveryFailed); err != nil {
+		t.Fatalf("EmitNonDeliveryNotice failed: %v", err)
+	}
+	anomaly, err := CreateAnomalyEnvelope(session, ReasonNotPEC)
+	if err != nil {
+		t.Fatalf("CreateAnomalyEnvelope failed: %v", err)
+	}
+	items, err := queue.Pending()
+	if err != nil {
+		t.Fatalf("Pending failed: %v", err)
+	}
+	if len(items) != 2 {
+		t.Fatalf("Expected 2 queued artifacts, got %d", len(items))
+	}
+
+	subjects := map[string]struct {
+		data    []byte
+		subject string
+	}{
+		"presa in carico":  {items[0].Data, "PRESA IN CARICO: " + common.NoSubject},
+		"mancata consegna": {items[1].Data, "AVVISO DI MANCATA CONSEGNA: " + common.NoSubject},
+		"anomalia":         {anomaly, "ANOMALIA MESSAGGIO: " + common.NoSubject},
+	}
+	for name, artifact := range subjects {
+		msg, err := common.ParseEmailMessage(artifact.data)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %v", name, err)
+		}
+		if got, _ := msg.Header.Subject(); got != artifact.subject {
+			t.Errorf("Expected %s Subject %q, got %q", name, artifact.subject, got)
+		}
+		if name != "anomalia" && !strings.Contains(string(artifact.data), `"`+common.NoSubject+`"`) {
+			t.Errorf("Expected the placeholder subject in the %s text", name)
+		}
+	}
+}
+
+// TestEmitPresaInCaricoReceipt_Base64LineLength tests that the daticert.xml
+// of the presa in carico receipt is wrapped at 76 characters
+func TestEmitPresaInCaricoReceipt_Base64LineLength(t *testing.T) {
+	queue := captureOutbound(t)
+	useAuthorities(t)
+	session := newEnvelopeSession(t, testEnvelope)
+	if err := EmitPresaInCaricoReceipt(session); err != nil {
+		t.Fatalf("EmitPresaInCaricoReceipt failed: %v", err)
+	}
+	items, err := queue.Pending()
+	if err != nil || len(items) != 1 {
+		t.Fatalf("Expected the queued receipt, got %d (%v)", len(items), err)
+	}
+
+	lines := strings.Split(string(items[0].Data), "\r\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, "Content-Disposition: attachment; filename=\"daticert.xml\"") {
+			for _, encoded := range lines[i+1:] {
+				if strings.HasPrefix(encoded, "--") {
+					break
+				}
+				if len(encoded) > common.Base64LineLength {
+					t.Errorf("Expected base64 lines of at most %d characters, got %d", common.Base64LineLength, len(encoded))
+				}
+			}
+			return
+		}
+	}
+	t.Errorf("Expected a daticert.xml part in\n%s", items[0].Data)
+}
+
+// TestReceptionPointHandler_ForwardTimeout tests that an envelope whose
+// forward to the delivery point times out is accepted once the sender is
+// notified, rather than deferred with a temporary failure
+func TestReceptionPointHandler_ForwardTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+	previous := deliveryPoint
+	deliveryPoint = newTestDeliveryPointClient(server.URL)
+	deliveryPoint.MaxAttempts = 1
+	deliveryPoint.Timeout = 20 * time.Millisecond
+	t.Cleanup(func() { deliveryPoint = previous })
+
+	var sent [][]byte
+	previousSend := sendEnvelope
+	sendEnvelope = func(envelope []byte) error {
+		sent = append(sent, envelope)
+		return nil
+	}
+	t.Cleanup(func() { sendEnvelope = previousSend })
+
+	provider := newProviderSigner(t)
+	trustProvider(t, provider)
+	useAuthorities(t)
+	envelope := signedTestEnvelope(t, provider, "From: posta-certificata@sender.example.com\r\n"+
+		"Reply-To: sender@sender.example.com\r\n"+
+		"To: recipient@example.com\r\n"+
+		"Subject: POSTA CERTIFICATA: test\r\n"+
+		"Date: Mon, 02 Jan 2006 15:04:05 +0000\r\n"+
+		"Message-ID: <envelope@sender.example.com>\r\n"+
+		"X-Trasporto: posta-certificata\r\n")
+
+	session := newAuthenticatedSession(t, ReceptionPointHandler)
+	if err := session.Data(bytes.NewReader(envelope)); err != nil {
+		t.Fatalf("Expected the envelope to be accepted, got %v", err)
+	}
+	if len(sent) != 2 {
+		t.Fatalf("Expected the presa in carico and the non-delivery notice, got %d messages", len(sent))
+	}
+	if !bytes.Contains(sent[1], []byte("X-Ricevuta: errore-consegna")) {
+		t.Errorf("Expected a non-delivery notice, got\n%s", sent[1])
+	}
+
+	// A sender that cannot be notified gets a permanent failure
+	sendEnvelope = func(envelope []byte) error {
+		if bytes.Contains(envelope, []byte("X-Ricevuta: errore-consegna")) {
+			return errors.New("connection refused")
+		}
+		return nil
+	}
+	session = newAuthenticatedSession(t, ReceptionPointHandler)
+	err := session.Data(bytes.NewReader(envelope))
+	if err != common.ErrNotDelivered {
+		t.Errorf("Expected %v, got %v", common.ErrNotDelivered, err)
+	}
+}
+
+// TestReceptionPointHandler_AnomalyReason tests that the anomaly envelope
+// reports why each message was not accepted
+func TestReceptionPointHandler_AnomalyReason(t *testing.T) {
+	provider := newProviderSigner(t)
+	trustProvider(t, provider)
+	untrusted := newProviderSigner(t)
+
+	envelopeHeaders := "From: posta-certificata@sender.example.com\r\n" +
+		"To: recipient@example.com\r\n" +
+		"Subject: POSTA CERTIFICATA: test\r\n" +
+		"Date: Mon, 02 Jan 2006 15:04:05 +0000\r\n" +
+		"Message-ID: <envelope@sender.example.com>\r\n"
+	plainHeaders := "From: sender@example.org\r\n" +
+		"To: recipient@example.com\r\n" +
+		"Subject: test\r\n" +
+		"Message-ID: <plain@example.org>\r\n"
+
+	tests := []struct {
+		name string
+		data []byte
+		want AnomalyReason
+	}{
+		{"unsigned message", []byte(plainHeaders + "Content-Type: text/plain\r\n\r\nHello\r\n"), ReasonInvalidSignature},
+		{"message without From", []byte(strings.Replace(plainHeaders, "From: sender@example.org\r\n", "", 1) + "Content-Type: text/plain\r\n\r\nHello\r\n"), ReasonInvalidSignature},
+		{"message with an invalid From", []byte(strings.Replace(plainHeaders, "From: sender@example.org", "From: not an address", 1) + "Content-Type: text/plain\r\n\r\nHello\r\n"), ReasonInvalidSignature},
+		{"untrusted provider", signedTestMessage(t, untrusted, envelopeHeaders+"X-Trasporto: posta-certificata\r\n"), ReasonUnknownProvider},
+		{"malformed envelope", signedTestMessage(t, provider, strings.Replace(envelopeHeaders, "To: recipient@example.com\r\n", "To: not an address\r\n", 1)+"X-Trasporto: posta-certificata\r\n"), ReasonMalformedEnvelope},
+		{"not a PEC", signedTestMessage(t, provider, plainHeaders), ReasonNotPEC},
+		{"malformed receipt", []byte(plainHeaders + "X-Ricevuta: avvenuta-consegna\r\nContent-Type: text/plain\r\n\r\nRicevuta\r\n"), ReasonMalformedReceipt},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queue := captureOutbound(t)
+			session := newEnvelopeSession(t, string(tt.data))
+			if err := ReceptionPointHandler(session); err != nil {
+				t.Fatalf("ReceptionPointHandler failed: %v", err)
+			}
+			items, err := queue.Pending()
+			if err != nil {
+				t.Fatalf("Pending failed: %v", err)
+			}
+			if len(items) != 1 {
+				t.Fatalf("Expected the anomaly envelope to be queued, got %d items", len(items))
+			}
+			anomaly := string(items[0].Data)
+			if !strings.Contains(anomaly, "X-Trasporto: errore") {
+				t.Fatalf("Expected an anomaly envelope, got:\n%s", anomaly)
+			}
+			if !strings.Contains(anomaly, string(tt.want)) {
+				t.Errorf("Expected the reason %q in the anomaly envelope, got:\n%s", tt.want, anomaly)
+			}
+		})
+	}
+}
+
+// TestCreateAnomalyEnvelope_DatiCert tests that the anomaly envelope carries
+// a daticert.xml describing the original message and the anomaly
+func TestCreateAnomalyEnvelope_DatiCert(t *testing.T) {
+	session := newEnvelopeSession(t, "From: sender@example.org\r\n"+
+		"To: recipient@example.com\r\n"+
+		"Cc: copia@example.com\r\n"+
+		"Subject: test\r\n"+
+		"Message-ID: <plain@example.org>\r\n"+
+		"Content-Type: text/plain\r\n"+
+		"\r\n"+
+		"Hello\r\n")
+	anomaly, err := CreateAnomalyEnvelope(session, ReasonInvalidSignature)
+	if err != nil {
+		t.Fatalf("CreateAnomalyEnvelope failed: %v", err)
+	}
+
+	mr, err := mail.CreateReader(bytes.NewReader(anomaly))
+	if err != nil {
+		t.Fatalf("Failed to parse anomaly envelope: %v", err)
+	}
+	var mediaTypes []string
+	var xmlData []byte
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Failed to read part: %v", err)
+		}
+		switch h := part.Header.(type) {
+		case *mail.InlineHeader:
+			mediaType, _, _ := h.ContentType()
+			mediaTypes = append(mediaTypes, mediaType)
+		case *mail.AttachmentHeader:
+			mediaType, _, _ := h.ContentType()
+			mediaTypes = append(mediaTypes, mediaType)
+			if filename, _ := h.Filename(); filename == "daticert.xml" {
+				if xmlData, err = io.ReadAll(part.Body); err != nil {
+					t.Fatalf("Failed to read daticert.xml: %v", err)
+				}
+			}
+		}
+	}
+	if strings.Join(mediaTypes, ",") != "text/plain,application/xml,message/rfc822,application/pkcs7-signature" {
+		t.Errorf("Unexpected parts %v", mediaTypes)
+	}
+	if xmlData == nil {
+		t.Fatal("Expected a daticert.xml attachment")
+	}
+
+	var datiCert pec.DatiCert
+	if err := xml.Unmarshal(xmlData, &datiCert); err != nil {
+		t.Fatalf("Failed to parse daticert.xml: %v", err)
+	}
+	if datiCert.Tipo != pec.TipoAnomalia || datiCert.Errore != pec.ErroreAltro {
+		t.Errorf("Unexpected daticert type %q, error %q", datiCert.Tipo, datiCert.Errore)
+	}
+	if datiCert.Intestazione.Mittente != "sender@example.org" || datiCert.Intestazione.Risposte != "sender@example.org" {
+		t.Errorf("Unexpected sender %q, risposte %q", datiCert.Intestazione.Mittente, datiCert.Intestazione.Risposte)
+	}
+	var destinatari []string
+	for _, d := range datiCert.Intestazione.Destinatari {
+		destinatari = append(destinatari, d.Val)
+	}
+	if strings.Join(destinatari, ",") != "recipient@example.com,copia@example.com" {
+		t.Errorf("Unexpected destinatari %v", destinatari)
+	}
+	if datiCert.Intestazione.Oggetto != "test" {
+		t.Errorf("Expected Oggetto 'test', got %q", datiCert.Intestazione.Oggetto)
+	}
+	if datiCert.Dati.MsgID != "<plain@example.org>" {
+		t.Errorf("Expected MsgID '<plain@example.org>', got %q", datiCert.Dati.MsgID)
+	}
+	if datiCert.Dati.ErroreEsteso != string(ReasonInvalidSignature) {
+		t.Errorf("Expected ErroreEsteso %q, got %q", ReasonInvalidSignature, datiCert.Dati.ErroreEsteso)
+	}
+	if datiCert.Dati.Identificativo == "" || datiCert.Dati.GestoreEmittente == "" {
+		t.Errorf("Expected the identificativo and the gestore emittente to be set")
+	}
+}
+
+// TestReceptionPointHandler_SignsAnomalyEnvelope tests that the forwarded
+// anomaly envelope is signed by the reception point and keeps its headers
+func TestReceptionPointHandler_SignsAnomalyEnvelope(t *testing.T) {
+	queue := captureOutbound(t)
+	session := newEnvelopeSession(t, "From: sender@example.org\r\n"+
+		"To: recipient@example.com\r\n"+
+		"Subject: test\r\n"+
+		"Message-ID: <plain@example.org>\r\n"+
+		"Content-Type: text/plain\r\n"+
+		"\r\n"+
+		"Hello\r\n")
+	if err := ReceptionPointHandler(session); err != nil {
+		t.Fatalf("ReceptionPointHandler failed: %v", err)
+	}
+	items, err := queue.Pending()
+	if err != nil {
+		t.Fatalf("Pending failed: %v", err)
+	}
+	if len(items) != 1 {
+		t.Fatalf("Expected the anomaly envelope to be queued, got %d items", len(items))
+	}
+	anomaly := items[0].Data
+
+	msg, err := common.ParseEmailMessage(anomaly)
+	if err != nil {
+		t.Fatalf("Failed to parse anomaly envelope: %v", err)
+	}
+	if mediaType, _, _ := msg.Header.ContentType(); mediaType != "multipart/signed" {
+		t.Errorf("Expected multipart/signed, got %s", mediaType)
+	}
+	if got := msg.Header.Get("X-Trasporto"); got != "errore" {
+		t.Errorf("Expected X-Trasporto errore, got %q", got)
+	}
+	if got, _ := msg.Header.Subject(); got != "ANOMALIA MESSAGGIO: test" {
+		t.Errorf("Unexpected Subject %q", got)
+	}
+
+	signerCert, err := common.VerifySignedMessage(anomaly)
+	if err != nil {
+		t.Fatalf("Expected the anomaly envelope to verify: %v", err)
+	}
+	if !signerCert.Equal(session.GetSigner().Cert) {
+		t.Errorf("Expected the anomaly envelope to be signed by the reception point")
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/danzipie/go-pec/pec-server/internal/common"
+	"github.com/danzipie/go-pec/pec-server/logger"
+)
+
+const defaultSenderAuthTimeout = 5 * time.Second
+
+// SenderAuthResults holds the outcome of the DKIM and SPF checks on an incoming message
+type SenderAuthResults struct {
+	DKIM common.AuthResult
+	SPF  common.AuthResult
+}
+
+// Failed reports whether a check explicitly failed. Missing records and DNS
+// errors do not count against the sender.
+func (r SenderAuthResults) Failed() bool {
+	return r.DKIM == common.AuthFail || r.SPF == common.AuthFail
+}
+
+func (r SenderAuthResults) String() string {
+	return fmt.Sprintf("dkim=%s spf=%s", r.DKIM, r.SPF)
+}
+
+// SenderAuthVerifier checks the DKIM signature and the SPF policy of incoming messages
+type SenderAuthVerifier struct {
+	CheckDKIM bool
+	CheckSPF  bool
+	Resolver  common.DNSResolver
+	Timeout   time.Duration
+}
+
+// NewSenderAuthVerifier creates a verifier using the system resolver
+func NewSenderAuthVerifier(checkDKIM, checkSPF bool) *SenderAuthVerifier {
+	return &SenderAuthVerifier{
+		CheckDKIM: checkDKIM,
+		CheckSPF:  checkSPF,
+		Resolver:  net.DefaultResolver,
+		Timeout:   defaultSenderAuthTimeout,
+	}
+}
+
+// senderAuth is the verifier used by ReceptionPointHandler; nil disables the checks
+var senderAuth *SenderAuthVerifier
+
+// Verify runs the enabled checks on the message received in the session.
+// Checks that are disabled report AuthNone.
+func (v *SenderAuthVerifier) Verify(s *common.Session, data []byte) SenderAuthResults {
+	results := SenderAuthResults{DKIM: common.AuthNone, SPF: common.AuthNone}
+
+	ctx := context.Background()
+	if v.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, v.Timeout)
+		defer cancel()
+	}
+
+	if v.CheckDKIM {
+		result, err := common.VerifyDKIM(ctx, v.Resolver, data)
+		if err != nil {
+			ctx := s.LogContext()
+			ctx["dkim"] = string(result)
+			ctx["reason"] = err.Error()
+			logger.LogDebug("DKIM check did not pass", ctx)
+		}
+		results.DKIM = result
+	}
+
+	if v.CheckSPF {
+		result, err := common.CheckSPF(ctx, v.Resolver, s.RemoteIP, senderDomain(s.From))
+		if err != nil {
+			ctx := s.LogContext()
+			ctx["spf"] = string(result)
+			ctx["reason"] = err.Error()
+			logger.LogDebug("SPF check did not pass", ctx)
+		}
+		results.SPF = result
+	}
+
+	return results
+}
+
+// senderDomain returns the domain part of the MAIL FROM address
+func senderDomain(from string) string {
+	from = strings.Trim(from, "<>")
+	if i := strings.LastIndex(from, "@"); i >= 0 {
+		return from[i+1:]
+	}
+	return ""
+}
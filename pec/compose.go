@@ -0,0 +1,221 @@
+package pec
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+)
+
+// Attachment is a file attached to an outgoing message
+type Attachment struct {
+	Filename    string
+	ContentType string // application/octet-stream when empty
+	Data        []byte
+}
+
+// OutgoingMessage describes a message a sender submits to its access point
+type OutgoingMessage struct {
+	From        string   // the sender's PEC address, optionally with a display name
+	To          []string // primary recipients
+	Cc          []string // recipients in copy
+	Subject     string
+	Text        string // text/plain body
+	HTML        string // text/html body, sent as an alternative to Text
+	Attachments []Attachment
+
+	// ReceiptType is the requested delivery receipt type (completa, breve or
+	// sintetica); the access point defaults to completa when empty
+	ReceiptType string
+	// Date defaults to the current time
+	Date time.Time
+	// MessageID is generated on the sender's domain when empty
+	MessageID string
+}
+
+// receiptTypes are the values of X-TipoRicevuta a sender may request
+var receiptTypes = map[string]bool{
+	"completa":  true,
+	"breve":     true,
+	"sintetica": true,
+}
+
+// Recipients returns the bare addresses of the To and Cc recipients, the
+// forward-paths of the SMTP envelope the message must be submitted with
+func (m *OutgoingMessage) Recipients() ([]string, error) {
+	to, err := parseAddresses("To", m.To)
+	if err != nil {
+		return nil, err
+	}
+	cc, err := parseAddresses("Cc", m.Cc)
+	if err != nil {
+		return nil, err
+	}
+	var recipients []string
+	for _, addr := range append(to, cc...) {
+		recipients = append(recipients, addr.Address)
+	}
+	return recipients, nil
+}
+
+// ComposeMessage builds the message m describes, ready to be submitted to an
+// access point: a single From, the To and Cc recipients and no Bcc, a Date
+// and a Message-ID, non-ASCII header text encoded and the bodies and
+// attachments in a MIME structure
+func ComposeMessage(m OutgoingMessage) (*message.Entity, error) {
+	from, err := mail.ParseAddress(m.From)
+	if err != nil {
+		return nil, fmt.Errorf("invalid 'From' address %q: %v", m.From, err)
+	}
+	to, err := parseAddresses("To", m.To)
+	if err != nil {
+		return nil, err
+	}
+	if len(to) == 0 {
+		return nil, fmt.Errorf("no 'To' recipient")
+	}
+	cc, err := parseAddresses("Cc", m.Cc)
+	if err != nil {
+		return nil, err
+	}
+	receiptType := strings.ToLower(strings.TrimSpace(m.ReceiptType))
+	if receiptType != "" && !receiptTypes[receiptType] {
+		return nil, fmt.Errorf("invalid receipt type %q", m.ReceiptType)
+	}
+
+	var header mail.Header
+	header.SetAddressList("From", []*mail.Address{from})
+	header.SetAddressList("To", to)
+	if len(cc) > 0 {
+		header.SetAddressList("Cc", cc)
+	}
+	header.SetSubject(m.Subject)
+	date := m.Date
+	if date.IsZero() {
+		date = time.Now()
+	}
+	header.SetDate(date)
+	if m.MessageID != "" {
+		header.SetMessageID(strings.Trim(m.MessageID, "<>"))
+	} else if err := header.GenerateMessageIDWithHostname(domainOf(from.Address)); err != nil {
+		return nil, fmt.Errorf("failed to generate Message-ID: %v", err)
+	}
+	if receiptType != "" {
+		header.Set("X-TipoRicevuta", receiptType)
+	}
+	header.Set("MIME-Version", "1.0")
+
+	body, err := composeBody(m)
+	if err != nil {
+		return nil, err
+	}
+	if len(m.Attachments) == 0 {
+		return withHeader(header.Header, body), nil
+	}
+
+	parts := []*message.Entity{body}
+	for _, attachment := range m.Attachments {
+		part, err := composeAttachment(attachment)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, part)
+	}
+	header.Set("Content-Type", "multipart/mixed")
+	msg, err := message.NewMultipart(header.Header, parts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create message: %v", err)
+	}
+	return msg, nil
+}
+
+// parseAddresses parses the addresses of a recipient field
+func parseAddresses(field string, values []string) ([]*mail.Address, error) {
+	addrs := make([]*mail.Address, 0, len(values))
+	for _, value := range values {
+		addr, err := mail.ParseAddress(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid '%s' address %q: %v", field, value, err)
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+// domainOf returns the domain of an address
+func domainOf(address string) string {
+	if at := strings.LastIndex(address, "@"); at >= 0 {
+		return address[at+1:]
+	}
+	return address
+}
+
+// composeBody returns the text part, the html part or both as alternatives
+func composeBody(m OutgoingMessage) (*message.Entity, error) {
+	if m.HTML == "" {
+		return newTextPart("text/plain", m.Text)
+	}
+	html, err := newTextPart("text/html", m.HTML)
+	if err != nil || m.Text == "" {
+		return html, err
+	}
+	text, err := newTextPart("text/plain", m.Text)
+	if err != nil {
+		return nil, err
+	}
+
+	var header message.Header
+	header.Set("Content-Type", "multipart/alternative")
+	alternative, err := message.NewMultipart(header, []*message.Entity{text, html})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create alternative part: %v", err)
+	}
+	return alternative, nil
+}
+
+// newTextPart returns a UTF-8 text part, quoted-printable encoded when written
+func newTextPart(mediaType, text string) (*message.Entity, error) {
+	var header mail.InlineHeader
+	header.SetContentType(mediaType, map[string]string{"charset": "utf-8"})
+	return newPart(header.Header, "quoted-printable", []byte(text))
+}
+
+// composeAttachment returns the base64 encoded part of an attachment
+func composeAttachment(attachment Attachment) (*message.Entity, error) {
+	if attachment.Filename == "" {
+		return nil, fmt.Errorf("attachment without a file name")
+	}
+	contentType := attachment.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	var header mail.AttachmentHeader
+	header.Set("Content-Type", contentType)
+	header.SetFilename(attachment.Filename)
+	return newPart(header.Header, "base64", attachment.Data)
+}
+
+// newPart returns a part holding data, written with the given transfer
+// encoding. message.New decodes the body it is given, so the encoding is
+// set once the part holds the plain data.
+func newPart(header message.Header, encoding string, data []byte) (*message.Entity, error) {
+	part, err := message.New(header, bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create part: %v", err)
+	}
+	part.Header.Set("Content-Transfer-Encoding", encoding)
+	return part, nil
+}
+
+// withHeader moves the message header onto its single part body
+func withHeader(header message.Header, body *message.Entity) *message.Entity {
+	fields := body.Header.Fields()
+	for fields.Next() {
+		header.Set(fields.Key(), fields.Value())
+	}
+	body.Header = header
+	return body
+}
@@ -0,0 +1,164 @@
+package pec
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+)
+
+// composeAndRead composes m, writes it and reads it back
+func composeAndRead(t *testing.T, m OutgoingMessage) (string, *mail.Reader) {
+	t.Helper()
+	msg, err := ComposeMessage(m)
+	if err != nil {
+		t.Fatalf("ComposeMessage failed: %v", err)
+	}
+	var raw bytes.Buffer
+	if err := msg.WriteTo(&raw); err != nil {
+		t.Fatalf("failed to write message: %v", err)
+	}
+	mr, err := mail.CreateReader(bytes.NewReader(raw.Bytes()))
+	if err != nil {
+		t.Fatalf("failed to read message: %v", err)
+	}
+	return raw.String(), mr
+}
+
+func TestComposeMessage(t *testing.T) {
+	date := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	raw, mr := composeAndRead(t, OutgoingMessage{
+		From:        "Niccolò Rossi <niccolo@pec.example.com>",
+		To:          []string{"primo@pec.example.org"},
+		Cc:          []string{"Copia <copia@pec.example.org>"},
+		Subject:     "Perchè la città è chiusa?",
+		Text:        "Buongiorno, è tutto chiuso.",
+		HTML:        "<p>Buongiorno, &egrave; tutto chiuso.</p>",
+		Attachments: []Attachment{{Filename: "fattura.pdf", ContentType: "application/pdf", Data: []byte("%PDF-1.4\x00\xff")}},
+		ReceiptType: "Breve",
+		Date:        date,
+	})
+
+	headerBlock := raw[:strings.Index(raw, "\r\n\r\n")]
+	for _, b := range []byte(headerBlock) {
+		if b > 127 {
+			t.Fatalf("expected a 7-bit header, got:\n%s", headerBlock)
+		}
+	}
+	if from, err := mr.Header.AddressList("From"); err != nil || len(from) != 1 || from[0].Name != "Niccolò Rossi" || from[0].Address != "niccolo@pec.example.com" {
+		t.Errorf("unexpected From %v (%v)", from, err)
+	}
+	if cc, err := mr.Header.AddressList("Cc"); err != nil || len(cc) != 1 || cc[0].Address != "copia@pec.example.org" {
+		t.Errorf("unexpected Cc %v (%v)", cc, err)
+	}
+	if subject, err := mr.Header.Subject(); err != nil || subject != "Perchè la città è chiusa?" {
+		t.Errorf("unexpected Subject %q (%v)", subject, err)
+	}
+	if got, err := mr.Header.Date(); err != nil || !got.Equal(date) {
+		t.Errorf("unexpected Date %v (%v)", got, err)
+	}
+	if id, err := mr.Header.MessageID(); err != nil || !strings.HasSuffix(id, "@pec.example.com") {
+		t.Errorf("expected a Message-ID on the sender's domain, got %q (%v)", id, err)
+	}
+	if got := mr.Header.Get("X-TipoRicevuta"); got != "breve" {
+		t.Errorf("expected X-TipoRicevuta breve, got %q", got)
+	}
+	if mediaType, _, _ := mr.Header.ContentType(); mediaType != "multipart/mixed" {
+		t.Errorf("expected multipart/mixed, got %s", mediaType)
+	}
+
+	entity, err := message.Read(strings.NewReader(raw))
+	if err != nil {
+		t.Fatalf("failed to read message: %v", err)
+	}
+	parts := map[string]string{}
+	err = entity.Walk(func(path []int, part *message.Entity, err error) error {
+		if err != nil {
+			return err
+		}
+		mediaType, _, _ := part.Header.ContentType()
+		if strings.HasPrefix(mediaType, "multipart/") {
+			return nil
+		}
+		body, err := io.ReadAll(part.Body)
+		parts[mediaType] = string(body)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("failed to walk message: %v", err)
+	}
+	want := map[string]string{
+		"text/plain":      "Buongiorno, è tutto chiuso.",
+		"text/html":       "<p>Buongiorno, &egrave; tutto chiuso.</p>",
+		"application/pdf": "%PDF-1.4\x00\xff",
+	}
+	for mediaType, body := range want {
+		if parts[mediaType] != body {
+			t.Errorf("expected %s part %q, got %q", mediaType, body, parts[mediaType])
+		}
+	}
+	if !strings.Contains(raw, "multipart/alternative") || !strings.Contains(raw, `filename=fattura.pdf`) {
+		t.Errorf("expected alternative bodies and a named attachment, got\n%s", raw)
+	}
+}
+
+func TestComposeMessage_TextOnly(t *testing.T) {
+	raw, mr := composeAndRead(t, OutgoingMessage{
+		From:      "sender@pec.example.com",
+		To:        []string{"recipient@pec.example.org"},
+		Subject:   "Testo",
+		Text:      "a=b",
+		MessageID: "<fixed@pec.example.com>",
+	})
+	if mediaType, params, _ := mr.Header.ContentType(); mediaType != "text/plain" || params["charset"] != "utf-8" {
+		t.Errorf("expected a single text/plain part, got %s %v", mediaType, params)
+	}
+	if got := mr.Header.Get("Message-ID"); got != "<fixed@pec.example.com>" {
+		t.Errorf("expected the given Message-ID, got %q", got)
+	}
+	if mr.Header.Has("X-TipoRicevuta") || mr.Header.Has("Cc") || mr.Header.Has("Bcc") {
+		t.Errorf("unexpected header fields in\n%s", raw)
+	}
+	if !strings.HasSuffix(raw, "\r\n\r\na=3Db") {
+		t.Errorf("expected a quoted-printable body, got\n%s", raw)
+	}
+}
+
+func TestComposeMessage_Errors(t *testing.T) {
+	valid := OutgoingMessage{From: "sender@pec.example.com", To: []string{"recipient@pec.example.org"}}
+	tests := []struct {
+		name   string
+		modify func(m *OutgoingMessage)
+	}{
+		{"no from", func(m *OutgoingMessage) { m.From = "" }},
+		{"invalid from", func(m *OutgoingMessage) { m.From = "not an address" }},
+		{"no to", func(m *OutgoingMessage) { m.To = nil }},
+		{"invalid cc", func(m *OutgoingMessage) { m.Cc = []string{"@"} }},
+		{"invalid receipt type", func(m *OutgoingMessage) { m.ReceiptType = "lunga" }},
+		{"unnamed attachment", func(m *OutgoingMessage) { m.Attachments = []Attachment{{Data: []byte("x")}} }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := valid
+			tt.modify(&m)
+			if _, err := ComposeMessage(m); err == nil {
+				t.Errorf("expected an error")
+			}
+		})
+	}
+}
+
+func TestOutgoingMessage_Recipients(t *testing.T) {
+	m := OutgoingMessage{To: []string{"Primo <primo@pec.example.org>"}, Cc: []string{"copia@pec.example.org"}}
+	recipients, err := m.Recipients()
+	if err != nil {
+		t.Fatalf("Recipients failed: %v", err)
+	}
+	if strings.Join(recipients, ",") != "primo@pec.example.org,copia@pec.example.org" {
+		t.Errorf("unexpected recipients %v", recipients)
+	}
+}
@@ -0,0 +1,210 @@
+package pec
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/mail"
+	"strings"
+
+	"github.com/emersion/go-message"
+)
+
+// Correlation holds the identifiers linking a transport envelope to a receipt
+type Correlation struct {
+	// MessageID is the Message-ID of the transport envelope
+	MessageID string `json:"message_id"`
+	// Riferimento is the X-Riferimento-Message-ID of the receipt
+	Riferimento string `json:"riferimento"`
+	// MsgID is the msgid of the receipt daticert.xml
+	MsgID string `json:"msgid"`
+	// Identificativo is the identificativo of the receipt daticert.xml
+	Identificativo string `json:"identificativo"`
+}
+
+// Matches reports whether both references of the receipt name the envelope
+func (c *Correlation) Matches() bool {
+	id := normalizeMessageID(c.MessageID)
+	return id != "" && normalizeMessageID(c.Riferimento) == id && normalizeMessageID(c.MsgID) == id
+}
+
+// CorrelateReceipt checks that receipt is the delivery receipt, or delivery
+// error receipt, of the transport envelope. Both signatures must be valid;
+// a receipt that does not reference the envelope is reported by Matches
+// on the returned identifiers.
+func CorrelateReceipt(envelope, receipt []byte) (*Correlation, error) {
+	envelopeResult, err := verifySigned("envelope", envelope)
+	if err != nil {
+		return nil, err
+	}
+	if envelopeResult.PecType != CertifiedEmail {
+		return nil, fmt.Errorf("envelope is not a transport envelope")
+	}
+	receiptResult, err := verifySigned("receipt", receipt)
+	if err != nil {
+		return nil, err
+	}
+	if receiptResult.PecType != DeliveryReceipt && receiptResult.PecType != DeliveryErrorReceipt {
+		return nil, fmt.Errorf("receipt is not a delivery receipt")
+	}
+
+	envelopeMsg, err := mail.ReadMessage(bytes.NewReader(envelope))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse envelope: %v", err)
+	}
+	receiptMsg, err := mail.ReadMessage(bytes.NewReader(receipt))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse receipt: %v", err)
+	}
+
+	return &Correlation{
+		MessageID:      envelopeMsg.Header.Get("Message-ID"),
+		Riferimento:    receiptMsg.Header.Get("X-Riferimento-Message-ID"),
+		MsgID:          receiptResult.DatiCert.Dati.MsgID,
+		Identificativo: receiptResult.DatiCert.Dati.Identificativo,
+	}, nil
+}
+
+// ReceiptMismatch is returned by MatchReceiptToSent when a receipt does not
+// refer to the sent message; Mismatches lists every difference found
+type ReceiptMismatch struct {
+	Mismatches []string
+}
+
+func (e *ReceiptMismatch) Error() string {
+	return "receipt does not match the sent message: " + strings.Join(e.Mismatches, "; ")
+}
+
+// MatchReceiptToSent checks that receipt, received by a sender, refers to
+// the message it sent, as submitted in sentRaw. The receipt signature must
+// be valid. Its X-Riferimento-Message-ID and the msgid of its daticert.xml
+// must name the Message-ID of the sent message and its mittente the sender;
+// when the receipt embeds the original message, the embedded body must be
+// the sent one. A receipt that does not match is reported with a
+// *ReceiptMismatch.
+func MatchReceiptToSent(sentRaw, receiptRaw []byte) (bool, error) {
+	sent, err := mail.ReadMessage(bytes.NewReader(sentRaw))
+	if err != nil {
+		return false, fmt.Errorf("failed to parse sent message: %v", err)
+	}
+	messageID := normalizeMessageID(sent.Header.Get("Message-ID"))
+	if messageID == "" {
+		return false, fmt.Errorf("sent message has no Message-ID")
+	}
+	sentBody, err := io.ReadAll(sent.Body)
+	if err != nil {
+		return false, fmt.Errorf("failed to read sent message: %v", err)
+	}
+
+	result, err := verifySigned("receipt", receiptRaw)
+	if err != nil {
+		return false, err
+	}
+	if result.PecType == CertifiedEmail {
+		return false, fmt.Errorf("receipt is a transport envelope")
+	}
+	receipt, err := mail.ReadMessage(bytes.NewReader(receiptRaw))
+	if err != nil {
+		return false, fmt.Errorf("failed to parse receipt: %v", err)
+	}
+
+	var mismatches []string
+	if riferimento := receipt.Header.Get("X-Riferimento-Message-ID"); normalizeMessageID(riferimento) != messageID {
+		mismatches = append(mismatches, fmt.Sprintf("X-Riferimento-Message-ID %q is not the sent Message-ID", riferimento))
+	}
+	if msgID := result.DatiCert.Dati.MsgID; normalizeMessageID(msgID) != messageID {
+		mismatches = append(mismatches, fmt.Sprintf("daticert.xml msgid %q is not the sent Message-ID", msgID))
+	}
+	if from, err := mail.ParseAddress(sent.Header.Get("From")); err == nil {
+		if mittente := result.DatiCert.Intestazione.Mittente; mittente != "" && !strings.EqualFold(mittente, from.Address) {
+			mismatches = append(mismatches, fmt.Sprintf("daticert.xml mittente %q is not the sender %q", mittente, from.Address))
+		}
+	}
+
+	embedded, err := embeddedMessages(receiptRaw)
+	if err != nil {
+		return false, fmt.Errorf("failed to read receipt attachments: %v", err)
+	}
+	if len(embedded) > 0 {
+		original, found := embedded[messageID]
+		switch {
+		case !found:
+			mismatches = append(mismatches, "the embedded original message is not the sent message")
+		case !bytes.Equal(normalizeBody(original), normalizeBody(sentBody)):
+			mismatches = append(mismatches, "the body of the embedded original message differs from the sent message")
+		}
+	}
+
+	if len(mismatches) > 0 {
+		return false, &ReceiptMismatch{Mismatches: mismatches}
+	}
+	return true, nil
+}
+
+// embeddedMessages returns the body of every message attached to data, at
+// any depth, by Message-ID. Attached messages without a Message-ID are
+// only searched for further messages.
+func embeddedMessages(data []byte) (map[string][]byte, error) {
+	entity, err := message.Read(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	messages := make(map[string][]byte)
+	err = entity.Walk(func(path []int, part *message.Entity, err error) error {
+		if err != nil {
+			return err
+		}
+		if mediaType, _, _ := part.Header.ContentType(); mediaType != "message/rfc822" {
+			return nil
+		}
+		raw, err := io.ReadAll(part.Body)
+		if err != nil {
+			return err
+		}
+		if attached, err := mail.ReadMessage(bytes.NewReader(raw)); err == nil {
+			if id := normalizeMessageID(attached.Header.Get("Message-ID")); id != "" {
+				body, err := io.ReadAll(attached.Body)
+				if err != nil {
+					return err
+				}
+				messages[id] = body
+			}
+		}
+		nested, err := embeddedMessages(raw)
+		if err != nil {
+			// An attached message that cannot be parsed holds no further messages
+			return nil
+		}
+		for id, body := range nested {
+			messages[id] = body
+		}
+		return nil
+	})
+	return messages, err
+}
+
+// normalizeBody makes bodies comparable across transports, which may change
+// line endings and trailing white space
+func normalizeBody(body []byte) []byte {
+	return bytes.TrimSpace(bytes.ReplaceAll(body, []byte("\r\n"), []byte("\n")))
+}
+
+// verifySigned verifies the PEC message data and requires a valid signature
+func verifySigned(name string, data []byte) (*VerificationResult, error) {
+	result, err := verifyDetailed(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify %s: %v", name, err)
+	}
+	if !result.SignatureValid {
+		return nil, fmt.Errorf("invalid %s signature: %s", name, result.SignatureError)
+	}
+	if result.DatiCert == nil {
+		return nil, fmt.Errorf("%s has no daticert.xml", name)
+	}
+	return result, nil
+}
+
+// normalizeMessageID strips the angle brackets and spaces around a Message-ID
+func normalizeMessageID(id string) string {
+	return strings.Trim(strings.TrimSpace(id), "<>")
+}
@@ -0,0 +1,253 @@
+package pec
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mozilla.org/pkcs7"
+)
+
+// signPEC builds a signed PEC message with headers and a daticert.xml of
+// type tipo referencing msgid
+func signPEC(t *testing.T, headers, tipo, msgid string) []byte {
+	t.Helper()
+	return signPECWithParts(t, headers, tipo, msgid, "")
+}
+
+// signPECWithParts builds a signed PEC message like signPEC, with the MIME
+// parts in extraParts appended after the daticert.xml
+func signPECWithParts(t *testing.T, headers, tipo, msgid, extraParts string) []byte {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "posta-certificata@example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse certificate: %v", err)
+	}
+
+	d := NewDatiCert(tipo, ErroreNessuno, "EXAMPLE PEC S.p.A.", time.Now())
+	d.Intestazione.Mittente = "sender@example.com"
+	d.AddDestinatari("certificato", "recipient@example.com")
+	d.Dati.Identificativo = "opec-receipt@example.com"
+	d.Dati.MsgID = msgid
+	xmlData, err := d.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+
+	content := "Content-Type: multipart/mixed; boundary=\"mixed\"\r\n" +
+		"\r\n" +
+		"--mixed\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Messaggio di servizio\r\n" +
+		"--mixed\r\n" +
+		"Content-Type: application/xml; name=\"daticert.xml\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		base64.StdEncoding.EncodeToString(xmlData) + "\r\n" +
+		extraParts +
+		"--mixed--\r\n"
+	signedData, err := pkcs7.NewSignedData([]byte(content))
+	if err != nil {
+		t.Fatalf("Failed to create signed data: %v", err)
+	}
+	if err := signedData.AddSigner(cert, key, pkcs7.SignerInfoConfig{}); err != nil {
+		t.Fatalf("Failed to add signer: %v", err)
+	}
+	signedData.Detach()
+	signature, err := signedData.Finish()
+	if err != nil {
+		t.Fatalf("Failed to sign: %v", err)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(headers)
+	buf.WriteString("Content-Type: multipart/signed; protocol=\"application/x-pkcs7-signature\"; micalg=\"sha-256\"; boundary=\"signed\"\r\n")
+	buf.WriteString("\r\n--signed\r\n")
+	buf.WriteString(content)
+	buf.WriteString("\r\n--signed\r\n")
+	buf.WriteString("Content-Type: application/x-pkcs7-signature; name=\"smime.p7s\"\r\n")
+	buf.WriteString("Content-Transfer-Encoding: base64\r\n\r\n")
+	buf.WriteString(base64.StdEncoding.EncodeToString(signature))
+	buf.WriteString("\r\n--signed--\r\n")
+	return buf.Bytes()
+}
+
+// testEnvelope returns a signed transport envelope for the user message messageID
+func testEnvelope(t *testing.T, messageID string) []byte {
+	return signPEC(t, "From: posta-certificata@example.com\r\n"+
+		"Message-ID: "+messageID+"\r\n"+
+		"X-Riferimento-Message-ID: "+messageID+"\r\n"+
+		"X-Trasporto: posta-certificata\r\n", TipoPostaCertificata, messageID)
+}
+
+// testReceipt returns a signed delivery receipt referencing riferimento and msgid
+func testReceipt(t *testing.T, riferimento, msgid string) []byte {
+	return signPEC(t, "From: posta-certificata@example.com\r\n"+
+		"Message-ID: <opec-receipt@example.com>\r\n"+
+		"X-Riferimento-Message-ID: "+riferimento+"\r\n"+
+		"X-Ricevuta: avvenuta-consegna\r\n", TipoAvvenutaConsegna, msgid)
+}
+
+func TestCorrelateReceipt(t *testing.T) {
+	const messageID = "<original@example.com>"
+	envelope := testEnvelope(t, messageID)
+
+	tests := []struct {
+		name        string
+		riferimento string
+		msgid       string
+		matches     bool
+	}{
+		{"matched", messageID, messageID, true},
+		{"matched without brackets in daticert", messageID, "original@example.com", true},
+		{"other riferimento", "<other@example.com>", messageID, false},
+		{"other msgid", messageID, "<other@example.com>", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := CorrelateReceipt(envelope, testReceipt(t, tt.riferimento, tt.msgid))
+			if err != nil {
+				t.Fatalf("CorrelateReceipt failed: %v", err)
+			}
+			if c.Matches() != tt.matches {
+				t.Errorf("expected Matches %v for %+v", tt.matches, c)
+			}
+			if c.MessageID != messageID || c.Riferimento != tt.riferimento || c.MsgID != tt.msgid {
+				t.Errorf("unexpected identifiers %+v", c)
+			}
+			if c.Identificativo != "opec-receipt@example.com" {
+				t.Errorf("unexpected identificativo %s", c.Identificativo)
+			}
+		})
+	}
+}
+
+func TestCorrelateReceiptRejects(t *testing.T) {
+	const messageID = "<original@example.com>"
+	envelope := testEnvelope(t, messageID)
+	receipt := testReceipt(t, messageID, messageID)
+
+	tests := []struct {
+		name     string
+		envelope []byte
+		receipt  []byte
+	}{
+		{"tampered envelope", bytes.Replace(envelope, []byte("Messaggio di servizio"), []byte("Messaggio alterato"), 1), receipt},
+		{"tampered receipt", envelope, bytes.Replace(receipt, []byte("Messaggio di servizio"), []byte("Messaggio alterato"), 1)},
+		{"swapped", receipt, envelope},
+		{"not a pec", []byte("Subject: hello\r\n\r\nHello\r\n"), receipt},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := CorrelateReceipt(tt.envelope, tt.receipt); err == nil {
+				t.Errorf("expected an error")
+			}
+		})
+	}
+}
+
+// sentMessage is a message as submitted by the sender
+const sentMessage = "From: Mario Rossi <sender@example.com>\r\n" +
+	"To: recipient@example.com\r\n" +
+	"Subject: Fattura\r\n" +
+	"Message-ID: <original@example.com>\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"In allegato la fattura.\r\n"
+
+// completeReceipt returns a signed delivery receipt for msgid embedding original
+func completeReceipt(t *testing.T, msgid, original string) []byte {
+	return signPECWithParts(t, "From: posta-certificata@example.com\r\n"+
+		"Message-ID: <opec-receipt@example.com>\r\n"+
+		"X-Riferimento-Message-ID: "+msgid+"\r\n"+
+		"X-Ricevuta: avvenuta-consegna\r\n", TipoAvvenutaConsegna, msgid,
+		"--mixed\r\n"+
+			"Content-Type: message/rfc822\r\n"+
+			"Content-Disposition: attachment; filename=\"postacert.eml\"\r\n"+
+			"\r\n"+
+			original)
+}
+
+func TestMatchReceiptToSent(t *testing.T) {
+	tests := []struct {
+		name    string
+		receipt []byte
+	}{
+		{"short receipt", testReceipt(t, "<original@example.com>", "original@example.com")},
+		{"complete receipt", completeReceipt(t, "<original@example.com>", sentMessage)},
+		{"complete receipt with LF line endings", completeReceipt(t, "<original@example.com>", strings.ReplaceAll(sentMessage, "\r\n", "\n")+"\r\n")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, err := MatchReceiptToSent([]byte(sentMessage), tt.receipt)
+			if err != nil || !ok {
+				t.Errorf("expected the receipt to match, got %v (%v)", ok, err)
+			}
+		})
+	}
+}
+
+func TestMatchReceiptToSent_Spoofed(t *testing.T) {
+	tests := []struct {
+		name    string
+		receipt []byte
+		detail  string
+	}{
+		{"other message", testReceipt(t, "<other@example.com>", "<other@example.com>"), "X-Riferimento-Message-ID"},
+		{"other msgid", testReceipt(t, "<original@example.com>", "<other@example.com>"), "msgid"},
+		{"altered original", completeReceipt(t, "<original@example.com>", strings.Replace(sentMessage, "la fattura", "il bonifico", 1)), "body"},
+		{"other original", completeReceipt(t, "<original@example.com>", strings.Replace(sentMessage, "<original@example.com>", "<other@example.com>", 1)), "embedded original"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, err := MatchReceiptToSent([]byte(sentMessage), tt.receipt)
+			if ok {
+				t.Fatalf("expected the receipt not to match")
+			}
+			var mismatch *ReceiptMismatch
+			if !errors.As(err, &mismatch) {
+				t.Fatalf("expected a ReceiptMismatch, got %v", err)
+			}
+			if !strings.Contains(mismatch.Error(), tt.detail) {
+				t.Errorf("expected the mismatch to mention %q, got %v", tt.detail, mismatch.Mismatches)
+			}
+		})
+	}
+
+	receipt := testReceipt(t, "<original@example.com>", "<original@example.com>")
+	forged := bytes.Replace(receipt, []byte("Messaggio di servizio"), []byte("Messaggio alterato"), 1)
+	if ok, err := MatchReceiptToSent([]byte(sentMessage), forged); ok || err == nil {
+		t.Errorf("expected a receipt with an invalid signature to be refused")
+	}
+	var mismatch *ReceiptMismatch
+	if _, err := MatchReceiptToSent([]byte(sentMessage), forged); errors.As(err, &mismatch) {
+		t.Errorf("expected a signature error, got %v", err)
+	}
+	if _, err := MatchReceiptToSent([]byte("Subject: no id\r\n\r\nHello\r\n"), receipt); err == nil {
+		t.Errorf("expected an error for a sent message without Message-ID")
+	}
+}
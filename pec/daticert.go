@@ -0,0 +1,53 @@
+package pec
+
+import (
+	"encoding/xml"
+	"fmt"
+	"time"
+)
+
+// values of the postacert tipo attribute
+const (
+	TipoAccettazione     = "accettazione"
+	TipoNonAccettazione  = "non-accettazione"
+	TipoPresaInCarico    = "presa-in-carico"
+	TipoAvvenutaConsegna = "avvenuta-consegna"
+	TipoPostaCertificata = "posta-certificata"
+	TipoErroreConsegna   = "errore-consegna"
+	TipoAnomalia         = "anomalia"
+)
+
+// values of the postacert errore attribute
+const (
+	ErroreNessuno   = "nessuno"
+	ErroreNoDest    = "no-dest"
+	ErroreNoDominio = "no-dominio"
+	ErroreVirus     = "virus"
+	ErroreAltro     = "altro"
+)
+
+// NewDatiCert returns a DatiCert of the given type issued by gestore at the given time
+func NewDatiCert(tipo, errore, gestore string, at time.Time) *DatiCert {
+	d := &DatiCert{Tipo: tipo, Errore: errore}
+	d.Dati.GestoreEmittente = gestore
+	d.Dati.Data.Zona = at.Format("-0700")
+	d.Dati.Data.Giorno = at.Format("02/01/2006")
+	d.Dati.Data.Ora = at.Format("15:04:05")
+	return d
+}
+
+// AddDestinatari lists the recipients of the given tipo (certificato or esterno)
+func (d *DatiCert) AddDestinatari(tipo string, recipients ...string) {
+	for _, rcpt := range recipients {
+		d.Intestazione.Destinatari = append(d.Intestazione.Destinatari, Destinatario{Tipo: tipo, Val: rcpt})
+	}
+}
+
+// Marshal encodes the DatiCert as an XML document
+func (d *DatiCert) Marshal() ([]byte, error) {
+	xmlBytes, err := xml.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal daticert.xml: %v", err)
+	}
+	return append([]byte(xml.Header), xmlBytes...), nil
+}
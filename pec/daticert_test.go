@@ -0,0 +1,54 @@
+package pec
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDatiCertMarshalRoundTrip(t *testing.T) {
+	at := time.Date(2024, 1, 15, 14, 30, 45, 0, time.FixedZone("CET", 3600))
+	d := NewDatiCert(TipoAvvenutaConsegna, ErroreNessuno, "EXAMPLE PEC S.p.A.", at)
+	d.Intestazione.Mittente = "sender@example.com"
+	d.AddDestinatari("certificato", "to1@example.com", "to2@example.com")
+	d.Intestazione.Oggetto = "Subject"
+	d.Dati.Identificativo = "unique-id"
+	d.Dati.MsgID = "<original@example.com>"
+	d.Dati.Ricevuta = &Ricevuta{Tipo: "breve"}
+	d.Dati.Consegna = "to1@example.com"
+
+	xmlBytes, err := d.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	for _, element := range []string{
+		`<?xml version="1.0" encoding="UTF-8"?>`,
+		`<postacert tipo="avvenuta-consegna" errore="nessuno">`,
+		`<destinatari tipo="certificato">to2@example.com</destinatari>`,
+		`<data zona="+0100">`,
+		`<giorno>15/01/2024</giorno>`,
+		`<ricevuta tipo="breve"></ricevuta>`,
+		`<consegna>to1@example.com</consegna>`,
+	} {
+		if !strings.Contains(string(xmlBytes), element) {
+			t.Errorf("expected XML to contain %s, got\n%s", element, xmlBytes)
+		}
+	}
+	if strings.Contains(string(xmlBytes), "errore-esteso") {
+		t.Errorf("expected no errore-esteso element")
+	}
+
+	parsed, err := ParseDatiCertXML(string(xmlBytes))
+	if err != nil {
+		t.Fatalf("failed to parse XML: %v", err)
+	}
+	if parsed.Tipo != TipoAvvenutaConsegna || len(parsed.Intestazione.Destinatari) != 2 {
+		t.Errorf("unexpected round trip: %+v", parsed)
+	}
+	if parsed.Dati.Ricevuta == nil || parsed.Dati.Ricevuta.Tipo != "breve" || parsed.Dati.Consegna != "to1@example.com" {
+		t.Errorf("unexpected dati: %+v", parsed.Dati)
+	}
+	if parsed.Dati.Data.Ora != "14:30:45" {
+		t.Errorf("expected 14:30:45, got %s", parsed.Dati.Data.Ora)
+	}
+}
@@ -0,0 +1,107 @@
+package pec
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+	"net/mail"
+	"strings"
+)
+
+// IdentityPolicy decides how strictly VerifySignerIdentity binds the signer
+// of a message to its From address
+type IdentityPolicy int
+
+const (
+	// IdentityProvider accepts a certificate issued to the From address or
+	// to the posta-certificata mailbox of its domain: the PEC messages and
+	// receipts are signed by the provider of the sender, not by the sender
+	IdentityProvider IdentityPolicy = iota
+	// IdentityStrict accepts only a certificate issued to the From address
+	IdentityStrict
+)
+
+// providerMailbox is the local-part of the address PEC providers sign with
+const providerMailbox = "posta-certificata"
+
+// oidEmailAddress is the emailAddress attribute of a certificate subject
+var oidEmailAddress = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 1}
+
+// IdentityMismatch is returned by VerifySignerIdentity when the signer
+// certificate is not issued to the sender of the message
+type IdentityMismatch struct {
+	From    string   // the address of the From field
+	Signers []string // the addresses the certificate is issued to
+}
+
+func (e *IdentityMismatch) Error() string {
+	if len(e.Signers) == 0 {
+		return fmt.Sprintf("signer certificate names no address, expected %s", e.From)
+	}
+	return fmt.Sprintf("signer certificate issued to %s, not to %s", strings.Join(e.Signers, ", "), e.From)
+}
+
+// VerifySignerIdentity checks that the signed PEC message raw is signed by a
+// certificate issued to the address of its From field, as CheckSignerIdentity.
+// The signature itself is not checked, see VerifyReader. A signer not bound
+// to the sender is reported with an *IdentityMismatch.
+func VerifySignerIdentity(raw []byte, policy IdentityPolicy) error {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return fmt.Errorf("failed to parse message: %v", err)
+	}
+	from, err := mail.ParseAddress(msg.Header.Get("From"))
+	if err != nil {
+		return fmt.Errorf("failed to parse From field: %v", err)
+	}
+	p7, _, err := signedData(raw)
+	if err != nil {
+		return err
+	}
+	cert := p7.GetOnlySigner()
+	if cert == nil {
+		return fmt.Errorf("signature has no single signer")
+	}
+	return CheckSignerIdentity(cert, from.Address, policy)
+}
+
+// CheckSignerIdentity checks that cert is issued to the address from: the
+// address must be among the EmailAddresses of the certificate, or be the
+// emailAddress or the common name of its subject. Under IdentityProvider the
+// posta-certificata address of the domain of from is accepted as well.
+func CheckSignerIdentity(cert *x509.Certificate, from string, policy IdentityPolicy) error {
+	accepted := []string{from}
+	if policy == IdentityProvider {
+		if at := strings.LastIndex(from, "@"); at >= 0 {
+			accepted = append(accepted, providerMailbox+from[at:])
+		}
+	}
+
+	signers := certificateAddresses(cert)
+	for _, signer := range signers {
+		for _, address := range accepted {
+			if strings.EqualFold(signer, address) {
+				return nil
+			}
+		}
+	}
+	return &IdentityMismatch{From: from, Signers: signers}
+}
+
+// certificateAddresses returns the addresses a certificate is issued to
+func certificateAddresses(cert *x509.Certificate) []string {
+	addresses := append([]string{}, cert.EmailAddresses...)
+	for _, name := range cert.Subject.Names {
+		if !name.Type.Equal(oidEmailAddress) {
+			continue
+		}
+		if address, ok := name.Value.(string); ok {
+			addresses = append(addresses, address)
+		}
+	}
+	if strings.Contains(cert.Subject.CommonName, "@") {
+		addresses = append(addresses, cert.Subject.CommonName)
+	}
+	return addresses
+}
@@ -0,0 +1,81 @@
+package pec
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"testing"
+)
+
+func TestVerifySignerIdentity(t *testing.T) {
+	// signPEC signs as posta-certificata@example.com
+	tests := []struct {
+		name   string
+		from   string
+		policy IdentityPolicy
+		match  bool
+	}{
+		{"provider address", "From: posta-certificata@example.com\r\n", IdentityStrict, true},
+		{"on behalf of the sender", "From: \"Per conto di: sender@example.com\" <posta-certificata@example.com>\r\n", IdentityStrict, true},
+		{"sender of the provider", "From: sender@example.com\r\n", IdentityProvider, true},
+		{"sender, strict", "From: sender@example.com\r\n", IdentityStrict, false},
+		{"other provider", "From: posta-certificata@other.example.org\r\n", IdentityProvider, false},
+		{"sender of another provider", "From: sender@other.example.org\r\n", IdentityProvider, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := signPEC(t, tt.from+"X-Ricevuta: accettazione\r\n", "accettazione", "<sent@example.com>")
+			err := VerifySignerIdentity(raw, tt.policy)
+			if tt.match {
+				if err != nil {
+					t.Errorf("expected the signer to match, got %v", err)
+				}
+				return
+			}
+			var mismatch *IdentityMismatch
+			if !errors.As(err, &mismatch) {
+				t.Fatalf("expected an IdentityMismatch, got %v", err)
+			}
+			if len(mismatch.Signers) != 1 || mismatch.Signers[0] != "posta-certificata@example.com" {
+				t.Errorf("expected the signer address in the mismatch, got %v", mismatch.Signers)
+			}
+		})
+	}
+}
+
+func TestVerifySignerIdentityUnsigned(t *testing.T) {
+	raw := []byte("From: sender@example.com\r\nContent-Type: text/plain\r\n\r\nHello\r\n")
+	err := VerifySignerIdentity(raw, IdentityProvider)
+	var mismatch *IdentityMismatch
+	if err == nil || errors.As(err, &mismatch) {
+		t.Errorf("expected an error for an unsigned message, got %v", err)
+	}
+}
+
+func TestCheckSignerIdentity(t *testing.T) {
+	tests := []struct {
+		name  string
+		cert  *x509.Certificate
+		match bool
+	}{
+		{"email address", &x509.Certificate{EmailAddresses: []string{"Posta-Certificata@Example.com"}}, true},
+		{"subject email", &x509.Certificate{Subject: pkix.Name{
+			CommonName: "Example PEC",
+			Names:      []pkix.AttributeTypeAndValue{{Type: oidEmailAddress, Value: "posta-certificata@example.com"}},
+		}}, true},
+		{"common name", &x509.Certificate{Subject: pkix.Name{CommonName: "posta-certificata@example.com"}}, true},
+		{"other address", &x509.Certificate{EmailAddresses: []string{"posta-certificata@other.example.org"}}, false},
+		{"no address", &x509.Certificate{Subject: pkix.Name{CommonName: "Example PEC"}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckSignerIdentity(tt.cert, "posta-certificata@example.com", IdentityStrict)
+			if tt.match && err != nil {
+				t.Errorf("expected the certificate to match, got %v", err)
+			}
+			if !tt.match && err == nil {
+				t.Errorf("expected a mismatch")
+			}
+		})
+	}
+}
@@ -0,0 +1,195 @@
+package pec
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// imapDialTimeout bounds the connection to the IMAP server
+const imapDialTimeout = 30 * time.Second
+
+// ReceiptClient fetches the receipts delivered to a PEC mailbox over IMAP
+type ReceiptClient struct {
+	Addr     string // host:port of the IMAP server
+	Username string
+	Password string
+
+	// TLSConfig secures the connection; when nil the server certificate is
+	// checked against the system roots for the host of Addr
+	TLSConfig *tls.Config
+	// StartTLS connects in clear text and upgrades the connection with
+	// STARTTLS, instead of connecting with TLS directly
+	StartTLS bool
+	// Mailbox is the mailbox to list, INBOX when empty
+	Mailbox string
+}
+
+// MailboxReceipt is a receipt found in a mailbox
+type MailboxReceipt struct {
+	UID      uint32 `json:"uid"`
+	Ricevuta string `json:"ricevuta"` // the X-Ricevuta header
+	Raw      []byte `json:"-"`
+
+	Mail         *PECMail            `json:"mail,omitempty"`
+	Verification *VerificationResult `json:"verification,omitempty"`
+	// Error is set when the receipt cannot be parsed as a PEC
+	Error string `json:"error,omitempty"`
+}
+
+// receiptHeader is the header section identifying the receipts
+var receiptHeader = &imap.BodySectionName{
+	BodyPartName: imap.BodyPartName{Specifier: imap.HeaderSpecifier, Fields: []string{"X-Ricevuta"}},
+	Peek:         true,
+}
+
+// entireMessage is the section holding a whole message
+var entireMessage = &imap.BodySectionName{Peek: true}
+
+// FetchReceipts lists the mailbox, identifies the receipts by their
+// X-Ricevuta header, fetches and verifies them. The mailbox is opened read
+// only, the receipts are left unseen. A receipt failing verification is
+// returned with the failed checks, or the parse error, in its result.
+func (c *ReceiptClient) FetchReceipts() ([]MailboxReceipt, error) {
+	imapClient, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer imapClient.Logout()
+
+	if err := imapClient.Login(c.Username, c.Password); err != nil {
+		return nil, fmt.Errorf("failed to log in: %v", err)
+	}
+	mailbox := c.Mailbox
+	if mailbox == "" {
+		mailbox = "INBOX"
+	}
+	status, err := imapClient.Select(mailbox, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select %s: %v", mailbox, err)
+	}
+	if status.Messages == 0 {
+		return nil, nil
+	}
+
+	// Identify the receipts from their header alone
+	all := new(imap.SeqSet)
+	all.AddRange(1, 0)
+	ricevute := make(map[uint32]string)
+	err = fetch(imapClient, all, []imap.FetchItem{imap.FetchUid, receiptHeader.FetchItem()}, func(msg *imap.Message) error {
+		header, err := readLiteral(msg.GetBody(receiptHeader))
+		if err != nil {
+			return err
+		}
+		parsed, err := mail.ReadMessage(bytes.NewReader(header))
+		if err != nil {
+			// Not a receipt if its header cannot be read
+			return nil
+		}
+		if ricevuta := strings.TrimSpace(parsed.Header.Get("X-Ricevuta")); ricevuta != "" {
+			ricevute[msg.Uid] = ricevuta
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %v", mailbox, err)
+	}
+	if len(ricevute) == 0 {
+		return nil, nil
+	}
+
+	uids := new(imap.SeqSet)
+	for uid := range ricevute {
+		uids.AddNum(uid)
+	}
+	var receipts []MailboxReceipt
+	err = fetch(imapClient, uids, []imap.FetchItem{imap.FetchUid, entireMessage.FetchItem()}, func(msg *imap.Message) error {
+		raw, err := readLiteral(msg.GetBody(entireMessage))
+		if err != nil {
+			return err
+		}
+		receipts = append(receipts, verifyReceipt(msg.Uid, ricevute[msg.Uid], raw))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch receipts: %v", err)
+	}
+	return receipts, nil
+}
+
+// dial connects to the server with TLS, directly or with STARTTLS
+func (c *ReceiptClient) dial() (*client.Client, error) {
+	dialer := &net.Dialer{Timeout: imapDialTimeout}
+	if !c.StartTLS {
+		imapClient, err := client.DialWithDialerTLS(dialer, c.Addr, c.TLSConfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to %s: %v", c.Addr, err)
+		}
+		return imapClient, nil
+	}
+
+	imapClient, err := client.DialWithDialer(dialer, c.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %v", c.Addr, err)
+	}
+	if err := imapClient.StartTLS(c.TLSConfig); err != nil {
+		imapClient.Logout()
+		return nil, fmt.Errorf("failed to start TLS: %v", err)
+	}
+	return imapClient, nil
+}
+
+// fetch runs a UID FETCH, calling handle for each message
+func fetch(imapClient *client.Client, uids *imap.SeqSet, items []imap.FetchItem, handle func(*imap.Message) error) error {
+	messages := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- imapClient.UidFetch(uids, items, messages)
+	}()
+
+	var handleErr error
+	for msg := range messages {
+		if handleErr == nil {
+			handleErr = handle(msg)
+		}
+	}
+	if err := <-done; err != nil {
+		return err
+	}
+	return handleErr
+}
+
+// readLiteral reads a fetched section
+func readLiteral(literal imap.Literal) ([]byte, error) {
+	if literal == nil {
+		return nil, fmt.Errorf("section missing in the server response")
+	}
+	return io.ReadAll(literal)
+}
+
+// verifyReceipt parses and verifies a fetched receipt
+func verifyReceipt(uid uint32, ricevuta string, raw []byte) MailboxReceipt {
+	receipt := MailboxReceipt{UID: uid, Ricevuta: ricevuta, Raw: raw}
+	result, err := verifyDetailed(raw)
+	if err != nil {
+		receipt.Error = err.Error()
+		return receipt
+	}
+	receipt.Verification = result
+
+	pecMail, _, err := ParsePecReader(bytes.NewReader(raw))
+	if err != nil {
+		receipt.Error = err.Error()
+		return receipt
+	}
+	receipt.Mail = pecMail
+	return receipt
+}
@@ -19,27 +19,41 @@ const (
 	DeliveryReceipt
 	DeliveryErrorReceipt
 	AcceptanceReceipt
+	NonAcceptanceReceipt
+	TakingChargeReceipt
 )
 
 type PECMail struct {
 	Envelope  Envelope `json:"envelope"`
 	MessageID string   `json:"message_id"`
 	PecType   PecType  `json:"pec_type"`
+	// MissingDatiCert is set when the message carries no daticert.xml: the
+	// type is known from the headers alone and the DatiCert is empty
+	MissingDatiCert bool `json:"missing_daticert,omitempty"`
 }
 
-// Define the structure of the DatiCert XML
+// Destinatario is a recipient listed in the DatiCert, one per element
+type Destinatario struct {
+	Tipo string `xml:"tipo,attr"` // certificato or esterno
+	Val  string `xml:",chardata"`
+}
+
+// Ricevuta is the receipt type requested by the sender
+type Ricevuta struct {
+	Tipo string `xml:"tipo,attr"` // completa, breve or sintetica
+}
+
+// DatiCert is the daticert.xml (postacert schema) attached to every PEC
+// message and receipt
 type DatiCert struct {
 	XMLName      xml.Name `xml:"postacert"`
 	Tipo         string   `xml:"tipo,attr"`
 	Errore       string   `xml:"errore,attr"`
 	Intestazione struct {
-		Mittente    string `xml:"mittente"`
-		Destinatari struct {
-			Tipo string `xml:"tipo,attr"`
-			Val  string `xml:",chardata"`
-		} `xml:"destinatari"`
-		Risposte string `xml:"risposte"`
-		Oggetto  string `xml:"oggetto"`
+		Mittente    string         `xml:"mittente"`
+		Destinatari []Destinatario `xml:"destinatari"`
+		Risposte    string         `xml:"risposte"`
+		Oggetto     string         `xml:"oggetto"`
 	} `xml:"intestazione"`
 	Dati struct {
 		GestoreEmittente string `xml:"gestore-emittente"`
@@ -48,8 +62,11 @@ type DatiCert struct {
 			Giorno string `xml:"giorno"`
 			Ora    string `xml:"ora"`
 		} `xml:"data"`
-		Identificativo string `xml:"identificativo"`
-		MsgID          string `xml:"msgid"`
-		ErroreEsteso   string `xml:"errore-esteso,omitempty"`
+		Identificativo string    `xml:"identificativo"`
+		MsgID          string    `xml:"msgid"`
+		Ricevuta       *Ricevuta `xml:"ricevuta,omitempty"`
+		Consegna       string    `xml:"consegna,omitempty"`
+		Ricezione      []string  `xml:"ricezione,omitempty"`
+		ErroreEsteso   string    `xml:"errore-esteso,omitempty"`
 	} `xml:"dati"`
 }
@@ -9,11 +9,16 @@ import (
 	"mime"
 	"mime/multipart"
 	"net/mail"
+	"net/textproto"
 	"strings"
+	"unicode"
+
+	"go.mozilla.org/pkcs7"
 )
 
-// Function to parse DatiCert XML
-func parseDatiCertXML(content string) (*DatiCert, error) {
+// ParseDatiCertXML parses the content of a daticert.xml, as decoded from
+// its attachment
+func ParseDatiCertXML(content string) (*DatiCert, error) {
 	// Remove any extra spaces or newlines that might exist around the XML content
 	content = strings.TrimSpace(content)
 
@@ -27,45 +32,55 @@ func parseDatiCertXML(content string) (*DatiCert, error) {
 	return &daticert, nil
 }
 
-// reads PEC-specific headers from the email
-func extractPECHeaders(header *mail.Header, pecMail *PECMail) {
-	pecHeaders := []string{
-		"X-Riferimento-Message-ID",
-		"Return-Path",
-		"Delivered-To",
-		"Received",
-		"X-Ricevuta",
-		"Message-ID",
-		"X-Trasporto",
+// receiptPrecedence maps the X-Ricevuta tokens to their PEC type. When a
+// message carries more than one token the first listed wins: failures come
+// first, so that a message is never reported as more successful than it is.
+var receiptPrecedence = []struct {
+	token   string
+	pecType PecType
+}{
+	{"non-accettazione", NonAcceptanceReceipt},
+	{"errore-consegna", DeliveryErrorReceipt},
+	{"avvenuta-consegna", DeliveryReceipt},
+	{"presa-in-carico", TakingChargeReceipt},
+	{"accettazione", AcceptanceReceipt},
+}
+
+// headerTokens returns the lowercased tokens of every value of the header
+// key, split on commas and spaces
+func headerTokens(header *mail.Header, key string) map[string]bool {
+	tokens := make(map[string]bool)
+	for _, value := range (*header)[textproto.CanonicalMIMEHeaderKey(key)] {
+		for _, token := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || unicode.IsSpace(r) }) {
+			tokens[strings.ToLower(token)] = true
+		}
 	}
+	return tokens
+}
 
+// reads PEC-specific headers from the email
+func extractPECHeaders(header *mail.Header, pecMail *PECMail) {
 	pecMail.PecType = None
+	pecMail.MessageID = header.Get("Message-ID")
 
-	for _, h := range pecHeaders {
-		if value := header.Get(h); value != "" {
-			if h == "X-Ricevuta" {
-				if strings.Contains(value, "accettazione") {
-					pecMail.PecType = AcceptanceReceipt
-				} else if strings.Contains(value, "avvenuta-consegna") {
-					pecMail.PecType = DeliveryReceipt
-				} else if strings.Contains(value, "errore-consegna") {
-					pecMail.PecType = DeliveryErrorReceipt
-				}
-			} else if h == "X-Trasporto" {
-				if strings.Contains(value, "posta-certificata") {
-					pecMail.PecType = CertifiedEmail
-				}
-			}
-			if h == "Message-ID" {
-				pecMail.MessageID = value
-			}
+	// A transport envelope is classified by X-Trasporto alone
+	if headerTokens(header, "X-Trasporto")["posta-certificata"] {
+		pecMail.PecType = CertifiedEmail
+		return
+	}
+
+	tokens := headerTokens(header, "X-Ricevuta")
+	for _, receipt := range receiptPrecedence {
+		if tokens[receipt.token] {
+			pecMail.PecType = receipt.pecType
+			return
 		}
 	}
 }
 
 // Function to parse the mixed part of the email
-// Should contain the daticert.xml
-func parseMixedPart(partData []byte, boundary string) *DatiCert {
+// Should contain the daticert.xml; nil is returned when it does not
+func parseMixedPart(partData []byte, boundary string) (*DatiCert, error) {
 
 	reader := multipart.NewReader(bytes.NewReader(partData), boundary)
 
@@ -75,12 +90,14 @@ func parseMixedPart(partData []byte, boundary string) *DatiCert {
 			break
 		}
 		if err != nil {
-			fmt.Println("Error reading multipart:", err)
-			return nil
+			return nil, fmt.Errorf("failed to read multipart: %v", err)
 		}
 
 		partMediaType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
-		partData, _ := io.ReadAll(part)
+		partData, err := io.ReadAll(part)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read multipart: %v", err)
+		}
 
 		if partMediaType == "multipart/alternative" {
 			// log.Println("multipart/alternative detected")
@@ -89,19 +106,14 @@ func parseMixedPart(partData []byte, boundary string) *DatiCert {
 			if part.Header.Get("Content-Transfer-Encoding") == "base64" {
 				d, err := base64.StdEncoding.DecodeString(string(partData))
 				if err != nil {
-					fmt.Println("Error decoding base64:", err)
-					return nil
+					return nil, fmt.Errorf("failed to decode daticert.xml: %v", err)
 				}
 				decoded = d
 			} else {
 				decoded = partData
 			}
 
-			datiCert, err := parseDatiCertXML(string(decoded))
-			if err != nil {
-				fmt.Println("Error parsing daticert.xml:", err)
-			}
-			return datiCert
+			return ParseDatiCertXML(string(decoded))
 
 		} else if partMediaType == "message/rfc822" {
 			// log.Println("message/rfc822 detected")
@@ -110,12 +122,98 @@ func parseMixedPart(partData []byte, boundary string) *DatiCert {
 		}
 	}
 
-	return nil
+	return nil, nil
+
+}
+
+// parseSignedParts returns the daticert.xml found in the parts of a
+// multipart/signed body, nil when there is none
+func parseSignedParts(body io.Reader, boundary string) (*DatiCert, error) {
+	var datiCert *DatiCert
+	mr := multipart.NewReader(body, boundary)
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("malformed multipart body: %v", err)
+		}
 
+		partMediaType, params, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		partData, err := io.ReadAll(part)
+		if err != nil {
+			return nil, fmt.Errorf("malformed multipart body: %v", err)
+		}
+
+		if partMediaType == "multipart/mixed" {
+			found, err := parseMixedPart(partData, params["boundary"])
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse mixed part: %v", err)
+			}
+			if found != nil {
+				datiCert = found
+			}
+		}
+	}
+	return datiCert, nil
+}
+
+// isOpaqueSigned reports whether mediaType is the one of an S/MIME message
+// enclosing its content in the signed data
+func isOpaqueSigned(mediaType string) bool {
+	return mediaType == "application/pkcs7-mime" || mediaType == "application/x-pkcs7-mime"
+}
+
+// opaqueSignedData decodes the signed data making up the body of an
+// application/pkcs7-mime message; its signature is not verified
+func opaqueSignedData(msg *mail.Message) (*pkcs7.PKCS7, error) {
+	body, err := io.ReadAll(msg.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signed data: %v", err)
+	}
+	if strings.EqualFold(msg.Header.Get("Content-Transfer-Encoding"), "base64") {
+		body, err = base64.StdEncoding.DecodeString(string(bytes.Join(bytes.Fields(body), nil)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode signed data: %v", err)
+		}
+	}
+	p7, err := pkcs7.Parse(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signed data: %v", err)
+	}
+	return p7, nil
+}
+
+// parseOpaqueContent returns the daticert.xml found in the content enclosed
+// in an application/pkcs7-mime message, nil when there is none
+func parseOpaqueContent(msg *mail.Message) (*DatiCert, error) {
+	p7, err := opaqueSignedData(msg)
+	if err != nil {
+		return nil, err
+	}
+	content, err := mail.ReadMessage(bytes.NewReader(p7.Content))
+	if err != nil {
+		return nil, fmt.Errorf("malformed signed content: %v", err)
+	}
+	mediaType, params, _ := mime.ParseMediaType(content.Header.Get("Content-Type"))
+	if mediaType != "multipart/mixed" {
+		return nil, nil
+	}
+	data, err := io.ReadAll(content.Body)
+	if err != nil {
+		return nil, fmt.Errorf("malformed signed content: %v", err)
+	}
+	found, err := parseMixedPart(data, params["boundary"])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse mixed part: %v", err)
+	}
+	return found, nil
 }
 
 // Function to parse the PEC email
-// Extracts the envelope and the daticert.xml
+// Extracts the envelope and the daticert.xml. A message without daticert.xml
+// is returned with an empty DatiCert and MissingDatiCert set.
 func ParsePec(msg *mail.Message) (*PECMail, *DatiCert, error) {
 
 	pecMail := &PECMail{}
@@ -129,7 +227,7 @@ func ParsePec(msg *mail.Message) (*PECMail, *DatiCert, error) {
 		return pecMail, datiCert, err
 	}
 
-	if mediaType != "multipart/signed" {
+	if mediaType != "multipart/signed" && !isOpaqueSigned(mediaType) {
 		fmt.Println("Email is not a signed S/MIME message")
 		return pecMail, datiCert, err
 	}
@@ -147,39 +245,45 @@ func ParsePec(msg *mail.Message) (*PECMail, *DatiCert, error) {
 		return nil, nil, fmt.Errorf("not a pec")
 	}
 
-	// Parse multipart content
-	mr := multipart.NewReader(msg.Body, params["boundary"])
-
-	for {
-		part, err := mr.NextPart()
-		if err == io.EOF {
-			break
-		}
-
-		if err != nil {
-			fmt.Println("Error reading multipart:", err)
-			// TODO: check this suppressed error for malformed eml files
-			return pecMail, datiCert, nil
-		}
-
-		partMediaType, params, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
-		partData, _ := io.ReadAll(part)
+	// Parse the signed content, in clear or enclosed in the signed data
+	var found *DatiCert
+	if isOpaqueSigned(mediaType) {
+		found, err = parseOpaqueContent(msg)
+	} else {
+		found, err = parseSignedParts(msg.Body, params["boundary"])
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	pecMail.MissingDatiCert = found == nil
+	if found != nil {
+		datiCert = found
+	}
 
-		if partMediaType == "multipart/mixed" {
-			datiCert = parseMixedPart(partData, params["boundary"])
-			if datiCert == nil {
-				return nil, nil, fmt.Errorf("failed to parse mixed part")
-			}
-		}
+	// Some legacy receipts omit the daticert.xml: the headers alone
+	// identify them, there is nothing to cross-check
+	if pecMail.MissingDatiCert {
+		return pecMail, datiCert, nil
 	}
 
 	// cross-check the extracted data
 	if (pecMail.PecType == AcceptanceReceipt && datiCert.Tipo != "accettazione") ||
 		(pecMail.PecType == DeliveryReceipt && datiCert.Tipo != "avvenuta-consegna") ||
 		(pecMail.PecType == CertifiedEmail && datiCert.Tipo != "posta-certificata") ||
-		(pecMail.PecType == DeliveryErrorReceipt && datiCert.Tipo != "errore-consegna") {
+		(pecMail.PecType == DeliveryErrorReceipt && datiCert.Tipo != "errore-consegna") ||
+		(pecMail.PecType == NonAcceptanceReceipt && datiCert.Tipo != "non-accettazione") ||
+		(pecMail.PecType == TakingChargeReceipt && datiCert.Tipo != "presa-in-carico") {
 		return nil, nil, fmt.Errorf("mismatch between PEC type and DatiCert type: %d vs %s", pecMail.PecType, datiCert.Tipo)
 	}
 
 	return pecMail, datiCert, nil
 }
+
+// ParsePecReader parses a PEC email read from r
+func ParsePecReader(r io.Reader) (*PECMail, *DatiCert, error) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error parsing email %s", err)
+	}
+	return ParsePec(msg)
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"net/mail"
+	"strings"
 	"testing"
 )
 
@@ -28,7 +29,7 @@ func TestParseDatiCertXML(t *testing.T) {
     		</dati>
 		</postacert>
 		`
-	daticert, err := parseDatiCertXML(xmlContent)
+	daticert, err := ParseDatiCertXML(xmlContent)
 	if err != nil {
 		t.Fatalf("failed to parse XML: %v", err)
 	}
@@ -66,7 +67,7 @@ func TestParseDatiCertXMLErroreEsteso(t *testing.T) {
 			</dati>
 		</postacert>`
 
-	daticert, err := parseDatiCertXML(xmlContent)
+	daticert, err := ParseDatiCertXML(xmlContent)
 	if err != nil {
 		t.Fatalf("failed to parse XML: %v", err)
 	}
@@ -125,6 +126,10 @@ func TestParseAccettazione(t *testing.T) {
 		t.Errorf("expected AcceptanceReceipt, got %v", pecMail.PecType)
 	}
 
+	if pecMail.MissingDatiCert {
+		t.Errorf("expected the daticert.xml to be found")
+	}
+
 	if datiCert.Errore != "nessuno" {
 		t.Errorf("expected nessuno, got %s", datiCert.Errore)
 	}
@@ -135,6 +140,74 @@ func TestParseAccettazione(t *testing.T) {
 
 }
 
+func TestParseMissingDatiCert(t *testing.T) {
+	filename := "test/resources/accettazione-senza-daticert.eml"
+	emlData := ReadEmail(filename)
+	if emlData == nil {
+		t.Fatalf("Error reading file %s", filename)
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(emlData))
+	if err != nil {
+		t.Fatalf("Error parsing email %s", err)
+	}
+
+	pecMail, datiCert, e := ParsePec(msg)
+	if e != nil {
+		t.Fatalf("expected a receipt without daticert.xml to be parsed, got %v", e)
+	}
+	if pecMail.PecType != AcceptanceReceipt {
+		t.Errorf("expected AcceptanceReceipt from the headers, got %v", pecMail.PecType)
+	}
+	if !pecMail.MissingDatiCert {
+		t.Errorf("expected the missing daticert.xml to be flagged")
+	}
+	if datiCert == nil || datiCert.Tipo != "" {
+		t.Errorf("expected an empty DatiCert, got %+v", datiCert)
+	}
+	if pecMail.Envelope.From != "posta-certificata@fakepec.it" {
+		t.Errorf("expected the envelope to be read, got %+v", pecMail.Envelope)
+	}
+}
+
+func TestParseUnreadableDatiCert(t *testing.T) {
+	emlData := ReadEmail("test/resources/accettazione.eml")
+	if emlData == nil {
+		t.Fatalf("Error reading file")
+	}
+	// A daticert.xml that is present but cannot be read is still an error
+	emlData = bytes.Replace(emlData, []byte("PD94bWwgdmVyc2lvbj0i"), []byte("!!not base64!!"), 1)
+
+	msg, err := mail.ReadMessage(bytes.NewReader(emlData))
+	if err != nil {
+		t.Fatalf("Error parsing email %s", err)
+	}
+	if _, _, e := ParsePec(msg); e == nil {
+		t.Errorf("expected an error for an unreadable daticert.xml")
+	}
+}
+
+func TestParseTruncated(t *testing.T) {
+	filename := "test/resources/accettazione-troncata.eml"
+	emlData := ReadEmail(filename)
+	if emlData == nil {
+		t.Fatalf("Error reading file %s", filename)
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(emlData))
+	if err != nil {
+		t.Fatalf("Error parsing email %s", err)
+	}
+
+	pecMail, datiCert, e := ParsePec(msg)
+	if e == nil || !strings.Contains(e.Error(), "malformed multipart body") {
+		t.Fatalf("expected a malformed multipart error, got %v", e)
+	}
+	if pecMail != nil || datiCert != nil {
+		t.Errorf("expected no half-parsed result, got %+v %+v", pecMail, datiCert)
+	}
+}
+
 func TestParseDelivery(t *testing.T) {
 	filename := "test/resources/email_2.eml"
 	emlData := ReadEmail(filename)
@@ -221,3 +294,43 @@ func TestParseAndVerify(t *testing.T) {
 		t.Fatalf("Verification failed")
 	}
 }
+
+func TestExtractPECHeaders(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers string
+		want    PecType
+	}{
+		{"accettazione", "X-Ricevuta: accettazione\r\n", AcceptanceReceipt},
+		{"non-accettazione", "X-Ricevuta: non-accettazione\r\n", NonAcceptanceReceipt},
+		{"avvenuta-consegna", "X-Ricevuta: avvenuta-consegna\r\n", DeliveryReceipt},
+		{"errore-consegna", "X-Ricevuta: errore-consegna\r\n", DeliveryErrorReceipt},
+		{"presa-in-carico", "X-Ricevuta: presa-in-carico\r\n", TakingChargeReceipt},
+		{"case insensitive", "X-Ricevuta: Non-Accettazione\r\n", NonAcceptanceReceipt},
+		{"surrounding spaces", "X-Ricevuta:   accettazione  \r\n", AcceptanceReceipt},
+		{"comma separated", "X-Ricevuta: accettazione, non-accettazione\r\n", NonAcceptanceReceipt},
+		{"repeated header", "X-Ricevuta: avvenuta-consegna\r\nX-Ricevuta: errore-consegna\r\n", DeliveryErrorReceipt},
+		{"no substring match", "X-Ricevuta: preavviso-errore-consegna\r\n", None},
+		{"no prefix match", "X-Ricevuta: accettazione-parziale\r\n", None},
+		{"transport envelope", "X-Trasporto: Posta-Certificata\r\n", CertifiedEmail},
+		{"anomaly envelope", "X-Trasporto: errore\r\n", None},
+		{"plain message", "Subject: hello\r\n", None},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := mail.ReadMessage(strings.NewReader("Message-ID: <id@example.com>\r\n" + tt.headers + "\r\n"))
+			if err != nil {
+				t.Fatalf("failed to read message: %v", err)
+			}
+			pecMail := &PECMail{}
+			extractPECHeaders(&msg.Header, pecMail)
+			if pecMail.PecType != tt.want {
+				t.Errorf("expected PecType %d, got %d", tt.want, pecMail.PecType)
+			}
+			if pecMail.MessageID != "<id@example.com>" {
+				t.Errorf("expected Message-ID <id@example.com>, got %s", pecMail.MessageID)
+			}
+		})
+	}
+}
@@ -0,0 +1,176 @@
+package pec
+
+import (
+	"fmt"
+	netmail "net/mail"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/mail"
+)
+
+// ReceivedHop is a hop of the delivery trace, parsed from a Received field
+type ReceivedHop struct {
+	From   string    `json:"from,omitempty"`    // the host the message was received from
+	FromIP string    `json:"from_ip,omitempty"` // its address, when reported
+	By     string    `json:"by,omitempty"`      // the host that received the message
+	With   string    `json:"with,omitempty"`    // the protocol, e.g. ESMTPS
+	ID     string    `json:"id,omitempty"`      // the queue identifier of the receiving host
+	For    string    `json:"for,omitempty"`     // the recipient the message was received for
+	Date   time.Time `json:"date"`              // zero when missing or unreadable
+	Raw    string    `json:"raw"`
+}
+
+func (h ReceivedHop) String() string {
+	var b strings.Builder
+	for _, clause := range []struct{ name, value string }{
+		{"from", h.From}, {"by", h.By}, {"with", h.With}, {"id", h.ID}, {"for", h.For},
+	} {
+		if clause.value == "" {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(clause.name + " " + clause.value)
+		if clause.name == "from" && h.FromIP != "" && h.FromIP != h.From {
+			b.WriteString(" [" + h.FromIP + "]")
+		}
+	}
+	if !h.Date.IsZero() {
+		b.WriteString("; " + h.Date.Format(time.RFC1123Z))
+	}
+	return b.String()
+}
+
+// ParseReceivedHeaders parses the Received fields of header into the hops of
+// the delivery trace, the most recent first as in the header. Parsing is
+// tolerant: unknown clauses and comments are skipped and a field is never
+// dropped, its unreadable parts are left empty. The error lists the fields
+// of which nothing could be read; the hops are returned all the same.
+func ParseReceivedHeaders(header *mail.Header) ([]ReceivedHop, error) {
+	var hops []ReceivedHop
+	var unreadable []string
+	for _, value := range header.Values("Received") {
+		hop := parseReceived(value)
+		if hop.From == "" && hop.By == "" && hop.Date.IsZero() {
+			unreadable = append(unreadable, fmt.Sprintf("%q", hop.Raw))
+		}
+		hops = append(hops, hop)
+	}
+	if len(unreadable) > 0 {
+		return hops, fmt.Errorf("unreadable Received fields: %s", strings.Join(unreadable, ", "))
+	}
+	return hops, nil
+}
+
+// parseReceived parses a Received field: name-value clauses, then the date
+// after the last semicolon
+func parseReceived(value string) ReceivedHop {
+	value = strings.Join(strings.Fields(value), " ")
+	hop := ReceivedHop{Raw: value}
+
+	clauses := value
+	if semicolon := strings.LastIndex(value, ";"); semicolon >= 0 {
+		clauses = value[:semicolon]
+		hop.Date = parseReceivedDate(value[semicolon+1:])
+	}
+
+	tokens := receivedTokens(clauses)
+	for i := 0; i < len(tokens)-1; i++ {
+		name := strings.ToLower(tokens[i])
+		next := tokens[i+1]
+		if strings.HasPrefix(next, "(") {
+			continue
+		}
+		switch name {
+		case "from":
+			hop.From = strings.Trim(next, "[]")
+			hop.FromIP = bracketed(next)
+			// The address is reported in the comment that follows
+			for j := i + 2; j < len(tokens) && strings.HasPrefix(tokens[j], "("); j++ {
+				if ip := bracketed(tokens[j]); ip != "" {
+					hop.FromIP = ip
+				}
+			}
+		case "by":
+			hop.By = next
+		case "with":
+			hop.With = next
+		case "id":
+			hop.ID = strings.Trim(next, "<>")
+		case "for":
+			hop.For = strings.Trim(next, "<>")
+		default:
+			continue
+		}
+		i++
+	}
+	return hop
+}
+
+// receivedTokens splits the clauses of a Received field into words and
+// parenthesized comments, which may nest
+func receivedTokens(s string) []string {
+	var tokens []string
+	depth, start := 0, -1
+	for i, r := range s {
+		switch {
+		case r == '(':
+			if depth == 0 {
+				if start >= 0 {
+					tokens = append(tokens, s[start:i])
+				}
+				start = i
+			}
+			depth++
+		case r == ')' && depth > 0:
+			depth--
+			if depth == 0 {
+				tokens = append(tokens, s[start:i+1])
+				start = -1
+			}
+		case r == ' ' && depth == 0:
+			if start >= 0 {
+				tokens = append(tokens, s[start:i])
+				start = -1
+			}
+		default:
+			if start < 0 {
+				start = i
+			}
+		}
+	}
+	if start >= 0 {
+		tokens = append(tokens, s[start:])
+	}
+	return tokens
+}
+
+// bracketed returns the address in square brackets within a token
+func bracketed(comment string) string {
+	open := strings.LastIndex(comment, "[")
+	end := strings.LastIndex(comment, "]")
+	if open < 0 || end < open {
+		return ""
+	}
+	address := comment[open+1 : end]
+	return strings.TrimPrefix(strings.TrimPrefix(address, "IPv6:"), "IPV6:")
+}
+
+// parseReceivedDate reads the date of a Received field, ignoring a trailing
+// comment such as (CET); the zero time is returned when it is unreadable
+func parseReceivedDate(s string) time.Time {
+	s = strings.TrimSpace(s)
+	if open := strings.Index(s, "("); open >= 0 {
+		s = strings.TrimSpace(s[:open])
+	}
+	if date, err := netmail.ParseDate(s); err == nil {
+		return date
+	}
+	// Some agents write the date like asctime
+	if date, err := time.Parse(time.ANSIC, s); err == nil {
+		return date
+	}
+	return time.Time{}
+}
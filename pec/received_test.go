@@ -0,0 +1,104 @@
+package pec
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/mail"
+)
+
+// receivedHeader returns a header holding the given Received fields, in order
+func receivedHeader(values ...string) *mail.Header {
+	var header mail.Header
+	for i := len(values) - 1; i >= 0; i-- {
+		header.Add("Received", values[i])
+	}
+	return &header
+}
+
+func TestParseReceivedHeaders(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  ReceivedHop
+	}{
+		{
+			"postfix",
+			"from mail.sender.example.com (mail.sender.example.com [192.0.2.10])\r\n\tby mx.pec.example.it (Postfix) with ESMTPS id 4B2XYZ1234\r\n\tfor <destinatario@pec.example.it>; Mon, 15 Jan 2024 14:30:45 +0100 (CET)",
+			ReceivedHop{From: "mail.sender.example.com", FromIP: "192.0.2.10", By: "mx.pec.example.it", With: "ESMTPS", ID: "4B2XYZ1234", For: "destinatario@pec.example.it",
+				Date: time.Date(2024, 1, 15, 14, 30, 45, 0, time.FixedZone("", 3600))},
+		},
+		{
+			"gmail",
+			"by 2002:a05:6a10:a0c5:b0:4d6:dd12:9b7f with SMTP id n5csp1234567pxb;\r\n        Tue, 2 Apr 2024 03:15:07 -0700 (PDT)",
+			ReceivedHop{By: "2002:a05:6a10:a0c5:b0:4d6:dd12:9b7f", With: "SMTP", ID: "n5csp1234567pxb",
+				Date: time.Date(2024, 4, 2, 3, 15, 7, 0, time.FixedZone("", -7*3600))},
+		},
+		{
+			"exim with IPv6 and helo",
+			"from [IPv6:2001:db8::1] (helo=client.example.org)\r\n\tby smtp.example.net with esmtpsa (TLS1.3) (Exim 4.96)\r\n\tid 1rABCD-000123-EF; Wed, 03 Apr 2024 09:00:00 +0000",
+			ReceivedHop{From: "IPv6:2001:db8::1", FromIP: "2001:db8::1", By: "smtp.example.net", With: "esmtpsa", ID: "1rABCD-000123-EF",
+				Date: time.Date(2024, 4, 3, 9, 0, 0, 0, time.UTC)},
+		},
+		{
+			"qmail comment",
+			"(qmail 12345 invoked by uid 89); 4 Apr 2024 10:11:12 -0000",
+			ReceivedHop{Date: time.Date(2024, 4, 4, 10, 11, 12, 0, time.UTC)},
+		},
+		{
+			"bare address and asctime date",
+			"from [198.51.100.7] by relay.example.com; Fri Apr  5 08:00:00 2024",
+			ReceivedHop{From: "198.51.100.7", FromIP: "198.51.100.7", By: "relay.example.com", Date: time.Date(2024, 4, 5, 8, 0, 0, 0, time.UTC)},
+		},
+		{
+			"no date",
+			"from localhost by pec.example.it with LMTP",
+			ReceivedHop{From: "localhost", By: "pec.example.it", With: "LMTP"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hops, err := ParseReceivedHeaders(receivedHeader(tt.value))
+			if err != nil {
+				t.Fatalf("ParseReceivedHeaders failed: %v", err)
+			}
+			if len(hops) != 1 {
+				t.Fatalf("expected 1 hop, got %d", len(hops))
+			}
+			got := hops[0]
+			if !got.Date.Equal(tt.want.Date) {
+				t.Errorf("expected date %v, got %v", tt.want.Date, got.Date)
+			}
+			got.Date, got.Raw = tt.want.Date, ""
+			if got != tt.want {
+				t.Errorf("expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestParseReceivedHeaders_Trace(t *testing.T) {
+	hops, err := ParseReceivedHeaders(receivedHeader(
+		"from mx.pec.example.it by pec.example.it with LMTP; Mon, 15 Jan 2024 14:30:47 +0100",
+		"garbage",
+		"from mail.sender.example.com by mx.pec.example.it with ESMTPS; Mon, 15 Jan 2024 14:30:45 +0100",
+	))
+	if err == nil || !strings.Contains(err.Error(), `"garbage"`) {
+		t.Errorf("expected an error naming the unreadable field, got %v", err)
+	}
+	if len(hops) != 3 {
+		t.Fatalf("expected every field to be returned, got %d hops", len(hops))
+	}
+	if hops[0].By != "pec.example.it" || hops[2].From != "mail.sender.example.com" || hops[1].Raw != "garbage" {
+		t.Errorf("unexpected trace %+v", hops)
+	}
+	if got := hops[0].String(); got != "from mx.pec.example.it by pec.example.it with LMTP; Mon, 15 Jan 2024 14:30:47 +0100" {
+		t.Errorf("unexpected String %q", got)
+	}
+
+	if hops, err := ParseReceivedHeaders(receivedHeader()); err != nil || len(hops) != 0 {
+		t.Errorf("expected no hops without Received fields, got %v (%v)", hops, err)
+	}
+}
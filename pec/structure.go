@@ -0,0 +1,170 @@
+package pec
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// The deviations from the MIME structure of a transport envelope reported by
+// ValidateEnvelopeStructure, wrapped with the details of the deviation
+var (
+	ErrEnvelopeNotSigned     = errors.New("envelope is not a multipart/signed message")
+	ErrEnvelopeSignaturePart = errors.New("envelope has no valid signature part")
+	ErrEnvelopeNotMixed      = errors.New("signed content is not multipart/mixed")
+	ErrEnvelopePartCount     = errors.New("wrong number of envelope parts")
+	ErrEnvelopeBodyPart      = errors.New("invalid envelope body part")
+	ErrEnvelopeDatiCertPart  = errors.New("invalid daticert.xml part")
+	ErrEnvelopeOriginalPart  = errors.New("invalid postacert.eml part")
+)
+
+const (
+	datiCertFilename  = "daticert.xml"
+	postacertFilename = "postacert.eml"
+)
+
+// ValidateEnvelopeStructure checks that raw has the MIME structure of a
+// transport envelope: a multipart/signed message whose signed content is a
+// multipart/mixed holding, in this order, the text of the envelope (text/plain
+// or multipart/alternative), the daticert.xml (application/xml) and the
+// original message postacert.eml (message/rfc822). Each deviation is reported
+// with an error wrapping one of the ErrEnvelope errors.
+func ValidateEnvelopeStructure(raw []byte) error {
+	parts, err := envelopeParts(raw)
+	if err != nil {
+		return err
+	}
+	if len(parts) != 3 {
+		return fmt.Errorf("%w: %d parts, expected the body, %s and %s", ErrEnvelopePartCount, len(parts), datiCertFilename, postacertFilename)
+	}
+
+	if bodyType := partMediaType(parts[0].header); bodyType != "text/plain" && bodyType != "multipart/alternative" {
+		return fmt.Errorf("%w: content type %q", ErrEnvelopeBodyPart, bodyType)
+	}
+	if err := checkAttachment(parts[1].header, "application/xml", datiCertFilename); err != nil {
+		return fmt.Errorf("%w: %v", ErrEnvelopeDatiCertPart, err)
+	}
+	if err := checkAttachment(parts[2].header, "message/rfc822", postacertFilename); err != nil {
+		return fmt.Errorf("%w: %v", ErrEnvelopeOriginalPart, err)
+	}
+	return nil
+}
+
+// ExtractPostacert returns the original message carried by the transport
+// envelope raw: the message/rfc822 part named postacert.eml, byte for byte so
+// that a signature of the sender on it can be verified. The other
+// message/rfc822 parts, if any, are not the original message.
+func ExtractPostacert(raw []byte) ([]byte, error) {
+	parts, err := envelopeParts(raw)
+	if err != nil {
+		return nil, err
+	}
+	for _, part := range parts {
+		if checkAttachment(part.header, "message/rfc822", postacertFilename) == nil {
+			return part.body, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: no %s in the envelope", ErrEnvelopeOriginalPart, postacertFilename)
+}
+
+// envelopeParts returns the parts of the multipart/mixed content of the
+// signed envelope raw
+func envelopeParts(raw []byte) ([]mimePart, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrEnvelopeNotSigned, err)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/signed" || params["boundary"] == "" {
+		return nil, fmt.Errorf("%w: content type %q", ErrEnvelopeNotSigned, msg.Header.Get("Content-Type"))
+	}
+
+	parts, err := readParts(msg.Body, params["boundary"])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrEnvelopeNotSigned, err)
+	}
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("%w: %d parts in the signed message", ErrEnvelopeSignaturePart, len(parts))
+	}
+	if signatureType := partMediaType(parts[1].header); signatureType != "application/pkcs7-signature" && signatureType != "application/x-pkcs7-signature" {
+		return nil, fmt.Errorf("%w: content type %q", ErrEnvelopeSignaturePart, signatureType)
+	}
+
+	signed := parts[0]
+	mediaType, params, err = mime.ParseMediaType(signed.header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" || params["boundary"] == "" {
+		return nil, fmt.Errorf("%w: content type %q", ErrEnvelopeNotMixed, signed.header.Get("Content-Type"))
+	}
+	parts, err = readParts(bytes.NewReader(signed.body), params["boundary"])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrEnvelopeNotMixed, err)
+	}
+	return parts, nil
+}
+
+// mimePart is a part of a multipart body, read in full
+type mimePart struct {
+	header textproto.MIMEHeader
+	body   []byte
+}
+
+// readParts reads the parts of the multipart body r, delimited by boundary
+func readParts(r io.Reader, boundary string) ([]mimePart, error) {
+	reader := multipart.NewReader(r, boundary)
+	var parts []mimePart
+	for {
+		part, err := reader.NextRawPart()
+		if err == io.EOF {
+			return parts, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("malformed multipart body: %v", err)
+		}
+		body, err := io.ReadAll(part)
+		if err != nil {
+			return nil, fmt.Errorf("malformed multipart body: %v", err)
+		}
+		parts = append(parts, mimePart{header: part.Header, body: body})
+	}
+}
+
+// partMediaType returns the media type of a part, text/plain by default
+func partMediaType(header textproto.MIMEHeader) string {
+	contentType := header.Get("Content-Type")
+	if contentType == "" {
+		return "text/plain"
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return contentType
+	}
+	return mediaType
+}
+
+// checkAttachment checks the media type and the file name of a part. The
+// file name is taken from the Content-Disposition, or else from the name
+// parameter of the Content-Type.
+func checkAttachment(header textproto.MIMEHeader, mediaType, filename string) error {
+	if got := partMediaType(header); got != mediaType {
+		return fmt.Errorf("content type %q, expected %s", got, mediaType)
+	}
+	name := ""
+	if _, params, err := mime.ParseMediaType(header.Get("Content-Disposition")); err == nil {
+		name = params["filename"]
+	}
+	if name == "" {
+		if _, params, err := mime.ParseMediaType(header.Get("Content-Type")); err == nil {
+			name = params["name"]
+		}
+	}
+	if !strings.EqualFold(name, filename) {
+		return fmt.Errorf("file name %q, expected %s", name, filename)
+	}
+	return nil
+}
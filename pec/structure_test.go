@@ -0,0 +1,108 @@
+package pec
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+const (
+	testBodyPart = "Content-Type: text/plain; charset=UTF-8\r\n" +
+		"\r\n" +
+		"Messaggio di posta certificata\r\n"
+	testDatiCertPart = "Content-Type: application/xml\r\n" +
+		"Content-Disposition: attachment; filename=\"daticert.xml\"\r\n" +
+		"\r\n" +
+		"<postacert tipo=\"posta-certificata\" errore=\"nessuno\"/>\r\n"
+	testOriginalPart = "Content-Type: message/rfc822; name=\"postacert.eml\"\r\n" +
+		"\r\n" +
+		"Subject: test\r\n" +
+		"\r\n" +
+		"Hello\r\n"
+	testSignaturePart = "Content-Type: application/pkcs7-signature; name=\"smime.p7s\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"AAAA\r\n"
+)
+
+// multipartBody joins parts with boundary
+func multipartBody(boundary string, parts ...string) string {
+	var b strings.Builder
+	for _, part := range parts {
+		b.WriteString("--" + boundary + "\r\n" + part)
+	}
+	b.WriteString("--" + boundary + "--\r\n")
+	return b.String()
+}
+
+// structuredEnvelope builds a signed envelope whose multipart/mixed content holds parts
+func structuredEnvelope(parts ...string) []byte {
+	mixed := "Content-Type: multipart/mixed; boundary=\"mixed\"\r\n" +
+		"\r\n" +
+		multipartBody("mixed", parts...)
+	return []byte("From: posta-certificata@example.com\r\n" +
+		"X-Trasporto: posta-certificata\r\n" +
+		"Content-Type: multipart/signed; protocol=\"application/pkcs7-signature\"; boundary=\"signed\"\r\n" +
+		"\r\n" +
+		multipartBody("signed", mixed, testSignaturePart))
+}
+
+func TestValidateEnvelopeStructure(t *testing.T) {
+	alternative := "Content-Type: multipart/alternative; boundary=\"alternative\"\r\n" +
+		"\r\n" +
+		multipartBody("alternative", testBodyPart, "Content-Type: text/html\r\n\r\n<p>Messaggio</p>\r\n")
+
+	tests := []struct {
+		name string
+		raw  []byte
+		want error
+	}{
+		{"valid envelope", structuredEnvelope(testBodyPart, testDatiCertPart, testOriginalPart), nil},
+		{"alternative body", structuredEnvelope(alternative, testDatiCertPart, testOriginalPart), nil},
+		{"not signed", []byte("Content-Type: text/plain\r\n\r\nHello\r\n"), ErrEnvelopeNotSigned},
+		{"missing signature", []byte("Content-Type: multipart/signed; boundary=\"signed\"\r\n\r\n" +
+			multipartBody("signed", testBodyPart)), ErrEnvelopeSignaturePart},
+		{"signed content not mixed", []byte("Content-Type: multipart/signed; boundary=\"signed\"\r\n\r\n" +
+			multipartBody("signed", testBodyPart, testSignaturePart)), ErrEnvelopeNotMixed},
+		{"missing original message", structuredEnvelope(testBodyPart, testDatiCertPart), ErrEnvelopePartCount},
+		{"extra part", structuredEnvelope(testBodyPart, testDatiCertPart, testOriginalPart, testBodyPart), ErrEnvelopePartCount},
+		{"attachment as body", structuredEnvelope(testDatiCertPart, testDatiCertPart, testOriginalPart), ErrEnvelopeBodyPart},
+		{"parts out of order", structuredEnvelope(testBodyPart, testOriginalPart, testDatiCertPart), ErrEnvelopeDatiCertPart},
+		{"wrong daticert name", structuredEnvelope(testBodyPart, strings.Replace(testDatiCertPart, "daticert.xml", "postacert.xml", 1), testOriginalPart), ErrEnvelopeDatiCertPart},
+		{"original message without name", structuredEnvelope(testBodyPart, testDatiCertPart, "Content-Type: message/rfc822\r\n\r\nSubject: test\r\n\r\nHello\r\n"), ErrEnvelopeOriginalPart},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateEnvelopeStructure(tt.raw)
+			if tt.want == nil {
+				if err != nil {
+					t.Errorf("Expected a valid structure, got %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, tt.want) {
+				t.Errorf("Expected %v, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestExtractPostacert(t *testing.T) {
+	forwarded := "Content-Type: message/rfc822; name=\"inoltrato.eml\"\r\n" +
+		"\r\n" +
+		"Subject: forwarded\r\n" +
+		"\r\n" +
+		"Forwarded\r\n"
+	postacert, err := ExtractPostacert(structuredEnvelope(testBodyPart, forwarded, testDatiCertPart, testOriginalPart))
+	if err != nil {
+		t.Fatalf("ExtractPostacert failed: %v", err)
+	}
+	if want := "Subject: test\r\n\r\nHello"; string(postacert) != want {
+		t.Errorf("Expected the postacert.eml %q, got %q", want, postacert)
+	}
+
+	if _, err := ExtractPostacert(structuredEnvelope(testBodyPart, testDatiCertPart, forwarded)); !errors.Is(err, ErrEnvelopeOriginalPart) {
+		t.Errorf("Expected ErrEnvelopeOriginalPart without postacert.eml, got %v", err)
+	}
+}
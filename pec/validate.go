@@ -2,10 +2,18 @@ package pec
 
 import (
 	"bytes"
+	"crypto/x509"
+	"encoding/base64"
 	"fmt"
+	"io"
+	"mime"
 	"net/mail"
 	"os"
 	"os/exec"
+	"strings"
+	"time"
+
+	"go.mozilla.org/pkcs7"
 )
 
 // Function to verify the S/MIME signature using OpenSSL
@@ -45,3 +53,239 @@ func Verify(filename string) error {
 	}
 	return nil
 }
+
+// VerifyReader parses and verifies a PEC message read from r, without
+// writing it to disk
+func VerifyReader(r io.Reader) error {
+	emlData, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("Error reading message: %v", err)
+	}
+
+	result, err := verifyDetailed(emlData)
+	if err != nil {
+		return err
+	}
+	if !result.SignatureValid {
+		return fmt.Errorf("Verification failed: %s", result.SignatureError)
+	}
+	return nil
+}
+
+// VerificationResult reports the outcome of each check performed on a PEC message
+type VerificationResult struct {
+	SignerSubject string    `json:"signer_subject"`
+	SignerIssuer  string    `json:"signer_issuer"`
+	NotBefore     time.Time `json:"not_before"`
+	NotAfter      time.Time `json:"not_after"`
+	SigningTime   time.Time `json:"signing_time"`
+	DatiCert      *DatiCert `json:"dati_cert"`
+	PecType       PecType   `json:"pec_type"`
+
+	// SignatureValid is set when the S/MIME signature matches the signed content
+	SignatureValid bool   `json:"signature_valid"`
+	SignatureError string `json:"signature_error,omitempty"`
+	// ChainValid is set when the signer certificate chains to a trusted root
+	ChainValid bool   `json:"chain_valid"`
+	ChainError string `json:"chain_error,omitempty"`
+	// TimeValid is set when the message was signed within the certificate validity window
+	TimeValid bool   `json:"time_valid"`
+	TimeError string `json:"time_error,omitempty"`
+}
+
+// Valid reports whether every check passed
+func (r *VerificationResult) Valid() bool {
+	return r.SignatureValid && r.ChainValid && r.TimeValid
+}
+
+// VerifyDetailed parses and verifies the PEC message in filename. Failed
+// checks are reported in the result; an error is returned only when the
+// message cannot be read or is not a PEC.
+func VerifyDetailed(filename string) (*VerificationResult, error) {
+	emlData := ReadEmail(filename)
+	if emlData == nil {
+		return nil, fmt.Errorf("Error reading file %s", filename)
+	}
+	return verifyDetailed(emlData)
+}
+
+// verifyDetailed parses and verifies a PEC message held in memory
+func verifyDetailed(emlData []byte) (*VerificationResult, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(emlData))
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing email %s", err)
+	}
+	signingTime, _ := mail.ParseDate(msg.Header.Get("Date"))
+	if _, _, err := signedMediaType(msg.Header.Get("Content-Type")); err != nil {
+		return nil, err
+	}
+
+	pecMail, datiCert, err := ParsePec(msg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse email: %v", err)
+	}
+
+	result := &VerificationResult{
+		SigningTime: signingTime,
+		DatiCert:    datiCert,
+		PecType:     pecMail.PecType,
+	}
+
+	p7, content, err := signedData(emlData)
+	if err != nil {
+		result.SignatureError = err.Error()
+		return result, nil
+	}
+
+	cert := p7.GetOnlySigner()
+	if cert == nil {
+		result.SignatureError = "signature has no single signer"
+		return result, nil
+	}
+	result.SignerSubject = cert.Subject.String()
+	result.SignerIssuer = cert.Issuer.String()
+	result.NotBefore = cert.NotBefore
+	result.NotAfter = cert.NotAfter
+
+	if content == nil {
+		// The signed data encloses the content it signs
+		if err := p7.Verify(); err != nil {
+			result.SignatureError = err.Error()
+		}
+	} else {
+		// The signed part is canonicalized to CRLF, but stored messages often
+		// use bare LF line endings
+		p7.Content = toCRLF(content)
+		if err := p7.Verify(); err != nil {
+			p7.Content = content
+			if rawErr := p7.Verify(); rawErr != nil {
+				result.SignatureError = err.Error()
+			}
+		}
+	}
+	result.SignatureValid = result.SignatureError == ""
+
+	checkTime := signingTime
+	if checkTime.IsZero() {
+		checkTime = time.Now()
+	}
+	if checkTime.Before(cert.NotBefore) || checkTime.After(cert.NotAfter) {
+		result.TimeError = fmt.Sprintf("signed at %s, outside of certificate validity %s to %s",
+			checkTime.Format(time.RFC3339), cert.NotBefore.Format(time.RFC3339), cert.NotAfter.Format(time.RFC3339))
+	}
+	result.TimeValid = result.TimeError == ""
+
+	intermediates := x509.NewCertPool()
+	for _, c := range p7.Certificates {
+		if !c.Equal(cert) {
+			intermediates.AddCert(c)
+		}
+	}
+	_, err = cert.Verify(x509.VerifyOptions{
+		Intermediates: intermediates,
+		CurrentTime:   checkTime,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		result.ChainError = err.Error()
+	}
+	result.ChainValid = result.ChainError == ""
+
+	return result, nil
+}
+
+// signedMediaType returns the media type of a signed S/MIME Content-Type,
+// multipart/signed with its boundary or application/pkcs7-mime
+func signedMediaType(contentType string) (string, string, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to parse content type: %v", err)
+	}
+	if isOpaqueSigned(mediaType) {
+		return mediaType, "", nil
+	}
+	if mediaType != "multipart/signed" || params["boundary"] == "" {
+		return "", "", fmt.Errorf("not a signed S/MIME message")
+	}
+	return mediaType, params["boundary"], nil
+}
+
+// signedData returns the signed data of the S/MIME message emlData. The
+// signed part of a multipart/signed message is returned with it, byte for
+// byte; an application/pkcs7-mime message encloses its content in the
+// signed data, and no part is returned.
+func signedData(emlData []byte) (*pkcs7.PKCS7, []byte, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(emlData))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse message: %v", err)
+	}
+	mediaType, boundary, err := signedMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, nil, err
+	}
+	if isOpaqueSigned(mediaType) {
+		p7, err := opaqueSignedData(msg)
+		return p7, nil, err
+	}
+
+	content, signature, err := splitSigned(emlData, boundary)
+	if err != nil {
+		return nil, nil, err
+	}
+	p7, err := pkcs7.Parse(signature)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse signature: %v", err)
+	}
+	return p7, content, nil
+}
+
+// splitSigned returns the raw signed part and the decoded signature of a
+// multipart/signed message. The signed part is returned byte for byte, as
+// re-encoding it would invalidate the signature.
+func splitSigned(emlData []byte, boundary string) ([]byte, []byte, error) {
+	delimiter := []byte("--" + boundary)
+	parts := bytes.Split(emlData, delimiter)
+	if len(parts) < 4 {
+		return nil, nil, fmt.Errorf("malformed multipart/signed message")
+	}
+
+	// parts[0] is the preamble, parts[1] the signed content and parts[2] the signature
+	content := trimPartDelimiters(parts[1])
+
+	sigPart, err := mail.ReadMessage(bytes.NewReader(bytes.TrimLeft(parts[2], "\r\n")))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read signature part: %v", err)
+	}
+	sigData, err := io.ReadAll(sigPart.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read signature part: %v", err)
+	}
+	if strings.EqualFold(sigPart.Header.Get("Content-Transfer-Encoding"), "base64") {
+		sigData, err = base64.StdEncoding.DecodeString(string(bytes.Join(bytes.Fields(sigData), nil)))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to decode signature: %v", err)
+		}
+	}
+	return content, sigData, nil
+}
+
+// trimPartDelimiters removes the line break following the boundary line and
+// the one preceding the next boundary, which belong to the delimiters
+func trimPartDelimiters(part []byte) []byte {
+	if bytes.HasPrefix(part, []byte("\r\n")) {
+		part = part[2:]
+	} else if bytes.HasPrefix(part, []byte("\n")) {
+		part = part[1:]
+	}
+	if bytes.HasSuffix(part, []byte("\r\n")) {
+		part = part[:len(part)-2]
+	} else if bytes.HasSuffix(part, []byte("\n")) {
+		part = part[:len(part)-1]
+	}
+	return part
+}
+
+// toCRLF converts bare LF line endings to CRLF
+func toCRLF(data []byte) []byte {
+	return normalizeLineEndings(bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n")))
+}
@@ -0,0 +1,368 @@
+package pec
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mozilla.org/pkcs7"
+)
+
+// newTestCertificate creates a self-signed test certificate valid over
+// notBefore..notAfter, with its key
+func newTestCertificate(t *testing.T, notBefore, notAfter time.Time) (*x509.Certificate, *rsa.PrivateKey) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "posta-certificata@fakepec.it", Organization: []string{"Fake PEC"}},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse certificate: %v", err)
+	}
+	return cert, key
+}
+
+// resignFixture replaces the signature of a fixture with one made by a
+// self-signed test certificate, valid over notBefore..notAfter
+func resignFixture(t *testing.T, filename string, notBefore, notAfter time.Time) []byte {
+	t.Helper()
+	cert, key := newTestCertificate(t, notBefore, notAfter)
+
+	emlData := ReadEmail(filename)
+	if emlData == nil {
+		t.Fatalf("Error reading file %s", filename)
+	}
+	header := emlData[:bytes.Index(emlData, []byte("\n\n"))]
+	boundary := "----76F9CFD0D4B5B34499C167119D5A1AEC"
+	if !bytes.Contains(header, []byte(boundary)) {
+		t.Fatalf("Unexpected boundary in %s", filename)
+	}
+
+	// The original signature is redacted, so only the signed part is kept
+	content := trimPartDelimiters(bytes.Split(emlData, []byte("--"+boundary))[1])
+	signedData, err := pkcs7.NewSignedData(toCRLF(content))
+	if err != nil {
+		t.Fatalf("Failed to create signed data: %v", err)
+	}
+	if err := signedData.AddSigner(cert, key, pkcs7.SignerInfoConfig{}); err != nil {
+		t.Fatalf("Failed to add signer: %v", err)
+	}
+	signedData.Detach()
+	signature, err := signedData.Finish()
+	if err != nil {
+		t.Fatalf("Failed to sign: %v", err)
+	}
+
+	var buf bytes.Buffer
+	buf.Write(header)
+	buf.WriteString("\n\nThis is an S/MIME signed message\n\n--" + boundary + "\n")
+	buf.Write(content)
+	buf.WriteString("\n--" + boundary + "\n")
+	buf.WriteString("Content-Type: application/x-pkcs7-signature; name=\"smime.p7s\"\n")
+	buf.WriteString("Content-Transfer-Encoding: base64\n\n")
+	buf.WriteString(base64.StdEncoding.EncodeToString(signature))
+	buf.WriteString("\n\n--" + boundary + "--\n")
+	return buf.Bytes()
+}
+
+// opaqueFixture signs the signed part of a fixture into an
+// application/pkcs7-mime message, as sent with receipt_signing_mode opaque
+func opaqueFixture(t *testing.T, filename string) []byte {
+	t.Helper()
+	cert, key := newTestCertificate(t, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2034, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	emlData := ReadEmail(filename)
+	if emlData == nil {
+		t.Fatalf("Error reading file %s", filename)
+	}
+	end := bytes.Index(emlData, []byte("\n\n"))
+	boundary := "----76F9CFD0D4B5B34499C167119D5A1AEC"
+	content := trimPartDelimiters(bytes.Split(emlData, []byte("--"+boundary))[1])
+	signedData, err := pkcs7.NewSignedData(toCRLF(content))
+	if err != nil {
+		t.Fatalf("Failed to create signed data: %v", err)
+	}
+	if err := signedData.AddSigner(cert, key, pkcs7.SignerInfoConfig{}); err != nil {
+		t.Fatalf("Failed to add signer: %v", err)
+	}
+	signature, err := signedData.Finish()
+	if err != nil {
+		t.Fatalf("Failed to sign: %v", err)
+	}
+
+	var buf bytes.Buffer
+	for _, line := range strings.Split(string(emlData[:end]), "\n") {
+		if strings.HasPrefix(line, "Content-Type:") {
+			line = "Content-Type: application/pkcs7-mime; smime-type=signed-data; name=\"smime.p7m\"\n" +
+				"Content-Transfer-Encoding: base64"
+		}
+		buf.WriteString(line + "\n")
+	}
+	buf.WriteString("\n" + base64.StdEncoding.EncodeToString(signature) + "\n")
+	return buf.Bytes()
+}
+
+// writeTemp writes data to a file in a temporary directory
+func writeTemp(t *testing.T, data []byte) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "message.eml")
+	if err := os.WriteFile(filename, data, 0600); err != nil {
+		t.Fatalf("Failed to write %s: %v", filename, err)
+	}
+	return filename
+}
+
+func TestVerifyDetailedFixtures(t *testing.T) {
+	tests := []struct {
+		filename string
+		pecType  PecType
+		tipo     string
+	}{
+		{"test/resources/accettazione.eml", AcceptanceReceipt, "accettazione"},
+		{"test/resources/consegna.eml", DeliveryErrorReceipt, "errore-consegna"},
+		{"test/resources/non-accettazione.eml", NonAcceptanceReceipt, "non-accettazione"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.filename, func(t *testing.T) {
+			result, err := VerifyDetailed(tt.filename)
+			if err != nil {
+				t.Fatalf("VerifyDetailed failed: %v", err)
+			}
+			if result.PecType != tt.pecType {
+				t.Errorf("expected PecType %d, got %d", tt.pecType, result.PecType)
+			}
+			if result.DatiCert == nil || result.DatiCert.Tipo != tt.tipo {
+				t.Fatalf("expected DatiCert of type %s, got %+v", tt.tipo, result.DatiCert)
+			}
+			if result.DatiCert.Intestazione.Mittente != "sender@fakepec.it" {
+				t.Errorf("expected sender@fakepec.it got %s", result.DatiCert.Intestazione.Mittente)
+			}
+			// The signatures of the fixtures are redacted
+			if result.SignatureValid || result.SignatureError == "" {
+				t.Errorf("expected the redacted signature to be reported as invalid")
+			}
+			if result.Valid() {
+				t.Errorf("expected the result not to be valid")
+			}
+		})
+	}
+}
+
+func TestVerifyDetailedSigned(t *testing.T) {
+	notBefore := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	notAfter := time.Date(2034, 1, 1, 0, 0, 0, 0, time.UTC)
+	signed := resignFixture(t, "test/resources/accettazione.eml", notBefore, notAfter)
+
+	result, err := VerifyDetailed(writeTemp(t, signed))
+	if err != nil {
+		t.Fatalf("VerifyDetailed failed: %v", err)
+	}
+	if !result.SignatureValid {
+		t.Errorf("expected a valid signature, got %s", result.SignatureError)
+	}
+	if !result.TimeValid {
+		t.Errorf("expected the signing time to be valid, got %s", result.TimeError)
+	}
+	if result.ChainValid {
+		t.Errorf("expected a self-signed certificate not to chain to a trusted root")
+	}
+	if !strings.Contains(result.SignerSubject, "CN=posta-certificata@fakepec.it") {
+		t.Errorf("unexpected signer subject %s", result.SignerSubject)
+	}
+	if !result.NotBefore.Equal(notBefore) || !result.NotAfter.Equal(notAfter) {
+		t.Errorf("unexpected validity window %s - %s", result.NotBefore, result.NotAfter)
+	}
+	if result.PecType != AcceptanceReceipt || result.DatiCert.Tipo != "accettazione" {
+		t.Errorf("unexpected PEC type %d / %s", result.PecType, result.DatiCert.Tipo)
+	}
+
+	tampered := bytes.Replace(signed, []byte("Test PEC\""), []byte("Test XYZ\""), 1)
+	result, err = VerifyDetailed(writeTemp(t, tampered))
+	if err != nil {
+		t.Fatalf("VerifyDetailed failed: %v", err)
+	}
+	if result.SignatureValid {
+		t.Errorf("expected a tampered message to fail the signature check")
+	}
+}
+
+func TestVerifyDetailedDatedBeforeCertificate(t *testing.T) {
+	// The fixture is dated 15/11/2024, before the certificate was issued
+	notBefore := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	notAfter := time.Now().AddDate(10, 0, 0)
+	signed := resignFixture(t, "test/resources/accettazione.eml", notBefore, notAfter)
+
+	result, err := VerifyDetailed(writeTemp(t, signed))
+	if err != nil {
+		t.Fatalf("VerifyDetailed failed: %v", err)
+	}
+	if !result.SignatureValid {
+		t.Errorf("expected a valid signature, got %s", result.SignatureError)
+	}
+	if result.TimeValid {
+		t.Errorf("expected a message dated outside of the certificate validity to fail the time check")
+	}
+}
+
+func TestVerifyReader(t *testing.T) {
+	notBefore := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	notAfter := time.Date(2034, 1, 1, 0, 0, 0, 0, time.UTC)
+	signed := resignFixture(t, "test/resources/accettazione.eml", notBefore, notAfter)
+
+	if err := VerifyReader(bytes.NewReader(signed)); err != nil {
+		t.Errorf("expected the message to verify, got %v", err)
+	}
+
+	tampered := bytes.Replace(signed, []byte("Test PEC\""), []byte("Test XYZ\""), 1)
+	if err := VerifyReader(bytes.NewReader(tampered)); err == nil {
+		t.Errorf("expected a tampered message to fail verification")
+	}
+
+	if err := VerifyReader(strings.NewReader("Subject: not a pec\n\nHello\n")); err == nil {
+		t.Errorf("expected a plain message to fail verification")
+	}
+}
+
+func TestParsePecOpaque(t *testing.T) {
+	opaque := opaqueFixture(t, "test/resources/accettazione.eml")
+
+	pecMail, datiCert, err := ParsePecReader(bytes.NewReader(opaque))
+	if err != nil {
+		t.Fatalf("failed to parse email: %v", err)
+	}
+	if pecMail.PecType != AcceptanceReceipt || pecMail.MissingDatiCert {
+		t.Errorf("expected an AcceptanceReceipt with its daticert, got %+v", pecMail)
+	}
+	if datiCert.Tipo != TipoAccettazione || datiCert.Intestazione.Mittente != "sender@fakepec.it" {
+		t.Errorf("unexpected daticert %s from %s", datiCert.Tipo, datiCert.Intestazione.Mittente)
+	}
+
+	result, err := verifyDetailed(opaque)
+	if err != nil {
+		t.Fatalf("verifyDetailed failed: %v", err)
+	}
+	if !result.SignatureValid || result.PecType != AcceptanceReceipt {
+		t.Errorf("expected a valid acceptance receipt, got %+v", result)
+	}
+	if err := VerifyReader(bytes.NewReader(opaque)); err != nil {
+		t.Errorf("expected the message to verify, got %v", err)
+	}
+	if err := VerifySignerIdentity(opaque, IdentityProvider); err != nil {
+		t.Errorf("expected the signer to be the provider, got %v", err)
+	}
+
+	// Signed data that does not parse is reported, not taken for an empty PEC
+	corrupted := append(opaque[:bytes.Index(opaque, []byte("\n\n"))+2], []byte("bm90IHNpZ25lZA==\n")...)
+	if _, _, err := ParsePecReader(bytes.NewReader(corrupted)); err == nil {
+		t.Errorf("expected an error for corrupted signed data")
+	}
+}
+
+func TestParsePecReader(t *testing.T) {
+	emlData := ReadEmail("test/resources/accettazione.eml")
+	if emlData == nil {
+		t.Fatalf("Error reading file")
+	}
+
+	pecMail, datiCert, err := ParsePecReader(bytes.NewReader(emlData))
+	if err != nil {
+		t.Fatalf("failed to parse email: %v", err)
+	}
+	if pecMail.PecType != AcceptanceReceipt {
+		t.Errorf("expected AcceptanceReceipt, got %v", pecMail.PecType)
+	}
+	if datiCert.Intestazione.Mittente != "sender@fakepec.it" {
+		t.Errorf("expected sender@fakepec.it got %s", datiCert.Intestazione.Mittente)
+	}
+}
+
+func TestParsePecNonAcceptance(t *testing.T) {
+	emlData := ReadEmail("test/resources/non-accettazione.eml")
+	if emlData == nil {
+		t.Fatalf("Error reading file")
+	}
+
+	pecMail, datiCert, err := ParsePecReader(bytes.NewReader(emlData))
+	if err != nil {
+		t.Fatalf("failed to parse email: %v", err)
+	}
+	if pecMail.PecType != NonAcceptanceReceipt {
+		t.Errorf("expected NonAcceptanceReceipt, got %v", pecMail.PecType)
+	}
+	if datiCert.Errore != ErroreAltro || datiCert.Dati.ErroreEsteso != "messaggio privo di destinatari validi" {
+		t.Errorf("unexpected errore %s / %s", datiCert.Errore, datiCert.Dati.ErroreEsteso)
+	}
+
+	// An acceptance header over a non-accettazione daticert is a mismatch
+	mislabeled := bytes.Replace(emlData, []byte("X-Ricevuta: non-accettazione"), []byte("X-Ricevuta: accettazione"), 1)
+	if _, _, err := ParsePecReader(bytes.NewReader(mislabeled)); err == nil {
+		t.Errorf("expected a mismatch between X-Ricevuta and the daticert type")
+	}
+
+	// A non-acceptance header over a daticert of another type is a mismatch
+	retyped := withDatiCertTipo(t, emlData, TipoAccettazione)
+	if _, _, err := ParsePecReader(bytes.NewReader(retyped)); err == nil {
+		t.Errorf("expected a mismatch between non-accettazione and a daticert of type accettazione")
+	}
+}
+
+func TestParsePecTakingCharge(t *testing.T) {
+	emlData := ReadEmail("test/resources/non-accettazione.eml")
+	if emlData == nil {
+		t.Fatalf("Error reading file")
+	}
+	takingCharge := bytes.Replace(emlData, []byte("X-Ricevuta: non-accettazione"), []byte("X-Ricevuta: presa-in-carico"), 1)
+
+	pecMail, _, err := ParsePecReader(bytes.NewReader(withDatiCertTipo(t, takingCharge, TipoPresaInCarico)))
+	if err != nil {
+		t.Fatalf("failed to parse email: %v", err)
+	}
+	if pecMail.PecType != TakingChargeReceipt {
+		t.Errorf("expected TakingChargeReceipt, got %v", pecMail.PecType)
+	}
+
+	// A presa-in-carico header over a daticert of another type is a mismatch
+	if _, _, err := ParsePecReader(bytes.NewReader(takingCharge)); err == nil {
+		t.Errorf("expected a mismatch between presa-in-carico and a daticert of type non-accettazione")
+	}
+}
+
+// withDatiCertTipo returns the non-accettazione fixture emlData with the
+// type of its daticert.xml replaced by tipo
+func withDatiCertTipo(t *testing.T, emlData []byte, tipo string) []byte {
+	t.Helper()
+	start := bytes.Index(emlData, []byte("PD94bWwg"))
+	if start < 0 {
+		t.Fatalf("no daticert.xml in the fixture")
+	}
+	end := start + bytes.IndexByte(emlData[start:], '\n')
+	encoded := strings.TrimSpace(string(emlData[start:end]))
+	xmlData, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		t.Fatalf("failed to decode daticert.xml: %v", err)
+	}
+	xmlData = bytes.Replace(xmlData, []byte(`tipo="non-accettazione"`), []byte(`tipo="`+tipo+`"`), 1)
+	return bytes.Replace(emlData, []byte(encoded), []byte(base64.StdEncoding.EncodeToString(xmlData)), 1)
+}